@@ -0,0 +1,465 @@
+// Package client is a Go client for the dcrspy HTTP API and event stream.
+//
+// A Client is created with the base URL of the dcrspy API server (the
+// apilisten address) and, in multi-tenant mode, the tenant's API key:
+//
+//	c := client.New("http://127.0.0.1:9190", apiKey)
+//	status, err := c.Status()
+//
+// Events may be polled with Events, or streamed with Subscribe.  For a server
+// requiring mutual TLS, UseTLS sets the client certificate.
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/websocket"
+)
+
+// DefaultTimeout is the timeout of the HTTP client created by New.
+const DefaultTimeout = 30 * time.Second
+
+// APIError is returned when dcrspy responds with an error status.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("dcrspy: %d %s: %s", e.StatusCode,
+		http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client is a dcrspy API client.  It is safe for concurrent use.
+type Client struct {
+	baseURL   string
+	apiKey    string
+	tlsConfig *tls.Config
+	// HTTPClient is used for all requests except the event stream.
+	HTTPClient *http.Client
+}
+
+// New creates a Client for the API server at baseURL (e.g.
+// "http://127.0.0.1:9190").  apiKey may be empty if multi-tenant mode is not
+// enabled.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// UseTLS sets the TLS configuration of the HTTPS requests and the event
+// stream, e.g. with the client certificate for a server requiring mutual TLS,
+// or the root CA of a self-signed server certificate.  It replaces the
+// transport of HTTPClient, and should be called before the first request.
+func (c *Client) UseTLS(config *tls.Config) {
+	c.tlsConfig = config
+	c.HTTPClient.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}
+}
+
+// header returns the request headers, with the API key if there is one.
+func (c *Client) header() http.Header {
+	h := make(http.Header)
+	if c.apiKey != "" {
+		h.Set("X-API-Key", c.apiKey)
+	}
+	return h
+}
+
+// do sends a request with the JSON encoding of in as the body, if not nil,
+// and decodes the JSON response into out, if not nil.
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header = c.header()
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &APIError{resp.StatusCode, strings.TrimSpace(string(msg))}
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Status returns dcrspy's status and availability.
+func (c *Client) Status() (*Status, error) {
+	s := new(Status)
+	if err := c.do("GET", "/status", nil, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RollingStats returns the rolling statistics of the given field, or of all
+// fields if field is empty.
+func (c *Client) RollingStats(field string) ([]*RollingStat, error) {
+	path := "/stats"
+	if field != "" {
+		path += "?" + url.Values{"field": {field}}.Encode()
+	}
+	var stats []*RollingStat
+	if err := c.do("GET", path, nil, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// TicketPool returns the latest sample of the live ticket pool's composition.
+func (c *Client) TicketPool() (*TicketPool, error) {
+	p := new(TicketPool)
+	if err := c.do("GET", "/ticketpool", nil, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Tickets returns the vote estimates for the wallet's tickets, soonest to
+// expire first.  It is not available to tenants.
+func (c *Client) Tickets() ([]*TicketEstimate, error) {
+	var tickets []*TicketEstimate
+	if err := c.do("GET", "/tickets", nil, &tickets); err != nil {
+		return nil, err
+	}
+	return tickets, nil
+}
+
+// VoteExpectations returns the report of the checks of the voting wallet's
+// votes against its expectations.  It is not available to tenants.
+func (c *Client) VoteExpectations() (*VoteExpectReport, error) {
+	r := new(VoteExpectReport)
+	if err := c.do("GET", "/voteexpect", nil, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// AddressHistory returns a page of the address's history, newest first,
+// skipping offset entries.  A limit of 0 uses the server's default.
+func (c *Client) AddressHistory(addr string, offset, limit int) (*AddressHistory, error) {
+	q := url.Values{}
+	if offset > 0 {
+		q.Set("offset", strconv.Itoa(offset))
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	path := "/api/address/" + addr + "/history"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	h := new(AddressHistory)
+	if err := c.do("GET", path, nil, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// XpubAccounts returns the summaries of the accounts watched by their extended
+// public keys.  It is not available to tenants.
+func (c *Client) XpubAccounts() ([]*XpubAccount, error) {
+	var accounts []*XpubAccount
+	if err := c.do("GET", "/xpub", nil, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// DecodeTx decodes the hex-encoded raw transaction.
+func (c *Client) DecodeTx(rawHex string) (*DecodedTx, error) {
+	tx := new(DecodedTx)
+	if err := c.do("POST", "/api/tx/decode", rawHex, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// DecodeTxID decodes the transaction with the txid.
+func (c *Client) DecodeTxID(txid string) (*DecodedTx, error) {
+	tx := new(DecodedTx)
+	path := "/api/tx/decode?" + url.Values{"txid": {txid}}.Encode()
+	if err := c.do("GET", path, nil, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Usage returns the usage report.  A tenant gets only its own usage.
+func (c *Client) Usage() (*UsageReport, error) {
+	r := new(UsageReport)
+	if err := c.do("GET", "/usage", nil, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// AddressStats returns the statistics of the watched addresses, most recently
+// active first.  A tenant gets only its own addresses.
+func (c *Client) AddressStats() ([]*AddressStats, error) {
+	var stats []*AddressStats
+	if err := c.do("GET", "/addrstats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// WatchedAddresses returns the watched addresses.
+func (c *Client) WatchedAddresses() ([]WatchedAddress, error) {
+	var addrs []WatchedAddress
+	if err := c.do("GET", "/watch", nil, &addrs); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// Watch registers a watched address, or updates its action.
+func (c *Client) Watch(req *WatchRequest) error {
+	return c.do("POST", "/watch", req, nil)
+}
+
+// Unwatch stops watching an address.
+func (c *Client) Unwatch(req *WatchRequest) error {
+	return c.do("DELETE", "/watch", req, nil)
+}
+
+// Webhooks returns the webhook subscriptions.
+func (c *Client) Webhooks() ([]*Webhook, error) {
+	var subs []*Webhook
+	if err := c.do("GET", "/webhooks", nil, &subs); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// Webhook returns the webhook subscription with the given ID.
+func (c *Client) Webhook(id string) (*Webhook, error) {
+	s := new(Webhook)
+	if err := c.do("GET", "/webhooks/"+id, nil, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CreateWebhook creates a webhook subscription, returning it with its ID.
+func (c *Client) CreateWebhook(s *Webhook) (*Webhook, error) {
+	created := new(Webhook)
+	if err := c.do("POST", "/webhooks", s, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// UpdateWebhook replaces the webhook subscription with ID s.ID.
+func (c *Client) UpdateWebhook(s *Webhook) (*Webhook, error) {
+	updated := new(Webhook)
+	err := c.do("PUT", "/webhooks/"+s.ID, s, updated)
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteWebhook deletes the webhook subscription with the given ID.
+func (c *Client) DeleteWebhook(id string) error {
+	return c.do("DELETE", "/webhooks/"+id, nil, nil)
+}
+
+// AckWebhook acknowledges the events up to and including seq for a webhook
+// subscription in ack mode.
+func (c *Client) AckWebhook(id string, seq uint64) error {
+	req := struct {
+		Seq uint64 `json:"seq"`
+	}{seq}
+	return c.do("POST", "/webhooks/"+id+"/ack", req, nil)
+}
+
+// MuteState returns whether the watched address notifications of the caller
+// are muted, and until when.
+func (c *Client) MuteState() (*MuteState, error) {
+	state := new(MuteState)
+	if err := c.do("GET", "/api/mute", nil, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Mute mutes the watched address notifications of the caller for the duration,
+// which requires the operator role.
+func (c *Client) Mute(d time.Duration) (*MuteState, error) {
+	req := struct {
+		Duration string `json:"duration"`
+	}{d.String()}
+	state := new(MuteState)
+	if err := c.do("POST", "/api/mute", req, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Unmute unmutes the watched address notifications of the caller.
+func (c *Client) Unmute() error {
+	return c.do("DELETE", "/api/mute", nil, nil)
+}
+
+// Events returns up to limit events with sequence numbers greater than since
+// and matching the filter expression (if not empty), oldest first.  A limit of
+// 0 uses the server's default.
+func (c *Client) Events(since uint64, filter string, limit int) ([]*Event,
+	error) {
+	q := url.Values{}
+	q.Set("since", strconv.FormatUint(since, 10))
+	if filter != "" {
+		q.Set("filter", filter)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var events []*Event
+	if err := c.do("GET", "/events?"+q.Encode(), nil, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Audit returns the audit events of control actions with sequence numbers
+// greater than since, by the actor if not empty, up to limit events (or the
+// server's default if limit is 0).
+func (c *Client) Audit(since uint64, actor string, limit int) ([]*Event, error) {
+	q := url.Values{}
+	q.Set("since", strconv.FormatUint(since, 10))
+	if actor != "" {
+		q.Set("actor", actor)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var events []*Event
+	if err := c.do("GET", "/audit?"+q.Encode(), nil, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// GraphQL executes a GraphQL query with optional variables, decoding the data
+// of the response into result.  If the response has errors, they are returned
+// as GraphQLErrors.
+func (c *Client) GraphQL(query string, variables map[string]interface{},
+	result interface{}) error {
+	req := struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables,omitempty"`
+	}{query, variables}
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors GraphQLErrors   `json:"errors"`
+	}
+	if err := c.do("POST", "/graphql", req, &resp); err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		return resp.Errors
+	}
+	if result == nil || len(resp.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Data, result)
+}
+
+// EventStream is a stream of events over a WebSocket.
+type EventStream struct {
+	conn    *websocket.Conn
+	lastSeq uint64
+}
+
+// Subscribe opens a stream of the events with sequence numbers greater than
+// since and matching the filter expression (if not empty), which first
+// replays recorded events, then delivers new events as they occur.  After an
+// error, a new stream may be opened with LastSeq to resume without missing
+// events.
+func (c *Client) Subscribe(since uint64, filter string) (*EventStream, error) {
+	u, err := url.Parse(c.baseURL + "/events/ws")
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	q := url.Values{}
+	q.Set("since", strconv.FormatUint(since, 10))
+	if filter != "" {
+		q.Set("filter", filter)
+	}
+	u.RawQuery = q.Encode()
+
+	dialer := websocket.DefaultDialer
+	if c.tlsConfig != nil {
+		dialer = &websocket.Dialer{TLSClientConfig: c.tlsConfig}
+	}
+	conn, resp, err := dialer.Dial(u.String(), c.header())
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return nil, &APIError{resp.StatusCode, err.Error()}
+		}
+		return nil, err
+	}
+	return &EventStream{conn: conn, lastSeq: since}, nil
+}
+
+// Next blocks until the next event is received.
+func (s *EventStream) Next() (*Event, error) {
+	e := new(Event)
+	if err := s.conn.ReadJSON(e); err != nil {
+		return nil, err
+	}
+	s.lastSeq = e.Seq
+	return e, nil
+}
+
+// LastSeq returns the sequence number of the last event received, or the
+// since argument of Subscribe if none has been received.
+func (s *EventStream) LastSeq() uint64 {
+	return s.lastSeq
+}
+
+// Close closes the stream.
+func (s *EventStream) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,397 @@
+// types.go defines the types of the dcrspy API requests and responses.
+
+package client
+
+// Event types and actions.
+const (
+	EventTypeWatchedAddr = "watchedaddr"
+	EventTypeColdAudit   = "coldaudit"
+	EventTypeChain       = "chain"
+	EventTypeSpy         = "spy"
+	EventTypeTicket      = "ticket"
+	EventTypePrice       = "price"
+	EventTypeAudit       = "audit"
+
+	EventActionMined         = "mined"
+	EventActionMempool       = "mempool"
+	EventActionColdSpent     = "spent"
+	EventActionColdBalance   = "balance"
+	EventActionNewBlock      = "block"
+	EventActionReorg         = "reorg"
+	EventActionPoWRetarget   = "powretarget"
+	EventActionStakeRetarget = "stakeretarget"
+	EventActionAgendaStatus  = "agendastatus"
+	EventActionFewVotes      = "fewvotes"
+	EventActionInsufficient  = "insufficientvotes"
+	EventActionSlowBlock     = "slowblock"
+	EventActionChainHalted   = "halted"
+	EventActionChainResumed  = "resumed"
+	EventActionStarted       = "started"
+	EventActionTicketExpiry  = "nearexpiry"
+	EventActionVoteDeviation = "votedeviation"
+	EventActionPriceCross    = "cross"
+	EventActionPriceMove     = "move"
+)
+
+// TxAction is the notification policy of a watched address.  The flags select
+// the watched address events for which dcrspy sends notifications, and the
+// bits from TxActionConfsShift the number of confirmations of a mined
+// transaction before it is notified.
+type TxAction int32
+
+// Valid values for TxAction.
+const (
+	TxMined TxAction = 1 << iota
+	TxInserted
+	// TxFollowUp notifies a mined transaction that was notified in mempool
+	// with a compact follow-up.
+	TxFollowUp
+)
+
+// TxActionConfsShift is the shift of the number of confirmations in a
+// TxAction.
+const TxActionConfsShift = 8
+
+// WithConfirmations returns the policy notifying mined transactions once they
+// have confs confirmations.
+func (a TxAction) WithConfirmations(confs int) TxAction {
+	return a&(TxMined|TxInserted|TxFollowUp) | TxMined |
+		TxAction(confs)<<TxActionConfsShift
+}
+
+// Event is an event recorded by dcrspy, such as a transaction paying to a
+// watched address.  Seq increases monotonically.  Fiat is the value of Amount
+// in the server's fiat currency when the event occurred, if known.
+type Event struct {
+	Seq         uint64  `json:"seq"`
+	Time        int64   `json:"time"`
+	Type        string  `json:"type"`
+	Action      string  `json:"action,omitempty"`
+	Height      int64   `json:"height,omitempty"`
+	Address     string  `json:"address,omitempty"`
+	Amount      float64 `json:"amount,omitempty"`
+	Fiat        float64 `json:"fiat,omitempty"`
+	TxID        string  `json:"txid,omitempty"`
+	Vout        int     `json:"vout"`
+	ScriptClass string  `json:"scriptclass,omitempty"`
+	Message     string  `json:"message,omitempty"`
+	Actor       string  `json:"actor,omitempty"`
+	Tenant      string  `json:"tenant,omitempty"`
+}
+
+// WatchedAddress is a watched address and its notification policy.  Policy is
+// the name of Action, e.g. "both" or "mined:6".
+type WatchedAddress struct {
+	Address string   `json:"address"`
+	Action  TxAction `json:"action"`
+	Policy  string   `json:"policy"`
+}
+
+// WatchRequest registers or removes a watched address.  In public mode,
+// Message ("dcrspy watch <address> <unix time>" to register, or
+// "dcrspy unwatch <address> <unix time>" to remove) and its Signature by the
+// address's key are required.
+type WatchRequest struct {
+	Address   string   `json:"address"`
+	Action    TxAction `json:"action"`
+	Message   string   `json:"message,omitempty"`
+	Signature string   `json:"signature,omitempty"`
+}
+
+// Webhook is a webhook subscription.  ID, Tenant, AckedSeq and Created are
+// set by dcrspy.  Secret is never returned.  Config is set for the webhooks of
+// dcrspy's config file, which cannot be changed or deleted.
+type Webhook struct {
+	ID         string   `json:"id,omitempty"`
+	Tenant     string   `json:"tenant,omitempty"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventtypes,omitempty"`
+	Addresses  []string `json:"addresses,omitempty"`
+	Filter     string   `json:"filter,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	Ack        bool     `json:"ack,omitempty"`
+	AckedSeq   uint64   `json:"ackedseq,omitempty"`
+	Created    int64    `json:"created,omitempty"`
+	Config     bool     `json:"config,omitempty"`
+}
+
+// UsageCounts are the counted uses by an owner.
+type UsageCounts struct {
+	APICalls      uint64 `json:"apicalls"`
+	Notifications uint64 `json:"notifications"`
+}
+
+// OwnerUsage is the usage by the operator (empty Tenant) or a tenant.
+type OwnerUsage struct {
+	Tenant           string      `json:"tenant,omitempty"`
+	WatchedAddresses int         `json:"watchedaddresses"`
+	Total            UsageCounts `json:"total"`
+	Period           UsageCounts `json:"period"`
+}
+
+// UsageReport is the usage since the start of the current accounting period.
+type UsageReport struct {
+	PeriodStart int64        `json:"periodstart"`
+	PeriodEnd   int64        `json:"periodend"`
+	Usage       []OwnerUsage `json:"usage"`
+}
+
+// MuteState is whether watched address notifications are muted, and Until
+// the unix time until when.
+type MuteState struct {
+	Muted bool  `json:"muted"`
+	Until int64 `json:"until,omitempty"`
+}
+
+// AddressNotification is a notification sent of a watched address event.
+type AddressNotification struct {
+	Time     int64   `json:"time"`
+	Action   string  `json:"action"`
+	FollowUp bool    `json:"followup"`
+	Height   int64   `json:"height"`
+	TxID     string  `json:"txid"`
+	Vout     int     `json:"vout"`
+	Amount   float64 `json:"amount"`
+}
+
+// AddressStats is the statistics of a watched address for the operator (empty
+// Tenant) or a tenant.  Notifications are the most recent, newest first.
+type AddressStats struct {
+	Address       string                 `json:"address"`
+	Tenant        string                 `json:"tenant"`
+	Label         string                 `json:"label"`
+	Mined         uint64                 `json:"mined"`
+	Mempool       uint64                 `json:"mempool"`
+	Received      float64                `json:"received"`
+	Sent          float64                `json:"sent"`
+	LastHeight    int64                  `json:"lastheight"`
+	LastTime      int64                  `json:"lasttime"`
+	Notified      uint64                 `json:"notified"`
+	Notifications []*AddressNotification `json:"notifications"`
+}
+
+// AvailabilitySummary summarizes dcrspy's availability over a period.
+// Uptime and RPCAvailability are fractions.
+type AvailabilitySummary struct {
+	Period          string  `json:"period"`
+	Uptime          float64 `json:"uptime"`
+	RPCAvailability float64 `json:"rpcavailability"`
+	RPCOutages      int     `json:"rpcoutages"`
+	MissedBlocks    int64   `json:"missedblocks"`
+}
+
+// Status is dcrspy's current status.
+type Status struct {
+	Started      int64                  `json:"started"`
+	Uptime       int64                  `json:"uptime"`
+	RPCAvailable bool                   `json:"rpcavailable"`
+	LastHeight   int64                  `json:"lastheight"`
+	NodeIndexes  *NodeIndexes           `json:"nodeindexes"`
+	Availability []*AvailabilitySummary `json:"availability"`
+	Alerts       []*FiringAlert         `json:"alerts,omitempty"`
+}
+
+// FiringAlert is an alert whose condition has not yet cleared.  Key
+// identifies the condition, and Since is when it started firing.
+type FiringAlert struct {
+	Key     string `json:"key"`
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+	Since   int64  `json:"since"`
+}
+
+// NodeIndexes are the optional indexes of dcrd, on which some features
+// depend.
+type NodeIndexes struct {
+	TxIndex   bool `json:"txindex"`
+	AddrIndex bool `json:"addrindex"`
+}
+
+// RollingStat is the statistics of a field over a rolling window of blocks or
+// time.  FromHeight and ToHeight are zero if Count is zero.
+type RollingStat struct {
+	Name       string  `json:"name"`
+	Field      string  `json:"field"`
+	Window     string  `json:"window"`
+	Count      int     `json:"count"`
+	FromHeight int64   `json:"fromheight"`
+	ToHeight   int64   `json:"toheight"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	Mean       float64 `json:"mean"`
+	Median     float64 `json:"median"`
+	StdDev     float64 `json:"stddev"`
+}
+
+// AgeBucket is a bucket of the ticket age histogram, for ages (in blocks
+// since purchase) in [From, To).
+type AgeBucket struct {
+	From  int64 `json:"from"`
+	To    int64 `json:"to"`
+	Count int   `json:"count"`
+}
+
+// PriceCount is the number of live tickets bought at a price.
+type PriceCount struct {
+	Price float64 `json:"price"`
+	Count int     `json:"count"`
+}
+
+// TicketPool is the composition of the live ticket pool at a height.
+type TicketPool struct {
+	Height       int64        `json:"height"`
+	Time         int64        `json:"time"`
+	PoolSize     int          `json:"poolsize"`
+	PoolValue    float64      `json:"poolvalue"`
+	AgeMean      float64      `json:"agemean"`
+	AgeMedian    float64      `json:"agemedian"`
+	AgeHistogram []*AgeBucket `json:"agehistogram"`
+	Prices       []PriceCount `json:"prices"`
+}
+
+// TicketEstimate is the vote estimate for a wallet ticket.  Status is
+// "unmined", "immature" or "live".  The block and time estimates are zero for
+// unmined tickets.  ExpectedBlocks and ExpectedVoteTime assume the ticket
+// votes before it expires.
+type TicketEstimate struct {
+	Ticket           string  `json:"ticket"`
+	Status           string  `json:"status"`
+	PurchaseHeight   int64   `json:"purchaseheight"`
+	BlocksToExpiry   int64   `json:"blockstoexpiry"`
+	VoteProbability  float64 `json:"voteprobability"`
+	ExpiryRisk       float64 `json:"expiryrisk"`
+	ExpectedBlocks   float64 `json:"expectedblocks"`
+	ExpectedVoteTime int64   `json:"expectedvotetime"`
+}
+
+// VoteExpectReport summarizes the checks of the voting wallet's votes against
+// its expectations since dcrspy started.
+type VoteExpectReport struct {
+	Expectations string           `json:"expectations"`
+	Since        int64            `json:"since"`
+	Called       int              `json:"called"`
+	Voted        int              `json:"voted"`
+	Deviations   int              `json:"deviations"`
+	Recent       []*VoteDeviation `json:"recent"`
+}
+
+// VoteDeviation is a deviation of a vote from the expectations.  Height is the
+// height of the block the ticket was called to vote on.
+type VoteDeviation struct {
+	Time   int64  `json:"time"`
+	Ticket string `json:"ticket"`
+	Height int64  `json:"height"`
+	Reason string `json:"reason"`
+}
+
+// DecodedTx is a decoded transaction.  Type is "regular", "ticket", "vote" or
+// "revocation".  The block fields are set for a transaction decoded by txid
+// that is mined.
+type DecodedTx struct {
+	TxID          string          `json:"txid"`
+	Type          string          `json:"type"`
+	Version       uint16          `json:"version"`
+	LockTime      uint32          `json:"locktime"`
+	Expiry        uint32          `json:"expiry"`
+	Size          int             `json:"size"`
+	Vin           []*DecodedTxIn  `json:"vin"`
+	Vout          []*DecodedTxOut `json:"vout"`
+	Fee           float64         `json:"fee"`
+	BlockHash     string          `json:"blockhash"`
+	BlockHeight   int64           `json:"blockheight"`
+	Confirmations int64           `json:"confirmations"`
+}
+
+// DecodedTxIn is a decoded transaction input.  ScriptClass and Addresses are
+// those of the previous output, if it could be looked up.  Watched lists the
+// caller's watched addresses.
+type DecodedTxIn struct {
+	PrevTxID    string   `json:"prevtxid"`
+	PrevVout    uint32   `json:"prevvout"`
+	Tree        int8     `json:"tree"`
+	Sequence    uint32   `json:"sequence"`
+	AmountIn    float64  `json:"amountin"`
+	ScriptClass string   `json:"scriptclass"`
+	Addresses   []string `json:"addresses"`
+	Watched     []string `json:"watched"`
+}
+
+// DecodedTxOut is a decoded transaction output.  Watched lists the caller's
+// watched addresses.
+type DecodedTxOut struct {
+	N           int      `json:"n"`
+	Value       float64  `json:"value"`
+	Version     uint16   `json:"version"`
+	ScriptClass string   `json:"scriptclass"`
+	ReqSigs     int      `json:"reqsigs"`
+	Addresses   []string `json:"addresses"`
+	Watched     []string `json:"watched"`
+}
+
+// AddressHistory is a page of a watched address's history, newest first,
+// with the totals of its recorded history.
+type AddressHistory struct {
+	Address  string                 `json:"address"`
+	Received float64                `json:"received"`
+	Sent     float64                `json:"sent"`
+	Balance  float64                `json:"balance"`
+	Total    int                    `json:"total"`
+	Offset   int                    `json:"offset"`
+	Limit    int                    `json:"limit"`
+	Entries  []*AddressHistoryEntry `json:"entries"`
+}
+
+// AddressHistoryEntry is a credit or debit of an address.  Type is "credit"
+// or "debit".  Index is the output index of a credit, or the input index of a
+// debit.  PrevTxID and PrevVout are the credit spent by a debit.
+type AddressHistoryEntry struct {
+	Address  string  `json:"address"`
+	Type     string  `json:"type"`
+	TxID     string  `json:"txid"`
+	Index    uint32  `json:"index"`
+	Amount   float64 `json:"amount"`
+	Height   int64   `json:"height"`
+	Time     int64   `json:"time"`
+	PrevTxID string  `json:"prevtxid"`
+	PrevVout uint32  `json:"prevvout"`
+}
+
+// XpubAccount summarizes an account watched by its extended public key.
+// Used are the account's addresses with recorded history, and the amounts are
+// totals of their history.
+type XpubAccount struct {
+	Xpub     string     `json:"xpub"`
+	External XpubBranch `json:"external"`
+	Internal XpubBranch `json:"internal"`
+	Used     []string   `json:"used"`
+	Received float64    `json:"received"`
+	Sent     float64    `json:"sent"`
+	Balance  float64    `json:"balance"`
+}
+
+// XpubBranch is the number of derived and used addresses of the external or
+// internal branch of an xpub account.
+type XpubBranch struct {
+	Derived int `json:"derived"`
+	Used    int `json:"used"`
+}
+
+// GraphQLError is an error in a GraphQL response.
+type GraphQLError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// GraphQLErrors are the errors of a GraphQL response.
+type GraphQLErrors []GraphQLError
+
+func (e GraphQLErrors) Error() string {
+	if len(e) == 1 {
+		return "graphql: " + e[0].Message
+	}
+	msg := "graphql:"
+	for _, err := range e {
+		msg += " " + err.Message + ";"
+	}
+	return msg
+}
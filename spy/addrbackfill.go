@@ -0,0 +1,122 @@
+// addrbackfill.go backfills the history of a watched address from dcrd's
+// address index (searchrawtransactions, which requires dcrd with
+// --addrindex), so that the address history API is complete as soon as an
+// address is watched, rather than only from the blocks processed since.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/decred/dcrd/wire"
+	"github.com/decred/dcrutil"
+)
+
+const (
+	// addrBackfillPageSize is the number of transactions requested per
+	// searchrawtransactions call.
+	addrBackfillPageSize = 100
+	// addrBackfillQueueSize is the number of addresses waiting to be
+	// backfilled, beyond which backfill requests are dropped.
+	addrBackfillQueueSize = 256
+)
+
+// requestBackfill queues the backfill of the address's history.  It does
+// nothing if backfill is not enabled.
+func (h *addrHistory) requestBackfill(addr string) {
+	if h == nil || h.backfillQueue == nil {
+		return
+	}
+	select {
+	case h.backfillQueue <- addr:
+	default:
+		log.Warnf("Address backfill queue full. Not backfilling %s.", addr)
+	}
+}
+
+// backfill records the history of the address from the transactions in
+// dcrd's address index, oldest first, so that credits are recorded before the
+// debits spending them.
+func (h *addrHistory) backfill(addrStr string) error {
+	addr, err := dcrutil.DecodeAddress(addrStr, activeNet.Params)
+	if err != nil {
+		return err
+	}
+	var count int
+	for skip := 0; ; skip += addrBackfillPageSize {
+		_, bestHeight, err := h.dcrd.GetBestBlock()
+		if err != nil {
+			return err
+		}
+		txs, err := h.dcrd.SearchRawTransactionsVerbose(addr, skip,
+			addrBackfillPageSize, false, false, nil)
+		if err != nil {
+			// dcrd returns an error when skip is past the last transaction.
+			if strings.Contains(err.Error(), "No information") {
+				break
+			}
+			return err
+		}
+
+		for _, tx := range txs {
+			// Unmined transactions are recorded when mined.
+			if tx.Confirmations == 0 {
+				continue
+			}
+			raw, err := hex.DecodeString(tx.Hex)
+			if err != nil {
+				return err
+			}
+			msgTx := wire.NewMsgTx()
+			if err = msgTx.Deserialize(bytes.NewReader(raw)); err != nil {
+				return err
+			}
+			height := bestHeight - int64(tx.Confirmations) + 1
+			h.mtx.Lock()
+			h.addTx(msgTx, height, tx.Blocktime)
+			h.mtx.Unlock()
+			count++
+		}
+
+		if len(txs) < addrBackfillPageSize {
+			break
+		}
+	}
+	log.Infof("Backfilled the history of %s from %d transactions.", addrStr,
+		count)
+	return nil
+}
+
+// runBackfill backfills the queued addresses until quit is closed.  It should
+// be run as a goroutine.
+func (h *addrHistory) runBackfill(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case addr := <-h.backfillQueue:
+			if err := h.backfill(addr); err != nil {
+				log.Errorf("Failed to backfill the history of %s: %v", addr,
+					err)
+			}
+		case <-quit:
+			log.Debugf("Quitting address backfill.")
+			return
+		}
+	}
+}
+
+// backfillUnrecorded queues the backfill of the watched addresses that have
+// no recorded history, e.g. when backfill is first enabled.
+func (h *addrHistory) backfillUnrecorded() {
+	if h == nil {
+		return
+	}
+	for _, a := range h.watched.all() {
+		if !h.used(a) {
+			h.requestBackfill(a)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+// addrhistory.go records the history of the watched addresses: the credits
+// (outputs paying to a watched address) and debits (inputs spending those
+// outputs) in each connected block.  Debits are found without RPC, as the
+// history knows the outpoints it credited.  The history is appended to a
+// file, loaded at startup, and served with pagination by the address history
+// API, making dcrspy usable as a lightweight explorer backend for the watched
+// addresses.
+
+package spy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/wire"
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+)
+
+// Types of addrHistoryEntry.
+const (
+	addrHistoryCredit = "credit"
+	addrHistoryDebit  = "debit"
+)
+
+const (
+	// defaultHistoryLimit and maxHistoryLimit are the default and maximum
+	// number of entries in an address history page.
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// addrHistoryEntry is a credit or debit of an address.  Index is the output
+// index for a credit, and the input index for a debit.  A debit's PrevTxID and
+// PrevVout are the credit it spends.
+type addrHistoryEntry struct {
+	Address  string  `json:"address"`
+	Type     string  `json:"type"`
+	TxID     string  `json:"txid"`
+	Index    uint32  `json:"index"`
+	Amount   float64 `json:"amount"`
+	Height   int64   `json:"height"`
+	Time     int64   `json:"time"`
+	PrevTxID string  `json:"prevtxid,omitempty"`
+	PrevVout uint32  `json:"prevvout,omitempty"`
+}
+
+// key identifies the entry, so that it is recorded once.
+func (e *addrHistoryEntry) key() string {
+	return fmt.Sprintf("%s:%s:%s:%d", e.Address, e.Type, e.TxID, e.Index)
+}
+
+// historyOutpoint identifies a credited output.
+type historyOutpoint struct {
+	hash  chainhash.Hash
+	index uint32
+}
+
+// addrHistory is the history of the watched addresses.
+type addrHistory struct {
+	mtx     sync.Mutex
+	path    string
+	file    *os.File
+	watched *watchedAddresses
+	byAddr  map[string][]*addrHistoryEntry
+	keys    map[string]bool
+	// credits are the credited outputs, by outpoint.
+	credits map[historyOutpoint]*addrHistoryEntry
+	// dcrd is used to backfill the history of the addresses queued in
+	// backfillQueue.  Both are nil if backfill is not enabled.
+	dcrd          *dcrrpcclient.Client
+	backfillQueue chan string
+}
+
+// spyAddrHistory is the package-level address history, nil if not enabled.
+var spyAddrHistory *addrHistory
+
+// openAddrHistory loads the history in the file at path, and opens it for
+// appending.  If dcrd is not nil, the history of newly watched addresses is
+// backfilled from its address index.
+func openAddrHistory(path string, watched *watchedAddresses,
+	dcrd *dcrrpcclient.Client) (*addrHistory, error) {
+	h := &addrHistory{
+		path:    path,
+		watched: watched,
+		dcrd:    dcrd,
+		byAddr:  make(map[string][]*addrHistoryEntry),
+		keys:    make(map[string]bool),
+		credits: make(map[historyOutpoint]*addrHistoryEntry),
+	}
+	if dcrd != nil {
+		h.backfillQueue = make(chan string, addrBackfillQueueSize)
+	}
+
+	fp, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(fp)
+		for scanner.Scan() {
+			e := new(addrHistoryEntry)
+			if err = json.Unmarshal(scanner.Bytes(), e); err != nil {
+				log.Warnf("Skipping invalid address history entry: %v", err)
+				continue
+			}
+			h.index(e)
+		}
+		err = scanner.Err()
+		fp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// close closes the history file.
+func (h *addrHistory) close() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.file.Close()
+}
+
+// index adds the entry to the in-memory history, returning false if it was
+// already recorded.  The mutex must be held, except while loading.
+func (h *addrHistory) index(e *addrHistoryEntry) bool {
+	k := e.key()
+	if h.keys[k] {
+		return false
+	}
+	h.keys[k] = true
+	h.byAddr[e.Address] = append(h.byAddr[e.Address], e)
+	if e.Type == addrHistoryCredit {
+		hash, err := chainhash.NewHashFromStr(e.TxID)
+		if err == nil {
+			h.credits[historyOutpoint{*hash, e.Index}] = e
+		}
+	}
+	return true
+}
+
+// add records the entry, unless it was already recorded.  The mutex must be
+// held.
+func (h *addrHistory) add(e *addrHistoryEntry) {
+	if !h.index(e) {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Failed to encode address history entry: %v", err)
+		return
+	}
+	if _, err = h.file.Write(append(b, '\n')); err != nil {
+		log.Errorf("Failed to record address history: %v", err)
+	}
+}
+
+// blockConnected records the block's credits to watched addresses and debits
+// of credited outputs.
+func (h *addrHistory) blockConnected(block *dcrutil.Block) {
+	if h == nil {
+		return
+	}
+	height := block.Height()
+	blockTime := block.MsgBlock().Header.Timestamp.Unix()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, txs := range [][]*wire.MsgTx{block.MsgBlock().Transactions,
+		block.MsgBlock().STransactions} {
+		for _, tx := range txs {
+			h.addTx(tx, height, blockTime)
+		}
+	}
+}
+
+// addTx records the transaction's credits to watched addresses and debits of
+// credited outputs.  The mutex must be held.
+func (h *addrHistory) addTx(tx *wire.MsgTx, height, blockTime int64) {
+	txid := tx.TxHash().String()
+	for i, txIn := range tx.TxIn {
+		prev := &txIn.PreviousOutPoint
+		c, ok := h.credits[historyOutpoint{prev.Hash, prev.Index}]
+		if !ok {
+			continue
+		}
+		h.add(&addrHistoryEntry{
+			Address:  c.Address,
+			Type:     addrHistoryDebit,
+			TxID:     txid,
+			Index:    uint32(i),
+			Amount:   c.Amount,
+			Height:   height,
+			Time:     blockTime,
+			PrevTxID: c.TxID,
+			PrevVout: c.Index,
+		})
+	}
+	for n, txOut := range tx.TxOut {
+		_, addrs, _, err := txOutAddresses(txOut)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if !h.watched.isWatched(a) {
+				continue
+			}
+			h.add(&addrHistoryEntry{
+				Address: a,
+				Type:    addrHistoryCredit,
+				TxID:    txid,
+				Index:   uint32(n),
+				Amount:  dcrutil.Amount(txOut.Value).ToCoin(),
+				Height:  height,
+				Time:    blockTime,
+			})
+		}
+	}
+}
+
+// addressHistory is a page of an address's history, newest first, with the
+// totals of the full history.
+type addressHistory struct {
+	Address  string              `json:"address"`
+	Received float64             `json:"received"`
+	Sent     float64             `json:"sent"`
+	Balance  float64             `json:"balance"`
+	Total    int                 `json:"total"`
+	Offset   int                 `json:"offset"`
+	Limit    int                 `json:"limit"`
+	Entries  []*addrHistoryEntry `json:"entries"`
+}
+
+// page returns the page of the address's history of at most limit entries
+// after skipping offset entries.
+func (h *addrHistory) page(addr string, offset, limit int) *addressHistory {
+	h.mtx.Lock()
+	entries := append([]*addrHistoryEntry{}, h.byAddr[addr]...)
+	h.mtx.Unlock()
+
+	sort.Sort(sort.Reverse(historyByHeight(entries)))
+	p := &addressHistory{
+		Address: addr,
+		Total:   len(entries),
+		Offset:  offset,
+		Limit:   limit,
+		Entries: []*addrHistoryEntry{},
+	}
+	p.Received, p.Sent = historyTotals(entries)
+	p.Balance = p.Received - p.Sent
+	if offset < len(entries) {
+		end := offset + limit
+		if end > len(entries) {
+			end = len(entries)
+		}
+		p.Entries = entries[offset:end]
+	}
+	return p
+}
+
+// totals returns the amounts received and sent by the address.
+func (h *addrHistory) totals(addr string) (received, sent float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return historyTotals(h.byAddr[addr])
+}
+
+// used returns true if the address has recorded history.
+func (h *addrHistory) used(addr string) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return len(h.byAddr[addr]) > 0
+}
+
+// lastActivity returns the height and block time of the address's last
+// credit or debit, or zeros if it has none.
+func (h *addrHistory) lastActivity(addr string) (height, t int64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, e := range h.byAddr[addr] {
+		if e.Height > height {
+			height, t = e.Height, e.Time
+		}
+	}
+	return
+}
+
+// historyTotals returns the total credits and debits of the entries.
+func historyTotals(entries []*addrHistoryEntry) (received, sent float64) {
+	for _, e := range entries {
+		if e.Type == addrHistoryCredit {
+			received += e.Amount
+		} else {
+			sent += e.Amount
+		}
+	}
+	return
+}
+
+// historyByHeight sorts history entries by height, credits before debits in
+// a block.
+type historyByHeight []*addrHistoryEntry
+
+func (s historyByHeight) Len() int { return len(s) }
+func (s historyByHeight) Less(i, j int) bool {
+	if s[i].Height != s[j].Height {
+		return s[i].Height < s[j].Height
+	}
+	return s[i].Type == addrHistoryCredit && s[j].Type == addrHistoryDebit
+}
+func (s historyByHeight) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// addrHistoryAPI documents historyHandler.
+var addrHistoryAPI = []apiOperation{{
+	method:  "GET",
+	path:    "/api/address/{address}/history",
+	summary: "Get the history of a watched address, newest first",
+	params: []apiParam{
+		{name: "address", in: "path", typ: "string"},
+		{name: "offset", in: "query", typ: "integer"},
+		{name: "limit", in: "query", typ: "integer",
+			description: fmt.Sprintf("Default %d, at most %d",
+				defaultHistoryLimit, maxHistoryLimit)},
+	},
+	response: addressHistory{},
+}}
+
+// historyHandler serves GET
+// /api/address/<address>/history?offset=N&limit=M.  A tenant may only get the
+// history of the addresses it watches.
+func (h *addrHistory) historyHandler(w http.ResponseWriter, r *http.Request,
+	t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h == nil {
+		http.Error(w, "address history is not enabled", http.StatusNotFound)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/address/"), "/")
+	if len(parts) != 2 || parts[1] != "history" {
+		http.NotFound(w, r)
+		return
+	}
+	addr := parts[0]
+	if _, err := dcrutil.DecodeAddress(addr, activeNet.Params); err != nil {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+	if t != nil && !h.watched.watches(t.owner(), addr) {
+		http.Error(w, "address not watched", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	var offset int
+	if o := q.Get("offset"); o != "" {
+		var err error
+		offset, err = strconv.Atoi(o)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultHistoryLimit
+	if l := q.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxHistoryLimit {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.page(addr, offset, limit))
+}
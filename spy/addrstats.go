@@ -0,0 +1,387 @@
+// addrstats.go keeps statistics of each watched address, for each of its
+// owners: the number of mined and mempool events, the amount received, the
+// height and time of the last activity, and the recent notifications sent.
+// With addrhistory, the received and sent amounts are the totals of the
+// address history instead.  The statistics are saved to address-stats.json in
+// the output folder periodically and when quitting, and served by /addrstats,
+// as JSON, and /addrstats.html, a dashboard page.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// addrStatsSaveInterval is the interval between saves of the statistics.
+	addrStatsSaveInterval = time.Minute
+	// addrStatsNotifications is the number of recent notifications kept for
+	// each address.
+	addrStatsNotifications = 10
+)
+
+// addrNotification is a notification sent of a watched address event.
+type addrNotification struct {
+	Time     int64   `json:"time"`
+	Action   string  `json:"action"`
+	FollowUp bool    `json:"followup,omitempty"`
+	Height   int64   `json:"height"`
+	TxID     string  `json:"txid"`
+	Vout     int     `json:"vout"`
+	Amount   float64 `json:"amount"`
+}
+
+// addrStatsEntry is the statistics of a watched address for one owner.
+// Tenant is empty for the operator.  Notifications are newest first.
+type addrStatsEntry struct {
+	Address       string              `json:"address"`
+	Tenant        string              `json:"tenant,omitempty"`
+	Label         string              `json:"label,omitempty"`
+	Mined         uint64              `json:"mined"`
+	Mempool       uint64              `json:"mempool"`
+	Received      float64             `json:"received"`
+	Sent          float64             `json:"sent"`
+	LastHeight    int64               `json:"lastheight"`
+	LastTime      int64               `json:"lasttime"`
+	Notified      uint64              `json:"notified"`
+	Notifications []*addrNotification `json:"notifications"`
+}
+
+// addrStats holds the statistics of the watched addresses.
+type addrStats struct {
+	mtx     sync.Mutex
+	path    string
+	watched *watchedAddresses
+	// entries is keyed by addrStatsKey.
+	entries map[string]*addrStatsEntry
+	dirty   bool
+}
+
+// spyAddrStats is the package-level address statistics, nil if not
+// monitoring.
+var spyAddrStats *addrStats
+
+// addrStatsKey is the key of an owner's address in the entries map.
+func addrStatsKey(owner, addr string) string {
+	return owner + "/" + addr
+}
+
+// newAddrStats creates an addrStats of the watched addresses, restoring the
+// statistics saved at path.
+func newAddrStats(path string, watched *watchedAddresses) (*addrStats, error) {
+	s := &addrStats{
+		path:    path,
+		watched: watched,
+		entries: make(map[string]*addrStatsEntry),
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []*addrStatsEntry
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	for _, e := range saved {
+		s.entries[addrStatsKey(e.Tenant, e.Address)] = e
+	}
+	return s, nil
+}
+
+// entryLocked returns the statistics of the owner's address, creating them if
+// needed.  The mutex must be held.
+func (s *addrStats) entryLocked(owner, addr string) *addrStatsEntry {
+	key := addrStatsKey(owner, addr)
+	e := s.entries[key]
+	if e == nil {
+		e = &addrStatsEntry{Address: addr, Tenant: owner}
+		s.entries[key] = e
+	}
+	return e
+}
+
+// event counts the watched address event.  Other events are ignored.
+func (s *addrStats) event(ev *spyEvent) {
+	if s == nil || ev.Type != eventTypeWatchedAddr {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	e := s.entryLocked(ev.Tenant, ev.Address)
+	switch ev.Action {
+	case eventActionMined:
+		e.Mined++
+		e.Received += ev.Amount
+	case eventActionMempool:
+		e.Mempool++
+	default:
+		return
+	}
+	if ev.Height > e.LastHeight {
+		e.LastHeight = ev.Height
+	}
+	e.LastTime = ev.Time
+	s.dirty = true
+}
+
+// notification records the notification of the watched address event sent to
+// its owner.
+func (s *addrStats) notification(ev *spyEvent) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	e := s.entryLocked(ev.Tenant, ev.Address)
+	e.Notified++
+	n := &addrNotification{
+		Time:     time.Now().Unix(),
+		Action:   ev.Action,
+		FollowUp: ev.followUp,
+		Height:   ev.Height,
+		TxID:     ev.TxID,
+		Vout:     ev.Vout,
+		Amount:   ev.Amount,
+	}
+	e.Notifications = append([]*addrNotification{n}, e.Notifications...)
+	if len(e.Notifications) > addrStatsNotifications {
+		e.Notifications = e.Notifications[:addrStatsNotifications]
+	}
+	s.dirty = true
+}
+
+// lastActivity returns the height and time of the address's last event for
+// any owner, or zeros if it has none.
+func (s *addrStats) lastActivity(addr string) (height, t int64) {
+	if s == nil {
+		return 0, 0
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, e := range s.entries {
+		if e.Address == addr && e.LastHeight > height {
+			height, t = e.LastHeight, e.LastTime
+		}
+	}
+	return
+}
+
+// addrStatsByActivity sorts statistics by last activity, most recent first,
+// then by address.
+type addrStatsByActivity []*addrStatsEntry
+
+func (a addrStatsByActivity) Len() int      { return len(a) }
+func (a addrStatsByActivity) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a addrStatsByActivity) Less(i, j int) bool {
+	if a[i].LastHeight != a[j].LastHeight {
+		return a[i].LastHeight > a[j].LastHeight
+	}
+	if a[i].Address != a[j].Address {
+		return a[i].Address < a[j].Address
+	}
+	return a[i].Tenant < a[j].Tenant
+}
+
+// report returns the statistics of the addresses watched by the tenant, or by
+// all owners if t is nil, including addresses without activity.
+func (s *addrStats) report(t *tenant) []*addrStatsEntry {
+	owners := make(map[string]map[string]TxAction)
+	if t != nil {
+		owners[t.owner()] = s.watched.list(t.owner())
+	} else {
+		for _, addr := range s.watched.all() {
+			for owner, actn := range s.watched.owners(addr) {
+				if owners[owner] == nil {
+					owners[owner] = make(map[string]TxAction)
+				}
+				owners[owner][addr] = actn
+			}
+		}
+	}
+
+	s.mtx.Lock()
+	entries := make([]*addrStatsEntry, 0, len(s.entries))
+	for owner, addrs := range owners {
+		for addr := range addrs {
+			e := addrStatsEntry{Address: addr, Tenant: owner}
+			if saved := s.entries[addrStatsKey(owner, addr)]; saved != nil {
+				e = *saved
+			}
+			e.Notifications = append([]*addrNotification{},
+				e.Notifications...)
+			entries = append(entries, &e)
+		}
+	}
+	s.mtx.Unlock()
+
+	for _, e := range entries {
+		e.Label = spyAddrLabels[e.Address]
+		if spyAddrHistory != nil {
+			e.Received, e.Sent = spyAddrHistory.totals(e.Address)
+		}
+	}
+	sort.Sort(addrStatsByActivity(entries))
+	return entries
+}
+
+// save writes the statistics to the file, if they changed since the last
+// save.
+func (s *addrStats) save() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	saved := make([]*addrStatsEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		saved = append(saved, e)
+	}
+	b, err := json.MarshalIndent(saved, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// run saves the statistics at addrStatsSaveInterval and when quit is closed.
+// It should be run as a goroutine.
+func (s *addrStats) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(addrStatsSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				log.Errorf("Failed to save address statistics: %v", err)
+			}
+		case <-quit:
+			if err := s.save(); err != nil {
+				log.Errorf("Failed to save address statistics: %v", err)
+			}
+			log.Debugf("Quitting address statistics.")
+			return
+		}
+	}
+}
+
+// addrStatsAPI documents statsHandler.
+var addrStatsAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "Get the statistics of the watched addresses",
+	response: []*addrStatsEntry{},
+}}
+
+// statsHandler serves GET /addrstats with the statistics of the caller's
+// watched addresses, or of all watched addresses for the operator.
+func (s *addrStats) statsHandler(w http.ResponseWriter, r *http.Request,
+	t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s == nil {
+		http.Error(w, "address statistics are not enabled",
+			http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.report(t)); err != nil {
+		log.Errorf("Failed to write address statistics: %v", err)
+	}
+}
+
+// addrQRCodeSize is the width and height in px of the QR codes of the
+// dashboard.
+const addrQRCodeSize = 96
+
+// addrStatsPage is the HTML dashboard of the address statistics, refreshed
+// every minute, with the QR code of each address.
+var addrStatsPage = template.Must(template.New("addrstats").Funcs(
+	template.FuncMap{
+		"unix": func(t int64) string {
+			return time.Unix(t, 0).UTC().Format("2006-01-02 15:04:05 UTC")
+		},
+		"qr": func(addr string) template.HTML {
+			return addrQRCode(addr, addrQRCodeSize)
+		},
+	}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>dcrspy watched addresses</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #091440; }
+table { border-collapse: collapse; }
+th { text-align: left; color: #596d81; }
+td, th { padding: 0.3em 1em 0.3em 0; vertical-align: top; }
+tr { border-top: 1px solid #ddd; }
+.idle { color: #596d81; }
+.qr svg { display: block; margin-top: 0.3em; }
+</style>
+</head>
+<body>
+<h1>Watched addresses</h1>
+{{if .}}<table>
+<tr><th>Address</th><th>Mined</th><th>Mempool</th><th>Received</th><th>Sent</th><th>Last activity</th><th>Recent notifications</th></tr>
+{{range .}}<tr{{if not .LastHeight}} class="idle"{{end}}>
+<td class="qr">{{with .Label}}<b>{{.}}</b><br>{{end}}<code>{{.Address}}</code>{{with .Tenant}}<br>tenant {{.}}{{end}}{{qr .Address}}</td>
+<td>{{.Mined}}</td>
+<td>{{.Mempool}}</td>
+<td>{{printf "%.8f" .Received}}</td>
+<td>{{printf "%.8f" .Sent}}</td>
+<td>{{if .LastHeight}}block {{.LastHeight}}<br>{{unix .LastTime}}{{else}}none{{end}}</td>
+<td>{{.Notified}}{{range .Notifications}}<br>{{unix .Time}}: {{if .FollowUp}}confirmed{{else}}{{.Action}}{{end}} {{printf "%.8f" .Amount}} DCR{{end}}</td>
+</tr>
+{{end}}</table>{{else}}<p>No watched addresses.</p>{{end}}
+</body>
+</html>
+`))
+
+// addrStatsPageAPI documents pageHandler.
+var addrStatsPageAPI = []apiOperation{{
+	method:      "GET",
+	summary:     "A dashboard page of the watched address statistics",
+	contentType: "text/html",
+}}
+
+// pageHandler serves GET /addrstats.html with the dashboard of the statistics
+// of the caller's watched addresses.
+func (s *addrStats) pageHandler(w http.ResponseWriter, r *http.Request,
+	t *tenant) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s == nil {
+		http.Error(w, "address statistics are not enabled",
+			http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := addrStatsPage.Execute(w, s.report(t)); err != nil {
+		log.Warnf("Failed to render address statistics page: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+// alerts.go provides a simple way for monitors to raise an alert.  Alerts are
+// always logged, and also emailed when an email configuration is available,
+// posted to Discord and Slack when webhooks are configured, and open PagerDuty
+// incidents when an integration is configured.
+// Critical alerts are also published as events and annotated in Grafana, so
+// that they reach every configured channel.
+//
+// Alerts for conditions that persist (e.g. a metric condition, or a chain
+// halt) are stateful: fireAlert alerts only when the condition starts firing,
+// and resolveAlert sends a recovery notification when it clears.  The firing
+// alerts are served by the status API.
+
+package spy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// alertEmailConfig is the email configuration used to send alerts.  It is nil
+// if email is not configured, in which case alerts are only logged.
+var alertEmailConfig *EmailConfig
+
+// sendAlert logs the alert message, and emails and posts it to Discord and
+// Slack if possible.
+func sendAlert(subject, format string, args ...interface{}) {
+	raiseAlert("", subject, fmt.Sprintf(format, args...))
+}
+
+// sendDedupAlert sends an alert like sendAlert, of an occurrence identified by
+// key (e.g. a spend from an address by a transaction), which deduplicates its
+// PagerDuty incident.
+func sendDedupAlert(key, subject, format string, args ...interface{}) {
+	raiseAlert(key, subject, fmt.Sprintf(format, args...))
+}
+
+// raiseAlert sends the alert with the key, which is empty for an alert
+// without one.
+func raiseAlert(key, subject, msg string) {
+	log.Warnf("ALERT (%s): %s", subject, msg)
+
+	if alertEmailConfig != nil {
+		spyNotifyPool.submit(notifyChannelEmail, func() {
+			sendEmailWatchRecv(msg, "dcrspy alert: "+subject, alertEmailConfig)
+		})
+	}
+	spyDiscord.notifyAlert("dcrspy alert: "+subject, msg, discordColorAlert)
+	spySlack.notifyAlert("dcrspy alert: "+subject, msg, slackColorAlert)
+	spyPagerDuty.trigger(key, subject, msg, "warning")
+}
+
+// sendCriticalAlert logs the event's message at critical level, emails it and
+// posts it to Discord and Slack with a CRITICAL subject if possible, and
+// publishes the event, which records it in the journal and delivers it to
+// webhooks and event stream subscribers.
+func sendCriticalAlert(subject string, e *spyEvent) {
+	raiseCriticalAlert("", subject, e)
+}
+
+// raiseCriticalAlert sends the critical alert with the key, which is empty for
+// an alert without one.
+func raiseCriticalAlert(key, subject string, e *spyEvent) {
+	log.Criticalf("CRITICAL ALERT (%s): %s", subject, e.Message)
+
+	if alertEmailConfig != nil {
+		spyNotifyPool.submit(notifyChannelEmail, func() {
+			sendEmailWatchRecv(e.Message, "dcrspy CRITICAL: "+subject,
+				alertEmailConfig)
+		})
+	}
+	spyDiscord.notifyAlert("dcrspy CRITICAL: "+subject, e.Message,
+		discordColorCritical)
+	spySlack.notifyAlert("dcrspy CRITICAL: "+subject, e.Message,
+		slackColorCritical)
+	spyPagerDuty.trigger(key, subject, e.Message, "critical")
+	publishEvent(e)
+	spyGrafana.annotate(e)
+}
+
+// firingAlert is the alert of a condition that has not yet cleared.
+type firingAlert struct {
+	Key     string `json:"key"`
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+	Since   int64  `json:"since"`
+}
+
+var (
+	// firingAlerts are the firing alerts, by condition key.
+	firingAlerts    = make(map[string]*firingAlert)
+	firingAlertsMtx sync.Mutex
+)
+
+// markFiring records the condition identified by key as firing, returning
+// false if it already was.
+func markFiring(key, subject, msg string) bool {
+	firingAlertsMtx.Lock()
+	defer firingAlertsMtx.Unlock()
+	if _, firing := firingAlerts[key]; firing {
+		return false
+	}
+	firingAlerts[key] = &firingAlert{
+		Key:     key,
+		Subject: subject,
+		Message: msg,
+		Since:   time.Now().Unix(),
+	}
+	return true
+}
+
+// fireAlert sends the alert for the condition identified by key, unless it is
+// already firing.  It returns true if the alert was sent.
+func fireAlert(key, subject, format string, args ...interface{}) bool {
+	msg := fmt.Sprintf(format, args...)
+	if !markFiring(key, subject, msg) {
+		log.Debugf("Alert %s still firing: %s", key, msg)
+		return false
+	}
+	raiseAlert(key, subject, msg)
+	return true
+}
+
+// fireCriticalAlert sends the critical alert for the condition identified by
+// key, unless it is already firing.  It returns true if the alert was sent.
+func fireCriticalAlert(key, subject string, e *spyEvent) bool {
+	if !markFiring(key, subject, e.Message) {
+		log.Debugf("Alert %s still firing: %s", key, e.Message)
+		return false
+	}
+	raiseCriticalAlert(key, subject, e)
+	return true
+}
+
+// resolveAlert sends a recovery notification if the condition identified by
+// key was firing, and clears it.  It returns true if the notification was
+// sent.
+func resolveAlert(key, format string, args ...interface{}) bool {
+	firingAlertsMtx.Lock()
+	a, firing := firingAlerts[key]
+	delete(firingAlerts, key)
+	firingAlertsMtx.Unlock()
+	if !firing {
+		return false
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	log.Infof("RECOVERED (%s): %s", a.Subject, msg)
+	if alertEmailConfig != nil {
+		spyNotifyPool.submit(notifyChannelEmail, func() {
+			sendEmailWatchRecv(msg, "dcrspy recovered: "+a.Subject,
+				alertEmailConfig)
+		})
+	}
+	spyDiscord.notifyAlert("dcrspy recovered: "+a.Subject, msg,
+		discordColorRecovered)
+	spySlack.notifyAlert("dcrspy recovered: "+a.Subject, msg,
+		slackColorRecovered)
+	spyPagerDuty.resolve(key)
+	return true
+}
+
+// clearAlert clears the condition identified by key without a recovery
+// notification, e.g. when it is superseded by another alert's condition.  Its
+// PagerDuty incident is resolved.
+func clearAlert(key string) {
+	firingAlertsMtx.Lock()
+	_, firing := firingAlerts[key]
+	delete(firingAlerts, key)
+	firingAlertsMtx.Unlock()
+	if firing {
+		spyPagerDuty.resolve(key)
+	}
+}
+
+// currentAlerts returns the firing alerts, oldest first.
+func currentAlerts() []*firingAlert {
+	firingAlertsMtx.Lock()
+	alerts := make([]*firingAlert, 0, len(firingAlerts))
+	for _, a := range firingAlerts {
+		c := *a
+		alerts = append(alerts, &c)
+	}
+	firingAlertsMtx.Unlock()
+	sort.Sort(alertsBySince(alerts))
+	return alerts
+}
+
+// alertsBySince sorts alerts by the time they started firing, then by key.
+type alertsBySince []*firingAlert
+
+func (s alertsBySince) Len() int { return len(s) }
+func (s alertsBySince) Less(i, j int) bool {
+	if s[i].Since != s[j].Since {
+		return s[i].Since < s[j].Since
+	}
+	return s[i].Key < s[j].Key
+}
+func (s alertsBySince) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,194 @@
+// apiroles.go implements API roles, which limit what an API key may do:
+//
+//	read      GET requests, and queries sent by POST (GraphQL, tx decode)
+//	operator  read, acknowledging webhook events and muting notifications
+//	admin     everything, e.g. adding watched addresses or webhooks
+//
+// The operator's API keys are given by the apikey option as ROLE:KEY, or
+// ROLE:NAME:KEY to name the key in the audit log.  With mutual TLS
+// (apiclientca), the apicertrole option gives the role of the client
+// certificates with a subject common name as ROLE:NAME instead.  When any key
+// or certificate role is given, one of them is required to use the API outside
+// multi-tenant mode.  In multi-tenant mode, each tenant's key has the tenant's
+// role.
+
+package spy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// apiRole is an API role.  Each role may do everything a lesser role may.
+type apiRole int
+
+// API roles
+const (
+	roleRead apiRole = iota
+	roleOperator
+	roleAdmin
+)
+
+func (r apiRole) String() string {
+	switch r {
+	case roleRead:
+		return "read"
+	case roleOperator:
+		return "operator"
+	}
+	return "admin"
+}
+
+// parseAPIRole parses a role name.  An empty name is read, so that a key is
+// only given more than read access explicitly.
+func parseAPIRole(s string) (apiRole, error) {
+	switch s {
+	case "read", "":
+		return roleRead, nil
+	case "operator":
+		return roleOperator, nil
+	case "admin":
+		return roleAdmin, nil
+	}
+	return roleRead, fmt.Errorf("unknown API role %q (expected read, "+
+		"operator or admin)", s)
+}
+
+// requiredRole returns the role required for the request.
+func requiredRole(req *http.Request) apiRole {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return roleRead
+	}
+	path := req.URL.Path
+	switch {
+	case path == "/graphql" || path == "/api/tx/decode":
+		// Queries, which do not change anything.
+		return roleRead
+	case strings.HasPrefix(path, "/webhooks/") &&
+		strings.HasSuffix(path, "/ack"), path == "/api/mute":
+		return roleOperator
+	}
+	return roleAdmin
+}
+
+// apiKey is an operator's API key, its name and its role.
+type apiKey struct {
+	name string
+	key  string
+	role apiRole
+}
+
+// apiKeys are the operator's API keys.
+type apiKeys []*apiKey
+
+// spyAPIKeys is the package-level set of the operator's API keys, nil if none
+// are configured, in which case the API may be used without a key.
+var spyAPIKeys apiKeys
+
+// parseAPIKeys parses the keys, each given as ROLE:KEY or ROLE:NAME:KEY.  A
+// key without a name is named by its position, e.g. key1.
+func parseAPIKeys(keys []string) (apiKeys, error) {
+	var ks apiKeys
+	for i, s := range keys {
+		parts := strings.SplitN(s, ":", 3)
+		if len(parts) < 2 || parts[len(parts)-1] == "" {
+			return nil, fmt.Errorf("invalid apikey (expected ROLE:KEY or " +
+				"ROLE:NAME:KEY)")
+		}
+		role, err := parseAPIRole(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		k := &apiKey{
+			name: fmt.Sprintf("key%d", i+1),
+			key:  parts[len(parts)-1],
+			role: role,
+		}
+		if len(parts) == 3 && parts[1] != "" {
+			k.name = parts[1]
+		}
+		ks = append(ks, k)
+	}
+	return ks, nil
+}
+
+// authenticate returns the API key in the request's X-API-Key header or
+// bearer token, or nil if there is no such key.
+func (ks apiKeys) authenticate(req *http.Request) *apiKey {
+	key := requestAPIKey(req)
+	if key == "" {
+		return nil
+	}
+	for _, k := range ks {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k.key)) == 1 {
+			return k
+		}
+	}
+	return nil
+}
+
+// apiCertRoles are the roles of the operator's client certificates, as
+// apiKeys without keys named by the common name of the certificate's subject.
+type apiCertRoles map[string]*apiKey
+
+// spyCertRoles is the package-level set of the roles of the operator's client
+// certificates, nil if none are configured.
+var spyCertRoles apiCertRoles
+
+// parseAPICertRoles parses the roles, each given as ROLE:NAME, where NAME is
+// the common name of the certificates' subject.
+func parseAPICertRoles(roles []string) (apiCertRoles, error) {
+	cr := make(apiCertRoles, len(roles))
+	for _, s := range roles {
+		i := strings.Index(s, ":")
+		if i < 0 || s[i+1:] == "" {
+			return nil, fmt.Errorf("invalid apicertrole %q (expected "+
+				"ROLE:NAME)", s)
+		}
+		role, err := parseAPIRole(s[:i])
+		if err != nil {
+			return nil, err
+		}
+		name := s[i+1:]
+		if _, dup := cr[name]; dup {
+			return nil, fmt.Errorf("duplicate apicertrole name %q", name)
+		}
+		cr[name] = &apiKey{name: name, role: role}
+	}
+	return cr, nil
+}
+
+// authenticate returns the role of the request's verified client certificate,
+// or nil if it has none with a role.
+func (cr apiCertRoles) authenticate(req *http.Request) *apiKey {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 ||
+		len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return cr[req.TLS.VerifiedChains[0][0].Subject.CommonName]
+}
+
+// requestAPIKey returns the API key in the request's X-API-Key header or
+// bearer token.
+func requestAPIKey(req *http.Request) string {
+	key := req.Header.Get("X-API-Key")
+	if key == "" {
+		key = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	return key
+}
+
+// allowRole writes a 403 response and returns false if the role may not make
+// the request.
+func allowRole(w http.ResponseWriter, req *http.Request, role apiRole) bool {
+	need := requiredRole(req)
+	if role < need {
+		http.Error(w, fmt.Sprintf("the %s role is required (this key has "+
+			"the %s role)", need, role), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package spy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPICertRoles(t *testing.T) {
+	if _, err := parseAPICertRoles([]string{"admin:a", "read:a"}); err == nil {
+		t.Error("parsed a duplicate name")
+	}
+	for _, s := range []string{"admin", "admin:", "owner:dashboard"} {
+		if _, err := parseAPICertRoles([]string{s}); err == nil {
+			t.Errorf("parsed apicertrole %q", s)
+		}
+	}
+
+	cr, err := parseAPICertRoles([]string{"read:dashboard", ":viewer",
+		"operator:oncall:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		// name is the common name of the verified certificate, if any.
+		name string
+		// wantRole is the role, if the certificate has one.
+		wantRole apiRole
+		wantKey  bool
+	}{
+		{"dashboard", roleRead, true},
+		{"viewer", roleRead, true},
+		{"oncall:1", roleOperator, true},
+		{"oncall", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/watch", nil)
+		if tt.name != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: tt.name}}
+			req.TLS = &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			}
+		}
+		k := cr.authenticate(req)
+		if (k != nil) != tt.wantKey || (k != nil && (k.role != tt.wantRole ||
+			k.name != tt.name)) {
+			t.Errorf("authenticate(%q) = %+v, want role %v: %v", tt.name, k,
+				tt.wantRole, tt.wantKey)
+		}
+	}
+
+	// Certificates without a role are not authenticated.
+	var none apiCertRoles
+	req := httptest.NewRequest("GET", "/watch", nil)
+	if k := none.authenticate(req); k != nil {
+		t.Errorf("authenticated %+v without certificate roles", k)
+	}
+}
@@ -0,0 +1,179 @@
+// apiserver.go defines the HTTP server used to expose dcrspy's metrics and
+// API endpoints.  A server's listener may be restricted to an allowlist of
+// IP networks, and may serve HTTPS, optionally requiring client certificates
+// (mutual TLS), so that it can be locked to a management network without a
+// proxy.
+
+package spy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxAPIBodySize is the maximum size of the body of an API request.
+const maxAPIBodySize = 1 << 20
+
+// apiServer serves HTTP requests on a single listener.  Handlers are added
+// with handle, and the allowlist and TLS are set up, before start is called.
+type apiServer struct {
+	listen    string
+	mux       *http.ServeMux
+	routes    []apiRoute
+	allow     []*net.IPNet
+	tlsConfig *tls.Config
+}
+
+// newAPIServer creates a new apiServer that will listen on the given address.
+func newAPIServer(listen string) *apiServer {
+	return &apiServer{
+		listen: listen,
+		mux:    http.NewServeMux(),
+	}
+}
+
+// handle adds the handler of the pattern, documented by ops in the OpenAPI
+// document (see openapi.go).
+func (s *apiServer) handle(pattern string, h http.Handler,
+	ops ...apiOperation) {
+	s.mux.Handle(pattern, h)
+	s.routes = append(s.routes, apiRoute{pattern, ops})
+}
+
+// allowFrom restricts the server to clients with an IP address in the
+// allowlist of IP addresses and CIDR networks (e.g. 10.0.0.0/8).  Connections
+// from other addresses are closed before any data is read.
+func (s *apiServer) allowFrom(allowlist []string) error {
+	for _, a := range allowlist {
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return fmt.Errorf("invalid IP address %q", a)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			s.allow = append(s.allow, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(a)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR network %q", a)
+		}
+		s.allow = append(s.allow, ipNet)
+	}
+	return nil
+}
+
+// useTLS serves HTTPS with the certificate and key files.  If clientCAFile is
+// not empty, clients must present a certificate signed by one of the CA
+// certificates in the file.
+func (s *apiServer) useTLS(certFile, keyFile, clientCAFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates in %s", clientCAFile)
+	}
+	s.tlsConfig.ClientCAs = pool
+	s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// start opens the listener and serves requests in a new goroutine until the
+// quit channel is closed.
+func (s *apiServer) start(wg *sync.WaitGroup, quit <-chan struct{}) error {
+	listener, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return err
+	}
+	scheme := "HTTP"
+	if len(s.allow) > 0 {
+		listener = &allowListener{listener, s.allow}
+	}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+		scheme = "HTTPS"
+		if s.tlsConfig.ClientCAs != nil {
+			scheme = "HTTPS (mutual TLS)"
+		}
+	}
+	log.Infof("%s server listening on %s", scheme, listener.Addr())
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-quit
+		log.Debugf("Stopping HTTP server.")
+		listener.Close()
+	}()
+
+	go func() {
+		// Serve returns when the listener is closed.
+		err := http.Serve(listener, s.mux)
+		log.Debugf("HTTP server stopped: %v", err)
+	}()
+
+	return nil
+}
+
+// allowListener is a listener accepting only connections from the allowed
+// networks.
+type allowListener struct {
+	net.Listener
+	allow []*net.IPNet
+}
+
+// Accept waits for and returns the next allowed connection, closing the
+// others.
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Debugf("Refused connection from %v to %v (not allowed).",
+			conn.RemoteAddr(), l.Addr())
+		conn.Close()
+	}
+}
+
+// allowed returns true if the address is in an allowed network.
+func (l *allowListener) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range l.allow {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
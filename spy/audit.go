@@ -0,0 +1,166 @@
+// audit.go records the control actions of the API, i.e. the requests that
+// change something (e.g. registering a watched address or creating a
+// webhook), as audit events in the event journal: who made the request, what
+// it was and its result, and when.  Refused requests are recorded too.  The
+// audit events are queried with GET /audit.
+//
+// Acknowledgements of webhook events are not recorded.  They are routine, and
+// each would be an event for the webhook to acknowledge.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Event type of audit events.  The action is the request's method in lower
+// case, e.g. post.
+const eventTypeAudit = "audit"
+
+// operatorActor is the actor of the operator's requests without an API key.
+const operatorActor = "operator"
+
+// auditRecorder records the status of a response, and the details of the
+// action set by the handler.
+type auditRecorder struct {
+	http.ResponseWriter
+	status  int
+	address string
+	detail  string
+}
+
+// WriteHeader records the status.
+func (a *auditRecorder) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 status.
+func (a *auditRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+// auditDetail sets the address concerned and a description of the action, if
+// the request is audited.
+func auditDetail(w http.ResponseWriter, address, format string,
+	args ...interface{}) {
+	if a, ok := w.(*auditRecorder); ok {
+		a.address = address
+		a.detail = fmt.Sprintf(format, args...)
+	}
+}
+
+// audited returns true if the request is a control action to record.
+func audited(req *http.Request) bool {
+	if requiredRole(req) == roleRead {
+		return false
+	}
+	return !strings.HasSuffix(req.URL.Path, "/ack")
+}
+
+// recordAudit publishes the audit event of the request by the actor (of the
+// tenant, if any) with the role, recorded by rec.
+func recordAudit(req *http.Request, actor, tenant string, role apiRole,
+	rec *auditRecorder) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	msg := fmt.Sprintf("%s (%s, %s) %s %s", actor, role, req.RemoteAddr,
+		req.Method, req.URL.Path)
+	if rec.detail != "" {
+		msg += ": " + rec.detail
+	}
+	msg += fmt.Sprintf(" [%d %s]", status, http.StatusText(status))
+	log.Infof("Audit: %s", msg)
+	publishEvent(&spyEvent{
+		Type:    eventTypeAudit,
+		Action:  strings.ToLower(req.Method),
+		Address: rec.address,
+		Actor:   actor,
+		Message: msg,
+		Tenant:  tenant,
+	})
+}
+
+// auditAPI documents auditHandler.
+var auditAPI = []apiOperation{{
+	method:  "GET",
+	summary: "Get the audit events, oldest first",
+	params: []apiParam{
+		{name: "since", in: "query", typ: "integer",
+			description: "Sequence number after which events are returned"},
+		{name: "from", in: "query", typ: "integer",
+			description: "Unix time"},
+		{name: "to", in: "query", typ: "integer", description: "Unix time"},
+		{name: "actor", in: "query", typ: "string"},
+		{name: "limit", in: "query", typ: "integer"},
+	},
+	response: []*spyEvent{},
+}}
+
+// auditHandler serves GET /audit?since=N&from=T&to=T&actor=A&limit=M,
+// returning the owner's audit events with sequence numbers greater than since,
+// at unix times within [from, to], and by the actor, oldest first.
+func auditHandler(w http.ResponseWriter, r *http.Request, t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	since, err := eventsSinceArg(r)
+	if err != nil {
+		http.Error(w, "invalid since", http.StatusBadRequest)
+		return
+	}
+	var from, to int64
+	if s := q.Get("from"); s != "" {
+		if from, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultEventsLimit
+	if l := q.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxEventsLimit {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	actor := q.Get("actor")
+
+	owner := t.owner()
+	events := make([]*spyEvent, 0)
+	err = spyJournal.scanAfter(since, func(e *spyEvent) bool {
+		if e.Type == eventTypeAudit && e.Tenant == owner &&
+			e.Time >= from && (to == 0 || e.Time <= to) &&
+			(actor == "" || e.Actor == actor) {
+			events = append(events, e)
+		}
+		return len(events) < limit
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to read event journal: %v", err)
+		http.Error(w, "failed to read events", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
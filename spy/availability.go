@@ -0,0 +1,378 @@
+// availability.go tracks dcrspy's own availability: its uptime (the time
+// windows during which it was running), the windows during which dcrd RPC was
+// unavailable, and the windows of blocks that were not processed (e.g. while
+// dcrspy was not running, or when data collection failed).  The windows are
+// saved to a file, so statistics cover restarts, and summarized for a period
+// in heartbeat messages and by the status API.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrrpcclient"
+)
+
+const (
+	// availabilityProbeInterval is the interval between dcrd RPC probes,
+	// which is also the resolution of the recorded windows.
+	availabilityProbeInterval = 30 * time.Second
+	// availabilityRetention is how long windows are kept.
+	availabilityRetention = 30 * 24 * time.Hour
+	// rpcDownAlert is the key of the alert of a dcrd RPC outage.
+	rpcDownAlert = "dcrd:rpc"
+)
+
+// timeWindow is a time interval in unix seconds.  An End of zero indicates a
+// window that has not ended.
+type timeWindow struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// overlap returns the number of seconds of the window within [from, to].
+func (w timeWindow) overlap(from, to int64) int64 {
+	start, end := w.Start, w.End
+	if end == 0 {
+		end = to
+	}
+	if start < from {
+		start = from
+	}
+	if end > to {
+		end = to
+	}
+	if end <= start {
+		return 0
+	}
+	return end - start
+}
+
+// missedBlocks is a range of block heights that were not processed, and the
+// time the gap was detected.
+type missedBlocks struct {
+	From     int64 `json:"from"`
+	To       int64 `json:"to"`
+	Detected int64 `json:"detected"`
+}
+
+// availabilityState is the saved availability history.
+type availabilityState struct {
+	Sessions     []timeWindow   `json:"sessions"`
+	RPCOutages   []timeWindow   `json:"rpcoutages"`
+	MissedBlocks []missedBlocks `json:"missedblocks"`
+	LastHeight   int64          `json:"lastheight"`
+}
+
+// availabilitySummary summarizes availability over a period.
+type availabilitySummary struct {
+	Period          string  `json:"period"`
+	Uptime          float64 `json:"uptime"`
+	RPCAvailability float64 `json:"rpcavailability"`
+	RPCOutages      int     `json:"rpcoutages"`
+	MissedBlocks    int64   `json:"missedblocks"`
+}
+
+func (s *availabilitySummary) String() string {
+	return fmt.Sprintf("uptime %.2f%%, RPC available %.2f%% (%d outages), "+
+		"%d missed blocks", 100*s.Uptime, 100*s.RPCAvailability,
+		s.RPCOutages, s.MissedBlocks)
+}
+
+// availabilityTracker records the availability windows.
+type availabilityTracker struct {
+	mtx     sync.Mutex
+	path    string
+	started time.Time
+	state   availabilityState
+	// session is the index of the current session in state.Sessions.
+	session int
+}
+
+// spyAvailability is the package-level availability tracker, or nil if not
+// monitoring.
+var spyAvailability *availabilityTracker
+
+// newAvailabilityTracker creates an availabilityTracker, loading the history
+// saved at path, and starts a new session.
+func newAvailabilityTracker(path string) (*availabilityTracker, error) {
+	a := &availabilityTracker{
+		path:    path,
+		started: time.Now(),
+	}
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err = json.Unmarshal(b, &a.state); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	now := a.started.Unix()
+	// The previous session and any outage ended no later than the last save.
+	for i := range a.state.RPCOutages {
+		if a.state.RPCOutages[i].End == 0 {
+			a.state.RPCOutages[i].End = a.lastSessionEnd(now)
+		}
+	}
+	a.state.Sessions = append(a.state.Sessions, timeWindow{now, now})
+	a.session = len(a.state.Sessions) - 1
+
+	spyMetrics.newGauge("dcrspy_uptime_seconds",
+		"Time since dcrspy was started.", func() float64 {
+			return time.Since(a.started).Seconds()
+		})
+	spyMetrics.newGauge("dcrspy_rpc_available",
+		"1 if dcrd RPC was available at the last probe, 0 otherwise.",
+		func() float64 {
+			if a.rpcDown() {
+				return 0
+			}
+			return 1
+		})
+	return a, nil
+}
+
+// lastSessionEnd returns the end of the last saved session, or def if there
+// is none.
+func (a *availabilityTracker) lastSessionEnd(def int64) int64 {
+	if n := len(a.state.Sessions); n > 0 {
+		return a.state.Sessions[n-1].End
+	}
+	return def
+}
+
+// rpcDown returns true if an RPC outage is in progress.
+func (a *availabilityTracker) rpcDown() bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	n := len(a.state.RPCOutages)
+	return n > 0 && a.state.RPCOutages[n-1].End == 0
+}
+
+// rpcStatus records the result of an RPC probe, starting or ending an outage,
+// and fires or resolves the dcrd connection alert.
+func (a *availabilityTracker) rpcStatus(err error) {
+	a.mtx.Lock()
+	now := time.Now().Unix()
+	n := len(a.state.RPCOutages)
+	down := n > 0 && a.state.RPCOutages[n-1].End == 0
+	var outage time.Duration
+	switch {
+	case err != nil && !down:
+		a.state.RPCOutages = append(a.state.RPCOutages, timeWindow{Start: now})
+		log.Warnf("dcrd RPC unavailable: %v", err)
+	case err == nil && down:
+		a.state.RPCOutages[n-1].End = now
+		outage = time.Duration(now-a.state.RPCOutages[n-1].Start) * time.Second
+		log.Infof("dcrd RPC available again after %v", outage)
+	}
+	a.mtx.Unlock()
+
+	// Alerts are sent without the lock, which the status handler takes.
+	switch {
+	case err != nil && !down:
+		fireAlert(rpcDownAlert, "dcrd connection lost",
+			"dcrd RPC is unavailable: %v", err)
+	case err == nil && down:
+		resolveAlert(rpcDownAlert, "dcrd RPC is available again after %v.",
+			outage)
+	}
+}
+
+// blockProcessed records that the block at the given height was processed,
+// recording any gap since the last processed block as missed.
+func (a *availabilityTracker) blockProcessed(height int64) {
+	if a == nil {
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	last := a.state.LastHeight
+	if last > 0 && height > last+1 {
+		a.state.MissedBlocks = append(a.state.MissedBlocks, missedBlocks{
+			From:     last + 1,
+			To:       height - 1,
+			Detected: time.Now().Unix(),
+		})
+		log.Warnf("Blocks %d to %d were not processed.", last+1, height-1)
+	}
+	a.state.LastHeight = height
+}
+
+// summary summarizes the availability over the period ending now.
+func (a *availabilityTracker) summary(period time.Duration) *availabilitySummary {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	to := time.Now().Unix()
+	from := to - int64(period/time.Second)
+	// Do not count the time before availability was first tracked.
+	if first := a.state.Sessions[0].Start; first > from {
+		from = first
+	}
+	s := &availabilitySummary{
+		Period:          period.String(),
+		Uptime:          1,
+		RPCAvailability: 1,
+	}
+
+	var up, rpcDown int64
+	for i, w := range a.state.Sessions {
+		if i == a.session {
+			// The current session is running now.
+			w.End = 0
+		}
+		up += w.overlap(from, to)
+	}
+	for _, w := range a.state.RPCOutages {
+		if d := w.overlap(from, to); d > 0 {
+			rpcDown += d
+			s.RPCOutages++
+		}
+	}
+	for _, m := range a.state.MissedBlocks {
+		if m.Detected >= from {
+			s.MissedBlocks += m.To - m.From + 1
+		}
+	}
+
+	if total := to - from; total > 0 {
+		s.Uptime = float64(up) / float64(total)
+	}
+	if up > 0 {
+		s.RPCAvailability = 1 - float64(rpcDown)/float64(up)
+	}
+	return s
+}
+
+// save updates the end of the current session and writes the history to the
+// file, dropping windows older than the retention period.
+func (a *availabilityTracker) save() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	now := time.Now().Unix()
+	a.state.Sessions[a.session].End = now
+
+	cutoff := now - int64(availabilityRetention/time.Second)
+	var sessions []timeWindow
+	for i, w := range a.state.Sessions {
+		if w.End >= cutoff || i == a.session {
+			sessions = append(sessions, w)
+		}
+	}
+	a.session = len(sessions) - 1
+	a.state.Sessions = sessions
+	var outages []timeWindow
+	for _, w := range a.state.RPCOutages {
+		if w.End == 0 || w.End >= cutoff {
+			outages = append(outages, w)
+		}
+	}
+	a.state.RPCOutages = outages
+	var missed []missedBlocks
+	for _, m := range a.state.MissedBlocks {
+		if m.Detected >= cutoff {
+			missed = append(missed, m)
+		}
+	}
+	a.state.MissedBlocks = missed
+
+	b, err := json.MarshalIndent(&a.state, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// run probes dcrd RPC and saves the history at availabilityProbeInterval
+// until quit is closed.  It should be run as a goroutine.
+func (a *availabilityTracker) run(dcrd *dcrrpcclient.Client,
+	wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(availabilityProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// A dcrd that does not respond is unavailable.
+			err := withRPCTimeout("getblockcount", func() error {
+				_, err := dcrd.GetBlockCount()
+				return err
+			})
+			a.rpcStatus(err)
+			if err = a.save(); err != nil {
+				log.Errorf("Failed to save availability history: %v", err)
+			}
+		case <-quit:
+			if err := a.save(); err != nil {
+				log.Errorf("Failed to save availability history: %v", err)
+			}
+			log.Debugf("Quitting availability tracker.")
+			return
+		}
+	}
+}
+
+// statusResponse is the response of the status API.
+type statusResponse struct {
+	Started      int64                  `json:"started"`
+	Uptime       int64                  `json:"uptime"`
+	RPCAvailable bool                   `json:"rpcavailable"`
+	LastHeight   int64                  `json:"lastheight"`
+	NodeIndexes  *nodeIndexes           `json:"nodeindexes"`
+	Availability []*availabilitySummary `json:"availability"`
+	Alerts       []*firingAlert         `json:"alerts,omitempty"`
+	Errors       []*errorStatus         `json:"errors,omitempty"`
+}
+
+// statusAPI documents statusHandler.
+var statusAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "Get the status and availability",
+	response: statusResponse{},
+}}
+
+// statusHandler serves GET /status with the current status, availability
+// summaries for the last day, week and 30 days, and, except to tenants, the
+// firing alerts and the last error of each collector, saver and notifier.
+func (a *availabilityTracker) statusHandler(w http.ResponseWriter, r *http.Request,
+	t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.mtx.Lock()
+	lastHeight := a.state.LastHeight
+	a.mtx.Unlock()
+	resp := &statusResponse{
+		Started:      a.started.Unix(),
+		Uptime:       int64(time.Since(a.started) / time.Second),
+		RPCAvailable: !a.rpcDown(),
+		LastHeight:   lastHeight,
+		NodeIndexes:  spyNodeIndexes,
+	}
+	for _, p := range []time.Duration{24 * time.Hour, 7 * 24 * time.Hour,
+		availabilityRetention} {
+		resp.Availability = append(resp.Availability, a.summary(p))
+	}
+	// The alerts and errors may concern the operator's addresses.
+	if t == nil {
+		resp.Alerts = currentAlerts()
+		resp.Errors = spyErrors.lastErrors()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,155 @@
+// bestblock.go serves the latest saved block data and stake info at
+// /block/best and /stakeinfo/current, which dashboards poll.  The responses
+// have an ETag, derived from their content, and a Last-Modified time, that of
+// the saved file, so that a client or proxy revalidating its copy with
+// If-None-Match or If-Modified-Since gets 304 Not Modified until the next
+// block is saved.
+
+package spy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bestBlockAPI documents bestBlockHandler.
+var bestBlockAPI = []apiOperation{{
+	method:  "GET",
+	summary: "Get the block data of the latest saved height",
+	description: "Supports conditional requests with If-None-Match and " +
+		"If-Modified-Since.",
+	response: storedBlockData{},
+}}
+
+// bestBlockHandler serves GET /block/best with the block data saved for the
+// latest height.
+func bestBlockHandler(outFolder string) tenantHandler {
+	return func(w http.ResponseWriter, r *http.Request, t *tenant) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		height, err := spyDataCache.latestHeight(outFolder,
+			blockDataFilePrefix)
+		if err != nil {
+			http.Error(w, "no saved block data", http.StatusNotFound)
+			return
+		}
+		data, err := spyDataCache.blockData(outFolder, height)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeConditionalJSON(w, r, data, storedFileModTime(outFolder,
+			blockDataFilePrefix, height))
+	}
+}
+
+// currentStakeInfoAPI documents currentStakeInfoHandler.
+var currentStakeInfoAPI = []apiOperation{{
+	method:  "GET",
+	summary: "Get the stake info of the latest saved height",
+	description: "Supports conditional requests with If-None-Match and " +
+		"If-Modified-Since.",
+	response: storedStakeInfoData{},
+}}
+
+// currentStakeInfoHandler serves GET /stakeinfo/current with the stake info
+// saved for the latest height.  It is not available to tenants.
+func currentStakeInfoHandler(outFolder string) tenantHandler {
+	return func(w http.ResponseWriter, r *http.Request, t *tenant) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if t != nil {
+			http.Error(w, "wallet data is not available to tenants",
+				http.StatusForbidden)
+			return
+		}
+		height, err := spyDataCache.latestHeight(outFolder,
+			stakeInfoFilePrefix)
+		if err != nil {
+			http.Error(w, "no saved stake info", http.StatusNotFound)
+			return
+		}
+		data, err := spyDataCache.stakeInfoData(outFolder, height)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeConditionalJSON(w, r, data, storedFileModTime(outFolder,
+			stakeInfoFilePrefix, height))
+	}
+}
+
+// storedFileModTime returns the modification time of the file with the prefix
+// and height in folder, or the zero time if unknown.
+func storedFileModTime(folder, prefix string, height int64) time.Time {
+	fi, err := os.Stat(filepath.Join(folder, fmt.Sprintf("%s%d.json", prefix,
+		height)))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// writeConditionalJSON writes v as JSON with its ETag and the Last-Modified
+// time modTime (unless zero), or 304 Not Modified if the request's
+// If-None-Match or If-Modified-Since matches.  Clients must revalidate.
+func writeConditionalJSON(w http.ResponseWriter, r *http.Request,
+	v interface{}, modTime time.Time) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "no-cache")
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, modTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// notModified returns whether the request's validators match the ETag or the
+// modification time.  If-Modified-Since is ignored if If-None-Match is given
+// (RFC 7232).
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			// The weak comparison applies to GET and HEAD.
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a resolution of a second.
+	return !modTime.Truncate(time.Second).After(t)
+}
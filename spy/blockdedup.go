@@ -0,0 +1,67 @@
+// blockdedup.go suppresses duplicate block connected notifications.  dcrd may
+// deliver the notification of a block again, e.g. after the RPC client
+// reconnects, and the collector, savers and notifiers must process each block
+// once.  A block disconnected by a reorg may be connected again, so it is
+// forgotten when its disconnected notification is received.
+
+package spy
+
+import (
+	"sync"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+)
+
+// blockDedupWindow is the number of recently connected block hashes kept.
+const blockDedupWindow = 64
+
+// blockDeduper remembers the hashes of the recently connected blocks.
+type blockDeduper struct {
+	mtx  sync.Mutex
+	seen map[chainhash.Hash]struct{}
+	// recent is a ring of the hashes in seen, the oldest at next once full.
+	recent     []chainhash.Hash
+	next       int
+	duplicates *metricCounter
+}
+
+// spyBlockDedup is the package-level block notification deduplicator.
+var spyBlockDedup = newBlockDeduper(blockDedupWindow)
+
+// newBlockDeduper creates a blockDeduper keeping the last window hashes.
+func newBlockDeduper(window int) *blockDeduper {
+	return &blockDeduper{
+		seen:   make(map[chainhash.Hash]struct{}, window),
+		recent: make([]chainhash.Hash, 0, window),
+		duplicates: spyMetrics.newCounter("dcrspy_duplicate_blocks_total",
+			"Block connected notifications suppressed as duplicates."),
+	}
+}
+
+// connected records the connected block's hash, returning false if it is a
+// duplicate of a recent notification.
+func (d *blockDeduper) connected(hash *chainhash.Hash) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.seen[*hash]; ok {
+		d.duplicates.inc()
+		return false
+	}
+	if len(d.recent) < cap(d.recent) {
+		d.recent = append(d.recent, *hash)
+	} else {
+		delete(d.seen, d.recent[d.next])
+		d.recent[d.next] = *hash
+		d.next = (d.next + 1) % len(d.recent)
+	}
+	d.seen[*hash] = struct{}{}
+	return true
+}
+
+// disconnected forgets the disconnected block's hash, so that its next
+// connected notification is processed.  Its slot in recent is left to expire.
+func (d *blockDeduper) disconnected(hash *chainhash.Hash) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.seen, *hash)
+}
@@ -0,0 +1,111 @@
+// blockext.go provides extension hooks for the per-block data.  Additional
+// collectors register a BlockDataExtension, and the named section it returns
+// for each block is attached to the blockData and serialized generically by
+// all of the savers, so new metrics do not require changes to each saver.
+
+package spy
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/decred/dcrd/dcrjson"
+	"github.com/decred/dcrrpcclient"
+)
+
+// BlockDataExtension is implemented by collectors of additional per-block
+// data.
+type BlockDataExtension interface {
+	// Name is the name of the section, used as its key in the JSON output.
+	Name() string
+	// Collect returns the section data for the block with the given header.
+	// The data must be encodable as JSON.
+	Collect(dcrd *dcrrpcclient.Client,
+		header *dcrjson.GetBlockHeaderVerboseResult) (interface{}, error)
+}
+
+// blockDataSection is the data collected by an extension for a block.
+type blockDataSection struct {
+	name string
+	data interface{}
+}
+
+// reservedSectionNames are the keys of the built-in block data sections.
+var reservedSectionNames = map[string]bool{
+	"estimatestakediff":   true,
+	"currentstakediff":    true,
+	"ticketfeeinfo_block": true,
+	"block_header":        true,
+	"ticket_pool_info":    true,
+	"coin_supply":         true,
+	derivedMetricsSection: true,
+}
+
+var (
+	blockDataExtensionsMtx sync.RWMutex
+	blockDataExtensions    []BlockDataExtension
+)
+
+// RegisterBlockDataExtension registers an extension to be collected with each
+// block.  Sections are output in the order the extensions were registered.
+// An error is returned if the name is empty, or is already used by a built-in
+// section or another extension.
+func RegisterBlockDataExtension(ext BlockDataExtension) error {
+	blockDataExtensionsMtx.Lock()
+	defer blockDataExtensionsMtx.Unlock()
+	if err := checkExtensionName(ext.Name(), blockDataExtensions); err != nil {
+		return err
+	}
+	blockDataExtensions = append(blockDataExtensions, ext)
+	log.Debugf("Registered block data extension %s", ext.Name())
+	return nil
+}
+
+// checkExtensionName returns an error if the name of an extension is empty,
+// or is already used by a built-in section or one of the extensions exts.
+func checkExtensionName(name string, exts []BlockDataExtension) error {
+	if name == "" {
+		return fmt.Errorf("block data extension name is empty")
+	}
+	if reservedSectionNames[name] {
+		return fmt.Errorf("block data section name %s is reserved", name)
+	}
+	for _, e := range exts {
+		if e.Name() == name {
+			return fmt.Errorf("block data extension %s already registered",
+				name)
+		}
+	}
+	return nil
+}
+
+// registeredBlockDataExtensions returns the registered extensions.
+func registeredBlockDataExtensions() []BlockDataExtension {
+	blockDataExtensionsMtx.RLock()
+	defer blockDataExtensionsMtx.RUnlock()
+	exts := make([]BlockDataExtension, len(blockDataExtensions))
+	copy(exts, blockDataExtensions)
+	return exts
+}
+
+// collectExtensions collects the sections of all registered extensions, then
+// of the run's extensions, runExts, for the block.  A failing extension is
+// logged and its section omitted, so that it does not prevent saving the rest
+// of the block data.
+func collectExtensions(dcrd *dcrrpcclient.Client,
+	header *dcrjson.GetBlockHeaderVerboseResult,
+	runExts []BlockDataExtension) []blockDataSection {
+	exts := append(registeredBlockDataExtensions(), runExts...)
+	var sections []blockDataSection
+	for _, ext := range exts {
+		data, err := ext.Collect(dcrd, header)
+		if err != nil {
+			log.Warnf("Block data extension %s failed for block %d: %v",
+				ext.Name(), header.Height,
+				reportError(errKindCollector, ext.Name(), err))
+			continue
+		}
+		sections = append(sections, blockDataSection{ext.Name(), data})
+	}
+	return sections
+}
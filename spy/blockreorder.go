@@ -0,0 +1,130 @@
+// blockreorder.go dispatches block connected notifications to the monitors in
+// order of height.  Notifications may arrive out of order, e.g. in races
+// around a reconnect, and the stored history must remain monotonic.  A block
+// more than one above the last dispatched height is held for up to the reorder
+// window, waiting for the blocks below it.  When they arrive, they and the
+// held blocks are dispatched in order of height; when the window expires, the
+// held blocks are dispatched in order regardless of the gap.  A block at or
+// below the next height, as in a reorg, is dispatched immediately.
+
+package spy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+)
+
+// heldBlock is a block held until the blocks below it arrive.
+type heldBlock struct {
+	hash   chainhash.Hash
+	height int32
+}
+
+// heldBlocksByHeight sorts held blocks by height.
+type heldBlocksByHeight []*heldBlock
+
+func (b heldBlocksByHeight) Len() int           { return len(b) }
+func (b heldBlocksByHeight) Less(i, j int) bool { return b[i].height < b[j].height }
+func (b heldBlocksByHeight) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// blockReorderer holds out of order blocks and dispatches blocks in order of
+// height.
+type blockReorderer struct {
+	mtx      sync.Mutex
+	window   time.Duration
+	dispatch func(hash *chainhash.Hash, height int32)
+	// last is the height of the last dispatched block, 0 if none.
+	last    int32
+	held    heldBlocksByHeight
+	timer   *time.Timer
+	stopped bool
+}
+
+// spyBlockReorder is the package-level block reorderer of the dcrd
+// notifications, nil if the RPC client was not created.
+var spyBlockReorder *blockReorderer
+
+// newBlockReorderer creates a blockReorderer calling dispatch for each block
+// in order of height, holding blocks for up to window.  A zero window
+// dispatches each block immediately.
+func newBlockReorderer(window time.Duration,
+	dispatch func(hash *chainhash.Hash, height int32)) *blockReorderer {
+	return &blockReorderer{
+		window:   window,
+		dispatch: dispatch,
+	}
+}
+
+// connected dispatches the connected block, or holds it if the blocks below
+// it have not arrived.
+func (r *blockReorderer) connected(hash *chainhash.Hash, height int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.stopped {
+		return
+	}
+	if r.window == 0 || r.last == 0 || height <= r.last+1 {
+		r.dispatchLocked(hash, height)
+		r.dispatchHeldLocked(false)
+		return
+	}
+
+	log.Infof("Block %v (height %d) arrived before height %d. Holding it "+
+		"for up to %v.", hash, height, r.last+1, r.window)
+	r.held = append(r.held, &heldBlock{*hash, height})
+	sort.Stable(r.held)
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.window, r.expire)
+	}
+}
+
+// expire dispatches the held blocks when the reorder window expires.
+func (r *blockReorderer) expire() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.timer = nil
+	if r.stopped || len(r.held) == 0 {
+		return
+	}
+	log.Warnf("Blocks below height %d did not arrive within %v. "+
+		"Dispatching the held blocks.", r.held[0].height, r.window)
+	r.dispatchHeldLocked(true)
+}
+
+// dispatchLocked dispatches the block.  The mutex must be held.
+func (r *blockReorderer) dispatchLocked(hash *chainhash.Hash, height int32) {
+	r.last = height
+	r.dispatch(hash, height)
+}
+
+// dispatchHeldLocked dispatches the held blocks that are next in height, or
+// all of them if force is true.  The mutex must be held.
+func (r *blockReorderer) dispatchHeldLocked(force bool) {
+	for len(r.held) > 0 && (force || r.held[0].height <= r.last+1) {
+		b := r.held[0]
+		r.held = r.held[1:]
+		r.dispatchLocked(&b.hash, b.height)
+	}
+	if len(r.held) == 0 && r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// stop drops the held blocks and dispatches no more blocks.
+func (r *blockReorderer) stop() {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.stopped = true
+	r.held = nil
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
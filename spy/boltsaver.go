@@ -0,0 +1,280 @@
+// boltsaver.go implements the Bolt savers, which store each block's data and
+// its stake info in an embedded Bolt key/value database in the output folder
+// (dcrspy.bolt), without an external database or a C compiler.  The database
+// is also dcrspy's own state store: it records the last processed block
+// height, reported on startup with the number of blocks connected while
+// dcrspy was stopped, and the watched transaction outputs already notified in
+// mempool, so that they are not notified again after a restart, even if the
+// mempool state is lost.
+//
+// The data are in buckets keyed by the big-endian block height, so that they
+// are iterated in order of height, with the JSON document of the block data
+// or stake info as the value.  A block stored again at the same height, e.g.
+// after a reorganization, replaces the previous one.  Block data and stake
+// info are put in batches from the saver's write-ahead log (see dbwal.go).
+
+package spy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// boltFileName is the name of the database file in the output folder.
+	boltFileName = "dcrspy.bolt"
+	// boltSchemaVersion is the version of the buckets and their keys.
+	boltSchemaVersion = 1
+	// boltOpenTimeout is how long to wait for the lock of a database in use,
+	// e.g. by another dcrspy.
+	boltOpenTimeout = 5 * time.Second
+	// seenTxExpiry is the time after which a notified transaction output is
+	// forgotten.
+	seenTxExpiry = 30 * 24 * time.Hour
+)
+
+// Buckets, and keys of the meta bucket
+var (
+	boltMetaBucket      = []byte("meta")
+	boltBlocksBucket    = []byte("blocks")
+	boltStakeInfoBucket = []byte("stake_info")
+	boltSeenTxsBucket   = []byte("seen_txs")
+
+	boltVersionKey    = []byte("version")
+	boltLastHeightKey = []byte("lastheight")
+)
+
+// boltStore is a Bolt database of block data and stake info, and of dcrspy's
+// state.
+type boltStore struct {
+	db   *bolt.DB
+	path string
+	wal  *dbWAL
+}
+
+// spyBolt is the package-level Bolt database, nil if disabled.
+var spyBolt *boltStore
+
+// newBoltStore opens the database at path, creating it and its buckets if
+// needed, and its write-ahead log.  Notified transaction outputs older than
+// seenTxExpiry are pruned.
+func newBoltStore(path string, walCfg dbWALConfig) (*boltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: boltOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use by another process", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStore{db: db, path: path}
+	if err = s.createBuckets(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the buckets of %s: %v", path,
+			err)
+	}
+	if err = s.pruneSeen(time.Now().Add(-seenTxExpiry)); err != nil {
+		log.Warnf("Unable to prune notified transactions in %s: %v", path,
+			err)
+	}
+	if s.wal, err = openDBWAL(walCfg, "bolt", s.insert, nil); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open the write-ahead log %s: %v",
+			walCfg.path, err)
+	}
+	return s, nil
+}
+
+// createBuckets creates the buckets of a new database, and checks the version
+// of an existing one.
+func (s *boltStore) createBuckets() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(boltVersionKey); v != nil {
+			version := binary.BigEndian.Uint32(v)
+			if version > boltSchemaVersion {
+				return fmt.Errorf("schema version %d is newer than this "+
+					"dcrspy's (%d)", version, boltSchemaVersion)
+			}
+			return nil
+		}
+		for _, name := range [][]byte{boltBlocksBucket, boltStakeInfoBucket,
+			boltSeenTxsBucket} {
+			if _, err = tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, boltSchemaVersion)
+		return meta.Put(boltVersionKey, v)
+	})
+}
+
+// heightKey returns the key of the block height.
+func heightKey(height uint32) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(height))
+	return k
+}
+
+// lastHeight returns the last processed block height, or false if none was
+// recorded.
+func (s *boltStore) lastHeight() (int64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	var height int64
+	var ok bool
+	s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMetaBucket).Get(boltLastHeightKey); v != nil {
+			height, ok = int64(binary.BigEndian.Uint64(v)), true
+		}
+		return nil
+	})
+	return height, ok
+}
+
+// markSeen records that the transaction output was notified, returning false
+// if it already was.
+func (s *boltStore) markSeen(txid string, vout int) bool {
+	if s == nil {
+		return true
+	}
+	key := []byte(pendingKey(txid, vout))
+	added := true
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSeenTxsBucket)
+		if b.Get(key) != nil {
+			added = false
+			return nil
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(time.Now().Unix()))
+		return b.Put(key, v)
+	})
+	if err != nil {
+		log.Errorf("Unable to record notified transaction %s in %s: %v",
+			key, s.path, reportError(errKindSaver, "bolt", err))
+	}
+	return added
+}
+
+// pruneSeen forgets the notified transaction outputs recorded before cutoff.
+func (s *boltStore) pruneSeen(cutoff time.Time) error {
+	var pruned int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSeenTxsBucket)
+		// Keys are not deleted while iterating, which would skip some.
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if len(v) != 8 ||
+				int64(binary.BigEndian.Uint64(v)) < cutoff.Unix() {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(expired)
+		return nil
+	})
+	if err == nil && pruned > 0 {
+		log.Debugf("Pruned %d notified transaction output(s) from %s.",
+			pruned, s.path)
+	}
+	return err
+}
+
+// insert puts the records in one transaction, recording the height of the
+// last block as the last processed one.
+func (s *boltStore) insert(records []*walRecord) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, r := range records {
+			bucket := boltStakeInfoBucket
+			if r.Kind == walBlockRecord {
+				bucket = boltBlocksBucket
+			}
+			key := heightKey(r.Height)
+			if err := tx.Bucket(bucket).Put(key, []byte(r.Data)); err != nil {
+				return err
+			}
+			if r.Kind != walBlockRecord {
+				continue
+			}
+			if err := tx.Bucket(boltMetaBucket).Put(boltLastHeightKey,
+				key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		err = reportError(errKindSaver, "bolt", err)
+		log.Errorf("Unable to store %d record(s) in %s: %v", len(records),
+			s.path, err)
+	}
+	return err
+}
+
+// close commits the write-ahead log and closes the database, and signs the
+// database file, which is consistent once closed.
+func (s *boltStore) close() error {
+	if s == nil {
+		return nil
+	}
+	if err := s.wal.close(); err != nil {
+		log.Errorf("Failed to close the write-ahead log %s: %v", s.wal.cfg.path,
+			err)
+	}
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	signStoredFile(s.path)
+	return nil
+}
+
+// BlockDataToBolt implements BlockDataSaver interface for output to a Bolt
+// database
+type BlockDataToBolt struct {
+	*boltStore
+}
+
+// NewBlockDataToBolt creates a new BlockDataToBolt saving to the database
+func NewBlockDataToBolt(s *boltStore) *BlockDataToBolt {
+	return &BlockDataToBolt{s}
+}
+
+// Store logs the blockData for insertion, replacing a block stored at its
+// height, and recording its height as the last processed one
+func (s *BlockDataToBolt) Store(data *blockData) error {
+	return s.wal.storeBlock(data)
+}
+
+// StakeInfoDataToBolt implements StakeInfoDataSaver interface for output to a
+// Bolt database
+type StakeInfoDataToBolt struct {
+	*boltStore
+}
+
+// NewStakeInfoDataToBolt creates a new StakeInfoDataToBolt saving to the
+// database
+func NewStakeInfoDataToBolt(s *boltStore) *StakeInfoDataToBolt {
+	return &StakeInfoDataToBolt{s}
+}
+
+// Store logs the stakeInfoData for insertion, replacing stake info stored at
+// its height
+func (s *StakeInfoDataToBolt) Store(data *stakeInfoData) error {
+	return s.wal.storeStakeInfo(data)
+}
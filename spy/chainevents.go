@@ -0,0 +1,152 @@
+// chainevents.go detects notable chain events from the block data of
+// consecutive blocks: chain reorganizations, proof-of-work and stake
+// difficulty retargets, and changes in the status of consensus agendas (e.g.
+// activations).  Chain events are published as events of type chain, and sent
+// to Grafana as annotations if configured.  Each new block is also published,
+// for webhooks, but not annotated, and may be posted to Slack.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/decred/dcrrpcclient"
+)
+
+// Event type for chain events, and their actions.
+const (
+	eventTypeChain = "chain"
+
+	eventActionNewBlock      = "block"
+	eventActionReorg         = "reorg"
+	eventActionPoWRetarget   = "powretarget"
+	eventActionStakeRetarget = "stakeretarget"
+	eventActionAgendaStatus  = "agendastatus"
+)
+
+// voteInfoAgenda is an agenda in the result of getvoteinfo.
+type voteInfoAgenda struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+}
+
+// chainEventDetector compares the block data of each block with that of the
+// previous block.
+type chainEventDetector struct {
+	dcrd *dcrrpcclient.Client
+	prev *blockData
+	// agendaStatus is the last status of each agenda.
+	agendaStatus map[string]string
+}
+
+// spyChainEvents is the package-level chain event detector, nil if not
+// monitoring.
+var spyChainEvents *chainEventDetector
+
+// newChainEventDetector creates a chainEventDetector.
+func newChainEventDetector(dcrd *dcrrpcclient.Client) *chainEventDetector {
+	return &chainEventDetector{
+		dcrd:         dcrd,
+		agendaStatus: make(map[string]string),
+	}
+}
+
+// blockConnected publishes the chain events between the previous block and
+// the block of data.
+func (c *chainEventDetector) blockConnected(data *blockData) {
+	if c == nil {
+		return
+	}
+	cur, prev := &data.header, c.prev
+	height := int64(cur.Height)
+	publish := func(action, format string, args ...interface{}) {
+		e := &spyEvent{
+			Time:    cur.Time,
+			Type:    eventTypeChain,
+			Action:  action,
+			Height:  height,
+			Message: fmt.Sprintf(format, args...),
+		}
+		log.Infof("Chain event: %s", e.Message)
+		publishEvent(e)
+		spyGrafana.annotate(e)
+		if err := spyMatrix.Notify(e); err != nil {
+			log.Warnf("Failed to post chain event to Matrix: %v", err)
+		}
+	}
+
+	newBlock := &spyEvent{
+		Time:    cur.Time,
+		Type:    eventTypeChain,
+		Action:  eventActionNewBlock,
+		Height:  height,
+		Message: fmt.Sprintf("Block %d (%s) connected.", height, cur.Hash),
+	}
+	publishEvent(newBlock)
+	if err := spyMatrix.Notify(newBlock); err != nil {
+		log.Warnf("Failed to post new block to Matrix: %v", err)
+	}
+	spyDesktop.notifyBlock(newBlock)
+	spySlack.notifyBlock(newBlock)
+
+	if prev != nil {
+		if cur.PreviousHash != prev.header.Hash {
+			publish(eventActionReorg, "Chain reorganization at height %d: "+
+				"block %s replaces the tip %s (height %d).", height, cur.Hash,
+				prev.header.Hash, prev.header.Height)
+		}
+		if cur.Difficulty != prev.header.Difficulty {
+			publish(eventActionPoWRetarget, "PoW difficulty retarget at "+
+				"height %d: %.0f to %.0f (%+.2f%%).", height,
+				prev.header.Difficulty, cur.Difficulty,
+				100*(cur.Difficulty/prev.header.Difficulty-1))
+		}
+		if cur.SBits != prev.header.SBits {
+			publish(eventActionStakeRetarget, "Ticket price retarget at "+
+				"height %d: %.8f to %.8f DCR (window %d).", height,
+				prev.header.SBits, cur.SBits, data.priceWindowNum)
+		}
+	}
+	c.prev = data
+
+	c.checkAgendas(publish)
+}
+
+// checkAgendas queries the status of the agendas of the network's consensus
+// deployments, publishing an event for each status change since the last
+// check.  The first check records the statuses.
+func (c *chainEventDetector) checkAgendas(publish func(action, format string,
+	args ...interface{})) {
+	versions := make([]int, 0, len(activeChain.Deployments))
+	for v := range activeChain.Deployments {
+		versions = append(versions, int(v))
+	}
+	sort.Ints(versions)
+
+	for _, v := range versions {
+		param, _ := json.Marshal(v)
+		res, err := c.dcrd.RawRequest("getvoteinfo", []json.RawMessage{param})
+		if err != nil {
+			log.Debugf("getvoteinfo %d failed: %v", v, err)
+			continue
+		}
+		var info struct {
+			Agendas []voteInfoAgenda `json:"agendas"`
+		}
+		if err = json.Unmarshal(res, &info); err != nil {
+			log.Warnf("Unable to decode getvoteinfo result: %v", err)
+			continue
+		}
+		for _, a := range info.Agendas {
+			last, seen := c.agendaStatus[a.ID]
+			c.agendaStatus[a.ID] = a.Status
+			if seen && last != a.Status {
+				publish(eventActionAgendaStatus, "Agenda %s (%s) is %s, "+
+					"was %s.", a.ID, a.Description, a.Status, last)
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// chainhalt.go detects a chain halt: no new block for longer than expected
+// while the votes needed to build on the tip are missing from mempool.  Without
+// votes from a majority of the tickets called to vote on the tip, miners cannot
+// extend the chain however much hash power they have, so the chain stays halted
+// until the votes appear.  A halt raises a critical alert on every channel.  A
+// tip that merely ages with its votes present is only a slow block, which
+// raises an ordinary alert.
+
+package spy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/wire"
+	"github.com/decred/dcrrpcclient"
+)
+
+// Actions for eventTypeChain events from the chain halt detector.
+const (
+	eventActionSlowBlock    = "slowblock"
+	eventActionChainHalted  = "halted"
+	eventActionChainResumed = "resumed"
+)
+
+// Keys of the alert states of the chain halt detector.
+const (
+	slowBlockAlert   = "chain:slowblock"
+	chainHaltedAlert = "chain:halted"
+)
+
+// chainHaltCheckInterval is the interval between checks of the tip age.
+const chainHaltCheckInterval = 30 * time.Second
+
+// Tip states of chainHaltDetector, each alerted once per tip.
+const (
+	tipStateOK = iota
+	tipStateSlow
+	tipStateHalted
+)
+
+// chainHaltDetector watches the age of the tip and, once it exceeds maxAge,
+// the votes for the tip in mempool.
+type chainHaltDetector struct {
+	mtx    sync.Mutex
+	dcrd   *dcrrpcclient.Client
+	maxAge time.Duration
+	// tip is the last connected block, and tipTime its timestamp.
+	tip       chainhash.Hash
+	tipHeight int64
+	tipTime   time.Time
+	state     int
+}
+
+// spyChainHalt is the package-level chain halt detector, nil if not enabled.
+var spyChainHalt *chainHaltDetector
+
+// newChainHaltDetector creates a chainHaltDetector that checks the votes for
+// the tip once it is older than maxAge.
+func newChainHaltDetector(dcrd *dcrrpcclient.Client,
+	maxAge time.Duration) *chainHaltDetector {
+	h := &chainHaltDetector{
+		dcrd:   dcrd,
+		maxAge: maxAge,
+	}
+	spyMetrics.newGauge("dcrspy_tip_age_seconds",
+		"Time since the timestamp of the best block.", func() float64 {
+			h.mtx.Lock()
+			defer h.mtx.Unlock()
+			if h.tipTime.IsZero() {
+				return 0
+			}
+			return time.Since(h.tipTime).Seconds()
+		})
+	spyMetrics.newGauge("dcrspy_chain_halted",
+		"1 if the chain is halted for lack of votes, 0 otherwise.",
+		func() float64 {
+			h.mtx.Lock()
+			defer h.mtx.Unlock()
+			if h.state == tipStateHalted {
+				return 1
+			}
+			return 0
+		})
+	return h
+}
+
+// blockConnected records the new tip, sending a recovery notification if the
+// chain was halted or the block was slow.
+func (h *chainHaltDetector) blockConnected(hash *chainhash.Hash, height int64,
+	blockTime time.Time) {
+	if h == nil {
+		return
+	}
+	h.mtx.Lock()
+	wasHalted := h.state == tipStateHalted
+	prevTipTime := h.tipTime
+	h.tip, h.tipHeight, h.tipTime = *hash, height, blockTime
+	h.state = tipStateOK
+	h.mtx.Unlock()
+
+	if wasHalted {
+		e := &spyEvent{
+			Type:   eventTypeChain,
+			Action: eventActionChainResumed,
+			Height: height,
+			Message: fmt.Sprintf("Chain resumed with block %d (%v) after "+
+				"%v.", height, hash, blockTime.Sub(prevTipTime)),
+		}
+		resolveAlert(chainHaltedAlert, "%s", e.Message)
+		publishEvent(e)
+		spyGrafana.annotate(e)
+		return
+	}
+	resolveAlert(slowBlockAlert, "Block %d (%v) connected after %v.", height,
+		hash, blockTime.Sub(prevTipTime))
+}
+
+// check alerts if the tip is older than maxAge, critically if its votes are
+// missing.
+func (h *chainHaltDetector) check() {
+	h.mtx.Lock()
+	tip, height, tipTime, state := h.tip, h.tipHeight, h.tipTime, h.state
+	h.mtx.Unlock()
+	age := time.Since(tipTime)
+	if tipTime.IsZero() || age < h.maxAge || state == tipStateHalted {
+		return
+	}
+
+	votes, err := countMempoolVotes(h.dcrd, tip)
+	if err != nil {
+		log.Errorf("Unable to count mempool votes for block %d: %v", height,
+			err)
+		return
+	}
+	majority := int(activeChain.TicketsPerBlock)/2 + 1
+	age = age - age%time.Second
+
+	e := &spyEvent{
+		Type:   eventTypeChain,
+		Height: height,
+	}
+	if votes < majority {
+		e.Action = eventActionChainHalted
+		e.Message = fmt.Sprintf("Chain halted: no block for %v since block "+
+			"%d (%v), which has only %d of the %d votes required to extend "+
+			"the chain.", age, height, tip, votes, majority)
+		if !h.setState(tip, tipStateHalted) {
+			return
+		}
+		// The halt supersedes the slow block alert.
+		clearAlert(slowBlockAlert)
+		fireCriticalAlert(chainHaltedAlert, "chain halted", e)
+		return
+	}
+	if state != tipStateOK || !h.setState(tip, tipStateSlow) {
+		return
+	}
+	e.Action = eventActionSlowBlock
+	e.Message = fmt.Sprintf("No block for %v since block %d (%v), which has "+
+		"%d votes in mempool.", age, height, tip, votes)
+	fireAlert(slowBlockAlert, "slow block", "%s", e.Message)
+	publishEvent(e)
+	spyGrafana.annotate(e)
+}
+
+// setState sets the state of the tip, returning false if the tip changed
+// since it was checked.
+func (h *chainHaltDetector) setState(tip chainhash.Hash, state int) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.tip != tip {
+		return false
+	}
+	h.state = state
+	return true
+}
+
+// run records the current tip and checks it every chainHaltCheckInterval
+// until quit is closed.  It should be run as a goroutine.
+func (h *chainHaltDetector) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	// Start from the current tip, so that a halt in progress is detected.
+	hash, height, err := h.dcrd.GetBestBlock()
+	if err == nil {
+		var header *wire.BlockHeader
+		header, err = h.dcrd.GetBlockHeader(hash)
+		if err == nil {
+			h.mtx.Lock()
+			if h.tipTime.IsZero() {
+				h.tip, h.tipHeight, h.tipTime = *hash, height, header.Timestamp
+			}
+			h.mtx.Unlock()
+		}
+	}
+	if err != nil {
+		log.Warnf("Unable to get the best block for chain halt detection: %v",
+			err)
+	}
+
+	ticker := time.NewTicker(chainHaltCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.check()
+		case <-quit:
+			log.Debugf("Quitting chain halt detector.")
+			return
+		}
+	}
+}
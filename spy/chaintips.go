@@ -0,0 +1,67 @@
+// chaintips.go implements the chaintips collector plugin, which collects the
+// tips of the block tree known to dcrd with getchaintips, showing the side
+// chains of recent reorganizations and orphaned blocks.
+
+package spy
+
+import (
+	"encoding/json"
+
+	"github.com/decred/dcrrpcclient"
+)
+
+func init() {
+	registerCollector("chaintips", func(dcrd *dcrrpcclient.Client) Collector {
+		return &chainTipsCollector{dcrd}
+	})
+}
+
+// chainTip is a tip in the result of getchaintips.
+type chainTip struct {
+	Height    int64  `json:"height"`
+	Hash      string `json:"hash"`
+	BranchLen int64  `json:"branchlen"`
+	Status    string `json:"status"`
+}
+
+// chainTips is the section of the chaintips collector.
+type chainTips struct {
+	// SideChains is the number of tips other than the active one, and
+	// LongestBranch the length of the longest of their branches.
+	SideChains    int        `json:"sidechains"`
+	LongestBranch int64      `json:"longestbranch"`
+	Tips          []chainTip `json:"tips"`
+}
+
+// chainTipsCollector collects the chain tips.
+type chainTipsCollector struct {
+	dcrd *dcrrpcclient.Client
+}
+
+// Name returns the name of the section.
+func (c *chainTipsCollector) Name() string {
+	return "chaintips"
+}
+
+// Collect returns the chain tips.  The tips are those at the time of the call,
+// which may be after the block height.
+func (c *chainTipsCollector) Collect(height uint32) (interface{}, error) {
+	res, err := c.dcrd.RawRequest("getchaintips", nil)
+	if err != nil {
+		return nil, err
+	}
+	var tips chainTips
+	if err = json.Unmarshal(res, &tips.Tips); err != nil {
+		return nil, err
+	}
+	for _, t := range tips.Tips {
+		if t.Status == "active" {
+			continue
+		}
+		tips.SideChains++
+		if t.BranchLen > tips.LongestBranch {
+			tips.LongestBranch = t.BranchLen
+		}
+	}
+	return &tips, nil
+}
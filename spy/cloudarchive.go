@@ -0,0 +1,546 @@
+// cloudarchive.go implements the cloud archive, which uploads a daily batch of
+// the collected data to an S3 or GCS bucket, for cheap long-term archival.
+// After each UTC day, the CSV files of the day (see csvsaver.go) and the JSON
+// files saved during it (see datasaver.go) are bundled in a gzipped tar file,
+// uploaded as PREFIXNETWORK/YYYY-MM-DD.tar.gz.  Days are archived in order,
+// and the last archived day is recorded in cloud-archive.json in the output
+// folder, so that a day that failed to upload is archived later, and none is
+// uploaded twice.  With a retention, older batches are deleted from the bucket
+// (never the local files).
+//
+// Requests use the S3 API, signed with AWS Signature Version 4, which GCS also
+// accepts with HMAC keys, so neither SDK is required.  An S3 compatible
+// service, such as MinIO, may be used with its endpoint.
+
+package spy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cloudArchiveInterval is the interval between checks for days to
+	// archive.
+	cloudArchiveInterval = time.Hour
+	// cloudArchiveTimeout is the timeout of a request to the bucket, which
+	// may upload a large batch.
+	cloudArchiveTimeout = 10 * time.Minute
+	// cloudArchiveDateFormat is the format of the dates of the batches.
+	cloudArchiveDateFormat = "2006-01-02"
+)
+
+// cloudArchiveState is the saved state of the cloud archive.
+type cloudArchiveState struct {
+	// LastDate is the last archived day, as YYYY-MM-DD.
+	LastDate string `json:"lastdate"`
+}
+
+// cloudArchiver uploads daily batches of the data files to a bucket.
+type cloudArchiver struct {
+	folder    string
+	statePath string
+	// baseURL is the URL of the bucket, e.g.
+	// https://bucket.s3.us-east-1.amazonaws.com or
+	// https://storage.googleapis.com/bucket.
+	baseURL   *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	// prefix is the prefix of the keys, including the network.
+	prefix    string
+	retention int
+	client    *http.Client
+
+	mtx   sync.Mutex
+	state cloudArchiveState
+}
+
+// spyCloudArchive is the package-level cloud archive, nil if disabled.
+var spyCloudArchive *cloudArchiver
+
+// newCloudArchiver creates a cloudArchiver of the data files in folder to the
+// bucket, s3://NAME or gs://NAME, with keys starting with prefix, deleting
+// batches older than retention days unless 0.  endpoint, if not empty, is the
+// URL of an S3 compatible service.  The region defaults to us-east-1 for S3,
+// and auto for GCS.
+func newCloudArchiver(folder, bucket, endpoint, region, accessKey, secretKey,
+	prefix string, retention int) (*cloudArchiver, error) {
+	u, err := url.Parse(bucket)
+	if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("invalid archivebucket %q (expected "+
+			"s3://NAME or gs://NAME)", bucket)
+	}
+	name := u.Host
+	var base string
+	switch {
+	case endpoint != "":
+		if !strings.HasPrefix(endpoint, "http://") &&
+			!strings.HasPrefix(endpoint, "https://") {
+			return nil, fmt.Errorf("invalid archiveendpoint %q: the scheme "+
+				"must be http or https", endpoint)
+		}
+		base = strings.TrimSuffix(endpoint, "/") + "/" + name
+	case u.Scheme == "s3":
+		if region == "" {
+			region = "us-east-1"
+		}
+		base = "https://" + name + ".s3." + region + ".amazonaws.com"
+	case u.Scheme == "gs":
+		base = "https://storage.googleapis.com/" + name
+	default:
+		return nil, fmt.Errorf("invalid archivebucket %q: the scheme must be "+
+			"s3 or gs", bucket)
+	}
+	if region == "" {
+		// GCS accepts any region, and MinIO defaults to us-east-1.
+		region = "auto"
+		if u.Scheme == "s3" {
+			region = "us-east-1"
+		}
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("archiveaccesskey and archivesecretkey are " +
+			"required")
+	}
+	if retention < 0 {
+		return nil, fmt.Errorf("invalid archiveretention %d", retention)
+	}
+
+	a := &cloudArchiver{
+		folder:    folder,
+		statePath: filepath.Join(folder, "cloud-archive.json"),
+		baseURL:   baseURL,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		prefix:    prefix + activeNet.Name + "/",
+		retention: retention,
+		client:    &http.Client{Timeout: cloudArchiveTimeout},
+	}
+	b, err := ioutil.ReadFile(a.statePath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(b, &a.state); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", a.statePath, err)
+		}
+	}
+	return a, nil
+}
+
+// run archives the days not yet archived every cloudArchiveInterval, and
+// deletes the expired batches, until quit is closed.  It should be run as a
+// goroutine.
+func (a *cloudArchiver) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(cloudArchiveInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now().UTC()
+		if err := a.archive(now, quit); err != nil {
+			log.Errorf("Cloud archive failed: %v",
+				reportError(errKindSaver, "cloudarchive", err))
+		}
+		if err := a.expire(now); err != nil {
+			log.Errorf("Failed to delete expired archive batches: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-quit:
+			log.Debugf("Quitting cloud archive.")
+			return
+		}
+	}
+}
+
+// archive uploads the batches of the days before now that were not archived,
+// oldest first, stopping at the first failure.
+func (a *cloudArchiver) archive(now time.Time, quit <-chan struct{}) error {
+	days, err := a.dataFiles()
+	if err != nil {
+		return err
+	}
+	today := now.Format(cloudArchiveDateFormat)
+	dates := make([]string, 0, len(days))
+	a.mtx.Lock()
+	last := a.state.LastDate
+	a.mtx.Unlock()
+	for date := range days {
+		if date > last && date < today {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+
+	for _, date := range dates {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+		if a.expired(date, now) {
+			// Uploaded only to be deleted.
+			log.Debugf("Not archiving %s, beyond the retention.", date)
+		} else if err = a.upload(date, days[date]); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", date, err)
+		}
+		if err = a.saveState(cloudArchiveState{LastDate: date}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataFiles returns the paths of the data files in the folder by the UTC day
+// of their data: the date in the name of a CSV file, or the modification time
+// of a JSON file.
+func (a *cloudArchiver) dataFiles() (map[string][]string, error) {
+	days := make(map[string][]string)
+	for _, prefix := range []string{blockDataCSVPrefix, stakeInfoCSVPrefix,
+		eventsCSVPrefix} {
+		paths, err := filepath.Glob(filepath.Join(a.folder, prefix+"*.csv"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			// The date may be followed by the sequence number of the file.
+			date := strings.TrimPrefix(filepath.Base(p), prefix)
+			if len(date) < len(cloudArchiveDateFormat) {
+				continue
+			}
+			date = date[:len(cloudArchiveDateFormat)]
+			if _, err = time.Parse(cloudArchiveDateFormat, date); err != nil {
+				continue
+			}
+			days[date] = append(days[date], p)
+		}
+	}
+	for _, prefix := range []string{blockDataFilePrefix,
+		stakeInfoFilePrefix} {
+		paths, err := filepath.Glob(filepath.Join(a.folder, prefix+"*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			fi, err := os.Stat(p)
+			if err != nil {
+				continue
+			}
+			date := fi.ModTime().UTC().Format(cloudArchiveDateFormat)
+			days[date] = append(days[date], p)
+		}
+	}
+	// Signature files go in the batch of the file they sign.
+	for date, paths := range days {
+		for _, p := range paths {
+			if _, err := os.Stat(p + signatureFileSuffix); err == nil {
+				days[date] = append(days[date], p+signatureFileSuffix)
+			}
+		}
+	}
+	return days, nil
+}
+
+// upload uploads the batch of the files of the date.
+func (a *cloudArchiver) upload(date string, paths []string) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	sort.Strings(paths)
+	for _, p := range paths {
+		// Files are read whole, so that a file written meanwhile is
+		// archived consistently.
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    filepath.Base(p),
+			Mode:    0600,
+			Size:    int64(len(b)),
+			ModTime: fi.ModTime(),
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = tw.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	key := a.prefix + date + ".tar.gz"
+	start := time.Now()
+	resp, err := a.do("PUT", key, nil, buf.Bytes(), "application/gzip")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	log.Infof("Archived %d files of %s to %s (%d bytes, %v).", len(paths),
+		date, key, buf.Len(), time.Since(start))
+	return nil
+}
+
+// expired returns whether the batch of the date is beyond the retention.
+func (a *cloudArchiver) expired(date string, now time.Time) bool {
+	if a.retention == 0 {
+		return false
+	}
+	cutoff := now.AddDate(0, 0, -a.retention).Format(cloudArchiveDateFormat)
+	return date < cutoff
+}
+
+// s3ListResult is the part of a ListObjects response used by the archive.
+type s3ListResult struct {
+	IsTruncated bool `xml:"IsTruncated"`
+	Contents    []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+// expire deletes the batches beyond the retention.
+func (a *cloudArchiver) expire(now time.Time) error {
+	if a.retention == 0 {
+		return nil
+	}
+	var expired []string
+	marker := ""
+	for {
+		q := url.Values{"prefix": {a.prefix}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := a.do("GET", "", q, nil, "")
+		if err != nil {
+			return err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("invalid list response: %v", err)
+		}
+		for _, c := range res.Contents {
+			date := strings.TrimSuffix(strings.TrimPrefix(c.Key, a.prefix),
+				".tar.gz")
+			if _, err = time.Parse(cloudArchiveDateFormat, date); err != nil {
+				// Not a batch
+				continue
+			}
+			if a.expired(date, now) {
+				expired = append(expired, c.Key)
+			}
+		}
+		if !res.IsTruncated || len(res.Contents) == 0 {
+			break
+		}
+		marker = res.Contents[len(res.Contents)-1].Key
+	}
+
+	for _, key := range expired {
+		resp, err := a.do("DELETE", key, nil, nil, "")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		log.Infof("Deleted expired archive batch %s.", key)
+	}
+	return nil
+}
+
+// saveState records the state.
+func (a *cloudArchiver) saveState(state cloudArchiveState) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := a.statePath + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, a.statePath); err != nil {
+		return err
+	}
+	a.state = state
+	return nil
+}
+
+// s3Error is the error response of the S3 API.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends the signed request for the key (the bucket if empty) with the query
+// and body, returning the response if successful.
+func (a *cloudArchiver) do(method, key string, query url.Values, body []byte,
+	contentType string) (*http.Response, error) {
+	u := *a.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	// The path and query are encoded as in the canonical request.
+	u.RawPath = s3URIEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	a.sign(req, body, time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var e s3Error
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return nil, fmt.Errorf("%s %s: %s: %s (%s)", method, u.Path,
+			resp.Status, e.Message, e.Code)
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, u.Path, resp.Status)
+}
+
+// sign adds the AWS Signature Version 4 of the request, with the body, at t,
+// to its headers.
+func (a *cloudArchiver) sign(req *http.Request, body []byte, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// The signed headers, sorted by name
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		headers["content-type"] = ct
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + a.region + "/s3/aws4_request"
+	crSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(crSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+a.secretKey), day)
+	for _, s := range []string{a.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		a.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of s with the key.
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query of a canonical request, sorted by name.
+func canonicalQuery(q url.Values) string {
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		values := append([]string{}, q[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3URIEncode(name, true)+"="+
+				s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// s3URIEncode percent-encodes s as required by Signature Version 4: all but
+// the unreserved characters, and the slash if encodeSlash.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z',
+			'0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,292 @@
+// coldaudit.go implements the cold storage audit, which periodically checks
+// the full set of unspent outputs of designated cold storage addresses with
+// dcrd, independently of the real-time notifications.  Any spend of an output
+// seen in the previous audit, or a balance differing from the expected
+// balance, raises an alert.  Finding the outputs requires dcrd's address
+// index (--addrindex).
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+)
+
+// Event type and actions for cold storage audit events
+const (
+	eventTypeColdAudit     = "coldaudit"
+	eventActionColdSpent   = "spent"
+	eventActionColdBalance = "balance"
+)
+
+const (
+	// defaultColdAuditInterval is the audit interval if not configured.
+	defaultColdAuditInterval = 6 * time.Hour
+	// coldAuditPageSize is the number of transactions requested per
+	// searchrawtransactions call.
+	coldAuditPageSize = 100
+)
+
+// coldOutpoint is an unspent output of a cold storage address.
+type coldOutpoint struct {
+	TxID  string  `json:"txid"`
+	Vout  uint32  `json:"vout"`
+	Value float64 `json:"value"`
+}
+
+func (o coldOutpoint) String() string {
+	return fmt.Sprintf("%s:%d", o.TxID, o.Vout)
+}
+
+type coldOutpoints []coldOutpoint
+
+func (s coldOutpoints) Len() int           { return len(s) }
+func (s coldOutpoints) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s coldOutpoints) Less(i, j int) bool { return s[i].String() < s[j].String() }
+
+// coldAddressState is the result of the audit of an address.
+type coldAddressState struct {
+	Balance float64        `json:"balance"`
+	UTXOs   []coldOutpoint `json:"utxos"`
+}
+
+// coldAuditState is the result of an audit, saved for comparison with the
+// next audit.
+type coldAuditState struct {
+	Time      int64                        `json:"time"`
+	Height    int64                        `json:"height"`
+	Addresses map[string]*coldAddressState `json:"addresses"`
+}
+
+// coldAuditor audits the cold storage addresses.
+type coldAuditor struct {
+	dcrd      *dcrrpcclient.Client
+	addrs     []dcrutil.Address
+	expected  map[string]float64
+	statePath string
+	last      *coldAuditState
+}
+
+// newColdAuditor creates a coldAuditor for the addresses given as "address" or
+// "address,expected balance in DCR", loading the previous audit from the file
+// at statePath, where each audit is saved.
+func newColdAuditor(dcrd *dcrrpcclient.Client, specs []string,
+	statePath string) (*coldAuditor, error) {
+	a := &coldAuditor{
+		dcrd:      dcrd,
+		expected:  make(map[string]float64),
+		statePath: statePath,
+	}
+	for _, spec := range specs {
+		s := strings.Split(spec, ",")
+		addr, err := dcrutil.DecodeAddress(s[0], activeNet.Params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cold storage address %s", s[0])
+		}
+		a.addrs = append(a.addrs, addr)
+		if len(s) > 1 && s[1] != "" {
+			bal, err := strconv.ParseFloat(s[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expected balance for %s: %v",
+					s[0], err)
+			}
+			a.expected[s[0]] = bal
+		}
+	}
+
+	b, err := ioutil.ReadFile(statePath)
+	if err == nil {
+		a.last = new(coldAuditState)
+		if err = json.Unmarshal(b, a.last); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", statePath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return a, nil
+}
+
+// unspentOutputs finds the unspent outputs paying to the address.  Outputs
+// spent by transactions in mempool are considered spent.
+func (a *coldAuditor) unspentOutputs(addr dcrutil.Address) ([]coldOutpoint, error) {
+	addrStr := addr.EncodeAddress()
+	var utxos []coldOutpoint
+	for skip := 0; ; skip += coldAuditPageSize {
+		txs, err := a.dcrd.SearchRawTransactionsVerbose(addr, skip,
+			coldAuditPageSize, false, false, nil)
+		if err != nil {
+			// dcrd returns an error when skip is past the last transaction.
+			if skip > 0 && strings.Contains(err.Error(), "No information") {
+				break
+			}
+			return nil, err
+		}
+
+		for _, tx := range txs {
+			txHash, err := chainhash.NewHashFromStr(tx.Txid)
+			if err != nil {
+				return nil, err
+			}
+			for _, vout := range tx.Vout {
+				var paysAddr bool
+				for _, va := range vout.ScriptPubKey.Addresses {
+					if va == addrStr {
+						paysAddr = true
+						break
+					}
+				}
+				if !paysAddr {
+					continue
+				}
+				txOut, err := a.dcrd.GetTxOut(txHash, vout.N, true)
+				if err != nil {
+					return nil, err
+				}
+				if txOut != nil {
+					utxos = append(utxos, coldOutpoint{tx.Txid, vout.N, vout.Value})
+				}
+			}
+		}
+
+		if len(txs) < coldAuditPageSize {
+			break
+		}
+	}
+
+	sort.Sort(coldOutpoints(utxos))
+	return utxos, nil
+}
+
+// audit checks each address, alerting on spent outputs and unexpected
+// balances, and saves the results.
+func (a *coldAuditor) audit() error {
+	_, height, err := a.dcrd.GetBestBlock()
+	if err != nil {
+		return err
+	}
+	state := &coldAuditState{
+		Time:      time.Now().Unix(),
+		Height:    height,
+		Addresses: make(map[string]*coldAddressState, len(a.addrs)),
+	}
+
+	for _, addr := range a.addrs {
+		addrStr := addr.EncodeAddress()
+		utxos, err := a.unspentOutputs(addr)
+		if err != nil {
+			return fmt.Errorf("unable to get outputs of %s: %v", addrStr, err)
+		}
+		var balance float64
+		for _, u := range utxos {
+			balance += u.Value
+		}
+		state.Addresses[addrStr] = &coldAddressState{balance, utxos}
+		log.Debugf("Cold storage audit: %s has %d unspent outputs, %.8f DCR",
+			addrStr, len(utxos), balance)
+
+		// Outputs present in the last audit must still be unspent.
+		if a.last != nil && a.last.Addresses[addrStr] != nil {
+			unspent := make(map[string]bool, len(utxos))
+			for _, u := range utxos {
+				unspent[u.String()] = true
+			}
+			for _, u := range a.last.Addresses[addrStr].UTXOs {
+				if unspent[u.String()] {
+					continue
+				}
+				msg := fmt.Sprintf("Cold storage address %s: output %v "+
+					"(%.8f DCR) was spent since the audit at height %d.",
+					addrStr, u, u.Value, a.last.Height)
+				sendDedupAlert("coldspend:"+addrStr+":"+u.String(),
+					"cold storage spend", "%s", msg)
+				e := &spyEvent{
+					Type:    eventTypeColdAudit,
+					Action:  eventActionColdSpent,
+					Height:  height,
+					Address: addrStr,
+					Amount:  u.Value,
+					TxID:    u.TxID,
+					Vout:    int(u.Vout),
+					Message: msg,
+				}
+				publishEvent(e)
+				if err := spySMS.Notify(e); err != nil {
+					log.Warnf("Failed to send cold storage spend by SMS: %v",
+						err)
+				}
+			}
+		}
+
+		expected, ok := a.expected[addrStr]
+		if !ok {
+			continue
+		}
+		alertKey := "coldbalance:" + addrStr
+		if math.Abs(balance-expected) <= 1e-8 {
+			resolveAlert(alertKey, "Cold storage address %s has the "+
+				"expected balance of %.8f DCR.", addrStr, balance)
+			continue
+		}
+		msg := fmt.Sprintf("Cold storage address %s has a balance of "+
+			"%.8f DCR, expected %.8f DCR.", addrStr, balance, expected)
+		if fireAlert(alertKey, "cold storage balance mismatch", "%s", msg) {
+			publishEvent(&spyEvent{
+				Type:    eventTypeColdAudit,
+				Action:  eventActionColdBalance,
+				Height:  height,
+				Address: addrStr,
+				Amount:  balance,
+				Message: msg,
+			})
+		}
+	}
+
+	a.last = state
+	b, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(a.statePath, b, 0644); err != nil {
+		return err
+	}
+	log.Infof("Cold storage audit of %d addresses completed at height %d.",
+		len(a.addrs), height)
+	return nil
+}
+
+// run audits the addresses immediately and then at the given interval until
+// quit is closed.  It should be run as a goroutine.
+func (a *coldAuditor) run(interval time.Duration, wg *sync.WaitGroup,
+	quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.audit(); err != nil {
+			fireAlert("coldaudit:failed", "cold storage audit failed", "%v",
+				err)
+		} else {
+			resolveAlert("coldaudit:failed", "Cold storage audit succeeded.")
+		}
+		select {
+		case <-ticker.C:
+		case <-quit:
+			log.Debugf("Quitting cold storage auditor.")
+			return
+		}
+	}
+}
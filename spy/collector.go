@@ -4,11 +4,10 @@
 //
 // chappjc
 
-package main
+package spy
 
 import (
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"strconv"
 	"sync"
@@ -40,18 +39,19 @@ type stakeInfoData struct {
 	stakeinfo        *dcrjson.GetStakeInfoResult
 	balances         *WalletBalances
 	accountBalances  *map[string]dcrjson.GetAccountBalanceResult
-	priceWindowNum   int // trivia
-	idxBlockInWindow int // Relative block index within the difficulty period
+	tickets          []string // hashes of the wallet's live and immature tickets
+	priceWindowNum   int      // trivia
+	idxBlockInWindow int      // Relative block index within the difficulty period
 }
 
 type stakeInfoDataCollector struct {
-	cfg          *config
+	cfg          *Config
 	dcrdChainSvr *dcrrpcclient.Client
 	dcrwChainSvr *dcrrpcclient.Client
 }
 
 // newStakeInfoDataCollector creates a new stakeInfoDataCollector.
-func newStakeInfoDataCollector(cfg *config,
+func newStakeInfoDataCollector(cfg *Config,
 	dcrdChainSvr *dcrrpcclient.Client,
 	dcrwChainSvr *dcrrpcclient.Client) (*stakeInfoDataCollector, error) {
 	return &stakeInfoDataCollector{
@@ -152,6 +152,15 @@ func (t *stakeInfoDataCollector) collect(height uint32) (*stakeInfoData, error)
 		ImmatureCoinbaseAllAcct: totals.ImmatureCoinbaseRewards,
 	}
 
+	ticketHashes, errTickets := wallet.GetTickets(true)
+	if errTickets != nil {
+		log.Warnf("Unable to get wallet tickets: %v", errTickets)
+	}
+	tickets := make([]string, 0, len(ticketHashes))
+	for _, h := range ticketHashes {
+		tickets = append(tickets, h.String())
+	}
+
 	// Output
 	winSize := uint32(activeNet.StakeDiffWindowSize)
 	stakeinfo := &stakeInfoData{
@@ -160,11 +169,12 @@ func (t *stakeInfoDataCollector) collect(height uint32) (*stakeInfoData, error)
 		stakeinfo:        getStakeInfoRes,
 		balances:         balances,
 		accountBalances:  &accountBalances,
+		tickets:          tickets,
 		priceWindowNum:   int(height / winSize),
 		idxBlockInWindow: int(height%winSize) + 1,
 	}
 
-	return stakeinfo, err
+	return stakeinfo, nil
 }
 
 // TicketPoolInfo models data about ticket pool
@@ -183,23 +193,30 @@ type blockData struct {
 	currentstakediff dcrjson.GetStakeDifficultyResult
 	eststakediff     dcrjson.EstimateStakeDiffResult
 	poolinfo         TicketPoolInfo
+	coinsupply       float64 // negative if unknown
 	priceWindowNum   int
 	idxBlockInWindow int
+	derived          map[string]float64 // derived metrics, see derived.go
+	extensions       []blockDataSection
 }
 
 type blockDataCollector struct {
 	mtx          sync.Mutex
-	cfg          *config
+	cfg          *Config
 	dcrdChainSvr *dcrrpcclient.Client
+	// extensions are the block data extensions of the run, e.g. the enabled
+	// collector plugins, collected after the registered extensions.
+	extensions []BlockDataExtension
 }
 
 // newBlockDataCollector creates a new blockDataCollector.
-func newBlockDataCollector(cfg *config,
-	dcrdChainSvr *dcrrpcclient.Client) (*blockDataCollector, error) {
+func newBlockDataCollector(cfg *Config, dcrdChainSvr *dcrrpcclient.Client,
+	extensions []BlockDataExtension) (*blockDataCollector, error) {
 	return &blockDataCollector{
 		mtx:          sync.Mutex{},
 		cfg:          cfg,
 		dcrdChainSvr: dcrdChainSvr,
+		extensions:   extensions,
 	}, nil
 }
 
@@ -216,29 +233,17 @@ func (t *blockDataCollector) collect(noTicketPool bool) (*blockData, error) {
 	}(time.Now())
 
 	// Run first client call with a timeout
-	type bbhRes struct {
-		err  error
-		hash *chainhash.Hash
-	}
-	toch := make(chan bbhRes)
-
-	// Pull and store relevant data about the blockchain.
-	go func() {
-		bestBlockHash, err := t.dcrdChainSvr.GetBestBlockHash()
-		toch <- bbhRes{err, bestBlockHash}
-		return
-	}()
-
-	var bbs bbhRes
-	select {
-	case bbs = <-toch:
-	case <-time.After(time.Second * 10):
-		log.Errorf("Timeout waiting for dcrd.")
-		return nil, errors.New("Timeout")
+	var bestBlockHash *chainhash.Hash
+	err := withRPCTimeout("getbestblockhash", func() error {
+		var err error
+		bestBlockHash, err = t.dcrdChainSvr.GetBestBlockHash()
+		return err
+	})
+	if err != nil {
+		log.Errorf("Failed waiting for dcrd: %v", err)
+		return nil, err
 	}
 
-	bestBlockHash := bbs.hash
-
 	bestBlock, err := t.dcrdChainSvr.GetBlock(bestBlockHash)
 	if err != nil {
 		return nil, err
@@ -327,6 +332,16 @@ func (t *blockDataCollector) collect(noTicketPool bool) (*blockData, error) {
 		return nil, err
 	}
 
+	// Coin supply is not available from older versions of dcrd, so do not
+	// fail the collection without it.
+	coinSupply := float64(-1)
+	supply, err := t.dcrdChainSvr.GetCoinSupply()
+	if err != nil {
+		log.Warnf("Unable to get coin supply: %v", err)
+	} else {
+		coinSupply = supply.ToCoin()
+	}
+
 	// Output
 	winSize := uint32(activeNet.StakeDiffWindowSize)
 	blockdata := &blockData{
@@ -336,9 +351,21 @@ func (t *blockDataCollector) collect(noTicketPool bool) (*blockData, error) {
 		currentstakediff: *stakeDiff,
 		eststakediff:     *estStakeDiff,
 		poolinfo:         ticketPoolInfo,
+		coinsupply:       coinSupply,
 		priceWindowNum:   int(height / winSize),
 		idxBlockInWindow: int(height%winSize) + 1,
 	}
 
-	return blockdata, err
+	// Sections from registered extensions and the run's collectors
+	blockdata.extensions = collectExtensions(t.dcrdChainSvr,
+		&blockdata.header, t.extensions)
+
+	// Derived metrics from the config
+	blockdata.derived = spyDerivedMetrics.compute(blockdata)
+	if blockdata.derived != nil {
+		blockdata.extensions = append(blockdata.extensions,
+			blockDataSection{derivedMetricsSection, blockdata.derived})
+	}
+
+	return blockdata, nil
 }
@@ -0,0 +1,104 @@
+// collectors.go defines the Collector plugins, which each collect one named
+// section of per-block data from dcrd, e.g. the chain tips, in their own module
+// rather than in blockDataCollector.  A plugin registers a constructor under
+// its name in an init function, and the collectors enabled with the collector
+// option are created by each run as its block data extensions (see
+// blockext.go), so their sections are output by all of the savers.
+
+package spy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/decred/dcrd/dcrjson"
+	"github.com/decred/dcrrpcclient"
+)
+
+// Collector is a plugin collecting a named section of data.
+type Collector interface {
+	// Name is the name of the section, used as its key in the JSON output.
+	Name() string
+	// Collect returns the section data at the block height.  The data must
+	// be encodable as JSON.
+	Collect(height uint32) (interface{}, error)
+}
+
+// collectorConstructor creates a Collector querying dcrd.
+type collectorConstructor func(dcrd *dcrrpcclient.Client) Collector
+
+var (
+	collectorsMtx sync.RWMutex
+	collectors    = make(map[string]collectorConstructor)
+)
+
+// registerCollector registers the constructor of the named collector plugin.
+// It panics if the name is already registered, since plugins register in
+// their init functions.
+func registerCollector(name string, newCollector collectorConstructor) {
+	collectorsMtx.Lock()
+	defer collectorsMtx.Unlock()
+	if _, ok := collectors[name]; ok {
+		panic(fmt.Sprintf("collector %s already registered", name))
+	}
+	collectors[name] = newCollector
+}
+
+// collectorNames returns the names of the registered collectors, sorted.
+func collectorNames() []string {
+	collectorsMtx.RLock()
+	defer collectorsMtx.RUnlock()
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newCollector creates the named collector, querying dcrd.
+func newCollector(name string, dcrd *dcrrpcclient.Client) (Collector, error) {
+	collectorsMtx.RLock()
+	newCollector, ok := collectors[name]
+	collectorsMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown collector %q (available: %s)", name,
+			strings.Join(collectorNames(), ", "))
+	}
+	return newCollector(dcrd), nil
+}
+
+// collectorExtension collects the section of a Collector with each block.
+type collectorExtension struct {
+	Collector
+}
+
+// Collect returns the section of the collector at the height of the block.
+func (e collectorExtension) Collect(dcrd *dcrrpcclient.Client,
+	header *dcrjson.GetBlockHeaderVerboseResult) (interface{}, error) {
+	return e.Collector.Collect(header.Height)
+}
+
+// enableCollectors creates the named collectors, querying dcrd, and returns
+// them as block data extensions of the run.  Their names may not be those of
+// registered extensions or of each other.
+func enableCollectors(names []string,
+	dcrd *dcrrpcclient.Client) ([]BlockDataExtension, error) {
+	var exts []BlockDataExtension
+	for _, name := range names {
+		c, err := newCollector(strings.TrimSpace(name), dcrd)
+		if err != nil {
+			return nil, err
+		}
+		err = checkExtensionName(c.Name(),
+			append(registeredBlockDataExtensions(), exts...))
+		if err != nil {
+			return nil, err
+		}
+		exts = append(exts, collectorExtension{c})
+		log.Infof("Collecting %s with each block.", c.Name())
+	}
+	return exts, nil
+}
@@ -0,0 +1,43 @@
+package spy
+
+import (
+	"testing"
+)
+
+func TestEnableCollectors(t *testing.T) {
+	registered := len(registeredBlockDataExtensions())
+	tests := []struct {
+		names []string
+		want  []string
+		valid bool
+	}{
+		{nil, nil, true},
+		{[]string{"chaintips"}, []string{"chaintips"}, true},
+		{[]string{"chaintips", " peerinfo "}, []string{"chaintips", "peerinfo"}, true},
+		{[]string{"chaintips", "chaintips"}, nil, false},
+		{[]string{"nosuchcollector"}, nil, false},
+	}
+	// Each run creates its own extensions, so enabling them twice is not a
+	// duplicate.
+	for i := 0; i < 2; i++ {
+		for _, tt := range tests {
+			exts, err := enableCollectors(tt.names, nil)
+			if (err == nil) != tt.valid {
+				t.Fatalf("%q: got error %v, want valid %v", tt.names, err, tt.valid)
+			}
+			if len(exts) != len(tt.want) {
+				t.Fatalf("%q: got %d extensions, want %d", tt.names, len(exts),
+					len(tt.want))
+			}
+			for j, ext := range exts {
+				if ext.Name() != tt.want[j] {
+					t.Errorf("%q: got extension %s, want %s", tt.names,
+						ext.Name(), tt.want[j])
+				}
+			}
+		}
+	}
+	if n := len(registeredBlockDataExtensions()); n != registered {
+		t.Errorf("got %d registered extensions, want %d", n, registered)
+	}
+}
@@ -0,0 +1,63 @@
+// confirmations.go defers the notifications of mined transactions to watched
+// addresses with a policy of more than one confirmation (e.g. mined:6) until
+// the transaction has that many confirmations.  The number of confirmations
+// is counted from the height of the block mining the transaction.  If the
+// transaction is mined again in another block, e.g. after a reorg, the count
+// restarts from the new height.
+
+package spy
+
+import (
+	"fmt"
+	"sync"
+)
+
+// confirmationWait is a notification waiting for confirmations.
+type confirmationWait struct {
+	e     *spyEvent
+	confs int64
+}
+
+// confirmationWaiter holds the notifications waiting for confirmations.
+type confirmationWaiter struct {
+	mtx sync.Mutex
+	// waits is keyed by transaction output and owner.
+	waits map[string]*confirmationWait
+}
+
+// spyConfirmations is the package-level confirmation waiter.
+var spyConfirmations = &confirmationWaiter{
+	waits: make(map[string]*confirmationWait),
+}
+
+// wait defers the notification of the mined event until the transaction has
+// confs confirmations.
+func (c *confirmationWaiter) wait(e *spyEvent, confs int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	key := fmt.Sprintf("%s:%d:%s", e.TxID, e.Vout, e.Tenant)
+	c.waits[key] = &confirmationWait{e, confs}
+	log.Debugf("Notifying %s[out:%d] at %d confirmations (height %d).",
+		e.TxID, e.Vout, confs, e.Height+confs-1)
+}
+
+// blockConnected sends the notifications of the transactions with enough
+// confirmations at the height of the connected block.
+func (c *confirmationWaiter) blockConnected(height int64) {
+	c.mtx.Lock()
+	var due []*confirmationWait
+	for key, w := range c.waits {
+		if height >= w.e.Height+w.confs-1 {
+			due = append(due, w)
+			delete(c.waits, key)
+		}
+	}
+	c.mtx.Unlock()
+
+	for _, w := range due {
+		e := *w.e
+		e.Message = fmt.Sprintf("%s, %d confirmations at block %d",
+			e.Message, w.confs, height)
+		notifyOwner(&e)
+	}
+}
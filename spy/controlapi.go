@@ -0,0 +1,265 @@
+// controlapi.go implements the control API for managing watched addresses
+// while dcrspy is running.  In public (multi-user) mode, registering or
+// removing an address requires a message signed with the address's key, as
+// produced by signmessage, proving control of the address.  In multi-tenant
+// mode, each tenant manages only its own addresses.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+)
+
+// ownershipProofMaxAge is the maximum age of the timestamp in a signed
+// ownership message.  This limits the time a captured proof may be replayed.
+const ownershipProofMaxAge = 10 * time.Minute
+
+// ownershipMessagePrefix begins the message that must be signed to prove
+// control of an address.  The full message is
+// "dcrspy <action> <address> <unix time>", where action is "watch" to register
+// the address or "unwatch" to remove it, so that a proof for one cannot be
+// replayed for the other.
+const ownershipMessagePrefix = "dcrspy"
+
+// Actions named in ownership messages.
+const (
+	ownershipActionWatch   = "watch"
+	ownershipActionUnwatch = "unwatch"
+)
+
+// watchRequest is the body of a request to register or remove a watched
+// address.  Message and Signature are the ownership proof, required in public
+// mode.
+type watchRequest struct {
+	Address   string   `json:"address"`
+	Action    TxAction `json:"action"`
+	Message   string   `json:"message,omitempty"`
+	Signature string   `json:"signature,omitempty"`
+}
+
+// watchedAddress describes a watched address in API responses.  Policy is the
+// name of Action.
+type watchedAddress struct {
+	Address string   `json:"address"`
+	Action  TxAction `json:"action"`
+	Policy  string   `json:"policy"`
+}
+
+// watchControl serves the /watch endpoint:
+//
+//	GET    list the watched addresses (in public mode, only for tenants)
+//	POST   register an address, or update its action
+//	DELETE stop watching an address
+type watchControl struct {
+	watched *watchedAddresses
+	dcrd    *dcrrpcclient.Client
+	public  bool
+}
+
+func newWatchControl(watched *watchedAddresses, dcrd *dcrrpcclient.Client,
+	public bool) *watchControl {
+	return &watchControl{
+		watched: watched,
+		dcrd:    dcrd,
+		public:  public,
+	}
+}
+
+// watchAPI documents the /watch endpoint.
+var watchAPI = []apiOperation{{
+	method:      "GET",
+	summary:     "List the watched addresses",
+	description: "Not available in public mode, except to tenants.",
+	response:    []watchedAddress{},
+}, {
+	method:  "POST",
+	summary: "Watch an address",
+	description: "In public mode, message and signature must prove " +
+		"control of the address, with message " +
+		"\"dcrspy watch <address> <unix time>\".",
+	request: watchRequest{},
+	status:  http.StatusNoContent,
+}, {
+	method:  "DELETE",
+	summary: "Stop watching an address",
+	description: "In public mode, message and signature must prove " +
+		"control of the address, with message " +
+		"\"dcrspy unwatch <address> <unix time>\".",
+	request: watchRequest{},
+	status:  http.StatusNoContent,
+}}
+
+// serve is a tenantHandler for the /watch endpoint.  t is nil when not in
+// multi-tenant mode.
+func (c *watchControl) serve(w http.ResponseWriter, r *http.Request, t *tenant) {
+	owner := t.owner()
+	switch r.Method {
+	case "GET":
+		if c.public && t == nil {
+			http.Error(w, "listing watched addresses is not available in "+
+				"public mode", http.StatusForbidden)
+			return
+		}
+		c.listWatched(w, owner)
+	case "POST", "DELETE":
+		var req watchRequest
+		r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		addr, err := dcrutil.DecodeAddress(req.Address, activeNet.Params)
+		if err != nil {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+		if c.public {
+			action := ownershipActionWatch
+			if r.Method == "DELETE" {
+				action = ownershipActionUnwatch
+			}
+			if err = c.verifyOwnership(addr, action, req.Message,
+				req.Signature); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		if r.Method == "DELETE" {
+			c.unregister(owner, addr)
+			auditDetail(w, addr.EncodeAddress(), "unwatch %s",
+				addr.EncodeAddress())
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var max int
+		if t != nil {
+			max = t.MaxAddresses
+		}
+		err = c.register(owner, addr, req.Action, max)
+		if err == errWatchQuota {
+			http.Error(w, fmt.Sprintf("quota of %d watched addresses "+
+				"reached", max), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			log.Errorf("Failed to register watched address: %v", err)
+			http.Error(w, "failed to register address",
+				http.StatusInternalServerError)
+			return
+		}
+		auditDetail(w, addr.EncodeAddress(), "watch %s with action %v",
+			addr.EncodeAddress(), req.Action)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *watchControl) listWatched(w http.ResponseWriter, owner string) {
+	addrs := c.watched.list(owner)
+	sorted := make([]string, 0, len(addrs))
+	for a := range addrs {
+		sorted = append(sorted, a)
+	}
+	sort.Strings(sorted)
+	list := make([]watchedAddress, 0, len(addrs))
+	for _, a := range sorted {
+		list = append(list, watchedAddress{a, addrs[a], addrs[a].String()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// verifyOwnership checks that message is a recent ownership message for addr
+// and action, and that signature is a valid signature of it by the address's
+// key.
+func (c *watchControl) verifyOwnership(addr dcrutil.Address, action, message,
+	signature string) error {
+	if message == "" || signature == "" {
+		return fmt.Errorf("a signed message proving control of the address " +
+			"is required")
+	}
+	if err := checkOwnershipMessage(message, action, addr.EncodeAddress(),
+		time.Now()); err != nil {
+		return err
+	}
+
+	valid, err := c.dcrd.VerifyMessage(addr, signature, message)
+	if err != nil {
+		log.Errorf("verifymessage failed: %v", err)
+		return fmt.Errorf("unable to verify the signature")
+	}
+	if !valid {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// checkOwnershipMessage checks that message is
+// "dcrspy <action> <address> <unix time>" for the given action and address,
+// with a time within ownershipProofMaxAge of now.
+func checkOwnershipMessage(message, action, address string, now time.Time) error {
+	fields := strings.Fields(message)
+	if len(fields) != 4 || fields[0] != ownershipMessagePrefix ||
+		fields[1] != action || fields[2] != address {
+		return fmt.Errorf("the signed message must be \"%s %s %s <unix time>\"",
+			ownershipMessagePrefix, action, address)
+	}
+	stamp, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid time in signed message")
+	}
+	age := now.Sub(time.Unix(stamp, 0))
+	if age > ownershipProofMaxAge || age < -ownershipProofMaxAge {
+		return fmt.Errorf("the time in the signed message must be within "+
+			"%v of the current time", ownershipProofMaxAge)
+	}
+	return nil
+}
+
+// register starts watching the address for the owner, adding it to dcrd's
+// transaction filter for mempool notifications and backfilling its history if
+// it is newly watched.  It returns errWatchQuota if the owner, limited to max
+// addresses if positive, is at its quota.
+func (c *watchControl) register(owner string, addr dcrutil.Address, actn TxAction,
+	max int) error {
+	a := addr.EncodeAddress()
+	isNew, err := c.watched.add(owner, a, actn, max)
+	if err != nil {
+		return err
+	}
+	if !isNew {
+		log.Infof("Updated watched address %s (owner %q, action %v)", a,
+			owner, actn)
+		return nil
+	}
+	// Add to the existing filter rather than reloading it.
+	if err := c.dcrd.LoadTxFilter(false, []dcrutil.Address{addr}, nil); err != nil {
+		c.watched.remove(owner, a)
+		spyRegistrationErrors.record("control API", a, err)
+		return err
+	}
+	log.Infof("Registered watched address %s (owner %q, action %v)", a,
+		owner, actn)
+	spyAddrHistory.requestBackfill(a)
+	return nil
+}
+
+// unregister stops watching the address for the owner.  It remains in dcrd's
+// transaction filter, but mempool notifications for it are ignored if it has
+// no other owners.
+func (c *watchControl) unregister(owner string, addr dcrutil.Address) {
+	if c.watched.remove(owner, addr.EncodeAddress()) {
+		log.Infof("Removed watched address %s (owner %q)",
+			addr.EncodeAddress(), owner)
+	}
+}
@@ -0,0 +1,82 @@
+package spy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckOwnershipMessage(t *testing.T) {
+	const addr = "DsUZxxoHJSty8DCfwfartwTYbuhmVct7tJu"
+	now := time.Unix(1490000000, 0)
+
+	tests := []struct {
+		name    string
+		message string
+		action  string
+		wantErr bool
+	}{
+		{"watch", "dcrspy watch " + addr + " 1490000000", ownershipActionWatch, false},
+		{"unwatch", "dcrspy unwatch " + addr + " 1490000000", ownershipActionUnwatch, false},
+		{"recent", "dcrspy watch " + addr + " 1489999700", ownershipActionWatch, false},
+		{"watch proof for unwatch", "dcrspy watch " + addr + " 1490000000", ownershipActionUnwatch, true},
+		{"unwatch proof for watch", "dcrspy unwatch " + addr + " 1490000000", ownershipActionWatch, true},
+		{"old format", "dcrspy watch " + addr, ownershipActionWatch, true},
+		{"other address", "dcrspy watch DsTmfhRuTwdGaUaRVVuVHzfzLqmVVAGhLro 1490000000", ownershipActionWatch, true},
+		{"wrong prefix", "spy watch " + addr + " 1490000000", ownershipActionWatch, true},
+		{"extra field", "dcrspy watch " + addr + " 1490000000 x", ownershipActionWatch, true},
+		{"bad time", "dcrspy watch " + addr + " soon", ownershipActionWatch, true},
+		{"expired", "dcrspy watch " + addr + " 1489999000", ownershipActionWatch, true},
+		{"future", "dcrspy watch " + addr + " 1490001000", ownershipActionWatch, true},
+	}
+	for _, tt := range tests {
+		err := checkOwnershipMessage(tt.message, tt.action, addr, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWatchedAddressesQuota(t *testing.T) {
+	w := newWatchedAddresses(map[string]TxAction{"Dsop": 0})
+
+	// Concurrent registrations do not exceed the quota.
+	const max = 5
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w.add("alice", fmt.Sprintf("Ds%d", i), 0, max)
+		}(i)
+	}
+	wg.Wait()
+	if n := len(w.list("alice")); n != max {
+		t.Fatalf("alice watches %d addresses, want %d", n, max)
+	}
+	var watched string
+	for a := range w.list("alice") {
+		watched = a
+	}
+
+	tests := []struct {
+		owner, addr string
+		wantNew     bool
+		wantErr     error
+	}{
+		{"alice", "Ds100", false, errWatchQuota},
+		// An address already watched is updated.
+		{"alice", watched, false, nil},
+		{"bob", "Dsop", false, nil},
+		{"bob", "Ds100", true, nil},
+		{"alice", "Ds100", false, errWatchQuota},
+	}
+	for _, tt := range tests {
+		isNew, err := w.add(tt.owner, tt.addr, 0, max)
+		if isNew != tt.wantNew || err != tt.wantErr {
+			t.Errorf("add(%q, %q) = %v, %v, want %v, %v", tt.owner, tt.addr,
+				isNew, err, tt.wantNew, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// coverage.go sends a periodic report of the watch-list coverage, so that
+// drift between what is meant to be monitored and what actually is (e.g. an
+// address whose notifications reach no channel, an address that has gone
+// quiet, or a failed registration) is caught.  The report lists each watched
+// address with its owner, policy, the channels its notifications are routed
+// to and its last event, followed by warnings and the errors registering
+// watched addresses since the last report.  It is logged, and emailed to
+// emailaddr.
+
+package spy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRegistrationErrors is the number of registration errors kept between
+// reports.  Older errors are counted but not listed.
+const maxRegistrationErrors = 50
+
+// registrationError is an error registering watched addresses.  Address is
+// empty if the error is not of one address.
+type registrationError struct {
+	time    time.Time
+	source  string
+	address string
+	err     error
+}
+
+// registrationErrors are the registration errors since the last report.
+type registrationErrors struct {
+	mtx     sync.Mutex
+	errs    []*registrationError
+	dropped int
+}
+
+// spyRegistrationErrors is the package-level record of registration errors.
+var spyRegistrationErrors = &registrationErrors{}
+
+// record records the error registering watched addresses from the source
+// (e.g. control API), of the address if not empty.
+func (r *registrationErrors) record(source, address string, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if len(r.errs) >= maxRegistrationErrors {
+		r.dropped++
+		return
+	}
+	r.errs = append(r.errs, &registrationError{time.Now(), source, address,
+		err})
+}
+
+// take returns the errors recorded since the last call, and the number not
+// kept.
+func (r *registrationErrors) take() ([]*registrationError, int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	errs, dropped := r.errs, r.dropped
+	r.errs, r.dropped = nil, 0
+	return errs, dropped
+}
+
+// coverageRouting describes the channels to which the notifications of the
+// owner's address are routed, with the recipients of email.
+func coverageRouting(owner, addr string) string {
+	var channels []string
+	for _, nn := range spyNotifiers.forOwner(owner) {
+		if _, ok := nn.notifier.(emailNotifier); ok && alertEmailConfig != nil {
+			to := alertEmailConfig.recipients(&spyEvent{Address: addr,
+				Tenant: owner})
+			channels = append(channels, fmt.Sprintf("email (%s)",
+				strings.Join(to, ", ")))
+			continue
+		}
+		channels = append(channels, nn.name)
+	}
+	return strings.Join(channels, ", ")
+}
+
+// coverageReport returns the coverage report of the watched addresses, and
+// the number of addresses and warnings.
+func coverageReport(watched *watchedAddresses) (report string, numAddrs,
+	numWarnings int) {
+	var buf, warnings bytes.Buffer
+	warn := func(format string, args ...interface{}) {
+		fmt.Fprintf(&warnings, "  "+format+"\n", args...)
+		numWarnings++
+	}
+
+	var entries []*addrStatsEntry
+	if spyAddrStats != nil {
+		entries = spyAddrStats.report(nil)
+	}
+	numAddrs = watched.count()
+	fmt.Fprintf(&buf, "dcrspy watch-list coverage at %s: %d watched "+
+		"address(es).\n\n", time.Now().UTC().Format("2006-01-02 15:04:05 UTC"),
+		numAddrs)
+
+	for _, e := range entries {
+		actn := watched.owners(e.Address)[e.Tenant]
+		owner := ownerName(e.Tenant)
+		buf.WriteString(e.Address)
+		if e.Label != "" {
+			fmt.Fprintf(&buf, " (%s)", e.Label)
+		}
+		fmt.Fprintf(&buf, "\n  owner: %s, policy: %v\n", owner, actn)
+
+		routing := "not notified"
+		if actn.mined() || actn.mempool() {
+			routing = coverageRouting(e.Tenant, e.Address)
+			if routing == "" {
+				routing = "no channel"
+				warn("%s: notified by its policy, but %s has no "+
+					"notification channel.", e.Address, owner)
+			}
+		}
+		fmt.Fprintf(&buf, "  routing: %s\n", routing)
+
+		if e.LastHeight == 0 {
+			buf.WriteString("  last event: none\n")
+			continue
+		}
+		fmt.Fprintf(&buf, "  last event: block %d (%s)\n", e.LastHeight,
+			time.Unix(e.LastTime, 0).UTC().Format("2006-01-02 15:04:05 UTC"))
+	}
+
+	errs, dropped := spyRegistrationErrors.take()
+	for _, re := range errs {
+		what := "addresses"
+		if re.address != "" {
+			what = re.address
+		}
+		warn("%s: failed to register %s (%s): %v",
+			re.time.UTC().Format("2006-01-02 15:04:05 UTC"), what, re.source,
+			re.err)
+	}
+	if dropped > 0 {
+		warn("%d more registration error(s).", dropped)
+	}
+
+	if warnings.Len() > 0 {
+		buf.WriteString("\nWarnings:\n")
+		buf.Write(warnings.Bytes())
+	}
+	return buf.String(), numAddrs, numWarnings
+}
+
+// coverageReporter logs and emails the coverage report at the interval until
+// quit is closed.  It should be run as a goroutine.
+func coverageReporter(watched *watchedAddresses, interval time.Duration,
+	wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			report, numAddrs, numWarnings := coverageReport(watched)
+			log.Infof("Watch-list coverage: %d watched address(es), %d "+
+				"warning(s).", numAddrs, numWarnings)
+			log.Debugf("%s", report)
+			if alertEmailConfig != nil {
+				spyNotifyPool.submit(notifyChannelEmail, func() {
+					sendEmailWatchRecv(report, "dcrspy watch-list coverage",
+						alertEmailConfig)
+				})
+			}
+		case <-quit:
+			log.Debugf("Quitting coverage reporter.")
+			return
+		}
+	}
+}
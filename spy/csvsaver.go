@@ -0,0 +1,361 @@
+// csvsaver.go implements the CSV savers, which append one row per block to
+// CSV files of block data, stake info data and events, rotated daily.  The
+// columns are the fields of the saved JSON documents (after the
+// post-processing pipelines), named by their paths, e.g.
+// ticket_pool_info.poolvalue.  Fields that are absent for a row are written
+// as empty cells.  When a row has a field that is not a column of the current
+// file, e.g. after a derived metric is added to the config, a new file is
+// started with the additional columns.  If columns are selected for block data
+// or stake info, only those columns are written, in the given order.  With a
+// signing key, a file is signed when it is closed, i.e. when the next one is
+// started and when dcrspy stops.
+
+package spy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The prefixes of the CSV file names, which are followed by the UTC date.
+const (
+	blockDataCSVPrefix = "block_data-"
+	stakeInfoCSVPrefix = "stake-info-"
+	eventsCSVPrefix    = "events-"
+)
+
+// eventCSVColumns are the columns of the events CSV files.
+var eventCSVColumns = []string{"seq", "time", "type", "action", "height",
+	"address", "amount", "txid", "vout", "scriptclass", "message", "tenant"}
+
+// csvAppender appends rows to daily CSV files.
+type csvAppender struct {
+	mtx    sync.Mutex
+	folder string
+	prefix string
+	// columns are the initial columns of a new file, or, if fixed, the only
+	// columns.
+	columns []string
+	fixed   bool
+
+	date   string
+	seq    int
+	header []string
+	file   *os.File
+	w      *csv.Writer
+}
+
+// newCSVAppender creates a csvAppender for the files in folder with names
+// starting with prefix.  columns, which may be nil, are the initial columns of
+// each file.
+func newCSVAppender(folder, prefix string, columns []string) *csvAppender {
+	return &csvAppender{
+		folder:  folder,
+		prefix:  prefix,
+		columns: columns,
+	}
+}
+
+// fileName returns the name of the file for date and seq.
+func (a *csvAppender) fileName(date string, seq int) string {
+	if seq == 0 {
+		return filepath.Join(a.folder, a.prefix+date+".csv")
+	}
+	return filepath.Join(a.folder, fmt.Sprintf("%s%s-%d.csv", a.prefix, date,
+		seq))
+}
+
+// closeFile flushes, closes and signs the current file, if any.
+func (a *csvAppender) closeFile() error {
+	if a.file == nil {
+		return nil
+	}
+	a.w.Flush()
+	err := a.w.Error()
+	if errClose := a.file.Close(); err == nil {
+		err = errClose
+	}
+	a.file, a.w, a.header = nil, nil, nil
+	signStoredFile(a.fileName(a.date, a.seq))
+	return err
+}
+
+// openFile opens the last file for date for appending and reads its header.
+// If there is no file for date, the first is created by the next append.
+func (a *csvAppender) openFile(date string) error {
+	seq := 0
+	for {
+		if _, err := os.Stat(a.fileName(date, seq+1)); err != nil {
+			break
+		}
+		seq++
+	}
+	a.date, a.seq, a.header = date, seq, nil
+	name := a.fileName(date, seq)
+	fp, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header, err := csv.NewReader(bufio.NewReader(fp)).Read()
+	fp.Close()
+	if err != nil {
+		// An empty or corrupt file is followed by a new one.
+		log.Warnf("Unable to read the header of %s: %v", name, err)
+		a.seq++
+		return nil
+	}
+
+	if fp, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	a.header = header
+	a.file, a.w = fp, csv.NewWriter(fp)
+	return nil
+}
+
+// createFile creates the file for date and seq, writing the header.
+func (a *csvAppender) createFile(date string, seq int, header []string) error {
+	name := a.fileName(date, seq)
+	fp, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	a.date, a.seq, a.header = date, seq, header
+	a.file, a.w = fp, csv.NewWriter(fp)
+	if err = a.w.Write(header); err != nil {
+		a.closeFile()
+		return err
+	}
+	log.Debugf("Started CSV file %s", name)
+	return nil
+}
+
+// appendRow appends a row with the given cells, keyed by column, to the file
+// for the current date.
+func (a *csvAppender) appendRow(cells map[string]string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	date := time.Now().UTC().Format("2006-01-02")
+	if date != a.date {
+		if err := a.closeFile(); err != nil {
+			log.Warnf("Failed to close CSV file: %v", err)
+		}
+		if err := a.openFile(date); err != nil {
+			return err
+		}
+	}
+
+	// Create the file, or start a new one if there are new columns, or the
+	// selected columns changed.
+	header := a.header
+	if a.file == nil || a.fixed {
+		header = a.columns
+	}
+	var added []string
+	if !a.fixed {
+		inHeader := make(map[string]bool, len(header))
+		for _, col := range header {
+			inHeader[col] = true
+		}
+		for col := range cells {
+			if !inHeader[col] {
+				added = append(added, col)
+			}
+		}
+	}
+	if a.file == nil || len(added) > 0 || !equalStrings(a.header, header) {
+		sort.Strings(added)
+		header = append(append([]string(nil), header...), added...)
+		seq := a.seq
+		if a.file != nil {
+			if err := a.closeFile(); err != nil {
+				log.Warnf("Failed to close CSV file: %v", err)
+			}
+			seq++
+		}
+		if err := a.createFile(date, seq, header); err != nil {
+			return err
+		}
+	}
+
+	row := make([]string, len(a.header))
+	for i, col := range a.header {
+		row[i] = cells[col]
+	}
+	if err := a.w.Write(row); err != nil {
+		return err
+	}
+	a.w.Flush()
+	return a.w.Error()
+}
+
+// equalStrings returns true if a and b are equal.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// close closes the current file.
+func (a *csvAppender) close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.closeFile()
+}
+
+// flattenJSON returns the fields of the JSON object in b keyed by their
+// paths.  Arrays are written as JSON.
+func flattenJSON(b []byte) (map[string]string, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	cells := make(map[string]string)
+	var flatten func(prefix string, v interface{}) error
+	flatten = func(prefix string, v interface{}) error {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, sub := range t {
+				path := k
+				if prefix != "" {
+					path = prefix + "." + k
+				}
+				if err := flatten(path, sub); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			arr, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			cells[prefix] = string(arr)
+		case json.Number:
+			cells[prefix] = t.String()
+		case string:
+			cells[prefix] = t
+		case bool:
+			cells[prefix] = strconv.FormatBool(t)
+		case nil:
+			cells[prefix] = ""
+		}
+		return nil
+	}
+	if err := flatten("", doc); err != nil {
+		return nil, err
+	}
+	return cells, nil
+}
+
+// BlockDataToCSV implements BlockDataSaver interface for output to daily CSV
+// files
+type BlockDataToCSV struct {
+	*csvAppender
+}
+
+// NewBlockDataToCSV creates a new BlockDataToCSV saving to files in folder,
+// with only the columns if any are given, or else all fields.
+func NewBlockDataToCSV(folder string, columns []string) *BlockDataToCSV {
+	a := newCSVAppender(folder, blockDataCSVPrefix, columns)
+	a.fixed = len(columns) > 0
+	return &BlockDataToCSV{a}
+}
+
+// Store appends the blockData to the CSV file
+func (s *BlockDataToCSV) Store(data *blockData) error {
+	jsonConcat, err := JSONFormatBlockData(data)
+	if err != nil {
+		return err
+	}
+	cells, err := flattenJSON(jsonConcat.Bytes())
+	if err != nil {
+		return err
+	}
+	if err = s.appendRow(cells); err != nil {
+		err = reportError(errKindSaver, "csv", err)
+		log.Errorf("Unable to append block data to CSV: %v", err)
+	}
+	return err
+}
+
+// StakeInfoDataToCSV implements StakeInfoDataSaver interface for output to
+// daily CSV files
+type StakeInfoDataToCSV struct {
+	*csvAppender
+}
+
+// NewStakeInfoDataToCSV creates a new StakeInfoDataToCSV saving to files in
+// folder, with the height and only the columns if any are given, or else all
+// fields.
+func NewStakeInfoDataToCSV(folder string, columns []string) *StakeInfoDataToCSV {
+	header := []string{"height"}
+	for _, col := range columns {
+		if col != "height" {
+			header = append(header, col)
+		}
+	}
+	a := newCSVAppender(folder, stakeInfoCSVPrefix, header)
+	a.fixed = len(columns) > 0
+	return &StakeInfoDataToCSV{a}
+}
+
+// Store appends the stakeInfoData to the CSV file
+func (s *StakeInfoDataToCSV) Store(data *stakeInfoData) error {
+	jsonConcat, err := JSONFormatStakeInfoData(data)
+	if err != nil {
+		return err
+	}
+	cells, err := flattenJSON(jsonConcat.Bytes())
+	if err != nil {
+		return err
+	}
+	cells["height"] = strconv.FormatUint(uint64(data.height), 10)
+	if err = s.appendRow(cells); err != nil {
+		err = reportError(errKindSaver, "csv", err)
+		log.Errorf("Unable to append stake info data to CSV: %v", err)
+	}
+	return err
+}
+
+// spyEventsCSV appends events to daily CSV files, nil if CSV output is not
+// enabled.
+var spyEventsCSV *csvAppender
+
+// appendEventCSV appends an event to the events CSV file.
+func appendEventCSV(e *spyEvent) {
+	if spyEventsCSV == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err == nil {
+		var cells map[string]string
+		if cells, err = flattenJSON(b); err == nil {
+			err = spyEventsCSV.appendRow(cells)
+		}
+	}
+	if err != nil {
+		log.Errorf("Unable to append event to CSV: %v",
+			reportError(errKindSaver, "csv", err))
+	}
+}
@@ -0,0 +1,218 @@
+// datacache.go caches the block data and stake info read from the JSON files
+// for the API, so that dashboards polling the latest block, or the same range
+// of blocks, do not read and decode the files on each request.  The least
+// recently used entries are evicted beyond the configured size.
+//
+// An entry is invalidated when the JSON file saver writes the file of its
+// height, and the entries at and above the height of a disconnected block are
+// invalidated on a reorganization, as is the latest stored height, so that the
+// API does not serve the data of blocks no longer in the main chain.
+
+package spy
+
+import (
+	"container/list"
+	"sync"
+)
+
+// dataCacheKey identifies a cached file, by its prefix (e.g.
+// blockDataFilePrefix) and height.
+type dataCacheKey struct {
+	prefix string
+	height int64
+}
+
+// dataCacheEntry is a cached file's decoded data.
+type dataCacheEntry struct {
+	key   dataCacheKey
+	value interface{}
+}
+
+// storedDataCache is an LRU cache of the stored block data and stake info.
+type storedDataCache struct {
+	size int
+
+	mtx     sync.Mutex
+	entries map[dataCacheKey]*list.Element
+	lru     *list.List
+	// hashes are the heights of the cached block data by block hash.
+	hashes map[string]int64
+	// latest is the latest stored height by prefix, if known.
+	latest map[string]int64
+	// generation is incremented by each invalidation, so that data loaded
+	// before it is not cached after it.
+	generation uint64
+
+	hits, misses *metricCounter
+}
+
+// spyDataCache is the package-level API read cache, nil if disabled.
+var spyDataCache *storedDataCache
+
+// newStoredDataCache creates a storedDataCache of size entries.
+func newStoredDataCache(size int) *storedDataCache {
+	return &storedDataCache{
+		size:    size,
+		entries: make(map[dataCacheKey]*list.Element),
+		lru:     list.New(),
+		hashes:  make(map[string]int64),
+		latest:  make(map[string]int64),
+		hits: spyMetrics.newCounter("dcrspy_api_cache_hits_total",
+			"API reads of stored data served from the cache."),
+		misses: spyMetrics.newCounter("dcrspy_api_cache_misses_total",
+			"API reads of stored data read from the files."),
+	}
+}
+
+// get returns the cached data of the key, and the current generation.
+func (c *storedDataCache) get(key dataCacheKey) (interface{}, uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.hits.inc()
+		return el.Value.(*dataCacheEntry).value, c.generation
+	}
+	c.misses.inc()
+	return nil, c.generation
+}
+
+// add caches the data of the key, loaded at the generation, unless it was
+// invalidated since.
+func (c *storedDataCache) add(key dataCacheKey, value interface{},
+	generation uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.removeLocked(el)
+	}
+	c.entries[key] = c.lru.PushFront(&dataCacheEntry{key, value})
+	if data, ok := value.(*storedBlockData); ok {
+		c.hashes[data.Header.Hash] = key.height
+	}
+	for c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// removeLocked removes the entry.  The mutex must be held.
+func (c *storedDataCache) removeLocked(el *list.Element) {
+	e := c.lru.Remove(el).(*dataCacheEntry)
+	delete(c.entries, e.key)
+	if data, ok := e.value.(*storedBlockData); ok {
+		delete(c.hashes, data.Header.Hash)
+	}
+}
+
+// blockData returns the block data stored in folder at the height.
+func (c *storedDataCache) blockData(folder string,
+	height int64) (*storedBlockData, error) {
+	if c == nil {
+		return loadStoredBlockData(folder, height)
+	}
+	key := dataCacheKey{blockDataFilePrefix, height}
+	v, generation := c.get(key)
+	if v != nil {
+		return v.(*storedBlockData), nil
+	}
+	data, err := loadStoredBlockData(folder, height)
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, data, generation)
+	return data, nil
+}
+
+// stakeInfoData returns the stake info stored in folder at the height.
+func (c *storedDataCache) stakeInfoData(folder string,
+	height int64) (*storedStakeInfoData, error) {
+	if c == nil {
+		return loadStoredStakeInfoData(folder, height)
+	}
+	key := dataCacheKey{stakeInfoFilePrefix, height}
+	v, generation := c.get(key)
+	if v != nil {
+		return v.(*storedStakeInfoData), nil
+	}
+	data, err := loadStoredStakeInfoData(folder, height)
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, data, generation)
+	return data, nil
+}
+
+// blockHeight returns the height of the cached block data of the hash, or
+// false if it is not cached.
+func (c *storedDataCache) blockHeight(hash string) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	height, ok := c.hashes[hash]
+	return height, ok
+}
+
+// latestHeight returns the latest height of the files with the prefix in
+// folder.
+func (c *storedDataCache) latestHeight(folder, prefix string) (int64,
+	error) {
+	if c == nil {
+		return latestStoredHeight(folder, prefix)
+	}
+	c.mtx.Lock()
+	height, ok := c.latest[prefix]
+	generation := c.generation
+	c.mtx.Unlock()
+	if ok {
+		return height, nil
+	}
+	height, err := latestStoredHeight(folder, prefix)
+	if err != nil {
+		return 0, err
+	}
+	c.mtx.Lock()
+	if generation == c.generation {
+		c.latest[prefix] = height
+	}
+	c.mtx.Unlock()
+	return height, nil
+}
+
+// stored invalidates the entry of the file with the prefix written at the
+// height, and updates the latest height.
+func (c *storedDataCache) stored(prefix string, height int64) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.generation++
+	if el, ok := c.entries[dataCacheKey{prefix, height}]; ok {
+		c.removeLocked(el)
+	}
+	if latest, ok := c.latest[prefix]; ok && height > latest {
+		c.latest[prefix] = height
+	}
+}
+
+// disconnected invalidates the entries at and above the height of a
+// disconnected block, and the latest heights.
+func (c *storedDataCache) disconnected(height int64) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.generation++
+	for key, el := range c.entries {
+		if key.height >= height {
+			c.removeLocked(el)
+		}
+	}
+	c.latest = make(map[string]int64)
+}
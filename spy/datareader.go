@@ -0,0 +1,119 @@
+// datareader.go provides functions to load the data previously written to the
+// file system by the JSON file savers.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrd/dcrjson"
+)
+
+// File name prefixes used by the JSON file savers.
+const (
+	blockDataFilePrefix = "block_data-"
+	stakeInfoFilePrefix = "stake-info-"
+)
+
+// storedBlockData is the block data as written by JSONFormatBlockData.
+type storedBlockData struct {
+	EstimateStakeDiff dcrjson.EstimateStakeDiffResult     `json:"estimatestakediff"`
+	CurrentStakeDiff  dcrjson.GetStakeDifficultyResult    `json:"currentstakediff"`
+	FeeInfo           dcrjson.FeeInfoBlock                `json:"ticketfeeinfo_block"`
+	Header            dcrjson.GetBlockHeaderVerboseResult `json:"block_header"`
+	PoolInfo          TicketPoolInfo                      `json:"ticket_pool_info"`
+	CoinSupply        *float64                            `json:"coin_supply,omitempty"`
+	// Sections holds every top-level section as stored, including those
+	// added by block data extensions.
+	Sections map[string]json.RawMessage `json:"-"`
+}
+
+// MarshalJSON encodes all of the stored sections, so that extension sections
+// are included.
+func (d *storedBlockData) MarshalJSON() ([]byte, error) {
+	if d.Sections != nil {
+		return json.Marshal(d.Sections)
+	}
+	type plain storedBlockData
+	return json.Marshal((*plain)(d))
+}
+
+// storedStakeInfoData is the stake info data as written by
+// JSONFormatStakeInfoData.
+type storedStakeInfoData struct {
+	StakeInfo  dcrjson.GetStakeInfoResult `json:"getstakeinfo"`
+	WalletInfo dcrjson.WalletInfoResult   `json:"walletinfo"`
+	Balances   WalletBalances             `json:"balances"`
+	Tickets    []string                   `json:"tickets"`
+}
+
+// loadStoredJSON decodes the JSON file with the given prefix and height in
+// folder into v.
+func loadStoredJSON(folder, prefix string, height int64, v interface{}) error {
+	fullfile := filepath.Join(folder, fmt.Sprintf("%s%d.json", prefix, height))
+	fp, err := os.Open(fullfile)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	if err = json.NewDecoder(fp).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", fullfile, err)
+	}
+	return nil
+}
+
+// loadStoredBlockData loads the block data saved for the given height.
+func loadStoredBlockData(folder string, height int64) (*storedBlockData, error) {
+	var raw json.RawMessage
+	if err := loadStoredJSON(folder, blockDataFilePrefix, height, &raw); err != nil {
+		return nil, err
+	}
+	data := new(storedBlockData)
+	if err := json.Unmarshal(raw, data); err != nil {
+		return nil, fmt.Errorf("failed to decode block data %d: %v", height, err)
+	}
+	if err := json.Unmarshal(raw, &data.Sections); err != nil {
+		return nil, fmt.Errorf("failed to decode block data %d: %v", height, err)
+	}
+	return data, nil
+}
+
+// loadStoredStakeInfoData loads the stake info data saved for the given
+// height.
+func loadStoredStakeInfoData(folder string, height int64) (*storedStakeInfoData, error) {
+	data := new(storedStakeInfoData)
+	if err := loadStoredJSON(folder, stakeInfoFilePrefix, height, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// latestStoredHeight returns the greatest height for which a file with the
+// given prefix exists in folder.
+func latestStoredHeight(folder, prefix string) (int64, error) {
+	matches, err := filepath.Glob(filepath.Join(folder, prefix+"*.json"))
+	if err != nil {
+		return 0, err
+	}
+	latest := int64(-1)
+	for _, m := range matches {
+		h := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), prefix), ".json")
+		height, err := strconv.ParseInt(h, 10, 64)
+		if err != nil {
+			continue
+		}
+		if height > latest {
+			latest = height
+		}
+	}
+	if latest < 0 {
+		return 0, fmt.Errorf("no %s files found in %s", prefix, folder)
+	}
+	return latest, nil
+}
@@ -4,7 +4,7 @@
 //
 // chappjc
 
-package main
+package spy
 
 import (
 	"bytes"
@@ -49,12 +49,6 @@ type BlockDataToJSONFiles struct {
 	fileSaver
 }
 
-// BlockDataToMySQL implements BlockDataSaver interface for output to a
-// MySQL database
-// type BlockDataToMySQL struct {
-// 	mtx *sync.Mutex
-// }
-
 // NewBlockDataToJSONStdOut creates a new BlockDataToJSONStdOut with optional
 // existing mutex
 func NewBlockDataToJSONStdOut(m ...*sync.Mutex) *BlockDataToJSONStdOut {
@@ -154,8 +148,20 @@ func (s *BlockDataToSummaryStdOut) Store(data *blockData) error {
 			data.poolinfo.PoolSize, data.poolinfo.PoolValAvg, data.poolinfo.PoolValue)
 	}
 
+	if data.coinsupply >= 0 {
+		fmt.Printf("  Coin supply:  %.2f DCR\n", data.coinsupply)
+	}
+
 	fmt.Printf("  Node connections:  %d\n", data.connections)
 
+	for _, sec := range data.extensions {
+		sectionJSON, err := json.Marshal(sec.data)
+		if err != nil {
+			sectionJSON = []byte(err.Error())
+		}
+		fmt.Printf("  %s:  %s\n", sec.name, sectionJSON)
+	}
+
 	return nil
 }
 
@@ -186,6 +192,10 @@ func (s *BlockDataToJSONFiles) Store(data *blockData) error {
 
 	s.file = *fp
 	_, err = writeFormattedJSONBlockData(jsonConcat, &s.file)
+	if err == nil {
+		signStoredFile(fullfile)
+	}
+	spyDataCache.stored(blockDataFilePrefix, int64(height))
 
 	return err
 }
@@ -238,10 +248,35 @@ func JSONFormatBlockData(data *blockData) (*bytes.Buffer, error) {
 	}
 	jsonAll.Write(poolInfoJSON)
 
+	if data.coinsupply >= 0 {
+		jsonAll.WriteString(",\"coin_supply\": ")
+		jsonAll.WriteString(strconv.FormatFloat(data.coinsupply, 'f', -1, 64))
+	}
+
+	for _, sec := range data.extensions {
+		sectionJSON, err := json.Marshal(sec.data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode section %s: %v",
+				sec.name, err)
+		}
+		jsonAll.WriteString(",")
+		jsonAll.WriteString(strconv.Quote(sec.name))
+		jsonAll.WriteString(": ")
+		jsonAll.Write(sectionJSON)
+	}
+
 	jsonAll.WriteString("}")
 
+	// Post-processing pipeline
+	jsonBytes := jsonAll.Bytes()
+	if len(blockDataPipeline) > 0 {
+		if jsonBytes, err = blockDataPipeline.transformJSON(jsonBytes); err != nil {
+			return nil, err
+		}
+	}
+
 	var jsonAllIndented bytes.Buffer
-	err = json.Indent(&jsonAllIndented, jsonAll.Bytes(), "", "    ")
+	err = json.Indent(&jsonAllIndented, jsonBytes, "", "    ")
 	if err != nil {
 		return nil, err
 	}
@@ -272,12 +307,6 @@ type StakeInfoDataToJSONFiles struct {
 	fileSaver
 }
 
-// StakeInfoDataToMySQL implements StakeInfoDataSaver interface for output to a
-// MySQL database
-// type StakeInfoDataToMySQL struct {
-// 	mtx *sync.Mutex
-// }
-
 // NewStakeInfoDataToJSONStdOut creates a new StakeInfoDataToJSONStdOut with
 // optional existing mutex
 func NewStakeInfoDataToJSONStdOut(m ...*sync.Mutex) *StakeInfoDataToJSONStdOut {
@@ -477,6 +506,10 @@ func (s *StakeInfoDataToJSONFiles) Store(data *stakeInfoData) error {
 	s.file = *fp
 	//_, err = writeFormattedJSONStakeInfoData(jsonConcat, &s.file)
 	_, err = fmt.Fprintln(&s.file, jsonConcat.String())
+	if err == nil {
+		signStoredFile(fullfile)
+	}
+	spyDataCache.stored(stakeInfoFilePrefix, int64(height))
 
 	return err
 }
@@ -509,10 +542,25 @@ func JSONFormatStakeInfoData(data *stakeInfoData) (*bytes.Buffer, error) {
 	}
 	jsonAll.Write(balancesJSON)
 
+	jsonAll.WriteString(",\"tickets\": ")
+	ticketsJSON, err := json.Marshal(data.tickets)
+	if err != nil {
+		return nil, err
+	}
+	jsonAll.Write(ticketsJSON)
+
 	jsonAll.WriteString("}")
 
+	// Post-processing pipeline
+	jsonBytes := jsonAll.Bytes()
+	if len(stakeInfoPipeline) > 0 {
+		if jsonBytes, err = stakeInfoPipeline.transformJSON(jsonBytes); err != nil {
+			return nil, err
+		}
+	}
+
 	var jsonAllIndented bytes.Buffer
-	err = json.Indent(&jsonAllIndented, jsonAll.Bytes(), "", "    ")
+	err = json.Indent(&jsonAllIndented, jsonBytes, "", "    ")
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,463 @@
+// dbwal.go implements the write-ahead log of the database savers.  The SQLite,
+// Bolt, MySQL and PostgreSQL savers append each block's data and stake info,
+// and the SQLite and PostgreSQL savers each watched address event, as a record
+// to a local log file in the output folder (e.g. dbwal-postgres.jsonl), synced
+// to disk, and the records are inserted into the database in batches of up to
+// dbwal-batch, each in one transaction, every dbwal-interval or as soon as a
+// batch is full.  This is much faster than a transaction per record, e.g. when
+// catching up after a restart, and keeps the database out of the path of
+// event delivery.
+//
+// A batch that fails, e.g. while the database server is down, stays in the log
+// and is retried at the next flush, and the records left in the log when
+// dcrspy stops are inserted when it starts again, so an outage does not lose
+// data.  So that a long outage does not fill the disk, a log holding dbwal-max
+// records drops (and logs) new records until it is emptied.  A record the
+// database rejects is dropped, so that it does not block the others.  Since a
+// block or stake info record replaces the rows at its height, inserting it
+// again, e.g. after a crash before the log was truncated, is harmless, though
+// an event may then be stored twice.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of records
+const (
+	walBlockRecord     = "block"
+	walStakeInfoRecord = "stake_info"
+	walEventRecord     = "event"
+)
+
+// dbWALConfig configures the write-ahead log of a database saver.
+type dbWALConfig struct {
+	// path is the log file.
+	path string
+	// batch is the maximum number of records inserted in one transaction,
+	// and interval the time between flushes.
+	batch    int
+	interval time.Duration
+	// max is the maximum number of records in the log, beyond which new
+	// records are dropped.  0 is no limit.
+	max int
+}
+
+// newDBWALConfig returns the configuration of the write-ahead log of the named
+// saver (e.g. postgres), in the output folder.
+func newDBWALConfig(cfg *Config, name string) dbWALConfig {
+	return dbWALConfig{
+		path:     filepath.Join(cfg.OutFolder, "dbwal-"+name+".jsonl"),
+		batch:    cfg.DBWALBatch,
+		interval: cfg.DBWALInterval,
+		max:      cfg.DBWALMax,
+	}
+}
+
+// walRecord is a block's data, stake info or event logged for insertion, with
+// the columns of its row and the JSON document of block data or stake info,
+// Data.
+type walRecord struct {
+	Kind      string           `json:"kind"`
+	Height    uint32           `json:"height"`
+	Block     *walBlockRow     `json:"block,omitempty"`
+	StakeInfo *walStakeInfoRow `json:"stake_info,omitempty"`
+	Event     *spyEvent        `json:"event,omitempty"`
+	Data      string           `json:"data"`
+}
+
+// walBlockRow has the columns of a row of the blocks table, and the derived
+// metrics of the block.
+type walBlockRow struct {
+	Hash        string             `json:"hash"`
+	Time        int64              `json:"time"`
+	Size        int64              `json:"size"`
+	Voters      int64              `json:"voters"`
+	FreshStake  int64              `json:"freshstake"`
+	Revocations int64              `json:"revocations"`
+	Difficulty  float64            `json:"difficulty"`
+	SDiff       float64            `json:"sdiff"`
+	PoolSize    int64              `json:"poolsize"`
+	PoolValue   float64            `json:"poolvalue"`
+	FeeMean     float64            `json:"fee_mean"`
+	CoinSupply  float64            `json:"coinsupply"`
+	Derived     map[string]float64 `json:"derived,omitempty"`
+}
+
+// walStakeInfoRow has the columns of a row of the stake_info table.
+type walStakeInfoRow struct {
+	Live     int64   `json:"live"`
+	Immature int64   `json:"immature"`
+	Voted    int64   `json:"voted"`
+	Missed   int64   `json:"missed"`
+	Revoked  int64   `json:"revoked"`
+	Balance  float64 `json:"balance"`
+}
+
+// newBlockRecord returns the record of the block data.
+func newBlockRecord(data *blockData) (*walRecord, error) {
+	jsonConcat, err := JSONFormatBlockData(data)
+	if err != nil {
+		return nil, err
+	}
+	h := &data.header
+	return &walRecord{
+		Kind:   walBlockRecord,
+		Height: h.Height,
+		Block: &walBlockRow{
+			Hash:        h.Hash,
+			Time:        h.Time,
+			Size:        int64(h.Size),
+			Voters:      int64(h.Voters),
+			FreshStake:  int64(h.FreshStake),
+			Revocations: int64(h.Revocations),
+			Difficulty:  h.Difficulty,
+			SDiff:       data.currentstakediff.CurrentStakeDifficulty,
+			PoolSize:    int64(data.poolinfo.PoolSize),
+			PoolValue:   data.poolinfo.PoolValue,
+			FeeMean:     data.feeinfo.Mean,
+			CoinSupply:  data.coinsupply,
+			Derived:     data.derived,
+		},
+		Data: strings.TrimSpace(jsonConcat.String()),
+	}, nil
+}
+
+// newStakeInfoRecord returns the record of the stake info.
+func newStakeInfoRecord(data *stakeInfoData) (*walRecord, error) {
+	jsonConcat, err := JSONFormatStakeInfoData(data)
+	if err != nil {
+		return nil, err
+	}
+	row := &walStakeInfoRow{}
+	if si := data.stakeinfo; si != nil {
+		row.Live, row.Immature = int64(si.Live), int64(si.Immature)
+		row.Voted, row.Missed, row.Revoked = int64(si.Voted),
+			int64(si.Missed), int64(si.Revoked)
+	}
+	if data.balances != nil {
+		row.Balance = data.balances.AllAllAcounts
+	}
+	return &walRecord{
+		Kind:      walStakeInfoRecord,
+		Height:    data.height,
+		StakeInfo: row,
+		Data:      strings.TrimSpace(jsonConcat.String()),
+	}, nil
+}
+
+// newEventRecord returns the record of the event.
+func newEventRecord(e *spyEvent) *walRecord {
+	return &walRecord{
+		Kind:   walEventRecord,
+		Height: uint32(e.Height),
+		Event:  e,
+	}
+}
+
+// dbWAL is the write-ahead log of a database saver.  The logged records are
+// pending until committed to the database by commit, which inserts its
+// records in one transaction.
+type dbWAL struct {
+	cfg dbWALConfig
+	// name is the name of the saver, e.g. postgres, in errors.
+	name   string
+	commit func([]*walRecord) error
+	// retryable returns true if a failed commit may succeed if retried, or
+	// false if the database rejected a record.
+	retryable func(error) bool
+
+	mtx     sync.Mutex
+	file    *os.File
+	size    int64
+	pending []*walRecord
+	// logged is the number of records in the file, and dropped the number
+	// of records dropped since the log was last full.
+	logged  int
+	dropped int
+
+	// flushMtx serializes flushes.
+	flushMtx sync.Mutex
+	full     chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// openDBWAL opens the write-ahead log of the named saver, creating it if
+// needed, and commits the records left in it.  A goroutine then commits the
+// logged records until close.  If retryable is nil, every failed commit is
+// retried.
+func openDBWAL(cfg dbWALConfig, name string, commit func([]*walRecord) error,
+	retryable func(error) bool) (*dbWAL, error) {
+	if cfg.batch < 1 || cfg.interval <= 0 {
+		return nil, fmt.Errorf("invalid batch size %d or interval %v",
+			cfg.batch, cfg.interval)
+	}
+	pending, size, err := readWALRecords(cfg.path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(cfg.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if retryable == nil {
+		retryable = func(error) bool { return true }
+	}
+	w := &dbWAL{
+		cfg:       cfg,
+		name:      name,
+		commit:    commit,
+		retryable: retryable,
+		file:      f,
+		size:      size,
+		pending:   pending,
+		logged:    len(pending),
+		full:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if len(pending) > 0 {
+		log.Infof("Inserting %d record(s) left in the write-ahead log %s.",
+			len(pending), cfg.path)
+		if err = w.flush(); err != nil {
+			log.Warnf("%d record(s) remain in the write-ahead log %s: %v",
+				w.len(), cfg.path, err)
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// readWALRecords reads the records of the log file at path, if it exists,
+// returning them and the size of the file without a partly written last
+// record, which is truncated.
+func readWALRecords(path string) ([]*walRecord, int64, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	// A crash while appending a record may leave it without its newline.
+	size := int64(bytes.LastIndexByte(b, '\n') + 1)
+	if size < int64(len(b)) {
+		log.Warnf("Discarding a partly written record at the end of the "+
+			"write-ahead log %s.", path)
+		if err = os.Truncate(path, size); err != nil {
+			return nil, 0, err
+		}
+	}
+	var records []*walRecord
+	for i, line := range bytes.Split(b[:size], []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		r := new(walRecord)
+		if err = json.Unmarshal(line, r); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode line %d of %s: %v",
+				i+1, path, err)
+		}
+		records = append(records, r)
+	}
+	return records, size, nil
+}
+
+// storeBlock logs the block data for insertion.
+func (w *dbWAL) storeBlock(data *blockData) error {
+	r, err := newBlockRecord(data)
+	if err == nil {
+		err = w.append(r)
+	}
+	if err != nil {
+		err = reportError(errKindSaver, w.name, err)
+		log.Errorf("Unable to log block data in %s: %v", w.cfg.path, err)
+	}
+	return err
+}
+
+// storeEvent logs the event for insertion.
+func (w *dbWAL) storeEvent(e *spyEvent) error {
+	err := w.append(newEventRecord(e))
+	if err != nil {
+		err = reportError(errKindSaver, w.name, err)
+		log.Errorf("Unable to log event %d in %s: %v", e.Seq, w.cfg.path, err)
+	}
+	return err
+}
+
+// storeStakeInfo logs the stake info for insertion.
+func (w *dbWAL) storeStakeInfo(data *stakeInfoData) error {
+	r, err := newStakeInfoRecord(data)
+	if err == nil {
+		err = w.append(r)
+	}
+	if err != nil {
+		err = reportError(errKindSaver, w.name, err)
+		log.Errorf("Unable to log stake info data in %s: %v", w.cfg.path, err)
+	}
+	return err
+}
+
+// append logs the record, synced to disk, for insertion at the next flush.
+// The record is dropped if the log is full.
+func (w *dbWAL) append(r *walRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.file == nil {
+		return fmt.Errorf("write-ahead log %s is closed", w.cfg.path)
+	}
+	if w.cfg.max > 0 && w.logged >= w.cfg.max {
+		w.dropped++
+		return fmt.Errorf("write-ahead log full with %d records, dropped "+
+			"the %s record at height %d (%d dropped)", w.logged, r.Kind,
+			r.Height, w.dropped)
+	}
+	n, err := w.file.Write(append(b, '\n'))
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// A partly written record would corrupt the next one.
+		if n > 0 {
+			w.file.Truncate(w.size)
+		}
+		return err
+	}
+	w.size += int64(n)
+	w.logged++
+	w.pending = append(w.pending, r)
+	if len(w.pending) >= w.cfg.batch {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// len returns the number of pending records.
+func (w *dbWAL) len() int {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return len(w.pending)
+}
+
+// flush commits the pending records in batches, removing them from the log
+// once all are committed.  It stops at the first batch that fails with an
+// error that may be retried, which stays in the log.
+func (w *dbWAL) flush() error {
+	w.flushMtx.Lock()
+	defer w.flushMtx.Unlock()
+	for {
+		w.mtx.Lock()
+		n := len(w.pending)
+		if n > w.cfg.batch {
+			n = w.cfg.batch
+		}
+		batch := w.pending[:n:n]
+		w.mtx.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		err := w.commit(batch)
+		if err != nil {
+			if w.retryable(err) {
+				return err
+			}
+			// The records are committed one at a time, dropping those the
+			// database rejects.
+			n, err = w.commitEach(batch)
+		}
+
+		w.mtx.Lock()
+		w.pending = w.pending[n:]
+		if len(w.pending) == 0 {
+			// Everything logged is in the database.
+			w.pending = nil
+			if terr := w.file.Truncate(0); terr == nil {
+				w.size, w.logged = 0, 0
+				if w.dropped > 0 {
+					log.Warnf("Write-ahead log %s emptied, after dropping "+
+						"%d record(s) while full.", w.cfg.path, w.dropped)
+					w.dropped = 0
+				}
+			} else if err == nil {
+				err = terr
+			}
+		}
+		w.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// commitEach commits the records one at a time, dropping those the database
+// rejects.  It returns the number of records committed or dropped before a
+// failure that may be retried.
+func (w *dbWAL) commitEach(records []*walRecord) (int, error) {
+	for i, r := range records {
+		err := w.commit(records[i : i+1])
+		if err == nil {
+			continue
+		}
+		if w.retryable(err) {
+			return i, err
+		}
+		log.Errorf("Dropped the %s record at height %d from the write-ahead "+
+			"log %s: %v", r.Kind, r.Height, w.cfg.path, err)
+	}
+	return len(records), nil
+}
+
+// run flushes the log every interval, or when a batch is full, until close.
+// It should be run as a goroutine.
+func (w *dbWAL) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.full:
+		case <-w.quit:
+			return
+		}
+		if err := w.flush(); err != nil {
+			log.Warnf("%d record(s) remain in the write-ahead log %s: %v",
+				w.len(), w.cfg.path, err)
+		}
+	}
+}
+
+// close stops flushing, commits the pending records, and closes the log.
+// Records that could not be committed are kept in the log for the next run.
+func (w *dbWAL) close() error {
+	close(w.quit)
+	<-w.done
+	if err := w.flush(); err != nil {
+		log.Warnf("%d record(s) remain in the write-ahead log %s, to be "+
+			"inserted when dcrspy starts again: %v", w.len(), w.cfg.path, err)
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
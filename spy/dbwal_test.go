@@ -0,0 +1,250 @@
+package spy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// errRejected is the error of a record rejected by the test database.
+var errRejected = errors.New("rejected")
+
+// testDB is a database committing batches of records, which fails while down,
+// and rejects the records at the heights in reject.
+type testDB struct {
+	mtx     sync.Mutex
+	down    bool
+	reject  map[uint32]bool
+	batches [][]uint32
+}
+
+func (db *testDB) commit(records []*walRecord) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.down {
+		return errors.New("connection refused")
+	}
+	var heights []uint32
+	for _, r := range records {
+		if db.reject[r.Height] {
+			return errRejected
+		}
+		heights = append(heights, r.Height)
+	}
+	db.batches = append(db.batches, heights)
+	return nil
+}
+
+func (db *testDB) setDown(down bool) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.down = down
+}
+
+func (db *testDB) committed() []uint32 {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	var heights []uint32
+	for _, b := range db.batches {
+		heights = append(heights, b...)
+	}
+	return heights
+}
+
+func testWALConfig(t *testing.T, batch int) dbWALConfig {
+	return dbWALConfig{
+		path:     filepath.Join(t.TempDir(), "dbwal-test.jsonl"),
+		batch:    batch,
+		interval: time.Hour,
+	}
+}
+
+func appendTestRecords(t *testing.T, w *dbWAL, from, to uint32) {
+	for h := from; h <= to; h++ {
+		r := &walRecord{Kind: walBlockRecord, Height: h,
+			Block: &walBlockRow{Hash: "00ab"}, Data: `{"height": 1}`}
+		if err := w.append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func walFileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestDBWAL(t *testing.T) {
+	tests := []struct {
+		name   string
+		batch  int
+		n      uint32
+		down   bool
+		reject map[uint32]bool
+		// want are the committed heights after close, and remain the
+		// number of records left in the log.
+		want   []uint32
+		remain int
+	}{
+		{"one batch", 10, 4, false, nil, []uint32{1, 2, 3, 4}, 0},
+		{"batches", 3, 7, false, nil, []uint32{1, 2, 3, 4, 5, 6, 7}, 0},
+		{"rejected", 3, 5, false, map[uint32]bool{2: true},
+			[]uint32{1, 3, 4, 5}, 0},
+		{"outage", 3, 5, true, nil, nil, 5},
+	}
+	for _, tt := range tests {
+		cfg := testWALConfig(t, tt.batch)
+		db := &testDB{down: tt.down, reject: tt.reject}
+		retryable := func(err error) bool { return err != errRejected }
+		w, err := openDBWAL(cfg, "test", db.commit, retryable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appendTestRecords(t, w, 1, tt.n)
+		if err = w.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := db.committed()
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: committed %v, want %v", tt.name, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%s: committed %v, want %v", tt.name, got, tt.want)
+			}
+		}
+		for _, b := range db.batches {
+			if len(b) > tt.batch {
+				t.Errorf("%s: committed a batch of %d records, more than %d",
+					tt.name, len(b), tt.batch)
+			}
+		}
+		records, _, err := readWALRecords(cfg.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != tt.remain {
+			t.Errorf("%s: %d records remain in the log, want %d", tt.name,
+				len(records), tt.remain)
+		}
+		if err = w.append(&walRecord{}); err == nil {
+			t.Errorf("%s: appended to a closed log", tt.name)
+		}
+	}
+}
+
+func TestDBWALReplay(t *testing.T) {
+	cfg := testWALConfig(t, 2)
+	db := &testDB{down: true}
+	w, err := openDBWAL(cfg, "test", db.commit, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendTestRecords(t, w, 1, 3)
+	// A flush during the outage keeps the records.
+	if err = w.flush(); err == nil {
+		t.Fatal("flush succeeded while the database is down")
+	}
+	if err = w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record partly written by a crash is discarded.
+	f, err := os.OpenFile(cfg.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"kind":"block","height":4,"da`)
+	f.Close()
+
+	// The records left in the log are committed when it is opened again,
+	// and the log continues after them.
+	db.setDown(false)
+	w, err = openDBWAL(cfg, "test", db.commit, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{1, 2, 3}
+	if got := db.committed(); len(got) != len(want) || got[2] != 3 {
+		t.Fatalf("committed %v on opening, want %v", got, want)
+	}
+	if len(db.batches) != 2 {
+		t.Errorf("committed %d batches, want 2", len(db.batches))
+	}
+	if size := walFileSize(t, cfg.path); size != 0 {
+		t.Errorf("the log has %d bytes after all records were committed", size)
+	}
+	db.setDown(true)
+	appendTestRecords(t, w, 4, 4)
+	if err = w.close(); err != nil {
+		t.Fatal(err)
+	}
+	records, _, err := readWALRecords(cfg.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Height != 4 ||
+		records[0].Block.Hash != "00ab" {
+		t.Errorf("got records %v in the log, want the block at height 4",
+			records)
+	}
+
+	if err = ioutil.WriteFile(cfg.path, []byte("not json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = openDBWAL(cfg, "test", db.commit, nil); err == nil {
+		t.Error("opened a corrupted log")
+	}
+}
+
+func TestDBWALMax(t *testing.T) {
+	cfg := testWALConfig(t, 10)
+	cfg.max = 3
+	db := &testDB{down: true}
+	w, err := openDBWAL(cfg, "test", db.commit, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	// Records are dropped while the log is full.
+	appendTestRecords(t, w, 1, 3)
+	if err = w.append(newEventRecord(&spyEvent{Seq: 7, Height: 4})); err == nil {
+		t.Fatal("appended to a full log")
+	}
+	if w.dropped != 1 {
+		t.Errorf("dropped %d records, want 1", w.dropped)
+	}
+	if err = w.flush(); err == nil {
+		t.Fatal("flush succeeded while the database is down")
+	}
+
+	// The log accepts records again once emptied.
+	db.setDown(false)
+	if err = w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if w.dropped != 0 {
+		t.Errorf("%d records dropped after emptying the log", w.dropped)
+	}
+	if err = w.append(newEventRecord(&spyEvent{Seq: 8, Height: 5})); err != nil {
+		t.Fatal(err)
+	}
+	records, _, err := readWALRecords(cfg.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Kind != walEventRecord ||
+		records[0].Event == nil || records[0].Event.Seq != 8 {
+		t.Errorf("got records %v in the log, want the event at height 5",
+			records)
+	}
+}
@@ -0,0 +1,79 @@
+// deadmansswitch.go pings an external dead man's switch service (e.g.
+// healthchecks.io) after each successfully processed block.  The service
+// alerts when the pings stop, i.e. if dcrspy or its node stops making
+// progress, which dcrspy cannot report by itself.
+
+package spy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// deadMansSwitch pings a URL after each processed block.
+type deadMansSwitch struct {
+	url    string
+	client *http.Client
+	// ping is signaled with the height of each processed block.  Pings are
+	// dropped while a previous ping is in progress.
+	ping chan int64
+}
+
+// spyDeadMansSwitch is the package-level dead man's switch, or nil if not
+// configured.
+var spyDeadMansSwitch *deadMansSwitch
+
+// newDeadMansSwitch creates a deadMansSwitch for the URL, and starts the
+// goroutine sending the pings.
+func newDeadMansSwitch(url string) *deadMansSwitch {
+	d := &deadMansSwitch{
+		url:    url,
+		client: newHTTPClient(),
+		ping:   make(chan int64, 1),
+	}
+	go d.pinger()
+	return d
+}
+
+// blockProcessed requests a ping for the block at the given height.  It does
+// not block.
+func (d *deadMansSwitch) blockProcessed(height int64) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.ping <- height:
+	default:
+		log.Debugf("Dead man's switch ping in progress, skipping block %d",
+			height)
+	}
+}
+
+// pinger sends a ping for each requested block.
+func (d *deadMansSwitch) pinger() {
+	for height := range d.ping {
+		if err := d.send(); err != nil {
+			log.Warnf("Dead man's switch ping for block %d failed: %v",
+				height, err)
+			continue
+		}
+		log.Tracef("Dead man's switch pinged for block %d", height)
+	}
+}
+
+// send requests the URL, returning an error if it fails or the response
+// status is not 2xx.
+func (d *deadMansSwitch) send() error {
+	resp, err := d.client.Get(d.url)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+// derived.go implements derived metrics, computed fields defined in the config
+// with expressions of the collected block data, e.g.
+//
+//	metric=price_per_pool_ticket=pool_value / pool_size
+//
+// Derived metrics are computed for each block, saved in the derived_metrics
+// section of the block data, and exported as gauges at /metrics.  Metric
+// alerts are conditions of the block data, derived metrics and exchange rate
+// for which an alert is sent when they become true, evaluated on each block
+// and each exchange rate update, e.g.
+//
+//	metricalert=pool_size < 40000 && price_change_24h <= -10
+
+package spy
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// derivedMetricsSection is the name of the block data section holding the
+// derived metrics.
+const derivedMetricsSection = "derived_metrics"
+
+// derivedMetricNameRE matches valid derived metric names, which are also used
+// in metric names at /metrics.
+var derivedMetricNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// vars returns the block data as variables for expressions.
+func (d *blockData) vars() map[string]float64 {
+	v := map[string]float64{
+		"height":            float64(d.header.Height),
+		"time":              float64(d.header.Time),
+		"size":              float64(d.header.Size),
+		"voters":            float64(d.header.Voters),
+		"freshstake":        float64(d.header.FreshStake),
+		"revocations":       float64(d.header.Revocations),
+		"difficulty":        d.header.Difficulty,
+		"sbits":             d.header.SBits,
+		"connections":       float64(d.connections),
+		"ticket_price":      d.currentstakediff.CurrentStakeDifficulty,
+		"next_ticket_price": d.currentstakediff.NextStakeDifficulty,
+		"est_ticket_price":  d.eststakediff.Expected,
+		"est_ticket_min":    d.eststakediff.Min,
+		"est_ticket_max":    d.eststakediff.Max,
+		"fee_count":         float64(d.feeinfo.Number),
+		"fee_min":           d.feeinfo.Min,
+		"fee_max":           d.feeinfo.Max,
+		"fee_mean":          d.feeinfo.Mean,
+		"fee_median":        d.feeinfo.Median,
+		"fee_stddev":        d.feeinfo.StdDev,
+		"pool_size":         float64(d.poolinfo.PoolSize),
+		"window_num":        float64(d.priceWindowNum),
+		"window_index":      float64(d.idxBlockInWindow),
+	}
+	// Pool value and coin supply are negative when not collected.
+	if d.poolinfo.PoolValue >= 0 {
+		v["pool_value"] = d.poolinfo.PoolValue
+		v["pool_avg_price"] = d.poolinfo.PoolValAvg
+	}
+	if d.coinsupply >= 0 {
+		v["coin_supply"] = d.coinsupply
+	}
+	for name, val := range d.derived {
+		v[name] = val
+	}
+	return v
+}
+
+// exprVarsOf returns the variables as exprVars.
+func exprVarsOf(v map[string]float64) exprVars {
+	return func(name string) (interface{}, bool) {
+		f, ok := v[name]
+		return f, ok
+	}
+}
+
+// derivedMetric is a named expression of the block data.
+type derivedMetric struct {
+	name string
+	expr *expression
+}
+
+// metricAlert is a condition of the block data that raises an alert when it
+// becomes true, and a recovery notification when it becomes false.  key
+// identifies its alert state.
+//
+// To suppress flapping, the condition may be required to hold for minDuration
+// before the alert fires, and a condition that compares numbers (e.g.
+// pool_size < 40000) may have a hysteresis, the margin by which the comparison
+// must be false before the alert resolves (e.g. pool_size >= 40500).
+type metricAlert struct {
+	cond        *expression
+	key         string
+	minDuration time.Duration
+	hysteresis  float64
+	// pendingSince is when the condition started to hold, if not firing.
+	pendingSince time.Time
+	firing       bool
+}
+
+// parseMetricAlert parses CONDITION[ | OPTION ...], where the options are
+// for=DURATION, the minimum duration, and hysteresis=MARGIN.
+func parseMetricAlert(s string) (*metricAlert, error) {
+	cond, opts := s, ""
+	if i := strings.LastIndex(s, " | "); i >= 0 {
+		cond, opts = s[:i], s[i+3:]
+	}
+	x, err := parseExpression(cond)
+	if err != nil {
+		return nil, err
+	}
+	a := &metricAlert{cond: x, key: "metric:" + x.String()}
+	for _, opt := range strings.Fields(opts) {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option %q", opt)
+		}
+		switch kv[0] {
+		case "for":
+			a.minDuration, err = time.ParseDuration(kv[1])
+			if err != nil || a.minDuration < 0 {
+				return nil, fmt.Errorf("invalid duration %q", kv[1])
+			}
+		case "hysteresis":
+			a.hysteresis, err = strconv.ParseFloat(kv[1], 64)
+			if err != nil || a.hysteresis < 0 {
+				return nil, fmt.Errorf("invalid hysteresis %q", kv[1])
+			}
+			if _, ok := hysteresisComparison(x); !ok {
+				return nil, fmt.Errorf("hysteresis requires a condition " +
+					"comparing numbers with <, <=, > or >=")
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", kv[0])
+		}
+	}
+	return a, nil
+}
+
+// hysteresisComparison returns the comparison at the root of the expression,
+// if it is <, <=, > or >=.
+func hysteresisComparison(x *expression) (*exprBinary, bool) {
+	b, ok := x.root.(*exprBinary)
+	if !ok {
+		return nil, false
+	}
+	switch b.op {
+	case "<", "<=", ">", ">=":
+		return b, true
+	}
+	return nil, false
+}
+
+// holds evaluates the condition.  While the alert is firing, the comparison
+// is shifted by the hysteresis, so that the condition holds until it is false
+// by that margin.
+func (a *metricAlert) holds(vars exprVars) (bool, error) {
+	b, ok := hysteresisComparison(a.cond)
+	if !a.firing || a.hysteresis == 0 || !ok {
+		return a.cond.evalBool(vars)
+	}
+	left, err := (&expression{root: b.left}).evalNumber(vars)
+	if err != nil {
+		return false, err
+	}
+	right, err := (&expression{root: b.right}).evalNumber(vars)
+	if err != nil {
+		return false, err
+	}
+	switch b.op {
+	case "<", "<=":
+		return left < right+a.hysteresis, nil
+	default:
+		return left > right-a.hysteresis, nil
+	}
+}
+
+// derivedMetrics holds the configured metrics and alerts, and the latest
+// values.
+type derivedMetrics struct {
+	mtx     sync.Mutex
+	metrics []*derivedMetric
+	alerts  []*metricAlert
+	latest  map[string]float64
+	// blockVars and blockDerived are the variables and derived metrics of
+	// the latest block, for alerts evaluated on exchange rate updates.
+	blockVars    map[string]float64
+	blockDerived map[string]float64
+}
+
+// spyDerivedMetrics is the package-level set of derived metrics, nil if none
+// are configured.
+var spyDerivedMetrics *derivedMetrics
+
+// newDerivedMetrics parses metric definitions of the form NAME=EXPRESSION and
+// alert conditions, registering a gauge for each metric.  Metrics are
+// computed in order, so a metric may use those defined before it.
+func newDerivedMetrics(defs, alerts []string) (*derivedMetrics, error) {
+	m := &derivedMetrics{latest: make(map[string]float64)}
+	for _, def := range defs {
+		kv := strings.SplitN(def, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !derivedMetricNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid metric definition %q: expected "+
+				"NAME=EXPRESSION", def)
+		}
+		for _, dm := range m.metrics {
+			if dm.name == name {
+				return nil, fmt.Errorf("metric %s defined twice", name)
+			}
+		}
+		x, err := parseExpression(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression for metric %s: %v",
+				name, err)
+		}
+		m.metrics = append(m.metrics, &derivedMetric{name, x})
+
+		spyMetrics.newGauge("dcrspy_derived_"+name,
+			fmt.Sprintf("Derived metric %s = %s.", name, x), func() float64 {
+				m.mtx.Lock()
+				defer m.mtx.Unlock()
+				if v, ok := m.latest[name]; ok {
+					return v
+				}
+				return math.NaN()
+			})
+	}
+	for _, s := range alerts {
+		a, err := parseMetricAlert(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric alert %q: %v", s, err)
+		}
+		m.alerts = append(m.alerts, a)
+	}
+	return m, nil
+}
+
+// compute evaluates the metrics for the block data.  A metric that cannot be
+// computed (e.g. division by zero, or a variable not collected) is omitted.
+func (m *derivedMetrics) compute(d *blockData) map[string]float64 {
+	if m == nil || len(m.metrics) == 0 {
+		return nil
+	}
+	vars := d.vars()
+	values := make(map[string]float64, len(m.metrics))
+	for _, dm := range m.metrics {
+		v, err := dm.expr.evalNumber(exprVarsOf(vars))
+		if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			err = fmt.Errorf("result is not finite")
+		}
+		if err != nil {
+			log.Debugf("Unable to compute metric %s at block %d: %v",
+				dm.name, d.header.Height, err)
+			continue
+		}
+		values[dm.name] = v
+		vars[dm.name] = v
+	}
+
+	m.mtx.Lock()
+	m.latest = values
+	m.mtx.Unlock()
+	return values
+}
+
+// checkAlerts evaluates the alert conditions for the block data and the
+// current exchange rate, sending an alert for each condition that has become
+// true, and a recovery notification for each that has become false, since the
+// previous evaluation.
+func (m *derivedMetrics) checkAlerts(d *blockData) {
+	if m == nil || len(m.alerts) == 0 {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.blockVars = d.vars()
+	m.blockDerived = d.derived
+	m.evalAlerts(fmt.Sprintf("Block %d", d.header.Height))
+}
+
+// priceUpdated evaluates the alert conditions for the latest block data and
+// the updated exchange rate, so that conditions combining both are evaluated
+// on each new data point.
+func (m *derivedMetrics) priceUpdated() {
+	if m == nil || len(m.alerts) == 0 {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.evalAlerts("Price update")
+}
+
+// evalAlerts evaluates the alert conditions for the latest block variables
+// and the price variables.  A condition using a variable that is not known
+// (e.g. price without a current rate) is skipped.  The mutex must be held.
+func (m *derivedMetrics) evalAlerts(point string) {
+	priceVars := spyExchangeRate.vars()
+	vars := mergeVars(m.blockVars, priceVars)
+	now := time.Now()
+	for _, a := range m.alerts {
+		holds, err := a.holds(exprVarsOf(vars))
+		if err != nil {
+			log.Debugf("Unable to evaluate metric alert %q (%s): %v",
+				a.cond, point, err)
+			continue
+		}
+		values := formatVars(mergeVars(m.blockDerived, priceVars))
+		switch {
+		case !holds:
+			a.pendingSince = time.Time{}
+			if a.firing {
+				resolveAlert(a.key, "%s: %s no longer holds (%s).", point,
+					a.cond, values)
+				a.firing = false
+			}
+		case a.firing:
+		case a.pendingSince.IsZero() && a.minDuration > 0:
+			a.pendingSince = now
+		case now.Sub(a.pendingSince) >= a.minDuration:
+			fireAlert(a.key, "metric condition", "%s: %s (%s).", point,
+				a.cond, values)
+			a.firing = true
+		}
+	}
+}
+
+// mergeVars returns the union of the variables.
+func mergeVars(a, b map[string]float64) map[string]float64 {
+	v := make(map[string]float64, len(a)+len(b))
+	for name, f := range a {
+		v[name] = f
+	}
+	for name, f := range b {
+		v[name] = f
+	}
+	return v
+}
+
+// formatVars formats values as "name=value, ..." sorted by name.
+func formatVars(v map[string]float64) string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%g", name, v[name]))
+	}
+	return strings.Join(parts, ", ")
+}
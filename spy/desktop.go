@@ -0,0 +1,157 @@
+// desktop.go shows the operator's watched address notifications, and
+// optionally new blocks, as desktop notifications when dcrspy runs on a
+// workstation: with notify-send (libnotify) on Linux and the BSDs, Notification
+// Center on macOS, and toast notifications on Windows.  The title and text are
+// passed to the scripts in environment variables, and to notify-send as
+// arguments, so they need no quoting.
+
+package spy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// desktopQueueSize is the number of notifications waiting to be shown, beyond
+// which new notifications are dropped.
+const desktopQueueSize = 50
+
+// Environment variables of the notification's title and text.
+const (
+	desktopTitleEnv = "DCRSPY_NOTIFY_TITLE"
+	desktopTextEnv  = "DCRSPY_NOTIFY_TEXT"
+)
+
+// desktopAppleScript shows a notification in Notification Center.
+const desktopAppleScript = `display notification (system attribute "` +
+	desktopTextEnv + `") with title (system attribute "` + desktopTitleEnv +
+	`")`
+
+// desktopPowerShell shows a toast notification, as PowerShell, which is
+// registered to show them.
+const desktopPowerShell = `` +
+	`[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null;` +
+	`$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02);` +
+	`$x = $t.GetElementsByTagName('text');` +
+	`$x.Item(0).AppendChild($t.CreateTextNode($env:` + desktopTitleEnv + `)) > $null;` +
+	`$x.Item(1).AppendChild($t.CreateTextNode($env:` + desktopTextEnv + `)) > $null;` +
+	`$id = '{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe';` +
+	`[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($id).Show([Windows.UI.Notifications.ToastNotification]::new($t))`
+
+// desktopMessage is a queued notification, and the watched address event it
+// notifies, if any.
+type desktopMessage struct {
+	title, text string
+	event       *spyEvent
+}
+
+// desktopNotifier shows desktop notifications with the platform's command.
+type desktopNotifier struct {
+	command string
+	args    []string
+	// textArgs is true if the title and text are appended to args.
+	textArgs bool
+	blocks   bool
+	queue    chan *desktopMessage
+}
+
+// spyDesktop is the package-level desktop notifier, nil if not enabled.
+var spyDesktop *desktopNotifier
+
+// newDesktopNotifier creates a desktopNotifier for the platform, also showing
+// new blocks if blocks is true.  An error is returned if the platform's
+// notification command is not found.
+func newDesktopNotifier(blocks bool) (*desktopNotifier, error) {
+	d := &desktopNotifier{
+		blocks: blocks,
+		queue:  make(chan *desktopMessage, desktopQueueSize),
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		d.command, d.args = "osascript", []string{"-e", desktopAppleScript}
+	case "windows":
+		d.command, d.args = "powershell", []string{"-NoProfile",
+			"-NonInteractive", "-Command", desktopPowerShell}
+	default:
+		d.command, d.args = "notify-send", []string{"--app-name=dcrspy", "--"}
+		d.textArgs = true
+	}
+	if _, err := exec.LookPath(d.command); err != nil {
+		return nil, fmt.Errorf("%s not found for desktop notifications on %s",
+			d.command, runtime.GOOS)
+	}
+	return d, nil
+}
+
+// Notify queues a notification of the watched address event, rendered
+// with the desktop template.  It does not block.
+func (d *desktopNotifier) Notify(e *spyEvent) error {
+	if d == nil {
+		return nil
+	}
+	d.enqueue(&desktopMessage{"dcrspy: watched address",
+		spyNotifyTemplates.render(notifyChannelDesktop, e), e})
+	return nil
+}
+
+// tracksDelivery implements deliveryNotifier.
+func (d *desktopNotifier) tracksDelivery() {}
+
+// notifyBlock queues a notification of the new block event, if new blocks
+// are shown.  It does not block.
+func (d *desktopNotifier) notifyBlock(e *spyEvent) {
+	if d == nil || !d.blocks {
+		return
+	}
+	d.enqueue(&desktopMessage{"dcrspy: new block", e.Message, nil})
+}
+
+// enqueue queues the notification, or drops it if the queue is full.
+func (d *desktopNotifier) enqueue(msg *desktopMessage) {
+	select {
+	case d.queue <- msg:
+	default:
+		log.Warnf("Desktop notification queue full. Dropping %q.", msg.text)
+		msg.event.delivered()
+	}
+}
+
+// run shows queued notifications until quit is closed.  It should be run as a
+// goroutine.
+func (d *desktopNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case msg := <-d.queue:
+			if err := d.show(msg); err != nil {
+				log.Warnf("Failed to show desktop notification: %v",
+					reportError(errKindNotifier, "desktop", err))
+			}
+			msg.event.delivered()
+		case <-quit:
+			log.Debugf("Quitting desktop notifier.")
+			return
+		}
+	}
+}
+
+// show runs the notification command for the message.
+func (d *desktopNotifier) show(msg *desktopMessage) error {
+	args := d.args
+	if d.textArgs {
+		args = append(args[:len(args):len(args)], msg.title, msg.text)
+	}
+	cmd := exec.Command(d.command, args...)
+	cmd.Env = append(os.Environ(), desktopTitleEnv+"="+msg.title,
+		desktopTextEnv+"="+msg.text)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", d.command, err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
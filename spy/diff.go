@@ -0,0 +1,169 @@
+// diff.go implements the diff command, which compares key metrics between two
+// heights for which block data was saved with --save-jsonfile.
+//
+// Usage: dcrspy diff --from H1 --to H2 [--json] [other dcrspy options]
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+
+	flags "github.com/btcsuite/go-flags"
+)
+
+// diffOptions are the options specific to the diff command.  Any other
+// options are passed on to the regular config parser, so that the output
+// folder and network are determined as usual.
+type diffOptions struct {
+	From int64 `long:"from" description:"Starting block height" required:"true"`
+	To   int64 `long:"to" description:"Ending block height" required:"true"`
+	JSON bool  `long:"json" description:"Write the differences as JSON instead of a table"`
+}
+
+// metricDiff is the change in a single metric between two heights.
+type metricDiff struct {
+	Name    string   `json:"name"`
+	From    *float64 `json:"from"`
+	To      *float64 `json:"to"`
+	Change  *float64 `json:"change"`
+	Percent *float64 `json:"percent"`
+}
+
+// blockDataDiff describes the changes in key metrics between two heights.
+type blockDataDiff struct {
+	FromHeight int64        `json:"fromheight"`
+	ToHeight   int64        `json:"toheight"`
+	Metrics    []metricDiff `json:"metrics"`
+}
+
+// diffMetrics extracts the compared metrics from stored block data.  A nil
+// value indicates the metric was not recorded.
+func diffMetrics(data *storedBlockData) map[string]*float64 {
+	f := func(v float64) *float64 { return &v }
+	m := map[string]*float64{
+		"ticket price": f(data.CurrentStakeDiff.CurrentStakeDifficulty),
+		"pool size":    f(float64(data.Header.PoolSize)),
+		"difficulty":   f(data.Header.Difficulty),
+		"supply":       data.CoinSupply,
+	}
+	// PoolValue is -1 when the pool value was not collected.
+	if data.PoolInfo.PoolValue >= 0 {
+		m["pool value"] = f(data.PoolInfo.PoolValue)
+	}
+	return m
+}
+
+// diffMetricNames sets the order of the metrics in the output.
+var diffMetricNames = []string{"ticket price", "pool size", "pool value",
+	"supply", "difficulty"}
+
+// diffBlockData computes the changes between the block data at two heights.
+func diffBlockData(from, to *storedBlockData) *blockDataDiff {
+	fromMetrics, toMetrics := diffMetrics(from), diffMetrics(to)
+
+	diff := &blockDataDiff{
+		FromHeight: int64(from.Header.Height),
+		ToHeight:   int64(to.Header.Height),
+	}
+	for _, name := range diffMetricNames {
+		md := metricDiff{
+			Name: name,
+			From: fromMetrics[name],
+			To:   toMetrics[name],
+		}
+		if md.From != nil && md.To != nil {
+			change := *md.To - *md.From
+			md.Change = &change
+			if *md.From != 0 {
+				pct := 100 * change / math.Abs(*md.From)
+				md.Percent = &pct
+			}
+		}
+		diff.Metrics = append(diff.Metrics, md)
+	}
+	return diff
+}
+
+// printDiffTable writes the differences as a plain text table to stdout.
+func printDiffTable(diff *blockDataDiff) {
+	fmtVal := func(v *float64) string {
+		if v == nil {
+			return "n/a"
+		}
+		return fmt.Sprintf("%.4f", *v)
+	}
+
+	fmt.Printf("%-14s %20s %20s %20s %10s\n", "Metric",
+		fmt.Sprintf("Height %d", diff.FromHeight),
+		fmt.Sprintf("Height %d", diff.ToHeight), "Change", "Change %")
+	for _, md := range diff.Metrics {
+		pct := "n/a"
+		if md.Percent != nil {
+			pct = fmt.Sprintf("%+.2f%%", *md.Percent)
+		}
+		change := fmtVal(md.Change)
+		if md.Change != nil {
+			change = fmt.Sprintf("%+.4f", *md.Change)
+		}
+		fmt.Printf("%-14s %20s %20s %20s %10s\n", md.Name, fmtVal(md.From),
+			fmtVal(md.To), change, pct)
+	}
+}
+
+// DiffMain is the entry point for the diff command.  args are the command line
+// arguments following "diff".  The return value is the exit code.
+func DiffMain(args []string) int {
+	var opts diffOptions
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.IgnoreUnknown)
+	remaining, err := parser.ParseArgs(args)
+	if err != nil {
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			parser.WriteHelp(os.Stdout)
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return 1
+	}
+
+	// Everything else is a regular option (e.g. --outfolder or --testnet).
+	os.Args = append([]string{os.Args[0]}, remaining...)
+	cfg, err := LoadConfig()
+	if err == ErrInfoShown {
+		return 0
+	}
+	if err != nil {
+		fmt.Printf("Failed to load dcrspy config: %s\n", err.Error())
+		return 1
+	}
+	defer backendLog.Flush()
+
+	from, err := loadStoredBlockData(cfg.OutFolder, opts.From)
+	if err != nil {
+		fmt.Printf("Unable to load block data for height %d: %v\n", opts.From, err)
+		return 2
+	}
+	to, err := loadStoredBlockData(cfg.OutFolder, opts.To)
+	if err != nil {
+		fmt.Printf("Unable to load block data for height %d: %v\n", opts.To, err)
+		return 2
+	}
+
+	diff := diffBlockData(from, to)
+
+	if opts.JSON {
+		j, err := json.MarshalIndent(diff, "", "    ")
+		if err != nil {
+			fmt.Printf("Failed to encode JSON: %v\n", err)
+			return 3
+		}
+		fmt.Println(string(j))
+		return 0
+	}
+
+	printDiffTable(diff)
+	return 0
+}
@@ -0,0 +1,229 @@
+// discord.go posts the operator's watched address notifications and alerts,
+// including the stake alerts of the vote monitors, to a Discord channel
+// through a webhook.  Each is sent as an embed: a watched address event shows
+// the amount, address, transaction and block height as fields, and an alert
+// is colored by severity.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// discordQueueSize is the number of messages waiting to be sent, beyond
+	// which new messages are dropped.
+	discordQueueSize = 200
+	// discordMaxRetryAfter is the longest wait for a rate limit to clear
+	// before a message is retried once.
+	discordMaxRetryAfter = 30 * time.Second
+)
+
+// Embed colors
+const (
+	discordColorMined     = 0x2ed6a1
+	discordColorMempool   = 0x2970ff
+	discordColorAlert     = 0xf5a623
+	discordColorCritical  = 0xed1c24
+	discordColorRecovered = 0x41bf53
+)
+
+// discordField is a field of an embed.
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+// discordEmbed is an embed of a message.
+type discordEmbed struct {
+	Title       string          `json:"title"`
+	Description string          `json:"description,omitempty"`
+	Color       int             `json:"color"`
+	Fields      []*discordField `json:"fields,omitempty"`
+	Timestamp   string          `json:"timestamp,omitempty"`
+}
+
+// discordMessage is a message posted to a webhook, and the event it notifies,
+// if any.
+type discordMessage struct {
+	Username string          `json:"username"`
+	Embeds   []*discordEmbed `json:"embeds"`
+
+	event *spyEvent
+}
+
+// discordNotifier posts messages to a Discord webhook.
+type discordNotifier struct {
+	url    string
+	client *http.Client
+	queue  chan *discordMessage
+}
+
+// spyDiscord is the package-level Discord notifier, nil if not configured.
+var spyDiscord *discordNotifier
+
+// newDiscordNotifier creates a discordNotifier for the webhook URL.
+func newDiscordNotifier(webhookURL string) (*discordNotifier, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Discord webhook URL")
+	}
+	return &discordNotifier{
+		url:    webhookURL,
+		client: newHTTPClient(),
+		queue:  make(chan *discordMessage, discordQueueSize),
+	}, nil
+}
+
+// Notify queues a message for the watched address event.  It does not
+// block.
+func (d *discordNotifier) Notify(e *spyEvent) error {
+	if d == nil {
+		return nil
+	}
+	amount := fmt.Sprintf("%.6f DCR", e.Amount)
+	if e.Fiat != 0 && spyExchangeRate != nil {
+		amount += fmt.Sprintf(" (%.2f %s)", e.Fiat,
+			strings.ToUpper(spyExchangeRate.currency))
+	}
+	embed := &discordEmbed{
+		Title:       "Received " + amount,
+		Description: spyNotifyTemplates.render(notifyChannelDiscord, e),
+		Color:       discordColorMempool,
+		Fields: []*discordField{
+			{"Amount", amount, true},
+			{"Address", discordLink("`"+e.Address+"`",
+				spyExplorer.address(e.Address)), false},
+			{"Transaction", discordLink(fmt.Sprintf("`%s:%d`", e.TxID, e.Vout),
+				spyExplorer.tx(e.TxID)), false},
+		},
+		Timestamp: time.Unix(e.Time, 0).UTC().Format(time.RFC3339),
+	}
+	if e.Action == eventActionMined {
+		embed.Color = discordColorMined
+		embed.Fields = append(embed.Fields, &discordField{"Block height",
+			strconv.FormatInt(e.Height, 10), true})
+	} else {
+		embed.Fields = append(embed.Fields, &discordField{"Block height",
+			fmt.Sprintf("mempool (best block %d)", e.Height), true})
+	}
+	d.enqueue(embed, e)
+	return nil
+}
+
+// tracksDelivery implements deliveryNotifier.
+func (d *discordNotifier) tracksDelivery() {}
+
+// discordLink returns the text as a markdown link to the URL, or the text if
+// the URL is empty.
+func discordLink(text, url string) string {
+	if url == "" {
+		return text
+	}
+	return "[" + text + "](" + url + ")"
+}
+
+// notifyAlert queues a message for an alert with the title and color.  It
+// does not block.
+func (d *discordNotifier) notifyAlert(title, msg string, color int) {
+	if d == nil {
+		return
+	}
+	d.enqueue(&discordEmbed{
+		Title:       title,
+		Description: msg,
+		Color:       color,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}, nil)
+}
+
+// enqueue queues a message with the embed of the event, if any, or drops it
+// if the queue is full.
+func (d *discordNotifier) enqueue(embed *discordEmbed, e *spyEvent) {
+	msg := &discordMessage{
+		Username: "dcrspy",
+		Embeds:   []*discordEmbed{embed},
+		event:    e,
+	}
+	select {
+	case d.queue <- msg:
+	default:
+		log.Warnf("Discord queue full. Dropping %q.", embed.Title)
+		e.delivered()
+	}
+}
+
+// run posts queued messages until quit is closed.  It should be run as a
+// goroutine.
+func (d *discordNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case msg := <-d.queue:
+			retryAfter, err := d.send(msg)
+			if retryAfter > 0 {
+				// Rate limited.  Wait and retry once.
+				select {
+				case <-time.After(retryAfter):
+					_, err = d.send(msg)
+				case <-quit:
+					log.Debugf("Quitting Discord notifier.")
+					return
+				}
+			}
+			if err != nil {
+				log.Warnf("Failed to send Discord message: %v",
+					reportError(errKindNotifier, "discord", err))
+			}
+			msg.event.delivered()
+		case <-quit:
+			log.Debugf("Quitting Discord notifier.")
+			return
+		}
+	}
+}
+
+// send posts the message to the webhook.  If the webhook is rate limited, the
+// wait before retrying is returned, up to discordMaxRetryAfter, with the
+// error.
+func (d *discordNotifier) send(msg *discordMessage) (time.Duration, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := d.client.Post(d.url, "application/json",
+		bytes.NewReader(payload))
+	if err != nil {
+		// Omit the URL, which includes the webhook token.
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		err = fmt.Errorf("status %s", resp.Status)
+		secs, perr := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64)
+		if perr != nil || secs <= 0 {
+			secs = 1
+		}
+		retryAfter := time.Duration(secs * float64(time.Second))
+		if retryAfter > discordMaxRetryAfter {
+			return 0, err
+		}
+		return retryAfter, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("status %s", resp.Status)
+	}
+	return 0, nil
+}
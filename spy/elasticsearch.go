@@ -0,0 +1,339 @@
+// elasticsearch.go implements the Elasticsearch saver, which indexes a summary
+// of each block, and the operator's watched address transactions, so that
+// months of monitoring data may be searched and visualized in Kibana.  Block
+// summaries are indexed in PREFIX-blocks-YYYY.MM and transactions in
+// PREFIX-events-YYYY.MM, by the month of the block or event time, each with an
+// @timestamp field for Kibana's time filter.
+//
+// Documents are sent with the bulk API in batches, every esFlushInterval or
+// once esBatchSize are pending.  A block summary's ID is its height and
+// network, so that a block indexed again, e.g. after a reorganization,
+// replaces the previous one, and a transaction's ID is its event sequence
+// number, so that a batch sent again is not indexed twice.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// esFlushInterval is the longest time a document waits to be sent.
+	esFlushInterval = 10 * time.Second
+	// esBatchSize is the number of pending documents that are sent without
+	// waiting for esFlushInterval.
+	esBatchSize = 100
+	// esMaxPending is the number of documents kept while Elasticsearch is
+	// unavailable, beyond which the oldest are dropped.
+	esMaxPending = 10000
+)
+
+// esDocument is a document to index.
+type esDocument struct {
+	index string
+	id    string
+	body  []byte
+}
+
+// esBlockSummary is the indexed summary of a block.
+type esBlockSummary struct {
+	Timestamp     string   `json:"@timestamp"`
+	Network       string   `json:"network"`
+	Height        uint32   `json:"height"`
+	Hash          string   `json:"hash"`
+	Size          uint32   `json:"size"`
+	Difficulty    float64  `json:"difficulty"`
+	Voters        uint16   `json:"voters"`
+	FreshStake    uint8    `json:"freshstake"`
+	Revocations   uint8    `json:"revocations"`
+	PoolSize      uint32   `json:"poolsize"`
+	PoolValue     float64  `json:"poolvalue,omitempty"`
+	TicketPrice   float64  `json:"ticketprice"`
+	NextPrice     float64  `json:"nextticketprice"`
+	EstimatePrice float64  `json:"estimatedticketprice"`
+	FeeMean       float64  `json:"ticketfeemean"`
+	FeeMedian     float64  `json:"ticketfeemedian"`
+	FeeMax        float64  `json:"ticketfeemax"`
+	CoinSupply    *float64 `json:"coinsupply,omitempty"`
+}
+
+// esIndexer sends documents to Elasticsearch.
+type esIndexer struct {
+	bulkURL string
+	user    string
+	pass    string
+	apiKey  string
+	prefix  string
+	client  *http.Client
+
+	mtx     sync.Mutex
+	pending []*esDocument
+	// full signals that esBatchSize documents are pending.
+	full chan struct{}
+}
+
+// spyElasticsearch is the package-level Elasticsearch indexer, nil if
+// disabled.
+var spyElasticsearch *esIndexer
+
+// newESIndexer creates an esIndexer of the Elasticsearch cluster at baseURL,
+// authenticated with user and pass, or apiKey, if not empty, and indexing in
+// the indices with the prefix.
+func newESIndexer(baseURL, user, pass, apiKey,
+	prefix string) (*esIndexer, error) {
+	if !strings.HasPrefix(baseURL, "http://") &&
+		!strings.HasPrefix(baseURL, "https://") {
+		return nil, fmt.Errorf("invalid esurl %q: the scheme must be http "+
+			"or https", baseURL)
+	}
+	if apiKey != "" && user != "" {
+		return nil, fmt.Errorf("esapikey and esuser are exclusive")
+	}
+	// Index names must be lowercase, without these characters.
+	if prefix == "" || prefix != strings.ToLower(prefix) ||
+		strings.ContainsAny(prefix, ` "*\<|,>/?#:`) ||
+		strings.HasPrefix(prefix, "_") || strings.HasPrefix(prefix, "-") {
+		return nil, fmt.Errorf("invalid esindexprefix %q", prefix)
+	}
+	return &esIndexer{
+		bulkURL: strings.TrimSuffix(baseURL, "/") + "/_bulk",
+		user:    user,
+		pass:    pass,
+		apiKey:  apiKey,
+		prefix:  prefix,
+		client:  newHTTPClient(),
+		full:    make(chan struct{}, 1),
+	}, nil
+}
+
+// index returns the name of the monthly index of the kind (blocks or events)
+// for the Unix time t.
+func (es *esIndexer) index(kind string, t int64) string {
+	return es.prefix + "-" + kind + "-" + time.Unix(t, 0).UTC().Format("2006.01")
+}
+
+// add queues the document of v.  It does not block.
+func (es *esIndexer) add(index, id string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	es.mtx.Lock()
+	es.pending = append(es.pending, &esDocument{index, id, body})
+	if n := len(es.pending); n > esMaxPending {
+		log.Warnf("Dropping %d documents not yet sent to Elasticsearch.",
+			n-esMaxPending)
+		es.pending = es.pending[n-esMaxPending:]
+	}
+	full := len(es.pending) >= esBatchSize
+	es.mtx.Unlock()
+	if full {
+		select {
+		case es.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// indexEvent queues the operator's watched address event.  Other events are
+// ignored.
+func (es *esIndexer) indexEvent(e *spyEvent) {
+	if es == nil || e.Type != eventTypeWatchedAddr ||
+		e.Tenant != operatorOwner {
+		return
+	}
+	// An event is numbered when recorded in the journal, otherwise
+	// Elasticsearch assigns the ID.
+	var id string
+	if e.Seq != 0 {
+		id = strconv.FormatUint(e.Seq, 10)
+	}
+	doc := struct {
+		Timestamp string `json:"@timestamp"`
+		Network   string `json:"network"`
+		*spyEvent
+	}{time.Unix(e.Time, 0).UTC().Format(time.RFC3339), activeNet.Name, e}
+	if err := es.add(es.index("events", e.Time), id, doc); err != nil {
+		log.Errorf("Failed to encode event %d for Elasticsearch: %v", e.Seq,
+			err)
+	}
+}
+
+// run sends the pending documents every esFlushInterval, when esBatchSize are
+// pending, and when quit is closed.  It should be run as a goroutine.
+func (es *esIndexer) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(esFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-es.full:
+		case <-quit:
+			es.flush()
+			log.Debugf("Quitting Elasticsearch indexer.")
+			return
+		}
+		es.flush()
+	}
+}
+
+// flush sends the pending documents with the bulk API, keeping those that
+// could not be indexed for a temporary reason for the next attempt.
+func (es *esIndexer) flush() {
+	es.mtx.Lock()
+	docs := es.pending
+	es.pending = nil
+	es.mtx.Unlock()
+	if len(docs) == 0 {
+		return
+	}
+
+	retry, err := es.bulk(docs)
+	if err != nil {
+		log.Errorf("Unable to index %d documents in Elasticsearch: %v",
+			len(docs), reportError(errKindSaver, "elasticsearch", err))
+	} else {
+		log.Debugf("Indexed %d documents in Elasticsearch.",
+			len(docs)-len(retry))
+	}
+	if len(retry) == 0 {
+		return
+	}
+	es.mtx.Lock()
+	es.pending = append(retry, es.pending...)
+	if n := len(es.pending); n > esMaxPending {
+		es.pending = es.pending[n-esMaxPending:]
+	}
+	es.mtx.Unlock()
+}
+
+// esBulkResponse is the part of a bulk API response used by the indexer.
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk indexes the documents, returning those to send again: all of them if
+// the request failed, or those rejected for a temporary reason (e.g. 429 Too
+// Many Requests).  Documents rejected otherwise (e.g. a mapping conflict) are
+// dropped.
+func (es *esIndexer) bulk(docs []*esDocument) ([]*esDocument, error) {
+	var body bytes.Buffer
+	for _, d := range docs {
+		action := map[string]map[string]string{"index": {"_index": d.index}}
+		if d.id != "" {
+			action["index"]["_id"] = d.id
+		}
+		a, _ := json.Marshal(action)
+		body.Write(a)
+		body.WriteByte('\n')
+		body.Write(d.body)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", es.bulkURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case es.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+es.apiKey)
+	case es.user != "":
+		req.SetBasicAuth(es.user, es.pass)
+	}
+	resp, err := es.client.Do(req)
+	if err != nil {
+		return docs, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return docs, fmt.Errorf("status %s: %s", resp.Status,
+			bytes.TrimSpace(msg))
+	}
+
+	var res esBulkResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("invalid bulk response: %v", err)
+	}
+	if !res.Errors {
+		return nil, nil
+	}
+	var retry []*esDocument
+	var dropped int
+	var firstErr json.RawMessage
+	for i, item := range res.Items {
+		if i >= len(docs) {
+			break
+		}
+		for _, r := range item {
+			switch {
+			case r.Status >= 200 && r.Status <= 299:
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				retry = append(retry, docs[i])
+			default:
+				dropped++
+				if firstErr == nil {
+					firstErr = r.Error
+				}
+			}
+		}
+	}
+	if dropped > 0 {
+		log.Errorf("Elasticsearch rejected %d documents, e.g.: %s", dropped,
+			firstErr)
+	}
+	return retry, nil
+}
+
+// BlockDataToElasticsearch implements BlockDataSaver interface for indexing
+// block summaries in Elasticsearch
+type BlockDataToElasticsearch struct {
+	es *esIndexer
+}
+
+// Store queues the summary of the blockData
+func (s *BlockDataToElasticsearch) Store(data *blockData) error {
+	h := &data.header
+	summary := &esBlockSummary{
+		Timestamp:     time.Unix(h.Time, 0).UTC().Format(time.RFC3339),
+		Network:       activeNet.Name,
+		Height:        h.Height,
+		Hash:          h.Hash,
+		Size:          h.Size,
+		Difficulty:    h.Difficulty,
+		Voters:        h.Voters,
+		FreshStake:    h.FreshStake,
+		Revocations:   h.Revocations,
+		PoolSize:      h.PoolSize,
+		PoolValue:     data.poolinfo.PoolValue,
+		TicketPrice:   data.currentstakediff.CurrentStakeDifficulty,
+		NextPrice:     data.currentstakediff.NextStakeDifficulty,
+		EstimatePrice: data.eststakediff.Expected,
+		FeeMean:       data.feeinfo.Mean,
+		FeeMedian:     data.feeinfo.Median,
+		FeeMax:        data.feeinfo.Max,
+	}
+	if data.coinsupply >= 0 {
+		supply := data.coinsupply
+		summary.CoinSupply = &supply
+	}
+	id := activeNet.Name + "-" + strconv.FormatUint(uint64(h.Height), 10)
+	return s.es.add(s.es.index("blocks", h.Time), id, summary)
+}
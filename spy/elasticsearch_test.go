@@ -0,0 +1,239 @@
+package spy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewESIndexer(t *testing.T) {
+	tests := []struct {
+		baseURL, user, apiKey, prefix string
+		// wantBulkURL is empty if the configuration is invalid.
+		wantBulkURL string
+	}{
+		{"http://127.0.0.1:9200", "", "", "dcrspy",
+			"http://127.0.0.1:9200/_bulk"},
+		{"https://es.example.com/", "elastic", "", "dcrspy-mainnet",
+			"https://es.example.com/_bulk"},
+		{"https://es.example.com/cluster", "", "a2V5", "dcr_spy",
+			"https://es.example.com/cluster/_bulk"},
+		{"es.example.com:9200", "", "", "dcrspy", ""},
+		{"https://es.example.com", "elastic", "a2V5", "dcrspy", ""},
+		{"https://es.example.com", "", "", "", ""},
+		{"https://es.example.com", "", "", "DcrSpy", ""},
+		{"https://es.example.com", "", "", "dcr spy", ""},
+		{"https://es.example.com", "", "", "dcrspy*", ""},
+		{"https://es.example.com", "", "", "dcr/spy", ""},
+		{"https://es.example.com", "", "", "dcr:spy", ""},
+		{"https://es.example.com", "", "", "_dcrspy", ""},
+		{"https://es.example.com", "", "", "-dcrspy", ""},
+	}
+	for _, tt := range tests {
+		es, err := newESIndexer(tt.baseURL, tt.user, "pass", tt.apiKey,
+			tt.prefix)
+		if tt.wantBulkURL == "" {
+			if err == nil {
+				t.Errorf("newESIndexer(%q, user %q, API key %q, prefix %q) "+
+					"succeeded, want an error", tt.baseURL, tt.user,
+					tt.apiKey, tt.prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newESIndexer(%q, prefix %q): %v", tt.baseURL, tt.prefix,
+				err)
+			continue
+		}
+		if es.bulkURL != tt.wantBulkURL {
+			t.Errorf("newESIndexer(%q) posts to %s, want %s", tt.baseURL,
+				es.bulkURL, tt.wantBulkURL)
+		}
+	}
+}
+
+func TestESIndex(t *testing.T) {
+	es := &esIndexer{prefix: "dcrspy"}
+	tests := []struct {
+		kind string
+		t    int64
+		want string
+	}{
+		{"blocks", 1454954400, "dcrspy-blocks-2016.02"},
+		{"events", 1454954400, "dcrspy-events-2016.02"},
+		// The month is UTC.
+		{"blocks", 1483228799, "dcrspy-blocks-2016.12"},
+		{"blocks", 1483228800, "dcrspy-blocks-2017.01"},
+	}
+	for _, tt := range tests {
+		if got := es.index(tt.kind, tt.t); got != tt.want {
+			t.Errorf("index(%q, %d) = %q, want %q", tt.kind, tt.t, got,
+				tt.want)
+		}
+	}
+}
+
+func TestESBulk(t *testing.T) {
+	docs := []*esDocument{
+		{"dcrspy-blocks-2017.01", "mainnet-120000", []byte(`{"height":120000}`)},
+		{"dcrspy-events-2017.01", "42", []byte(`{"seq":42}`)},
+		{"dcrspy-events-2017.01", "", []byte(`{"seq":0}`)},
+	}
+	wantBody := `{"index":{"_id":"mainnet-120000","_index":"dcrspy-blocks-` +
+		`2017.01"}}` + "\n" + `{"height":120000}` + "\n" +
+		`{"index":{"_id":"42","_index":"dcrspy-events-2017.01"}}` + "\n" +
+		`{"seq":42}` + "\n" +
+		`{"index":{"_index":"dcrspy-events-2017.01"}}` + "\n" +
+		`{"seq":0}` + "\n"
+
+	tests := []struct {
+		name     string
+		apiKey   string
+		user     string
+		status   int
+		response string
+		// wantRetry are the indexes in docs of the documents to send again.
+		wantRetry []int
+		wantErr   bool
+	}{
+		{"indexed", "", "", http.StatusOK,
+			`{"took":3,"errors":false,"items":[]}`, nil, false},
+		{"rejected", "a2V5", "", http.StatusOK, `{"errors":true,"items":[` +
+			`{"index":{"status":201}},` +
+			`{"index":{"status":429,"error":{"type":"es_rejected_execution"}}},` +
+			`{"index":{"status":400,"error":{"type":"mapper_parsing"}}}]}`,
+			[]int{1}, false},
+		{"unavailable shards", "", "elastic", http.StatusOK,
+			`{"errors":true,"items":[{"index":{"status":503}},` +
+				`{"index":{"status":200}},{"index":{"status":500}}]}`,
+			[]int{0, 2}, false},
+		{"more items than documents", "", "", http.StatusOK,
+			`{"errors":true,"items":[{"index":{"status":200}},` +
+				`{"index":{"status":200}},{"index":{"status":200}},` +
+				`{"index":{"status":503}}]}`, nil, false},
+		{"unauthorized", "", "elastic", http.StatusUnauthorized,
+			`{"error":"missing authentication"}`, []int{0, 1, 2}, true},
+		{"overloaded", "", "", http.StatusServiceUnavailable, "",
+			[]int{0, 1, 2}, true},
+		{"invalid response", "", "", http.StatusOK, `<html>`, nil, true},
+	}
+
+	// The server's request and response, guarded by mtx
+	var mtx sync.Mutex
+	var gotBody, gotAuth, gotType string
+	var status int
+	var response string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mtx.Lock()
+		defer mtx.Unlock()
+		gotBody, gotAuth = string(b), r.Header.Get("Authorization")
+		gotType = r.Header.Get("Content-Type")
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer ts.Close()
+
+	for _, tt := range tests {
+		es, err := newESIndexer(ts.URL, tt.user, "changeme", tt.apiKey,
+			"dcrspy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtx.Lock()
+		status, response = tt.status, tt.response
+		mtx.Unlock()
+		retry, err := es.bulk(docs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err,
+				tt.wantErr)
+		}
+		if len(retry) != len(tt.wantRetry) {
+			t.Errorf("%s: got %d documents to retry, want %d", tt.name,
+				len(retry), len(tt.wantRetry))
+		} else {
+			for i, d := range retry {
+				if d != docs[tt.wantRetry[i]] {
+					t.Errorf("%s: retrying %s, want %s", tt.name, d.body,
+						docs[tt.wantRetry[i]].body)
+				}
+			}
+		}
+
+		mtx.Lock()
+		gotBody, gotAuth, gotType := gotBody, gotAuth, gotType
+		mtx.Unlock()
+		if gotBody != wantBody {
+			t.Errorf("%s: posted\n%s\nwant\n%s", tt.name, gotBody, wantBody)
+		}
+		if gotType != "application/x-ndjson" {
+			t.Errorf("%s: posted Content-Type %q", tt.name, gotType)
+		}
+		var wantAuth string
+		switch {
+		case tt.apiKey != "":
+			wantAuth = "ApiKey " + tt.apiKey
+		case tt.user != "":
+			// elastic:changeme
+			wantAuth = "Basic ZWxhc3RpYzpjaGFuZ2VtZQ=="
+		}
+		if gotAuth != wantAuth {
+			t.Errorf("%s: got Authorization %q, want %q", tt.name, gotAuth,
+				wantAuth)
+		}
+	}
+}
+
+func TestESFlush(t *testing.T) {
+	// The first document is rejected for a temporary reason, and kept for
+	// the next flush, before the documents added meanwhile.
+	var mtx sync.Mutex
+	var posted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mtx.Lock()
+		defer mtx.Unlock()
+		posted = append(posted, string(b))
+		if len(posted) == 1 {
+			w.Write([]byte(`{"errors":true,"items":[{"index":{"status":429}},` +
+				`{"index":{"status":201}}]}`))
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer ts.Close()
+
+	es, err := newESIndexer(ts.URL, "", "", "", "dcrspy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if err = es.add("dcrspy-events-2017.01", id, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	es.flush()
+	if len(es.pending) != 1 || es.pending[0].id != "1" {
+		t.Fatalf("got %d pending documents after a partial failure, want "+
+			"document 1", len(es.pending))
+	}
+	es.add("dcrspy-events-2017.01", "3", "3")
+	es.flush()
+	es.flush()
+	if len(es.pending) != 0 {
+		t.Errorf("got %d pending documents after indexing", len(es.pending))
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(posted) != 2 || !strings.Contains(posted[1], `"_id":"1"`) ||
+		strings.Index(posted[1], `"_id":"1"`) >
+			strings.Index(posted[1], `"_id":"3"`) {
+		t.Errorf("posted %q, want documents 1 and 3 in the second request",
+			posted)
+	}
+}
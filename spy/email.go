@@ -0,0 +1,487 @@
+package spy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTP connection security modes
+const (
+	// smtpTLSAuto upgrades the connection with STARTTLS if the server offers
+	// it.
+	smtpTLSAuto = "auto"
+	// smtpTLSStartTLS requires the server to offer STARTTLS.
+	smtpTLSStartTLS = "starttls"
+	// smtpTLSImplicit connects with TLS, e.g. to port 465.
+	smtpTLSImplicit = "tls"
+	// smtpTLSNone never uses TLS, e.g. for a local relay.
+	smtpTLSNone = "none"
+)
+
+// SMTP authentication mechanisms
+const (
+	smtpAuthPlain   = "plain"
+	smtpAuthLogin   = "login"
+	smtpAuthCRAMMD5 = "cram-md5"
+	smtpAuthNone    = "none"
+)
+
+// EmailConfig contains the email server address and credentials
+type EmailConfig struct {
+	// emailAddrs are the recipients, and routes the recipients of the
+	// notifications of watched addresses with their own.
+	emailAddrs                     []string
+	routes                         map[string][]string
+	smtpUser, smtpPass, smtpServer string
+	smtpPort                       int
+	// smtpTLS is the connection security mode, and smtpAuth the
+	// authentication mechanism.
+	smtpTLS, smtpAuth string
+}
+
+// EmailMsgChan is used with EmailQueue to automatically batch events in to
+// single emails.
+var EmailMsgChan chan *spyEvent
+
+func init() {
+	EmailMsgChan = make(chan *spyEvent, 200)
+}
+
+// spyEmailDropped counts the notifications dropped because EmailMsgChan was
+// full, e.g. while the SMTP server is slow or unreachable.
+var spyEmailDropped = spyMetrics.newCounter(
+	"dcrspy_email_notifications_dropped_total",
+	"Email notifications dropped because the email queue was full.")
+
+// emailNotifier is the Notifier of email, queueing the notifications for
+// EmailQueue.  It notifies the operator, and tenants with an email address.
+type emailNotifier struct{}
+
+// tracksDelivery implements deliveryNotifier.  sendEmailEvents reports the
+// delivery of the events.
+func (emailNotifier) tracksDelivery() {}
+
+// Notify queues the notification of the event on EmailMsgChan.  It does not
+// block: if the queue is full, the notification is dropped and counted.
+func (emailNotifier) Notify(e *spyEvent) error {
+	select {
+	case EmailMsgChan <- e:
+		return nil
+	default:
+		spyEmailDropped.inc()
+		return fmt.Errorf("email queue full")
+	}
+}
+
+// notifiesTenant returns true if the tenant has an email address.
+func (emailNotifier) notifiesTenant(t *tenant) bool {
+	return t.EmailAddr != ""
+}
+
+// auth returns the smtp.Auth of the configured mechanism, or nil for none.
+func (ecfg *EmailConfig) auth() smtp.Auth {
+	switch ecfg.smtpAuth {
+	case smtpAuthNone:
+		return nil
+	case smtpAuthLogin:
+		return &loginAuth{ecfg.smtpUser, ecfg.smtpPass, ecfg.smtpServer}
+	case smtpAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(ecfg.smtpUser, ecfg.smtpPass)
+	default:
+		return smtp.PlainAuth("", ecfg.smtpUser, ecfg.smtpPass,
+			ecfg.smtpServer)
+	}
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which some servers
+// offer instead of PLAIN.  Like smtp.PlainAuth, it only sends the credentials
+// over TLS or to localhost.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" &&
+		a.host != "::1" {
+		return "", nil, fmt.Errorf("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, fmt.Errorf("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+// dial connects to the SMTP server, with TLS or STARTTLS as configured.
+func (ecfg *EmailConfig) dial() (*smtp.Client, error) {
+	// The SMTP server address includes the port
+	addr := net.JoinHostPort(ecfg.smtpServer, strconv.Itoa(ecfg.smtpPort))
+	tlsConfig := &tls.Config{ServerName: ecfg.smtpServer}
+	dialer := &net.Dialer{Timeout: spySMTPTimeout}
+
+	var conn net.Conn
+	var err error
+	if ecfg.smtpTLS == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The deadline bounds the whole session, so that a server that stops
+	// responding does not hang the send.
+	conn.SetDeadline(time.Now().Add(spySMTPTimeout))
+	c, err := smtp.NewClient(conn, ecfg.smtpServer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	switch ecfg.smtpTLS {
+	case smtpTLSAuto, smtpTLSStartTLS, "":
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			err = c.StartTLS(tlsConfig)
+		} else if ecfg.smtpTLS == smtpTLSStartTLS {
+			err = fmt.Errorf("server does not offer STARTTLS")
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// SendEmailWatchRecv Sends an email using the input emailConfig and message
+// string.
+func SendEmailWatchRecv(message, subject string, ecfg *EmailConfig) error {
+	return sendEmail(subject, message, "", ecfg)
+}
+
+// sendEmail sends an email with the text, and also the HTML as an alternative
+// if it is not empty.
+func sendEmail(subject, text, html string, ecfg *EmailConfig) error {
+	// Check for nil pointer emailConfig
+	if ecfg == nil {
+		return fmt.Errorf("emailConfig must not be a nil pointer")
+	}
+
+	if len(ecfg.emailAddrs) == 0 {
+		return fmt.Errorf("no email recipients")
+	}
+
+	// The sender is the SMTP user, or the first recipient without
+	// authentication.
+	from := ecfg.smtpUser
+	if from == "" {
+		from = ecfg.emailAddrs[0]
+	}
+
+	// Make a header using a map for clarity
+	header := make(map[string]string)
+	header["From"] = from
+	header["To"] = strings.Join(ecfg.emailAddrs, ", ")
+	header["Subject"] = mime.QEncoding.Encode("utf-8", subject)
+	header["MIME-Version"] = "1.0"
+
+	var body bytes.Buffer
+	if html == "" {
+		header["Content-Type"] = `text/plain; charset="utf-8"`
+		header["Content-Transfer-Encoding"] = "quoted-printable"
+		if err := writeQuotedPrintable(&body, text); err != nil {
+			return err
+		}
+	} else {
+		mw := multipart.NewWriter(&body)
+		header["Content-Type"] = "multipart/alternative; boundary=" +
+			mw.Boundary()
+		parts := []struct{ contentType, content string }{
+			{`text/plain; charset="utf-8"`, text},
+			{`text/html; charset="utf-8"`, html},
+		}
+		for _, p := range parts {
+			w, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {p.contentType},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			if err != nil {
+				return err
+			}
+			if err = writeQuotedPrintable(w, p.content); err != nil {
+				return err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+	}
+
+	// Build the full message with the header + body
+	var msg bytes.Buffer
+	for k, v := range header {
+		fmt.Fprintf(&msg, "%s: %s\r\n", k, v)
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+
+	// Send email
+	if err := ecfg.send(from, ecfg.emailAddrs, msg.Bytes()); err != nil {
+		return fmt.Errorf("Failed to send email: %v",
+			reportError(errKindNotifier, "email", err))
+	}
+
+	return nil
+}
+
+// writeQuotedPrintable writes the text to w, quoted-printable encoded.
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, text); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// send sends the message from the sender to the recipients, like
+// smtp.SendMail, with the configured connection security and authentication.
+func (ecfg *EmailConfig) send(from string, to []string, msg []byte) error {
+	c, err := ecfg.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if a := ecfg.auth(); a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("server does not support authentication")
+		}
+		if err = c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// sendEmailWatchRecv sends the message, and is run by the notification pool.
+// An email that fails to send is queued for retry.
+func sendEmailWatchRecv(message, subject string, ecfg *EmailConfig) {
+	err := SendEmailWatchRecv(message, subject, ecfg)
+	if err != nil {
+		if len(ecfg.emailAddrs) == 0 || !spyRetryQueue.enqueueEmail(subject,
+			message, "", ecfg.emailAddrs, err) {
+			log.Warn(err)
+		}
+		return
+	}
+	log.Debugf("Sent email to %v", strings.Join(ecfg.emailAddrs, ", "))
+}
+
+// recipients returns the recipients of the notification of the event: the
+// tenant's email address for a tenant's event, or else the route of the
+// watched address, if any, or else emailAddrs.
+func (ecfg *EmailConfig) recipients(e *spyEvent) []string {
+	if e.Tenant != operatorOwner {
+		if t := spyTenants.lookup(e.Tenant); t != nil && t.EmailAddr != "" {
+			return []string{t.EmailAddr}
+		}
+		return nil
+	}
+	if to, ok := ecfg.routes[e.Address]; ok {
+		return to
+	}
+	return ecfg.emailAddrs
+}
+
+// sendEmailEvents sends emails of the watched address events, rendered with
+// spyEmailTemplates, one to each set of recipients of the events (a tenant, a
+// route or emailaddr).  An email that fails to send is queued for retry.
+// It is run by the notification pool for EmailQueue.
+func sendEmailEvents(events []*spyEvent, ecfg *EmailConfig) {
+	defer func() {
+		for _, e := range events {
+			e.delivered()
+		}
+	}()
+
+	// The events of each set of recipients, in order of the first event.
+	var keys []string
+	byRecipients := make(map[string][]*spyEvent)
+	recipients := make(map[string][]string)
+	for _, e := range events {
+		to := ecfg.recipients(e)
+		if len(to) == 0 {
+			// Only routed addresses are emailed without emailaddr.
+			continue
+		}
+		key := strings.Join(to, ",")
+		if _, ok := byRecipients[key]; !ok {
+			keys = append(keys, key)
+			recipients[key] = to
+		}
+		byRecipients[key] = append(byRecipients[key], e)
+	}
+
+	for _, key := range keys {
+		conf := *ecfg
+		conf.emailAddrs = recipients[key]
+		subject, text, html := spyEmailTemplates.render(byRecipients[key])
+		if err := sendEmail(subject, text, html, &conf); err != nil {
+			if !spyRetryQueue.enqueueEmail(subject, text, html,
+				conf.emailAddrs, err) {
+				log.Warn(err)
+			}
+			continue
+		}
+		log.Debugf("Sent email of %d event(s) to %v", len(byRecipients[key]),
+			key)
+	}
+}
+
+// emailDigestBlock is the emaildigest value of a digest after each block.
+const emailDigestBlock = "block"
+
+// emailBlockChan signals EmailQueue that the notifications of the block at the
+// height are queued, for the digest after each block.
+var emailBlockChan = make(chan int64, 16)
+
+// emailBlockNotified signals EmailQueue that the notifications of the block
+// are queued.  It does not block.
+func emailBlockNotified(height int64) {
+	select {
+	case emailBlockChan <- height:
+	default:
+	}
+}
+
+// EmailQueue batches events into single emails, using a progressively shorter
+// delay before sending an email as the number of queued events increases.  In
+// digest mode, the events are instead sent every digest interval, if it is not
+// zero, or after the notifications of each block if perBlock is true.  Events
+// are received on the package-level channel EmailMsgChan, and the queued ones
+// are sent when quitting.  EmailQueue should be run as a goroutine.
+func EmailQueue(emailConf *EmailConfig, digest time.Duration, perBlock bool,
+	wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	var events []*spyEvent
+	lastMsgTime := time.Now()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	timeToWait := func(numMessages int) time.Duration {
+		if numMessages == 0 || digest > 0 || perBlock {
+			return math.MaxInt64
+		}
+		return 10 * time.Second / time.Duration(numMessages)
+	}
+
+	var digestTicker <-chan time.Time
+	if digest > 0 {
+		t := time.NewTicker(digest)
+		defer t.Stop()
+		digestTicker = t.C
+	}
+	var blocks <-chan int64
+	if perBlock {
+		blocks = emailBlockChan
+	}
+
+	flush := func() {
+		if len(events) > 0 {
+			batch := events
+			if !spyNotifyPool.submit(notifyChannelEmail, func() {
+				sendEmailEvents(batch, emailConf)
+			}) {
+				for _, e := range batch {
+					e.delivered()
+				}
+			}
+			events = nil
+		}
+	}
+
+	for {
+		//watchquit:
+		select {
+		case <-quit:
+			if len(events) > 0 {
+				sendEmailEvents(events, emailConf)
+			}
+			log.Debugf("Quitting emailQueue.")
+			return
+		case e, ok := <-EmailMsgChan:
+			if !ok {
+				log.Info("emailQueue channel closed")
+				return
+			}
+			events = append(events, e)
+			lastMsgTime = time.Now()
+		case <-ticker.C:
+			if time.Since(lastMsgTime) > timeToWait(len(events)) {
+				flush()
+			}
+		case <-digestTicker:
+			flush()
+		case height := <-blocks:
+			// The block's events were queued before the signal.
+		drain:
+			for {
+				select {
+				case e := <-EmailMsgChan:
+					events = append(events, e)
+				default:
+					break drain
+				}
+			}
+			if len(events) > 0 {
+				log.Debugf("Sending email digest of %d event(s) at block %d.",
+					len(events), height)
+			}
+			flush()
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// emailtemplates.go renders the emails of watched address notifications.  The
+// subject is rendered from emailsubj, a text/template, and the body has a text
+// part, with each event rendered by the email template of notifytemplates, and
+// an HTML part rendered with html/template from email.html in the
+// notifytemplates directory, or the built-in template.  A batch of events is
+// sent in one email.
+//
+// The subject and HTML templates are executed with {{.Events}}, the events
+// with the fields of the notification templates (including {{.Label}} and the
+// explorer links, e.g. {{.TxURL}}), {{.Count}}, the number of events,
+// {{.Total}}, the sum of their amounts, and {{.Currency}}, the fiat currency.
+// In the HTML template, {{qr .Address}} is the QR code of an address's
+// decred: URI, as a table, which email clients show unlike images.
+
+package spy
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// emailHTMLTemplateFile is the name of the HTML template in the notifytemplates
+// directory.
+const emailHTMLTemplateFile = "email.html"
+
+// emailTextIntro begins the text part of notification emails.
+const emailTextIntro = "Watched addresses were observed in the following " +
+	"transactions:\n\n"
+
+// builtinEmailHTMLTemplate is the built-in template of the HTML part.
+const builtinEmailHTMLTemplate = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+<p>Watched addresses were observed in the following transactions:</p>
+<table cellpadding="6" style="border-collapse: collapse">
+<tr style="text-align: left"><th>Address</th><th>Amount</th><th>Status</th><th>Transaction</th></tr>
+{{range .Events}}<tr style="border-top: 1px solid #ddd">
+<td>{{with .Label}}<b>{{.}}</b><br>{{end}}{{if .AddrURL}}<a href="{{.AddrURL}}"><code>{{.Address}}</code></a>{{else}}<code>{{.Address}}</code>{{end}}<br>{{qr .Address}}</td>
+<td>{{printf "%.6f" .Amount}} DCR{{with .Fiat}}<br>{{printf "%.2f" .}} {{$.Currency}}{{end}}</td>
+<td>{{if eq .Action "mined"}}{{if .FollowUp}}Confirmed{{else}}Mined{{end}} in block {{if .BlockURL}}<a href="{{.BlockURL}}">{{.Height}}</a>{{else}}{{.Height}}{{end}}{{else}}In mempool{{end}}</td>
+<td>{{if .TxURL}}<a href="{{.TxURL}}">{{.TxID}}</a>{{else}}<code>{{.TxID}}</code>{{end}}:{{.Vout}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>`
+
+// emailHTMLFuncs are the functions of the HTML template.
+var emailHTMLFuncs = htmltemplate.FuncMap{
+	"qr": emailQRCode,
+}
+
+// emailTemplateData is the data with which the subject and HTML templates are
+// executed.
+type emailTemplateData struct {
+	Events   []*notifyTemplateData
+	Count    int
+	Total    float64
+	Currency string
+}
+
+// emailTemplates are the templates of notification emails.
+type emailTemplates struct {
+	subject *template.Template
+	html    *htmltemplate.Template
+}
+
+// builtinEmailTemplates are the default subject and the built-in HTML
+// template.
+var builtinEmailTemplates = &emailTemplates{
+	subject: template.Must(template.New("subject").Parse(defaultEmailSubject)),
+	html: htmltemplate.Must(htmltemplate.New(emailHTMLTemplateFile).Funcs(
+		emailHTMLFuncs).Parse(builtinEmailHTMLTemplate)),
+}
+
+// spyEmailTemplates are the package-level email templates.
+var spyEmailTemplates = builtinEmailTemplates
+
+// newEmailTemplates parses the subject template, and reads the HTML template
+// from the notifytemplates directory, dir, if it has one.
+func newEmailTemplates(subject, dir string) (*emailTemplates, error) {
+	t := &emailTemplates{html: builtinEmailTemplates.html}
+	var err error
+	t.subject, err = template.New("subject").Parse(subject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email subject: %v", err)
+	}
+	if dir == "" {
+		return t, nil
+	}
+	text, err := ioutil.ReadFile(filepath.Join(dir, emailHTMLTemplateFile))
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.html, err = htmltemplate.New(emailHTMLTemplateFile).Funcs(
+		emailHTMLFuncs).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// render returns the subject, text and HTML of the email of the events.  If
+// the subject or HTML template fails, the default subject or no HTML part is
+// used.
+func (t *emailTemplates) render(events []*spyEvent) (subject, text,
+	html string) {
+	data := &emailTemplateData{Count: len(events)}
+	texts := make([]string, 0, len(events))
+	for _, e := range events {
+		d := newNotifyTemplateData(e)
+		data.Events = append(data.Events, d)
+		data.Total += e.Amount
+		data.Currency = d.Currency
+		texts = append(texts, spyNotifyTemplates.render(notifyChannelEmail, e))
+	}
+	text = emailTextIntro + strings.Join(texts, "\n\n")
+
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		log.Warnf("Failed to render email subject: %v", err)
+		buf.Reset()
+		buf.WriteString(defaultEmailSubject)
+	}
+	// Headers are one line.
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := t.html.Execute(&buf, data); err != nil {
+		log.Warnf("Failed to render HTML email: %v", err)
+		return subject, text, ""
+	}
+	return subject, text, buf.String()
+}
@@ -0,0 +1,280 @@
+// errcodes.go classifies the errors of the collectors, savers and notifiers by
+// code (e.g. wallet_locked, rpc_unreachable or db_constraint), so that
+// automation can tell the cause of a failure without parsing log messages.
+// reportError classifies an error and records it: the returned spyError is
+// logged with its code, the errors are counted by kind, source and code by the
+// dcrspy_errors_total metric, and the last error of each source is listed in
+// the errors of GET /status.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrjson"
+	"github.com/decred/dcrrpcclient"
+	"github.com/go-sql-driver/mysql"
+)
+
+// errorCode is the code of a class of errors.
+type errorCode string
+
+// Error codes
+const (
+	errCodeRPCUnreachable     errorCode = "rpc_unreachable"
+	errCodeRPCTimeout         errorCode = "rpc_timeout"
+	errCodeRPCRejected        errorCode = "rpc_rejected"
+	errCodeNodeSyncing        errorCode = "node_syncing"
+	errCodeWalletLocked       errorCode = "wallet_locked"
+	errCodeWalletSyncing      errorCode = "wallet_syncing"
+	errCodeWalletDisconnected errorCode = "wallet_disconnected"
+	errCodeDBUnreachable      errorCode = "db_unreachable"
+	errCodeDBConstraint       errorCode = "db_constraint"
+	errCodeDBRejected         errorCode = "db_rejected"
+	errCodeNotifyUnreachable  errorCode = "notify_unreachable"
+	errCodeNotifyTimeout      errorCode = "notify_timeout"
+	errCodeNotifyRejected     errorCode = "notify_rejected"
+	errCodeIO                 errorCode = "io"
+	errCodeEncoding           errorCode = "encoding"
+	errCodeUnknown            errorCode = "unknown"
+)
+
+// Kinds of error sources
+const (
+	errKindCollector = "collector"
+	errKindSaver     = "saver"
+	errKindNotifier  = "notifier"
+)
+
+// spyError is a classified error of a source (e.g. mysql or email) of a kind.
+type spyError struct {
+	Code   errorCode
+	Kind   string
+	Source string
+	Err    error
+}
+
+// Error returns the message of the error, with its code.
+func (e *spyError) Error() string {
+	return fmt.Sprintf("%v [%s]", e.Err, e.Code)
+}
+
+// classifyError returns the code of the error of a source of the kind.
+func classifyError(kind string, err error) errorCode {
+	switch e := err.(type) {
+	case *spyError:
+		return e.Code
+	case *timeoutError:
+		if kind == errKindNotifier {
+			return errCodeNotifyTimeout
+		}
+		return errCodeRPCTimeout
+	case *dcrjson.RPCError:
+		switch {
+		case e.Code == dcrjson.ErrRPCWalletUnlockNeeded ||
+			e.Code == dcrjson.ErrRPCWalletPassphraseIncorrect:
+			return errCodeWalletLocked
+		case e.Code == dcrjson.ErrRPCClientInInitialDownload:
+			return errCodeNodeSyncing
+		case e.Code == dcrjson.ErrRPCClientNotConnected:
+			return errCodeWalletDisconnected
+		case strings.Contains(e.Message, "try again later"):
+			return errCodeWalletSyncing
+		}
+		return errCodeRPCRejected
+	case *mysql.MySQLError:
+		switch e.Number {
+		// ER_DUP_ENTRY, ER_BAD_NULL_ERROR, ER_ROW_IS_REFERENCED(_2) and
+		// ER_NO_REFERENCED_ROW(_2)
+		case 1062, 1048, 1216, 1217, 1451, 1452:
+			return errCodeDBConstraint
+		}
+		return errCodeDBRejected
+	case *textproto.Error:
+		// An SMTP reply
+		return errCodeNotifyRejected
+	case *os.PathError, *os.LinkError, *os.SyscallError:
+		return errCodeIO
+	case *json.MarshalerError, *json.UnsupportedTypeError,
+		*json.UnsupportedValueError, *json.SyntaxError,
+		*json.UnmarshalTypeError:
+		return errCodeEncoding
+	}
+
+	switch err {
+	case dcrrpcclient.ErrClientShutdown, dcrrpcclient.ErrClientDisconnect,
+		dcrrpcclient.ErrClientNotConnected:
+		return errCodeRPCUnreachable
+	case io.EOF, io.ErrUnexpectedEOF:
+		return unreachableCode(kind)
+	}
+	if ne, ok := err.(net.Error); ok {
+		if ne.Timeout() {
+			switch kind {
+			case errKindNotifier:
+				return errCodeNotifyTimeout
+			case errKindSaver:
+				return errCodeDBUnreachable
+			}
+			return errCodeRPCTimeout
+		}
+		return unreachableCode(kind)
+	}
+	// The SQLite driver's errors are only distinguished by their message.
+	if kind == errKindSaver && strings.Contains(err.Error(), "constraint") {
+		return errCodeDBConstraint
+	}
+	if kind == errKindNotifier {
+		// The endpoint responded, but not with success.
+		return errCodeNotifyRejected
+	}
+	return errCodeUnknown
+}
+
+// unreachableCode returns the code of a connection failure of a source of
+// the kind.
+func unreachableCode(kind string) errorCode {
+	switch kind {
+	case errKindSaver:
+		return errCodeDBUnreachable
+	case errKindNotifier:
+		return errCodeNotifyUnreachable
+	}
+	return errCodeRPCUnreachable
+}
+
+// errorStatus is the last error of a source, listed by GET /status.
+type errorStatus struct {
+	Kind    string    `json:"kind"`
+	Source  string    `json:"source"`
+	Code    errorCode `json:"code"`
+	Message string    `json:"message"`
+	Time    int64     `json:"time"`
+	Count   uint64    `json:"count"`
+}
+
+// errorKey identifies the count of errors with a code of a source.
+type errorKey struct {
+	kind, source string
+	code         errorCode
+}
+
+// errorRegistry records the reported errors.
+type errorRegistry struct {
+	mtx    sync.Mutex
+	counts map[errorKey]uint64
+	last   map[string]*errorStatus
+}
+
+// spyErrors is the package-level error registry.
+var spyErrors = newErrorRegistry()
+
+func newErrorRegistry() *errorRegistry {
+	r := &errorRegistry{
+		counts: make(map[errorKey]uint64),
+		last:   make(map[string]*errorStatus),
+	}
+	spyMetrics.register("dcrspy_errors_total", r)
+	return r
+}
+
+// reportError classifies the error of the source of the kind, records it, and
+// returns it as a *spyError to be logged or returned.  A nil error is not
+// reported, and nil is returned.
+func reportError(kind, source string, err error) error {
+	if err == nil {
+		return nil
+	}
+	se, ok := err.(*spyError)
+	if !ok {
+		se = &spyError{
+			Code:   classifyError(kind, err),
+			Kind:   kind,
+			Source: source,
+			Err:    err,
+		}
+	}
+	spyErrors.record(se)
+	return se
+}
+
+// record counts the error, and makes it the last error of its source.
+func (r *errorRegistry) record(e *spyError) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.counts[errorKey{e.Kind, e.Source, e.Code}]++
+	st, ok := r.last[e.Source]
+	if !ok {
+		st = &errorStatus{Kind: e.Kind, Source: e.Source}
+		r.last[e.Source] = st
+	}
+	st.Code = e.Code
+	st.Message = e.Err.Error()
+	st.Time = time.Now().Unix()
+	st.Count++
+}
+
+// lastErrors returns the last error of each source, sorted by source.
+func (r *errorRegistry) lastErrors() []*errorStatus {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	errs := make([]*errorStatus, 0, len(r.last))
+	for _, st := range r.last {
+		c := *st
+		errs = append(errs, &c)
+	}
+	sort.Sort(errorStatusesBySource(errs))
+	return errs
+}
+
+type errorStatusesBySource []*errorStatus
+
+func (s errorStatusesBySource) Len() int      { return len(s) }
+func (s errorStatusesBySource) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s errorStatusesBySource) Less(i, j int) bool {
+	return s[i].Source < s[j].Source
+}
+
+func (r *errorRegistry) writeMetrics(w io.Writer) {
+	const name = "dcrspy_errors_total"
+	fmt.Fprintf(w, "# HELP %s Errors of collectors, savers and notifiers, "+
+		"by kind, source and code.\n# TYPE %s counter\n", name, name)
+	r.mtx.Lock()
+	keys := make([]errorKey, 0, len(r.counts))
+	for k := range r.counts {
+		keys = append(keys, k)
+	}
+	counts := make(map[errorKey]uint64, len(r.counts))
+	for k, n := range r.counts {
+		counts[k] = n
+	}
+	r.mtx.Unlock()
+	sort.Sort(errorKeys(keys))
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{kind=%q,source=%q,code=%q} %d\n", name, k.kind,
+			k.source, string(k.code), counts[k])
+	}
+}
+
+type errorKeys []errorKey
+
+func (s errorKeys) Len() int      { return len(s) }
+func (s errorKeys) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s errorKeys) Less(i, j int) bool {
+	if s[i].kind != s[j].kind {
+		return s[i].kind < s[j].kind
+	}
+	if s[i].source != s[j].source {
+		return s[i].source < s[j].source
+	}
+	return s[i].code < s[j].code
+}
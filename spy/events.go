@@ -0,0 +1,335 @@
+// events.go defines spyEvent, the record of something noteworthy observed by
+// dcrspy (e.g. a transaction involving a watched address), and the event
+// journal where events are recorded.
+
+package spy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	eventTypeWatchedAddr = "watchedaddr"
+	eventTypeSpy         = "spy"
+)
+
+// Actions for eventTypeSpy events
+const (
+	eventActionStarted = "started"
+)
+
+// Actions for eventTypeWatchedAddr events
+const (
+	eventActionMined   = "mined"
+	eventActionMempool = "mempool"
+)
+
+// spyEvent describes an event.  Seq is assigned when the event is recorded in
+// the journal, and increases monotonically, and is 0 if it is not recorded.  Fiat is the value of Amount in
+// fiatcurrency at the rate when the event was published, if known.  Actor is
+// who made the request of an audit event.  Tenant is the tenant to which the
+// event is routed, or empty for the operator.
+type spyEvent struct {
+	Seq         uint64  `json:"seq"`
+	Time        int64   `json:"time"`
+	Type        string  `json:"type"`
+	Action      string  `json:"action,omitempty"`
+	Height      int64   `json:"height,omitempty"`
+	Address     string  `json:"address,omitempty"`
+	Amount      float64 `json:"amount,omitempty"`
+	Fiat        float64 `json:"fiat,omitempty"`
+	TxID        string  `json:"txid,omitempty"`
+	Vout        int     `json:"vout"`
+	ScriptClass string  `json:"scriptclass,omitempty"`
+	Message     string  `json:"message,omitempty"`
+	Actor       string  `json:"actor,omitempty"`
+	Tenant      string  `json:"tenant,omitempty"`
+	// followUp is true for the compact notification of a mined transaction
+	// that was notified in mempool.  It is not recorded.
+	followUp bool
+	// deliveries counts the deliveries of the notifications of the block
+	// whose transaction the event is, if any.  It is not recorded.
+	deliveries *blockDeliveries
+}
+
+// delivered is called by a deliveryNotifier once the notification of the event
+// has been sent, or has failed or been dropped.
+func (e *spyEvent) delivered() {
+	if e != nil && e.deliveries != nil {
+		e.deliveries.done()
+	}
+}
+
+// vars returns the event's fields as variables for filter expressions.
+func (e *spyEvent) vars() exprVars {
+	return func(name string) (interface{}, bool) {
+		switch name {
+		case "seq":
+			return float64(e.Seq), true
+		case "time":
+			return float64(e.Time), true
+		case "type":
+			return e.Type, true
+		case "action":
+			return e.Action, true
+		case "height":
+			return float64(e.Height), true
+		case "address":
+			return e.Address, true
+		case "amount":
+			return e.Amount, true
+		case "fiat":
+			return e.Fiat, true
+		case "txid":
+			return e.TxID, true
+		case "vout":
+			return float64(e.Vout), true
+		case "scriptclass":
+			return e.ScriptClass, true
+		case "message":
+			return e.Message, true
+		case "actor":
+			return e.Actor, true
+		}
+		return nil, false
+	}
+}
+
+// matchesFilter returns true if the filter expression is true for the event,
+// or if filter is nil.  A filter that cannot be evaluated does not match.
+func (e *spyEvent) matchesFilter(filter *expression) bool {
+	if filter == nil {
+		return true
+	}
+	match, err := filter.evalBool(e.vars())
+	return err == nil && match
+}
+
+// journalIndexInterval is the number of events between entries of the
+// journal's index.
+const journalIndexInterval = 256
+
+// journalIndexEntry is the byte offset in the journal file of the event with
+// sequence number seq.
+type journalIndexEntry struct {
+	seq    uint64
+	offset int64
+}
+
+// eventJournal appends events to a file, one JSON object per line.  A sparse
+// index of the offsets of the events, by sequence number, lets readers of the
+// recent events start near them instead of at the start of the file.
+type eventJournal struct {
+	mtx     sync.Mutex
+	path    string
+	file    *os.File
+	lastSeq uint64
+	size    int64
+	index   []journalIndexEntry
+}
+
+// spyJournal is the package-level event journal.  Events are not recorded if
+// it is nil.
+var spyJournal *eventJournal
+
+// openEventJournal opens the journal file at path for appending, creating it
+// if necessary.  The existing events are scanned to continue the sequence.
+func openEventJournal(path string) (*eventJournal, error) {
+	j := &eventJournal{path: path}
+	err := j.scanFrom(0, func(e *spyEvent, offset int64) bool {
+		j.lastSeq = e.Seq
+		j.indexEvent(e.Seq, offset)
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	j.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := j.file.Stat()
+	if err != nil {
+		j.file.Close()
+		return nil, err
+	}
+	j.size = fi.Size()
+	return j, nil
+}
+
+// indexEvent adds the offset of the event to the index if it is at least
+// journalIndexInterval events after the last indexed event.  The mutex must
+// be held, except while opening the journal.
+func (j *eventJournal) indexEvent(seq uint64, offset int64) {
+	n := len(j.index)
+	if n == 0 || seq >= j.index[n-1].seq+journalIndexInterval {
+		j.index = append(j.index, journalIndexEntry{seq, offset})
+	}
+}
+
+// lastSequence returns the sequence number of the last recorded event.
+func (j *eventJournal) lastSequence() uint64 {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.lastSeq
+}
+
+// close closes the journal file.
+func (j *eventJournal) close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.file.Close()
+}
+
+// append writes the event to the journal with the next sequence number, which
+// is assigned to the event only if it is written.
+func (j *eventJournal) append(e *spyEvent) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	recorded := *e
+	recorded.Seq = j.lastSeq + 1
+	b, err := json.Marshal(&recorded)
+	if err != nil {
+		return err
+	}
+	n, err := j.file.Write(append(b, '\n'))
+	if err != nil {
+		// Resynchronize the offset with the file after a partial write.
+		if fi, errStat := j.file.Stat(); errStat == nil {
+			j.size = fi.Size()
+		}
+		return err
+	}
+	e.Seq = recorded.Seq
+	j.indexEvent(e.Seq, j.size)
+	j.size += int64(n)
+	j.lastSeq = e.Seq
+	return nil
+}
+
+// scan calls f for each event in the journal, in order, until f returns
+// false.
+func (j *eventJournal) scan(f func(e *spyEvent) bool) error {
+	return j.scanFrom(0, func(e *spyEvent, _ int64) bool {
+		return f(e)
+	})
+}
+
+// scanAfter calls f for each event with a sequence number greater than seq, in
+// order, until f returns false.  Reading starts at the last indexed event at
+// or before seq+1, rather than at the start of the journal.
+func (j *eventJournal) scanAfter(seq uint64, f func(e *spyEvent) bool) error {
+	j.mtx.Lock()
+	if seq >= j.lastSeq {
+		j.mtx.Unlock()
+		return nil
+	}
+	i := sort.Search(len(j.index), func(i int) bool {
+		return j.index[i].seq > seq+1
+	})
+	var offset int64
+	if i > 0 {
+		offset = j.index[i-1].offset
+	}
+	j.mtx.Unlock()
+
+	return j.scanFrom(offset, func(e *spyEvent, _ int64) bool {
+		if e.Seq <= seq {
+			return true
+		}
+		return f(e)
+	})
+}
+
+// scanFrom calls f for each event in the journal from the byte offset, in
+// order, with the event's offset, until f returns false.
+func (j *eventJournal) scanFrom(offset int64, f func(e *spyEvent, offset int64) bool) error {
+	fp, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if offset > 0 {
+		if _, err = fp.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		lineOffset := offset
+		offset += int64(len(line)) + 1
+		e := new(spyEvent)
+		if err = json.Unmarshal(line, e); err != nil {
+			log.Warnf("Skipping invalid event journal entry: %v", err)
+			continue
+		}
+		if !f(e, lineOffset) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// query returns the most recent events (up to limit) for which match returns
+// true, oldest first.  A nil match function matches all events.
+func (j *eventJournal) query(match func(e *spyEvent) bool, limit int) ([]*spyEvent, error) {
+	var events []*spyEvent
+	err := j.scan(func(e *spyEvent) bool {
+		if match == nil || match(e) {
+			events = append(events, e)
+			if limit > 0 && len(events) > 2*limit {
+				events = events[len(events)-limit:]
+			}
+		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, nil
+}
+
+// publishEvent records the event in the journal and delivers it to the
+// matching webhook subscriptions and the open event streams.  An event that
+// could not be recorded is delivered without a sequence number, except to the
+// subscriptions in ack mode, which only deliver recorded events.
+func publishEvent(e *spyEvent) {
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	if e.Amount != 0 && e.Fiat == 0 {
+		e.Fiat = spyExchangeRate.toFiat(e.Amount)
+	}
+	if spyJournal != nil {
+		if err := spyJournal.append(e); err != nil {
+			log.Errorf("Failed to record event in journal: %v", err)
+		}
+	}
+	appendEventCSV(e)
+	spySQLite.event(e)
+	spyPostgres.event(e)
+	spyAddrStats.event(e)
+	if spyWebhooks != nil {
+		spyWebhooks.dispatch(e)
+	}
+	spyMQTT.publishEvent(e)
+	spyNATS.publishEvent(e)
+	spyAMQP.publishEvent(e)
+	spyElasticsearch.indexEvent(e)
+	spyEventHub.broadcast(e)
+}
@@ -0,0 +1,103 @@
+package spy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEventJournalScanAfter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	j, err := openEventJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 3*journalIndexInterval + 17
+	for i := 0; i < n; i++ {
+		if err = j.append(&spyEvent{Type: eventTypeSpy, Height: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(j *eventJournal) {
+		for _, after := range []uint64{0, 1, journalIndexInterval - 1,
+			journalIndexInterval, journalIndexInterval + 1, 2*journalIndexInterval + 5,
+			n - 1, n, n + 10} {
+			var seqs []uint64
+			err := j.scanAfter(after, func(e *spyEvent) bool {
+				seqs = append(seqs, e.Seq)
+				return len(seqs) < 10
+			})
+			if err != nil {
+				t.Fatalf("scanAfter(%d): %v", after, err)
+			}
+			want := 10
+			if after >= n {
+				want = 0
+			} else if n-after < 10 {
+				want = int(n - after)
+			}
+			if len(seqs) != want {
+				t.Fatalf("scanAfter(%d): got %d events, want %d", after,
+					len(seqs), want)
+			}
+			for i, seq := range seqs {
+				if seq != after+uint64(i)+1 {
+					t.Fatalf("scanAfter(%d): event %d has seq %d", after, i, seq)
+				}
+			}
+		}
+	}
+	check(j)
+	if len(j.index) != 4 {
+		t.Errorf("got %d index entries, want 4", len(j.index))
+	}
+	if err = j.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index is rebuilt when the journal is reopened, and the sequence
+	// continues.
+	j, err = openEventJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	check(j)
+	e := &spyEvent{Type: eventTypeSpy}
+	if err = j.append(e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Seq != n+1 {
+		t.Errorf("got seq %d after reopening, want %d", e.Seq, n+1)
+	}
+	var last uint64
+	j.scanAfter(n, func(e *spyEvent) bool {
+		last = e.Seq
+		return true
+	})
+	if last != n+1 {
+		t.Errorf("got last seq %d, want %d", last, n+1)
+	}
+}
+
+func TestEventJournalAppendFailure(t *testing.T) {
+	j, err := openEventJournal(filepath.Join(t.TempDir(), "events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.append(&spyEvent{Type: eventTypeSpy}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An event that is not written keeps no sequence number, and the next
+	// event gets the one it would have had.
+	j.file.Close()
+	e := &spyEvent{Type: eventTypeSpy}
+	if err = j.append(e); err == nil {
+		t.Fatal("appended to a closed journal")
+	}
+	if e.Seq != 0 || j.lastSequence() != 1 {
+		t.Errorf("got seq %d and last seq %d after a failed write, want 0 "+
+			"and 1", e.Seq, j.lastSequence())
+	}
+}
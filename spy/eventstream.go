@@ -0,0 +1,272 @@
+// eventstream.go serves the events recorded in the journal to API clients,
+// either by polling (GET /events) or as a stream over a WebSocket
+// (/events/ws).  A stream first replays the journal after the requested
+// sequence number, then sends events as they are published, so a client that
+// reconnects with the last sequence number it received does not miss events.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/websocket"
+)
+
+const (
+	// defaultEventsLimit and maxEventsLimit are the default and maximum
+	// number of events returned by GET /events.
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+	// eventStreamBuffer is the number of published events buffered for a
+	// stream.  A stream that falls further behind is closed.
+	eventStreamBuffer = 256
+	// eventStreamPingInterval is the interval between pings on an idle
+	// stream.
+	eventStreamPingInterval = 30 * time.Second
+	// eventStreamWriteTimeout is the time allowed to write a message.
+	eventStreamWriteTimeout = 10 * time.Second
+)
+
+// eventHub fans out published events to the open streams.
+type eventHub struct {
+	mtx  sync.Mutex
+	subs map[chan *spyEvent]struct{}
+}
+
+// spyEventHub is the package-level event hub.
+var spyEventHub = &eventHub{
+	subs: make(map[chan *spyEvent]struct{}),
+}
+
+// subscribe returns a channel receiving each published event.  The channel is
+// closed if the subscriber falls behind.
+func (h *eventHub) subscribe() chan *spyEvent {
+	c := make(chan *spyEvent, eventStreamBuffer)
+	h.mtx.Lock()
+	h.subs[c] = struct{}{}
+	h.mtx.Unlock()
+	return c
+}
+
+// unsubscribe removes the subscription, closing its channel.
+func (h *eventHub) unsubscribe(c chan *spyEvent) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if _, ok := h.subs[c]; ok {
+		delete(h.subs, c)
+		close(c)
+	}
+}
+
+// broadcast sends the event to all subscribers without blocking.
+func (h *eventHub) broadcast(e *spyEvent) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for c := range h.subs {
+		select {
+		case c <- e:
+		default:
+			log.Warnf("Event stream fell behind; closing it.")
+			delete(h.subs, c)
+			close(c)
+		}
+	}
+}
+
+// eventsSinceArg parses the since query parameter, the sequence number after
+// which events are requested.
+func eventsSinceArg(r *http.Request) (uint64, error) {
+	s := r.URL.Query().Get("since")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// eventsFilterArg parses the filter query parameter, an expression (see
+// expr.go) the events must match.  The filter is nil if there is none.
+func eventsFilterArg(r *http.Request) (*expression, error) {
+	s := r.URL.Query().Get("filter")
+	if s == "" {
+		return nil, nil
+	}
+	return parseExpression(s)
+}
+
+// eventsAPI documents eventsHandler.
+var eventsAPI = []apiOperation{{
+	method:  "GET",
+	summary: "Get the events after a sequence number, oldest first",
+	params: []apiParam{
+		{name: "since", in: "query", typ: "integer"},
+		{name: "filter", in: "query", typ: "string",
+			description: "A filter expression the events must match"},
+		{name: "limit", in: "query", typ: "integer",
+			description: fmt.Sprintf("Default %d, at most %d",
+				defaultEventsLimit, maxEventsLimit)},
+	},
+	response: []*spyEvent{},
+}}
+
+// eventsHandler serves GET /events?since=N&filter=F&limit=M, returning the
+// owner's events with sequence numbers greater than since and matching the
+// filter, oldest first.
+func eventsHandler(w http.ResponseWriter, r *http.Request, t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	since, err := eventsSinceArg(r)
+	if err != nil {
+		http.Error(w, "invalid since", http.StatusBadRequest)
+		return
+	}
+	filter, err := eventsFilterArg(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid filter: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+	limit := defaultEventsLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxEventsLimit {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	owner := t.owner()
+	events := make([]*spyEvent, 0)
+	err = spyJournal.scanAfter(since, func(e *spyEvent) bool {
+		if e.Tenant == owner && e.matchesFilter(filter) {
+			events = append(events, e)
+		}
+		return len(events) < limit
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to read event journal: %v", err)
+		http.Error(w, "failed to read events", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+var eventStreamUpgrader = websocket.Upgrader{
+	HandshakeTimeout: 10 * time.Second,
+	ReadBufferSize:   1024,
+	WriteBufferSize:  4096,
+}
+
+// eventStreamAPI documents eventStreamHandler.
+var eventStreamAPI = []apiOperation{{
+	method:  "GET",
+	summary: "Stream the events after a sequence number over a WebSocket",
+	description: "Each event is sent as a JSON text message, as returned " +
+		"by /events.",
+	params: []apiParam{
+		{name: "since", in: "query", typ: "integer"},
+		{name: "filter", in: "query", typ: "string",
+			description: "A filter expression the events must match"},
+	},
+	status: http.StatusSwitchingProtocols,
+}}
+
+// eventStreamHandler serves /events/ws?since=N&filter=F, a WebSocket on which
+// each of the owner's events after since and matching the filter is sent as a
+// JSON text message.
+func eventStreamHandler(w http.ResponseWriter, r *http.Request, t *tenant) {
+	since, err := eventsSinceArg(r)
+	if err != nil {
+		http.Error(w, "invalid since", http.StatusBadRequest)
+		return
+	}
+	filter, err := eventsFilterArg(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid filter: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+	conn, err := eventStreamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has replied with an error.
+		log.Debugf("Event stream upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Subscribe before replaying, so that no event is missed in between.
+	live := spyEventHub.subscribe()
+	defer spyEventHub.unsubscribe(live)
+
+	// The client is not expected to send anything, but reading is required
+	// to process control messages and detect a closed connection.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	owner := t.owner()
+	last := since
+	send := func(e *spyEvent) error {
+		if e.Seq <= last || e.Tenant != owner || !e.matchesFilter(filter) {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(eventStreamWriteTimeout))
+		if err := conn.WriteJSON(e); err != nil {
+			return err
+		}
+		last = e.Seq
+		spyUsage.notification(owner)
+		return nil
+	}
+
+	// Replay from the journal.
+	var sendErr error
+	err = spyJournal.scanAfter(since, func(e *spyEvent) bool {
+		sendErr = send(e)
+		return sendErr == nil
+	})
+	if (err != nil && !os.IsNotExist(err)) || sendErr != nil {
+		log.Debugf("Event stream replay ended: %v %v", err, sendErr)
+		return
+	}
+
+	ticker := time.NewTicker(eventStreamPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-live:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, nil,
+					time.Now().Add(eventStreamWriteTimeout))
+				return
+			}
+			if err = send(e); err != nil {
+				log.Debugf("Event stream write failed: %v", err)
+				return
+			}
+		case <-ticker.C:
+			err = conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(eventStreamWriteTimeout))
+			if err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
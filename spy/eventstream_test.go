@@ -0,0 +1,105 @@
+package spy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventsHandler(t *testing.T) {
+	j, err := openEventJournal(filepath.Join(t.TempDir(), "events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	spyJournal = j
+	defer func() { spyJournal = nil }()
+	for _, e := range []*spyEvent{
+		{Type: eventTypeWatchedAddr, Action: "mined", Address: "Dsa", Amount: 5},
+		{Type: eventTypeWatchedAddr, Action: "mined", Address: "Dsb", Amount: 150},
+		{Type: eventTypeSpy, Action: eventActionStarted},
+		{Type: eventTypeWatchedAddr, Action: "mempool", Address: "Dsa",
+			Amount: 200},
+		{Type: eventTypeWatchedAddr, Action: "mined", Address: "Dsc",
+			Amount: 300, Tenant: "alice"},
+	} {
+		if err = j.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		// wantSeqs are the sequence numbers of the returned events, if the
+		// status is OK.
+		wantStatus int
+		wantSeqs   []uint64
+	}{
+		{"", http.StatusOK, []uint64{1, 2, 3, 4}},
+		{"since=2", http.StatusOK, []uint64{3, 4}},
+		{"limit=2", http.StatusOK, []uint64{1, 2}},
+		{"filter=" + url.QueryEscape("amount >= 100"), http.StatusOK,
+			[]uint64{2, 4}},
+		{"since=2&filter=" + url.QueryEscape(`address == "Dsa"`),
+			http.StatusOK, []uint64{4}},
+		{"filter=" + url.QueryEscape(`type == "spy" || action == "mined"`) +
+			"&limit=2", http.StatusOK, []uint64{1, 2}},
+		// An event for which the filter fails does not match.
+		{"filter=" + url.QueryEscape("amount / 0 > 1"), http.StatusOK,
+			[]uint64{}},
+		{"filter=" + url.QueryEscape("amount >"), http.StatusBadRequest, nil},
+		{"filter=" + url.QueryEscape(strings.Repeat("(", 100)),
+			http.StatusBadRequest, nil},
+		{"since=x", http.StatusBadRequest, nil},
+		{"limit=0", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		eventsHandler(w, httptest.NewRequest("GET", "/events?"+tt.query, nil),
+			nil)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q: got status %d, want %d", tt.query, w.Code,
+				tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var events []*spyEvent
+		if err = json.NewDecoder(w.Body).Decode(&events); err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		seqs := make([]uint64, 0, len(events))
+		for _, e := range events {
+			seqs = append(seqs, e.Seq)
+		}
+		if !reflect.DeepEqual(seqs, tt.wantSeqs) {
+			t.Errorf("%q: got events %v, want %v", tt.query, seqs, tt.wantSeqs)
+		}
+	}
+
+	// A tenant receives only its own events.
+	w := httptest.NewRecorder()
+	eventsHandler(w, httptest.NewRequest("GET", "/events?filter="+
+		url.QueryEscape("amount > 100"), nil), &tenant{Name: "alice"})
+	if body := w.Body.String(); !strings.Contains(body, `"Dsc"`) ||
+		strings.Contains(body, `"Dsb"`) {
+		t.Errorf("got tenant events %s", body)
+	}
+}
+
+func TestEventStreamHandlerFilter(t *testing.T) {
+	// An invalid filter is refused before upgrading the connection.
+	w := httptest.NewRecorder()
+	eventStreamHandler(w, httptest.NewRequest("GET", "/events/ws?filter="+
+		url.QueryEscape("amount >"), nil), nil)
+	if w.Code != http.StatusBadRequest ||
+		!strings.Contains(w.Body.String(), "invalid filter") {
+		t.Errorf("got %d %s for an invalid filter", w.Code, w.Body.String())
+	}
+}
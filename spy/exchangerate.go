@@ -0,0 +1,246 @@
+// exchangerate.go polls the DCR exchange rate in a fiat currency, so that
+// amounts can be valued in fiat when events occur.  Events for amounts carry
+// their fiat value at the current rate, which filter expressions may use
+// (e.g. fiat >= 1000), email notifications of receives may be limited to
+// those worth at least a fiat amount, and price alerts are checked on each
+// update (see pricealerts.go), as are metric alerts using the price variables
+// (see derived.go).
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrrpcclient"
+)
+
+const (
+	// exchangeRateURL is the URL of the exchange rate, with %s for the
+	// currency.  The response is like {"decred":{"usd":12.34}}.
+	exchangeRateURL = "https://api.coingecko.com/api/v3/simple/price?ids=decred&vs_currencies=%s"
+	// exchangeRateInterval is the interval between exchange rate requests.
+	exchangeRateInterval = 5 * time.Minute
+	// exchangeRateMaxAge is the age after which a rate is not used, e.g.
+	// because the requests have failed since.
+	exchangeRateMaxAge = 30 * time.Minute
+	// exchangeRateHistory is the period of the rates kept for the price
+	// change variables.
+	exchangeRateHistory = 7 * 24 * time.Hour
+)
+
+// priceChangeVars are the price change variables of alert conditions, and
+// their periods.
+var priceChangeVars = []struct {
+	name   string
+	period time.Duration
+}{
+	{"price_change_1h", time.Hour},
+	{"price_change_24h", 24 * time.Hour},
+	{"price_change_7d", exchangeRateHistory},
+}
+
+// exchangeRate is the polled exchange rate of DCR in a currency.
+type exchangeRate struct {
+	mtx      sync.RWMutex
+	currency string
+	url      string
+	client   *http.Client
+	rate     float64
+	updated  time.Time
+	// history are the rates within exchangeRateHistory, oldest first.
+	history []priceSample
+	// minNotify is the minimum fiat value of a receive that is notified by
+	// email, or zero for any.
+	minNotify float64
+}
+
+// spyExchangeRate is the package-level exchange rate, nil if no fiat currency
+// is configured.
+var spyExchangeRate *exchangeRate
+
+// newExchangeRate creates an exchangeRate for the currency (e.g. "usd").
+func newExchangeRate(currency string, minNotify float64) *exchangeRate {
+	currency = strings.ToLower(currency)
+	return &exchangeRate{
+		currency:  currency,
+		url:       fmt.Sprintf(exchangeRateURL, currency),
+		client:    newHTTPClient(),
+		minNotify: minNotify,
+	}
+}
+
+// update requests the current exchange rate.
+func (x *exchangeRate) update() error {
+	resp, err := x.client.Get(x.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	var prices map[string]map[string]float64
+	if err = json.NewDecoder(resp.Body).Decode(&prices); err != nil {
+		return err
+	}
+	rate, ok := prices["decred"][x.currency]
+	if !ok || rate <= 0 {
+		return fmt.Errorf("no %s rate in response", x.currency)
+	}
+
+	now := time.Now()
+	x.mtx.Lock()
+	x.rate = rate
+	x.updated = now
+	x.history = append(x.history, priceSample{now, rate})
+	first := 0
+	for now.Sub(x.history[first].time) > exchangeRateHistory {
+		first++
+	}
+	if first > 0 {
+		x.history = append([]priceSample(nil), x.history[first:]...)
+	}
+	x.mtx.Unlock()
+	log.Debugf("DCR exchange rate: %.4f %s", rate, strings.ToUpper(x.currency))
+	spyPriceAlerts.rateUpdated(rate, now)
+	spyDerivedMetrics.priceUpdated()
+	return nil
+}
+
+// run updates the exchange rate every exchangeRateInterval until quit is
+// closed.  It should be run as a goroutine.
+func (x *exchangeRate) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	if err := x.update(); err != nil {
+		log.Warnf("Failed to get the DCR exchange rate: %v", err)
+	}
+	ticker := time.NewTicker(exchangeRateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := x.update(); err != nil {
+				log.Warnf("Failed to get the DCR exchange rate: %v", err)
+			}
+		case <-quit:
+			log.Debugf("Quitting exchange rate updates.")
+			return
+		}
+	}
+}
+
+// current returns the current rate, or false if there is no rate newer than
+// exchangeRateMaxAge.
+func (x *exchangeRate) current() (float64, bool) {
+	if x == nil {
+		return 0, false
+	}
+	x.mtx.RLock()
+	defer x.mtx.RUnlock()
+	if x.rate == 0 || time.Since(x.updated) > exchangeRateMaxAge {
+		return 0, false
+	}
+	return x.rate, true
+}
+
+// vars returns the current rate as the variable price, and its percentage
+// changes from the oldest rates within the periods of priceChangeVars.  There
+// are no variables without a current rate, and no change variable without an
+// earlier rate.
+func (x *exchangeRate) vars() map[string]float64 {
+	v := make(map[string]float64)
+	rate, ok := x.current()
+	if !ok {
+		return v
+	}
+	v["price"] = rate
+
+	x.mtx.RLock()
+	defer x.mtx.RUnlock()
+	now := x.updated
+	for _, pc := range priceChangeVars {
+		for _, s := range x.history {
+			if now.Sub(s.time) > pc.period {
+				continue
+			}
+			if s.time.Before(now) {
+				v[pc.name] = 100 * (rate - s.rate) / s.rate
+			}
+			break
+		}
+	}
+	return v
+}
+
+// toFiat returns the fiat value of the amount in DCR at the current rate, or
+// zero if there is no current rate.
+func (x *exchangeRate) toFiat(amount float64) float64 {
+	rate, ok := x.current()
+	if !ok {
+		return 0
+	}
+	return amount * rate
+}
+
+// notifies returns true if a receive of the amount in DCR is notified by
+// email: if it is worth at least minNotify at the current rate.  Without a
+// current rate, all receives are notified rather than risk missing one.
+func (x *exchangeRate) notifies(amount float64) bool {
+	if x == nil || x.minNotify == 0 {
+		return true
+	}
+	rate, ok := x.current()
+	if !ok {
+		log.Warnf("No current exchange rate. Notifying of a receive of "+
+			"%.6f DCR regardless of its %s value.", amount,
+			strings.ToUpper(x.currency))
+		return true
+	}
+	return amount*rate >= x.minNotify
+}
+
+func init() {
+	registerCollector("exchangerate", func(*dcrrpcclient.Client) Collector {
+		return exchangeRateCollector{}
+	})
+}
+
+// exchangeRateSection is the section of the exchangerate collector.
+type exchangeRateSection struct {
+	Currency string  `json:"currency"`
+	Rate     float64 `json:"rate"`
+	Updated  int64   `json:"updated"`
+}
+
+// exchangeRateCollector collects the last exchange rate polled in the
+// fiatcurrency.
+type exchangeRateCollector struct{}
+
+// Name returns the name of the section.
+func (exchangeRateCollector) Name() string {
+	return "exchangerate"
+}
+
+// Collect returns the current exchange rate.
+func (exchangeRateCollector) Collect(height uint32) (interface{}, error) {
+	x := spyExchangeRate
+	rate, ok := x.current()
+	if !ok {
+		return nil, fmt.Errorf("no current DCR exchange rate " +
+			"(fiatcurrency not set, or requests failing)")
+	}
+	x.mtx.RLock()
+	defer x.mtx.RUnlock()
+	return &exchangeRateSection{
+		Currency: x.currency,
+		Rate:     rate,
+		Updated:  x.updated.Unix(),
+	}, nil
+}
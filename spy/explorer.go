@@ -0,0 +1,135 @@
+// explorer.go links transactions, addresses and blocks to a block explorer in
+// notifications.  By default, the links are to dcrdata, the explorer of the
+// network (none on simnet), at /tx/HASH, /address/ADDRESS and /block/HEIGHT
+// under explorerurl, and each may instead be given as a format with %s, e.g.
+// for another explorer.
+
+package spy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrwallet/netparams"
+)
+
+// Default explorer base URLs
+const (
+	mainnetExplorerURL = "https://dcrdata.decred.org"
+	testnetExplorerURL = "https://testnet.dcrdata.org"
+)
+
+// blockExplorer formats the URLs of a block explorer.
+type blockExplorer struct {
+	// txURL, addrURL and blockURL are the formats of the URLs, with %s for the
+	// transaction hash, address or block height, or empty for no links.
+	txURL    string
+	addrURL  string
+	blockURL string
+}
+
+// spyExplorer is the package-level block explorer, nil if links are disabled.
+var spyExplorer *blockExplorer
+
+// defaultExplorerURL returns the base URL of the active network's explorer, or
+// empty if it has none.
+func defaultExplorerURL() string {
+	switch activeNet {
+	case &netparams.MainNetParams:
+		return mainnetExplorerURL
+	case &netparams.TestNetParams:
+		return testnetExplorerURL
+	}
+	return ""
+}
+
+// newBlockExplorer creates a blockExplorer linking to dcrdata at baseURL,
+// except for the non-empty formats of txURL, addrURL and blockURL.  It
+// returns nil if there are no links.
+func newBlockExplorer(baseURL, txURL, addrURL,
+	blockURL string) (*blockExplorer, error) {
+	if baseURL != "" {
+		u, err := url.Parse(baseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+			return nil, fmt.Errorf("invalid explorerurl %q", baseURL)
+		}
+		baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+	formats := []struct {
+		format *string
+		option string
+		path   string
+		value  string
+	}{
+		{&txURL, "explorertxurl", "/tx/", "transaction hash"},
+		{&addrURL, "exploreraddrurl", "/address/", "address"},
+		{&blockURL, "explorerblockurl", "/block/", "block height"},
+	}
+	for _, f := range formats {
+		if *f.format == "" {
+			if baseURL != "" {
+				*f.format = baseURL + f.path + "%s"
+			}
+			continue
+		}
+		if strings.Count(*f.format, "%s") != 1 {
+			return nil, fmt.Errorf("%s %q must contain %%s once, for the %s",
+				f.option, *f.format, f.value)
+		}
+	}
+	if txURL == "" && addrURL == "" && blockURL == "" {
+		return nil, nil
+	}
+	return &blockExplorer{
+		txURL:    txURL,
+		addrURL:  addrURL,
+		blockURL: blockURL,
+	}, nil
+}
+
+// explorerLink returns the format with its %s replaced by value, or empty if
+// either is.
+func explorerLink(format, value string) string {
+	if format == "" || value == "" {
+		return ""
+	}
+	return strings.Replace(format, "%s", value, 1)
+}
+
+// tx returns the URL of the transaction, or empty if there are no links.
+func (b *blockExplorer) tx(txid string) string {
+	if b == nil {
+		return ""
+	}
+	return explorerLink(b.txURL, txid)
+}
+
+// address returns the URL of the address, or empty if there are no links.
+func (b *blockExplorer) address(addr string) string {
+	if b == nil {
+		return ""
+	}
+	return explorerLink(b.addrURL, addr)
+}
+
+// block returns the URL of the block at the height, or empty if there are no
+// links.
+func (b *blockExplorer) block(height int64) string {
+	if b == nil || height <= 0 {
+		return ""
+	}
+	return explorerLink(b.blockURL, strconv.FormatInt(height, 10))
+}
+
+// eventBlock returns the URL of the event's block: the block of a new block
+// event, or the block in which a watched address transaction was mined.  It is
+// empty for other events, whose height is the best block's.
+func (b *blockExplorer) eventBlock(e *spyEvent) string {
+	if e.Action != eventActionMined && e.Action != eventActionNewBlock {
+		return ""
+	}
+	return b.block(e.Height)
+}
@@ -0,0 +1,661 @@
+// expr.go implements a small expression language used for event filters, e.g.
+//
+//	type == "watchedaddr" && amount > 10 && address in ["Dsabc...", "Dsdef..."]
+//
+// Values are numbers (float64), strings, booleans and lists.  The operators,
+// from lowest to highest precedence, are: || (or), && (and), ! (not), the
+// comparisons == != < <= > >= and in, + -, * /, and unary minus.  Identifiers
+// are variables resolved at evaluation time, or calls of the built-in
+// functions abs, min and max.
+
+package spy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprVars resolves a variable name to its value, returning false if the
+// variable is not defined.
+type exprVars func(name string) (interface{}, bool)
+
+// exprNode is a node of a parsed expression.
+type exprNode interface {
+	eval(vars exprVars) (interface{}, error)
+}
+
+// expression is a parsed expression.
+type expression struct {
+	src  string
+	root exprNode
+}
+
+// String returns the source of the expression.
+func (x *expression) String() string {
+	return x.src
+}
+
+// eval evaluates the expression.
+func (x *expression) eval(vars exprVars) (interface{}, error) {
+	return x.root.eval(vars)
+}
+
+// evalBool evaluates the expression, which must result in a boolean.
+func (x *expression) evalBool(vars exprVars) (bool, error) {
+	v, err := x.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q is not a condition", x.src)
+	}
+	return b, nil
+}
+
+// evalNumber evaluates the expression, which must result in a number.
+func (x *expression) evalNumber(vars exprVars) (float64, error) {
+	v, err := x.root.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("expression %q is not a number", x.src)
+	}
+	return f, nil
+}
+
+// parseExpression parses an expression.
+func parseExpression(src string) (*expression, error) {
+	toks, err := lexExpression(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != exprTokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", p.peek().val, p.peek().pos)
+	}
+	return &expression{src, root}, nil
+}
+
+// LEXER
+
+type exprTokenKind int
+
+const (
+	exprTokEOF exprTokenKind = iota
+	exprTokNumber
+	exprTokString
+	exprTokIdent
+	exprTokOp
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	val  string
+	pos  int
+}
+
+// exprOps are the operator tokens, longest first.
+var exprOps = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!",
+	"+", "-", "*", "/", "(", ")", "[", "]", ","}
+
+func lexExpression(src string) ([]exprToken, error) {
+	var toks []exprToken
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(src) &&
+			unicode.IsDigit(rune(src[i+1]))):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.' ||
+				src[i] == 'e' || src[i] == 'E' ||
+				((src[i] == '-' || src[i] == '+') &&
+					(src[i-1] == 'e' || src[i-1] == 'E'))) {
+				i++
+			}
+			toks = append(toks, exprToken{exprTokNumber, src[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var str []byte
+			for i < len(src) && rune(src[i]) != c {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				str = append(str, src[i])
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			toks = append(toks, exprToken{exprTokString, string(str), start})
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '.' ||
+				unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			toks = append(toks, exprToken{exprTokIdent, src[start:i], start})
+		default:
+			var op string
+			for _, o := range exprOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			toks = append(toks, exprToken{exprTokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, exprToken{kind: exprTokEOF, pos: len(src)}), nil
+}
+
+// PARSER
+
+// maxExprDepth is the maximum nesting of parentheses, lists, calls and unary
+// operators in an expression, so that a hostile filter cannot exhaust the
+// stack.
+const maxExprDepth = 64
+
+type exprParser struct {
+	toks  []exprToken
+	pos   int
+	depth int
+}
+
+// enter increases the nesting depth of the parser, failing if the expression
+// is nested too deeply.  Each successful enter is paired with a leave.
+func (p *exprParser) enter() error {
+	if p.depth >= maxExprDepth {
+		return fmt.Errorf("expression nested too deeply at %d", p.peek().pos)
+	}
+	p.depth++
+	return nil
+}
+
+func (p *exprParser) leave() {
+	p.depth--
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.pos]
+	if t.kind != exprTokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is one of the given operators or
+// keywords, returning the operator.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != exprTokOp && t.kind != exprTokIdent {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.val == op {
+			p.next()
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return fmt.Errorf("expected %q at %d", op, p.peek().pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprLogical{"||", left, right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprLogical{"&&", left, right}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<=", ">=", "<", ">", "in")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	return &exprBinary{op, left, right}, nil
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op, left, right}
+	}
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op, left, right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprBinary{"-", exprLiteral{0.0}, operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case exprTokNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.val, t.pos)
+		}
+		return exprLiteral{f}, nil
+	case exprTokString:
+		return exprLiteral{t.val}, nil
+	case exprTokIdent:
+		switch t.val {
+		case "true":
+			return exprLiteral{true}, nil
+		case "false":
+			return exprLiteral{false}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(t)
+		}
+		return exprVariable(t.val), nil
+	case exprTokOp:
+		switch t.val {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			var list exprList
+			for {
+				if _, ok := p.accept("]"); ok {
+					return list, nil
+				}
+				if len(list) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				n, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, n)
+			}
+		}
+	}
+	if t.kind == exprTokEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.val, t.pos)
+}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	fn, ok := exprFuncs[name.val]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name.val, name.pos)
+	}
+	call := &exprCall{name: name.val, fn: fn}
+	for {
+		if _, ok := p.accept(")"); ok {
+			return call, nil
+		}
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, n)
+	}
+}
+
+// EVALUATION
+
+type exprLiteral struct {
+	val interface{}
+}
+
+func (n exprLiteral) eval(exprVars) (interface{}, error) {
+	return n.val, nil
+}
+
+type exprVariable string
+
+func (n exprVariable) eval(vars exprVars) (interface{}, error) {
+	if vars != nil {
+		if v, ok := vars(string(n)); ok {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("undefined variable %q", string(n))
+}
+
+type exprList []exprNode
+
+func (n exprList) eval(vars exprVars) (interface{}, error) {
+	list := make([]interface{}, 0, len(n))
+	for _, elem := range n {
+		v, err := elem.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+type exprNot struct {
+	operand exprNode
+}
+
+func (n *exprNot) eval(vars exprVars) (interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("operand of ! is not a boolean")
+	}
+	return !b, nil
+}
+
+// exprLogical is && or ||, which short-circuit.
+type exprLogical struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *exprLogical) eval(vars exprVars) (interface{}, error) {
+	evalBool := func(node exprNode) (bool, error) {
+		v, err := node.eval(vars)
+		if err != nil {
+			return false, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("operand of %s is not a boolean", n.op)
+		}
+		return b, nil
+	}
+
+	left, err := evalBool(n.left)
+	if err != nil {
+		return nil, err
+	}
+	if (n.op == "&&" && !left) || (n.op == "||" && left) {
+		return left, nil
+	}
+	return evalBool(n.right)
+}
+
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *exprBinary) eval(vars exprVars) (interface{}, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	case "in":
+		list, ok := right.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("right operand of in is not a list")
+		}
+		for _, elem := range list {
+			if exprEqual(left, elem) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// String comparison and concatenation
+	if ls, ok := left.(string); ok {
+		rs, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("mismatched operands of %s", n.op)
+		}
+		switch n.op {
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		case "+":
+			return ls + rs, nil
+		}
+		return nil, fmt.Errorf("operator %s is not defined for strings", n.op)
+	}
+
+	lf, lok := left.(float64)
+	rf, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("operands of %s are not numbers", n.op)
+	}
+	switch n.op {
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	case ">=":
+		return lf >= rf, nil
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+// exprEqual compares two values, which are unequal if of different types.
+func exprEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		return ok && av == bv
+	case string:
+		bv, ok := b.(string)
+		return ok && av == bv
+	case bool:
+		bv, ok := b.(bool)
+		return ok && av == bv
+	}
+	return false
+}
+
+// exprFunc is a built-in function of numbers.
+type exprFunc func(args []float64) (float64, error)
+
+var exprFuncs = map[string]exprFunc{
+	"abs": func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("abs takes 1 argument")
+		}
+		return math.Abs(args[0]), nil
+	},
+	"min": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("min requires arguments")
+		}
+		m := args[0]
+		for _, a := range args[1:] {
+			m = math.Min(m, a)
+		}
+		return m, nil
+	},
+	"max": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("max requires arguments")
+		}
+		m := args[0]
+		for _, a := range args[1:] {
+			m = math.Max(m, a)
+		}
+		return m, nil
+	},
+}
+
+type exprCall struct {
+	name string
+	fn   exprFunc
+	args []exprNode
+}
+
+func (n *exprCall) eval(vars exprVars) (interface{}, error) {
+	args := make([]float64, 0, len(n.args))
+	for _, a := range n.args {
+		v, err := a.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("arguments of %s must be numbers", n.name)
+		}
+		args = append(args, f)
+	}
+	return n.fn(args)
+}
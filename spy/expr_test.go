@@ -0,0 +1,159 @@
+package spy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testExprVars are the variables of the expressions in the tests.
+func testExprVars(name string) (interface{}, bool) {
+	v, ok := map[string]interface{}{
+		"type":         "watchedaddr",
+		"action":       "received",
+		"address":      "Dsabc",
+		"amount":       12.5,
+		"confirmed":    true,
+		"block.height": 120000.0,
+	}[name]
+	return v, ok
+}
+
+func TestExpression(t *testing.T) {
+	tests := []struct {
+		src string
+		// want is the value, or nil if parsing or evaluating fails with
+		// wantErr.
+		want    interface{}
+		wantErr string
+	}{
+		// Arithmetic
+		{"1 + 2 * 3", 7.0, ""},
+		{"(1 + 2) * 3", 9.0, ""},
+		{"10 - 2 - 3", 5.0, ""},
+		{"8 / 2 / 2", 2.0, ""},
+		{"1-3", -2.0, ""},
+		{"-2 * -3", 6.0, ""},
+		{"--2", 2.0, ""},
+		{"1.5e3 + .5 + 2E-1", 1500.7, ""},
+		{"abs(-3) + min(4, 2, 8) + max(1, amount)", 17.5, ""},
+		{"1 / 0", nil, "division by zero"},
+
+		// Strings
+		{`"dcr" + 'spy'`, "dcrspy", ""},
+		{`"say \"hi\"" + 'it\'s'`, `say "hi"it's`, ""},
+		{`"b" > "a" && "a" <= "a"`, true, ""},
+		{`"a" - "b"`, nil, "operator - is not defined for strings"},
+		{`"a" < 1`, nil, "mismatched operands of <"},
+		{`1 + "a"`, nil, "operands of + are not numbers"},
+
+		// Comparisons and logic
+		{`type == "watchedaddr" && amount > 10`, true, ""},
+		{`type == "watchedaddr" and amount >= 20`, false, ""},
+		{`action != "sent" || amount < 0`, true, ""},
+		{"block.height >= 120000", true, ""},
+		{"true == 1", false, ""},
+		{`1 != "1"`, true, ""},
+		{"!confirmed", false, ""},
+		{"not not confirmed", true, ""},
+		{"!(1 < 2) or 2 > 1 and false", false, ""},
+		{"false && undefined", false, ""},
+		{"true || undefined", true, ""},
+		{"undefined || true", nil, `undefined variable "undefined"`},
+		{"!1", nil, "operand of ! is not a boolean"},
+		{"1 && true", nil, "operand of && is not a boolean"},
+		{"false || 1", nil, "operand of || is not a boolean"},
+
+		// Lists
+		{`address in ["Dsdef", "Dsabc"]`, true, ""},
+		{`address in []`, false, ""},
+		{`1 in [1, "1"]`, true, ""},
+		{`"1" in [1]`, false, ""},
+		{"amount in [10 + 2.5]", true, ""},
+		{`[1, "a", true]`, []interface{}{1.0, "a", true}, ""},
+		{"1 in 1", nil, "right operand of in is not a list"},
+
+		// Functions
+		{"abs(1, 2)", nil, "abs takes 1 argument"},
+		{"min()", nil, "min requires arguments"},
+		{"max(type)", nil, "arguments of max must be numbers"},
+
+		// Syntax errors
+		{"", nil, "unexpected end of expression"},
+		{"1 +", nil, "unexpected end of expression"},
+		{"(1", nil, `expected ")" at 2`},
+		{"[1 2]", nil, `expected "," at 3`},
+		{"1 2", nil, `unexpected "2" at 2`},
+		{"1 < 2 == true", nil, `unexpected "==" at 6`},
+		{"sqrt(4)", nil, `unknown function "sqrt" at 0`},
+		{"1 $ 2", nil, `unexpected character '$' at 2`},
+		{`"dcrspy`, nil, "unterminated string at 0"},
+		{"1.2.3", nil, `invalid number "1.2.3" at 0`},
+		{"* 2", nil, `unexpected "*" at 0`},
+
+		// Nesting
+		{strings.Repeat("(", 60) + "1" + strings.Repeat(")", 60), 1.0, ""},
+		{strings.Repeat("(", 64) + "1" + strings.Repeat(")", 64), nil,
+			"expression nested too deeply at 64"},
+		{strings.Repeat("[", 100000), nil, "expression nested too deeply"},
+		{strings.Repeat("abs(", 100) + "1", nil, "nested too deeply"},
+		{strings.Repeat("!", 100000) + "true", nil, "nested too deeply"},
+		{strings.Repeat("- ", 100000) + "1", nil, "nested too deeply"},
+	}
+	for _, tt := range tests {
+		x, err := parseExpression(tt.src)
+		var got interface{}
+		if err == nil {
+			if x.String() != tt.src {
+				t.Errorf("parsed %q as %q", tt.src, x.String())
+			}
+			got, err = x.eval(testExprVars)
+		}
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q: got %v, error %v, want error %q", tt.src, got,
+					err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExpressionResultType(t *testing.T) {
+	tests := []struct {
+		src              string
+		isBool, isNumber bool
+	}{
+		{"amount > 10", true, false},
+		{"amount * 2", false, true},
+		{"type", false, false},
+	}
+	for _, tt := range tests {
+		x, err := parseExpression(tt.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = x.evalBool(testExprVars); (err == nil) != tt.isBool {
+			t.Errorf("evalBool(%q): got error %v", tt.src, err)
+		}
+		if _, err = x.evalNumber(testExprVars); (err == nil) != tt.isNumber {
+			t.Errorf("evalNumber(%q): got error %v", tt.src, err)
+		}
+	}
+
+	// Variables are undefined without a resolver.
+	x, err := parseExpression("amount > 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = x.evalBool(nil); err == nil {
+		t.Error("evaluated a variable without a resolver")
+	}
+}
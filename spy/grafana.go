@@ -0,0 +1,117 @@
+// grafana.go pushes annotations for events to a Grafana instance's annotation
+// API, so that chart viewers see markers for chain events and dcrspy restarts
+// aligned with the time series.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// grafanaQueueSize is the number of annotations waiting to be sent, beyond
+// which new annotations are dropped.
+const grafanaQueueSize = 64
+
+// grafanaAnnotation is a request to the Grafana annotation API.
+type grafanaAnnotation struct {
+	DashboardID int64    `json:"dashboardId,omitempty"`
+	Time        int64    `json:"time"`
+	Tags        []string `json:"tags"`
+	Text        string   `json:"text"`
+}
+
+// grafanaAnnotator sends annotations to Grafana.
+type grafanaAnnotator struct {
+	url         string
+	apiKey      string
+	dashboardID int64
+	client      *http.Client
+	queue       chan *grafanaAnnotation
+}
+
+// spyGrafana is the package-level Grafana annotator, nil if not configured.
+var spyGrafana *grafanaAnnotator
+
+// newGrafanaAnnotator creates a grafanaAnnotator for the Grafana instance at
+// baseURL.  A dashboardID of zero creates organization-wide annotations.
+func newGrafanaAnnotator(baseURL, apiKey string,
+	dashboardID int64) *grafanaAnnotator {
+	return &grafanaAnnotator{
+		url:         strings.TrimSuffix(baseURL, "/") + "/api/annotations",
+		apiKey:      apiKey,
+		dashboardID: dashboardID,
+		client:      newHTTPClient(),
+		queue:       make(chan *grafanaAnnotation, grafanaQueueSize),
+	}
+}
+
+// annotate queues an annotation for the event, tagged dcrspy, the event type
+// and the action.
+func (g *grafanaAnnotator) annotate(e *spyEvent) {
+	if g == nil {
+		return
+	}
+	tags := []string{"dcrspy", e.Type}
+	if e.Action != "" {
+		tags = append(tags, e.Action)
+	}
+	a := &grafanaAnnotation{
+		DashboardID: g.dashboardID,
+		Time:        e.Time * 1000,
+		Tags:        tags,
+		Text:        e.Message,
+	}
+	select {
+	case g.queue <- a:
+	default:
+		log.Warnf("Grafana annotation queue full. Dropping %q.", e.Message)
+	}
+}
+
+// run sends queued annotations until quit is closed.  It should be run as a
+// goroutine.
+func (g *grafanaAnnotator) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case a := <-g.queue:
+			if err := g.post(a); err != nil {
+				log.Warnf("Failed to send annotation to Grafana: %v",
+					reportError(errKindNotifier, "grafana", err))
+			}
+		case <-quit:
+			log.Debugf("Quitting Grafana annotator.")
+			return
+		}
+	}
+}
+
+// post sends an annotation to the annotation API.
+func (g *grafanaAnnotator) post(a *grafanaAnnotation) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", g.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,718 @@
+// graphql.go implements the subset of GraphQL needed to query dcrspy's data:
+// query operations with fields, aliases, arguments and variables.  Fragments,
+// directives, mutations and introspection are not supported.
+//
+// Rather than defining a type system, the value returned by the resolver for
+// each top-level field is projected onto the requested selection set using
+// the value's JSON field names.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// LEXER
+
+type gqlTokenKind int
+
+const (
+	gqlTokEOF gqlTokenKind = iota
+	gqlTokPunct
+	gqlTokName
+	gqlTokInt
+	gqlTokFloat
+	gqlTokString
+)
+
+type gqlToken struct {
+	kind gqlTokenKind
+	val  string
+	pos  int
+}
+
+type gqlLexer struct {
+	src string
+	pos int
+}
+
+// next returns the next token, skipping whitespace, commas and comments,
+// which are insignificant in GraphQL.
+func (l *gqlLexer) next() (gqlToken, error) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+			continue
+		}
+		if c == ',' || c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			l.pos++
+			continue
+		}
+		break
+	}
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: gqlTokEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("{}()[]:!$=@", c) >= 0:
+		l.pos++
+		return gqlToken{gqlTokPunct, string(c), start}, nil
+	case c == '.':
+		if strings.HasPrefix(l.src[l.pos:], "...") {
+			l.pos += 3
+			return gqlToken{gqlTokPunct, "...", start}, nil
+		}
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' ||
+			unicode.IsLetter(rune(l.src[l.pos])) ||
+			unicode.IsDigit(rune(l.src[l.pos]))) {
+			l.pos++
+		}
+		return gqlToken{gqlTokName, l.src[start:l.pos], start}, nil
+	case c == '-' || unicode.IsDigit(rune(c)):
+		kind := gqlTokInt
+		l.pos++
+		for l.pos < len(l.src) {
+			d := l.src[l.pos]
+			if d == '.' || d == 'e' || d == 'E' {
+				kind = gqlTokFloat
+			} else if !unicode.IsDigit(rune(d)) && !(kind == gqlTokFloat &&
+				(d == '-' || d == '+')) {
+				break
+			}
+			l.pos++
+		}
+		return gqlToken{kind, l.src[start:l.pos], start}, nil
+	case c == '"':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != '"' {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return gqlToken{}, fmt.Errorf("unterminated string at %d", start)
+		}
+		l.pos++
+		s, err := strconv.Unquote(l.src[start:l.pos])
+		if err != nil {
+			return gqlToken{}, fmt.Errorf("invalid string at %d", start)
+		}
+		return gqlToken{gqlTokString, s, start}, nil
+	}
+	return gqlToken{}, fmt.Errorf("unexpected character %q at %d", c, start)
+}
+
+// PARSER
+
+// gqlVariable is a reference to a variable in an argument value.
+type gqlVariable string
+
+// gqlField is a field in a selection set.
+type gqlField struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []*gqlField
+}
+
+// responseKey is the key of the field in the result.
+func (f *gqlField) responseKey() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+// gqlOperation is a parsed query operation.
+type gqlOperation struct {
+	name        string
+	varDefaults map[string]interface{}
+	selections  []*gqlField
+}
+
+// maxGQLDepth is the maximum nesting of selection sets, list values and list
+// types in a query.
+const maxGQLDepth = 64
+
+type gqlParser struct {
+	lex   gqlLexer
+	tok   gqlToken
+	depth int
+}
+
+// enter increases the nesting depth of the parser, failing if the query is
+// nested too deeply.  Each successful enter is paired with a leave.
+func (p *gqlParser) enter() error {
+	if p.depth >= maxGQLDepth {
+		return fmt.Errorf("query nested too deeply at %d", p.tok.pos)
+	}
+	p.depth++
+	return nil
+}
+
+func (p *gqlParser) leave() {
+	p.depth--
+}
+
+func (p *gqlParser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *gqlParser) isPunct(val string) bool {
+	return p.tok.kind == gqlTokPunct && p.tok.val == val
+}
+
+func (p *gqlParser) expectPunct(val string) error {
+	if !p.isPunct(val) {
+		return fmt.Errorf("expected %q at %d", val, p.tok.pos)
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) expectName() (string, error) {
+	if p.tok.kind != gqlTokName {
+		return "", fmt.Errorf("expected name at %d", p.tok.pos)
+	}
+	name := p.tok.val
+	return name, p.advance()
+}
+
+// parseGraphQL parses a GraphQL document, returning the operation with the
+// given name, or the only operation if name is empty.
+func parseGraphQL(query, operationName string) (*gqlOperation, error) {
+	p := &gqlParser{lex: gqlLexer{src: query}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var ops []*gqlOperation
+	for p.tok.kind != gqlTokEOF {
+		op, err := p.parseOperation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("no operations in query")
+	}
+	if operationName == "" {
+		if len(ops) > 1 {
+			return nil, fmt.Errorf("operationName is required for a " +
+				"document with multiple operations")
+		}
+		return ops[0], nil
+	}
+	for _, op := range ops {
+		if op.name == operationName {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", operationName)
+}
+
+func (p *gqlParser) parseOperation() (*gqlOperation, error) {
+	op := &gqlOperation{varDefaults: make(map[string]interface{})}
+
+	// Query shorthand
+	if p.isPunct("{") {
+		sels, err := p.parseSelectionSet()
+		op.selections = sels
+		return op, err
+	}
+
+	opType, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	switch opType {
+	case "query":
+	case "fragment":
+		return nil, fmt.Errorf("fragments are not supported")
+	default:
+		return nil, fmt.Errorf("%s operations are not supported", opType)
+	}
+
+	if p.tok.kind == gqlTokName {
+		op.name = p.tok.val
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isPunct("(") {
+		if err = p.parseVariableDefinitions(op); err != nil {
+			return nil, err
+		}
+	}
+
+	op.selections, err = p.parseSelectionSet()
+	return op, err
+}
+
+func (p *gqlParser) parseVariableDefinitions(op *gqlOperation) error {
+	if err := p.expectPunct("("); err != nil {
+		return err
+	}
+	for !p.isPunct(")") {
+		if err := p.expectPunct("$"); err != nil {
+			return err
+		}
+		name, err := p.expectName()
+		if err != nil {
+			return err
+		}
+		if err = p.expectPunct(":"); err != nil {
+			return err
+		}
+		if err = p.skipType(); err != nil {
+			return err
+		}
+		if p.isPunct("=") {
+			if err = p.advance(); err != nil {
+				return err
+			}
+			val, err := p.parseValue()
+			if err != nil {
+				return err
+			}
+			op.varDefaults[name] = val
+		}
+	}
+	return p.advance()
+}
+
+// skipType consumes a type reference such as Int, String! or [Int!]!.  Types
+// are not checked.
+func (p *gqlParser) skipType() error {
+	if p.isPunct("[") {
+		if err := p.enter(); err != nil {
+			return err
+		}
+		defer p.leave()
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.expectName(); err != nil {
+		return err
+	}
+	if p.isPunct("!") {
+		return p.advance()
+	}
+	return nil
+}
+
+func (p *gqlParser) parseSelectionSet() ([]*gqlField, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	var fields []*gqlField
+	for !p.isPunct("}") {
+		if p.tok.kind == gqlTokEOF {
+			return nil, fmt.Errorf("unterminated selection set")
+		}
+		if p.isPunct("...") {
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+		field, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, p.advance()
+}
+
+func (p *gqlParser) parseField() (*gqlField, error) {
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	field := &gqlField{name: name}
+	if p.isPunct(":") {
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+		field.alias = name
+		if field.name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isPunct("(") {
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+		field.args = make(map[string]interface{})
+		for !p.isPunct(")") {
+			argName, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expectPunct(":"); err != nil {
+				return nil, err
+			}
+			if field.args[argName], err = p.parseValue(); err != nil {
+				return nil, err
+			}
+		}
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isPunct("@") {
+		return nil, fmt.Errorf("directives are not supported")
+	}
+
+	if p.isPunct("{") {
+		if field.selections, err = p.parseSelectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+func (p *gqlParser) parseValue() (interface{}, error) {
+	tok := p.tok
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	switch tok.kind {
+	case gqlTokInt:
+		return strconv.ParseInt(tok.val, 10, 64)
+	case gqlTokFloat:
+		return strconv.ParseFloat(tok.val, 64)
+	case gqlTokString:
+		return tok.val, nil
+	case gqlTokName:
+		switch tok.val {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		// Enum values are treated as strings.
+		return tok.val, nil
+	case gqlTokPunct:
+		switch tok.val {
+		case "$":
+			name, err := p.expectName()
+			return gqlVariable(name), err
+		case "[":
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			var list []interface{}
+			for !p.isPunct("]") {
+				v, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			return list, p.advance()
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", tok.val, tok.pos)
+}
+
+// EXECUTION
+
+// gqlResolver resolves a top-level query field given its arguments.
+type gqlResolver func(args map[string]interface{}) (interface{}, error)
+
+// gqlObject is a result object that preserves the order of the selections
+// when marshalled to JSON.
+type gqlObject struct {
+	keys []string
+	vals map[string]interface{}
+}
+
+func (o *gqlObject) set(key string, val interface{}) {
+	if _, ok := o.vals[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.vals[key] = val
+}
+
+// MarshalJSON implements json.Marshaler.
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kj, _ := json.Marshal(k)
+		buf.Write(kj)
+		buf.WriteByte(':')
+		vj, err := json.Marshal(o.vals[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(vj)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlError is an error in the GraphQL response.
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlResponse is the GraphQL response body.
+type gqlResponse struct {
+	Data   *gqlObject `json:"data"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// executeGraphQL resolves each top-level field of the operation with the
+// corresponding resolver and projects the results onto the selections.
+func executeGraphQL(op *gqlOperation, resolvers map[string]gqlResolver,
+	variables map[string]interface{}) *gqlResponse {
+	resp := &gqlResponse{
+		Data: &gqlObject{vals: make(map[string]interface{})},
+	}
+
+	for _, field := range op.selections {
+		key := field.responseKey()
+		fail := func(err error) {
+			resp.Data.set(key, nil)
+			resp.Errors = append(resp.Errors, gqlError{
+				Message: err.Error(),
+				Path:    []interface{}{key},
+			})
+		}
+
+		if field.name == "__typename" {
+			resp.Data.set(key, "Query")
+			continue
+		}
+		resolve, ok := resolvers[field.name]
+		if !ok {
+			fail(fmt.Errorf("unknown field %q on type Query", field.name))
+			continue
+		}
+
+		args := make(map[string]interface{}, len(field.args))
+		for name, val := range field.args {
+			if v, isVar := val.(gqlVariable); isVar {
+				var found bool
+				if val, found = variables[string(v)]; !found {
+					val = op.varDefaults[string(v)]
+				}
+			}
+			args[name] = val
+		}
+
+		result, err := resolve(args)
+		if err != nil {
+			fail(err)
+			continue
+		}
+
+		// Convert the result to generic JSON values so the selections may be
+		// applied using the JSON field names.
+		b, err := json.Marshal(result)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		var generic interface{}
+		if err = json.Unmarshal(b, &generic); err != nil {
+			fail(err)
+			continue
+		}
+
+		projected, err := gqlProject(generic, field.selections)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		resp.Data.set(key, projected)
+	}
+
+	return resp
+}
+
+// gqlProject applies the selections to a generic JSON value.  All fields are
+// returned if there are no selections.
+func gqlProject(v interface{}, selections []*gqlField) (interface{}, error) {
+	if len(selections) == 0 || v == nil {
+		return v, nil
+	}
+
+	switch val := v.(type) {
+	case []interface{}:
+		out := make([]interface{}, 0, len(val))
+		for _, elem := range val {
+			p, err := gqlProject(elem, selections)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, p)
+		}
+		return out, nil
+	case map[string]interface{}:
+		obj := &gqlObject{vals: make(map[string]interface{})}
+		for _, sel := range selections {
+			if len(sel.args) > 0 {
+				return nil, fmt.Errorf("arguments are not supported on "+
+					"field %q", sel.name)
+			}
+			if sel.name == "__typename" {
+				obj.set(sel.responseKey(), "Object")
+				continue
+			}
+			fieldVal, ok := val[sel.name]
+			if !ok {
+				return nil, fmt.Errorf("unknown field %q", sel.name)
+			}
+			p, err := gqlProject(fieldVal, sel.selections)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(sel.responseKey(), p)
+		}
+		return obj, nil
+	default:
+		return nil, fmt.Errorf("cannot select fields of scalar value")
+	}
+}
+
+// gqlIntArg returns the named integer argument, or def if it is not given.
+func gqlIntArg(args map[string]interface{}, name string, def int64) (int64, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		return v, nil
+	case float64:
+		// Variables decoded from JSON
+		if v != float64(int64(v)) {
+			return 0, fmt.Errorf("argument %q must be an integer", name)
+		}
+		return int64(v), nil
+	default:
+		return 0, fmt.Errorf("argument %q must be an integer", name)
+	}
+}
+
+// gqlStringArg returns the named string argument, or def if it is not given.
+func gqlStringArg(args map[string]interface{}, name string, def string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("argument %q must be a string", name)
+	}
+}
+
+// graphQLAPI documents gqlHandler.
+var graphQLAPI = []apiOperation{{
+	method:  "GET",
+	summary: "Run a GraphQL query",
+	params: []apiParam{
+		{name: "query", in: "query", typ: "string", required: true},
+		{name: "variables", in: "query", typ: "string",
+			description: "The variables as a JSON object"},
+		{name: "operationName", in: "query", typ: "string"},
+	},
+	response: gqlResponse{},
+}, {
+	method:  "POST",
+	summary: "Run a GraphQL query",
+	request: struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName,omitempty"`
+		Variables     map[string]interface{} `json:"variables,omitempty"`
+	}{},
+	response: gqlResponse{},
+}}
+
+// gqlHandler serves GraphQL queries with the given resolvers via GET (query
+// and variables URL parameters) or POST (JSON body).
+func gqlHandler(resolvers map[string]gqlResolver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+		}
+
+		switch r.Method {
+		case "GET":
+			req.Query = r.URL.Query().Get("query")
+			req.OperationName = r.URL.Query().Get("operationName")
+			if vars := r.URL.Query().Get("variables"); vars != "" {
+				if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+					http.Error(w, "invalid variables", http.StatusBadRequest)
+					return
+				}
+			}
+		case "POST":
+			r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		op, err := parseGraphQL(req.Query, req.OperationName)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct {
+				Errors []gqlError `json:"errors"`
+			}{[]gqlError{{Message: err.Error()}}})
+			return
+		}
+
+		resp := executeGraphQL(op, resolvers, req.Variables)
+		if err = json.NewEncoder(w).Encode(resp); err != nil {
+			log.Errorf("Failed to write GraphQL response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package spy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGQLLexer(t *testing.T) {
+	tests := []struct {
+		src string
+		// want are the kinds and values of the tokens before EOF.
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{" ,\t\r\n# comment only", nil, false},
+		{"query Q($h: Int!) { block(height: $h) { hash } }",
+			[]string{"name:query", "name:Q", "punct:(", "punct:$", "name:h",
+				"punct::", "name:Int", "punct:!", "punct:)", "punct:{",
+				"name:block", "punct:(", "name:height", "punct::", "punct:$",
+				"name:h", "punct:)", "punct:{", "name:hash", "punct:}",
+				"punct:}"}, false},
+		{"a # comment\n_b2,c", []string{"name:a", "name:_b2", "name:c"}, false},
+		{"12 -3 0.5 1e6 -2.5E-3 6.02e+23", []string{"int:12", "int:-3",
+			"float:0.5", "float:1e6", "float:-2.5E-3", "float:6.02e+23"},
+			false},
+		{`"dcrspy" "a \"q\"" "tab\t" "\u00e9"`, []string{"string:dcrspy",
+			`string:a "q"`, "string:tab\t", "string:\u00e9"}, false},
+		{"...", []string{"punct:..."}, false},
+		{"[]=@", []string{"punct:[", "punct:]", "punct:=", "punct:@"}, false},
+		{`"unterminated`, nil, true},
+		{`"bad \q escape"`, nil, true},
+		{"..", nil, true},
+		{"a ; b", []string{"name:a"}, true},
+	}
+	kinds := map[gqlTokenKind]string{gqlTokPunct: "punct", gqlTokName: "name",
+		gqlTokInt: "int", gqlTokFloat: "float", gqlTokString: "string"}
+	for _, tt := range tests {
+		l := gqlLexer{src: tt.src}
+		var got []string
+		var err error
+		for {
+			var tok gqlToken
+			if tok, err = l.next(); err != nil || tok.kind == gqlTokEOF {
+				break
+			}
+			got = append(got, kinds[tok.kind]+":"+tok.val)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("lexing %q: got error %v, want error %v", tt.src, err,
+				tt.wantErr)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lexing %q: got tokens %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// gqlFieldString formats the parsed fields like the query, with the arguments
+// sorted by name, e.g. "b:block(height:1){hash}".
+func gqlFieldString(fields []*gqlField) string {
+	var parts []string
+	for _, f := range fields {
+		s := f.name
+		if f.alias != "" {
+			s = f.alias + ":" + s
+		}
+		if f.args != nil {
+			args, _ := json.Marshal(f.args)
+			s += "(" + string(args) + ")"
+		}
+		if f.selections != nil {
+			s += "{" + gqlFieldString(f.selections) + "}"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		query, operationName string
+		// want is the operation's name and fields as formatted by
+		// gqlFieldString, and wantErr a substring of the error.
+		want     string
+		defaults map[string]interface{}
+		wantErr  string
+	}{
+		{"{ bestBlock { height hash } }", "",
+			"bestBlock{height hash}", nil, ""},
+		{"query { tip: bestBlock { h: height } }", "",
+			"tip:bestBlock{h:height}", nil, ""},
+		{"query Blocks { blocks(from: 10, to: 12, order: DESC) { hash } }",
+			"", `Blocks blocks({"from":10,"order":"DESC","to":12}){hash}`,
+			nil, ""},
+		{`{ events(types: ["block", "vote"], all: true, tenant: null, ` +
+			`min: 0.5) }`, "",
+			`events({"all":true,"min":0.5,"tenant":null,` +
+				`"types":["block","vote"]})`, nil, ""},
+		{"query Q($h: Int! = 5, $t: [String!]) { block(height: $h) }", "",
+			`Q block({"height":"h"})`, map[string]interface{}{"h": int64(5)},
+			""},
+		{"query A { a } query B { b }", "B", "B b", nil, ""},
+		{"", "", "", nil, "no operations"},
+		{"query A { a } query B { b }", "", "", nil, "operationName"},
+		{"query A { a }", "C", "", nil, `unknown operation "C"`},
+		{"mutation { watch(address: \"Ds1\") }", "", "", nil,
+			"mutation operations are not supported"},
+		{"fragment F on Block { hash }", "", "", nil,
+			"fragments are not supported"},
+		{"{ bestBlock { ...F } }", "", "", nil, "fragments are not supported"},
+		{"{ bestBlock @skip(if: true) }", "", "", nil,
+			"directives are not supported"},
+		{"{ bestBlock { hash }", "", "", nil, "unterminated selection set"},
+		{"{ block(height: ) }", "", "", nil, `unexpected ")"`},
+		{"{ block(height 1) }", "", "", nil, `expected ":"`},
+		{"query Q(h: Int) { a }", "", "", nil, `expected "$"`},
+		{"{ a: }", "", "", nil, "expected name"},
+		{strings.Repeat("{ a ", 100000), "", "", nil,
+			"query nested too deeply"},
+		{"{ a(b: " + strings.Repeat("[", 100000) + ") }", "", "", nil,
+			"query nested too deeply"},
+		{"query Q($a: " + strings.Repeat("[", 100000) + ") { a }", "", "",
+			nil, "query nested too deeply"},
+	}
+	for _, tt := range tests {
+		op, err := parseGraphQL(tt.query, tt.operationName)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseGraphQL(%q): got error %v, want %q", tt.query,
+					err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseGraphQL(%q): %v", tt.query, err)
+			continue
+		}
+		got := gqlFieldString(op.selections)
+		if op.name != "" {
+			got = op.name + " " + got
+		}
+		if got != tt.want {
+			t.Errorf("parseGraphQL(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+		if len(op.varDefaults) != len(tt.defaults) ||
+			(len(tt.defaults) > 0 &&
+				!reflect.DeepEqual(op.varDefaults, tt.defaults)) {
+			t.Errorf("parseGraphQL(%q): got variable defaults %v, want %v",
+				tt.query, op.varDefaults, tt.defaults)
+		}
+	}
+}
+
+// testGQLBlock is a result of the test resolvers.
+type testGQLBlock struct {
+	Height int64    `json:"height"`
+	Hash   string   `json:"hash"`
+	Votes  []string `json:"votes"`
+}
+
+var testGQLResolvers = map[string]gqlResolver{
+	"block": func(args map[string]interface{}) (interface{}, error) {
+		h, err := gqlIntArg(args, "height", 1)
+		if err != nil {
+			return nil, err
+		}
+		return testGQLBlock{h, fmt.Sprintf("%064d", h),
+			[]string{"v1", "v2"}}, nil
+	},
+	"blocks": func(args map[string]interface{}) (interface{}, error) {
+		return []testGQLBlock{{Height: 1}, {Height: 2}}, nil
+	},
+	"failing": func(args map[string]interface{}) (interface{}, error) {
+		return nil, errors.New("no data")
+	},
+}
+
+func TestExecuteGraphQL(t *testing.T) {
+	tests := []struct {
+		query     string
+		variables map[string]interface{}
+		want      string
+	}{
+		{"{ block { height } }", nil, `{"data":{"block":{"height":1}}}`},
+		{"{ b: block(height: 7) { hash h: height } __typename }", nil,
+			`{"data":{"b":{"hash":"` + fmt.Sprintf("%064d", 7) +
+				`","h":7},"__typename":"Query"}}`},
+		{"{ blocks { height __typename } }", nil,
+			`{"data":{"blocks":[{"height":1,"__typename":"Object"},` +
+				`{"height":2,"__typename":"Object"}]}}`},
+		{"query Q($h: Int = 3) { block(height: $h) { height } }", nil,
+			`{"data":{"block":{"height":3}}}`},
+		{"query Q($h: Int = 3) { block(height: $h) { height } }",
+			map[string]interface{}{"h": float64(9)},
+			`{"data":{"block":{"height":9}}}`},
+		{"query Q($h: Int) { block(height: $h) { height } }",
+			map[string]interface{}{"h": 1.5},
+			`{"data":{"block":null},"errors":[{"message":"argument ` +
+				`\"height\" must be an integer","path":["block"]}]}`},
+		{"{ block { votes } }", nil, `{"data":{"block":{"votes":["v1","v2"]}}}`},
+		{"{ block { votes { id } } }", nil,
+			`{"data":{"block":null},"errors":[{"message":"cannot select ` +
+				`fields of scalar value","path":["block"]}]}`},
+		{"{ block { size } }", nil,
+			`{"data":{"block":null},"errors":[{"message":"unknown field ` +
+				`\"size\"","path":["block"]}]}`},
+		{"{ block { height(unit: DCR) } }", nil,
+			`{"data":{"block":null},"errors":[{"message":"arguments are ` +
+				`not supported on field \"height\"","path":["block"]}]}`},
+		{"{ failing tx block { height } }", nil,
+			`{"data":{"failing":null,"tx":null,"block":{"height":1}},` +
+				`"errors":[{"message":"no data","path":["failing"]},` +
+				`{"message":"unknown field \"tx\" on type Query",` +
+				`"path":["tx"]}]}`},
+	}
+	for _, tt := range tests {
+		op, err := parseGraphQL(tt.query, "")
+		if err != nil {
+			t.Fatalf("parseGraphQL(%q): %v", tt.query, err)
+		}
+		b, err := json.Marshal(executeGraphQL(op, testGQLResolvers,
+			tt.variables))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("executing %q:\n got %s\nwant %s", tt.query, b, tt.want)
+		}
+	}
+}
+
+func TestGQLArgs(t *testing.T) {
+	intTests := []struct {
+		arg     interface{}
+		want    int64
+		wantErr bool
+	}{
+		{nil, 5, false},
+		{int64(-2), -2, false},
+		{float64(12), 12, false},
+		{1.5, 0, true},
+		{"12", 0, true},
+	}
+	for _, tt := range intTests {
+		args := map[string]interface{}{"n": tt.arg}
+		got, err := gqlIntArg(args, "n", 5)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("gqlIntArg(%v) = %d, %v, want %d, error %v", tt.arg, got,
+				err, tt.want, tt.wantErr)
+		}
+	}
+	stringTests := []struct {
+		arg     interface{}
+		want    string
+		wantErr bool
+	}{
+		{nil, "def", false},
+		{"Ds1", "Ds1", false},
+		{int64(1), "", true},
+	}
+	for _, tt := range stringTests {
+		args := map[string]interface{}{"s": tt.arg}
+		got, err := gqlStringArg(args, "s", "def")
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("gqlStringArg(%v) = %q, %v, want %q, error %v", tt.arg,
+				got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGQLHandler(t *testing.T) {
+	query := "query Q($h: Int) { block(height: $h) { height } }"
+	tests := []struct {
+		method, target, body string
+		wantStatus           int
+		want                 string
+	}{
+		{"GET", "/graphql?query=" + url.QueryEscape(query) +
+			"&variables=" + url.QueryEscape(`{"h": 4}`), "", http.StatusOK,
+			`{"data":{"block":{"height":4}}}`},
+		{"POST", "/graphql", `{"query": "` + query + `", ` +
+			`"operationName": "Q", "variables": {"h": 6}}`, http.StatusOK,
+			`{"data":{"block":{"height":6}}}`},
+		{"GET", "/graphql?query=" + url.QueryEscape("{ block"), "",
+			http.StatusBadRequest,
+			`{"errors":[{"message":"unterminated selection set"}]}`},
+		{"GET", "/graphql?query=x&variables=%7B", "", http.StatusBadRequest,
+			"invalid variables"},
+		{"POST", "/graphql", "{", http.StatusBadRequest,
+			"invalid request body"},
+		{"POST", "/graphql", `{"query": "` +
+			strings.Repeat(" ", maxAPIBodySize) + `{ block }"}`,
+			http.StatusBadRequest, "invalid request body"},
+		{"PUT", "/graphql", "", http.StatusMethodNotAllowed,
+			"method not allowed"},
+	}
+	handler := gqlHandler(testGQLResolvers)
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target,
+			strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if got := strings.TrimSpace(w.Body.String()); w.Code != tt.wantStatus ||
+			got != tt.want {
+			t.Errorf("%s %s: got %d %s, want %d %s", tt.method, tt.target,
+				w.Code, got, tt.wantStatus, tt.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// graphqlapi.go defines the query fields of the GraphQL API, which serves the
+// data saved by the JSON file savers and the watched address event journal.
+// The saved data are read through the API read cache (see datacache.go).
+
+package spy
+
+import (
+	"fmt"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrrpcclient"
+)
+
+// maxGraphQLBlocks is the maximum number of blocks returned by the blocks
+// query field.
+const maxGraphQLBlocks = 100
+
+// newGraphQLResolvers creates the resolvers for the query fields, reading
+// stored data from outFolder, and the heights of block hashes from dcrd.  For
+// a tenant, only the tenant's events are available, and the operator's wallet
+// data is not.
+func newGraphQLResolvers(outFolder string, dcrd *dcrrpcclient.Client,
+	t *tenant) map[string]gqlResolver {
+	// heightArg returns the height argument, or the latest stored height for
+	// the given file prefix if it was not specified.
+	heightArg := func(args map[string]interface{}, prefix string) (int64, error) {
+		height, err := gqlIntArg(args, "height", -1)
+		if err != nil || height >= 0 {
+			return height, err
+		}
+		return spyDataCache.latestHeight(outFolder, prefix)
+	}
+
+	// blockByHash returns the stored block data of the block hash, which
+	// must still be the block at its height.
+	blockByHash := func(hash string) (*storedBlockData, error) {
+		height, ok := spyDataCache.blockHeight(hash)
+		if !ok {
+			h, err := chainhash.NewHashFromStr(hash)
+			if err != nil {
+				return nil, fmt.Errorf("invalid block hash %q", hash)
+			}
+			header, err := dcrd.GetBlockHeader(h)
+			if err != nil {
+				return nil, fmt.Errorf("unknown block %s", hash)
+			}
+			height = int64(header.Height)
+		}
+		data, err := spyDataCache.blockData(outFolder, height)
+		if err != nil {
+			return nil, err
+		}
+		if data.Header.Hash != hash {
+			return nil, fmt.Errorf("block %s is not saved", hash)
+		}
+		return data, nil
+	}
+
+	errWalletData := fmt.Errorf("wallet data is not available to tenants")
+
+	return map[string]gqlResolver{
+		// block(height: Int, hash: String): the block data at height, or
+		// of the block hash, or the latest
+		"block": func(args map[string]interface{}) (interface{}, error) {
+			hash, err := gqlStringArg(args, "hash", "")
+			if err != nil {
+				return nil, err
+			}
+			if hash != "" {
+				return blockByHash(hash)
+			}
+			height, err := heightArg(args, blockDataFilePrefix)
+			if err != nil {
+				return nil, err
+			}
+			return spyDataCache.blockData(outFolder, height)
+		},
+
+		// blocks(from: Int!, to: Int): the block data in a range of heights,
+		// skipping heights with no saved data
+		"blocks": func(args map[string]interface{}) (interface{}, error) {
+			from, err := gqlIntArg(args, "from", -1)
+			if err != nil {
+				return nil, err
+			}
+			to, err := gqlIntArg(args, "to", from+maxGraphQLBlocks-1)
+			if err != nil {
+				return nil, err
+			}
+			if from < 0 || to < from {
+				return nil, fmt.Errorf("invalid height range [%d, %d]", from, to)
+			}
+			if to-from >= maxGraphQLBlocks {
+				return nil, fmt.Errorf("at most %d blocks may be requested",
+					maxGraphQLBlocks)
+			}
+			blocks := make([]*storedBlockData, 0, to-from+1)
+			for h := from; h <= to; h++ {
+				data, err := spyDataCache.blockData(outFolder, h)
+				if err != nil {
+					continue
+				}
+				blocks = append(blocks, data)
+			}
+			return blocks, nil
+		},
+
+		// stakeInfo(height: Int): the wallet stake info at height, or the
+		// latest
+		"stakeInfo": func(args map[string]interface{}) (interface{}, error) {
+			if t != nil {
+				return nil, errWalletData
+			}
+			height, err := heightArg(args, stakeInfoFilePrefix)
+			if err != nil {
+				return nil, err
+			}
+			return spyDataCache.stakeInfoData(outFolder, height)
+		},
+
+		// tickets(height: Int): the wallet's ticket hashes at height, or the
+		// latest
+		"tickets": func(args map[string]interface{}) (interface{}, error) {
+			if t != nil {
+				return nil, errWalletData
+			}
+			height, err := heightArg(args, stakeInfoFilePrefix)
+			if err != nil {
+				return nil, err
+			}
+			data, err := spyDataCache.stakeInfoData(outFolder, height)
+			if err != nil {
+				return nil, err
+			}
+			return data.Tickets, nil
+		},
+
+		// watchedEvents(address: String, action: String, limit: Int = 100):
+		// the most recent watched address events, at most maxEventsLimit
+		"watchedEvents": func(args map[string]interface{}) (interface{}, error) {
+			if spyJournal == nil {
+				return nil, fmt.Errorf("the event journal is not enabled")
+			}
+			address, err := gqlStringArg(args, "address", "")
+			if err != nil {
+				return nil, err
+			}
+			action, err := gqlStringArg(args, "action", "")
+			if err != nil {
+				return nil, err
+			}
+			limit, err := gqlIntArg(args, "limit", defaultEventsLimit)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case limit <= 0:
+				limit = defaultEventsLimit
+			case limit > maxEventsLimit:
+				limit = maxEventsLimit
+			}
+			return spyJournal.query(func(e *spyEvent) bool {
+				return e.Type == eventTypeWatchedAddr &&
+					e.Tenant == t.owner() &&
+					(address == "" || e.Address == address) &&
+					(action == "" || e.Action == action)
+			}, int(limit))
+		},
+	}
+}
@@ -0,0 +1,86 @@
+// heartbeat.go sends periodic "all clear" messages, so that silence from
+// dcrspy can be distinguished from a dead notifier or a crashed process.
+
+package spy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrrpcclient"
+)
+
+// heartbeatMessage describes the current state for a heartbeat: the best
+// block height, the number of events recorded in the journal during the last
+// interval, and a summary of availability over the interval.
+func heartbeatMessage(dcrd *dcrrpcclient.Client, interval time.Duration) (string, error) {
+	var height int64
+	err := withRPCTimeout("getbestblock", func() error {
+		var err error
+		_, height, err = dcrd.GetBestBlock()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	events := "no events"
+	if spyJournal != nil {
+		since := time.Now().Add(-interval).Unix()
+		recent, err := spyJournal.query(func(e *spyEvent) bool {
+			return e.Time >= since
+		}, 0)
+		if err != nil {
+			return "", err
+		}
+		switch len(recent) {
+		case 0:
+		case 1:
+			events = "1 event"
+		default:
+			events = fmt.Sprintf("%d events", len(recent))
+		}
+	}
+
+	msg := fmt.Sprintf("dcrspy alive, height %d, %s in last %v.", height,
+		events, interval)
+	if spyAvailability != nil {
+		msg += fmt.Sprintf(" Availability: %v.", spyAvailability.summary(interval))
+	}
+	return msg, nil
+}
+
+// heartbeat logs and emails a heartbeat message at the given interval until
+// quit is closed.  If dcrd cannot be reached, an alert is sent instead.  It
+// should be run as a goroutine.
+func heartbeat(dcrd *dcrrpcclient.Client, interval time.Duration,
+	wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			msg, err := heartbeatMessage(dcrd, interval)
+			if err != nil {
+				fireAlert("heartbeat", "heartbeat failed",
+					"Unable to check status: %v", err)
+				continue
+			}
+			resolveAlert("heartbeat", "Status check succeeded.")
+			log.Infof("Heartbeat: %s", msg)
+			if alertEmailConfig != nil {
+				spyNotifyPool.submit(notifyChannelEmail, func() {
+					sendEmailWatchRecv(msg, "dcrspy heartbeat",
+						alertEmailConfig)
+				})
+			}
+		case <-quit:
+			log.Debugf("Quitting heartbeat.")
+			return
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// hostmetrics.go monitors the resources of the host: the free space of the
+// filesystems of the output folder and of other paths (e.g. dcrd's data
+// directory), since a full disk is the most common cause of node failure, and
+// dcrspy's own memory, goroutine and CPU use.  They are checked every minute,
+// provided as metrics, and alerted on when beyond the configured thresholds,
+// with the alert resolved when back within them.  A memory or goroutine
+// threshold exceeded for several checks also captures a profile (see
+// profiles.go).  The free space and CPU time are obtained from the operating
+// system (see hostmetrics_*.go).
+
+package spy
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostCheckInterval is the interval between checks of the host resources.
+const hostCheckInterval = time.Minute
+
+// diskUsage is the free and total space of a filesystem, in bytes.
+type diskUsage struct {
+	free, total uint64
+}
+
+// hostMonitor checks the host resources.
+type hostMonitor struct {
+	paths []string
+	// minFreeBytes or minFreePercent is the free space below which a
+	// path's filesystem alerts, zero if disabled.
+	minFreeBytes   uint64
+	minFreePercent float64
+	// maxMemory is the memory use in bytes, maxGoroutines the number of
+	// goroutines, and maxCPU the CPU use in percent of a core, above which
+	// dcrspy alerts, zero if disabled.
+	maxMemory     uint64
+	maxGoroutines int
+	maxCPU        float64
+	// profiles captures the profiles, nil if disabled, and highChecks
+	// counts the consecutive checks beyond the limit of each kind.
+	profiles   *profileCapture
+	highChecks map[string]int
+
+	mtx   sync.Mutex
+	disks map[string]diskUsage
+	// cpuTime is the CPU time of the process at cpuCheck, and cpuPercent
+	// the CPU use since the previous check.
+	cpuTime    time.Duration
+	cpuCheck   time.Time
+	cpuPercent float64
+}
+
+// spyHostMonitor is the package-level host monitor.
+var spyHostMonitor *hostMonitor
+
+// parseMinFree parses a free space threshold, in GiB (e.g. 10) or as a
+// percentage of the filesystem (e.g. 5%).
+func parseMinFree(s string) (uint64, float64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || p <= 0 || p >= 100 {
+			return 0, 0, fmt.Errorf("invalid diskminfree %q", s)
+		}
+		return 0, p, nil
+	}
+	gib, err := strconv.ParseFloat(s, 64)
+	if err != nil || gib <= 0 {
+		return 0, 0, fmt.Errorf("invalid diskminfree %q", s)
+	}
+	return uint64(gib * (1 << 30)), 0, nil
+}
+
+// newHostMonitor creates a hostMonitor of the filesystems of the paths, with
+// the free space threshold minFree (empty to disable), and the memory (MiB),
+// goroutine and CPU (percent) thresholds (zero to disable).  Profiles are
+// captured to profileDir when the memory or goroutine threshold is exceeded.
+func newHostMonitor(paths []string, minFree string, maxMemory int64,
+	maxGoroutines int, maxCPU float64, profileDir string) (*hostMonitor,
+	error) {
+	if maxMemory < 0 || maxGoroutines < 0 || maxCPU < 0 {
+		return nil, fmt.Errorf("maxmemory, maxgoroutines and maxcpu must " +
+			"not be negative")
+	}
+	h := &hostMonitor{
+		maxMemory:     uint64(maxMemory) << 20,
+		maxGoroutines: maxGoroutines,
+		maxCPU:        maxCPU,
+		highChecks:    make(map[string]int),
+		disks:         make(map[string]diskUsage),
+	}
+	if maxMemory > 0 || maxGoroutines > 0 {
+		var err error
+		if h.profiles, err = newProfileCapture(profileDir); err != nil {
+			return nil, fmt.Errorf("failed to create profiledir: %v", err)
+		}
+	}
+	if minFree != "" {
+		var err error
+		h.minFreeBytes, h.minFreePercent, err = parseMinFree(minFree)
+		if err != nil {
+			return nil, err
+		}
+	}
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		p, err := filepath.Abs(cleanAndExpandPath(p))
+		if err != nil {
+			return nil, err
+		}
+		if !seen[p] {
+			seen[p] = true
+			h.paths = append(h.paths, p)
+		}
+	}
+
+	spyMetrics.register("dcrspy_disk_free_bytes", hostDiskMetrics{h})
+	spyMetrics.newGauge("dcrspy_memory_bytes",
+		"Memory obtained from the operating system by dcrspy.",
+		func() float64 {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			return float64(m.Sys)
+		})
+	spyMetrics.newGauge("dcrspy_goroutines",
+		"Number of goroutines of dcrspy.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	spyMetrics.newGauge("dcrspy_cpu_seconds_total",
+		"CPU time (user and system) used by dcrspy.",
+		func() float64 {
+			t, err := processCPUTime()
+			if err != nil {
+				return 0
+			}
+			return t.Seconds()
+		})
+	return h, nil
+}
+
+// run checks the resources every hostCheckInterval until quit is closed.  It
+// should be run as a goroutine.
+func (h *hostMonitor) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	log.Infof("Monitoring the free space of %s.", strings.Join(h.paths, ", "))
+
+	ticker := time.NewTicker(hostCheckInterval)
+	defer ticker.Stop()
+	for {
+		h.check(time.Now())
+		select {
+		case <-ticker.C:
+		case <-quit:
+			log.Debugf("Quitting host monitor.")
+			return
+		}
+	}
+}
+
+// check updates the resource use, and alerts on the thresholds.
+func (h *hostMonitor) check(now time.Time) {
+	for _, p := range h.paths {
+		u, err := getDiskUsage(p)
+		if err != nil {
+			log.Warnf("Unable to get the free space of %s: %v", p,
+				reportError(errKindCollector, "host", err))
+			continue
+		}
+		h.mtx.Lock()
+		h.disks[p] = u
+		h.mtx.Unlock()
+		h.checkDisk(p, u)
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if h.maxMemory > 0 {
+		high := m.Sys > h.maxMemory
+		if high {
+			fireAlert("host:memory", "memory use", "dcrspy is using %d MiB "+
+				"of memory, more than %d MiB.", m.Sys>>20, h.maxMemory>>20)
+		} else {
+			resolveAlert("host:memory", "dcrspy is using %d MiB of memory.",
+				m.Sys>>20)
+		}
+		h.captureIfSustained(profileHeap, high, now,
+			fmt.Sprintf("more than %d MiB of memory", h.maxMemory>>20))
+	}
+	if h.maxGoroutines > 0 {
+		n := runtime.NumGoroutine()
+		high := n > h.maxGoroutines
+		if high {
+			fireAlert("host:goroutines", "goroutines", "dcrspy has %d "+
+				"goroutines, more than %d.", n, h.maxGoroutines)
+		} else {
+			resolveAlert("host:goroutines", "dcrspy has %d goroutines.", n)
+		}
+		h.captureIfSustained(profileGoroutine, high, now,
+			fmt.Sprintf("more than %d goroutines", h.maxGoroutines))
+	}
+
+	cpuTime, err := processCPUTime()
+	if err != nil {
+		log.Debugf("Unable to get the CPU time: %v", err)
+		return
+	}
+	h.mtx.Lock()
+	first := h.cpuCheck.IsZero()
+	if !first {
+		h.cpuPercent = 100 * float64(cpuTime-h.cpuTime) /
+			float64(now.Sub(h.cpuCheck))
+	}
+	h.cpuTime, h.cpuCheck = cpuTime, now
+	cpu := h.cpuPercent
+	h.mtx.Unlock()
+	if first || h.maxCPU == 0 {
+		return
+	}
+	if cpu > h.maxCPU {
+		fireAlert("host:cpu", "CPU use", "dcrspy used %.0f%% of a CPU core "+
+			"over the last %v, more than %.0f%%.", cpu, hostCheckInterval,
+			h.maxCPU)
+	} else {
+		resolveAlert("host:cpu", "dcrspy used %.0f%% of a CPU core over the "+
+			"last %v.", cpu, hostCheckInterval)
+	}
+}
+
+// captureIfSustained counts the consecutive checks beyond the limit of the
+// kind of profile, high being whether this check is, and captures the profile
+// once there are profileSustainChecks of them, alerting with its path.
+func (h *hostMonitor) captureIfSustained(kind string, high bool,
+	now time.Time, limit string) {
+	if !high {
+		h.highChecks[kind] = 0
+		return
+	}
+	h.highChecks[kind]++
+	if h.highChecks[kind] < profileSustainChecks || h.profiles == nil {
+		return
+	}
+	path, err := h.profiles.capture(kind, now)
+	if err != nil {
+		log.Errorf("Unable to capture a %s profile: %v", kind, err)
+		return
+	}
+	if path == "" {
+		return
+	}
+	log.Infof("Captured a %s profile at %s.", kind, path)
+	sendAlert(kind+" profile", "dcrspy has used %s for %v. A %s profile "+
+		"was captured at %s for analysis with go tool pprof.", limit,
+		time.Duration(h.highChecks[kind])*hostCheckInterval, kind, path)
+}
+
+// checkDisk alerts if the free space of the path's filesystem is below the
+// threshold.
+func (h *hostMonitor) checkDisk(path string, u diskUsage) {
+	if h.minFreeBytes == 0 && h.minFreePercent == 0 {
+		return
+	}
+	var percent float64
+	if u.total > 0 {
+		percent = 100 * float64(u.free) / float64(u.total)
+	}
+	low := u.free < h.minFreeBytes ||
+		(h.minFreePercent > 0 && percent < h.minFreePercent)
+	free := fmt.Sprintf("%.1f GiB (%.1f%%)", float64(u.free)/(1<<30),
+		percent)
+	if low {
+		fireAlert("host:disk:"+path, "low disk space", "The filesystem of %s "+
+			"has %s free. A full disk stops dcrd and dcrspy.", path, free)
+	} else {
+		resolveAlert("host:disk:"+path, "The filesystem of %s has %s free.",
+			path, free)
+	}
+}
+
+// hostDiskMetrics writes the free and total space of the monitored paths.
+type hostDiskMetrics struct {
+	h *hostMonitor
+}
+
+func (m hostDiskMetrics) writeMetrics(w io.Writer) {
+	m.h.mtx.Lock()
+	paths := make([]string, 0, len(m.h.disks))
+	for p := range m.h.disks {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	disks := make([]diskUsage, len(paths))
+	for i, p := range paths {
+		disks[i] = m.h.disks[p]
+	}
+	m.h.mtx.Unlock()
+
+	const free, total = "dcrspy_disk_free_bytes", "dcrspy_disk_total_bytes"
+	fmt.Fprintf(w, "# HELP %s Free space of the filesystem of a monitored "+
+		"path.\n# TYPE %s gauge\n", free, free)
+	for i, p := range paths {
+		fmt.Fprintf(w, "%s{path=%q} %d\n", free, p, disks[i].free)
+	}
+	fmt.Fprintf(w, "# HELP %s Size of the filesystem of a monitored path.\n"+
+		"# TYPE %s gauge\n", total, total)
+	for i, p := range paths {
+		fmt.Fprintf(w, "%s{path=%q} %d\n", total, p, disks[i].total)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package spy
+
+import (
+	"errors"
+	"time"
+)
+
+// errHostMetricsUnsupported is returned on systems where the free space and
+// CPU time are not obtained.
+var errHostMetricsUnsupported = errors.New("not supported on this system")
+
+// getDiskUsage is not supported on this system.
+func getDiskUsage(path string) (diskUsage, error) {
+	return diskUsage{}, errHostMetricsUnsupported
+}
+
+// processCPUTime is not supported on this system.
+func processCPUTime() (time.Duration, error) {
+	return 0, errHostMetricsUnsupported
+}
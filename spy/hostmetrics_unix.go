@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package spy
+
+import (
+	"syscall"
+	"time"
+)
+
+// getDiskUsage returns the free and total space of the path's filesystem.
+// The free space is that available to unprivileged users.
+func getDiskUsage(path string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskUsage{}, err
+	}
+	bsize := uint64(st.Bsize)
+	return diskUsage{
+		free:  uint64(st.Bavail) * bsize,
+		total: uint64(st.Blocks) * bsize,
+	}, nil
+}
+
+// processCPUTime returns the user and system CPU time of the process.
+func processCPUTime() (time.Duration, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
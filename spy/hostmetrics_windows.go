@@ -0,0 +1,45 @@
+package spy
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").
+	NewProc("GetDiskFreeSpaceExW")
+
+// getDiskUsage returns the free and total space of the path's volume.  The
+// free space is that available to the user.
+func getDiskUsage(path string) (diskUsage, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return diskUsage{}, err
+	}
+	var free, total, totalFree uint64
+	r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&totalFree)))
+	if r == 0 {
+		return diskUsage{}, err
+	}
+	return diskUsage{free: free, total: total}, nil
+}
+
+// processCPUTime returns the user and kernel CPU time of the process.
+func processCPUTime() (time.Duration, error) {
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, err
+	}
+	var creation, exit, kernel, user syscall.Filetime
+	if err = syscall.GetProcessTimes(h, &creation, &exit, &kernel,
+		&user); err != nil {
+		return 0, err
+	}
+	// Filetimes are in 100 ns intervals.
+	ticks := func(f syscall.Filetime) int64 {
+		return int64(f.HighDateTime)<<32 | int64(f.LowDateTime)
+	}
+	return time.Duration((ticks(kernel) + ticks(user)) * 100), nil
+}
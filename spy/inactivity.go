@@ -0,0 +1,149 @@
+// inactivity.go alerts when a watched address expected to be active (e.g. an
+// exchange hot wallet or a mining payout address) has had no activity for a
+// period, which may reveal a failure upstream of it.  Rules such as
+//
+//	inactivealert=DsYAN3vT15rjzgoGgEEscoUpPCRtwQKL7dQ,24h
+//	inactivealert=DsYAN3vT15rjzgoGgEEscoUpPCRtwQKL7dQ,288blocks
+//
+// give the period as a duration or a number of blocks.  The activity of an
+// address is its last event in the address statistics, or its last credit or
+// debit with addrhistory.  An address without any activity is measured from
+// the start of monitoring.  The rules are checked after the notifications of
+// each block, and the alert is resolved when the address is active again.
+
+package spy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/decred/dcrutil"
+)
+
+// inactivityRule is the expected activity of an address, within period or
+// blocks.
+type inactivityRule struct {
+	addr   string
+	period time.Duration
+	blocks int64
+}
+
+// parseInactivityRule parses ADDRESS,DURATION or ADDRESS,Nblocks.
+func parseInactivityRule(s string) (*inactivityRule, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid inactive address alert %q "+
+			"(expected ADDRESS,DURATION or ADDRESS,Nblocks)", s)
+	}
+	r := &inactivityRule{addr: strings.TrimSpace(parts[0])}
+	if _, err := dcrutil.DecodeAddress(r.addr, activeNet.Params); err != nil {
+		return nil, fmt.Errorf("invalid address in inactive address alert "+
+			"%q: %v", s, err)
+	}
+	p := strings.TrimSpace(parts[1])
+	var err error
+	if strings.HasSuffix(p, "blocks") {
+		r.blocks, err = strconv.ParseInt(strings.TrimSuffix(p, "blocks"), 10,
+			64)
+		if err != nil || r.blocks <= 0 {
+			return nil, fmt.Errorf("invalid number of blocks in inactive "+
+				"address alert %q", s)
+		}
+		return r, nil
+	}
+	r.period, err = time.ParseDuration(p)
+	if err != nil || r.period <= 0 {
+		return nil, fmt.Errorf("invalid period in inactive address alert %q",
+			s)
+	}
+	return r, nil
+}
+
+// String describes the rule's period.
+func (r *inactivityRule) String() string {
+	if r.blocks > 0 {
+		return fmt.Sprintf("%d blocks", r.blocks)
+	}
+	return r.period.String()
+}
+
+// inactivityAlerts checks the rules after each block.
+type inactivityAlerts struct {
+	rules []*inactivityRule
+	// startHeight and startTime are the start of monitoring, from which
+	// addresses without activity are measured.
+	startHeight int64
+	startTime   time.Time
+}
+
+// spyInactivity is the package-level inactive address alerts, nil if no
+// rules are configured.
+var spyInactivity *inactivityAlerts
+
+// newInactivityAlerts parses the rules.  Each address must be watched.
+func newInactivityAlerts(rules []string,
+	watched *watchedAddresses) (*inactivityAlerts, error) {
+	a := &inactivityAlerts{startTime: time.Now()}
+	for _, s := range rules {
+		r, err := parseInactivityRule(s)
+		if err != nil {
+			return nil, err
+		}
+		if !watched.isWatched(r.addr) {
+			return nil, fmt.Errorf("inactive address alert for %s, which "+
+				"is not a watched address", r.addr)
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a, nil
+}
+
+// lastActivity returns the height and time of the address's last activity,
+// or zeros if it has none.
+func lastActivity(addr string) (height, t int64) {
+	height, t = spyAddrStats.lastActivity(addr)
+	if spyAddrHistory != nil {
+		hh, ht := spyAddrHistory.lastActivity(addr)
+		if hh > height {
+			height, t = hh, ht
+		}
+	}
+	return
+}
+
+// blockNotified checks the rules at the height, after the notifications of
+// the block's transactions.
+func (a *inactivityAlerts) blockNotified(height int64) {
+	if a == nil {
+		return
+	}
+	if a.startHeight == 0 {
+		a.startHeight = height
+	}
+	now := time.Now()
+	for _, r := range a.rules {
+		key := "inactive:" + r.addr
+		lastHeight, lastTime := lastActivity(r.addr)
+		since := "the start of monitoring"
+		if lastHeight == 0 {
+			lastHeight, lastTime = a.startHeight, a.startTime.Unix()
+		} else {
+			since = fmt.Sprintf("block %d", lastHeight)
+		}
+		idle := now.Sub(time.Unix(lastTime, 0))
+		inactive := idle >= r.period
+		if r.blocks > 0 {
+			inactive = height-lastHeight >= r.blocks
+		}
+		if inactive {
+			fireAlert(key, "inactive address", "No activity of watched "+
+				"address %s for %s (%d blocks, %v since %s).", r.addr, r,
+				height-lastHeight, idle/time.Minute*time.Minute, since)
+		} else {
+			resolveAlert(key, "Watched address %s is active again at block "+
+				"%d.", r.addr, lastHeight)
+		}
+	}
+}
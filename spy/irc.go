@@ -0,0 +1,268 @@
+// irc.go is a small IRC client that joins a channel and announces the
+// operator's watched address transactions and a summary of each new block,
+// e.g. for a community node.  It reconnects when the connection is lost, and
+// paces its messages so that servers do not disconnect it for flooding.
+
+package spy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ircQueueSize is the number of messages waiting to be sent, beyond which
+	// new messages are dropped.
+	ircQueueSize = 200
+	// ircDialTimeout is the timeout of connecting to the server.
+	ircDialTimeout = 30 * time.Second
+	// ircReconnectDelay is the delay before reconnecting.
+	ircReconnectDelay = time.Minute
+	// ircMessageInterval is the minimum interval between messages.
+	ircMessageInterval = time.Second
+	// ircMaxLineLen is the maximum length of the text of a message line, which
+	// keeps the line with its prefix under the protocol's 512 bytes.
+	ircMaxLineLen = 400
+)
+
+// ircNotifier sends messages to an IRC channel.
+type ircNotifier struct {
+	server   string
+	useTLS   bool
+	password string
+	nick     string
+	channel  string
+	queue    chan *queuedText
+}
+
+// spyIRC is the package-level IRC notifier, nil if not configured.
+var spyIRC *ircNotifier
+
+// newIRCNotifier creates an ircNotifier joining the channel on the server
+// (host:port) with the nick, using TLS if useTLS is true.  password is the
+// server password, if any.
+func newIRCNotifier(server string, useTLS bool, password, nick,
+	channel string) *ircNotifier {
+	if !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel, "&") {
+		channel = "#" + channel
+	}
+	return &ircNotifier{
+		server:   server,
+		useTLS:   useTLS,
+		password: password,
+		nick:     nick,
+		channel:  channel,
+		queue:    make(chan *queuedText, ircQueueSize),
+	}
+}
+
+// notify queues the message of the event, if any.  It does not block.
+func (n *ircNotifier) notify(msg string, e *spyEvent) {
+	if n == nil {
+		return
+	}
+	select {
+	case n.queue <- &queuedText{msg, e}:
+	default:
+		log.Warnf("IRC queue full. Dropping %q.", msg)
+		e.delivered()
+	}
+}
+
+// Notify queues a message of the event, rendered with the irc template.
+// It does not block.
+func (n *ircNotifier) Notify(e *spyEvent) error {
+	if n == nil {
+		return nil
+	}
+	n.notify(spyNotifyTemplates.render(notifyChannelIRC, e), e)
+	return nil
+}
+
+// tracksDelivery implements deliveryNotifier.
+func (n *ircNotifier) tracksDelivery() {}
+
+// blockConnected queues a summary of the block.
+func (n *ircNotifier) blockConnected(data *blockData) {
+	if n == nil {
+		return
+	}
+	n.notify(fmt.Sprintf("Block %d (%s): %d votes, %d tickets, %d "+
+		"revocations. Ticket price %.4f DCR, pool size %d.",
+		data.header.Height, data.header.Hash, data.header.Voters,
+		data.header.FreshStake, data.header.Revocations,
+		data.currentstakediff.CurrentStakeDifficulty, data.poolinfo.PoolSize),
+		nil)
+}
+
+// run connects to the server and sends queued messages until quit is closed,
+// reconnecting after ircReconnectDelay when the connection fails.  It should
+// be run as a goroutine.
+func (n *ircNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		err := n.session(quit)
+		if err == nil {
+			log.Debugf("Quitting IRC notifier.")
+			return
+		}
+		log.Warnf("IRC connection to %s failed: %v. Reconnecting in %v.",
+			n.server, err, ircReconnectDelay)
+		select {
+		case <-time.After(ircReconnectDelay):
+		case <-quit:
+			log.Debugf("Quitting IRC notifier.")
+			return
+		}
+	}
+}
+
+// dial connects to the server.
+func (n *ircNotifier) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: ircDialTimeout}
+	if !n.useTLS {
+		return dialer.Dial("tcp", n.server)
+	}
+	host, _, err := net.SplitHostPort(n.server)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", n.server,
+		&tls.Config{ServerName: host})
+}
+
+// session registers with the server, joins the channel, and then sends queued
+// messages until quit is closed, returning nil, or the connection fails.
+func (n *ircNotifier) session(quit <-chan struct{}) error {
+	conn, err := n.dial()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+
+	// Lines are read until the connection is closed.
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+		err := scanner.Err()
+		if err == nil {
+			err = fmt.Errorf("connection closed by server")
+		}
+		readErr <- err
+	}()
+
+	write := func(format string, args ...interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(ircDialTimeout))
+		_, err := fmt.Fprintf(conn, format+"\r\n", args...)
+		return err
+	}
+	if n.password != "" {
+		if err = write("PASS %s", n.password); err != nil {
+			return err
+		}
+	}
+	nick := n.nick
+	if err = write("NICK %s", nick); err != nil {
+		return err
+	}
+	if err = write("USER %s 0 * :dcrspy", n.nick); err != nil {
+		return err
+	}
+
+	// Messages are only taken from the queue once the channel is joined.
+	var queue chan *queuedText
+	var lastSent time.Time
+	for {
+		select {
+		case line := <-lines:
+			prefix, command, params := parseIRCLine(line)
+			switch command {
+			case "PING":
+				err = write("PONG :%s", strings.Join(params, " "))
+			case "001":
+				// Registered
+				err = write("JOIN %s", n.channel)
+			case "433":
+				// Nick in use
+				nick += "_"
+				err = write("NICK %s", nick)
+			case "JOIN":
+				if strings.HasPrefix(prefix, nick+"!") {
+					log.Infof("Joined IRC channel %s on %s as %s.",
+						n.channel, n.server, nick)
+					queue = n.queue
+				}
+			case "KICK":
+				if len(params) > 1 && params[1] == nick {
+					log.Warnf("Kicked from IRC channel %s. Rejoining.",
+						n.channel)
+					queue = nil
+					err = write("JOIN %s", n.channel)
+				}
+			case "ERROR":
+				return fmt.Errorf("server error: %s", strings.Join(params, " "))
+			}
+		case msg := <-queue:
+			for _, text := range strings.Split(msg.text, "\n") {
+				if text = strings.TrimSpace(text); text == "" {
+					continue
+				}
+				if len(text) > ircMaxLineLen {
+					text = text[:ircMaxLineLen-3] + "..."
+				}
+				if wait := ircMessageInterval - time.Since(lastSent); wait > 0 {
+					time.Sleep(wait)
+				}
+				if err = write("PRIVMSG %s :%s", n.channel, text); err != nil {
+					break
+				}
+				lastSent = time.Now()
+			}
+			msg.event.delivered()
+		case err = <-readErr:
+			return err
+		case <-quit:
+			write("QUIT :dcrspy stopping")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseIRCLine splits a line of the IRC protocol into its prefix (without
+// the colon), command and parameters, the last of which may contain spaces.
+func parseIRCLine(line string) (prefix, command string, params []string) {
+	if strings.HasPrefix(line, ":") {
+		i := strings.Index(line, " ")
+		if i < 0 {
+			return line[1:], "", nil
+		}
+		prefix, line = line[1:i], line[i+1:]
+	}
+	if i := strings.Index(line, " :"); i >= 0 {
+		params = append(strings.Fields(line[:i]), line[i+2:])
+	} else {
+		params = strings.Fields(line)
+	}
+	if len(params) == 0 {
+		return prefix, "", nil
+	}
+	return prefix, params[0], params[1:]
+}
@@ -0,0 +1,177 @@
+package spy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIRCLine(t *testing.T) {
+	tests := []struct {
+		line            string
+		prefix, command string
+		params          []string
+	}{
+		{"PING :irc.example.net", "", "PING", []string{"irc.example.net"}},
+		{":irc.example.net 001 dcrspy :Welcome to the network",
+			"irc.example.net", "001", []string{"dcrspy",
+				"Welcome to the network"}},
+		{":irc.example.net 433 * dcrspy :Nickname is already in use",
+			"irc.example.net", "433", []string{"*", "dcrspy",
+				"Nickname is already in use"}},
+		{":dcrspy!~dcrspy@host JOIN #decred", "dcrspy!~dcrspy@host", "JOIN",
+			[]string{"#decred"}},
+		{":op!~op@host KICK #decred dcrspy :flooding", "op!~op@host", "KICK",
+			[]string{"#decred", "dcrspy", "flooding"}},
+		{"ERROR :Closing link: (dcrspy@host) [Ping timeout]", "", "ERROR",
+			[]string{"Closing link: (dcrspy@host) [Ping timeout]"}},
+		{"PRIVMSG #decred :", "", "PRIVMSG", []string{"#decred", ""}},
+		{"PRIVMSG #decred :a :b  c", "", "PRIVMSG",
+			[]string{"#decred", "a :b  c"}},
+		{"MODE  dcrspy   +i", "", "MODE", []string{"dcrspy", "+i"}},
+		{"QUIT", "", "QUIT", []string{}},
+		{":irc.example.net", "irc.example.net", "", nil},
+		{":irc.example.net ", "irc.example.net", "", nil},
+		{"", "", "", nil},
+	}
+	for _, tt := range tests {
+		prefix, command, params := parseIRCLine(tt.line)
+		if prefix != tt.prefix || command != tt.command ||
+			strings.Join(params, "|") != strings.Join(tt.params, "|") ||
+			len(params) != len(tt.params) {
+			t.Errorf("parseIRCLine(%q) = %q, %q, %q, want %q, %q, %q", tt.line,
+				prefix, command, params, tt.prefix, tt.command, tt.params)
+		}
+	}
+}
+
+func TestNewIRCNotifier(t *testing.T) {
+	tests := []struct {
+		channel, want string
+	}{
+		{"decred", "#decred"},
+		{"#decred", "#decred"},
+		{"&local", "&local"},
+		{"+modeless", "#+modeless"},
+	}
+	for _, tt := range tests {
+		n := newIRCNotifier("irc.example.net:6667", false, "", "dcrspy",
+			tt.channel)
+		if n.channel != tt.want {
+			t.Errorf("newIRCNotifier(channel %q) joins %q, want %q",
+				tt.channel, n.channel, tt.want)
+		}
+	}
+}
+
+func TestIRCSession(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	n := newIRCNotifier(ln.Addr().String(), false, "secret", "dcrspy",
+		"decred")
+	long := strings.Repeat("x", ircMaxLineLen+10)
+	n.queue <- &queuedText{text: "\n  \n" + long}
+
+	quit := make(chan struct{})
+	sessionErr := make(chan error, 1)
+	go func() { sessionErr <- n.session(quit) }()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// Each step sends the server's lines, if any, and expects the client's
+	// line in reply.
+	steps := []struct {
+		send, want string
+	}{
+		{"", "PASS secret"},
+		{"", "NICK dcrspy"},
+		{"", "USER dcrspy 0 * :dcrspy"},
+		{":irc.example.net 433 * dcrspy :Nickname is already in use",
+			"NICK dcrspy_"},
+		{"PING :irc.example.net", "PONG :irc.example.net"},
+		{":irc.example.net 001 dcrspy_ :Welcome", "JOIN #decred"},
+		{":other!~other@host JOIN #decred\r\n" +
+			":dcrspy_!~dcrspy@host JOIN #decred",
+			"PRIVMSG #decred :" + long[:ircMaxLineLen-3] + "..."},
+		{":op!~op@host KICK #decred dcrspy_ :bye", "JOIN #decred"},
+	}
+	for _, s := range steps {
+		if s.send != "" {
+			if _, err = conn.Write([]byte(s.send + "\r\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the reply to %q: %v", s.send, err)
+		}
+		if line != s.want+"\r\n" {
+			t.Fatalf("got %q in reply to %q, want %q", line, s.send, s.want)
+		}
+	}
+
+	close(quit)
+	if line, err := r.ReadString('\n'); err != nil ||
+		line != "QUIT :dcrspy stopping\r\n" {
+		t.Errorf("got %q (%v) on quitting, want QUIT", line, err)
+	}
+	if err = <-sessionErr; err != nil {
+		t.Errorf("session returned %v on quitting", err)
+	}
+}
+
+func TestIRCSessionError(t *testing.T) {
+	tests := []struct {
+		name, send, wantErr string
+	}{
+		{"error", "ERROR :Closing link: (dcrspy@host) [K-lined]",
+			"server error: Closing link: (dcrspy@host) [K-lined]"},
+		{"closed", "", "connection closed by server"},
+	}
+	for _, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := newIRCNotifier(ln.Addr().String(), false, "", "dcrspy", "decred")
+		sessionErr := make(chan error, 1)
+		go func() { sessionErr <- n.session(nil) }()
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The session fails after registering.
+		r := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			if _, err = r.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.send != "" {
+			conn.Write([]byte(tt.send + "\r\n"))
+		}
+		conn.Close()
+		select {
+		case err = <-sessionErr:
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: session returned %v, want %q", tt.name, err,
+					tt.wantErr)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: session did not return", tt.name)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// latency.go tracks the latency of the block processing pipeline, from the
+// block connected notification to the completion of each later stage (data
+// saved, watched address notifications delivered).  Recent samples are kept
+// for percentile computation, exposed via the metrics registry, and checked
+// against the configured service level objectives (SLOs).  The samples are
+// saved to a file, so the percentiles are kept across restarts.
+//
+// The notified stage of a block completes once every notification of its
+// watched address transactions has been sent by its notifiers (or has failed
+// or been dropped), which blockDeliveries counts.  A block without any
+// completes when it has been checked for watched addresses.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyStage identifies a stage of the block processing pipeline.
+type latencyStage int
+
+// The tracked pipeline stages.
+const (
+	stageSaved latencyStage = iota
+	stageNotified
+	numLatencyStages
+)
+
+var latencyStageNames = [numLatencyStages]string{"saved", "notified"}
+
+func (s latencyStage) String() string {
+	return latencyStageNames[s]
+}
+
+const (
+	// latencyWindowSize is the number of recent samples kept per stage for
+	// percentile computation.
+	latencyWindowSize = 1000
+	// maxPendingBlocks is the number of recent blocks for which the
+	// notification time is remembered.
+	maxPendingBlocks = 64
+	// latencySaveInterval is the interval between saves of the samples.
+	latencySaveInterval = 5 * time.Minute
+)
+
+// latencyTracker records pipeline stage latencies relative to the time a
+// block connected notification was received.
+type latencyTracker struct {
+	mtx        sync.Mutex
+	path       string
+	slo        [numLatencyStages]time.Duration
+	received   map[int64]time.Time
+	samples    [numLatencyStages][]float64
+	next       [numLatencyStages]int
+	count      [numLatencyStages]uint64
+	sum        [numLatencyStages]float64
+	violations [numLatencyStages]uint64
+}
+
+// pipelineLatency is the package-level pipeline latency tracker.
+var pipelineLatency = newLatencyTracker()
+
+func newLatencyTracker() *latencyTracker {
+	t := &latencyTracker{
+		received: make(map[int64]time.Time),
+	}
+	spyMetrics.register("dcrspy_pipeline_latency_seconds", t)
+	return t
+}
+
+// savedLatencyStage is the saved state of a stage, in the order of the
+// samples.
+type savedLatencyStage struct {
+	Samples    []float64 `json:"samples"`
+	Count      uint64    `json:"count"`
+	Sum        float64   `json:"sum"`
+	Violations uint64    `json:"violations"`
+}
+
+// load restores the samples saved in the file at path, if it exists, and
+// saves them there from now on.
+func (t *latencyTracker) load(path string) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.path = path
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var saved map[string]*savedLatencyStage
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	for s := latencyStage(0); s < numLatencyStages; s++ {
+		st := saved[s.String()]
+		if st == nil {
+			continue
+		}
+		samples := st.Samples
+		if len(samples) > latencyWindowSize {
+			samples = samples[len(samples)-latencyWindowSize:]
+		}
+		t.samples[s] = append([]float64(nil), samples...)
+		t.next[s] = 0
+		t.count[s], t.sum[s], t.violations[s] = st.Count, st.Sum, st.Violations
+	}
+	return nil
+}
+
+// save writes the samples to the file, if loaded from one.
+func (t *latencyTracker) save() error {
+	t.mtx.Lock()
+	if t.path == "" {
+		t.mtx.Unlock()
+		return nil
+	}
+	saved := make(map[string]*savedLatencyStage, numLatencyStages)
+	for s := latencyStage(0); s < numLatencyStages; s++ {
+		// Oldest first, so that the window continues after a restart.
+		n := len(t.samples[s])
+		samples := make([]float64, 0, n)
+		samples = append(samples, t.samples[s][t.next[s]:]...)
+		samples = append(samples, t.samples[s][:t.next[s]]...)
+		saved[s.String()] = &savedLatencyStage{samples, t.count[s], t.sum[s],
+			t.violations[s]}
+	}
+	path := t.path
+	t.mtx.Unlock()
+
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// run saves the samples at latencySaveInterval and when quit is closed.  It
+// should be run as a goroutine.
+func (t *latencyTracker) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	ticker := time.NewTicker(latencySaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.save(); err != nil {
+				log.Errorf("Failed to save pipeline latency: %v", err)
+			}
+		case <-quit:
+			if err := t.save(); err != nil {
+				log.Errorf("Failed to save pipeline latency: %v", err)
+			}
+			log.Debugf("Quitting pipeline latency saver.")
+			return
+		}
+	}
+}
+
+// setSLO sets the latency objective for a stage. A zero duration disables
+// checking for the stage.
+func (t *latencyTracker) setSLO(stage latencyStage, slo time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.slo[stage] = slo
+}
+
+// blockReceived records the time the block connected notification for the
+// block at the given height was received.
+func (t *latencyTracker) blockReceived(height int64, when time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.received[height] = when
+	for h := range t.received {
+		if h <= height-maxPendingBlocks {
+			delete(t.received, h)
+		}
+	}
+}
+
+// stageDone records completion of a pipeline stage for the block at the given
+// height.  An alert is sent if the SLO for the stage was exceeded.
+func (t *latencyTracker) stageDone(height int64, stage latencyStage) {
+	t.mtx.Lock()
+	start, ok := t.received[height]
+	if !ok {
+		t.mtx.Unlock()
+		return
+	}
+	latency := time.Since(start)
+	secs := latency.Seconds()
+
+	if len(t.samples[stage]) < latencyWindowSize {
+		t.samples[stage] = append(t.samples[stage], secs)
+	} else {
+		t.samples[stage][t.next[stage]] = secs
+		t.next[stage] = (t.next[stage] + 1) % latencyWindowSize
+	}
+	t.count[stage]++
+	t.sum[stage] += secs
+
+	slo := t.slo[stage]
+	exceeded := slo > 0 && latency > slo
+	if exceeded {
+		t.violations[stage]++
+	}
+	t.mtx.Unlock()
+
+	log.Debugf("Block %d pipeline stage %v completed in %v", height, stage,
+		latency)
+
+	alertKey := "latency:" + stage.String()
+	if exceeded {
+		fireAlert(alertKey, "pipeline latency SLO exceeded",
+			"Block %d: stage \"%v\" completed in %v, exceeding the SLO of %v.",
+			height, stage, latency, slo)
+	} else if slo > 0 {
+		resolveAlert(alertKey,
+			"Block %d: stage \"%v\" completed in %v, within the SLO of %v.",
+			height, stage, latency, slo)
+	}
+}
+
+// blockDeliveries counts the notification deliveries of a block in progress,
+// and completes the block's notified stage when none remain.
+type blockDeliveries struct {
+	height  int64
+	pending int32
+}
+
+// newBlockDeliveries creates the blockDeliveries of the block at height.  It
+// starts with one pending delivery, held by the block's handler until it has
+// submitted all the block's notifications, and released with done.
+func newBlockDeliveries(height int64) *blockDeliveries {
+	return &blockDeliveries{height: height, pending: 1}
+}
+
+// add counts a delivery in progress.
+func (d *blockDeliveries) add() {
+	atomic.AddInt32(&d.pending, 1)
+}
+
+// done counts the completion of a delivery.  The notified stage of the block
+// is done when no deliveries remain.
+func (d *blockDeliveries) done() {
+	if atomic.AddInt32(&d.pending, -1) == 0 {
+		pipelineLatency.stageDone(d.height, stageNotified)
+	}
+}
+
+// percentiles returns the requested percentiles of the recent samples for a
+// stage.
+func (t *latencyTracker) percentiles(stage latencyStage, ps ...float64) []float64 {
+	t.mtx.Lock()
+	sorted := make([]float64, len(t.samples[stage]))
+	copy(sorted, t.samples[stage])
+	t.mtx.Unlock()
+
+	sort.Float64s(sorted)
+	out := make([]float64, len(ps))
+	for i, p := range ps {
+		out[i] = percentile(sorted, p)
+	}
+	return out
+}
+
+// writeMetrics implements metricsWriter, writing a summary per stage.
+func (t *latencyTracker) writeMetrics(w io.Writer) {
+	const name = "dcrspy_pipeline_latency_seconds"
+	quantiles := []float64{0.5, 0.9, 0.99}
+
+	fmt.Fprintf(w, "# HELP %s Time from block notification to completion of "+
+		"each pipeline stage.\n# TYPE %s summary\n", name, name)
+	for s := latencyStage(0); s < numLatencyStages; s++ {
+		values := t.percentiles(s, quantiles...)
+		for i, q := range quantiles {
+			fmt.Fprintf(w, "%s{stage=\"%v\",quantile=\"%g\"} %g\n",
+				name, s, q, values[i])
+		}
+		t.mtx.Lock()
+		sum, count := t.sum[s], t.count[s]
+		t.mtx.Unlock()
+		fmt.Fprintf(w, "%s_sum{stage=\"%v\"} %g\n", name, s, sum)
+		fmt.Fprintf(w, "%s_count{stage=\"%v\"} %d\n", name, s, count)
+	}
+
+	const vname = "dcrspy_pipeline_slo_violations_total"
+	fmt.Fprintf(w, "# HELP %s Number of blocks exceeding the latency SLO.\n"+
+		"# TYPE %s counter\n", vname, vname)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for s := latencyStage(0); s < numLatencyStages; s++ {
+		fmt.Fprintf(w, "%s{stage=\"%v\"} %d\n", vname, s, t.violations[s])
+	}
+}
@@ -0,0 +1,89 @@
+package spy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlockDeliveries(t *testing.T) {
+	tr := newLatencyTracker()
+	saved := pipelineLatency
+	pipelineLatency = tr
+	defer func() { pipelineLatency = saved }()
+
+	tests := []struct {
+		name       string
+		deliveries int
+	}{
+		{"no transactions", 0},
+		{"one delivery", 1},
+		{"several deliveries", 3},
+	}
+	for i, tt := range tests {
+		height := int64(1000 + i)
+		tr.blockReceived(height, time.Now())
+		d := newBlockDeliveries(height)
+		for j := 0; j < tt.deliveries; j++ {
+			d.add()
+		}
+		// The handler releases its hold after submitting the notifications.
+		d.done()
+		for j := 0; j < tt.deliveries; j++ {
+			if got := tr.count[stageNotified]; got != uint64(i) {
+				t.Fatalf("%s: stage done with %d deliveries pending", tt.name,
+					tt.deliveries-j)
+			}
+			d.done()
+		}
+		if got := tr.count[stageNotified]; got != uint64(i+1) {
+			t.Errorf("%s: got %d samples, want %d", tt.name, got, i+1)
+		}
+	}
+}
+
+func TestLatencyTrackerSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pipeline-latency.json")
+	tr := newLatencyTracker()
+	if err := tr.load(path); err != nil {
+		t.Fatalf("loading a missing file: %v", err)
+	}
+	// Fill past the window, so that the samples wrap.
+	n := latencyWindowSize + 10
+	for i := 0; i < n; i++ {
+		tr.blockReceived(int64(i), time.Now().Add(-time.Duration(i)*time.Millisecond))
+		tr.stageDone(int64(i), stageSaved)
+	}
+	if err := tr.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newLatencyTracker()
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.count[stageSaved] != uint64(n) {
+		t.Errorf("got count %d, want %d", loaded.count[stageSaved], n)
+	}
+	if loaded.sum[stageSaved] != tr.sum[stageSaved] {
+		t.Errorf("got sum %g, want %g", loaded.sum[stageSaved], tr.sum[stageSaved])
+	}
+	want := tr.percentiles(stageSaved, 0.5, 0.99)
+	got := loaded.percentiles(stageSaved, 0.5, 0.99)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("percentile %d: got %g, want %g", i, got[i], want[i])
+		}
+	}
+	// The oldest loaded sample is replaced first.
+	oldest := loaded.samples[stageSaved][0]
+	loaded.blockReceived(int64(n), time.Now())
+	loaded.stageDone(int64(n), stageSaved)
+	if loaded.samples[stageSaved][0] == oldest {
+		t.Error("the oldest sample was not replaced")
+	}
+	if len(loaded.samples[stageSaved]) != latencyWindowSize {
+		t.Errorf("got %d samples, want %d", len(loaded.samples[stageSaved]),
+			latencyWindowSize)
+	}
+}
@@ -2,11 +2,10 @@
 // Use of this source code is governed by an ISC
 // license that can be found in the LICENSE file.
 
-package main
+package spy
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/btcsuite/btclog"
 	"github.com/btcsuite/seelog"
@@ -76,9 +75,17 @@ func useLogger(subsystemID string, logger btclog.Logger) {
 	}
 }
 
+// UseLogger sets the logger of every subsystem, for use when dcrspy is
+// embedded with Run rather than configured with LoadConfig.
+func UseLogger(logger btclog.Logger) {
+	for subsystemID := range subsystemLoggers {
+		useLogger(subsystemID, logger)
+	}
+}
+
 // initSeelogLogger initializes a new seelog logger that is used as the backend
 // for all logging subsytems.
-func initSeelogLogger(logFile string) {
+func initSeelogLogger(logFile string) error {
 	config := `
         <seelog type="adaptive" mininterval="2000000" maxinterval="100000000"
                 critmsgcount="500" minlevel="trace">
@@ -94,11 +101,11 @@ func initSeelogLogger(logFile string) {
 
 	logger, err := seelog.LoggerFromConfigAsString(config)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to create logger: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to create logger: %v", err)
 	}
 
 	backendLog = logger
+	return nil
 }
 
 // setLogLevel sets the logging level for provided subsystem.  Invalid
@@ -144,10 +151,3 @@ func pickNoun(n int, singular, plural string) string {
 	}
 	return plural
 }
-
-// fatalf logs a string, then cleanly exits.
-func fatalf(str string) {
-	log.Errorf("Unable to create profiler: %v", str)
-	backendLog.Flush()
-	os.Exit(1)
-}
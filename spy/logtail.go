@@ -0,0 +1,304 @@
+// logtail.go tails the log files of dcrd and dcrwallet, and raises alerts on
+// lines matching configured patterns, e.g. database corruption or a spike of
+// banned peers, with rules such as
+//
+//	logalert=corruption:(?i)corrupt
+//	logalert=bans:5/10m:Banned peer
+//
+// A rule fires when its pattern matches the given number of lines (1 by
+// default) within the period (10 minutes by default), and is resolved when it
+// matches fewer lines within the period.  Alerts are sent like other alerts,
+// and the matching lines are counted by the dcrspy_log_matches_total metric.
+//
+// The files are read from their end on startup, so that earlier lines do not
+// alert, and reopened from their start when rotated or truncated.
+
+package spy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// logTailInterval is the interval between reads of the log files.
+	logTailInterval = time.Second
+	// defaultLogAlertPeriod is the period of a rule without a threshold.
+	defaultLogAlertPeriod = 10 * time.Minute
+	// maxLogLine is the length beyond which a line is truncated.
+	maxLogLine = 4096
+)
+
+// logAlertRule alerts when its pattern matches count lines within period.
+type logAlertRule struct {
+	name    string
+	pattern *regexp.Regexp
+	count   int
+	period  time.Duration
+}
+
+// parseLogAlertRule parses NAME:REGEXP or NAME:COUNT/PERIOD:REGEXP.
+func parseLogAlertRule(s string) (*logAlertRule, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid log alert %q (expected NAME:REGEXP "+
+			"or NAME:COUNT/PERIOD:REGEXP)", s)
+	}
+	r := &logAlertRule{name: parts[0], count: 1,
+		period: defaultLogAlertPeriod}
+	expr := strings.Join(parts[1:], ":")
+	// The second part is a threshold if it parses as one, and otherwise
+	// part of the pattern.
+	if len(parts) == 3 {
+		if i := strings.Index(parts[1], "/"); i > 0 {
+			count, err1 := strconv.Atoi(parts[1][:i])
+			period, err2 := time.ParseDuration(parts[1][i+1:])
+			if err1 == nil && err2 == nil {
+				if count <= 0 || period <= 0 {
+					return nil, fmt.Errorf("invalid threshold in log alert "+
+						"%q", s)
+				}
+				r.count, r.period, expr = count, period, parts[2]
+			}
+		}
+	}
+	var err error
+	if r.pattern, err = regexp.Compile(expr); err != nil {
+		return nil, fmt.Errorf("invalid pattern in log alert %q: %v", s, err)
+	}
+	return r, nil
+}
+
+// logRuleState is the state of a rule on a log.
+type logRuleState struct {
+	*logAlertRule
+	// matches are the times of the matching lines within the period.
+	matches  []time.Time
+	lastLine string
+	total    uint64
+}
+
+// logTailer tails a log file.
+type logTailer struct {
+	// name is the name of the log (dcrd or dcrwallet), and path its file.
+	name  string
+	path  string
+	rules []*logRuleState
+
+	mtx sync.Mutex
+	// tried is whether the file was opened, or tried to be.
+	tried   bool
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	partial []byte
+}
+
+// logTailers are the tailers of the logs, for the metrics.
+var (
+	logTailersMtx sync.Mutex
+	logTailers    []*logTailer
+)
+
+// newLogTailer creates a tailer of the log file at path, named name, with the
+// rules.
+func newLogTailer(name, path string, rules []*logAlertRule) *logTailer {
+	t := &logTailer{name: name, path: path}
+	for _, r := range rules {
+		t.rules = append(t.rules, &logRuleState{logAlertRule: r})
+	}
+	logTailersMtx.Lock()
+	if len(logTailers) == 0 {
+		spyMetrics.register("dcrspy_log_matches_total", logMatchMetrics{})
+	}
+	logTailers = append(logTailers, t)
+	logTailersMtx.Unlock()
+	return t
+}
+
+// open opens the file, at its end if atEnd is true and otherwise at its
+// start.
+func (t *logTailer) open(atEnd bool) error {
+	fp, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	var offset int64
+	if atEnd {
+		if offset, err = fp.Seek(0, io.SeekEnd); err != nil {
+			fp.Close()
+			return err
+		}
+	}
+	t.file, t.info, t.offset = fp, fi, offset
+	t.reader = bufio.NewReader(fp)
+	t.partial = nil
+	return nil
+}
+
+// reopenIfRotated reopens the file from its start if it was replaced (e.g.
+// rotated) or truncated since it was opened.
+func (t *logTailer) reopenIfRotated() error {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		// Rotation may briefly leave no file, so the old one is read.
+		return nil
+	}
+	if os.SameFile(fi, t.info) && fi.Size() >= t.offset {
+		return nil
+	}
+	// Lines written to the old file after the last read are lost.
+	log.Debugf("Log file %s was rotated or truncated. Reopening it.", t.path)
+	t.file.Close()
+	t.file = nil
+	return t.open(false)
+}
+
+// run reads the new lines of the log every logTailInterval until quit is
+// closed.  It should be run as a goroutine.
+func (t *logTailer) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	log.Infof("Tailing %s log %s with %d alert rule(s).", t.name, t.path,
+		len(t.rules))
+
+	ticker := time.NewTicker(logTailInterval)
+	defer ticker.Stop()
+	var failing bool
+	for {
+		select {
+		case now := <-ticker.C:
+			err := t.read(now)
+			if err != nil && !failing {
+				log.Warnf("Unable to read %s log %s: %v", t.name, t.path,
+					reportError(errKindCollector, t.name+" log", err))
+			}
+			failing = err != nil
+			t.checkRules(now)
+		case <-quit:
+			log.Debugf("Quitting %s log tailing.", t.name)
+			t.mtx.Lock()
+			if t.file != nil {
+				t.file.Close()
+			}
+			t.mtx.Unlock()
+			return
+		}
+	}
+}
+
+// read reads the lines appended to the log since the last read.
+func (t *logTailer) read(now time.Time) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.file == nil {
+		// The first open is at the end.  A file that did not exist then is
+		// read from its start.
+		atEnd := !t.tried
+		t.tried = true
+		if err := t.open(atEnd); err != nil {
+			return err
+		}
+	} else if err := t.reopenIfRotated(); err != nil {
+		return err
+	}
+
+	for {
+		b, err := t.reader.ReadSlice('\n')
+		t.offset += int64(len(b))
+		if len(t.partial) < maxLogLine {
+			t.partial = append(t.partial, b...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			// An incomplete line is completed by the next read.
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line := strings.TrimRight(string(t.partial), "\r\n")
+		t.partial = t.partial[:0]
+		t.matchLocked(line, now)
+	}
+}
+
+// matchLocked records the line's matches of the rules.  The mutex must be
+// held.
+func (t *logTailer) matchLocked(line string, now time.Time) {
+	for _, r := range t.rules {
+		if !r.pattern.MatchString(line) {
+			continue
+		}
+		r.matches = append(r.matches, now)
+		r.lastLine = line
+		r.total++
+	}
+}
+
+// checkRules fires the rules with count matches within their period, and
+// resolves those with fewer.
+func (t *logTailer) checkRules(now time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, r := range t.rules {
+		first := 0
+		for first < len(r.matches) && now.Sub(r.matches[first]) > r.period {
+			first++
+		}
+		if first > 0 {
+			r.matches = append([]time.Time(nil), r.matches[first:]...)
+		}
+
+		key := "log:" + t.name + ":" + r.name
+		if len(r.matches) >= r.count {
+			fireAlert(key, t.name+" log "+r.name, "%d line(s) of the %s log "+
+				"matched %s within %v. Last: %s", len(r.matches), t.name,
+				r.name, r.period, r.lastLine)
+		} else {
+			resolveAlert(key, "Fewer than %d line(s) of the %s log matched "+
+				"%s within %v.", r.count, t.name, r.name, r.period)
+		}
+	}
+}
+
+// logMatchMetrics writes the counts of matching lines by log and rule.
+type logMatchMetrics struct{}
+
+func (logMatchMetrics) writeMetrics(w io.Writer) {
+	const name = "dcrspy_log_matches_total"
+	fmt.Fprintf(w, "# HELP %s Lines of the tailed logs matching the log "+
+		"alert rules.\n# TYPE %s counter\n", name, name)
+	logTailersMtx.Lock()
+	tailers := make([]*logTailer, len(logTailers))
+	copy(tailers, logTailers)
+	logTailersMtx.Unlock()
+	var lines []string
+	for _, t := range tailers {
+		t.mtx.Lock()
+		for _, r := range t.rules {
+			lines = append(lines, fmt.Sprintf("%s{log=%q,rule=%q} %d", name,
+				t.name, r.name, r.total))
+		}
+		t.mtx.Unlock()
+	}
+	sort.Strings(lines)
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
@@ -0,0 +1,134 @@
+// matrix.go posts the operator's watched address notifications, with the same
+// content as the email notifications, and chain events (new blocks, reorgs,
+// retargets and agenda status changes) to a Matrix room, as a user with an
+// access token on its homeserver.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// matrixSendPath is the path of the client API's endpoint sending a
+	// message event to a room, with %s for the escaped room ID.  The
+	// transaction ID is appended.
+	matrixSendPath = "/_matrix/client/r0/rooms/%s/send/m.room.message/"
+	// matrixQueueSize is the number of messages waiting to be sent, beyond
+	// which new messages are dropped.
+	matrixQueueSize = 200
+)
+
+// matrixMessage is the content of an m.room.message event.
+type matrixMessage struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+}
+
+// matrixNotifier sends messages to a Matrix room.
+type matrixNotifier struct {
+	url   string
+	token string
+	// txnPrefix and txnSeq make the transaction ID of each message, unique
+	// for the access token.
+	txnPrefix string
+	txnSeq    uint64
+	client    *http.Client
+	queue     chan *queuedText
+}
+
+// spyMatrix is the package-level Matrix notifier, nil if not configured.
+var spyMatrix *matrixNotifier
+
+// newMatrixNotifier creates a matrixNotifier sending to the room with the ID
+// (e.g. !abcdefg:matrix.org) through the homeserver (e.g.
+// https://matrix.org), as the user of the access token.
+func newMatrixNotifier(homeserver, token, roomID string) (*matrixNotifier,
+	error) {
+	u, err := url.Parse(homeserver)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") ||
+		u.Host == "" {
+		return nil, fmt.Errorf("invalid homeserver URL %q", homeserver)
+	}
+	if !strings.HasPrefix(roomID, "!") {
+		return nil, fmt.Errorf("invalid room ID %q (expected !id:server)",
+			roomID)
+	}
+	return &matrixNotifier{
+		url: strings.TrimSuffix(homeserver, "/") +
+			fmt.Sprintf(matrixSendPath, url.QueryEscape(roomID)),
+		token:     token,
+		txnPrefix: fmt.Sprintf("dcrspy%d.", time.Now().UnixNano()),
+		client:    newHTTPClient(),
+		queue:     make(chan *queuedText, matrixQueueSize),
+	}, nil
+}
+
+// Notify queues a message of the event, rendered with the matrix template.
+// It does not block, and fails if the queue is full.
+func (m *matrixNotifier) Notify(e *spyEvent) error {
+	if m == nil {
+		return nil
+	}
+	msg := spyNotifyTemplates.render(notifyChannelMatrix, e)
+	select {
+	case m.queue <- &queuedText{msg, e}:
+	default:
+		return fmt.Errorf("Matrix queue full, dropping %q", msg)
+	}
+	return nil
+}
+
+// tracksDelivery implements deliveryNotifier.
+func (m *matrixNotifier) tracksDelivery() {}
+
+// run sends queued messages until quit is closed.  It should be run as a
+// goroutine.
+func (m *matrixNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case msg := <-m.queue:
+			if err := m.send(msg.text); err != nil {
+				log.Warnf("Failed to send Matrix message: %v",
+					reportError(errKindNotifier, "matrix", err))
+			}
+			msg.event.delivered()
+		case <-quit:
+			log.Debugf("Quitting Matrix notifier.")
+			return
+		}
+	}
+}
+
+// send sends the message to the room as a notice, the message type of bots.
+func (m *matrixNotifier) send(msg string) error {
+	payload, err := json.Marshal(&matrixMessage{"m.notice", msg})
+	if err != nil {
+		return err
+	}
+	m.txnSeq++
+	txnID := fmt.Sprintf("%s%d", m.txnPrefix, m.txnSeq)
+	req, err := http.NewRequest("PUT", m.url+txnID, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
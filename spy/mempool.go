@@ -1,4 +1,4 @@
-package main
+package spy
 
 import (
 	"bytes"
@@ -35,15 +35,12 @@ type mempoolMonitor struct {
 	maxInterval    time.Duration
 	collector      *mempoolDataCollector
 	dataSavers     []MempoolDataSaver
-	quit           chan struct{}
-	wg             *sync.WaitGroup
 	mtx            sync.RWMutex
 }
 
 // newMempoolMonitor creates a new mempoolMonitor
 func newMempoolMonitor(collector *mempoolDataCollector,
-	savers []MempoolDataSaver,
-	quit chan struct{}, wg *sync.WaitGroup, newTicketLimit int32,
+	savers []MempoolDataSaver, newTicketLimit int32,
 	mini time.Duration, maxi time.Duration, mpi *mempoolInfo) *mempoolMonitor {
 	return &mempoolMonitor{
 		mpoolInfo:      *mpi,
@@ -52,19 +49,23 @@ func newMempoolMonitor(collector *mempoolDataCollector,
 		maxInterval:    maxi,
 		collector:      collector,
 		dataSavers:     savers,
-		quit:           quit,
-		wg:             wg,
 	}
 }
 
+// mempoolMonitorWatchdog tracks the progress of the mempool monitor.
+var mempoolMonitorWatchdog = newWatchdog(func() int {
+	return len(spyChans.newTxChan)
+})
+
 // txHandler receives signals from OnTxAccepted via the newTxChan, indicating
 // that a new transaction has entered mempool.
 // This function should be launched as a goroutine, and stopped by closing the
 // quit channel, the broadcasting mechanism used by main.
 // The newTxChan contains a chain hash for the transaction from the
 // notificiation, or a zero value hash indicating it was from a Ticker.
-func (p *mempoolMonitor) txHandler(client *dcrrpcclient.Client) {
-	defer p.wg.Done()
+func (p *mempoolMonitor) txHandler(client *dcrrpcclient.Client,
+	wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
 	for {
 		select {
 		case s, ok := <-spyChans.newTxChan:
@@ -72,6 +73,7 @@ func (p *mempoolMonitor) txHandler(client *dcrrpcclient.Client) {
 				mempoolLog.Infof("New Tx channel closed")
 				return
 			}
+			mempoolMonitorWatchdog.progressed()
 
 			var err error
 			// oneTicket is 0 for a Ticker event or 1 for a ticket purchase Tx.
@@ -180,23 +182,27 @@ func (p *mempoolMonitor) txHandler(client *dcrrpcclient.Client) {
 
 			newTickets := p.mpoolInfo.numTicketsSinceStatsReport
 
-			var data *mempoolData
-			if newBlock || quiteLong || (enoughNewTickets && longEnough) {
+			collect := newBlock || quiteLong || (enoughNewTickets && longEnough)
+			if collect {
 				// reset counter for tickets since last report
 				atomic.StoreInt32(&p.mpoolInfo.numTicketsSinceStatsReport, 0)
 				// and timer
 				p.mpoolInfo.lastCollectTime = time.Now()
-				p.mtx.Unlock()
-				// Collect mempool data (currently ticket fees)
-				mempoolLog.Trace("Gathering new mempool data.")
-				data, err = p.collector.collect()
-				if err != nil {
-					mempoolLog.Errorf("mempool data collection failed: %v", err.Error())
-					// data is nil when err != nil
-					continue
-				}
-			} else {
-				p.mtx.Unlock()
+			}
+			// Track the state across restarts
+			spyMempoolState.ticketsUpdated(&p.mpoolInfo, ticketHashes)
+			p.mtx.Unlock()
+			if !collect {
+				continue
+			}
+
+			// Collect mempool data (currently ticket fees)
+			mempoolLog.Trace("Gathering new mempool data.")
+			data, err := p.collector.collect()
+			if err != nil {
+				mempoolLog.Errorf("mempool data collection failed: %v",
+					reportError(errKindCollector, "mempool", err))
+				// data is nil when err != nil
 				continue
 			}
 
@@ -213,7 +219,7 @@ func (p *mempoolMonitor) txHandler(client *dcrrpcclient.Client) {
 				}
 			}
 
-		case <-p.quit:
+		case <-quit:
 			mempoolLog.Debugf("Quitting OnTxAccepted (new tx in mempool) handler.")
 			return
 		}
@@ -242,7 +248,8 @@ func (p *mempoolMonitor) maybeCollect(txHeight uint32) (*mempoolData, error) {
 		mempoolLog.Infof("Gathering new mempool data.")
 		data, err = p.collector.collect()
 		if err != nil {
-			mempoolLog.Errorf("mempool data collection failed: %v", err.Error())
+			mempoolLog.Errorf("mempool data collection failed: %v",
+				reportError(errKindCollector, "mempool", err))
 			// data is nil when err != nil
 		}
 	} else {
@@ -282,12 +289,12 @@ type mempoolData struct {
 
 type mempoolDataCollector struct {
 	mtx          sync.Mutex
-	cfg          *config
+	cfg          *Config
 	dcrdChainSvr *dcrrpcclient.Client
 }
 
 // newMempoolDataCollector creates a new mempoolDataCollector.
-func newMempoolDataCollector(cfg *config,
+func newMempoolDataCollector(cfg *Config,
 	dcrdChainSvr *dcrrpcclient.Client) (*mempoolDataCollector, error) {
 	return &mempoolDataCollector{
 		mtx:          sync.Mutex{},
@@ -618,6 +625,8 @@ func (s *MempoolDataToJSONFiles) Store(data *mempoolData) error {
 	_, err = writeFormattedJSONMempoolData(jsonConcat, &s.file)
 	if err != nil {
 		mempoolLog.Error("Write JSON mempool data to file: ", *fp)
+	} else {
+		signStoredFile(fullfile)
 	}
 
 	return err
@@ -662,6 +671,8 @@ func (s *MempoolFeeDumper) Store(data *mempoolData) error {
 	_, err = fmt.Fprintln(&s.file, string(j))
 	if err != nil {
 		mempoolLog.Error("Write mempool ticket fees data to file: ", *fp)
+	} else {
+		signStoredFile(fullfile)
 	}
 	mempoolLog.Debugf("All fees written to %s.", fname)
 
@@ -0,0 +1,65 @@
+// mempoolinfo.go implements the mempoolinfo collector plugin, which collects
+// the number, total size and total fees of the transactions in dcrd's mempool,
+// by type, with getrawmempool.
+
+package spy
+
+import (
+	"github.com/decred/dcrd/dcrjson"
+	"github.com/decred/dcrrpcclient"
+)
+
+func init() {
+	registerCollector("mempoolinfo", func(dcrd *dcrrpcclient.Client) Collector {
+		return &mempoolInfoCollector{dcrd}
+	})
+}
+
+// mempoolTxTypeInfo is the number, size in bytes and fees in DCR of the
+// transactions of a type in mempool.
+type mempoolTxTypeInfo struct {
+	Count int     `json:"count"`
+	Bytes int64   `json:"bytes"`
+	Fees  float64 `json:"fees"`
+}
+
+// mempoolInfoSection is the section of the mempoolinfo collector.
+type mempoolInfoSection struct {
+	Count  int                           `json:"count"`
+	Bytes  int64                         `json:"bytes"`
+	Fees   float64                       `json:"fees"`
+	ByType map[string]*mempoolTxTypeInfo `json:"bytype"`
+}
+
+// mempoolInfoCollector collects the mempool information.
+type mempoolInfoCollector struct {
+	dcrd *dcrrpcclient.Client
+}
+
+// Name returns the name of the section.
+func (c *mempoolInfoCollector) Name() string {
+	return "mempoolinfo"
+}
+
+// Collect returns the mempool information at the time of the call.
+func (c *mempoolInfoCollector) Collect(height uint32) (interface{}, error) {
+	info := &mempoolInfoSection{ByType: make(map[string]*mempoolTxTypeInfo)}
+	for _, txType := range []dcrjson.GetRawMempoolTxTypeCmd{
+		dcrjson.GRMRegular, dcrjson.GRMTickets, dcrjson.GRMVotes,
+		dcrjson.GRMRevocations} {
+		txs, err := c.dcrd.GetRawMempoolVerbose(txType)
+		if err != nil {
+			return nil, err
+		}
+		t := &mempoolTxTypeInfo{Count: len(txs)}
+		for _, tx := range txs {
+			t.Bytes += int64(tx.Size)
+			t.Fees += tx.Fee
+		}
+		info.ByType[string(txType)] = t
+		info.Count += t.Count
+		info.Bytes += t.Bytes
+		info.Fees += t.Fees
+	}
+	return info, nil
+}
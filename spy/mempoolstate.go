@@ -0,0 +1,275 @@
+// mempoolstate.go tracks the mempool state that would otherwise be lost when
+// dcrspy restarts: the transactions to watched addresses seen in mempool and
+// awaiting confirmation, and the tickets in mempool with the counters of the
+// mempool monitor.  The state is saved to mempool-state.json in the output
+// folder periodically and when quitting, and restored on startup.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+)
+
+const (
+	// mempoolStateSaveInterval is the interval between saves of the state.
+	mempoolStateSaveInterval = time.Minute
+	// pendingTxExpiry is the time after which a watched transaction that has
+	// not been mined is forgotten, e.g. if it was dropped from mempool or
+	// double spent.
+	pendingTxExpiry = 72 * time.Hour
+)
+
+// pendingTx is an output to a watched address of a transaction seen in mempool
+// and not yet mined.
+type pendingTx struct {
+	TxID    string  `json:"txid"`
+	Vout    int     `json:"vout"`
+	Address string  `json:"address"`
+	Amount  float64 `json:"amount"`
+	// Seen is the time the transaction was seen in mempool, and Height the
+	// best block height at the time.
+	Seen   int64 `json:"seen"`
+	Height int64 `json:"height"`
+}
+
+// mempoolTickets is the mempool monitor's state of the tickets in mempool.
+type mempoolTickets struct {
+	Height      uint32   `json:"height"`
+	Tickets     []string `json:"tickets"`
+	SinceReport int32    `json:"sincereport"`
+	LastCollect int64    `json:"lastcollect"`
+}
+
+// mempoolStateFile is the saved state.
+type mempoolStateFile struct {
+	Pending []*pendingTx    `json:"pending"`
+	Tickets *mempoolTickets `json:"tickets,omitempty"`
+}
+
+// mempoolState is the tracked mempool state.
+type mempoolState struct {
+	mtx  sync.Mutex
+	path string
+	// pending is keyed by pendingKey.
+	pending map[string]*pendingTx
+	tickets *mempoolTickets
+	dirty   bool
+}
+
+// spyMempoolState is the package-level mempool state, nil if neither watching
+// addresses nor monitoring mempool.
+var spyMempoolState *mempoolState
+
+// pendingKey is the key of a transaction output in the pending map.
+func pendingKey(txid string, vout int) string {
+	return fmt.Sprintf("%s:%d", txid, vout)
+}
+
+// newMempoolState creates a mempoolState, restoring the state saved at path.
+// Pending transactions older than pendingTxExpiry are dropped.
+func newMempoolState(path string) (*mempoolState, error) {
+	s := &mempoolState{
+		path:    path,
+		pending: make(map[string]*pendingTx),
+	}
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		var saved mempoolStateFile
+		if err = json.Unmarshal(b, &saved); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+		}
+		for _, p := range saved.Pending {
+			s.pending[pendingKey(p.TxID, p.Vout)] = p
+		}
+		s.tickets = saved.Tickets
+		s.expireLocked()
+		if len(s.pending) > 0 {
+			log.Infof("Restored %d watched transaction output(s) awaiting "+
+				"confirmation.", len(s.pending))
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	spyMetrics.newGauge("dcrspy_pending_watched_txs",
+		"Outputs to watched addresses in mempool awaiting confirmation.",
+		func() float64 {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			return float64(len(s.pending))
+		})
+	return s, nil
+}
+
+// addPending records the output to the watched address of a transaction seen
+// in mempool at the best block height, returning false if it was already
+// pending.
+func (s *mempoolState) addPending(txid string, vout int, addr string,
+	amount float64, height int64) bool {
+	if s == nil {
+		return true
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := pendingKey(txid, vout)
+	if _, ok := s.pending[key]; ok {
+		return false
+	}
+	s.pending[key] = &pendingTx{
+		TxID:    txid,
+		Vout:    vout,
+		Address: addr,
+		Amount:  amount,
+		Seen:    time.Now().Unix(),
+		Height:  height,
+	}
+	s.dirty = true
+	return true
+}
+
+// mined removes the output of a mined transaction from the pending outputs,
+// returning it, or nil if it was not pending.
+func (s *mempoolState) mined(txid string, vout int) *pendingTx {
+	if s == nil {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := pendingKey(txid, vout)
+	p, ok := s.pending[key]
+	if !ok {
+		return nil
+	}
+	delete(s.pending, key)
+	s.dirty = true
+	return p
+}
+
+// ticketsUpdated records the mempool monitor's state and the tickets in
+// mempool.
+func (s *mempoolState) ticketsUpdated(info *mempoolInfo,
+	tickets []*chainhash.Hash) {
+	if s == nil {
+		return
+	}
+	t := &mempoolTickets{
+		Height:      info.currentHeight,
+		Tickets:     make([]string, 0, len(tickets)),
+		SinceReport: info.numTicketsSinceStatsReport,
+		LastCollect: info.lastCollectTime.Unix(),
+	}
+	for _, h := range tickets {
+		t.Tickets = append(t.Tickets, h.String())
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.tickets = t
+	s.dirty = true
+}
+
+// restoreTickets restores the mempool monitor's counters saved before the
+// restart.  The tickets in mempool now that were not saved entered mempool
+// while dcrspy was stopped, and are counted as new.
+func (s *mempoolState) restoreTickets(info *mempoolInfo,
+	tickets []*chainhash.Hash) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.tickets == nil {
+		return
+	}
+	saved := make(map[string]struct{}, len(s.tickets.Tickets))
+	for _, t := range s.tickets.Tickets {
+		saved[t] = struct{}{}
+	}
+	var missed int32
+	for _, h := range tickets {
+		if _, ok := saved[h.String()]; !ok {
+			missed++
+		}
+	}
+	info.numTicketsSinceStatsReport = s.tickets.SinceReport + missed
+	info.lastCollectTime = time.Unix(s.tickets.LastCollect, 0)
+	log.Infof("Restored mempool monitor state: %d new ticket(s) since the "+
+		"last report, %d of which entered mempool while stopped.",
+		info.numTicketsSinceStatsReport, missed)
+}
+
+// expireLocked drops pending outputs older than pendingTxExpiry.  The mutex
+// must be held.
+func (s *mempoolState) expireLocked() {
+	cutoff := time.Now().Add(-pendingTxExpiry).Unix()
+	for key, p := range s.pending {
+		if p.Seen < cutoff {
+			log.Warnf("Transaction %s to watched address %s was not mined "+
+				"within %v of entering mempool. No longer tracking it.",
+				p.TxID, p.Address, pendingTxExpiry)
+			delete(s.pending, key)
+			s.dirty = true
+		}
+	}
+}
+
+// save writes the state to the file, if it changed since the last save.
+func (s *mempoolState) save() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.expireLocked()
+	if !s.dirty {
+		return nil
+	}
+
+	saved := mempoolStateFile{
+		Pending: make([]*pendingTx, 0, len(s.pending)),
+		Tickets: s.tickets,
+	}
+	for _, p := range s.pending {
+		saved.Pending = append(saved.Pending, p)
+	}
+	b, err := json.MarshalIndent(&saved, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// run saves the state at mempoolStateSaveInterval and when quit is closed.
+// It should be run as a goroutine.
+func (s *mempoolState) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(mempoolStateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				log.Errorf("Failed to save mempool state: %v", err)
+			}
+		case <-quit:
+			if err := s.save(); err != nil {
+				log.Errorf("Failed to save mempool state: %v", err)
+			}
+			log.Debugf("Quitting mempool state tracker.")
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// metrics.go defines a minimal metrics registry that renders counters, gauges
+// and summaries in the Prometheus text exposition format.  Components register
+// their metrics with spyMetrics, which is served at /metrics by the API
+// server.
+
+package spy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metricsWriter is implemented by anything that can write its metrics in the
+// text exposition format.
+type metricsWriter interface {
+	writeMetrics(w io.Writer)
+}
+
+// metricsRegistry holds all the registered metrics by name.
+type metricsRegistry struct {
+	mtx     sync.RWMutex
+	metrics map[string]metricsWriter
+}
+
+// spyMetrics is the package-level metrics registry.
+var spyMetrics = &metricsRegistry{
+	metrics: make(map[string]metricsWriter),
+}
+
+// register adds a metricsWriter with the given name.  Registering a name a
+// second time replaces the previous entry.
+func (r *metricsRegistry) register(name string, m metricsWriter) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.metrics[name] = m
+}
+
+// newCounter creates and registers a new counter.
+func (r *metricsRegistry) newCounter(name, help string) *metricCounter {
+	c := &metricCounter{name: name, help: help}
+	r.register(name, c)
+	return c
+}
+
+// newGauge creates and registers a new gauge, the value of which is obtained
+// from the provided function each time the metrics are written.
+func (r *metricsRegistry) newGauge(name, help string, value func() float64) {
+	r.register(name, &metricGauge{name: name, help: help, value: value})
+}
+
+// metricsAPI documents the metrics endpoint.
+var metricsAPI = []apiOperation{{
+	method:      "GET",
+	summary:     "Metrics in the Prometheus text format",
+	contentType: "text/plain; version=0.0.4",
+	public:      true,
+}}
+
+// ServeHTTP implements http.Handler, writing all registered metrics sorted by
+// name.
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mtx.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metricsWriter, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mtx.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.writeMetrics(w)
+	}
+}
+
+// metricCounter is a monotonically increasing counter.
+type metricCounter struct {
+	name, help string
+	value      uint64
+}
+
+// inc increments the counter by one.
+func (c *metricCounter) inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// add increments the counter by n.
+func (c *metricCounter) add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// get returns the current value of the counter.
+func (c *metricCounter) get() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *metricCounter) writeMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+		c.name, c.help, c.name, c.name, c.get())
+}
+
+// metricGauge is a gauge with a value computed on demand.
+type metricGauge struct {
+	name, help string
+	value      func() float64
+}
+
+func (g *metricGauge) writeMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n",
+		g.name, g.help, g.name, g.name, g.value())
+}
+
+// percentile returns the p-th percentile (0 <= p <= 1) of the sorted slice s
+// using the nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	N := len(sorted)
+	if N == 0 {
+		return 0
+	}
+	idx := int(p*float64(N)+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= N {
+		idx = N - 1
+	}
+	return sorted[idx]
+}
@@ -0,0 +1,409 @@
+// mqtt.go publishes block data, stake info and the operator's watched address
+// events to an MQTT broker, for home automation and IoT dashboards.  Each is
+// published as JSON to its configured topic, and watched address events to a
+// subtopic per address (e.g. dcrspy/watchedaddr/Dsabc...), so that a
+// subscriber may select addresses with wildcards.  The publisher implements the
+// parts of MQTT 3.1.1 it needs: it connects with a clean session, publishes at
+// QoS 0 or 1, pings the broker to keep the connection alive, and reconnects
+// with backoff when the connection fails.
+
+package spy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// mqttQueueSize is the number of messages waiting to be published,
+	// beyond which new messages are dropped.
+	mqttQueueSize = 200
+	// mqttKeepAlive is the keep alive interval of the connection.  The
+	// broker is pinged at half the interval when idle.
+	mqttKeepAlive = 60 * time.Second
+	// mqttTimeout is the timeout of connecting, and of each exchange with the
+	// broker.
+	mqttTimeout = 10 * time.Second
+	// mqttMaxBackoff is the maximum delay between reconnection attempts.
+	mqttMaxBackoff = time.Minute
+)
+
+// MQTT control packet types
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttMessage is a message to publish.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// mqttPublisher publishes messages to an MQTT broker.
+type mqttPublisher struct {
+	addr     string
+	useTLS   bool
+	host     string
+	clientID string
+	user     string
+	pass     string
+	qos      byte
+	retain   bool
+
+	blockTopic, stakeInfoTopic, addrTopic string
+	// addrFilter is the filter expression of published events, or nil.
+	addrFilter *expression
+
+	queue    chan *mqttMessage
+	packetID uint16
+}
+
+// spyMQTT is the package-level MQTT publisher, nil if disabled.
+var spyMQTT *mqttPublisher
+
+// newMQTTPublisher creates an mqttPublisher of the broker, a URL with the
+// scheme tcp or tls (e.g. tls://broker.local:8883).  Messages are published
+// to the topics (empty to not publish), at the QoS, with block data and stake
+// info retained if retain is true.  Only the events matching the filter
+// expression, if not empty, are published.
+func newMQTTPublisher(broker, clientID, user, pass string, qos int,
+	retain bool, blockTopic, stakeInfoTopic, addrTopic,
+	addrFilter string) (*mqttPublisher, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mqttbroker %q: %v", broker, err)
+	}
+	p := &mqttPublisher{
+		addr:           u.Host,
+		clientID:       clientID,
+		user:           user,
+		pass:           pass,
+		retain:         retain,
+		blockTopic:     blockTopic,
+		stakeInfoTopic: stakeInfoTopic,
+		addrTopic:      addrTopic,
+		queue:          make(chan *mqttMessage, mqttQueueSize),
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "tls", "ssl", "mqtts":
+		p.useTLS = true
+		port = "8883"
+	default:
+		return nil, fmt.Errorf("invalid mqttbroker %q: the scheme must be "+
+			"tcp or tls", broker)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid mqttbroker %q: no host", broker)
+	}
+	p.host = u.Host
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		p.host = h
+	} else {
+		p.addr = net.JoinHostPort(u.Host, port)
+	}
+	if qos != 0 && qos != 1 {
+		return nil, fmt.Errorf("invalid mqttqos %d (expected 0 or 1)", qos)
+	}
+	p.qos = byte(qos)
+	if clientID == "" || len(clientID) > 23 {
+		return nil, fmt.Errorf("invalid mqttclientid %q (expected 1 to 23 "+
+			"characters)", clientID)
+	}
+	if pass != "" && user == "" {
+		return nil, errors.New("mqttpass requires mqttuser")
+	}
+	if addrFilter != "" {
+		if p.addrFilter, err = parseExpression(addrFilter); err != nil {
+			return nil, fmt.Errorf("invalid mqttfilter: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// publish queues the message.  It does not block.
+func (p *mqttPublisher) publish(topic string, payload []byte, retain bool) {
+	select {
+	case p.queue <- &mqttMessage{topic, payload, retain}:
+	default:
+		log.Warnf("MQTT queue full. Dropping message to %s.", topic)
+	}
+}
+
+// publishEvent publishes the operator's watched address event to the address
+// topic, if it matches the filter.  Other events are ignored.
+func (p *mqttPublisher) publishEvent(e *spyEvent) {
+	if p == nil || p.addrTopic == "" || e.Type != eventTypeWatchedAddr ||
+		e.Tenant != operatorOwner || !e.matchesFilter(p.addrFilter) {
+		return
+	}
+	payload, err := spyNotifyTemplates.payload(notifyChannelMQTT, e)
+	if err != nil {
+		log.Errorf("Failed to encode event %d: %v", e.Seq, err)
+		return
+	}
+	p.publish(p.addrTopic+"/"+e.Address, payload, false)
+}
+
+// run publishes the queued messages until quit is closed, reconnecting as
+// needed.  It should be run as a goroutine.
+func (p *mqttPublisher) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	var pending *mqttMessage
+	backoff := time.Second
+	for {
+		err := p.session(&pending, quit)
+		if err == nil {
+			log.Debugf("Quitting MQTT publisher.")
+			return
+		}
+		log.Warnf("MQTT connection to %s failed: %v. Reconnecting in %v.",
+			p.addr, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-quit:
+			log.Debugf("Quitting MQTT publisher.")
+			return
+		}
+		if backoff *= 2; backoff > mqttMaxBackoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+// dial connects to the broker.
+func (p *mqttPublisher) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	if p.useTLS {
+		return tls.DialWithDialer(dialer, "tcp", p.addr,
+			&tls.Config{ServerName: p.host})
+	}
+	return dialer.Dial("tcp", p.addr)
+}
+
+// session connects to the broker and publishes messages, starting with
+// *pending if not nil, until quit is closed or the connection fails.  A
+// message that could not be published is left in *pending.  It returns nil
+// when quitting.
+func (p *mqttPublisher) session(pending **mqttMessage,
+	quit <-chan struct{}) error {
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+	if _, err = conn.Write(p.connectPacket()); err != nil {
+		return err
+	}
+	typ, body, err := mqttReadPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ != mqttConnAck || len(body) != 2 {
+		return fmt.Errorf("unexpected packet %d awaiting CONNACK", typ)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("connection refused (return code %d)", body[1])
+	}
+	log.Infof("Connected to MQTT broker %s", p.addr)
+
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		msg := *pending
+		if msg == nil {
+			select {
+			case msg = <-p.queue:
+			case <-ping.C:
+				conn.SetDeadline(time.Now().Add(mqttTimeout))
+				if _, err = conn.Write([]byte{mqttPingReq << 4, 0}); err != nil {
+					return err
+				}
+				if err = mqttExpect(r, mqttPingResp, nil); err != nil {
+					return err
+				}
+				continue
+			case <-quit:
+				conn.SetDeadline(time.Now().Add(mqttTimeout))
+				conn.Write([]byte{mqttDisconnect << 4, 0})
+				return nil
+			}
+		}
+
+		*pending = msg
+		conn.SetDeadline(time.Now().Add(mqttTimeout))
+		if err = p.publishPacket(conn, r, msg); err != nil {
+			return err
+		}
+		*pending = nil
+	}
+}
+
+// publishPacket sends the PUBLISH packet of the message, and awaits its
+// PUBACK at QoS 1.
+func (p *mqttPublisher) publishPacket(w io.Writer, r *bufio.Reader,
+	msg *mqttMessage) error {
+	flags := p.qos << 1
+	if msg.retain {
+		flags |= 1
+	}
+	body := mqttString(msg.topic)
+	var id []byte
+	if p.qos > 0 {
+		p.packetID++
+		if p.packetID == 0 {
+			p.packetID = 1
+		}
+		id = []byte{byte(p.packetID >> 8), byte(p.packetID)}
+		body = append(body, id...)
+	}
+	body = append(body, msg.payload...)
+	if _, err := w.Write(mqttPacket(mqttPublish<<4|flags, body)); err != nil {
+		return err
+	}
+	if p.qos == 0 {
+		return nil
+	}
+	return mqttExpect(r, mqttPubAck, id)
+}
+
+// connectPacket returns the CONNECT packet of the publisher.
+func (p *mqttPublisher) connectPacket() []byte {
+	body := mqttString("MQTT")
+	// Protocol level 4 (3.1.1), and the clean session flag.
+	body = append(body, 4)
+	var flags byte = 0x02
+	if p.user != "" {
+		flags |= 0x80
+	}
+	if p.pass != "" {
+		flags |= 0x40
+	}
+	keepAlive := uint16(mqttKeepAlive / time.Second)
+	body = append(body, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = append(body, mqttString(p.clientID)...)
+	if p.user != "" {
+		body = append(body, mqttString(p.user)...)
+	}
+	if p.pass != "" {
+		body = append(body, mqttString(p.pass)...)
+	}
+	return mqttPacket(mqttConnect<<4, body)
+}
+
+// mqttString encodes s as a length-prefixed UTF-8 string.
+func mqttString(s string) []byte {
+	b := []byte{byte(len(s) >> 8), byte(len(s))}
+	return append(b, s...)
+}
+
+// mqttPacket returns the packet with the first byte of the fixed header and
+// the body.
+func mqttPacket(header byte, body []byte) []byte {
+	b := []byte{header}
+	n := len(body)
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+// mqttReadPacket reads a packet, returning its type and body.
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n, shift uint
+	for i := 0; ; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= uint(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		shift += 7
+	}
+	body := make([]byte, n)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+// mqttExpect reads a packet, which must be of the type, with the body if not
+// nil.
+func mqttExpect(r *bufio.Reader, typ byte, body []byte) error {
+	t, b, err := mqttReadPacket(r)
+	if err != nil {
+		return err
+	}
+	if t != typ || (body != nil && string(b) != string(body)) {
+		return fmt.Errorf("unexpected packet %d awaiting packet %d", t, typ)
+	}
+	return nil
+}
+
+// BlockDataToMQTT implements BlockDataSaver interface for publishing block
+// data to an MQTT topic.
+type BlockDataToMQTT struct {
+	p *mqttPublisher
+}
+
+// Store publishes the block data.
+func (s *BlockDataToMQTT) Store(data *blockData) error {
+	payload, err := JSONFormatBlockData(data)
+	if err != nil {
+		return err
+	}
+	s.p.publish(s.p.blockTopic, payload.Bytes(), s.p.retain)
+	return nil
+}
+
+// StakeInfoDataToMQTT implements StakeInfoDataSaver interface for publishing
+// stake info to an MQTT topic.
+type StakeInfoDataToMQTT struct {
+	p *mqttPublisher
+}
+
+// Store publishes the stake info.
+func (s *StakeInfoDataToMQTT) Store(data *stakeInfoData) error {
+	payload, err := JSONFormatStakeInfoData(data)
+	if err != nil {
+		return err
+	}
+	s.p.publish(s.p.stakeInfoTopic, payload.Bytes(), s.p.retain)
+	return nil
+}
@@ -0,0 +1,219 @@
+package spy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestMQTTPacket(t *testing.T) {
+	// The examples of the remaining length encoding in section 2.2.3 of the
+	// MQTT 3.1.1 specification
+	tests := []struct {
+		n      int
+		length string
+	}{
+		{0, "00"},
+		{127, "7f"},
+		{128, "8001"},
+		{16383, "ff7f"},
+		{16384, "808001"},
+		{2097151, "ffff7f"},
+		{2097152, "80808001"},
+	}
+	for _, tt := range tests {
+		body := bytes.Repeat([]byte{0xab}, tt.n)
+		p := mqttPacket(mqttPublish<<4, body)
+		want, _ := hex.DecodeString("30" + tt.length)
+		if !bytes.HasPrefix(p, want) || len(p) != len(want)+tt.n {
+			t.Errorf("length %d: got header %x, want %x", tt.n,
+				p[:len(want)], want)
+			continue
+		}
+		typ, got, err := mqttReadPacket(bufio.NewReader(bytes.NewReader(p)))
+		if err != nil {
+			t.Errorf("length %d: %v", tt.n, err)
+			continue
+		}
+		if typ != mqttPublish || !bytes.Equal(got, body) {
+			t.Errorf("length %d: read packet %d with %d bytes", tt.n, typ,
+				len(got))
+		}
+	}
+}
+
+func TestMQTTReadPacketErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+	}{
+		{"empty", ""},
+		{"no length", "20"},
+		{"length too long", "30ffffffff01"},
+		{"short body", "200200"},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.packet)
+		_, _, err := mqttReadPacket(bufio.NewReader(bytes.NewReader(b)))
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestMQTTConnectPacket(t *testing.T) {
+	tests := []struct {
+		user, pass string
+		want       string
+	}{
+		// Protocol name MQTT, level 4, clean session, keep alive 60 s and
+		// the client ID
+		{"", "", "1012" + "00044d515454" + "04" + "02" + "003c" +
+			"0006" + hex.EncodeToString([]byte("dcrspy"))},
+		{"u", "", "1015" + "00044d515454" + "04" + "82" + "003c" +
+			"0006" + hex.EncodeToString([]byte("dcrspy")) + "000175"},
+		{"u", "pw", "1019" + "00044d515454" + "04" + "c2" + "003c" +
+			"0006" + hex.EncodeToString([]byte("dcrspy")) + "000175" +
+			"00027077"},
+	}
+	for _, tt := range tests {
+		p, err := newMQTTPublisher("tcp://localhost", "dcrspy", tt.user,
+			tt.pass, 0, false, "b", "s", "a", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(p.connectPacket()); got != tt.want {
+			t.Errorf("user %q pass %q: got %s, want %s", tt.user, tt.pass,
+				got, tt.want)
+		}
+	}
+}
+
+func TestMQTTPublishPacket(t *testing.T) {
+	tests := []struct {
+		qos    int
+		retain bool
+		puback string
+		want   string
+		valid  bool
+	}{
+		{0, false, "", "3006" + "0001" + "74" + "7b7d" + "0a", true},
+		{0, true, "", "3106" + "0001" + "74" + "7b7d" + "0a", true},
+		{1, false, "40020001", "3208" + "0001" + "74" + "0001" + "7b7d" + "0a", true},
+		{1, true, "40020001", "3308" + "0001" + "74" + "0001" + "7b7d" + "0a", true},
+		// A PUBACK of another packet, and a PINGRESP
+		{1, false, "40020002", "3208" + "0001" + "74" + "0001" + "7b7d" + "0a", false},
+		{1, false, "d000", "3208" + "0001" + "74" + "0001" + "7b7d" + "0a", false},
+	}
+	for _, tt := range tests {
+		p, err := newMQTTPublisher("tcp://localhost", "dcrspy", "", "",
+			tt.qos, false, "b", "s", "a", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, _ := hex.DecodeString(tt.puback)
+		var w bytes.Buffer
+		err = p.publishPacket(&w, bufio.NewReader(bytes.NewReader(ack)),
+			&mqttMessage{"t", []byte("{}\n"), tt.retain})
+		if (err == nil) != tt.valid {
+			t.Errorf("qos %d retain %v ack %s: got error %v", tt.qos,
+				tt.retain, tt.puback, err)
+		}
+		if got := hex.EncodeToString(w.Bytes()); got != tt.want {
+			t.Errorf("qos %d retain %v: got %s, want %s", tt.qos, tt.retain,
+				got, tt.want)
+		}
+	}
+}
+
+func TestNewMQTTPublisher(t *testing.T) {
+	tests := []struct {
+		broker, clientID, user, pass string
+		qos                          int
+		addr                         string
+		useTLS                       bool
+		err                          string
+	}{
+		{"tcp://broker.local", "dcrspy", "", "", 0, "broker.local:1883", false, ""},
+		{"mqtt://broker.local:1884", "dcrspy", "", "", 1, "broker.local:1884", false, ""},
+		{"tls://broker.local", "dcrspy", "u", "p", 1, "broker.local:8883", true, ""},
+		{"mqtts://[::1]:8884", "dcrspy", "", "", 0, "[::1]:8884", true, ""},
+		{"http://broker.local", "dcrspy", "", "", 0, "", false, "scheme"},
+		{"tcp://", "dcrspy", "", "", 0, "", false, "no host"},
+		{"tcp://broker.local", "dcrspy", "", "", 2, "", false, "mqttqos"},
+		{"tcp://broker.local", "", "", "", 0, "", false, "mqttclientid"},
+		{"tcp://broker.local", strings.Repeat("x", 24), "", "", 0, "", false,
+			"mqttclientid"},
+		{"tcp://broker.local", "dcrspy", "", "p", 0, "", false, "mqttuser"},
+	}
+	for _, tt := range tests {
+		p, err := newMQTTPublisher(tt.broker, tt.clientID, tt.user, tt.pass,
+			tt.qos, false, "b", "s", "a", "")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.broker, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.broker, err)
+			continue
+		}
+		if p.addr != tt.addr || p.useTLS != tt.useTLS {
+			t.Errorf("%s: got %s (TLS %v), want %s (TLS %v)", tt.broker,
+				p.addr, p.useTLS, tt.addr, tt.useTLS)
+		}
+	}
+}
+
+func TestMQTTPublishEvent(t *testing.T) {
+	tests := []struct {
+		filter string
+		event  spyEvent
+		// wantTopic is empty if the event is not published.
+		wantTopic string
+	}{
+		{"", spyEvent{Type: eventTypeWatchedAddr, Address: "Dsa"},
+			"a/Dsa"},
+		{"", spyEvent{Type: eventTypeSpy}, ""},
+		{"", spyEvent{Type: eventTypeWatchedAddr, Address: "Dsa",
+			Tenant: "alice"}, ""},
+		{"amount >= 100", spyEvent{Type: eventTypeWatchedAddr,
+			Address: "Dsb", Amount: 100}, "a/Dsb"},
+		{"amount >= 100", spyEvent{Type: eventTypeWatchedAddr,
+			Address: "Dsb", Amount: 99}, ""},
+		{`action == "mined" && address in ["Dsa", "Dsc"]`,
+			spyEvent{Type: eventTypeWatchedAddr, Action: "mined",
+				Address: "Dsc"}, "a/Dsc"},
+		{`action == "mined"`, spyEvent{Type: eventTypeWatchedAddr,
+			Action: "mempool", Address: "Dsa"}, ""},
+		// A filter that cannot be evaluated does not match.
+		{"amount", spyEvent{Type: eventTypeWatchedAddr, Address: "Dsa"}, ""},
+	}
+	for _, tt := range tests {
+		p, err := newMQTTPublisher("tcp://localhost", "dcrspy", "", "", 0,
+			false, "b", "s", "a", tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.publishEvent(&tt.event)
+		var topic string
+		select {
+		case msg := <-p.queue:
+			topic = msg.topic
+		default:
+		}
+		if topic != tt.wantTopic {
+			t.Errorf("filter %q, event %+v: published to %q, want %q",
+				tt.filter, tt.event, topic, tt.wantTopic)
+		}
+	}
+
+	if _, err := newMQTTPublisher("tcp://localhost", "dcrspy", "", "", 0,
+		false, "b", "s", "a", "amount >"); err == nil ||
+		!strings.Contains(err.Error(), "mqttfilter") {
+		t.Errorf("got error %v for an invalid filter", err)
+	}
+}
@@ -0,0 +1,310 @@
+// mysqlsaver.go implements the MySQL savers, which insert each block's data,
+// its derived metrics and its stake info into a MySQL (or MariaDB) database
+// given by mysqldsn.  The tables are created if they do not exist.  The blocks
+// and stake info are inserted in batches from the saver's write-ahead log (see
+// dbwal.go), each in one transaction, with a multi-row insert of the derived
+// metrics of each block.  A block or stake info stored again at the same
+// height, e.g. after a reorganization, replaces the previous rows.
+//
+// Connections are reopened as needed by database/sql.  An insert that fails
+// because the server cannot be reached (e.g. during a restart) is retried with
+// backoff, and then stays in the write-ahead log, while a record the server
+// rejects (e.g. a constraint violation) is dropped.
+
+package spy
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// mysqlSchemaVersion is the version of the schema created by
+	// mysqlSchema.
+	mysqlSchemaVersion = 1
+	// mysqlAttempts is the number of attempts of an insert when the server
+	// cannot be reached, and mysqlInitialBackoff the delay before the first
+	// retry, doubled for each following retry.
+	mysqlAttempts       = 5
+	mysqlInitialBackoff = time.Second
+	// mysqlConnMaxLifetime is the time after which a connection is closed
+	// and reopened, shorter than the server's usual wait_timeout so that
+	// idle connections are not closed by the server first.
+	mysqlConnMaxLifetime = 5 * time.Minute
+)
+
+// mysqlSchema creates the tables of the database.
+var mysqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS schema_version (
+		version INT NOT NULL
+	) ENGINE=InnoDB`,
+	`CREATE TABLE IF NOT EXISTS blocks (
+		height INT UNSIGNED NOT NULL PRIMARY KEY,
+		hash CHAR(64) NOT NULL,
+		time BIGINT NOT NULL,
+		size INT UNSIGNED NOT NULL,
+		voters SMALLINT UNSIGNED NOT NULL,
+		freshstake TINYINT UNSIGNED NOT NULL,
+		revocations TINYINT UNSIGNED NOT NULL,
+		difficulty DOUBLE NOT NULL,
+		sdiff DOUBLE NOT NULL,
+		poolsize INT UNSIGNED NOT NULL,
+		poolvalue DOUBLE NOT NULL,
+		fee_mean DOUBLE NOT NULL,
+		coinsupply DOUBLE NOT NULL,
+		data MEDIUMTEXT NOT NULL,
+		KEY blocks_time (time)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	`CREATE TABLE IF NOT EXISTS block_metrics (
+		height INT UNSIGNED NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		value DOUBLE NOT NULL,
+		PRIMARY KEY (height, name)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	`CREATE TABLE IF NOT EXISTS stake_info (
+		height INT UNSIGNED NOT NULL PRIMARY KEY,
+		live INT UNSIGNED NOT NULL,
+		immature INT UNSIGNED NOT NULL,
+		voted INT UNSIGNED NOT NULL,
+		missed INT UNSIGNED NOT NULL,
+		revoked INT UNSIGNED NOT NULL,
+		balance DOUBLE NOT NULL,
+		data MEDIUMTEXT NOT NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+}
+
+// mysqlStore is a MySQL database of block data and stake info.
+type mysqlStore struct {
+	db *sql.DB
+	// addr describes the database in logs, without the credentials.
+	addr string
+	wal  *dbWAL
+}
+
+// newMySQLStore connects to the database with the DSN (e.g.
+// user:pass@tcp(localhost:3306)/dcrspy), creating the tables if needed, and
+// opens its write-ahead log.
+func newMySQLStore(dsn string, walCfg dbWALConfig) (*mysqlStore, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mysqldsn: %v", err)
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetConnMaxLifetime(mysqlConnMaxLifetime)
+	s := &mysqlStore{
+		db:   db,
+		addr: fmt.Sprintf("%s/%s", cfg.Addr, cfg.DBName),
+	}
+	if err = s.createSchema(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the tables of %s: %v",
+			s.addr, err)
+	}
+	s.wal, err = openDBWAL(walCfg, "mysql", s.insert, mysqlRetryable)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open the write-ahead log %s: %v",
+			walCfg.path, err)
+	}
+	return s, nil
+}
+
+// createSchema creates the tables of a new database, and checks the version
+// of an existing one.
+func (s *mysqlStore) createSchema() error {
+	for _, stmt := range mysqlSchema {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	// MAX is NULL, i.e. version 0, if the tables were just created.
+	var v sql.NullInt64
+	err := s.db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&v)
+	if err != nil {
+		return err
+	}
+	version := int(v.Int64)
+	switch {
+	case version == mysqlSchemaVersion:
+		return nil
+	case version > mysqlSchemaVersion:
+		return fmt.Errorf("schema version %d is newer than this dcrspy's (%d)",
+			version, mysqlSchemaVersion)
+	}
+	if _, err = s.db.Exec(`INSERT INTO schema_version (version) VALUES (?)`,
+		mysqlSchemaVersion); err != nil {
+		return err
+	}
+	log.Infof("Created the tables of MySQL database %s", s.addr)
+	return nil
+}
+
+// mysqlRetryable returns true if the error is not the server's, e.g. a
+// connection that could not be made or was lost, so the insert may succeed if
+// retried.
+func mysqlRetryable(err error) bool {
+	if se, ok := err.(*spyError); ok {
+		err = se.Err
+	}
+	_, rejected := err.(*mysql.MySQLError)
+	return !rejected
+}
+
+// withTx runs f in a transaction, described by what in logs, retrying it with
+// backoff if the server cannot be reached.
+func (s *mysqlStore) withTx(what string, f func(*sql.Tx) error) error {
+	backoff := mysqlInitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = s.tryTx(f); err == nil || !mysqlRetryable(err) ||
+			attempt == mysqlAttempts {
+			break
+		}
+		log.Warnf("Failed to store %s in %s: %v. Retrying in %v.", what,
+			s.addr, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err != nil {
+		err = reportError(errKindSaver, "mysql", err)
+		log.Errorf("Unable to store %s in %s: %v", what, s.addr, err)
+	}
+	return err
+}
+
+// tryTx runs f in a transaction, which is committed if f succeeds.
+func (s *mysqlStore) tryTx(f func(*sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insert inserts the records in one transaction.
+func (s *mysqlStore) insert(records []*walRecord) error {
+	what := fmt.Sprintf("%d record(s)", len(records))
+	return s.withTx(what, func(tx *sql.Tx) error {
+		for _, r := range records {
+			var err error
+			switch r.Kind {
+			case walBlockRecord:
+				err = mysqlInsertBlock(tx, r)
+			case walStakeInfoRecord:
+				err = mysqlInsertStakeInfo(tx, r)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mysqlInsertBlock inserts the block record and its derived metrics,
+// replacing a block stored at its height.
+func mysqlInsertBlock(tx *sql.Tx, r *walRecord) error {
+	b := r.Block
+	_, err := tx.Exec(`REPLACE INTO blocks (height, hash, time, size, voters,
+		freshstake, revocations, difficulty, sdiff, poolsize, poolvalue,
+		fee_mean, coinsupply, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		int64(r.Height), b.Hash, b.Time, b.Size, b.Voters, b.FreshStake,
+		b.Revocations, b.Difficulty, b.SDiff, b.PoolSize, b.PoolValue,
+		b.FeeMean, b.CoinSupply, r.Data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM block_metrics WHERE height = ?`,
+		int64(r.Height))
+	if err != nil || len(b.Derived) == 0 {
+		return err
+	}
+
+	// The derived metrics are inserted in one statement.
+	names := make([]string, 0, len(b.Derived))
+	for name := range b.Derived {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, 0, len(names))
+	args := make([]interface{}, 0, 3*len(names))
+	for _, name := range names {
+		values = append(values, "(?, ?, ?)")
+		args = append(args, int64(r.Height), name, b.Derived[name])
+	}
+	_, err = tx.Exec(`INSERT INTO block_metrics (height, name, value)
+		VALUES `+strings.Join(values, ", "), args...)
+	return err
+}
+
+// mysqlInsertStakeInfo inserts the stake info record, replacing stake info
+// stored at its height.
+func mysqlInsertStakeInfo(tx *sql.Tx, r *walRecord) error {
+	si := r.StakeInfo
+	_, err := tx.Exec(`REPLACE INTO stake_info (height, live, immature, voted,
+		missed, revoked, balance, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		int64(r.Height), si.Live, si.Immature, si.Voted, si.Missed,
+		si.Revoked, si.Balance, r.Data)
+	return err
+}
+
+// close commits the write-ahead log and closes the database.
+func (s *mysqlStore) close() error {
+	if s == nil {
+		return nil
+	}
+	if err := s.wal.close(); err != nil {
+		log.Errorf("Failed to close the write-ahead log %s: %v", s.wal.cfg.path,
+			err)
+	}
+	return s.db.Close()
+}
+
+// BlockDataToMySQL implements BlockDataSaver interface for output to a
+// MySQL database
+type BlockDataToMySQL struct {
+	*mysqlStore
+}
+
+// NewBlockDataToMySQL creates a new BlockDataToMySQL saving to the database
+func NewBlockDataToMySQL(s *mysqlStore) *BlockDataToMySQL {
+	return &BlockDataToMySQL{s}
+}
+
+// Store logs the blockData and its derived metrics for insertion, replacing a
+// block stored at its height
+func (s *BlockDataToMySQL) Store(data *blockData) error {
+	return s.wal.storeBlock(data)
+}
+
+// StakeInfoDataToMySQL implements StakeInfoDataSaver interface for output to a
+// MySQL database
+type StakeInfoDataToMySQL struct {
+	*mysqlStore
+}
+
+// NewStakeInfoDataToMySQL creates a new StakeInfoDataToMySQL saving to the
+// database
+func NewStakeInfoDataToMySQL(s *mysqlStore) *StakeInfoDataToMySQL {
+	return &StakeInfoDataToMySQL{s}
+}
+
+// Store logs the stakeInfoData for insertion, replacing stake info stored at
+// its height
+func (s *StakeInfoDataToMySQL) Store(data *stakeInfoData) error {
+	return s.wal.storeStakeInfo(data)
+}
@@ -0,0 +1,623 @@
+// nats.go publishes block data, stake info and the operator's events to a NATS
+// server, so that other services may subscribe to them.  Block data and stake
+// info are published as JSON to their configured subjects, and events to a
+// subject per type under the event subject, with the address of a watched
+// address event as the last token (e.g. dcrspy.event.watchedaddr.Dsabc...), so
+// that a subscriber may select them with wildcards.
+//
+// The publisher implements the parts of the NATS client protocol it needs.
+// With JetStream enabled, each message is published with a reply subject and a
+// Nats-Msg-Id header, and is published again until the server acknowledges
+// that a stream stored it, so that messages are delivered at least once, and
+// the stream discards duplicates of a message published again within its
+// duplicate window.  Without JetStream, messages are published at most once.
+
+package spy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// natsQueueSize is the number of messages waiting to be published,
+	// beyond which new messages are dropped.
+	natsQueueSize = 200
+	// natsPingInterval is the interval at which the server is pinged when
+	// idle, to detect a dead connection.
+	natsPingInterval = 30 * time.Second
+	// natsTimeout is the timeout of connecting, of each write, and of
+	// awaiting a PONG or a JetStream acknowledgement.
+	natsTimeout = 10 * time.Second
+	// natsMaxBackoff is the maximum delay between reconnection attempts.
+	natsMaxBackoff = time.Minute
+	// natsMaxControlLine is the maximum length of a protocol line.
+	natsMaxControlLine = 4096
+)
+
+// natsMessage is a message to publish.  id is its Nats-Msg-Id, by which
+// JetStream discards duplicates, or empty.
+type natsMessage struct {
+	subject string
+	id      string
+	payload []byte
+}
+
+// natsPublisher publishes messages to a NATS server.
+type natsPublisher struct {
+	addr      string
+	useTLS    bool
+	host      string
+	user      string
+	pass      string
+	token     string
+	jetStream bool
+
+	blockSubject, stakeInfoSubject, eventSubject string
+
+	queue chan *natsMessage
+	// inbox is the prefix of the reply subjects of JetStream
+	// acknowledgements, and replyID the last reply subject's suffix.
+	inbox   string
+	replyID uint64
+}
+
+// spyNATS is the package-level NATS publisher, nil if disabled.
+var spyNATS *natsPublisher
+
+// newNATSPublisher creates a natsPublisher of the server, a URL with the scheme
+// nats or tls (e.g. tls://nats.local:4222).  Messages are published to the
+// subjects (empty to not publish), awaiting JetStream acknowledgements if
+// jetStream is true.
+func newNATSPublisher(server, user, pass, token string, jetStream bool,
+	blockSubject, stakeInfoSubject, eventSubject string) (*natsPublisher,
+	error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid natsserver %q: %v", server, err)
+	}
+	p := &natsPublisher{
+		addr:             u.Host,
+		user:             user,
+		pass:             pass,
+		token:            token,
+		jetStream:        jetStream,
+		blockSubject:     blockSubject,
+		stakeInfoSubject: stakeInfoSubject,
+		eventSubject:     eventSubject,
+		queue:            make(chan *natsMessage, natsQueueSize),
+	}
+	switch u.Scheme {
+	case "nats", "tcp":
+	case "tls":
+		p.useTLS = true
+	default:
+		return nil, fmt.Errorf("invalid natsserver %q: the scheme must be "+
+			"nats or tls", server)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid natsserver %q: no host", server)
+	}
+	p.host = u.Host
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		p.host = h
+	} else {
+		p.addr = net.JoinHostPort(u.Host, "4222")
+	}
+	if pass != "" && user == "" {
+		return nil, errors.New("natspass requires natsuser")
+	}
+	if token != "" && user != "" {
+		return nil, errors.New("natstoken and natsuser are exclusive")
+	}
+	for _, s := range []string{blockSubject, stakeInfoSubject, eventSubject} {
+		if s != "" && !natsValidSubject(s) {
+			return nil, fmt.Errorf("invalid NATS subject %q", s)
+		}
+	}
+
+	var b [8]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	p.inbox = "_INBOX.dcrspy." + hex.EncodeToString(b[:])
+	return p, nil
+}
+
+// natsValidSubject returns whether s is a subject that may be published to:
+// dot-separated, non-empty tokens without whitespace or wildcards.
+func natsValidSubject(s string) bool {
+	for _, token := range strings.Split(s, ".") {
+		if token == "" || token == "*" || token == ">" ||
+			strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// publish queues the message.  It does not block.
+func (p *natsPublisher) publish(subject, id string, payload []byte) {
+	select {
+	case p.queue <- &natsMessage{subject, id, payload}:
+	default:
+		log.Warnf("NATS queue full. Dropping message to %s.", subject)
+	}
+}
+
+// publishEvent publishes the operator's event to the subject of its type, and
+// of its address if any.  Tenants' events are ignored.
+func (p *natsPublisher) publishEvent(e *spyEvent) {
+	if p == nil || p.eventSubject == "" || e.Tenant != operatorOwner {
+		return
+	}
+	payload, err := spyNotifyTemplates.payload(notifyChannelNATS, e)
+	if err != nil {
+		log.Errorf("Failed to encode event %d: %v", e.Seq, err)
+		return
+	}
+	subject := p.eventSubject + "." + e.Type
+	if e.Address != "" {
+		subject += "." + e.Address
+	}
+	// Events are numbered when recorded in the journal.
+	var id string
+	if e.Seq != 0 {
+		id = "event-" + strconv.FormatUint(e.Seq, 10)
+	}
+	p.publish(subject, id, payload)
+}
+
+// run publishes the queued messages until quit is closed, reconnecting as
+// needed.  It should be run as a goroutine.
+func (p *natsPublisher) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	var pending *natsMessage
+	backoff := time.Second
+	for {
+		err := p.session(&pending, quit)
+		if err == nil {
+			log.Debugf("Quitting NATS publisher.")
+			return
+		}
+		log.Warnf("NATS connection to %s failed: %v. Reconnecting in %v.",
+			p.addr, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-quit:
+			log.Debugf("Quitting NATS publisher.")
+			return
+		}
+		if backoff *= 2; backoff > natsMaxBackoff {
+			backoff = natsMaxBackoff
+		}
+	}
+}
+
+// natsServerInfo is the part of the server's INFO used by the publisher.
+type natsServerInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// natsConnectOptions are the options of the CONNECT message.
+type natsConnectOptions struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	TLSRequired  bool   `json:"tls_required"`
+	Name         string `json:"name"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+}
+
+// natsConn is a connection to the server, written to by the session and by
+// its reader, which answers the server's pings.
+type natsConn struct {
+	mtx  sync.Mutex
+	conn net.Conn
+}
+
+// write writes b to the connection.
+func (c *natsConn) write(b []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// natsReply is a message received on the inbox: a JetStream acknowledgement,
+// or a status such as 503 (no responders).
+type natsReply struct {
+	subject string
+	status  string
+	payload []byte
+}
+
+// session connects to the server and publishes messages, starting with
+// *pending if not nil, until quit is closed or the connection fails.  A
+// message that could not be published, or whose JetStream acknowledgement was
+// not received, is left in *pending.  It returns nil when quitting.
+func (p *natsPublisher) session(pending **natsMessage,
+	quit <-chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", p.addr, natsTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() { conn.Close() }()
+	r := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	info, err := p.handshake(&conn, &r)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	log.Infof("Connected to NATS server %s", p.addr)
+
+	c := &natsConn{conn: conn}
+	done := make(chan struct{})
+	defer close(done)
+	replies := make(chan *natsReply)
+	pongs := make(chan struct{}, 1)
+	errc := make(chan error, 1)
+	go natsReadLoop(r, c, replies, pongs, errc, done)
+
+	if p.jetStream {
+		if err = c.write([]byte("SUB " + p.inbox + ".* 1\r\n")); err != nil {
+			return err
+		}
+	}
+
+	ping := time.NewTicker(natsPingInterval)
+	defer ping.Stop()
+	for {
+		msg := *pending
+		if msg == nil {
+			select {
+			case msg = <-p.queue:
+			case <-ping.C:
+				if err = c.write([]byte("PING\r\n")); err != nil {
+					return err
+				}
+				select {
+				case <-pongs:
+				case err = <-errc:
+					return err
+				case <-time.After(natsTimeout):
+					return errors.New("timed out awaiting PONG")
+				}
+				continue
+			case err = <-errc:
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+
+		*pending = msg
+		if info.MaxPayload > 0 && len(msg.payload) > info.MaxPayload {
+			log.Errorf("Dropping message to %s: its %d bytes exceed the "+
+				"server's maximum payload.", msg.subject, len(msg.payload))
+		} else if err = p.publishMessage(c, msg, replies, errc); err != nil {
+			return err
+		}
+		*pending = nil
+	}
+}
+
+// handshake reads the server's INFO, upgrades the connection to TLS if
+// configured or required by the server, and sends CONNECT, awaiting the PONG
+// of a PING that confirms it was accepted.
+func (p *natsPublisher) handshake(conn *net.Conn,
+	r **bufio.Reader) (*natsServerInfo, error) {
+	line, err := natsReadLine(*r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return nil, fmt.Errorf("unexpected %q awaiting INFO", line)
+	}
+	info := new(natsServerInfo)
+	if err = json.Unmarshal([]byte(line[len("INFO "):]), info); err != nil {
+		return nil, fmt.Errorf("invalid INFO: %v", err)
+	}
+	if p.jetStream && !info.Headers {
+		return nil, errors.New("the server does not support headers, " +
+			"required by JetStream")
+	}
+
+	if p.useTLS || info.TLSRequired {
+		tlsConn := tls.Client(*conn, &tls.Config{ServerName: p.host})
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		*conn = tlsConn
+		*r = bufio.NewReader(tlsConn)
+	}
+
+	connect, err := json.Marshal(&natsConnectOptions{
+		TLSRequired:  p.useTLS || info.TLSRequired,
+		Name:         "dcrspy",
+		Lang:         "go",
+		Version:      ver.String(),
+		Protocol:     1,
+		Headers:      p.jetStream,
+		NoResponders: p.jetStream,
+		User:         p.user,
+		Pass:         p.pass,
+		AuthToken:    p.token,
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(*conn, "CONNECT %s\r\nPING\r\n", connect)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		line, err = natsReadLine(*r)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case line == "PONG":
+			return info, nil
+		case strings.HasPrefix(line, "-ERR"):
+			return nil, natsServerError(line)
+		}
+	}
+}
+
+// publishMessage publishes the message, and awaits its JetStream
+// acknowledgement on the inbox if JetStream is enabled.
+func (p *natsPublisher) publishMessage(c *natsConn, msg *natsMessage,
+	replies <-chan *natsReply, errc <-chan error) error {
+	if !p.jetStream {
+		b := fmt.Sprintf("PUB %s %d\r\n", msg.subject, len(msg.payload))
+		return c.write(append(append([]byte(b), msg.payload...), '\r', '\n'))
+	}
+
+	p.replyID++
+	reply := p.inbox + "." + strconv.FormatUint(p.replyID, 10)
+	header := "NATS/1.0\r\n"
+	if msg.id != "" {
+		header += "Nats-Msg-Id: " + msg.id + "\r\n"
+	}
+	header += "\r\n"
+	b := fmt.Sprintf("HPUB %s %s %d %d\r\n%s", msg.subject, reply,
+		len(header), len(header)+len(msg.payload), header)
+	err := c.write(append(append([]byte(b), msg.payload...), '\r', '\n'))
+	if err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(natsTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case rep := <-replies:
+			// An acknowledgement of an earlier attempt arriving late
+			// is ignored.
+			if rep.subject != reply {
+				continue
+			}
+			return rep.ackError(msg.subject)
+		case err = <-errc:
+			return err
+		case <-timeout.C:
+			return fmt.Errorf("timed out awaiting the JetStream "+
+				"acknowledgement of a message to %s", msg.subject)
+		}
+	}
+}
+
+// natsPubAck is a JetStream acknowledgement.
+type natsPubAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	Error  *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// ackError returns the error of the JetStream acknowledgement of a message to
+// subject, nil if a stream stored the message.
+func (rep *natsReply) ackError(subject string) error {
+	switch rep.status {
+	case "":
+	case "503":
+		return fmt.Errorf("no JetStream stream stores %s", subject)
+	default:
+		return fmt.Errorf("status %s publishing to %s", rep.status, subject)
+	}
+	var ack natsPubAck
+	if err := json.Unmarshal(rep.payload, &ack); err != nil {
+		return fmt.Errorf("invalid JetStream acknowledgement: %v", err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("JetStream rejected a message to %s: %s (%d)",
+			subject, ack.Error.Description, ack.Error.Code)
+	}
+	if ack.Stream == "" {
+		return fmt.Errorf("invalid JetStream acknowledgement %q", rep.payload)
+	}
+	return nil
+}
+
+// natsReadLoop reads the messages of the server until the connection fails,
+// sending the error to errc, or done is closed.  It answers the server's
+// pings, and sends the PONGs and the messages received on the inbox to pongs
+// and replies.
+func natsReadLoop(r *bufio.Reader, c *natsConn, replies chan<- *natsReply,
+	pongs chan<- struct{}, errc chan<- error, done <-chan struct{}) {
+	for {
+		rep, err := natsReadMessage(r, c, pongs)
+		if err != nil {
+			errc <- err
+			return
+		}
+		if rep == nil {
+			continue
+		}
+		select {
+		case replies <- rep:
+		case <-done:
+			return
+		}
+	}
+}
+
+// natsReadMessage reads a line of the server, and the payload of a MSG or
+// HMSG, which it returns.  Other lines are handled, and return nil.
+func natsReadMessage(r *bufio.Reader, c *natsConn,
+	pongs chan<- struct{}) (*natsReply, error) {
+	line, err := natsReadLine(r)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "PING":
+		return nil, c.write([]byte("PONG\r\n"))
+	case "PONG":
+		select {
+		case pongs <- struct{}{}:
+		default:
+		}
+		return nil, nil
+	case "-ERR":
+		return nil, natsServerError(line)
+	case "MSG":
+		// MSG <subject> <sid> [reply-to] <#bytes>
+		if len(fields) != 4 && len(fields) != 5 {
+			return nil, fmt.Errorf("malformed %q", line)
+		}
+		n, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("malformed %q", line)
+		}
+		payload, err := natsReadPayload(r, n)
+		if err != nil {
+			return nil, err
+		}
+		return &natsReply{subject: fields[1], payload: payload}, nil
+	case "HMSG":
+		// HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>
+		if len(fields) != 5 && len(fields) != 6 {
+			return nil, fmt.Errorf("malformed %q", line)
+		}
+		h, err1 := strconv.Atoi(fields[len(fields)-2])
+		n, err2 := strconv.Atoi(fields[len(fields)-1])
+		if err1 != nil || err2 != nil || h < 0 || n < h {
+			return nil, fmt.Errorf("malformed %q", line)
+		}
+		b, err := natsReadPayload(r, n)
+		if err != nil {
+			return nil, err
+		}
+		rep := &natsReply{subject: fields[1], payload: b[h:]}
+		// The status, if any, follows the version on the first line
+		// of the header (e.g. NATS/1.0 503).
+		status := string(b[:h])
+		if i := strings.Index(status, "\r\n"); i >= 0 {
+			status = status[:i]
+		}
+		if f := strings.Fields(status); len(f) > 1 {
+			rep.status = f[1]
+		}
+		return rep, nil
+	}
+	// +OK and INFO updates are ignored.
+	return nil, nil
+}
+
+// natsReadLine reads a protocol line, without its CRLF.
+func natsReadLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, b...)
+		if len(line) > natsMaxControlLine {
+			return "", errors.New("protocol line too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// natsReadPayload reads a payload of n bytes and its CRLF.
+func natsReadPayload(r *bufio.Reader, n int) ([]byte, error) {
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// natsServerError returns the error of a -ERR line.
+func natsServerError(line string) error {
+	msg := strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))
+	return fmt.Errorf("server error: %s", strings.Trim(msg, "'"))
+}
+
+// BlockDataToNATS implements BlockDataSaver interface for publishing block
+// data to a NATS subject.
+type BlockDataToNATS struct {
+	p *natsPublisher
+}
+
+// Store publishes the block data.
+func (s *BlockDataToNATS) Store(data *blockData) error {
+	payload, err := JSONFormatBlockData(data)
+	if err != nil {
+		return err
+	}
+	s.p.publish(s.p.blockSubject, "block-"+data.header.Hash, payload.Bytes())
+	return nil
+}
+
+// StakeInfoDataToNATS implements StakeInfoDataSaver interface for publishing
+// stake info to a NATS subject.
+type StakeInfoDataToNATS struct {
+	p *natsPublisher
+}
+
+// Store publishes the stake info.
+func (s *StakeInfoDataToNATS) Store(data *stakeInfoData) error {
+	payload, err := JSONFormatStakeInfoData(data)
+	if err != nil {
+		return err
+	}
+	id := "stakeinfo-" + strconv.FormatUint(uint64(data.height), 10)
+	s.p.publish(s.p.stakeInfoSubject, id, payload.Bytes())
+	return nil
+}
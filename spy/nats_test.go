@@ -0,0 +1,224 @@
+package spy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConn is a net.Conn recording what is written to it.
+type testConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *testConn) Write(b []byte) (int, error)      { return c.written.Write(b) }
+func (c *testConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestNATSValidSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		valid   bool
+	}{
+		{"dcrspy.block", true},
+		{"dcrspy.event.watchedaddr.DsabcXYZ", true},
+		{"dcrspy", true},
+		{"", false},
+		{"dcrspy..block", false},
+		{"dcrspy.block.", false},
+		{"dcrspy.*", false},
+		{"dcrspy.>", false},
+		{"dcrspy.blo ck", false},
+		{"dcrspy.block\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := natsValidSubject(tt.subject); got != tt.valid {
+			t.Errorf("natsValidSubject(%q) = %v, want %v", tt.subject, got,
+				tt.valid)
+		}
+	}
+}
+
+func TestNATSReadMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		subject string
+		status  string
+		payload string
+		written string
+		pong    bool
+		err     string
+	}{
+		{name: "ping", in: "PING\r\n", written: "PONG\r\n"},
+		{name: "pong", in: "PONG\r\n", pong: true},
+		{name: "ok", in: "+OK\r\n"},
+		{name: "info", in: "INFO {\"headers\":true}\r\n"},
+		{name: "msg", in: "MSG _INBOX.x.1 1 7\r\n{\"a\":1}\r\n",
+			subject: "_INBOX.x.1", payload: `{"a":1}`},
+		{name: "msg with reply", in: "MSG s 1 r 2\r\nhi\r\n", subject: "s",
+			payload: "hi"},
+		{name: "hmsg status", in: "HMSG _INBOX.x.2 1 16 16\r\n" +
+			"NATS/1.0 503\r\n\r\n\r\n", subject: "_INBOX.x.2", status: "503"},
+		{name: "hmsg payload", in: "HMSG s 1 12 14\r\nNATS/1.0\r\n\r\nok\r\n",
+			subject: "s", payload: "ok"},
+		{name: "error", in: "-ERR 'Authorization Violation'\r\n",
+			err: "server error: Authorization Violation"},
+		{name: "malformed msg", in: "MSG s\r\n", err: "malformed"},
+		{name: "negative size", in: "MSG s 1 -1\r\n", err: "malformed"},
+		{name: "header longer than message", in: "HMSG s 1 5 4\r\n",
+			err: "malformed"},
+		{name: "short payload", in: "MSG s 1 10\r\nabc\r\n", err: "EOF"},
+		{name: "long line", in: "INFO " + strings.Repeat("x",
+			natsMaxControlLine) + "\r\n", err: "too long"},
+	}
+	for _, tt := range tests {
+		conn := new(testConn)
+		pongs := make(chan struct{}, 1)
+		rep, err := natsReadMessage(bufio.NewReader(strings.NewReader(tt.in)),
+			&natsConn{conn: conn}, pongs)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.subject == "" {
+			if rep != nil {
+				t.Errorf("%s: got reply %+v", tt.name, rep)
+			}
+		} else if rep == nil || rep.subject != tt.subject ||
+			rep.status != tt.status || string(rep.payload) != tt.payload {
+			t.Errorf("%s: got reply %+v, want subject %s, status %q and "+
+				"payload %q", tt.name, rep, tt.subject, tt.status, tt.payload)
+		}
+		if got := conn.written.String(); got != tt.written {
+			t.Errorf("%s: wrote %q, want %q", tt.name, got, tt.written)
+		}
+		if got := len(pongs) == 1; got != tt.pong {
+			t.Errorf("%s: got PONG %v, want %v", tt.name, got, tt.pong)
+		}
+	}
+}
+
+func TestNATSPublishMessage(t *testing.T) {
+	ack := &natsReply{subject: "_INBOX.t.1", payload: []byte(
+		`{"stream":"DCRSPY","seq":7}`)}
+	tests := []struct {
+		name      string
+		jetStream bool
+		msg       *natsMessage
+		replies   []*natsReply
+		written   string
+		err       string
+	}{
+		{"core", false, &natsMessage{"dcrspy.block", "block-00ab", []byte("{}")},
+			nil, "PUB dcrspy.block 2\r\n{}\r\n", ""},
+		{"jetstream", true, &natsMessage{"dcrspy.block", "block-00ab",
+			[]byte("{}")}, []*natsReply{ack},
+			"HPUB dcrspy.block _INBOX.t.1 37 39\r\n" +
+				"NATS/1.0\r\nNats-Msg-Id: block-00ab\r\n\r\n{}\r\n", ""},
+		{"jetstream without id", true, &natsMessage{"s", "", []byte("x")},
+			[]*natsReply{ack}, "HPUB s _INBOX.t.1 12 13\r\nNATS/1.0\r\n\r\nx\r\n",
+			""},
+		// A late acknowledgement of an earlier attempt is ignored.
+		{"late ack", true, &natsMessage{"s", "", []byte("x")},
+			[]*natsReply{{subject: "_INBOX.t.0"}, ack},
+			"HPUB s _INBOX.t.1 12 13\r\nNATS/1.0\r\n\r\nx\r\n", ""},
+		{"no responders", true, &natsMessage{"s", "", []byte("x")},
+			[]*natsReply{{subject: "_INBOX.t.1", status: "503"}},
+			"HPUB s _INBOX.t.1 12 13\r\nNATS/1.0\r\n\r\nx\r\n",
+			"no JetStream stream"},
+	}
+	for _, tt := range tests {
+		p := &natsPublisher{jetStream: tt.jetStream, inbox: "_INBOX.t"}
+		conn := new(testConn)
+		replies := make(chan *natsReply, len(tt.replies))
+		for _, rep := range tt.replies {
+			replies <- rep
+		}
+		err := p.publishMessage(&natsConn{conn: conn}, tt.msg, replies, nil)
+		if (err == nil) != (tt.err == "") ||
+			(err != nil && !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+		if got := conn.written.String(); got != tt.written {
+			t.Errorf("%s: wrote %q, want %q", tt.name, got, tt.written)
+		}
+	}
+}
+
+func TestNATSAckError(t *testing.T) {
+	tests := []struct {
+		status  string
+		payload string
+		err     string
+	}{
+		{"", `{"stream":"DCRSPY","seq":1}`, ""},
+		{"", `{"stream":"DCRSPY","seq":1,"duplicate":true}`, ""},
+		{"503", "", "no JetStream stream stores s"},
+		{"408", "", "status 408"},
+		{"", `{"error":{"code":400,"description":"bad"}}`,
+			"JetStream rejected a message to s: bad (400)"},
+		{"", `{}`, "invalid JetStream acknowledgement"},
+		{"", `not json`, "invalid JetStream acknowledgement"},
+	}
+	for _, tt := range tests {
+		rep := &natsReply{status: tt.status, payload: []byte(tt.payload)}
+		err := rep.ackError("s")
+		if (err == nil) != (tt.err == "") ||
+			(err != nil && !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("status %q payload %s: got error %v, want %q", tt.status,
+				tt.payload, err, tt.err)
+		}
+	}
+}
+
+func TestNewNATSPublisher(t *testing.T) {
+	tests := []struct {
+		server, user, pass, token string
+		subject                   string
+		addr                      string
+		useTLS                    bool
+		err                       string
+	}{
+		{"nats://nats.local", "", "", "", "dcrspy.block", "nats.local:4222",
+			false, ""},
+		{"tls://nats.local:4443", "u", "p", "", "dcrspy.block",
+			"nats.local:4443", true, ""},
+		{"tcp://nats.local", "", "", "t", "", "nats.local:4222", false, ""},
+		{"http://nats.local", "", "", "", "", "", false, "scheme"},
+		{"nats://", "", "", "", "", "", false, "no host"},
+		{"nats://nats.local", "", "p", "", "", "", false, "natsuser"},
+		{"nats://nats.local", "u", "", "t", "", "", false, "exclusive"},
+		{"nats://nats.local", "", "", "", "dcrspy.*", "", false, "subject"},
+	}
+	for _, tt := range tests {
+		p, err := newNATSPublisher(tt.server, tt.user, tt.pass, tt.token,
+			false, tt.subject, "", "")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.server, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.server, err)
+			continue
+		}
+		if p.addr != tt.addr || p.useTLS != tt.useTLS {
+			t.Errorf("%s: got %s (TLS %v), want %s (TLS %v)", tt.server,
+				p.addr, p.useTLS, tt.addr, tt.useTLS)
+		}
+		if !strings.HasPrefix(p.inbox, "_INBOX.dcrspy.") {
+			t.Errorf("%s: got inbox %s", tt.server, p.inbox)
+		}
+	}
+}
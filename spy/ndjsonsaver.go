@@ -0,0 +1,220 @@
+// ndjsonsaver.go implements the newline-delimited JSON savers, which append
+// the JSON document of each block's data and stake info, one per line, to a
+// file per network in the output folder (e.g. block_data-mainnet.ndjson), for
+// other tools to tail or load.  The file is rotated when it reaches the
+// rotation size, or when a new rotation period (e.g. a UTC day for 24h)
+// starts, by renaming it with the UTC time of the rotation (e.g.
+// block_data-mainnet-20170301T000000Z.ndjson) and starting a new one.  With a
+// signing key, a file is signed when it is rotated, and the current file when
+// the saver is closed, rather than rereading a large file after each line.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ndjsonAppender appends lines to a rotated file.
+type ndjsonAppender struct {
+	mtx    sync.Mutex
+	folder string
+	// name is the base name of the file, without the extension.
+	name string
+	// rotateSize is the size in bytes beyond which the file is rotated, and
+	// rotatePeriod the period, 0 if not rotated by size or time.
+	rotateSize   int64
+	rotatePeriod time.Duration
+
+	file *os.File
+	size int64
+	// period is the start of the rotation period of the file.
+	period time.Time
+}
+
+// newNDJSONAppender creates an ndjsonAppender of the file named name.ndjson in
+// folder.
+func newNDJSONAppender(folder, name string, rotateSize int64,
+	rotatePeriod time.Duration) *ndjsonAppender {
+	return &ndjsonAppender{
+		folder:       folder,
+		name:         name,
+		rotateSize:   rotateSize,
+		rotatePeriod: rotatePeriod,
+	}
+}
+
+// path returns the path of the current file.
+func (a *ndjsonAppender) path() string {
+	return filepath.Join(a.folder, a.name+".ndjson")
+}
+
+// periodOf returns the start of the rotation period of t.
+func (a *ndjsonAppender) periodOf(t time.Time) time.Time {
+	if a.rotatePeriod <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(a.rotatePeriod)
+}
+
+// openFile opens the current file for appending, creating it if needed.  An
+// existing file is in the rotation period of its last modification.
+func (a *ndjsonAppender) openFile() error {
+	fp, err := os.OpenFile(a.path(), os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0644)
+	if err != nil {
+		return err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	a.file, a.size = fp, fi.Size()
+	a.period = a.periodOf(time.Now())
+	if a.size > 0 {
+		a.period = a.periodOf(fi.ModTime())
+	}
+	return nil
+}
+
+// rotate closes the current file and renames it with the UTC time.
+func (a *ndjsonAppender) rotate(now time.Time) error {
+	err := a.file.Close()
+	a.file = nil
+	if err != nil {
+		return err
+	}
+	stamp := now.UTC().Format("20060102T150405Z")
+	rotated := filepath.Join(a.folder, fmt.Sprintf("%s-%s.ndjson", a.name,
+		stamp))
+	// Files rotated within the same second are numbered.
+	for i := 1; ; i++ {
+		if _, err = os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = filepath.Join(a.folder, fmt.Sprintf("%s-%s-%d.ndjson",
+			a.name, stamp, i))
+	}
+	if err = os.Rename(a.path(), rotated); err != nil {
+		return err
+	}
+	log.Debugf("Rotated %s to %s", a.path(), rotated)
+	signStoredFile(rotated)
+	return nil
+}
+
+// appendLine appends the JSON document b, compacted to a line, to the file,
+// rotating it first if needed.
+func (a *ndjsonAppender) appendLine(b []byte) error {
+	var line bytes.Buffer
+	if err := json.Compact(&line, b); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.file == nil {
+		if err := a.openFile(); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	if a.size > 0 && ((a.rotateSize > 0 &&
+		a.size+int64(line.Len()) > a.rotateSize) ||
+		!a.periodOf(now).Equal(a.period)) {
+		if err := a.rotate(now); err != nil {
+			return err
+		}
+		if err := a.openFile(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(line.Bytes())
+	a.size += int64(n)
+	return err
+}
+
+// close closes the current file.
+func (a *ndjsonAppender) close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	if err == nil {
+		signStoredFile(a.path())
+	}
+	return err
+}
+
+// BlockDataToNDJSON implements BlockDataSaver interface for output to a
+// rotated newline-delimited JSON file
+type BlockDataToNDJSON struct {
+	*ndjsonAppender
+}
+
+// NewBlockDataToNDJSON creates a new BlockDataToNDJSON saving to the network's
+// file in folder, rotated at rotateSize bytes or each rotatePeriod.
+func NewBlockDataToNDJSON(folder, network string, rotateSize int64,
+	rotatePeriod time.Duration) *BlockDataToNDJSON {
+	return &BlockDataToNDJSON{newNDJSONAppender(folder,
+		blockDataFilePrefix+network, rotateSize, rotatePeriod)}
+}
+
+// Store appends the blockData to the file
+func (s *BlockDataToNDJSON) Store(data *blockData) error {
+	jsonConcat, err := JSONFormatBlockData(data)
+	if err != nil {
+		return err
+	}
+	if err = s.appendLine(jsonConcat.Bytes()); err != nil {
+		err = reportError(errKindSaver, "ndjson", err)
+		log.Errorf("Unable to append block data to %s: %v", s.path(), err)
+	}
+	return err
+}
+
+// StakeInfoDataToNDJSON implements StakeInfoDataSaver interface for output to
+// a rotated newline-delimited JSON file
+type StakeInfoDataToNDJSON struct {
+	*ndjsonAppender
+}
+
+// NewStakeInfoDataToNDJSON creates a new StakeInfoDataToNDJSON saving to the
+// network's file in folder, rotated at rotateSize bytes or each rotatePeriod.
+func NewStakeInfoDataToNDJSON(folder, network string, rotateSize int64,
+	rotatePeriod time.Duration) *StakeInfoDataToNDJSON {
+	return &StakeInfoDataToNDJSON{newNDJSONAppender(folder,
+		stakeInfoFilePrefix+network, rotateSize, rotatePeriod)}
+}
+
+// Store appends the stakeInfoData, with its height, to the file
+func (s *StakeInfoDataToNDJSON) Store(data *stakeInfoData) error {
+	jsonConcat, err := JSONFormatStakeInfoData(data)
+	if err != nil {
+		return err
+	}
+	// The document has no height, so it is added as the first field.
+	doc := strings.TrimSpace(jsonConcat.String())
+	if !strings.HasPrefix(doc, "{") {
+		return fmt.Errorf("stake info is not a JSON object")
+	}
+	line := fmt.Sprintf(`{"height":%d,%s`, data.height, doc[1:])
+	if err = s.appendLine([]byte(line)); err != nil {
+		err = reportError(errKindSaver, "ndjson", err)
+		log.Errorf("Unable to append stake info data to %s: %v", s.path(),
+			err)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+// nodeindexes.go probes at startup whether dcrd maintains its optional
+// transaction index (--txindex) and address index (--addrindex), so that the
+// features depending on them are enabled or disabled up front with a clear
+// message, rather than failing on each use.  The dependent features are:
+//
+//	txindex:   ticket pool sampling, and the previous outputs of inputs in the
+//	           transaction decode API
+//	addrindex: cold storage audits and address history backfill
+
+package spy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+)
+
+// nodeIndexes are the optional indexes of dcrd.
+type nodeIndexes struct {
+	TxIndex   bool `json:"txindex"`
+	AddrIndex bool `json:"addrindex"`
+}
+
+// spyNodeIndexes are dcrd's indexes, assumed enabled until probed.
+var spyNodeIndexes = &nodeIndexes{TxIndex: true, AddrIndex: true}
+
+// String describes the status of the indexes.
+func (n *nodeIndexes) String() string {
+	status := func(enabled bool) string {
+		if enabled {
+			return "enabled"
+		}
+		return "disabled"
+	}
+	return fmt.Sprintf("txindex %s, addrindex %s", status(n.TxIndex),
+		status(n.AddrIndex))
+}
+
+// isIndexDisabledErr returns true if err is dcrd's error for a request that
+// requires the named index (e.g. "--txindex" for txindex) when it is not
+// enabled.
+func isIndexDisabledErr(err error, index string) bool {
+	return err != nil && strings.Contains(err.Error(), "--"+index)
+}
+
+// probeNodeIndexes determines which indexes dcrd maintains by requesting the
+// coinbase of block 1, which requires the transaction index, and the
+// transactions of its first output's address, which require the address
+// index.  An index is assumed enabled if the probe fails for another reason.
+func probeNodeIndexes(dcrd *dcrrpcclient.Client) *nodeIndexes {
+	n := &nodeIndexes{TxIndex: true, AddrIndex: true}
+
+	var coinbase *dcrutil.Tx
+	hash, err := dcrd.GetBlockHash(1)
+	if err == nil {
+		var block *dcrutil.Block
+		if block, err = dcrd.GetBlock(hash); err == nil {
+			if txs := block.Transactions(); len(txs) > 0 {
+				coinbase = txs[0]
+			} else {
+				err = fmt.Errorf("block 1 has no transactions")
+			}
+		}
+	}
+	if err != nil {
+		log.Warnf("Unable to probe dcrd's indexes: %v", err)
+		return n
+	}
+
+	_, err = dcrd.GetRawTransaction(coinbase.Hash())
+	n.TxIndex = !isIndexDisabledErr(err, "txindex")
+	if err != nil && n.TxIndex {
+		log.Warnf("Unable to determine if dcrd has txindex: %v", err)
+	}
+
+	var addr dcrutil.Address
+	for _, txOut := range coinbase.MsgTx().TxOut {
+		_, addrs, _, err := txOutAddresses(txOut)
+		if err == nil && len(addrs) > 0 {
+			addr, err = dcrutil.DecodeAddress(addrs[0], activeNet.Params)
+			if err == nil {
+				break
+			}
+		}
+	}
+	if addr == nil {
+		log.Warnf("Unable to determine if dcrd has addrindex: no address " +
+			"in the coinbase of block 1")
+		return n
+	}
+	_, err = dcrd.SearchRawTransactions(addr, 0, 1, false, nil)
+	n.AddrIndex = !isIndexDisabledErr(err, "addrindex")
+	// An address without transactions is not an error of the index.
+	if err != nil && n.AddrIndex &&
+		!strings.Contains(err.Error(), "No information") {
+		log.Warnf("Unable to determine if dcrd has addrindex: %v", err)
+	}
+	return n
+}
+
+// require returns true if the index ("txindex" or "addrindex") is enabled,
+// and otherwise logs that the feature requiring it is disabled.
+func (n *nodeIndexes) require(index, feature string) bool {
+	enabled := n.TxIndex
+	if index == "addrindex" {
+		enabled = n.AddrIndex
+	}
+	if !enabled {
+		log.Warnf("%s is disabled: dcrd is not running with --%s.", feature,
+			index)
+	}
+	return enabled
+}
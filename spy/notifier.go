@@ -0,0 +1,142 @@
+// notifier.go defines Notifier, a channel of watched address notifications
+// (e.g. email, Telegram or Discord), and the registry of the configured
+// notifiers.  Run registers each notifier as it is configured, and a watched
+// address notification is sent to every registered notifier of its owner, so
+// that any combination of channels may be enabled, and a new channel only
+// needs to implement Notifier and be registered.
+
+package spy
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Notifier is implemented by the channels of watched address notifications.
+type Notifier interface {
+	// Notify sends, or queues for sending, the notification of the watched
+	// address event.  It should not block.
+	Notify(e *spyEvent) error
+}
+
+// deliveryNotifier is implemented by a Notifier that reports the completion of
+// its queued notifications, by calling the event's delivered method once the
+// notification has been sent, or has failed or been dropped, but not if
+// Notify returns an error.  Other notifiers have delivered a notification once
+// Notify returns.
+type deliveryNotifier interface {
+	Notifier
+	tracksDelivery()
+}
+
+// queuedText is a text message queued by a notifier, with the event it
+// notifies, if any, whose delivered method is called once it has been sent.
+type queuedText struct {
+	text  string
+	event *spyEvent
+}
+
+// tenantNotifier is implemented by a Notifier that also notifies tenants.
+// Other notifiers only notify the operator.
+type tenantNotifier interface {
+	Notifier
+	// notifiesTenant returns true if the tenant may be notified.
+	notifiesTenant(t *tenant) bool
+}
+
+// namedNotifier is a registered notifier and its name.
+type namedNotifier struct {
+	name     string
+	notifier Notifier
+}
+
+// notifierRegistry holds the registered notifiers, in the order they were
+// registered.
+type notifierRegistry struct {
+	mtx       sync.RWMutex
+	notifiers []namedNotifier
+}
+
+// spyNotifiers is the package-level notifier registry, created by Run.
+var spyNotifiers *notifierRegistry
+
+func newNotifierRegistry() *notifierRegistry {
+	return &notifierRegistry{}
+}
+
+// register adds the notifier with the name (e.g. telegram), which must be
+// unique.
+func (r *notifierRegistry) register(name string, n Notifier) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, nn := range r.notifiers {
+		if nn.name == name {
+			return fmt.Errorf("notifier %s already registered", name)
+		}
+	}
+	r.notifiers = append(r.notifiers, namedNotifier{name, n})
+	log.Debugf("Registered %s notifier", name)
+	return nil
+}
+
+// count returns the number of registered notifiers.
+func (r *notifierRegistry) count() int {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return len(r.notifiers)
+}
+
+// forOwner returns the notifiers of the owner: all notifiers for the
+// operator, and those notifying the tenant for a tenant.
+func (r *notifierRegistry) forOwner(owner string) []namedNotifier {
+	if r == nil {
+		return nil
+	}
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if owner == operatorOwner {
+		return append([]namedNotifier(nil), r.notifiers...)
+	}
+
+	t := spyTenants.lookup(owner)
+	if t == nil {
+		return nil
+	}
+	var notifiers []namedNotifier
+	for _, nn := range r.notifiers {
+		if tn, ok := nn.notifier.(tenantNotifier); ok && tn.notifiesTenant(t) {
+			notifiers = append(notifiers, nn)
+		}
+	}
+	return notifiers
+}
+
+// notifyOwner sends a notification of a watched address event to the owner of
+// the address, e.Tenant, with each of the owner's notifiers, unless the owner
+// muted them, or it is a duplicate or over the rate limit.  A notifier that fails is logged, and does
+// not prevent the others from sending.
+func notifyOwner(e *spyEvent) {
+	notifiers := spyNotifiers.forOwner(e.Tenant)
+	if len(notifiers) == 0 || spyNotifyMutes.muted(e) {
+		return
+	}
+	if !spyNotifyLimiter.allow(e) {
+		return
+	}
+	spyUsage.notification(e.Tenant)
+	spyAddrStats.notification(e)
+	for _, nn := range notifiers {
+		_, tracked := nn.notifier.(deliveryNotifier)
+		if e.deliveries != nil {
+			e.deliveries.add()
+		}
+		err := nn.notifier.Notify(e)
+		if err != nil {
+			log.Warnf("Failed to send %s notification of %s[out:%d]: %v",
+				nn.name, e.TxID, e.Vout, err)
+		}
+		if err != nil || !tracked {
+			e.delivered()
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// notifylimit.go limits the watched address notifications sent to each owner
+// across all channels.  Duplicates are suppressed within the notifydedup
+// window: a notification of a transaction output to a watched address is sent
+// once, so that a transaction notified in mempool is not notified again, near
+// identically, when mined.  The compact follow-up of the followup policy is
+// not a duplicate.  With notifyratelimit, at most that many notifications are
+// sent to each owner per notifyrateperiod, so that a burst of transactions
+// (e.g. a block paying many watched addresses) does not send hundreds of
+// messages.  Suppressed notifications are logged and counted, and their
+// events are still published.
+
+package spy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// notifyRateWindow counts the notifications to an owner in the current rate
+// period.
+type notifyRateWindow struct {
+	start   time.Time
+	sent    int
+	dropped int
+}
+
+// notifyLimiter suppresses duplicate notifications and limits their rate.
+type notifyLimiter struct {
+	mtx sync.Mutex
+	// dedup is the window of duplicate suppression, 0 if disabled.  seen
+	// holds the time each notification key was sent within it.
+	dedup time.Duration
+	seen  map[string]time.Time
+	// limit is the number of notifications per period to each owner, 0 if
+	// unlimited.  windows are by owner.
+	limit   int
+	period  time.Duration
+	windows map[string]*notifyRateWindow
+
+	duplicates, limited *metricCounter
+}
+
+// spyNotifyLimiter is the package-level notification limiter, nil if neither
+// duplicate suppression nor rate limiting is enabled.
+var spyNotifyLimiter *notifyLimiter
+
+// newNotifyLimiter creates a notifyLimiter suppressing duplicates within
+// dedup, and sending at most limit notifications per period to each owner.
+func newNotifyLimiter(dedup time.Duration, limit int,
+	period time.Duration) (*notifyLimiter, error) {
+	if dedup < 0 {
+		return nil, fmt.Errorf("invalid notifydedup %v", dedup)
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("invalid notifyratelimit %d", limit)
+	}
+	if limit > 0 && period <= 0 {
+		return nil, fmt.Errorf("invalid notifyrateperiod %v", period)
+	}
+	return &notifyLimiter{
+		dedup:   dedup,
+		seen:    make(map[string]time.Time),
+		limit:   limit,
+		period:  period,
+		windows: make(map[string]*notifyRateWindow),
+		duplicates: spyMetrics.newCounter(
+			"dcrspy_notifications_duplicate_total",
+			"Watched address notifications suppressed as duplicates."),
+		limited: spyMetrics.newCounter(
+			"dcrspy_notifications_rate_limited_total",
+			"Watched address notifications dropped by the rate limit."),
+	}, nil
+}
+
+// notifyDedupKey identifies the notification of the event to its owner.  The
+// mined and mempool notifications of a transaction output have the same key,
+// and its follow-up another.
+func notifyDedupKey(e *spyEvent) string {
+	kind := "tx"
+	if e.followUp {
+		kind = "followup"
+	}
+	return fmt.Sprintf("%s/%s/%s:%d/%s", e.Tenant, e.Address, e.TxID,
+		e.Vout, kind)
+}
+
+// allow returns true if the notification of the event may be sent to its
+// owner, recording it, or false if it is a duplicate or over the rate limit.
+func (l *notifyLimiter) allow(e *spyEvent) bool {
+	if l == nil {
+		return true
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+
+	var key string
+	if l.dedup > 0 {
+		for k, t := range l.seen {
+			if now.Sub(t) >= l.dedup {
+				delete(l.seen, k)
+			}
+		}
+		key = notifyDedupKey(e)
+		if _, ok := l.seen[key]; ok {
+			l.duplicates.inc()
+			log.Debugf("Suppressed duplicate %s notification of %s[out:%d] "+
+				"to %s.", e.Action, e.TxID, e.Vout, e.Address)
+			return false
+		}
+	}
+
+	if l.limit > 0 {
+		w := l.windows[e.Tenant]
+		if w == nil || now.Sub(w.start) >= l.period {
+			if w != nil && w.dropped > 0 {
+				log.Warnf("%d notification(s) to %s dropped by the rate "+
+					"limit of %d per %v.", w.dropped, ownerName(e.Tenant),
+					l.limit, l.period)
+			}
+			w = &notifyRateWindow{start: now}
+			l.windows[e.Tenant] = w
+		}
+		if w.sent >= l.limit {
+			if w.dropped == 0 {
+				log.Warnf("Notification rate limit of %d per %v reached "+
+					"for %s. Dropping notifications until %v.", l.limit,
+					l.period, ownerName(e.Tenant), w.start.Add(l.period))
+			}
+			w.dropped++
+			l.limited.inc()
+			return false
+		}
+		w.sent++
+	}
+
+	if key != "" {
+		l.seen[key] = now
+	}
+	return true
+}
+
+// ownerName names the owner in log messages.
+func ownerName(owner string) string {
+	if owner == operatorOwner {
+		return "the operator"
+	}
+	return "tenant " + owner
+}
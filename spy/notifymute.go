@@ -0,0 +1,158 @@
+// notifymute.go lets the operator role mute the watched address notifications
+// of an owner (the operator or a tenant) for a while, e.g. during maintenance
+// or a known burst of transactions, with POST /api/mute, and unmute them with
+// DELETE /api/mute.  Muted notifications are logged and counted, and their
+// events are still published.  Mutes are not kept across restarts.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxMuteDuration is the longest that notifications may be muted.
+const maxMuteDuration = 7 * 24 * time.Hour
+
+// notifyMutes holds until when the notifications of each owner are muted.
+type notifyMutes struct {
+	mtx   sync.Mutex
+	until map[string]time.Time
+}
+
+// spyNotifyMutes is the package-level set of muted owners.
+var spyNotifyMutes = newNotifyMutes()
+
+// spyNotifyMuted counts the notifications not sent while muted.
+var spyNotifyMuted = spyMetrics.newCounter(
+	"dcrspy_notifications_muted_total",
+	"Watched address notifications not sent while muted.")
+
+func newNotifyMutes() *notifyMutes {
+	return &notifyMutes{until: make(map[string]time.Time)}
+}
+
+// mute mutes the owner's notifications until the time.
+func (m *notifyMutes) mute(owner string, until time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.until[owner] = until
+	log.Infof("Notifications to %s muted until %v.", ownerName(owner),
+		until.Format(time.RFC3339))
+}
+
+// unmute unmutes the owner's notifications, returning true if they were muted.
+func (m *notifyMutes) unmute(owner string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	until, ok := m.until[owner]
+	delete(m.until, owner)
+	if !ok || !time.Now().Before(until) {
+		return false
+	}
+	log.Infof("Notifications to %s unmuted.", ownerName(owner))
+	return true
+}
+
+// mutedUntil returns until when the owner's notifications are muted, or the
+// zero time if they are not.
+func (m *notifyMutes) mutedUntil(owner string) time.Time {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	until, ok := m.until[owner]
+	if !ok {
+		return time.Time{}
+	}
+	if !time.Now().Before(until) {
+		delete(m.until, owner)
+		log.Infof("Notifications to %s are no longer muted.",
+			ownerName(owner))
+		return time.Time{}
+	}
+	return until
+}
+
+// muted returns true if the notification of the event to its owner is muted,
+// counting it.
+func (m *notifyMutes) muted(e *spyEvent) bool {
+	if m.mutedUntil(e.Tenant).IsZero() {
+		return false
+	}
+	spyNotifyMuted.inc()
+	log.Debugf("Muted %s notification of %s[out:%d] to %s.", e.Action,
+		e.TxID, e.Vout, e.Address)
+	return true
+}
+
+// muteRequest is the body of POST /api/mute.
+type muteRequest struct {
+	// Duration is how long to mute, e.g. "2h".
+	Duration string `json:"duration"`
+}
+
+// muteState is the response of /api/mute.  Until is the unix time until which
+// notifications are muted, 0 if they are not.
+type muteState struct {
+	Muted bool  `json:"muted"`
+	Until int64 `json:"until,omitempty"`
+}
+
+// muteAPI documents muteHandler.
+var muteAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "Get whether watched address notifications are muted",
+	response: muteState{},
+}, {
+	method:  "POST",
+	summary: "Mute watched address notifications for a duration",
+	description: fmt.Sprintf("The duration is e.g. 90m or 2h, at most %v.",
+		maxMuteDuration),
+	request:  muteRequest{},
+	response: muteState{},
+}, {
+	method:  "DELETE",
+	summary: "Unmute watched address notifications",
+	status:  http.StatusNoContent,
+}}
+
+// muteHandler is a tenantHandler for /api/mute, muting the notifications of
+// the owner.
+func muteHandler(w http.ResponseWriter, r *http.Request, t *tenant) {
+	owner := t.owner()
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req muteRequest
+		r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxMuteDuration {
+			http.Error(w, fmt.Sprintf("invalid duration (expected e.g. 2h, "+
+				"at most %v)", maxMuteDuration), http.StatusBadRequest)
+			return
+		}
+		spyNotifyMutes.mute(owner, time.Now().Add(d))
+		auditDetail(w, "", "mute notifications for %v", d)
+	case "DELETE":
+		spyNotifyMutes.unmute(owner)
+		auditDetail(w, "", "unmute notifications")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var state muteState
+	if until := spyNotifyMutes.mutedUntil(owner); !until.IsZero() {
+		state = muteState{Muted: true, Until: until.Unix()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
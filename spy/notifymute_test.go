@@ -0,0 +1,68 @@
+package spy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMuteHandler(t *testing.T) {
+	spyNotifyMutes = newNotifyMutes()
+	defer func() { spyNotifyMutes = newNotifyMutes() }()
+	alice := &tenant{Name: "alice"}
+	e := &spyEvent{Type: eventTypeWatchedAddr, Tenant: "alice"}
+
+	tests := []struct {
+		method, body string
+		wantStatus   int
+		wantMuted    bool
+	}{
+		{"GET", "", http.StatusOK, false},
+		{"POST", `{"duration": "0s"}`, http.StatusBadRequest, false},
+		{"POST", `{"duration": "-1h"}`, http.StatusBadRequest, false},
+		{"POST", `{"duration": "200h"}`, http.StatusBadRequest, false},
+		{"POST", `{"duration": "soon"}`, http.StatusBadRequest, false},
+		{"POST", `{"duration": `, http.StatusBadRequest, false},
+		{"POST", `{"duration": "2h"}`, http.StatusOK, true},
+		{"GET", "", http.StatusOK, true},
+		{"PUT", "", http.StatusMethodNotAllowed, true},
+		{"DELETE", "", http.StatusNoContent, false},
+		{"GET", "", http.StatusOK, false},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		muteHandler(w, httptest.NewRequest(tt.method, "/api/mute",
+			strings.NewReader(tt.body)), alice)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%d: %s %s: got status %d, want %d", i, tt.method,
+				tt.body, w.Code, tt.wantStatus)
+		}
+		if w.Code == http.StatusOK {
+			var state muteState
+			if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+				t.Fatal(err)
+			}
+			if state.Muted != tt.wantMuted || (state.Until != 0) != tt.wantMuted {
+				t.Errorf("%d: %s %s: got %+v, want muted %v", i, tt.method,
+					tt.body, state, tt.wantMuted)
+			}
+		}
+		if muted := spyNotifyMutes.muted(e); muted != tt.wantMuted {
+			t.Errorf("%d: %s %s: muted %v, want %v", i, tt.method, tt.body,
+				muted, tt.wantMuted)
+		}
+		// Only the owner's notifications are muted.
+		if spyNotifyMutes.muted(&spyEvent{Tenant: operatorOwner}) {
+			t.Errorf("%d: muted the operator", i)
+		}
+	}
+
+	// Mutes expire.
+	spyNotifyMutes.mute("alice", time.Now().Add(-time.Second))
+	if spyNotifyMutes.muted(e) {
+		t.Error("muted after the mute expired")
+	}
+}
@@ -0,0 +1,158 @@
+// notifypool.go bounds the concurrency of notification sends, so that a burst
+// of events or alerts does not open hundreds of simultaneous SMTP connections.
+// Sends are submitted to the pool by channel (e.g. email), and run by the
+// channel's workers, at most notifyconcurrency of the channel at once, and at
+// most notifyworkers across all channels.  Sends that do not fit in a
+// channel's queue are dropped.
+
+package spy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// notifyPoolQueueSize is the number of sends of a channel waiting for a
+	// worker, beyond which new sends are dropped.
+	notifyPoolQueueSize = 500
+	// defaultChannelConcurrency is the concurrency of a channel without a
+	// notifyconcurrency limit.
+	defaultChannelConcurrency = 2
+)
+
+// notifyPool runs the submitted sends.
+type notifyPool struct {
+	// global is a semaphore of the workers of all channels.
+	global chan struct{}
+	limits map[string]int
+
+	mtx    sync.Mutex
+	queues map[string]chan func()
+	wg     sync.WaitGroup
+	quit   <-chan struct{}
+}
+
+// spyNotifyPool is the package-level notification pool.  Sends are run in
+// their own goroutines if it is nil.
+var spyNotifyPool *notifyPool
+
+// newNotifyPool creates a notifyPool with the number of workers across all
+// channels, and the concurrency limits of channels, given as CHANNEL:N (e.g.
+// email:2).  Its workers quit when quit is closed, after running the queued
+// sends.
+func newNotifyPool(workers int, limits []string,
+	quit <-chan struct{}) (*notifyPool, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("invalid notifyworkers %d", workers)
+	}
+	p := &notifyPool{
+		global: make(chan struct{}, workers),
+		limits: make(map[string]int),
+		queues: make(map[string]chan func()),
+		quit:   quit,
+	}
+	for _, l := range limits {
+		fields := strings.Split(l, ":")
+		if len(fields) != 2 || !knownNotifyChannel(fields[0]) {
+			return nil, fmt.Errorf("invalid notifyconcurrency %q (expected "+
+				"CHANNEL:N, where CHANNEL is one of %s)", l,
+				strings.Join(notifyChannels, ", "))
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid notifyconcurrency %q", l)
+		}
+		p.limits[fields[0]] = n
+	}
+	return p, nil
+}
+
+// limit returns the concurrency of the channel, no more than the number of
+// workers.
+func (p *notifyPool) limit(channel string) int {
+	n, ok := p.limits[channel]
+	if !ok {
+		n = defaultChannelConcurrency
+	}
+	if n > cap(p.global) {
+		n = cap(p.global)
+	}
+	return n
+}
+
+// submit runs the send f on the channel.  It does not block, except when the
+// workers are quitting, in which case f is run before returning.  It returns
+// false if the send was dropped.
+func (p *notifyPool) submit(channel string, f func()) bool {
+	if p == nil {
+		go f()
+		return true
+	}
+	select {
+	case <-p.quit:
+		// The workers are quitting.
+		f()
+		return true
+	default:
+	}
+	p.mtx.Lock()
+	queue, ok := p.queues[channel]
+	if !ok {
+		queue = make(chan func(), notifyPoolQueueSize)
+		p.queues[channel] = queue
+		for i := p.limit(channel); i > 0; i-- {
+			p.wg.Add(1)
+			go p.worker(queue)
+		}
+		log.Debugf("Started %d %s notification worker(s)", p.limit(channel),
+			channel)
+	}
+	p.mtx.Unlock()
+
+	select {
+	case queue <- f:
+		return true
+	default:
+		log.Warnf("%s notification queue full. Dropping a notification.",
+			channel)
+		return false
+	}
+}
+
+// worker runs the sends of a channel's queue until quit is closed, and then
+// those still queued.
+func (p *notifyPool) worker(queue chan func()) {
+	defer p.wg.Done()
+	run := func(f func()) {
+		p.global <- struct{}{}
+		defer func() { <-p.global }()
+		f()
+	}
+	for {
+		select {
+		case f := <-queue:
+			run(f)
+		case <-p.quit:
+			for {
+				select {
+				case f := <-queue:
+					run(f)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// run waits for the workers to quit, once quit is closed.  It should be run as
+// a goroutine.
+func (p *notifyPool) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	<-p.quit
+	p.wg.Wait()
+	log.Debugf("Quitting notification pool.")
+}
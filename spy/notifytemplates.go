@@ -0,0 +1,301 @@
+// notifytemplates.go renders the notifications of events with text/template
+// templates for each notification channel and event type, so that, e.g., a
+// text message or Telegram message can be short while an email is detailed and
+// a Discord or Slack message uses markdown.  Templates are read from a
+// directory with files named CHANNEL_TYPE.tmpl (e.g. telegram_watchedaddr.tmpl),
+// or CHANNEL.tmpl for any event type of a channel.  The built-in templates are
+// used for the pairs without a file.
+//
+// Templates are executed with the event's fields (e.g. {{.Address}},
+// {{.Amount}}, {{.Fiat}}, {{.Message}}), {{.Currency}}, the fiat currency,
+// {{.Label}}, the label of the address, {{.TxURL}}, {{.AddrURL}} and
+// {{.BlockURL}}, the links of the transaction, address and block to a block
+// explorer (see explorer.go), and {{.FollowUp}}.  The compact follow-up of a
+// mined transaction that was notified in mempool is rendered with the
+// templates of the followup type (e.g. telegram_followup.tmpl).
+//
+// The webhook, mqtt, nats and amqp channels have no built-in templates: their
+// payload is the event as JSON, unless a template is read for them, e.g. to
+// POST the message format of a chat service's incoming webhook.  The json
+// function encodes a value as JSON, for such payloads (e.g.
+// {"text": {{json .Message}}}).
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Notification channels
+const (
+	notifyChannelEmail    = "email"
+	notifyChannelTelegram = "telegram"
+	notifyChannelDiscord  = "discord"
+	notifyChannelSlack    = "slack"
+	notifyChannelSMS      = "sms"
+	notifyChannelPushover = "pushover"
+	notifyChannelMatrix   = "matrix"
+	notifyChannelIRC      = "irc"
+	notifyChannelXMPP     = "xmpp"
+	notifyChannelDesktop  = "desktop"
+	notifyChannelWebhook  = "webhook"
+	notifyChannelMQTT     = "mqtt"
+	notifyChannelNATS     = "nats"
+	notifyChannelAMQP     = "amqp"
+)
+
+// notifyChannels are the channels that may have templates.
+var notifyChannels = []string{notifyChannelEmail, notifyChannelTelegram,
+	notifyChannelDiscord, notifyChannelSlack, notifyChannelSMS,
+	notifyChannelPushover, notifyChannelMatrix, notifyChannelIRC,
+	notifyChannelXMPP, notifyChannelDesktop, notifyChannelWebhook,
+	notifyChannelMQTT, notifyChannelNATS, notifyChannelAMQP}
+
+// defaultNotifyTemplate is the built-in template of the pairs without one in
+// builtinNotifyTemplateText.
+const defaultNotifyTemplate = "{{.Message}}"
+
+// notifyTypeFollowUp is the type of the templates of follow-up notifications.
+const notifyTypeFollowUp = "followup"
+
+// emailWatchedAddrTemplate is the built-in template of watched address
+// emails, which Matrix and XMPP messages mirror.
+const emailWatchedAddrTemplate = `{{.Message}}` +
+	`{{with .Fiat}}
+Value: {{printf "%.2f" .}} {{$.Currency}}{{end}}` +
+	`{{with .TxURL}}
+Transaction: {{.}}{{end}}` +
+	`{{with .AddrURL}}
+Address: {{.}}{{end}}` +
+	`{{with .BlockURL}}
+Block: {{.}}{{end}}`
+
+// builtinNotifyTemplateText are the built-in templates, by CHANNEL_TYPE.
+var builtinNotifyTemplateText = map[string]string{
+	notifyChannelEmail + "_" + eventTypeWatchedAddr:  emailWatchedAddrTemplate,
+	notifyChannelMatrix + "_" + eventTypeWatchedAddr: emailWatchedAddrTemplate,
+	notifyChannelXMPP + "_" + eventTypeWatchedAddr:   emailWatchedAddrTemplate,
+	notifyChannelTelegram + "_" + eventTypeWatchedAddr: `` +
+		`{{if eq .Action "mined"}}Block {{.Height}}{{else}}Mempool{{end}}: ` +
+		`+{{printf "%.6f" .Amount}} DCR` +
+		`{{with .Fiat}} ({{printf "%.2f" .}} {{$.Currency}}){{end}} ` +
+		`to {{.Address}}
+{{or .TxURL .TxID}}{{if not .TxURL}}:{{.Vout}}{{end}}`,
+	notifyChannelDiscord + "_" + eventTypeWatchedAddr: `` +
+		`Watched address ` +
+		`{{if .AddrURL}}**[{{.Address}}]({{.AddrURL}})**` +
+		`{{else}}**{{.Address}}**{{end}} received ` +
+		`**{{printf "%.6f" .Amount}} DCR** ` +
+		`{{if eq .Action "mined"}}in block ` +
+		`{{if .BlockURL}}[{{.Height}}]({{.BlockURL}}){{else}}{{.Height}}{{end}}` +
+		`{{else}}in the mempool{{end}}.`,
+	notifyChannelSlack + "_" + eventTypeWatchedAddr: `` +
+		`Watched address ` +
+		`{{if .AddrURL}}*<{{.AddrURL}}|{{.Address}}>*` +
+		`{{else}}*{{.Address}}*{{end}} received ` +
+		`*{{printf "%.6f" .Amount}} DCR* ` +
+		`{{if eq .Action "mined"}}in block ` +
+		`{{if .BlockURL}}<{{.BlockURL}}|{{.Height}}>{{else}}{{.Height}}{{end}}` +
+		`{{else}}in the mempool{{end}}.`,
+	notifyChannelPushover + "_" + eventTypeWatchedAddr: `` +
+		`+{{printf "%.6f" .Amount}} DCR` +
+		`{{with .Fiat}} ({{printf "%.2f" .}} {{$.Currency}}){{end}} ` +
+		`to {{.Address}} ` +
+		`{{if eq .Action "mined"}}in block {{.Height}}` +
+		`{{else}}in the mempool{{end}}`,
+	notifyChannelIRC + "_" + eventTypeWatchedAddr: `` +
+		`{{if eq .Action "mined"}}Block {{.Height}}{{else}}Mempool{{end}}: ` +
+		`+{{printf "%.6f" .Amount}} DCR` +
+		`{{with .Fiat}} ({{printf "%.2f" .}} {{$.Currency}}){{end}} ` +
+		`to {{.Address}} in {{or .TxURL .TxID}}`,
+	notifyChannelDesktop + "_" + eventTypeWatchedAddr: `` +
+		`+{{printf "%.6f" .Amount}} DCR` +
+		`{{with .Fiat}} ({{printf "%.2f" .}} {{$.Currency}}){{end}} ` +
+		`to {{.Address}} ` +
+		`{{if eq .Action "mined"}}in block {{.Height}}` +
+		`{{else}}in the mempool{{end}}`,
+	notifyChannelSMS + "_" + eventTypeWatchedAddr: `` +
+		`dcrspy: +{{printf "%.2f" .Amount}} DCR to {{.Address}} ` +
+		`({{.Action}})`,
+	notifyChannelSMS + "_" + eventTypeColdAudit: `` +
+		`dcrspy: cold storage {{.Address}} spent ` +
+		`{{printf "%.2f" .Amount}} DCR`,
+	// The follow-up of any channel
+	notifyTypeFollowUp: `` +
+		`Confirmed in block {{.Height}}: {{or .Label .Address}} ` +
+		`{{.TxID}}:{{.Vout}}`,
+}
+
+// notifyTemplateFuncs are the functions of the templates.
+var notifyTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// builtinNotifyTemplates are the parsed builtinNotifyTemplateText.
+var builtinNotifyTemplates = parseBuiltinNotifyTemplates()
+
+// parseBuiltinNotifyTemplates parses builtinNotifyTemplateText and
+// defaultNotifyTemplate, with the key "" for the latter.
+func parseBuiltinNotifyTemplates() map[string]*template.Template {
+	tmpls := map[string]*template.Template{
+		"": template.Must(template.New("default").Funcs(notifyTemplateFuncs).
+			Parse(defaultNotifyTemplate)),
+	}
+	for name, text := range builtinNotifyTemplateText {
+		tmpls[name] = template.Must(template.New(name).
+			Funcs(notifyTemplateFuncs).Parse(text))
+	}
+	return tmpls
+}
+
+// notifyTemplateData is the data with which templates are executed.
+type notifyTemplateData struct {
+	*spyEvent
+	Currency string
+	Label    string
+	TxURL    string
+	AddrURL  string
+	BlockURL string
+	FollowUp bool
+}
+
+// spyAddrLabels are the labels of watched addresses, given with watchaddress.
+var spyAddrLabels = make(map[string]string)
+
+// newNotifyTemplateData returns the data with which templates are executed
+// for the event.
+func newNotifyTemplateData(e *spyEvent) *notifyTemplateData {
+	data := &notifyTemplateData{
+		spyEvent: e,
+		Label:    spyAddrLabels[e.Address],
+		TxURL:    spyExplorer.tx(e.TxID),
+		AddrURL:  spyExplorer.address(e.Address),
+		BlockURL: spyExplorer.eventBlock(e),
+		FollowUp: e.followUp,
+	}
+	if spyExchangeRate != nil {
+		data.Currency = strings.ToUpper(spyExchangeRate.currency)
+	}
+	return data
+}
+
+// notifyTemplates are the templates read from a directory, by CHANNEL_TYPE or
+// CHANNEL.
+type notifyTemplates struct {
+	tmpls map[string]*template.Template
+}
+
+// spyNotifyTemplates is the package-level set of templates, nil if no template
+// directory is configured, in which case the built-in templates are used.
+var spyNotifyTemplates *notifyTemplates
+
+// loadNotifyTemplates reads the templates in the directory.  Each .tmpl file
+// must be named for a channel, optionally followed by _ and an event type.
+func loadNotifyTemplates(dir string) (*notifyTemplates, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	n := &notifyTemplates{tmpls: make(map[string]*template.Template)}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		channel := strings.SplitN(name, "_", 2)[0]
+		if !knownNotifyChannel(channel) {
+			return nil, fmt.Errorf("template %s is not for a channel (%s)",
+				file, strings.Join(notifyChannels, ", "))
+		}
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		// Editors usually end files with a newline, which is not part of the
+		// notification.
+		tmpl, err := template.New(name).Funcs(notifyTemplateFuncs).Parse(
+			strings.TrimSuffix(string(text), "\n"))
+		if err != nil {
+			return nil, err
+		}
+		n.tmpls[name] = tmpl
+	}
+	return n, nil
+}
+
+// knownNotifyChannel returns true if the channel is one of notifyChannels.
+func knownNotifyChannel(channel string) bool {
+	for _, c := range notifyChannels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the template of the channel and event type: the template
+// read for the pair, or else for the channel, or else the built-in template
+// for the pair, or else for the type, or else defaultNotifyTemplate.
+func (n *notifyTemplates) lookup(channel, eventType string) *template.Template {
+	pair := channel + "_" + eventType
+	if n != nil {
+		if tmpl, ok := n.tmpls[pair]; ok {
+			return tmpl
+		}
+		if tmpl, ok := n.tmpls[channel]; ok {
+			return tmpl
+		}
+	}
+	if tmpl, ok := builtinNotifyTemplates[pair]; ok {
+		return tmpl
+	}
+	if tmpl, ok := builtinNotifyTemplates[eventType]; ok {
+		return tmpl
+	}
+	return builtinNotifyTemplates[""]
+}
+
+// render returns the notification of the event on the channel.  If the
+// template fails, the event's message is the notification.
+func (n *notifyTemplates) render(channel string, e *spyEvent) string {
+	eventType := e.Type
+	if e.followUp {
+		eventType = notifyTypeFollowUp
+	}
+	var buf bytes.Buffer
+	err := n.lookup(channel, eventType).Execute(&buf, newNotifyTemplateData(e))
+	if err != nil {
+		log.Warnf("Failed to render %s notification of a %s event: %v",
+			channel, e.Type, err)
+		return e.Message
+	}
+	return buf.String()
+}
+
+// payload returns the payload of the event on the webhook, mqtt, nats or amqp
+// channel: the rendered template read for the channel, if any, or else the
+// event as JSON.
+func (n *notifyTemplates) payload(channel string, e *spyEvent) ([]byte, error) {
+	if n != nil {
+		tmpl, ok := n.tmpls[channel+"_"+e.Type]
+		if !ok {
+			tmpl, ok = n.tmpls[channel]
+		}
+		if ok {
+			var buf bytes.Buffer
+			err := tmpl.Execute(&buf, newNotifyTemplateData(e))
+			if err != nil {
+				return nil, fmt.Errorf("failed to render %s payload of a %s "+
+					"event: %v", channel, e.Type, err)
+			}
+			return buf.Bytes(), nil
+		}
+	}
+	return json.Marshal(e)
+}
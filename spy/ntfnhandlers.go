@@ -1,4 +1,4 @@
-package main
+package spy
 
 import (
 	"bytes"
@@ -19,7 +19,13 @@ import (
 // cfg.CmdArgs    // e.g. "127.0.0.1,-n-8"
 
 // Define notification handlers
-func getNodeNtfnHandlers(cfg *config) *dcrrpcclient.NotificationHandlers {
+func getNodeNtfnHandlers(cfg *Config) *dcrrpcclient.NotificationHandlers {
+	// Blocks are dispatched to the monitors in order of height.
+	spyBlockReorder = newBlockReorderer(cfg.ReorderWindow,
+		func(hash *chainhash.Hash, height int32) {
+			dispatchBlockConnected(cfg, hash, height)
+		})
+
 	return &dcrrpcclient.NotificationHandlers{
 		OnBlockConnected: func(blockHeaderSerialized []byte, transactions [][]byte) {
 			// OnBlockConnected: func(hash *chainhash.Hash, height int32,
@@ -31,62 +37,28 @@ func getNodeNtfnHandlers(cfg *config) *dcrrpcclient.NotificationHandlers {
 			}
 			height := int32(blockHeader.Height)
 			hash := blockHeader.BlockHash()
-			select {
-			case spyChans.connectChan <- &hash:
-				// Past this point in this case is command execution. Block
-				// height was sent on connectChan, so move on if no command.
-				cmdName := cfg.CmdName
-				if len(cmdName) == 0 {
-					break
-				}
-
-				// replace %h and %n with hash and block height, resp.
-				rep := strings.NewReplacer("%h", hash.String(), "%n",
-					strconv.Itoa(int(height)))
-				var argSubst bytes.Buffer
-				rep.WriteString(&argSubst, cfg.CmdArgs)
-
-				// Split the argument string by comma
-				argsSplit := strings.Split(argSubst.String(), ",")
-
-				// Create command, with substituted args
-				cmd := exec.Command(cmdName, argsSplit...)
-				// Get a pipe for stdout
-				outpipe, err := cmd.StdoutPipe()
-				if err != nil {
-					log.Critical(err)
-				}
-				// Send stderr to the same place
-				cmd.Stderr = cmd.Stdout
-
-				// Display the full command being executed
-				execLog.Debugf("Full command line to be executed: %s %s",
-					cmd.Path, strings.Join(argsSplit, " "))
-
-				// Channel for logger and command execution routines to talk
-				cmdDone := make(chan error)
-				go execLogger(outpipe, cmdDone)
-
-				// Start command and return from handler without waiting
-				go func() {
-					if err := cmd.Run(); err != nil {
-						execLog.Errorf("Failed to start system command %v. Error: %v",
-							cmdName, err)
-					}
-					// Signal the logger goroutine, and clean up
-					cmdDone <- err
-					close(cmdDone)
-				}()
-			// send to nil channel blocks
-			default:
+			// dcrd may notify of the same block again, e.g. after a
+			// reconnect.  It is processed once.
+			if !spyBlockDedup.connected(&hash) {
+				log.Infof("Ignoring duplicate notification of block %v "+
+					"(height %d).", hash, height)
+				return
 			}
-
-			// Also send on stake info channel, if enabled.
-			select {
-			case spyChans.connectChanStkInf <- height:
-			// send to nil channel blocks
-			default:
+			pipelineLatency.blockReceived(int64(height), time.Now())
+			spyBlockReorder.connected(&hash, height)
+		},
+		OnBlockDisconnected: func(blockHeaderSerialized []byte) {
+			blockHeader := new(wire.BlockHeader)
+			if err := blockHeader.FromBytes(blockHeaderSerialized); err != nil {
+				log.Error("Failed to deserialize blockHeader in block " +
+					"disconnected notification.")
+				return
 			}
+			hash := blockHeader.BlockHash()
+			log.Infof("Block %v (height %d) disconnected.", hash,
+				blockHeader.Height)
+			spyBlockDedup.disconnected(&hash)
+			spyDataCache.disconnected(int64(blockHeader.Height))
 		},
 		// Not too useful since this notifies on every block
 		OnStakeDifficulty: func(hash *chainhash.Hash, height int64,
@@ -96,7 +68,7 @@ func getNodeNtfnHandlers(cfg *config) *dcrrpcclient.NotificationHandlers {
 			default:
 			}
 		},
-		// TODO
+		// Tickets called to vote on the new block
 		OnWinningTickets: func(blockHash *chainhash.Hash, blockHeight int64,
 			tickets []*chainhash.Hash) {
 			var txstr []string
@@ -104,6 +76,7 @@ func getNodeNtfnHandlers(cfg *config) *dcrrpcclient.NotificationHandlers {
 				txstr = append(txstr, t.String())
 			}
 			log.Debugf("Winning tickets: %v", strings.Join(txstr, ", "))
+			spyVoteExpect.winningTickets(blockHash, blockHeight, tickets)
 		},
 		// maturing tickets
 		// BUG: dcrrpcclient/notify.go (parseNewTicketsNtfnParams) is unable to
@@ -150,7 +123,68 @@ func getNodeNtfnHandlers(cfg *config) *dcrrpcclient.NotificationHandlers {
 	}
 }
 
-func getWalletNtfnHandlers(cfg *config) *dcrrpcclient.NotificationHandlers {
+// dispatchBlockConnected sends the connected block to the block data and
+// stake info monitors, and executes the configured command.
+func dispatchBlockConnected(cfg *Config, hash *chainhash.Hash, height int32) {
+	select {
+	case spyChans.connectChan <- hash:
+		// Past this point in this case is command execution. Block
+		// height was sent on connectChan, so move on if no command.
+		cmdName := cfg.CmdName
+		if len(cmdName) == 0 {
+			break
+		}
+
+		// replace %h and %n with hash and block height, resp.
+		rep := strings.NewReplacer("%h", hash.String(), "%n",
+			strconv.Itoa(int(height)))
+		var argSubst bytes.Buffer
+		rep.WriteString(&argSubst, cfg.CmdArgs)
+
+		// Split the argument string by comma
+		argsSplit := strings.Split(argSubst.String(), ",")
+
+		// Create command, with substituted args
+		cmd := exec.Command(cmdName, argsSplit...)
+		// Get a pipe for stdout
+		outpipe, err := cmd.StdoutPipe()
+		if err != nil {
+			log.Critical(err)
+		}
+		// Send stderr to the same place
+		cmd.Stderr = cmd.Stdout
+
+		// Display the full command being executed
+		execLog.Debugf("Full command line to be executed: %s %s",
+			cmd.Path, strings.Join(argsSplit, " "))
+
+		// Channel for logger and command execution routines to talk
+		cmdDone := make(chan error)
+		go execLogger(outpipe, cmdDone)
+
+		// Start command and return from handler without waiting
+		go func() {
+			if err := cmd.Run(); err != nil {
+				execLog.Errorf("Failed to start system command %v. Error: %v",
+					cmdName, err)
+			}
+			// Signal the logger goroutine, and clean up
+			cmdDone <- err
+			close(cmdDone)
+		}()
+	// send to nil channel blocks
+	default:
+	}
+
+	// Also send on stake info channel, if enabled.
+	select {
+	case spyChans.connectChanStkInf <- height:
+	// send to nil channel blocks
+	default:
+	}
+}
+
+func getWalletNtfnHandlers(cfg *Config) *dcrrpcclient.NotificationHandlers {
 	return &dcrrpcclient.NotificationHandlers{
 		OnAccountBalance: func(account string, balance dcrutil.Amount, confirmed bool) {
 			log.Debug("OnAccountBalance")
@@ -0,0 +1,394 @@
+// openapi.go generates the OpenAPI 3.0 document of the HTTP API, served at
+// /api/spec, so that the API is self-describing and client SDKs may be
+// generated from it.  The operations of each handler are documented next to
+// it, as apiOperations given when the handler is added to the apiServer.  The
+// schemas of their request and response bodies are generated from the Go types
+// of the bodies by reflection, as encoding/json encodes them, and the API role
+// an operation requires (see apiroles.go) is given by its x-dcrspy-role.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// openAPIVersion is the version of the OpenAPI specification of the document.
+const openAPIVersion = "3.0.3"
+
+// apiParam is a query or path parameter of an operation.
+type apiParam struct {
+	name string
+	// in is query or path.
+	in string
+	// typ is the JSON schema type of the value, e.g. integer.
+	typ         string
+	description string
+	required    bool
+}
+
+// apiOperation documents an operation of the API.
+type apiOperation struct {
+	method string
+	// path is the templated path, e.g. /webhooks/{id}, if not the pattern the
+	// handler is added with.
+	path        string
+	summary     string
+	description string
+	params      []apiParam
+	// request and response are values of the types of the JSON request and
+	// response bodies, nil if none.
+	request  interface{}
+	response interface{}
+	// status is the status of a successful response, 200 if 0.
+	status int
+	// contentType is the content type of the response, application/json if
+	// empty.
+	contentType string
+	// public is true if the operation does not require an API key.
+	public bool
+}
+
+// apiRoute is the pattern of a handler and its documented operations.
+type apiRoute struct {
+	pattern string
+	ops     []apiOperation
+}
+
+// specAPI documents specHandler.
+var specAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "The OpenAPI document of the API",
+	response: map[string]interface{}{},
+}}
+
+// specHandler serves GET /api/spec with the OpenAPI document of the server's
+// routes.
+func (s *apiServer) specHandler(w http.ResponseWriter, r *http.Request,
+	t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	doc := openAPIDocument(s.routes)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	doc["servers"] = []interface{}{
+		map[string]interface{}{"url": scheme + "://" + r.Host},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// openAPIDocument returns the OpenAPI document of the documented operations of
+// the routes.
+func openAPIDocument(routes []apiRoute) map[string]interface{} {
+	g := &schemaGenerator{
+		schemas: make(map[string]interface{}),
+		names:   make(map[reflect.Type]string),
+	}
+	// API keys are required once any is configured.
+	auth := spyTenants != nil || len(spyAPIKeys) > 0
+
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		for i := range route.ops {
+			op := &route.ops[i]
+			p := op.path
+			if p == "" {
+				p = route.pattern
+			}
+			item, ok := paths[p].(map[string]interface{})
+			if !ok {
+				item = make(map[string]interface{})
+				paths[p] = item
+			}
+			o := g.operation(p, op)
+			if auth && op.public {
+				o["security"] = []interface{}{}
+			}
+			item[strings.ToLower(op.method)] = o
+		}
+	}
+
+	version := fmt.Sprintf("%d.%d.%d", ver.Major, ver.Minor, ver.Patch)
+	if ver.Label != "" {
+		version += "-" + ver.Label
+	}
+	doc := map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title": "dcrspy API",
+			"description": "The HTTP API of dcrspy, a Decred chain and " +
+				"wallet monitor. Errors are plain text.",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "header",
+					"name": "X-API-Key",
+				},
+				"bearer": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+	if auth {
+		doc["security"] = []interface{}{
+			map[string]interface{}{"apiKey": []string{}},
+			map[string]interface{}{"bearer": []string{}},
+		}
+	}
+	return doc
+}
+
+// operation returns the OpenAPI operation object of the operation on the path.
+func (g *schemaGenerator) operation(p string,
+	op *apiOperation) map[string]interface{} {
+	o := map[string]interface{}{
+		"operationId": operationID(op.method, p),
+		"summary":     op.summary,
+		"x-dcrspy-role": requiredRole(&http.Request{
+			Method: op.method,
+			URL:    &url.URL{Path: p},
+		}).String(),
+	}
+	if op.description != "" {
+		o["description"] = op.description
+	}
+
+	if len(op.params) > 0 {
+		params := make([]interface{}, 0, len(op.params))
+		for _, prm := range op.params {
+			param := map[string]interface{}{
+				"name":   prm.name,
+				"in":     prm.in,
+				"schema": map[string]interface{}{"type": prm.typ},
+			}
+			if prm.description != "" {
+				param["description"] = prm.description
+			}
+			// Path parameters are always required.
+			if prm.required || prm.in == "path" {
+				param["required"] = true
+			}
+			params = append(params, param)
+		}
+		o["parameters"] = params
+	}
+
+	if op.request != nil {
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": g.schema(reflect.TypeOf(op.request)),
+				},
+			},
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := map[string]interface{}{"description": http.StatusText(status)}
+	contentType := op.contentType
+	if contentType == "" && op.response != nil {
+		contentType = "application/json"
+	}
+	if contentType != "" {
+		schema := map[string]interface{}{"type": "string"}
+		if op.response != nil {
+			schema = g.schema(reflect.TypeOf(op.response))
+		}
+		resp["content"] = map[string]interface{}{
+			contentType: map[string]interface{}{"schema": schema},
+		}
+	}
+	o["responses"] = map[string]interface{}{
+		fmt.Sprint(status): resp,
+		"default": map[string]interface{}{
+			"description": "An error",
+			"content": map[string]interface{}{
+				"text/plain": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+	}
+	return o
+}
+
+// operationID returns the ID of the operation, e.g. getWebhooksById for GET
+// /webhooks/{id}.
+func operationID(method, p string) string {
+	id := strings.ToLower(method)
+	words := strings.FieldsFunc(p, func(r rune) bool {
+		return r == '/' || r == '.' || r == '-' || r == '_'
+	})
+	for _, w := range words {
+		if strings.HasPrefix(w, "{") && strings.HasSuffix(w, "}") {
+			w = "by" + strings.Title(strings.Trim(w, "{}"))
+		}
+		id += strings.Title(w)
+	}
+	return id
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	marshalerType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schemaGenerator generates the JSON schemas of Go types, as encoding/json
+// encodes them.  The schemas of named struct types are added to schemas, by
+// the exported form of the type's name, and referenced.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+	names   map[reflect.Type]string
+}
+
+// schema returns the schema of the type.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t.Implements(marshalerType) ||
+		reflect.PtrTo(t).Implements(marshalerType):
+		// The types encoding themselves encode objects.
+		return map[string]interface{}{"type": "object"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{
+			"type":  "array",
+			"items": g.schema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": g.schema(t.Elem()),
+		}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name, ok := g.names[t]
+		if !ok {
+			name = g.schemaName(t)
+			// The name is reserved first, for recursive references.
+			g.names[t] = name
+			g.schemas[name] = nil
+			g.schemas[name] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	// Interfaces may be anything.
+	return map[string]interface{}{}
+}
+
+// schemaName returns the name of the schema of the named type, the exported
+// form of its name, qualified by its package if another type has the name.
+func (g *schemaGenerator) schemaName(t reflect.Type) string {
+	name := strings.Title(t.Name())
+	if _, taken := g.schemas[name]; taken {
+		name = strings.Title(path.Base(t.PkgPath())) + name
+	}
+	return name
+}
+
+// object returns the schema of the struct type.
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	g.properties(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// properties adds the schemas of the fields of the struct type to props, by
+// their JSON names.  The fields of embedded structs are added unless a field
+// of the outer struct has the name.
+func (g *schemaGenerator) properties(t reflect.Type,
+	props map[string]interface{}) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, ft)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		schema := g.schema(f.Type)
+		for _, opt := range opts[1:] {
+			if opt == "string" {
+				schema = map[string]interface{}{"type": "string"}
+			}
+		}
+		props[name] = schema
+	}
+
+	for _, et := range embedded {
+		inner := make(map[string]interface{})
+		g.properties(et, inner)
+		for name, schema := range inner {
+			if _, ok := props[name]; !ok {
+				props[name] = schema
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package spy
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOperationID(t *testing.T) {
+	tests := []struct {
+		method, path, want string
+	}{
+		{"GET", "/webhooks", "getWebhooks"},
+		{"GET", "/webhooks/{id}", "getWebhooksById"},
+		{"DELETE", "/webhooks/{id}", "deleteWebhooksById"},
+		{"POST", "/api/alert-rules", "postApiAlertRules"},
+		{"GET", "/api/spec", "getApiSpec"},
+		{"GET", "/block_data/{height}.json", "getBlockDataByHeightJson"},
+		{"GET", "/", "get"},
+	}
+	for _, tt := range tests {
+		if got := operationID(tt.method, tt.path); got != tt.want {
+			t.Errorf("operationID(%s, %s) = %s, want %s", tt.method, tt.path,
+				got, tt.want)
+		}
+	}
+}
+
+// testSchemaMarshaler is a type encoding itself.
+type testSchemaMarshaler struct{}
+
+func (testSchemaMarshaler) MarshalJSON() ([]byte, error) { return []byte("{}"), nil }
+
+// testSchemaBlock and testSchemaNode are named struct types of the schema
+// tests.
+type testSchemaBlock struct {
+	Height uint32 `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+type testSchemaNode struct {
+	Value    int               `json:"value"`
+	Children []*testSchemaNode `json:"children,omitempty"`
+}
+
+type testSchemaBase struct {
+	Seq  uint64 `json:"seq"`
+	Time int64  `json:"time"`
+}
+
+func TestSchema(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{true, `{"type":"boolean"}`},
+		{int64(1), `{"format":"int64","type":"integer"}`},
+		{int32(1), `{"format":"int32","type":"integer"}`},
+		{uint16(1), `{"minimum":0,"type":"integer"}`},
+		{1.5, `{"format":"double","type":"number"}`},
+		{"", `{"type":"string"}`},
+		{new(string), `{"type":"string"}`},
+		{[]byte{}, `{"format":"byte","type":"string"}`},
+		{[2]byte{}, `{"items":{"minimum":0,"type":"integer"},"type":"array"}`},
+		{[]string{}, `{"items":{"type":"string"},"type":"array"}`},
+		{map[string]float64{}, `{"additionalProperties":{"format":"double",` +
+			`"type":"number"},"type":"object"}`},
+		{time.Time{}, `{"format":"date-time","type":"string"}`},
+		{json.RawMessage{}, `{}`},
+		{testSchemaMarshaler{}, `{"type":"object"}`},
+		{[]interface{}{}, `{"items":{},"type":"array"}`},
+		{struct {
+			Name    string `json:"name"`
+			Amount  int64  `json:"amount,string"`
+			Skipped bool   `json:"-"`
+			NoTag   bool
+			hidden  bool
+		}{}, `{"properties":{"NoTag":{"type":"boolean"},"amount":{"type":` +
+			`"string"},"name":{"type":"string"}},"type":"object"}`},
+		// The fields of embedded structs are promoted, unless the outer
+		// struct has a field with the name.
+		{struct {
+			testSchemaBase
+			Time string `json:"time"`
+		}{}, `{"properties":{"seq":{"minimum":0,"type":"integer"},"time":` +
+			`{"type":"string"}},"type":"object"}`},
+		{struct {
+			*testSchemaBase
+			Tagged testSchemaBase `json:"base"`
+		}{}, `{"properties":{"base":{"$ref":"#/components/schemas/` +
+			`TestSchemaBase"},"seq":{"minimum":0,"type":"integer"},"time":` +
+			`{"format":"int64","type":"integer"}},"type":"object"}`},
+		{&testSchemaBlock{}, `{"$ref":"#/components/schemas/TestSchemaBlock"}`},
+		{[]testSchemaBlock{}, `{"items":{"$ref":"#/components/schemas/` +
+			`TestSchemaBlock"},"type":"array"}`},
+	}
+	for _, tt := range tests {
+		g := &schemaGenerator{
+			schemas: make(map[string]interface{}),
+			names:   make(map[reflect.Type]string),
+		}
+		b, err := json.Marshal(g.schema(reflect.TypeOf(tt.v)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("schema of %T = %s, want %s", tt.v, b, tt.want)
+		}
+	}
+}
+
+// cookie is named like http.Cookie.
+type cookie struct {
+	Name string `json:"name"`
+}
+
+func TestSchemaComponents(t *testing.T) {
+	g := &schemaGenerator{
+		schemas: make(map[string]interface{}),
+		names:   make(map[reflect.Type]string),
+	}
+	g.schema(reflect.TypeOf(testSchemaBlock{}))
+	g.schema(reflect.TypeOf([]*testSchemaBlock{}))
+	g.schema(reflect.TypeOf(testSchemaNode{}))
+	// A type named like one already added is qualified by its package.
+	g.schema(reflect.TypeOf(http.Cookie{}))
+	g.schema(reflect.TypeOf(struct{ C cookie }{}))
+
+	var names []string
+	for name := range g.schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"Cookie", "SpyCookie", "TestSchemaBlock", "TestSchemaNode"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got schemas %v, want %v", names, want)
+	}
+
+	tests := []struct {
+		name, want string
+	}{
+		{"TestSchemaBlock", `{"properties":{"hash":{"type":"string"},` +
+			`"height":{"minimum":0,"type":"integer"}},"type":"object"}`},
+		// A recursive type references itself.
+		{"TestSchemaNode", `{"properties":{"children":{"items":{"$ref":` +
+			`"#/components/schemas/TestSchemaNode"},"type":"array"},"value":` +
+			`{"format":"int64","type":"integer"}},"type":"object"}`},
+		{"SpyCookie", `{"properties":{"name":{"type":"string"}},` +
+			`"type":"object"}`},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(g.schemas[tt.name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("schema %s = %s, want %s", tt.name, b, tt.want)
+		}
+	}
+}
+
+func TestOpenAPIOperation(t *testing.T) {
+	tests := []struct {
+		name string
+		op   apiOperation
+		// want are the parameters, request body and responses of the
+		// operation.
+		want string
+	}{
+		{"params", apiOperation{
+			method: "GET",
+			params: []apiParam{
+				{name: "id", in: "path", typ: "integer"},
+				{name: "limit", in: "query", typ: "integer",
+					description: "The maximum number"},
+				{name: "address", in: "query", typ: "string", required: true},
+			},
+			response: []testSchemaBlock{},
+		}, `{"parameters":[{"in":"path","name":"id","required":true,` +
+			`"schema":{"type":"integer"}},{"description":"The maximum ` +
+			`number","in":"query","name":"limit","schema":{"type":` +
+			`"integer"}},{"in":"query","name":"address","required":true,` +
+			`"schema":{"type":"string"}}],"responses":{"200":{"content":{` +
+			`"application/json":{"schema":{"items":{"$ref":"#/components/` +
+			`schemas/TestSchemaBlock"},"type":"array"}}},"description":"OK"},` +
+			`"default":{"content":{"text/plain":{"schema":{"type":` +
+			`"string"}}},"description":"An error"}}}`},
+		{"created", apiOperation{
+			method:   "POST",
+			request:  struct{ URL string }{},
+			response: struct{ ID string }{},
+			status:   http.StatusCreated,
+		}, `{"requestBody":{"content":{"application/json":{"schema":{` +
+			`"properties":{"URL":{"type":"string"}},"type":"object"}}},` +
+			`"required":true},"responses":{"201":{"content":{` +
+			`"application/json":{"schema":{"properties":{"ID":{"type":` +
+			`"string"}},"type":"object"}}},"description":"Created"},` +
+			`"default":{"content":{"text/plain":{"schema":{"type":` +
+			`"string"}}},"description":"An error"}}}`},
+		{"no content", apiOperation{
+			method: "DELETE",
+			status: http.StatusNoContent,
+		}, `{"responses":{"204":{"description":"No Content"},"default":{` +
+			`"content":{"text/plain":{"schema":{"type":"string"}}},` +
+			`"description":"An error"}}}`},
+		{"image", apiOperation{
+			method:      "GET",
+			contentType: "image/svg+xml",
+		}, `{"responses":{"200":{"content":{"image/svg+xml":{"schema":{` +
+			`"type":"string"}}},"description":"OK"},"default":{"content":{` +
+			`"text/plain":{"schema":{"type":"string"}}},"description":` +
+			`"An error"}}}`},
+	}
+	for _, tt := range tests {
+		g := &schemaGenerator{
+			schemas: make(map[string]interface{}),
+			names:   make(map[reflect.Type]string),
+		}
+		o := g.operation("/webhooks/{id}", &tt.op)
+		if o["operationId"] != operationID(tt.op.method, "/webhooks/{id}") {
+			t.Errorf("%s: got operationId %v", tt.name, o["operationId"])
+		}
+		// The summary, ID and role are not compared.
+		delete(o, "summary")
+		delete(o, "operationId")
+		delete(o, "x-dcrspy-role")
+		b, err := json.Marshal(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s: got operation\n%s\nwant\n%s", tt.name, b, tt.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// pagerduty.go opens PagerDuty incidents for alerts with the Events API v2,
+// and resolves them when the alert's condition clears.  Incidents are
+// deduplicated by the alert's key, e.g. the cold storage address and spending
+// transaction, or by its subject for alerts without a key.  Alerts have the
+// warning severity and critical alerts the critical severity, unless the
+// severity of the alert's subject is configured.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pagerDutyEventsURL is the URL of the Events API v2.
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	// pagerDutyQueueSize is the number of events waiting to be sent, beyond
+	// which new events are dropped.
+	pagerDutyQueueSize = 100
+	// pagerDutyAttempts is the number of attempts to send an event.
+	pagerDutyAttempts = 3
+)
+
+// PagerDuty severities, in increasing order.
+var pagerDutySeverities = []string{"info", "warning", "error", "critical"}
+
+// pagerDutyPayload is the payload of a trigger event.
+type pagerDutyPayload struct {
+	Summary   string `json:"summary"`
+	Source    string `json:"source"`
+	Severity  string `json:"severity"`
+	Timestamp string `json:"timestamp"`
+	Class     string `json:"class,omitempty"`
+}
+
+// pagerDutyEvent is a request to the Events API.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// pagerDutyNotifier sends alerts to a PagerDuty service.
+type pagerDutyNotifier struct {
+	url         string
+	routingKey  string
+	source      string
+	severities  map[string]string
+	minSeverity int
+	client      *http.Client
+	queue       chan *pagerDutyEvent
+}
+
+// spyPagerDuty is the package-level PagerDuty notifier, nil if not
+// configured.
+var spyPagerDuty *pagerDutyNotifier
+
+// pagerDutySeverityRank returns the rank of the severity in
+// pagerDutySeverities, or -1 if it is not a severity.
+func pagerDutySeverityRank(severity string) int {
+	for i, s := range pagerDutySeverities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// newPagerDutyNotifier creates a pagerDutyNotifier for the integration's
+// routing key.  severities are SUBJECT:SEVERITY mappings of alert subjects
+// (e.g. "cold storage spend:critical").  Alerts of a lower severity than
+// minSeverity do not open incidents.
+func newPagerDutyNotifier(routingKey string, severities []string,
+	minSeverity string) (*pagerDutyNotifier, error) {
+	p := &pagerDutyNotifier{
+		url:        pagerDutyEventsURL,
+		routingKey: routingKey,
+		severities: make(map[string]string),
+		client:     newHTTPClient(),
+		queue:      make(chan *pagerDutyEvent, pagerDutyQueueSize),
+	}
+	if p.minSeverity = pagerDutySeverityRank(minSeverity); p.minSeverity < 0 {
+		return nil, fmt.Errorf("invalid severity %q (expected %s)",
+			minSeverity, strings.Join(pagerDutySeverities, ", "))
+	}
+	for _, s := range severities {
+		i := strings.LastIndex(s, ":")
+		if i <= 0 || pagerDutySeverityRank(s[i+1:]) < 0 {
+			return nil, fmt.Errorf("invalid severity mapping %q (expected "+
+				"SUBJECT:SEVERITY, with SEVERITY one of %s)", s,
+				strings.Join(pagerDutySeverities, ", "))
+		}
+		p.severities[s[:i]] = s[i+1:]
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	p.source = "dcrspy@" + host
+	return p, nil
+}
+
+// dedupKey returns the deduplication key of an alert with the key, or else
+// the subject.
+func (p *pagerDutyNotifier) dedupKey(key, subject string) string {
+	if key == "" {
+		key = subject
+	}
+	return "dcrspy:" + key
+}
+
+// trigger queues an event opening (or adding to) the incident of the alert,
+// of the severity unless the subject's severity is configured.  It does not
+// block.
+func (p *pagerDutyNotifier) trigger(key, subject, msg, severity string) {
+	if p == nil {
+		return
+	}
+	if s, ok := p.severities[subject]; ok {
+		severity = s
+	}
+	if pagerDutySeverityRank(severity) < p.minSeverity {
+		return
+	}
+	summary := subject + ": " + msg
+	// The summary is limited to 1024 characters.
+	if len(summary) > 1024 {
+		summary = summary[:1021] + "..."
+	}
+	p.enqueue(&pagerDutyEvent{
+		RoutingKey:  p.routingKey,
+		EventAction: "trigger",
+		DedupKey:    p.dedupKey(key, subject),
+		Payload: &pagerDutyPayload{
+			Summary:   summary,
+			Source:    p.source,
+			Severity:  severity,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Class:     subject,
+		},
+	})
+}
+
+// resolve queues an event resolving the incident of the alert with the key.
+// It does not block.
+func (p *pagerDutyNotifier) resolve(key string) {
+	if p == nil {
+		return
+	}
+	p.enqueue(&pagerDutyEvent{
+		RoutingKey:  p.routingKey,
+		EventAction: "resolve",
+		DedupKey:    p.dedupKey(key, ""),
+	})
+}
+
+// enqueue queues the event, or drops it if the queue is full.
+func (p *pagerDutyNotifier) enqueue(e *pagerDutyEvent) {
+	select {
+	case p.queue <- e:
+	default:
+		log.Warnf("PagerDuty queue full. Dropping %s of %s.", e.EventAction,
+			e.DedupKey)
+	}
+}
+
+// run sends queued events until quit is closed.  It should be run as a
+// goroutine.
+func (p *pagerDutyNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case e := <-p.queue:
+			var err error
+			for attempt := 1; attempt <= pagerDutyAttempts; attempt++ {
+				if err = p.send(e); err == nil ||
+					attempt == pagerDutyAttempts {
+					break
+				}
+				select {
+				case <-time.After(time.Duration(attempt) * 2 * time.Second):
+				case <-quit:
+					log.Debugf("Quitting PagerDuty notifier.")
+					return
+				}
+			}
+			if err != nil {
+				log.Warnf("Failed to send PagerDuty %s of %s: %v",
+					e.EventAction, e.DedupKey,
+					reportError(errKindNotifier, "pagerduty", err))
+			}
+		case <-quit:
+			log.Debugf("Quitting PagerDuty notifier.")
+			return
+		}
+	}
+}
+
+// send sends the event.
+func (p *pagerDutyNotifier) send(e *pagerDutyEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Post(p.url, "application/json",
+		bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
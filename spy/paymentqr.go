@@ -0,0 +1,137 @@
+// paymentqr.go renders the QR codes of decred: URIs of watched addresses, for
+// scanning with a mobile wallet: in the address statistics dashboard, in the
+// HTML part of notification emails, and served by the API as an SVG image of
+// a payment URI with an amount and label, e.g. for the invoices of a payment
+// page whose address dcrspy watches.
+
+package spy
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrutil"
+)
+
+const (
+	// defaultQRImageSize and maxQRImageSize are the default and maximum width
+	// and height in px of the QR code images served by the API.
+	defaultQRImageSize = 256
+	maxQRImageSize     = 1024
+	// emailQRModuleSize is the width and height in px of the modules of the
+	// QR codes in emails.
+	emailQRModuleSize = 3
+)
+
+// decredURI returns the decred: URI of a payment to the address, with the
+// amount in DCR and the label if not zero or empty.
+func decredURI(addr string, amount float64, label string) string {
+	var params []string
+	if amount > 0 {
+		params = append(params, "amount="+
+			strconv.FormatFloat(amount, 'f', -1, 64))
+	}
+	if label != "" {
+		// Spaces are %20, not +, in URIs.
+		params = append(params, "label="+
+			strings.Replace(url.QueryEscape(label), "+", "%20", -1))
+	}
+	if len(params) == 0 {
+		return "decred:" + addr
+	}
+	return "decred:" + addr + "?" + strings.Join(params, "&")
+}
+
+// addrQRCode returns an SVG image of width and height px of the QR code of
+// the address's decred: URI, or nothing if it cannot be encoded.
+func addrQRCode(addr string, px int) template.HTML {
+	q, err := newQRCode([]byte(decredURI(addr, 0, "")), qrLevelM)
+	if err != nil {
+		log.Warnf("Failed to encode the QR code of %s: %v", addr, err)
+		return ""
+	}
+	return template.HTML(q.svg(px))
+}
+
+// emailQRCode returns an HTML table of the QR code of the address's decred:
+// URI, or nothing if it cannot be encoded.  It is the qr function of the HTML
+// email template.
+func emailQRCode(addr string) template.HTML {
+	q, err := newQRCode([]byte(decredURI(addr, 0, "")), qrLevelM)
+	if err != nil {
+		log.Warnf("Failed to encode the QR code of %s: %v", addr, err)
+		return ""
+	}
+	return template.HTML(q.html(emailQRModuleSize))
+}
+
+// paymentQRAPI documents paymentQRHandler.
+var paymentQRAPI = []apiOperation{{
+	method: "GET",
+	summary: "An SVG image of the QR code of a decred: payment URI of a " +
+		"watched address",
+	params: []apiParam{
+		{name: "address", in: "query", typ: "string", required: true,
+			description: "The watched address"},
+		{name: "amount", in: "query", typ: "number",
+			description: "The amount in DCR"},
+		{name: "label", in: "query", typ: "string",
+			description: "The label of the payment, e.g. an invoice number"},
+		{name: "size", in: "query", typ: "integer",
+			description: "The width and height in px (default 256)"},
+	},
+	contentType: "image/svg+xml",
+}}
+
+// paymentQRHandler returns a tenantHandler for GET /qr?address=<address>,
+// serving an SVG image of the QR code of a payment URI of an address watched
+// by the caller.
+func paymentQRHandler(watched *watchedAddresses) tenantHandler {
+	return func(w http.ResponseWriter, r *http.Request, t *tenant) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		addr := q.Get("address")
+		if _, err := dcrutil.DecodeAddress(addr, activeNet.Params); err != nil {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+		if t != nil && !watched.watches(t.owner(), addr) {
+			http.Error(w, "address not watched", http.StatusForbidden)
+			return
+		}
+		var amount float64
+		if a := q.Get("amount"); a != "" {
+			var err error
+			// At most the supply of 21 million DCR, and not NaN
+			amount, err = strconv.ParseFloat(a, 64)
+			if err != nil || !(amount >= 0 && amount <= 21e6) {
+				http.Error(w, "invalid amount", http.StatusBadRequest)
+				return
+			}
+		}
+		size := defaultQRImageSize
+		if s := q.Get("size"); s != "" {
+			var err error
+			size, err = strconv.Atoi(s)
+			if err != nil || size <= 0 || size > maxQRImageSize {
+				http.Error(w, "invalid size", http.StatusBadRequest)
+				return
+			}
+		}
+
+		code, err := newQRCode([]byte(decredURI(addr, amount,
+			q.Get("label"))), qrLevelM)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(code.svg(size))
+	}
+}
@@ -0,0 +1,26 @@
+package spy
+
+import "testing"
+
+func TestDecredURI(t *testing.T) {
+	const addr = "DsUZxxoHJSty8DCfwfartwTYbuhmVct7tJu"
+	tests := []struct {
+		amount float64
+		label  string
+		want   string
+	}{
+		{0, "", "decred:" + addr},
+		{1.5, "", "decred:" + addr + "?amount=1.5"},
+		{0.00000001, "", "decred:" + addr + "?amount=0.00000001"},
+		{21000000, "", "decred:" + addr + "?amount=21000000"},
+		{0, "INV-42", "decred:" + addr + "?label=INV-42"},
+		{2, "Invoice 42 & co", "decred:" + addr +
+			"?amount=2&label=Invoice%2042%20%26%20co"},
+	}
+	for _, tt := range tests {
+		if got := decredURI(addr, tt.amount, tt.label); got != tt.want {
+			t.Errorf("decredURI(%v, %q) = %s, want %s", tt.amount, tt.label,
+				got, tt.want)
+		}
+	}
+}
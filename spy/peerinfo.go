@@ -0,0 +1,77 @@
+// peerinfo.go implements the peerinfo collector plugin, which collects dcrd's
+// peers with getpeerinfo: their number, inbound and outbound, the mean ping
+// time, and each peer's address, version and height.
+
+package spy
+
+import (
+	"github.com/decred/dcrrpcclient"
+)
+
+func init() {
+	registerCollector("peerinfo", func(dcrd *dcrrpcclient.Client) Collector {
+		return &peerInfoCollector{dcrd}
+	})
+}
+
+// peerSummary is a peer in the section of the peerinfo collector.
+type peerSummary struct {
+	Addr          string  `json:"addr"`
+	Inbound       bool    `json:"inbound"`
+	SubVer        string  `json:"subver"`
+	CurrentHeight int64   `json:"currentheight"`
+	PingTime      float64 `json:"pingtime"`
+	BanScore      int32   `json:"banscore"`
+}
+
+// peerInfo is the section of the peerinfo collector.
+type peerInfo struct {
+	Count    int `json:"count"`
+	Inbound  int `json:"inbound"`
+	Outbound int `json:"outbound"`
+	// MeanPingTime is the mean ping time of the peers, in microseconds.
+	MeanPingTime float64       `json:"meanpingtime"`
+	Peers        []peerSummary `json:"peers"`
+}
+
+// peerInfoCollector collects dcrd's peers.
+type peerInfoCollector struct {
+	dcrd *dcrrpcclient.Client
+}
+
+// Name returns the name of the section.
+func (c *peerInfoCollector) Name() string {
+	return "peerinfo"
+}
+
+// Collect returns dcrd's peers at the time of the call.
+func (c *peerInfoCollector) Collect(height uint32) (interface{}, error) {
+	peers, err := c.dcrd.GetPeerInfo()
+	if err != nil {
+		return nil, err
+	}
+	info := &peerInfo{
+		Count: len(peers),
+		Peers: make([]peerSummary, 0, len(peers)),
+	}
+	for _, p := range peers {
+		if p.Inbound {
+			info.Inbound++
+		} else {
+			info.Outbound++
+		}
+		info.MeanPingTime += p.PingTime
+		info.Peers = append(info.Peers, peerSummary{
+			Addr:          p.Addr,
+			Inbound:       p.Inbound,
+			SubVer:        p.SubVer,
+			CurrentHeight: p.CurrentHeight,
+			PingTime:      p.PingTime,
+			BanScore:      p.BanScore,
+		})
+	}
+	if len(peers) > 0 {
+		info.MeanPingTime /= float64(len(peers))
+	}
+	return info, nil
+}
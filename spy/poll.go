@@ -0,0 +1,121 @@
+// poll.go runs collector plugins (see collectors.go) on time intervals,
+// independently of blocks, for data that dcrd does not notify, e.g. peer info
+// every minute.  Each result is appended with the time and the best block
+// height as a line of the collector's own time series, a newline-delimited
+// JSON file per network in the output folder (e.g. peerinfo-mainnet.ndjson),
+// rotated like the other NDJSON output.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrrpcclient"
+)
+
+// minPollInterval is the shortest interval of a polled collector.
+const minPollInterval = time.Second
+
+// poller runs a collector at an interval.
+type poller struct {
+	collector Collector
+	interval  time.Duration
+	dcrd      *dcrrpcclient.Client
+	series    *ndjsonAppender
+}
+
+// parsePoll parses a poll option, NAME:INTERVAL (e.g. peerinfo:1m), creating
+// the named collector.
+func parsePoll(s string, dcrd *dcrrpcclient.Client) (Collector, time.Duration,
+	error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return nil, 0, fmt.Errorf("invalid poll %q, expected NAME:INTERVAL", s)
+	}
+	interval, err := time.ParseDuration(strings.TrimSpace(s[i+1:]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid interval in poll %q: %v", s, err)
+	}
+	if interval < minPollInterval {
+		return nil, 0, fmt.Errorf("interval in poll %q is shorter than %v",
+			s, minPollInterval)
+	}
+	c, err := newCollector(strings.TrimSpace(s[:i]), dcrd)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c, interval, nil
+}
+
+// newPoller creates a poller of the collector, appending to its time series
+// in folder for the network, rotated at rotateSize bytes or each rotatePeriod.
+func newPoller(c Collector, interval time.Duration, dcrd *dcrrpcclient.Client,
+	folder, network string, rotateSize int64,
+	rotatePeriod time.Duration) *poller {
+	return &poller{
+		collector: c,
+		interval:  interval,
+		dcrd:      dcrd,
+		series: newNDJSONAppender(folder, c.Name()+"-"+network, rotateSize,
+			rotatePeriod),
+	}
+}
+
+// run polls the collector at its interval until quit is closed.  It should be
+// run as a goroutine.
+func (p *poller) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	defer p.series.close()
+	name := p.collector.Name()
+	log.Infof("Polling %s every %v.", name, p.interval)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.poll()
+		select {
+		case <-ticker.C:
+		case <-quit:
+			log.Debugf("Quitting %s polling.", name)
+			return
+		}
+	}
+}
+
+// poll collects the data, and appends it to the time series.
+func (p *poller) poll() {
+	name := p.collector.Name()
+	now := time.Now()
+	var height int64
+	var data interface{}
+	err := withRPCTimeout(name+" poll", func() error {
+		var err error
+		if height, err = p.dcrd.GetBlockCount(); err != nil {
+			return err
+		}
+		data, err = p.collector.Collect(uint32(height))
+		return err
+	})
+	if err != nil {
+		log.Warnf("Failed to poll %s: %v", name,
+			reportError(errKindCollector, name, err))
+		return
+	}
+
+	line, err := json.Marshal(map[string]interface{}{
+		"time":   now.Unix(),
+		"height": height,
+		name:     data,
+	})
+	if err == nil {
+		err = p.series.appendLine(line)
+	}
+	if err != nil {
+		log.Errorf("Unable to append %s to %s: %v", name, p.series.path(),
+			reportError(errKindSaver, "ndjson", err))
+	}
+}
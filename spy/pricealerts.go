@@ -0,0 +1,166 @@
+// pricealerts.go raises alerts on the DCR exchange rate polled by the
+// exchange rate module (see exchangerate.go), with rules such as
+//
+//	pricealert=cross:20
+//	pricealert=move:10:24h
+//
+// A cross rule alerts when the rate crosses the level in either direction.  A
+// move rule alerts when the rate has changed by at least the percentage, up or
+// down, within the period.  Alerts are sent like other alerts, and published
+// as price events.
+
+package spy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event type and actions of price alerts
+const (
+	eventTypePrice        = "price"
+	eventActionPriceCross = "cross"
+	eventActionPriceMove  = "move"
+)
+
+// priceSample is an exchange rate at a time.
+type priceSample struct {
+	time time.Time
+	rate float64
+}
+
+// priceAlertRule is a cross rule, with level, or a move rule, with percent
+// and period.
+type priceAlertRule struct {
+	level   float64
+	percent float64
+	period  time.Duration
+	// above is whether the last rate was at or above level, if known.
+	above, known bool
+	// lastAlert is the time of the last alert of a move rule.  Rates before
+	// it are not compared, so that a move alerts once.
+	lastAlert time.Time
+}
+
+// parsePriceAlertRule parses cross:LEVEL or move:PERCENT:PERIOD.
+func parsePriceAlertRule(s string) (*priceAlertRule, error) {
+	parts := strings.Split(s, ":")
+	r := &priceAlertRule{}
+	var err error
+	switch {
+	case parts[0] == "cross" && len(parts) == 2:
+		r.level, err = strconv.ParseFloat(parts[1], 64)
+		if err != nil || r.level <= 0 {
+			return nil, fmt.Errorf("invalid level in price alert %q", s)
+		}
+	case parts[0] == "move" && len(parts) == 3:
+		r.percent, err = strconv.ParseFloat(strings.TrimSuffix(parts[1], "%"),
+			64)
+		if err != nil || r.percent <= 0 {
+			return nil, fmt.Errorf("invalid percentage in price alert %q", s)
+		}
+		r.period, err = time.ParseDuration(parts[2])
+		if err != nil || r.period <= 0 {
+			return nil, fmt.Errorf("invalid period in price alert %q", s)
+		}
+	default:
+		return nil, fmt.Errorf("invalid price alert %q (expected "+
+			"cross:LEVEL or move:PERCENT:PERIOD)", s)
+	}
+	return r, nil
+}
+
+// priceAlerts checks the rules on each update of the exchange rate.
+type priceAlerts struct {
+	mtx      sync.Mutex
+	currency string
+	rules    []*priceAlertRule
+	// samples are the rates within the longest period of the move rules.
+	samples   []priceSample
+	maxPeriod time.Duration
+}
+
+// spyPriceAlerts is the package-level price alerts, nil if no rules are
+// configured.
+var spyPriceAlerts *priceAlerts
+
+// newPriceAlerts parses the rules on the rate in the currency.
+func newPriceAlerts(currency string, rules []string) (*priceAlerts, error) {
+	p := &priceAlerts{currency: strings.ToUpper(currency)}
+	for _, s := range rules {
+		r, err := parsePriceAlertRule(s)
+		if err != nil {
+			return nil, err
+		}
+		if r.period > p.maxPeriod {
+			p.maxPeriod = r.period
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// rateUpdated checks the rules against the new rate.
+func (p *priceAlerts) rateUpdated(rate float64, now time.Time) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.samples = append(p.samples, priceSample{now, rate})
+	first := 0
+	for first < len(p.samples) && now.Sub(p.samples[first].time) > p.maxPeriod {
+		first++
+	}
+	if first > 0 {
+		p.samples = append([]priceSample(nil), p.samples[first:]...)
+	}
+
+	pair := "DCR/" + p.currency
+	for _, r := range p.rules {
+		if r.period == 0 {
+			above := rate >= r.level
+			if r.known && above != r.above {
+				direction := "below"
+				if above {
+					direction = "above"
+				}
+				p.alert(eventActionPriceCross, fmt.Sprintf("%s crossed %s "+
+					"%.4f: %.4f", pair, direction, r.level, rate))
+			}
+			r.above, r.known = above, true
+			continue
+		}
+
+		// Compare with the oldest rate within the period and since the last
+		// alert.
+		for _, s := range p.samples {
+			if now.Sub(s.time) > r.period || s.time.Before(r.lastAlert) {
+				continue
+			}
+			change := 100 * (rate - s.rate) / s.rate
+			if change >= r.percent || -change >= r.percent {
+				elapsed := now.Sub(s.time) / time.Minute * time.Minute
+				p.alert(eventActionPriceMove, fmt.Sprintf("%s moved %+.2f%% "+
+					"in %v, from %.4f to %.4f", pair, change, elapsed, s.rate,
+					rate))
+				r.lastAlert = now
+			}
+			break
+		}
+	}
+}
+
+// alert sends the price alert and publishes it as an event.
+func (p *priceAlerts) alert(action, msg string) {
+	sendAlert("price", "%s", msg)
+	publishEvent(&spyEvent{
+		Type:    eventTypePrice,
+		Action:  action,
+		Message: msg,
+	})
+}
@@ -0,0 +1,104 @@
+// profiles.go captures heap and goroutine profiles to disk when dcrspy's memory
+// use or goroutine count stays beyond its limit (see hostmetrics.go), so that
+// a slow leak of a long-running instance leaves post-mortem data, which may be
+// examined with go tool pprof.  A profile is captured once the limit has been
+// exceeded for profileSustainChecks consecutive checks, and again at most every
+// profileMinInterval while it still is.  Only the latest maxProfiles of each
+// kind are kept.
+
+package spy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// profileSustainChecks is the number of consecutive checks beyond the
+	// limit after which a profile is captured.
+	profileSustainChecks = 3
+	// profileMinInterval is the minimum interval between captures of a kind
+	// of profile.
+	profileMinInterval = time.Hour
+	// maxProfiles is the number of profiles of each kind kept.
+	maxProfiles = 10
+)
+
+// Kinds of profiles, as named by runtime/pprof
+const (
+	profileHeap      = "heap"
+	profileGoroutine = "goroutine"
+)
+
+// profileCapture writes profiles to a directory.
+type profileCapture struct {
+	dir string
+
+	mtx  sync.Mutex
+	last map[string]time.Time
+}
+
+// newProfileCapture creates a profileCapture writing to dir, creating it if
+// needed.
+func newProfileCapture(dir string) (*profileCapture, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &profileCapture{dir: dir, last: make(map[string]time.Time)}, nil
+}
+
+// capture writes a profile of the kind, returning its path, or an empty path
+// if one was captured less than profileMinInterval before now.
+func (c *profileCapture) capture(kind string, now time.Time) (string, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if now.Sub(c.last[kind]) < profileMinInterval {
+		return "", nil
+	}
+	c.last[kind] = now
+
+	p := pprof.Lookup(kind)
+	if p == nil {
+		return "", fmt.Errorf("unknown profile %q", kind)
+	}
+	if kind == profileHeap {
+		// The heap profile is as of the last garbage collection.
+		runtime.GC()
+	}
+	path := filepath.Join(c.dir, fmt.Sprintf("%s-%s.pprof", kind,
+		now.UTC().Format("20060102-150405")))
+	fp, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if err = p.WriteTo(fp, 0); err != nil {
+		fp.Close()
+		return "", err
+	}
+	if err = fp.Close(); err != nil {
+		return "", err
+	}
+	c.prune(kind)
+	return path, nil
+}
+
+// prune removes the profiles of the kind but the latest maxProfiles.  Their
+// names sort by time.
+func (c *profileCapture) prune(kind string) {
+	paths, err := filepath.Glob(filepath.Join(c.dir, kind+"-*.pprof"))
+	if err != nil || len(paths) <= maxProfiles {
+		return
+	}
+	sort.Strings(paths)
+	for _, p := range paths[:len(paths)-maxProfiles] {
+		if err = os.Remove(p); err != nil {
+			log.Warnf("Unable to remove old profile %s: %v", p, err)
+		}
+	}
+}
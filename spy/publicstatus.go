@@ -0,0 +1,135 @@
+// publicstatus.go serves a minimal, read-only status page on its own listener
+// (publiclisten), suitable for exposing to the internet as a community node
+// status page.  It shows only public chain data (the height, time, ticket
+// price and pool size of the last block) and dcrspy's uptime: no addresses,
+// alerts, tenants or node details, and no access to the API.
+
+package spy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// publicStatusData is the data shown by the public status page, and the
+// response of /status.json.
+type publicStatusData struct {
+	Height      int64   `json:"height"`
+	BlockTime   int64   `json:"blocktime"`
+	TicketPrice float64 `json:"ticketprice"`
+	PoolSize    uint32  `json:"poolsize"`
+	Started     int64   `json:"started"`
+	Uptime      int64   `json:"uptime"`
+}
+
+// publicStatus records the public data of the last block.
+type publicStatus struct {
+	mtx     sync.RWMutex
+	started time.Time
+	data    publicStatusData
+}
+
+// spyPublicStatus is the package-level public status, nil if publiclisten is
+// not set.
+var spyPublicStatus *publicStatus
+
+// newPublicStatus creates a publicStatus, with dcrspy's uptime from now.
+func newPublicStatus() *publicStatus {
+	return &publicStatus{started: time.Now()}
+}
+
+// blockConnected records the public data of the block.
+func (p *publicStatus) blockConnected(data *blockData) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.data.Height = int64(data.header.Height)
+	p.data.BlockTime = data.header.Time
+	p.data.TicketPrice = data.currentstakediff.CurrentStakeDifficulty
+	p.data.PoolSize = data.poolinfo.PoolSize
+}
+
+// current returns the public status now.
+func (p *publicStatus) current() publicStatusData {
+	p.mtx.RLock()
+	data := p.data
+	p.mtx.RUnlock()
+	data.Started = p.started.Unix()
+	data.Uptime = int64(time.Since(p.started) / time.Second)
+	return data
+}
+
+// publicStatusPage is the HTML status page, refreshed every minute.
+var publicStatusPage = template.Must(template.New("status").Funcs(
+	template.FuncMap{
+		"unix": func(t int64) string {
+			return time.Unix(t, 0).UTC().Format("2006-01-02 15:04:05 UTC")
+		},
+		"secs": func(s int64) time.Duration {
+			return time.Duration(s) * time.Second
+		},
+	}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>Decred node status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #091440; }
+table { border-collapse: collapse; }
+td { padding: 0.3em 1em 0.3em 0; }
+td:first-child { color: #596d81; }
+</style>
+</head>
+<body>
+<h1>Decred node status</h1>
+{{if .Height}}<table>
+<tr><td>Chain height</td><td>{{.Height}}</td></tr>
+<tr><td>Last block time</td><td>{{unix .BlockTime}}</td></tr>
+<tr><td>Ticket price</td><td>{{printf "%.8f" .TicketPrice}} DCR</td></tr>
+<tr><td>Ticket pool size</td><td>{{.PoolSize}}</td></tr>
+<tr><td>Monitor uptime</td><td>{{secs .Uptime}}</td></tr>
+</table>{{else}}<p>Waiting for the next block.</p>{{end}}
+</body>
+</html>
+`))
+
+// pageHandler serves GET / with the HTML status page.
+func (p *publicStatus) pageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := publicStatusPage.Execute(w, p.current()); err != nil {
+		log.Warnf("Failed to render status page: %v", err)
+	}
+}
+
+// jsonHandler serves GET /status.json with the status.
+func (p *publicStatus) jsonHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.current())
+}
+
+// publicStatusServer creates the server of the status page and /status.json,
+// listening on listen.  No other path is served.
+func publicStatusServer(listen string, p *publicStatus) *apiServer {
+	s := newAPIServer(listen)
+	s.mux.HandleFunc("/", p.pageHandler)
+	s.mux.HandleFunc("/status.json", p.jsonHandler)
+	return s
+}
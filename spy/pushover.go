@@ -0,0 +1,157 @@
+// pushover.go sends the operator's watched address notifications to mobile
+// devices with the Pushover API.  The priority of a notification escalates
+// with its amount: high priority, which bypasses quiet hours, and emergency
+// priority, which repeats until acknowledged on the device.
+
+package spy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pushoverAPIURL is the URL of the Pushover messages API.
+	pushoverAPIURL = "https://api.pushover.net/1/messages.json"
+	// pushoverQueueSize is the number of messages waiting to be sent, beyond
+	// which new messages are dropped.
+	pushoverQueueSize = 200
+	// pushoverRetry and pushoverExpire are how often an emergency
+	// notification is repeated until acknowledged, and for how long.
+	pushoverRetry  = time.Minute
+	pushoverExpire = time.Hour
+)
+
+// Pushover priorities
+const (
+	pushoverPriorityNormal    = 0
+	pushoverPriorityHigh      = 1
+	pushoverPriorityEmergency = 2
+)
+
+// pushoverMessage is a queued message and its priority.
+type pushoverMessage struct {
+	text     string
+	priority int
+	// txURL is the transaction's link to a block explorer, if any.
+	txURL string
+	// event is the event the message notifies.
+	event *spyEvent
+}
+
+// pushoverNotifier sends notifications to a Pushover user or group.
+type pushoverNotifier struct {
+	url             string
+	token           string
+	user            string
+	highAmount      float64
+	emergencyAmount float64
+	client          *http.Client
+	queue           chan *pushoverMessage
+}
+
+// spyPushover is the package-level Pushover notifier, nil if not configured.
+var spyPushover *pushoverNotifier
+
+// newPushoverNotifier creates a pushoverNotifier for the application's API
+// token and the user key.  Notifications of at least highAmount or
+// emergencyAmount DCR are sent with high or emergency priority, unless the
+// amount is zero.
+func newPushoverNotifier(token, user string, highAmount,
+	emergencyAmount float64) *pushoverNotifier {
+	return &pushoverNotifier{
+		url:             pushoverAPIURL,
+		token:           token,
+		user:            user,
+		highAmount:      highAmount,
+		emergencyAmount: emergencyAmount,
+		client:          newHTTPClient(),
+		queue:           make(chan *pushoverMessage, pushoverQueueSize),
+	}
+}
+
+// priority returns the priority of a notification of the amount.
+func (p *pushoverNotifier) priority(amount float64) int {
+	switch {
+	case p.emergencyAmount > 0 && amount >= p.emergencyAmount:
+		return pushoverPriorityEmergency
+	case p.highAmount > 0 && amount >= p.highAmount:
+		return pushoverPriorityHigh
+	}
+	return pushoverPriorityNormal
+}
+
+// Notify queues a notification of the event, rendered with the pushover
+// template.  It does not block, and fails if the queue is full.
+func (p *pushoverNotifier) Notify(e *spyEvent) error {
+	if p == nil {
+		return nil
+	}
+	msg := &pushoverMessage{
+		text:     spyNotifyTemplates.render(notifyChannelPushover, e),
+		priority: p.priority(e.Amount),
+		txURL:    spyExplorer.tx(e.TxID),
+		event:    e,
+	}
+	select {
+	case p.queue <- msg:
+	default:
+		return fmt.Errorf("Pushover queue full, dropping %q", msg.text)
+	}
+	return nil
+}
+
+// tracksDelivery implements deliveryNotifier.
+func (p *pushoverNotifier) tracksDelivery() {}
+
+// run sends queued messages until quit is closed.  It should be run as a
+// goroutine.
+func (p *pushoverNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case msg := <-p.queue:
+			if err := p.send(msg); err != nil {
+				log.Warnf("Failed to send Pushover notification: %v",
+					reportError(errKindNotifier, "pushover", err))
+			}
+			msg.event.delivered()
+		case <-quit:
+			log.Debugf("Quitting Pushover notifier.")
+			return
+		}
+	}
+}
+
+// send sends the message.
+func (p *pushoverNotifier) send(msg *pushoverMessage) error {
+	form := url.Values{}
+	form.Set("token", p.token)
+	form.Set("user", p.user)
+	form.Set("title", "dcrspy")
+	form.Set("message", msg.text)
+	form.Set("priority", strconv.Itoa(msg.priority))
+	if msg.txURL != "" {
+		form.Set("url", msg.txURL)
+		form.Set("url_title", "View transaction")
+	}
+	if msg.priority == pushoverPriorityEmergency {
+		form.Set("retry", strconv.Itoa(int(pushoverRetry/time.Second)))
+		form.Set("expire", strconv.Itoa(int(pushoverExpire/time.Second)))
+	}
+	resp, err := p.client.Post(p.url, "application/x-www-form-urlencoded",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
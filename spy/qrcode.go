@@ -0,0 +1,605 @@
+// qrcode.go encodes QR codes (ISO/IEC 18004) of text, such as a decred: URI of
+// a watched address or of a payment, and renders them as SVG for pages served
+// by dcrspy, or as an HTML table for emails, whose clients often show neither
+// SVG nor inline images.  No script or external service is needed.  Only what
+// those need is implemented: byte mode, and versions 1 to 10, up to 271 bytes
+// at error correction level L.
+
+package spy
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// qrMaxVersion is the largest version encoded.
+const qrMaxVersion = 10
+
+// qrLevel is an error correction level.
+type qrLevel int
+
+// The error correction levels, by the share of codewords that can be
+// recovered.
+const (
+	qrLevelL qrLevel = iota // 7%
+	qrLevelM                // 15%
+	qrLevelQ                // 25%
+	qrLevelH                // 30%
+)
+
+// qrLevelFormatBits are the format information bits of the levels.
+var qrLevelFormatBits = [...]int{qrLevelL: 1, qrLevelM: 0, qrLevelQ: 3,
+	qrLevelH: 2}
+
+// qrECCodewords are the number of error correction codewords of each block,
+// by level and version.
+var qrECCodewords = [...][qrMaxVersion + 1]int{
+	qrLevelL: {0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18},
+	qrLevelM: {0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26},
+	qrLevelQ: {0, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24},
+	qrLevelH: {0, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28},
+}
+
+// qrNumBlocks are the number of error correction blocks, by level and
+// version.
+var qrNumBlocks = [...][qrMaxVersion + 1]int{
+	qrLevelL: {0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4},
+	qrLevelM: {0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5},
+	qrLevelQ: {0, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8},
+	qrLevelH: {0, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8},
+}
+
+// qrRawCodewords returns the number of codewords, data and error correction,
+// of a version.
+func qrRawCodewords(version int) int {
+	modules := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		modules -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			// Version information
+			modules -= 36
+		}
+	}
+	return modules / 8
+}
+
+// qrDataCodewords returns the number of data codewords of a version at a
+// level.
+func qrDataCodewords(version int, level qrLevel) int {
+	return qrRawCodewords(version) -
+		qrECCodewords[level][version]*qrNumBlocks[level][version]
+}
+
+// qrAlignment are the alignment pattern center coordinates, by version.
+var qrAlignment = [qrMaxVersion + 1][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+// qrCode is the matrix of modules of a QR code.
+type qrCode struct {
+	size  int
+	level qrLevel
+	// dark and function are indexed by row, then column.  function marks the
+	// modules of the function patterns, which are not masked.
+	dark     [][]bool
+	function [][]bool
+}
+
+// newQRCode encodes the data as a QR code of the smallest version holding it
+// at the error correction level.
+func newQRCode(data []byte, level qrLevel) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= qrMaxVersion; v++ {
+		// Mode, character count and data bits
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		bits := 4 + countBits + 8*len(data)
+		if bits <= 8*qrDataCodewords(v, level) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes are too long for a QR code",
+			len(data))
+	}
+
+	q := &qrCode{size: 17 + 4*version, level: level}
+	q.dark = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.dark {
+		q.dark[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrCodewords(version, level, data))
+
+	// Use the mask with the lowest penalty.
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		// Masking again undoes it.
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+// setFunction sets the function module at the column x and row y.
+func (q *qrCode) setFunction(x, y int, dark bool) {
+	q.dark[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFunctionPatterns draws the finder, timing and alignment patterns, and
+// the version information, and reserves the format information.
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns, with their separators
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= q.size || y < 0 || y >= q.size {
+					continue
+				}
+				d := qrMax(qrAbs(dx), qrAbs(dy))
+				q.setFunction(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+
+	// Alignment patterns, except where they would overlap the finders
+	pos := qrAlignment[version]
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) ||
+				(i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(pos[i]+dx, pos[j]+dy,
+						qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	q.drawFormat(0)
+
+	if version >= 7 {
+		// The version and its BCH(18,6) code
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information of the level and
+// the mask, and the dark module.
+func (q *qrCode) drawFormat(mask int) {
+	// The format has a BCH(15,5) code, and is masked.
+	data := qrLevelFormatBits[q.level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// qrCodewords returns the data in byte mode, padded to the data capacity of
+// the version at the level, with the error correction codewords of its
+// blocks, interleaved.
+func qrCodewords(version int, level qrLevel, data []byte) []byte {
+	capacity := qrDataCodewords(version, level)
+
+	var bits qrBitBuffer
+	bits.append(4, 4)
+	if version >= 10 {
+		bits.append(uint(len(data)), 16)
+	} else {
+		bits.append(uint(len(data)), 8)
+	}
+	for _, b := range data {
+		bits.append(uint(b), 8)
+	}
+	// Terminator, up to 4 bits, and padding to a byte
+	bits.append(0, qrMin(4, 8*capacity-bits.n))
+	bits.append(0, (8-bits.n%8)%8)
+	codewords := bits.bytes()
+	for pad := byte(0xec); len(codewords) < capacity; pad ^= 0xec ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	// Split into blocks, the shorter first, each with its error correction.
+	// The longer blocks have one more data codeword.
+	numBlocks := qrNumBlocks[level][version]
+	ecLen := qrECCodewords[level][version]
+	numShort := numBlocks - qrRawCodewords(version)%numBlocks
+	shortLen := qrRawCodewords(version)/numBlocks - ecLen
+	divisor := qrRSDivisor(ecLen)
+	var dataBlocks, ecBlocks [][]byte
+	for i := 0; i < numBlocks; i++ {
+		n := shortLen
+		if i >= numShort {
+			n++
+		}
+		block := codewords[:n]
+		codewords = codewords[n:]
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, qrRSRemainder(block, divisor))
+	}
+
+	var out []byte
+	for i := 0; i <= shortLen; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+// drawCodewords places the codewords in the modules that are not function
+// modules, in the zigzag order of two-module columns from the bottom right.
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		// The vertical timing pattern is skipped.
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if q.function[y][x] || i >= 8*len(codewords) {
+					continue
+				}
+				q.dark[y][x] = codewords[i/8]>>uint(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the modules, other than function modules, selected by the
+// mask pattern.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.function[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				q.dark[y][x] = !q.dark[y][x]
+			}
+		}
+	}
+}
+
+// penalty returns the penalty score of the modules, lower for a code that is
+// easier to read: for runs of 5 or more modules of a color, 2x2 blocks of a
+// color, sequences resembling finder patterns (dark and light runs in the
+// ratio 1:1:3:1:1, with 4 light modules on one side, the area outside the
+// code being light), and an imbalance of dark and light modules.
+func (q *qrCode) penalty() int {
+	var p, dark int
+	// at returns the module at i along row or column line.
+	at := func(line, i int, row bool) bool {
+		if row {
+			return q.dark[line][i]
+		}
+		return q.dark[i][line]
+	}
+	for _, row := range []bool{true, false} {
+		for line := 0; line < q.size; line++ {
+			var h qrRunHistory
+			color, run := false, 0
+			for i := 0; i < q.size; i++ {
+				if at(line, i, row) == color {
+					run++
+					if run == 5 {
+						p += 3
+					} else if run > 5 {
+						p++
+					}
+					continue
+				}
+				h.add(run, q.size)
+				if !color {
+					p += 40 * h.finderLike()
+				}
+				color, run = !color, 1
+			}
+			// The final run, and the light area after the code
+			if color {
+				h.add(run, q.size)
+				run = 0
+			}
+			h.add(run+q.size, q.size)
+			p += 40 * h.finderLike()
+		}
+	}
+
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.dark[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && q.dark[y][x] == q.dark[y-1][x] &&
+				q.dark[y][x] == q.dark[y][x-1] &&
+				q.dark[y][x] == q.dark[y-1][x-1] {
+				p += 3
+			}
+		}
+	}
+
+	// 10 for each 5% of imbalance beyond the first
+	total := q.size * q.size
+	k := (qrAbs(dark*20-total*10)+total-1)/total - 1
+	return p + 10*k
+}
+
+// qrRunHistory are the lengths of the last 7 runs of a row or column, most
+// recent first.
+type qrRunHistory [7]int
+
+// add adds a run.  The first run, which is light, is extended by the light
+// area before the code, of length size.
+func (h *qrRunHistory) add(run, size int) {
+	if h[0] == 0 {
+		run += size
+	}
+	copy(h[1:], h[:6])
+	h[0] = run
+}
+
+// finderLike returns the number of sides of the last 5 runs, the most recent
+// light, on which they resemble a finder pattern.
+func (h *qrRunHistory) finderLike() int {
+	n := h[1]
+	if n == 0 || h[2] != n || h[3] != 3*n || h[4] != n || h[5] != n {
+		return 0
+	}
+	var count int
+	if h[0] >= 4*n && h[6] >= n {
+		count++
+	}
+	if h[6] >= 4*n && h[0] >= n {
+		count++
+	}
+	return count
+}
+
+// svg returns the code as an SVG image of width and height px, with a quiet
+// zone of 4 modules.
+func (q *qrCode) svg(px int) []byte {
+	n := q.size + 8
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" `+
+		`height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		px, px, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path d="`,
+		n, n)
+	// Each horizontal run of dark modules is a rectangle.
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; {
+			if !q.dark[y][x] {
+				x++
+				continue
+			}
+			start := x
+			for x < q.size && q.dark[y][x] {
+				x++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", start+4, y+4, x-start,
+				x-start)
+		}
+	}
+	b.WriteString(`" fill="#000"/></svg>`)
+	return b.Bytes()
+}
+
+// html returns the code as an HTML table with modules of px pixels and a
+// quiet zone of 4 modules, for emails.  Each run of modules of a color in a
+// row is one cell, after a first row of empty cells fixing the width of each
+// column.
+func (q *qrCode) html(px int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<table cellpadding="0" cellspacing="0" border="0" `+
+		`width="%d" style="border-collapse: collapse; table-layout: fixed; `+
+		`background: #fff; border: %dpx solid #fff">`, q.size*px, 4*px)
+	b.WriteString("<tr>")
+	for x := 0; x < q.size; x++ {
+		fmt.Fprintf(&b, `<td width="%d" style="padding: 0"></td>`, px)
+	}
+	b.WriteString("</tr>")
+	for y := 0; y < q.size; y++ {
+		fmt.Fprintf(&b, `<tr style="height: %dpx">`, px)
+		for x := 0; x < q.size; {
+			start := x
+			for x < q.size && q.dark[y][x] == q.dark[y][start] {
+				x++
+			}
+			color := "#fff"
+			if q.dark[y][start] {
+				color = "#000"
+			}
+			fmt.Fprintf(&b, `<td colspan="%d" height="%d" bgcolor="%s" `+
+				`style="padding: 0; background: %s"></td>`, x-start, px,
+				color, color)
+		}
+		b.WriteString("</tr>")
+	}
+	b.WriteString("</table>")
+	return b.Bytes()
+}
+
+// qrBitBuffer is a sequence of bits.
+type qrBitBuffer struct {
+	buf []byte
+	n   int
+}
+
+// append appends the low n bits of v, most significant first.
+func (bb *qrBitBuffer) append(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if bb.n%8 == 0 {
+			bb.buf = append(bb.buf, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			bb.buf[bb.n/8] |= 0x80 >> uint(bb.n%8)
+		}
+		bb.n++
+	}
+}
+
+// bytes returns the bits, whose number must be a multiple of 8.
+func (bb *qrBitBuffer) bytes() []byte {
+	return bb.buf
+}
+
+// qrRSDivisor returns the Reed-Solomon generator polynomial of the degree,
+// without its leading coefficient, highest degree first.
+func qrRSDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		// Multiply by (x - root).
+		for j := range result {
+			result[j] = qrGFMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrGFMultiply(root, 0x02)
+	}
+	return result
+}
+
+// qrRSRemainder returns the Reed-Solomon error correction codewords of the
+// data with the divisor.
+func qrRSRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= qrGFMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// qrGFMultiply returns the product of x and y in GF(2^8) modulo
+// x^8 + x^4 + x^3 + x^2 + 1.
+func qrGFMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11d
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func qrAbs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func qrMin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
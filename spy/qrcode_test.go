@@ -0,0 +1,233 @@
+package spy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const qrTestURI = "decred:DsUZxxoHJSty8DCfwfartwTYbuhmVct7tJu"
+
+// qrTestLongURI is 190 bytes, which needs version 10 at level M, with a 16
+// bit character count and blocks of two lengths.
+var qrTestLongURI = (qrTestURI + "?amount=12.5&message=" +
+	strings.Repeat("Invoice 2017-0042 for hosting services, ", 4))[:190]
+
+// qrVectors are the modules of QR codes encoded by a reference encoder (a
+// port of Project Nayuki's QR Code generator), one hex string per row, the
+// leftmost module the most significant bit.
+var qrVectors = []struct {
+	data    string
+	level   qrLevel
+	version int
+	rows    []string
+}{
+	{"dcrspy", qrLevelM, 1, []string{
+		"fe4bf8", "822208", "babae8", "ba9ae8", "bafae8", "82ea08",
+		"feabf8", "00b800", "be0be0", "8ce928", "6b14d0", "95e1e0",
+		"df94d0", "009f28", "fe6b10", "82fe68", "ba89d0", "baa8a0",
+		"bab440", "826160", "fe9550",
+	}},
+	{qrTestURI, qrLevelL, 3, []string{
+		"fe1e63f8", "82644a08", "ba0ab2e8", "ba8c4ae8", "bac38ae8",
+		"821ac208", "feaaabf8", "00308800", "c75440c0", "79c925b0",
+		"f22746a0", "dcca2058", "4bd88258", "c883b3c8", "037baa40",
+		"5c920c78", "7733d9a0", "cc8d99c8", "ca33bce8", "b0e92980",
+		"832f4fe0", "00811880", "fe9b9aa0", "82d238c8", "ba661ff0",
+		"ba6c9dc8", "ba274590", "82ae1968", "feeb96e0",
+	}},
+	{qrTestURI, qrLevelM, 3, []string{
+		"fe78bbf8", "827d4a08", "ba9ab2e8", "ba9fc2e8", "babb8ae8",
+		"82fbc208", "feaaabf8", "00c98800", "be4c43e0", "4da2ab88",
+		"feaf46a0", "09232448", "e3365930", "d562b7d8", "f68baa40",
+		"bca98240", "06b3d9a0", "d18c9dd8", "be7d6780", "95782d90",
+		"92574fe0", "008298b8", "fe6b9aa0", "82f338d8", "ba98cf98",
+		"bacd99d8", "ba814590", "82719750", "fecf96e0",
+	}},
+	{qrTestURI, qrLevelQ, 4, []string{
+		"fe90633f8", "820723208", "baa829ae8", "bae5fa2e8",
+		"ba04bf2e8", "82df52208", "feaaaabf8", "008d64800",
+		"57ba81768", "cc12dcc18", "06293ace8", "b870bc3d0",
+		"2a9bbf798", "492629ac8", "0ee3334b0", "adcb6dc10",
+		"8339633c8", "ddc5ad910", "f39324ad8", "ed7744298",
+		"f78a34d90", "642d92a58", "cf75f4f88", "6c6914050",
+		"9e3141fc0", "008d3c8d8", "feb441ad0", "82d6fc898",
+		"ba3a92f88", "bae8c53d0", "ba7e6ffa8", "82f1f5c80",
+		"fe4a9cd90",
+	}},
+	{qrTestURI, qrLevelH, 5, []string{
+		"fe46ed5bf8", "82a12e0208", "ba6576b2e8", "ba3cdfbae8",
+		"ba28db0ae8", "82c226a208", "feaaaaabf8", "0081ec0800",
+		"0f7e8d9310", "34d3f0cca0", "4360a2bde0", "b4975e9628",
+		"efdab08f28", "75e46198d0", "1fb91f1ee0", "7809413538",
+		"3e73d22fa0", "0d42ce5aa0", "33801bb5e0", "012a0089b8",
+		"be8b394e60", "04468e54c0", "3e70e8b9c0", "1dd0053420",
+		"7727016b78", "d4b43cfce8", "128ce5d0a0", "0559db2130",
+		"ea61544fd8", "00868b18d8", "fefdf70aa0", "82db0208a0",
+		"ba9cf8cfb8", "ba7bfa2f20", "ba097a1f70", "824974afb0",
+		"fe16ad90b8",
+	}},
+	{qrTestURI + "?amount=0.5&label=Order%2042%20from%20shop",
+		qrLevelQ, 7, []string{
+			"fe093e6e4bf8", "826940479208", "babb50f0d2e8", "ba12f82f1ae8",
+			"baf21f867ae8", "828678fdc208", "feaaaaaaabf8", "005388bda800",
+			"4abf4fd585a0", "28770826dbc0", "9782746b47b0", "e9bd4a82a100",
+			"43ed9831d108", "908e94b38af8", "ef1b66ba0790", "24411544bb98",
+			"e26f78b08300", "d41653631b30", "ef775cf30250", "9802ed1ec700",
+			"efb8afa28f88", "78b4d8e658e0", "1a801ade7ac0", "b8bd48a1d888",
+			"0fbcafa69f98", "b8f91907c110", "5751cb2944d0", "f4d8dbb1ae08",
+			"571043348938", "6cbc6a0f9960", "9eba23ce15a0", "a80e2680ae90",
+			"ef602bd3c168", "25b7ef5b4120", "0b76dc6a1d10", "79425ad1eb08",
+			"9a961f97af98", "0080a88a88d0", "fe62aaaf8ad0", "821aa88558c0",
+			"bad36fd2afd0", "ba55454ad6e8", "ba1ffe93e2f0", "82dbfe023480",
+			"fe2ac6f49d48",
+		}},
+	{qrTestURI + "?amount=1.25&label=Invoice%20INV-2017-0042%20for%20hosting",
+		qrLevelH, 10, []string{
+			"fe408a1887373f8", "82f3d7076e71208", "bae70a5941a72e8",
+			"bad3f799a3152e8", "bae509be81f92e8", "828a4f631872208",
+			"feaaaaaaaaaabf8", "003cb5a2ee80800", "27beab7f54c35f0",
+			"8ccb1f1da6085c8", "334dcdb746021a8", "b515cb5a93cd0d0",
+			"07890a933eab4d8", "dd72a789d485550", "9a376210514d0c8",
+			"a98a72ce09db418", "573b922044fe248", "7130eb21bd044e0",
+			"7a271de4419fc08", "edd2408495af3d8", "c78db89db2ab380",
+			"28f55b79d8dd568", "437873a0d95bcc8", "882ab395991e9e0",
+			"b3e3996e83ba7f8", "8c7e41f2a5080d0", "0f8da87e15a0ff8",
+			"58da9da3721e8d0", "4a8837abab89ad8", "08a1552395dd8a8",
+			"2fc435ff1ebdfe8", "3c58f53461cfe48", "ff83e241ff8bfe8",
+			"90e89efb8559350", "f67047bac4d9ee8", "35ae2ab901c6fc8",
+			"567e04f25b88e20", "0089269388cdd68", "42d6b2686b90e28",
+			"19db744898d7dc8", "af0fb001c2bdf58", "ac4197d5a096768",
+			"baa7300472df2e8", "9495b89b165d698", "523d2fa3d4af280",
+			"aca81f447e18178", "a79cd0f08699328", "f867a755ce9de80",
+			"03313cbf24dff88", "008cd1e3d684888", "fea75eaa36deac8",
+			"829da2e2bb6d880", "ba4983fe6accfd0", "ba5d3b1d6555c80",
+			"ba8ba309bed4ab8", "8220dfe57a68c00", "fe15bac2b65a4a8",
+		}},
+	{qrTestLongURI, qrLevelM, 10, []string{
+		"fe5637974ff73f8", "821208f0a8d1208", "baf2140343e72e8",
+		"ba8a910618712e8", "baa0cfbf5c792e8", "8291456221da208",
+		"feaaaaaaaaaabf8", "00ccd963a6bd800", "be5464be7c323e0",
+		"9038998225e9d08", "e794faad58b8730", "29afff83dced9f8",
+		"479b62b20b06218", "25dec5631c65c68", "7f1c0c35aa1f7b0",
+		"2578396bd088de8", "56e3c7002f31418", "f8b2e1ca0c78c68",
+		"137bdb286ba3a50", "bd9064dd412efa8", "2f8140316d51218",
+		"6ca50ddc5871df8", "b6af4c933c5ef30", "2452968a05adef8",
+		"32cc8071b852200", "d153fdd6d4a5c28", "8feb787ff08fff0",
+		"38d5bba3c3898e0", "8ac72f2a1c70a80", "88ee9be254708d8",
+		"8fd4d17e1b89fc0", "3016a594cfcb270", "3a5bd79e76469d0",
+		"a81e528584fdf18", "538417f332024e8", "b51a2899948d260",
+		"033a31120c16d80", "ac0875aac170a28", "1ad23d1a6a6a530",
+		"c9df7f2d47ada70", "9e9bd25b5a524c8", "0da5caa3d6e8078",
+		"3e2b747f29178f0", "e9e47ca121da6f8", "16f9d64a1e34c98",
+		"d1baa79745a5848", "a791acd23a0f8e0", "f81968c7b747768",
+		"024fe77e7a16f80", "00cd46e225618b8", "fe68beea5f42ad0",
+		"82b713a39b988e8", "bab65efe4c71fc8", "ba81bf6f1c755c0",
+		"babff6362b17e00", "8225cd07d0a98e0", "fe9ad2484857b10",
+	}},
+}
+
+// qrRows returns the modules of the code in the form of qrVectors.
+func qrRows(q *qrCode) []string {
+	rows := make([]string, q.size)
+	for y, row := range q.dark {
+		var b bytes.Buffer
+		for x := 0; x < q.size; x += 4 {
+			var nibble int
+			for i := 0; i < 4; i++ {
+				nibble <<= 1
+				if x+i < q.size && row[x+i] {
+					nibble |= 1
+				}
+			}
+			fmt.Fprintf(&b, "%x", nibble)
+		}
+		rows[y] = b.String()
+	}
+	return rows
+}
+
+func TestQRCodeVectors(t *testing.T) {
+	for _, v := range qrVectors {
+		q, err := newQRCode([]byte(v.data), v.level)
+		if err != nil {
+			t.Fatalf("%.20q: %v", v.data, err)
+		}
+		if want := 17 + 4*v.version; q.size != want {
+			t.Errorf("%.20q level %d: got size %d, want %d (version %d)",
+				v.data, v.level, q.size, want, v.version)
+			continue
+		}
+		for y, row := range qrRows(q) {
+			if row != v.rows[y] {
+				t.Errorf("%.20q level %d: row %d is %s, want %s", v.data,
+					v.level, y, row, v.rows[y])
+			}
+		}
+	}
+}
+
+func TestQRCodeCapacity(t *testing.T) {
+	tests := []struct {
+		level   qrLevel
+		maxLen  int
+		version int
+	}{
+		{qrLevelL, 271, 10},
+		{qrLevelM, 213, 10},
+		{qrLevelQ, 151, 10},
+		{qrLevelH, 119, 10},
+		{qrLevelM, 14, 1},
+		{qrLevelH, 7, 1},
+	}
+	for _, tt := range tests {
+		q, err := newQRCode(make([]byte, tt.maxLen), tt.level)
+		if err != nil {
+			t.Errorf("level %d, %d bytes: %v", tt.level, tt.maxLen, err)
+			continue
+		}
+		if want := 17 + 4*tt.version; q.size != want {
+			t.Errorf("level %d, %d bytes: got size %d, want %d", tt.level,
+				tt.maxLen, q.size, want)
+		}
+		if tt.version == qrMaxVersion {
+			_, err = newQRCode(make([]byte, tt.maxLen+1), tt.level)
+			if err == nil {
+				t.Errorf("level %d: %d bytes were encoded", tt.level,
+					tt.maxLen+1)
+			}
+		}
+	}
+}
+
+func TestQRCodeRender(t *testing.T) {
+	q, err := newQRCode([]byte("dcrspy"), qrLevelM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := string(q.svg(96))
+	if !strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg" `+
+		`width="96" height="96" viewBox="0 0 29 29"`) {
+		t.Errorf("unexpected svg %.100s", svg)
+	}
+
+	// Each row of the table spans the width of the code.
+	html := string(q.html(3))
+	rows := strings.Split(html, `<tr style="height: 3px">`)
+	if len(rows) != q.size+1 {
+		t.Fatalf("got %d rows, want %d", len(rows)-1, q.size)
+	}
+	for y, row := range rows[1:] {
+		var span, colspan int
+		for _, cell := range strings.Split(row, "<td ")[1:] {
+			if _, err := fmt.Sscanf(cell, `colspan="%d"`, &colspan); err != nil {
+				t.Fatalf("row %d: %v", y, err)
+			}
+			span += colspan
+		}
+		if span != q.size {
+			t.Errorf("row %d spans %d columns, want %d", y, span, q.size)
+		}
+	}
+}
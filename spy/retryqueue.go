@@ -0,0 +1,347 @@
+// retryqueue.go implements the retry queue of notifications that could not be
+// delivered, so that a notification is not lost when the SMTP server or a
+// webhook endpoint is down.  An email that fails to send, or a webhook
+// delivery that fails all of its immediate attempts, is queued and retried
+// with exponential backoff.  After retryattempts attempts it is dead-lettered:
+// logged as an error and appended to dead-letters.jsonl in the output folder.
+// The queue is saved to retry-queue.json in the output folder on each change,
+// so pending retries survive a restart.  Webhooks in ack mode are not queued,
+// since they are redelivered from the event journal.
+
+package spy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// retryCheckInterval is the interval between checks for due retries.
+	retryCheckInterval = 15 * time.Second
+	// retryInitialBackoff is the delay before the first retry, doubled for
+	// each following retry.
+	retryInitialBackoff = time.Minute
+	// retryMaxBackoff is the maximum delay between retries.
+	retryMaxBackoff = time.Hour
+
+	retryKindEmail   = "email"
+	retryKindWebhook = "webhook"
+)
+
+// errRetryObsolete is returned by attempt if the notification can no longer
+// be delivered (e.g. its webhook was unsubscribed), so it is dropped.
+var errRetryObsolete = errors.New("destination no longer exists")
+
+// retryItem is a queued notification.  Attempts is the number of attempts so
+// far, and Next the time of the next attempt.  The email fields are set for
+// an email, and the webhook fields for a webhook delivery.
+type retryItem struct {
+	ID        uint64 `json:"id"`
+	Kind      string `json:"kind"`
+	Created   int64  `json:"created"`
+	Attempts  int    `json:"attempts"`
+	Next      int64  `json:"next"`
+	LastError string `json:"lasterror"`
+
+	Subject string   `json:"subject,omitempty"`
+	Text    string   `json:"text,omitempty"`
+	HTML    string   `json:"html,omitempty"`
+	To      []string `json:"to,omitempty"`
+
+	Webhook string          `json:"webhook,omitempty"`
+	Tenant  string          `json:"tenant,omitempty"`
+	URL     string          `json:"url,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// String describes the notification in log messages.
+func (it *retryItem) String() string {
+	if it.Kind == retryKindEmail {
+		return fmt.Sprintf("email %q to %v", it.Subject, it.To)
+	}
+	return fmt.Sprintf("event %d to webhook %s", it.Seq, it.URL)
+}
+
+// retryQueue holds the queued notifications.
+type retryQueue struct {
+	mtx      sync.Mutex
+	path     string
+	deadPath string
+	attempts int
+	items    map[uint64]*retryItem
+	lastID   uint64
+
+	retried, delivered, dead *metricCounter
+}
+
+// spyRetryQueue is the package-level retry queue, nil if disabled.
+var spyRetryQueue *retryQueue
+
+// newRetryQueue creates a retryQueue saved at path, restoring the queued
+// notifications, which are dead-lettered to deadPath after attempts attempts.
+func newRetryQueue(path, deadPath string, attempts int) (*retryQueue, error) {
+	if attempts < 1 {
+		return nil, fmt.Errorf("invalid retryattempts %d", attempts)
+	}
+	q := &retryQueue{
+		path:     path,
+		deadPath: deadPath,
+		attempts: attempts,
+		items:    make(map[uint64]*retryItem),
+		retried: spyMetrics.newCounter("dcrspy_notification_retries_total",
+			"Retries of queued notifications."),
+		delivered: spyMetrics.newCounter(
+			"dcrspy_notification_retries_delivered_total",
+			"Queued notifications delivered by a retry."),
+		dead: spyMetrics.newCounter("dcrspy_notification_dead_letters_total",
+			"Queued notifications dead-lettered after the last attempt."),
+	}
+	spyMetrics.newGauge("dcrspy_notification_retry_queue",
+		"Notifications queued for retry.", func() float64 {
+			q.mtx.Lock()
+			defer q.mtx.Unlock()
+			return float64(len(q.items))
+		})
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []*retryItem
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	for _, it := range saved {
+		q.items[it.ID] = it
+		if it.ID > q.lastID {
+			q.lastID = it.ID
+		}
+	}
+	if len(saved) > 0 {
+		log.Infof("%d notification(s) queued for retry.", len(saved))
+	}
+	return q, nil
+}
+
+// retryBackoff returns the delay before the next attempt after the given
+// number of attempts.
+func retryBackoff(attempts int) time.Duration {
+	d := retryInitialBackoff
+	for i := 1; i < attempts && d < retryMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > retryMaxBackoff {
+		d = retryMaxBackoff
+	}
+	return d
+}
+
+// enqueueEmail queues the email to the recipients, which failed to send with
+// err.  It returns false if the queue is disabled.
+func (q *retryQueue) enqueueEmail(subject, text, html string, to []string,
+	err error) bool {
+	return q.enqueue(&retryItem{
+		Kind:      retryKindEmail,
+		LastError: err.Error(),
+		Subject:   subject,
+		Text:      text,
+		HTML:      html,
+		To:        to,
+	})
+}
+
+// enqueueWebhook queues the delivery of the event's payload to the
+// subscription, which failed with err.  It returns false if the queue is
+// disabled.
+func (q *retryQueue) enqueueWebhook(s *webhookSubscription, seq uint64,
+	payload []byte, err error) bool {
+	return q.enqueue(&retryItem{
+		Kind:      retryKindWebhook,
+		LastError: err.Error(),
+		Webhook:   s.ID,
+		Tenant:    s.Tenant,
+		URL:       s.URL,
+		Seq:       seq,
+		Payload:   json.RawMessage(payload),
+	})
+}
+
+// enqueue queues the notification after its first failed attempt.
+func (q *retryQueue) enqueue(it *retryItem) bool {
+	if q == nil {
+		return false
+	}
+	now := time.Now()
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.lastID++
+	it.ID = q.lastID
+	it.Created = now.Unix()
+	it.Attempts = 1
+	it.Next = now.Add(retryBackoff(1)).Unix()
+	q.items[it.ID] = it
+	log.Warnf("Failed to deliver %v: %s. Retrying in %v.", it, it.LastError,
+		retryBackoff(1))
+	if err := q.saveLocked(); err != nil {
+		log.Errorf("Failed to save retry queue: %v", err)
+	}
+	return true
+}
+
+// attempt tries to deliver the notification.
+func (q *retryQueue) attempt(it *retryItem) error {
+	switch it.Kind {
+	case retryKindEmail:
+		if alertEmailConfig == nil {
+			return errors.New("email is not configured")
+		}
+		conf := *alertEmailConfig
+		conf.emailAddrs = it.To
+		return sendEmail(it.Subject, it.Text, it.HTML, &conf)
+	case retryKindWebhook:
+		if spyWebhooks == nil {
+			return errRetryObsolete
+		}
+		s := spyWebhooks.get(it.Tenant, it.Webhook)
+		if s == nil || s.URL != it.URL {
+			return errRetryObsolete
+		}
+		if err := spyWebhooks.post(s, it.Payload); err != nil {
+			return err
+		}
+		spyUsage.notification(s.Tenant)
+		return nil
+	}
+	return errRetryObsolete
+}
+
+// retryDue attempts the notifications that are due, and removes those
+// delivered, obsolete or out of attempts.
+func (q *retryQueue) retryDue() {
+	now := time.Now()
+	q.mtx.Lock()
+	var due []*retryItem
+	for _, it := range q.items {
+		if it.Next <= now.Unix() {
+			due = append(due, it)
+		}
+	}
+	q.mtx.Unlock()
+	if len(due) == 0 {
+		return
+	}
+	sort.Sort(retryItemsByID(due))
+
+	type result struct {
+		it  *retryItem
+		err error
+	}
+	results := make([]result, 0, len(due))
+	for _, it := range due {
+		q.retried.inc()
+		results = append(results, result{it, q.attempt(it)})
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for _, r := range results {
+		it := r.it
+		it.Attempts++
+		switch {
+		case r.err == nil:
+			log.Infof("Delivered %v after %d attempts.", it, it.Attempts)
+			q.delivered.inc()
+			delete(q.items, it.ID)
+		case r.err == errRetryObsolete:
+			log.Infof("Dropping %v: %v.", it, r.err)
+			delete(q.items, it.ID)
+		case it.Attempts >= q.attempts:
+			it.LastError = r.err.Error()
+			log.Errorf("Failed to deliver %v after %d attempts: %v. "+
+				"Dead-lettered to %s.", it, it.Attempts, r.err, q.deadPath)
+			if err := q.deadLetter(it); err != nil {
+				log.Errorf("Failed to write dead letter: %v", err)
+			}
+			q.dead.inc()
+			delete(q.items, it.ID)
+		default:
+			it.LastError = r.err.Error()
+			it.Next = now.Add(retryBackoff(it.Attempts)).Unix()
+			log.Debugf("Retry %d of %v failed: %v", it.Attempts-1, it, r.err)
+		}
+	}
+	if err := q.saveLocked(); err != nil {
+		log.Errorf("Failed to save retry queue: %v", err)
+	}
+}
+
+// deadLetter appends the notification to the dead letter file.
+func (q *retryQueue) deadLetter(it *retryItem) error {
+	b, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(q.deadPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type retryItemsByID []*retryItem
+
+func (s retryItemsByID) Len() int           { return len(s) }
+func (s retryItemsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s retryItemsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// saveLocked writes the queue to the file.  The mutex must be held.
+func (q *retryQueue) saveLocked() error {
+	saved := make([]*retryItem, 0, len(q.items))
+	for _, it := range q.items {
+		saved = append(saved, it)
+	}
+	sort.Sort(retryItemsByID(saved))
+	b, err := json.MarshalIndent(saved, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// run retries the due notifications at retryCheckInterval until quit is
+// closed.  It should be run as a goroutine.
+func (q *retryQueue) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(retryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.retryDue()
+		case <-quit:
+			log.Debugf("Quitting retry queue.")
+			return
+		}
+	}
+}
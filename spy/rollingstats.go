@@ -0,0 +1,315 @@
+// rollingstats.go maintains rolling statistics (min, max, mean, median and
+// standard deviation) of collected fields over windows of the most recent
+// blocks or of the most recent period of time, e.g.
+//
+//	rollingstat=ticket_price:144
+//	rollingstat=fee_mean:24h
+//
+// The fields are the variables of derived metric expressions (see derived.go),
+// including the derived metrics.  The samples are saved to a file, so the
+// windows are kept across restarts, and the statistics are served by the
+// stats API.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rollingStatsSaveInterval is the interval between saves of the samples.
+const rollingStatsSaveInterval = 5 * time.Minute
+
+// rollingSample is a value of a field at a block.
+type rollingSample struct {
+	Height int64   `json:"height"`
+	Time   int64   `json:"time"`
+	Value  float64 `json:"value"`
+}
+
+// rollingStat is a field and its window, either a number of blocks or a
+// duration.
+type rollingStat struct {
+	name    string
+	field   string
+	blocks  int
+	period  time.Duration
+	samples []rollingSample
+}
+
+// add appends a sample, first dropping any samples at or above its height
+// (after a reorg), then those outside of the window.
+func (s *rollingStat) add(sample rollingSample) {
+	n := len(s.samples)
+	for n > 0 && s.samples[n-1].Height >= sample.Height {
+		n--
+	}
+	s.samples = append(s.samples[:n], sample)
+	s.trim()
+}
+
+// trim drops the samples outside of the window ending at the last sample.
+func (s *rollingStat) trim() {
+	n := len(s.samples)
+	if n == 0 {
+		return
+	}
+	first := 0
+	if s.blocks > 0 {
+		if n > s.blocks {
+			first = n - s.blocks
+		}
+	} else {
+		cutoff := s.samples[n-1].Time - int64(s.period/time.Second)
+		for first < n && s.samples[first].Time <= cutoff {
+			first++
+		}
+	}
+	if first > 0 {
+		s.samples = append([]rollingSample(nil), s.samples[first:]...)
+	}
+}
+
+// rollingStatSummary is the statistics of a field over its window.
+type rollingStatSummary struct {
+	Name       string  `json:"name"`
+	Field      string  `json:"field"`
+	Window     string  `json:"window"`
+	Count      int     `json:"count"`
+	FromHeight int64   `json:"fromheight,omitempty"`
+	ToHeight   int64   `json:"toheight,omitempty"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	Mean       float64 `json:"mean"`
+	Median     float64 `json:"median"`
+	StdDev     float64 `json:"stddev"`
+}
+
+// summary computes the statistics of the samples.
+func (s *rollingStat) summary() *rollingStatSummary {
+	sum := &rollingStatSummary{
+		Name:  s.name,
+		Field: s.field,
+		Count: len(s.samples),
+	}
+	if s.blocks > 0 {
+		sum.Window = fmt.Sprintf("%d blocks", s.blocks)
+	} else {
+		sum.Window = s.period.String()
+	}
+	if sum.Count == 0 {
+		return sum
+	}
+	sum.FromHeight = s.samples[0].Height
+	sum.ToHeight = s.samples[sum.Count-1].Height
+
+	values := make([]float64, sum.Count)
+	sum.Min, sum.Max = math.Inf(1), math.Inf(-1)
+	var total float64
+	for i, sample := range s.samples {
+		values[i] = sample.Value
+		total += sample.Value
+		sum.Min = math.Min(sum.Min, sample.Value)
+		sum.Max = math.Max(sum.Max, sample.Value)
+	}
+	sum.Mean = total / float64(sum.Count)
+	var sq float64
+	for _, v := range values {
+		sq += (v - sum.Mean) * (v - sum.Mean)
+	}
+	sum.StdDev = math.Sqrt(sq / float64(sum.Count))
+	// MedianCoin sorts values, which is a copy.
+	sum.Median = MedianCoin(values)
+	return sum
+}
+
+// parseRollingStat parses a FIELD:WINDOW specification, where WINDOW is a
+// number of blocks or a duration.
+func parseRollingStat(spec string) (*rollingStat, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid rolling statistic %q: expected "+
+			"FIELD:WINDOW", spec)
+	}
+	field, window := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if !derivedMetricNameRE.MatchString(field) {
+		return nil, fmt.Errorf("invalid field name in %q", spec)
+	}
+	s := &rollingStat{name: field + ":" + window, field: field}
+	if n, err := strconv.Atoi(window); err == nil {
+		if n < 1 {
+			return nil, fmt.Errorf("invalid window in %q", spec)
+		}
+		s.blocks = n
+		return s, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid window in %q: expected a number of "+
+			"blocks or a duration", spec)
+	}
+	s.period = d
+	return s, nil
+}
+
+// rollingStats maintains the configured rolling statistics.
+type rollingStats struct {
+	mtx   sync.Mutex
+	path  string
+	stats []*rollingStat
+}
+
+// spyRollingStats is the package-level set of rolling statistics, nil if
+// none are configured.
+var spyRollingStats *rollingStats
+
+// newRollingStats parses the statistics specifications and loads the samples
+// saved at path.
+func newRollingStats(specs []string, path string) (*rollingStats, error) {
+	r := &rollingStats{path: path}
+	for _, spec := range specs {
+		s, err := parseRollingStat(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range r.stats {
+			if other.name == s.name {
+				return nil, fmt.Errorf("rolling statistic %s defined twice",
+					s.name)
+			}
+		}
+		r.stats = append(r.stats, s)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved map[string][]rollingSample
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	// Samples of statistics no longer configured are discarded.
+	for _, s := range r.stats {
+		s.samples = saved[s.name]
+		s.trim()
+	}
+	return r, nil
+}
+
+// add adds the fields of the block data to the statistics.  A field that is
+// not available for the block (e.g. a derived metric that could not be
+// computed) is skipped.
+func (r *rollingStats) add(d *blockData) {
+	if r == nil {
+		return
+	}
+	vars := d.vars()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, s := range r.stats {
+		v, ok := vars[s.field]
+		if !ok {
+			continue
+		}
+		s.add(rollingSample{
+			Height: int64(d.header.Height),
+			Time:   d.header.Time,
+			Value:  v,
+		})
+	}
+}
+
+// summaries returns the statistics of the given field, or of all fields if
+// field is empty.
+func (r *rollingStats) summaries(field string) []*rollingStatSummary {
+	if r == nil {
+		return []*rollingStatSummary{}
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	sums := make([]*rollingStatSummary, 0, len(r.stats))
+	for _, s := range r.stats {
+		if field == "" || s.field == field {
+			sums = append(sums, s.summary())
+		}
+	}
+	return sums
+}
+
+// save writes the samples to the file.
+func (r *rollingStats) save() error {
+	r.mtx.Lock()
+	saved := make(map[string][]rollingSample, len(r.stats))
+	for _, s := range r.stats {
+		saved[s.name] = s.samples
+	}
+	b, err := json.Marshal(saved)
+	r.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// run saves the samples at rollingStatsSaveInterval and when quit is closed.
+// It should be run as a goroutine.
+func (r *rollingStats) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(rollingStatsSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.save(); err != nil {
+				log.Errorf("Failed to save rolling statistics: %v", err)
+			}
+		case <-quit:
+			if err := r.save(); err != nil {
+				log.Errorf("Failed to save rolling statistics: %v", err)
+			}
+			log.Debugf("Quitting rolling statistics saver.")
+			return
+		}
+	}
+}
+
+// rollingStatsAPI documents statsHandler.
+var rollingStatsAPI = []apiOperation{{
+	method:  "GET",
+	summary: "Get the rolling statistics",
+	params: []apiParam{
+		{name: "field", in: "query", typ: "string",
+			description: "Only the statistics of the field"},
+	},
+	response: []*rollingStatSummary{},
+}}
+
+// statsHandler serves GET /stats with the rolling statistics, optionally only
+// those of the field given by the field query parameter.
+func (r *rollingStats) statsHandler(w http.ResponseWriter, req *http.Request,
+	t *tenant) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.summaries(req.URL.Query().Get("field")))
+}
@@ -1,4 +1,4 @@
-package main
+package spy
 
 import (
 	"fmt"
@@ -10,7 +10,7 @@ import (
 var requiredChainServerAPI = semver{major: 3, minor: 1, patch: 0}
 var requiredWalletAPI = semver{major: 4, minor: 1, patch: 0}
 
-func connectWalletRPC(cfg *config) (*dcrrpcclient.Client, semver, error) {
+func connectWalletRPC(cfg *Config) (*dcrrpcclient.Client, semver, error) {
 	var dcrwCerts []byte
 	var err error
 	var walletVer semver
@@ -65,7 +65,7 @@ func connectWalletRPC(cfg *config) (*dcrrpcclient.Client, semver, error) {
 	return dcrwClient, walletVer, nil
 }
 
-func connectNodeRPC(cfg *config) (*dcrrpcclient.Client, semver, error) {
+func connectNodeRPC(cfg *Config) (*dcrrpcclient.Client, semver, error) {
 	var dcrdCerts []byte
 	var err error
 	var nodeVer semver
@@ -0,0 +1,1682 @@
+// Package spy is the dcrspy monitoring engine: the block, stake info and
+// mempool data collectors and savers, the chain and mempool monitors, the
+// watched address handlers, and the HTTP API.  It is used by the dcrspy
+// command, and may be embedded in other Go programs with Run:
+//
+//	cfg := spy.DefaultConfig()
+//	cfg.DcrdUser, cfg.DcrdPass = "user", "pass"
+//	cfg.NoCollectStakeInfo = true
+//	go spy.Run(cfg, stop)
+//
+// The engine's state is global, so only one Run may be in progress at a time.
+package spy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrjson"
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+)
+
+const (
+	spyart = `
+                       __                          
+                  ____/ /__________________  __  __
+                 / __  / ___/ ___/ ___/ __ \/ / / /
+                / /_/ / /__/ /  (__  ) /_/ / /_/ / 
+                \__,_/\___/_/  /____/ .___/\__, /  
+                                   /_/    /____/  
+`
+)
+
+// Run does all the work, monitoring until stop is closed, and returns the
+// process exit code, which the caller may exit with.  If stop is nil,
+// monitoring stops on an interrupt signal (CTRL+C).  The config is normalized
+// by Run if it was not loaded with LoadConfig, and loggers may be set up with
+// UseLogger.  The engine's state is reset when Run returns, so Run may be
+// called again, but only one Run may be in progress at a time.
+//
+// The exit code is 0 once monitoring stops, and otherwise identifies the
+// failure that stopped Run from starting (see Exit Codes in README.md):
+//
+//	1 config, 2 output folder, 4 dcrd connection, 5 dcrd network,
+//	6 watchaddress policy, 7 block notifications, 9 block collector,
+//	10 initial block data, 11 block data summary, 12 stake info collector,
+//	13 mempool collector, 14 initial mempool data, 15 mempool summary,
+//	16 email config, 17 dcrwallet connection, 18 apiallow, 19 event journal,
+//	20 signing key, 21 tenants, 22 webhook subscriptions, 23 cold audit,
+//	24 availability, 25 block transforms, 26 derived metrics,
+//	27 rolling stats, 28 sheets-id, 29 vote expectations,
+//	30 address history, 31 watchaccount wallet, 32 xpub accounts,
+//	33 fiatcurrency, 34 notification templates, 35 Discord, 36 publicallow,
+//	37 SMS config, 38 apikey, 39 PagerDuty, 40 Matrix config,
+//	41 IRC config, 42 XMPP config, 43 desktop notifications,
+//	44 mempool state, 45 address stats, 46 inactive alerts,
+//	47 notification limits, 48 retry queue, 49 MQTT, 50 notification
+//	workers, 51 NDJSON rotation, 52 timeouts, 53 SQLite, 54 MySQL,
+//	55 collectors, 56 Bolt, 57 logalert, 58 host monitoring, 59 NATS,
+//	60 AMQP, 61 Elasticsearch, 62 cloud archive, 63 Slack,
+//	64 pipeline latency, 65 PostgreSQL, 66 apipublic, 67 apicertrole
+//	without apiclientca, 68 apicertrole, 69 watchaddress address, 70 Matrix,
+//	71 XMPP, 72 SMTP server, 73 email templates, 74 block explorer links,
+//	75 stake difficulty notifications, 76 mempool notifications,
+//	77 winning ticket notifications, 78 watched address filter,
+//	79 price alerts, 80 logalert log files, 81 wallet accounts,
+//	82 xpub discovery, 83 webhook, 84 API TLS, 85 API server,
+//	86 public status TLS, 87 public status server, 88 stake info transforms,
+//	89 Google Sheets, 90 poll, 91 block height, 92 initial stake info,
+//	93 stake info summary, 94 emaildigest.
+func Run(cfg *Config, stop <-chan struct{}) int {
+	// Registered last, so it runs after the goroutines have stopped.
+	defer resetRunState()
+
+	if err := cfg.normalize(); err != nil {
+		fmt.Printf("Invalid dcrspy config: %s\n", err.Error())
+		return 1
+	}
+	defer backendLog.Flush()
+
+	// mempool: new transactions, new tickets
+	if cfg.MonitorMempool && cfg.NoMonitor {
+		log.Warn("Both --nomonitor (-e) and --mempool (-m) specified. " +
+			"Not monitoring mempool.")
+		cfg.MonitorMempool = false
+	}
+
+	if cfg.CPUProfile != "" {
+		f, err := os.Create(cfg.CPUProfile)
+		if err != nil {
+			log.Critical(err)
+			return -1
+		}
+		pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
+	}
+
+	// Start with version info
+	log.Infof(appName+" version %s%v", ver.String(), spyart)
+
+	dcrrpcclient.UseLogger(clientLog)
+
+	// Timeouts of SMTP sends, HTTP requests and RPC requests
+	if err := setTimeouts(cfg); err != nil {
+		log.Errorf("Failed to set timeouts: %v", err)
+		return 52
+	}
+
+	log.Debugf("Output folder: %v", cfg.OutFolder)
+	log.Debugf("Log folder: %v", cfg.LogDir)
+
+	// Create data output folder if it does not already exist
+	if err := os.MkdirAll(cfg.OutFolder, 0750); err != nil {
+		fmt.Printf("Failed to create data output folder %s. Error: %s\n",
+			cfg.OutFolder, err.Error())
+		return 2
+	}
+
+	// Connect to dcrd RPC server using websockets. Set up the
+	// notification handler to deliver blocks through a channel.
+	makeChans(cfg)
+
+	// Daemon client connection
+	dcrdClient, nodeVer, err := connectNodeRPC(cfg)
+	if err != nil || dcrdClient == nil {
+		log.Infof("Connection to dcrd failed: %v", err)
+		return 4
+	}
+	// Shut down on an early return too.  Shutting down again is a no-op.
+	defer dcrdClient.Shutdown()
+
+	// Display connected network
+	curnet, err := dcrdClient.GetCurrentNet()
+	if err != nil {
+		fmt.Println("Unable to get current network from dcrd:", err.Error())
+		return 5
+	}
+	log.Infof("Connected to dcrd (JSON-RPC API v%s) on %v",
+		nodeVer.String(), curnet.String())
+
+	// Features depending on dcrd's optional indexes are disabled up front if
+	// they are missing.
+	spyNodeIndexes = probeNodeIndexes(dcrdClient)
+	log.Infof("dcrd indexes: %v", spyNodeIndexes)
+
+	// Validate each watchaddress
+	addresses := make([]dcrutil.Address, 0, len(cfg.WatchAddresses))
+	addrMap := make(map[string]TxAction)
+	var needEmail bool
+	if (len(cfg.WatchAddresses) > 0 || len(cfg.WatchAccounts) > 0 ||
+		len(cfg.WatchXpubs) > 0) && !cfg.NoMonitor {
+		for _, acct := range cfg.WatchAccounts {
+			needEmail = needEmail || parseWatchedAccount(acct).action != 0
+		}
+		for _, x := range cfg.WatchXpubs {
+			if acct, err := parseXpubAccount(x); err == nil {
+				needEmail = needEmail || acct.action != 0
+			}
+		}
+		for _, ai := range cfg.WatchAddresses {
+			// The label may contain commas.
+			s := strings.SplitN(ai, ",", 3)
+
+			var emailActn TxAction
+			if len(s) > 1 && len(s[1]) > 0 {
+				var err error
+				emailActn, err = parseTxAction(s[1])
+				if err != nil {
+					log.Errorf("Invalid watchaddress %v: %v", ai, err)
+					return 6
+				}
+				needEmail = needEmail || (emailActn != 0)
+			}
+
+			a := s[0]
+
+			addr, err := dcrutil.DecodeAddress(a, activeNet.Params)
+			// or DecodeNetworkAddress for auto-detection of network
+			if err != nil {
+				log.Errorf("Invalid watchaddress %v", a)
+				return 69
+			}
+			if _, seen := addrMap[a]; seen {
+				continue
+			}
+			log.Infof("Valid watchaddress: %v", addr)
+			addresses = append(addresses, addr)
+			addrMap[a] = emailActn
+			if len(s) > 2 && s[2] != "" {
+				spyAddrLabels[a] = s[2]
+			}
+		}
+		// Addresses may still be registered via the control API, or by
+		// watched wallet and xpub accounts.
+		if len(addresses) == 0 && cfg.APIListen == "" &&
+			len(cfg.WatchAccounts) == 0 && len(cfg.WatchXpubs) == 0 {
+			if spyChans.relevantTxMempoolChan != nil {
+				close(spyChans.relevantTxMempoolChan)
+				spyChans.relevantTxMempoolChan = nil
+			}
+		}
+	}
+
+	watched := newWatchedAddresses(addrMap)
+
+	// Watched address notifications are sent with each notifier registered
+	// as its channel is configured.
+	spyNotifiers = newNotifierRegistry()
+
+	// Notifications may be sent to Telegram instead of email.
+	if cfg.TelegramToken != "" && cfg.TelegramChat != "" && !cfg.NoMonitor {
+		spyTelegram = newTelegramNotifier(cfg.TelegramToken, cfg.TelegramChat)
+		spyNotifiers.register("telegram", spyTelegram)
+	}
+
+	// Notifications and alerts may be posted to Discord.
+	if cfg.DiscordWebhook != "" {
+		spyDiscord, err = newDiscordNotifier(cfg.DiscordWebhook)
+		if err != nil {
+			log.Errorf("Failed to set up Discord notifications: %v", err)
+			return 35
+		}
+		spyNotifiers.register("discord", spyDiscord)
+	}
+
+	// Notifications, alerts and new blocks may be posted to Slack.
+	if cfg.SlackWebhook != "" {
+		spySlack, err = newSlackNotifier(cfg.SlackWebhook, cfg.SlackBlocks)
+		if err != nil {
+			log.Errorf("Failed to set up Slack notifications: %v", err)
+			return 63
+		}
+		spyNotifiers.register("slack", spySlack)
+	} else if cfg.SlackBlocks {
+		log.Warnf("slackblocks requires slackwebhook.")
+	}
+
+	// High-value events may be sent by SMS.
+	if cfg.TwilioSID != "" && len(cfg.SMSTo) > 0 && !cfg.NoMonitor {
+		if cfg.TwilioToken == "" || cfg.SMSFrom == "" {
+			log.Errorf("SMS requires twiliotoken and smsfrom.")
+			return 37
+		}
+		spySMS = newSMSNotifier(cfg.TwilioSID, cfg.TwilioToken, cfg.SMSFrom,
+			cfg.SMSTo, cfg.SMSMinAmount)
+		spyNotifiers.register("sms", spySMS)
+	}
+
+	// Notifications may be pushed to mobile devices with Pushover.
+	if cfg.PushoverToken != "" && cfg.PushoverUser != "" && !cfg.NoMonitor {
+		spyPushover = newPushoverNotifier(cfg.PushoverToken, cfg.PushoverUser,
+			cfg.PushoverHighAmount, cfg.PushoverEmergencyAmount)
+		spyNotifiers.register("pushover", spyPushover)
+	}
+
+	// Alerts may open PagerDuty incidents.
+	if cfg.PagerDutyKey != "" {
+		spyPagerDuty, err = newPagerDutyNotifier(cfg.PagerDutyKey,
+			cfg.PagerDutySeverities, cfg.PagerDutyMinSeverity)
+		if err != nil {
+			log.Errorf("Failed to set up PagerDuty incidents: %v", err)
+			return 39
+		}
+	}
+
+	// Notifications and chain events may be posted to a Matrix room.
+	if cfg.MatrixServer != "" && !cfg.NoMonitor {
+		if cfg.MatrixToken == "" || cfg.MatrixRoom == "" {
+			log.Errorf("Matrix requires matrixtoken and matrixroom.")
+			return 40
+		}
+		spyMatrix, err = newMatrixNotifier(cfg.MatrixServer, cfg.MatrixToken,
+			cfg.MatrixRoom)
+		if err != nil {
+			log.Errorf("Failed to set up Matrix notifications: %v", err)
+			return 70
+		}
+		spyNotifiers.register("matrix", spyMatrix)
+	}
+
+	// Notifications and block summaries may be announced in an IRC channel.
+	if cfg.IRCServer != "" && !cfg.NoMonitor {
+		if cfg.IRCChannel == "" {
+			log.Errorf("IRC requires ircchannel.")
+			return 41
+		}
+		spyIRC = newIRCNotifier(cfg.IRCServer, cfg.IRCTLS, cfg.IRCPassword,
+			cfg.IRCNick, cfg.IRCChannel)
+		spyNotifiers.register("irc", spyIRC)
+	}
+
+	// Notifications may be sent as XMPP chat messages.
+	if cfg.XMPPJID != "" && !cfg.NoMonitor {
+		if cfg.XMPPPassword == "" || len(cfg.XMPPTo) == 0 {
+			log.Errorf("XMPP requires xmpppass and xmppto.")
+			return 42
+		}
+		spyXMPP, err = newXMPPNotifier(cfg.XMPPJID, cfg.XMPPPassword,
+			cfg.XMPPServer, cfg.XMPPTo)
+		if err != nil {
+			log.Errorf("Failed to set up XMPP notifications: %v", err)
+			return 71
+		}
+		spyNotifiers.register("xmpp", spyXMPP)
+	}
+
+	// Notifications may be shown on the desktop of a workstation.
+	if cfg.DesktopNotify && !cfg.NoMonitor {
+		spyDesktop, err = newDesktopNotifier(cfg.DesktopNotifyBlocks)
+		if err != nil {
+			log.Errorf("Failed to set up desktop notifications: %v", err)
+			return 43
+		}
+		spyNotifiers.register("desktop", spyDesktop)
+	}
+
+	// Templates of the notifications on each channel
+	if cfg.NotifyTemplates != "" {
+		spyNotifyTemplates, err = loadNotifyTemplates(cfg.NotifyTemplates)
+		if err != nil {
+			log.Errorf("Failed to load notification templates: %v", err)
+			return 34
+		}
+	}
+
+	// Duplicate suppression and rate limiting of notifications
+	if cfg.NotifyDedup != 0 || cfg.NotifyRateLimit != 0 {
+		spyNotifyLimiter, err = newNotifyLimiter(cfg.NotifyDedup,
+			cfg.NotifyRateLimit, cfg.NotifyRatePeriod)
+		if err != nil {
+			log.Errorf("Failed to set up notification limits: %v", err)
+			return 47
+		}
+	}
+
+	emailConfig, err := getEmailConfig(cfg)
+	if needEmail && err != nil && spyNotifiers.count() == 0 {
+		log.Error("Error parsing email configuration: ", err)
+		return 16
+	}
+	// An SMTP server that is set but misconfigured is an error even without
+	// email notifications, since alerts are emailed too.
+	if cfg.SMTPServer != "" && err != nil {
+		log.Error("Error parsing email configuration: ", err)
+		return 72
+	}
+	// Alerts are also emailed if an SMTP server is configured.
+	alertEmailConfig = emailConfig
+	if emailConfig != nil {
+		spyEmailTemplates, err = newEmailTemplates(cfg.EmailSubject,
+			cfg.NotifyTemplates)
+		if err != nil {
+			log.Errorf("Failed to load email templates: %v", err)
+			return 73
+		}
+	}
+
+	// Transactions, addresses and blocks are linked to a block explorer in
+	// notifications.
+	if !cfg.NoExplorerLinks {
+		explorerURL := cfg.ExplorerURL
+		if explorerURL == "" {
+			explorerURL = defaultExplorerURL()
+		}
+		spyExplorer, err = newBlockExplorer(explorerURL, cfg.ExplorerTxURL,
+			cfg.ExplorerAddrURL, cfg.ExplorerBlockURL)
+		if err != nil {
+			log.Errorf("Invalid block explorer links: %v", err)
+			return 74
+		}
+	}
+
+	// Register for block connection notifications.
+	if err = dcrdClient.NotifyBlocks(); err != nil {
+		fmt.Printf("Failed to register daemon RPC client for "+
+			"block notifications: %s\n", err.Error())
+		return 7
+	}
+
+	// Register for stake difficulty change notifications.
+	if err = dcrdClient.NotifyStakeDifficulty(); err != nil {
+		fmt.Printf("Failed to register daemon RPC client for "+
+			"stake difficulty change notifications: %s\n", err.Error())
+		return 75
+	}
+
+	// Register for tx accepted into mempool ntfns
+	if err = dcrdClient.NotifyNewTransactions(false); err != nil {
+		fmt.Printf("Failed to register daemon RPC client for "+
+			"new transaction (mempool) notifications: %s\n", err.Error())
+		return 76
+	}
+
+	// For OnNewTickets
+	//  Commented since there is a bug in dcrrpcclient/notify.go
+	// if err := dcrdClient.NotifyNewTickets(); err != nil {
+	// 	fmt.Printf("Failed to register daemon RPC client for  "+
+	// 		"new tickets (mempool) notifications: %s\n", err.Error())
+	// 	os.Exit(1)
+	// }
+
+	if err = dcrdClient.NotifyWinningTickets(); err != nil {
+		fmt.Printf("Failed to register daemon RPC client for  "+
+			"winning tickets notifications: %s\n", err.Error())
+		return 77
+	}
+
+	// Register a Tx filter for addresses (receiving).  The filter applies to
+	// OnRelevantTxAccepted.
+	// TODO: register outpoints (third argument).
+	if len(addresses) > 0 {
+		if err = dcrdClient.LoadTxFilter(true, addresses, nil); err != nil {
+			fmt.Printf("Failed to register addresses.  Error: %v", err.Error())
+			return 78
+		}
+	}
+
+	// Wallet
+
+	var dcrwClient *dcrrpcclient.Client
+	if !cfg.NoCollectStakeInfo {
+		var walletVer semver
+		dcrwClient, walletVer, err = connectWalletRPC(cfg)
+		if err != nil || dcrwClient == nil {
+			log.Infof("Connection to dcrwallet failed: %v", err)
+			return 17
+		}
+		defer dcrwClient.Shutdown()
+		log.Infof("Connected to dcrwallet (JSON-RPC API v%s)",
+			walletVer.String())
+	}
+
+	// Ctrl-C to shut down.
+	// Nothing should be sent the quit channel.  It should only be closed.
+	quit := make(chan struct{})
+	var quitOnce sync.Once
+	stopRun := func() {
+		quitOnce.Do(func() { close(quit) })
+	}
+	// Only accept a single CTRL+C
+	c := make(chan os.Signal, 1)
+	if stop == nil {
+		signal.Notify(c, os.Interrupt)
+		defer signal.Stop(c)
+	}
+
+	// Start waiting for the interrupt signal or stop
+	go func() {
+		select {
+		case <-c:
+			signal.Stop(c)
+			log.Infof("CTRL+C hit.  Closing goroutines.")
+		case <-stop:
+			log.Infof("Stop requested.  Closing goroutines.")
+		case <-quit:
+			// Run returned early.
+			return
+		}
+		// Close the channel so multiple goroutines can get the message
+		stopRun()
+	}()
+
+	// Pipeline latency objectives
+	pipelineLatency.setSLO(stageSaved,
+		time.Duration(cfg.SLOSaveSecs*float64(time.Second)))
+	pipelineLatency.setSLO(stageNotified,
+		time.Duration(cfg.SLONotifySecs*float64(time.Second)))
+
+	// WaitGroup for the monitor goroutines
+	var wg sync.WaitGroup
+	// On an early return, the goroutines already started are stopped.
+	defer func() {
+		stopRun()
+		wg.Wait()
+	}()
+
+	// Samples of the pipeline latency, kept across restarts
+	err = pipelineLatency.load(filepath.Join(cfg.OutFolder,
+		"pipeline-latency.json"))
+	if err != nil {
+		log.Errorf("Failed to load pipeline latency: %v", err)
+		return 64
+	}
+	wg.Add(1)
+	go pipelineLatency.run(&wg, quit)
+
+	// Bounded concurrency of notification sends
+	spyNotifyPool, err = newNotifyPool(cfg.NotifyWorkers,
+		cfg.NotifyConcurrency, quit)
+	if err != nil {
+		log.Errorf("Failed to set up notification workers: %v", err)
+		return 50
+	}
+	wg.Add(1)
+	go spyNotifyPool.run(&wg)
+
+	// Retries of email and webhook notifications that failed to deliver
+	if cfg.RetryAttempts != 0 {
+		spyRetryQueue, err = newRetryQueue(filepath.Join(cfg.OutFolder,
+			"retry-queue.json"), filepath.Join(cfg.OutFolder,
+			"dead-letters.jsonl"), cfg.RetryAttempts)
+		if err != nil {
+			log.Errorf("Failed to load retry queue: %v", err)
+			return 48
+		}
+		wg.Add(1)
+		go spyRetryQueue.run(&wg, quit)
+	}
+
+	// Telegram notifications
+	if spyTelegram != nil {
+		wg.Add(1)
+		go spyTelegram.run(&wg, quit)
+	}
+
+	// Discord notifications
+	if spyDiscord != nil {
+		wg.Add(1)
+		go spyDiscord.run(&wg, quit)
+	}
+
+	// Slack notifications
+	if spySlack != nil {
+		wg.Add(1)
+		go spySlack.run(&wg, quit)
+	}
+
+	// SMS notifications
+	if spySMS != nil {
+		wg.Add(1)
+		go spySMS.run(&wg, quit)
+	}
+
+	// Pushover notifications
+	if spyPushover != nil {
+		wg.Add(1)
+		go spyPushover.run(&wg, quit)
+	}
+
+	// Matrix notifications
+	if spyMatrix != nil {
+		wg.Add(1)
+		go spyMatrix.run(&wg, quit)
+	}
+
+	// IRC notifications
+	if spyIRC != nil {
+		wg.Add(1)
+		go spyIRC.run(&wg, quit)
+	}
+
+	// XMPP notifications
+	if spyXMPP != nil {
+		wg.Add(1)
+		go spyXMPP.run(&wg, quit)
+	}
+
+	// Desktop notifications
+	if spyDesktop != nil {
+		wg.Add(1)
+		go spyDesktop.run(&wg, quit)
+	}
+
+	// PagerDuty incidents
+	if spyPagerDuty != nil {
+		wg.Add(1)
+		go spyPagerDuty.run(&wg, quit)
+	}
+
+	// Key for signing exported data
+	if cfg.SigningKey != "" {
+		spySigner, err = loadOrCreateSigningKey(cfg.SigningKey)
+		if err != nil {
+			log.Errorf("Failed to load signing key: %v", err)
+			return 20
+		}
+		log.Infof("Signing exported data with public key %s",
+			spySigner.publicKey())
+	}
+
+	// Journal of watched address events
+	if !cfg.NoMonitor {
+		spyJournal, err = openEventJournal(filepath.Join(cfg.OutFolder,
+			"events.jsonl"))
+		if err != nil {
+			log.Errorf("Failed to open event journal: %v", err)
+			return 19
+		}
+		defer spyJournal.close()
+	}
+
+	// Exchange rate, for the fiat value of events, notification thresholds
+	// and price alerts
+	if (cfg.NotifyMinFiat > 0 || len(cfg.PriceAlerts) > 0) &&
+		cfg.FiatCurrency == "" {
+		log.Errorf("notifyminfiat and pricealert require fiatcurrency.")
+		return 33
+	}
+	if cfg.FiatCurrency != "" && !cfg.NoMonitor {
+		if len(cfg.PriceAlerts) > 0 {
+			spyPriceAlerts, err = newPriceAlerts(cfg.FiatCurrency,
+				cfg.PriceAlerts)
+			if err != nil {
+				log.Errorf("Failed to set up price alerts: %v", err)
+				return 79
+			}
+		}
+		spyExchangeRate = newExchangeRate(cfg.FiatCurrency, cfg.NotifyMinFiat)
+	}
+
+	// Host resources
+	profileDir := filepath.Join(cfg.OutFolder, "profiles")
+	if cfg.ProfileDir != "" {
+		profileDir = cleanAndExpandPath(cfg.ProfileDir)
+	}
+	spyHostMonitor, err = newHostMonitor(append([]string{cfg.OutFolder},
+		cfg.DiskPaths...), cfg.DiskMinFree, cfg.MaxMemory, cfg.MaxGoroutines,
+		cfg.MaxCPU, profileDir)
+	if err != nil {
+		log.Errorf("Failed to set up host monitoring: %v", err)
+		return 58
+	}
+
+	// Log tailing
+	var logRules []*logAlertRule
+	for _, s := range cfg.LogAlerts {
+		r, err := parseLogAlertRule(s)
+		if err != nil {
+			log.Errorf("Failed to set up log alerts: %v", err)
+			return 57
+		}
+		logRules = append(logRules, r)
+	}
+	var tailers []*logTailer
+	if len(logRules) > 0 {
+		if cfg.DcrdLogFile == "" && cfg.DcrwLogFile == "" {
+			log.Errorf("logalert requires dcrdlogfile or dcrwlogfile.")
+			return 80
+		}
+		if cfg.DcrdLogFile != "" {
+			tailers = append(tailers, newLogTailer("dcrd",
+				cleanAndExpandPath(cfg.DcrdLogFile), logRules))
+		}
+		if cfg.DcrwLogFile != "" {
+			tailers = append(tailers, newLogTailer("dcrwallet",
+				cleanAndExpandPath(cfg.DcrwLogFile), logRules))
+		}
+	}
+
+	// History of the watched addresses
+	watchXpubs := len(cfg.WatchXpubs) > 0 && !cfg.NoMonitor &&
+		spyNodeIndexes.require("addrindex", "xpub account discovery")
+	if (cfg.AddrHistory || cfg.AddrBackfill || watchXpubs) && !cfg.NoMonitor {
+		backfill := (cfg.AddrBackfill || watchXpubs) &&
+			spyNodeIndexes.require("addrindex", "Address history backfill")
+		var backfillClient *dcrrpcclient.Client
+		if backfill {
+			backfillClient = dcrdClient
+		}
+		spyAddrHistory, err = openAddrHistory(filepath.Join(cfg.OutFolder,
+			"address-history.jsonl"), watched, backfillClient)
+		if err != nil {
+			log.Errorf("Failed to open address history: %v", err)
+			return 30
+		}
+		defer spyAddrHistory.close()
+		if backfill {
+			wg.Add(1)
+			go spyAddrHistory.runBackfill(&wg, quit)
+			spyAddrHistory.backfillUnrecorded()
+		}
+	}
+
+	// Addresses of watched wallet accounts
+	if len(cfg.WatchAccounts) > 0 && !cfg.NoMonitor {
+		if dcrwClient == nil {
+			log.Errorf("watchaccount requires the wallet connection " +
+				"(disabled by nostakeinfo).")
+			return 31
+		}
+		accounts := newAccountWatcher(dcrwClient, dcrdClient, watched,
+			cfg.WatchAccounts)
+		if err = accounts.sync(); err != nil {
+			log.Errorf("Failed to watch wallet accounts: %v", err)
+			return 81
+		}
+		wg.Add(1)
+		go accounts.run(&wg, quit)
+	}
+
+	// Addresses of watched xpub accounts
+	if watchXpubs {
+		spyXpubs, err = newXpubWatcher(dcrdClient, watched, cfg.WatchXpubs)
+		if err != nil {
+			log.Errorf("Failed to set up xpub accounts: %v", err)
+			return 32
+		}
+		if err = spyXpubs.discover(); err != nil {
+			log.Errorf("Failed to discover xpub account addresses: %v", err)
+			return 82
+		}
+		wg.Add(1)
+		go spyXpubs.run(&wg, quit)
+	}
+
+	// Uptime, RPC availability and missed blocks
+	if !cfg.NoMonitor {
+		spyAvailability, err = newAvailabilityTracker(filepath.Join(
+			cfg.OutFolder, "availability.json"))
+		if err != nil {
+			log.Errorf("Failed to load availability history: %v", err)
+			return 24
+		}
+		wg.Add(1)
+		go spyAvailability.run(dcrdClient, &wg, quit)
+	}
+
+	// Watched transactions awaiting confirmation and mempool tickets, across
+	// restarts
+	if !cfg.NoMonitor || cfg.MonitorMempool {
+		spyMempoolState, err = newMempoolState(filepath.Join(cfg.OutFolder,
+			"mempool-state.json"))
+		if err != nil {
+			log.Errorf("Failed to load mempool state: %v", err)
+			return 44
+		}
+		wg.Add(1)
+		go spyMempoolState.run(&wg, quit)
+	}
+
+	// Statistics of each watched address, across restarts
+	if !cfg.NoMonitor {
+		spyAddrStats, err = newAddrStats(filepath.Join(cfg.OutFolder,
+			"address-stats.json"), watched)
+		if err != nil {
+			log.Errorf("Failed to load address statistics: %v", err)
+			return 45
+		}
+		wg.Add(1)
+		go spyAddrStats.run(&wg, quit)
+	}
+
+	// Alerts on watched addresses without expected activity
+	if len(cfg.InactiveAlerts) > 0 && !cfg.NoMonitor {
+		spyInactivity, err = newInactivityAlerts(cfg.InactiveAlerts, watched)
+		if err != nil {
+			log.Errorf("Failed to set up inactive address alerts: %v", err)
+			return 46
+		}
+	}
+
+	// Rolling statistics
+	if len(cfg.RollingStats) > 0 && !cfg.NoMonitor {
+		spyRollingStats, err = newRollingStats(cfg.RollingStats,
+			filepath.Join(cfg.OutFolder, "rolling-stats.json"))
+		if err != nil {
+			log.Errorf("Failed to set up rolling statistics: %v", err)
+			return 27
+		}
+		wg.Add(1)
+		go spyRollingStats.run(&wg, quit)
+	}
+
+	// Ticket pool composition
+	if cfg.TicketPoolInterval > 0 && !cfg.NoMonitor &&
+		spyNodeIndexes.require("txindex", "Ticket pool sampling") {
+		spyTicketPool = newTicketPoolSampler(dcrdClient, cfg.OutFolder,
+			cfg.TicketPoolBucket)
+		wg.Add(1)
+		go spyTicketPool.run(cfg.TicketPoolInterval, &wg, quit)
+	}
+
+	// Mempool votes for new blocks
+	if cfg.VoteWait > 0 && !cfg.NoMonitor {
+		spyVoteMonitor = newMempoolVoteMonitor(dcrdClient, cfg.VoteWait)
+	}
+
+	// Chain halt detection
+	if cfg.HaltAge > 0 && !cfg.NoMonitor {
+		spyChainHalt = newChainHaltDetector(dcrdClient, cfg.HaltAge)
+		wg.Add(1)
+		go spyChainHalt.run(&wg, quit)
+	}
+
+	// Vote estimates for the wallet's tickets
+	if !cfg.NoCollectStakeInfo && !cfg.NoMonitor {
+		spyTicketEstimator = newTicketVoteEstimator(dcrwClient,
+			cfg.TicketExpiryAlert)
+	}
+
+	// Expectations of the voting wallet
+	if len(cfg.VoteExpectations) > 0 && !cfg.NoMonitor {
+		spyVoteExpect, err = newVoteExpectChecker(dcrdClient, dcrwClient,
+			cfg.VoteExpectations)
+		if err != nil {
+			log.Errorf("Failed to set up vote expectations: %v", err)
+			return 29
+		}
+		log.Infof("Checking the voting wallet's votes: %v", spyVoteExpect.exp)
+	}
+
+	// API tenants
+	if cfg.APITenants != "" {
+		spyTenants, err = loadTenants(cfg.APITenants)
+		if err != nil {
+			log.Errorf("Failed to load tenants: %v", err)
+			return 21
+		}
+		log.Infof("Multi-tenant mode with %d tenants", len(spyTenants.tenants))
+	}
+
+	// The operator's API keys and their roles
+	if len(cfg.APIKeys) > 0 {
+		spyAPIKeys, err = parseAPIKeys(cfg.APIKeys)
+		if err != nil {
+			log.Errorf("Failed to parse API keys: %v", err)
+			return 38
+		}
+		if spyTenants != nil {
+			log.Warnf("The apikey option is ignored in multi-tenant mode.")
+		}
+	}
+	if len(cfg.APICertRoles) > 0 {
+		if cfg.APIClientCA == "" {
+			log.Errorf("The apicertrole option requires apiclientca.")
+			return 67
+		}
+		spyCertRoles, err = parseAPICertRoles(cfg.APICertRoles)
+		if err != nil {
+			log.Errorf("Failed to parse API certificate roles: %v", err)
+			return 68
+		}
+		if spyTenants != nil {
+			log.Warnf("The apicertrole option is ignored in multi-tenant " +
+				"mode.")
+		}
+	}
+
+	// Without API keys or tenants, every caller is the operator, which must
+	// not be the case for a public API.
+	if cfg.APIPublic && spyTenants == nil && spyAPIKeys == nil &&
+		spyCertRoles == nil {
+		log.Errorf("The apipublic option requires apikey, apicertrole or " +
+			"apitenants.")
+		return 66
+	}
+
+	// Webhooks, configured in the config file or subscribed with the API
+	if (cfg.APIListen != "" || len(cfg.Webhooks) > 0) && !cfg.NoMonitor {
+		spyWebhooks, err = newWebhookManager(filepath.Join(cfg.OutFolder,
+			"webhooks.json"), cfg.WebhookAllow)
+		if err != nil {
+			log.Errorf("Failed to load webhook subscriptions: %v", err)
+			return 22
+		}
+		if err = spyWebhooks.addConfigured(cfg.Webhooks); err != nil {
+			log.Errorf("Invalid webhook: %v", err)
+			return 83
+		}
+		wg.Add(1)
+		go spyWebhooks.run(&wg, quit)
+	}
+
+	// HTTP server for metrics, the GraphQL API and the control API
+	if cfg.APIListen != "" && !cfg.NoMonitor {
+		if cfg.APICacheSize > 0 {
+			spyDataCache = newStoredDataCache(cfg.APICacheSize)
+		}
+		apiServer := newAPIServer(cfg.APIListen)
+		apiServer.handle("/metrics", spyMetrics, metricsAPI...)
+		apiServer.handle("/api/spec",
+			spyTenants.require(apiServer.specHandler), specAPI...)
+		apiServer.handle("/graphql", spyTenants.require(
+			func(w http.ResponseWriter, r *http.Request, t *tenant) {
+				gqlHandler(newGraphQLResolvers(cfg.OutFolder, dcrdClient,
+					t))(w, r)
+			}), graphQLAPI...)
+		watchCtl := newWatchControl(watched, dcrdClient, cfg.APIPublic)
+		apiServer.handle("/watch", spyTenants.require(watchCtl.serve),
+			watchAPI...)
+		apiServer.handle("/api/tx/decode", spyTenants.require(
+			newTxDecoder(dcrdClient, watched).serve), txDecodeAPI...)
+		apiServer.handle("/api/address/",
+			spyTenants.require(spyAddrHistory.historyHandler),
+			addrHistoryAPI...)
+		apiServer.handle("/usage", spyTenants.require(usageHandler(watched)),
+			usageAPI...)
+		apiServer.handle("/addrstats",
+			spyTenants.require(spyAddrStats.statsHandler), addrStatsAPI...)
+		apiServer.handle("/addrstats.html",
+			spyTenants.require(spyAddrStats.pageHandler), addrStatsPageAPI...)
+		apiServer.handle("/qr", spyTenants.require(paymentQRHandler(watched)),
+			paymentQRAPI...)
+		apiServer.handle("/events", spyTenants.require(eventsHandler),
+			eventsAPI...)
+		apiServer.handle("/audit", spyTenants.require(auditHandler),
+			auditAPI...)
+		apiServer.handle("/api/mute", spyTenants.require(muteHandler),
+			muteAPI...)
+		apiServer.handle("/events/ws",
+			spyTenants.require(eventStreamHandler), eventStreamAPI...)
+		apiServer.handle("/status",
+			spyTenants.require(spyAvailability.statusHandler), statusAPI...)
+		apiServer.handle("/stats",
+			spyTenants.require(spyRollingStats.statsHandler),
+			rollingStatsAPI...)
+		apiServer.handle("/block/best",
+			spyTenants.require(bestBlockHandler(cfg.OutFolder)),
+			bestBlockAPI...)
+		apiServer.handle("/stakeinfo/current",
+			spyTenants.require(currentStakeInfoHandler(cfg.OutFolder)),
+			currentStakeInfoAPI...)
+		apiServer.handle("/ticketpool",
+			spyTenants.require(spyTicketPool.ticketPoolHandler),
+			ticketPoolAPI...)
+		apiServer.handle("/tickets",
+			spyTenants.require(spyTicketEstimator.ticketsHandler),
+			ticketsAPI...)
+		apiServer.handle("/voteexpect",
+			spyTenants.require(spyVoteExpect.voteExpectHandler),
+			voteExpectAPI...)
+		apiServer.handle("/xpub", spyTenants.require(spyXpubs.xpubHandler),
+			xpubAPI...)
+		apiServer.handle("/webhooks", spyTenants.require(spyWebhooks.serve),
+			webhooksAPI...)
+		apiServer.handle("/webhooks/", spyTenants.require(spyWebhooks.serve),
+			webhookAPI...)
+		if err = apiServer.allowFrom(cfg.APIAllow); err != nil {
+			log.Errorf("Invalid apiallow: %v", err)
+			return 18
+		}
+		if cfg.APITLSCert != "" || cfg.APIClientCA != "" {
+			err = apiServer.useTLS(cfg.APITLSCert, cfg.APITLSKey,
+				cfg.APIClientCA)
+			if err != nil {
+				log.Errorf("Failed to set up HTTP server TLS: %v", err)
+				return 84
+			}
+		}
+		if err = apiServer.start(&wg, quit); err != nil {
+			log.Errorf("Failed to start HTTP server: %v", err)
+			return 85
+		}
+	}
+
+	// Public status page, on its own listener
+	if cfg.PublicListen != "" && !cfg.NoMonitor {
+		spyPublicStatus = newPublicStatus()
+		publicServer := publicStatusServer(cfg.PublicListen, spyPublicStatus)
+		if err = publicServer.allowFrom(cfg.PublicAllow); err != nil {
+			log.Errorf("Invalid publicallow: %v", err)
+			return 36
+		}
+		if cfg.PublicTLSCert != "" {
+			err = publicServer.useTLS(cfg.PublicTLSCert, cfg.PublicTLSKey, "")
+			if err != nil {
+				log.Errorf("Failed to set up public status page TLS: %v", err)
+				return 86
+			}
+		}
+		if err = publicServer.start(&wg, quit); err != nil {
+			log.Errorf("Failed to start public status page: %v", err)
+			return 87
+		}
+	}
+
+	// Cold storage audit
+	if len(cfg.ColdAddresses) > 0 && !cfg.NoMonitor &&
+		spyNodeIndexes.require("addrindex", "Cold storage audit") {
+		auditor, err := newColdAuditor(dcrdClient, cfg.ColdAddresses,
+			filepath.Join(cfg.OutFolder, "cold-audit.json"))
+		if err != nil {
+			log.Errorf("Failed to set up cold storage audit: %v", err)
+			return 23
+		}
+		interval := cfg.ColdAuditInterval
+		if interval <= 0 {
+			interval = defaultColdAuditInterval
+		}
+		wg.Add(1)
+		go auditor.run(interval, &wg, quit)
+	}
+
+	// Heartbeat messages
+	if cfg.Heartbeat > 0 && !cfg.NoMonitor {
+		wg.Add(1)
+		go heartbeat(dcrdClient, cfg.Heartbeat, &wg, quit)
+	}
+
+	// Watch-list coverage reports
+	if cfg.CoverageReport > 0 && !cfg.NoMonitor {
+		wg.Add(1)
+		go coverageReporter(watched, cfg.CoverageReport, &wg, quit)
+	}
+
+	// Chain events, and Grafana annotations
+	if !cfg.NoMonitor {
+		if cfg.GrafanaURL != "" {
+			spyGrafana = newGrafanaAnnotator(cfg.GrafanaURL, cfg.GrafanaAPIKey,
+				cfg.GrafanaDashboard)
+			wg.Add(1)
+			go spyGrafana.run(&wg, quit)
+		}
+		spyChainEvents = newChainEventDetector(dcrdClient)
+
+		started := &spyEvent{
+			Type:    eventTypeSpy,
+			Action:  eventActionStarted,
+			Message: fmt.Sprintf("%s %s started.", appName, ver.String()),
+		}
+		publishEvent(started)
+		spyGrafana.annotate(started)
+	}
+
+	// Dead man's switch pings
+	if cfg.DeadMansSwitch != "" && !cfg.NoMonitor {
+		spyDeadMansSwitch = newDeadMansSwitch(cfg.DeadMansSwitch)
+		log.Infof("Pinging dead man's switch after each block: %s",
+			cfg.DeadMansSwitch)
+	}
+
+	// Periodic usage reports
+	if cfg.UsageReportInterval > 0 && !cfg.NoMonitor {
+		wg.Add(1)
+		go usageReporter(cfg.UsageReportInterval, cfg.OutFolder, watched,
+			&wg, quit)
+	}
+
+	// Post-processing pipelines for the JSON savers
+	if blockDataPipeline, err = parseTransformPipeline(cfg.BlockTransforms); err != nil {
+		log.Errorf("Invalid block data transform: %v", err)
+		return 25
+	}
+	if stakeInfoPipeline, err = parseTransformPipeline(cfg.StakeInfoTransforms); err != nil {
+		log.Errorf("Invalid stake info transform: %v", err)
+		return 88
+	}
+
+	// Derived metrics and metric alerts
+	if len(cfg.DerivedMetrics) > 0 || len(cfg.MetricAlerts) > 0 {
+		spyDerivedMetrics, err = newDerivedMetrics(cfg.DerivedMetrics,
+			cfg.MetricAlerts)
+		if err != nil {
+			log.Errorf("Invalid derived metric: %v", err)
+			return 26
+		}
+	}
+
+	// Exchange rate updates, once the alerts checked on each update are set up
+	if spyExchangeRate != nil {
+		wg.Add(1)
+		go spyExchangeRate.run(&wg, quit)
+	}
+
+	// Saver mutex, to share the same underlying output resource between block
+	// and stake info data savers
+	saverMutexTerm := new(sync.Mutex)
+	saverMutexFiles := new(sync.Mutex)
+
+	// Build a slice of each required saver type for each data source
+	var blockDataSavers []BlockDataSaver
+	var stakeInfoDataSavers []StakeInfoDataSaver
+	var mempoolSavers []MempoolDataSaver
+	// JSON to stdout
+	if cfg.SaveJSONStdout {
+		blockDataSavers = append(blockDataSavers,
+			NewBlockDataToJSONStdOut(saverMutexTerm))
+		stakeInfoDataSavers = append(stakeInfoDataSavers,
+			NewStakeInfoDataToJSONStdOut(saverMutexTerm))
+		mempoolSavers = append(mempoolSavers,
+			NewMempoolDataToJSONStdOut(saverMutexTerm))
+	}
+	// JSON to file
+	if cfg.SaveJSONFile {
+		blockDataSavers = append(blockDataSavers,
+			NewBlockDataToJSONFiles(cfg.OutFolder, blockDataFilePrefix, saverMutexFiles))
+		stakeInfoDataSavers = append(stakeInfoDataSavers,
+			NewStakeInfoDataToJSONFiles(cfg.OutFolder, stakeInfoFilePrefix,
+				saverMutexFiles))
+		mempoolSavers = append(mempoolSavers,
+			NewMempoolDataToJSONFiles(cfg.OutFolder, "mempool-info-", saverMutexFiles))
+	}
+
+	// CSV files
+	if cfg.SaveCSV {
+		blockDataCSV := NewBlockDataToCSV(cfg.OutFolder,
+			cfg.CSVBlockDataColumns)
+		defer blockDataCSV.close()
+		stakeInfoCSV := NewStakeInfoDataToCSV(cfg.OutFolder,
+			cfg.CSVStakeInfoColumns)
+		defer stakeInfoCSV.close()
+		blockDataSavers = append(blockDataSavers, blockDataCSV)
+		stakeInfoDataSavers = append(stakeInfoDataSavers, stakeInfoCSV)
+		if !cfg.NoMonitor {
+			spyEventsCSV = newCSVAppender(cfg.OutFolder, eventsCSVPrefix,
+				eventCSVColumns)
+			defer spyEventsCSV.close()
+		}
+	}
+
+	// Newline-delimited JSON files
+	if cfg.SaveNDJSON {
+		if cfg.NDJSONRotateSize < 0 || cfg.NDJSONRotatePeriod < 0 {
+			log.Errorf("Invalid newline-delimited JSON rotation.")
+			return 51
+		}
+		blockDataNDJSON := NewBlockDataToNDJSON(cfg.OutFolder, activeNet.Name,
+			cfg.NDJSONRotateSize<<20, cfg.NDJSONRotatePeriod)
+		defer blockDataNDJSON.close()
+		stakeInfoNDJSON := NewStakeInfoDataToNDJSON(cfg.OutFolder,
+			activeNet.Name, cfg.NDJSONRotateSize<<20, cfg.NDJSONRotatePeriod)
+		defer stakeInfoNDJSON.close()
+		blockDataSavers = append(blockDataSavers, blockDataNDJSON)
+		stakeInfoDataSavers = append(stakeInfoDataSavers, stakeInfoNDJSON)
+	}
+
+	// SQLite database
+	if cfg.SaveSQLite {
+		spySQLite, err = newSQLiteStore(filepath.Join(cfg.OutFolder,
+			sqliteFileName), newDBWALConfig(cfg, "sqlite"))
+		if err != nil {
+			log.Errorf("Failed to open SQLite database: %v", err)
+			return 53
+		}
+		defer spySQLite.close()
+		blockDataSavers = append(blockDataSavers,
+			NewBlockDataToSQLite(spySQLite))
+		stakeInfoDataSavers = append(stakeInfoDataSavers,
+			NewStakeInfoDataToSQLite(spySQLite))
+	}
+
+	// Bolt database
+	if cfg.SaveBolt {
+		spyBolt, err = newBoltStore(filepath.Join(cfg.OutFolder,
+			boltFileName), newDBWALConfig(cfg, "bolt"))
+		if err != nil {
+			log.Errorf("Failed to open Bolt database: %v", err)
+			return 56
+		}
+		defer spyBolt.close()
+		blockDataSavers = append(blockDataSavers, NewBlockDataToBolt(spyBolt))
+		stakeInfoDataSavers = append(stakeInfoDataSavers,
+			NewStakeInfoDataToBolt(spyBolt))
+	}
+
+	// MySQL database
+	if cfg.MySQLDSN != "" {
+		mysqlDB, err := newMySQLStore(cfg.MySQLDSN,
+			newDBWALConfig(cfg, "mysql"))
+		if err != nil {
+			log.Errorf("Failed to set up MySQL saver: %v", err)
+			return 54
+		}
+		defer mysqlDB.close()
+		blockDataSavers = append(blockDataSavers, NewBlockDataToMySQL(mysqlDB))
+		stakeInfoDataSavers = append(stakeInfoDataSavers,
+			NewStakeInfoDataToMySQL(mysqlDB))
+	}
+
+	// PostgreSQL database
+	if cfg.PostgresDSN != "" {
+		spyPostgres, err = newPostgresStore(cfg.PostgresDSN,
+			newDBWALConfig(cfg, "postgres"))
+		if err != nil {
+			log.Errorf("Failed to set up PostgreSQL saver: %v", err)
+			return 65
+		}
+		defer spyPostgres.close()
+		blockDataSavers = append(blockDataSavers,
+			NewBlockDataToPostgres(spyPostgres))
+		stakeInfoDataSavers = append(stakeInfoDataSavers,
+			NewStakeInfoDataToPostgres(spyPostgres))
+	}
+
+	// Google Sheets
+	if cfg.SheetsKey != "" && !cfg.NoMonitor {
+		if cfg.SheetsID == "" {
+			log.Errorf("sheets-id is required with sheets-key.")
+			return 28
+		}
+		sheetsSaver, err := NewBlockDataToSheets(cfg.SheetsKey, cfg.SheetsID,
+			cfg.SheetsName, cfg.SheetsColumns, cfg.SheetsBatch)
+		if err != nil {
+			log.Errorf("Failed to set up Google Sheets saver: %v", err)
+			return 89
+		}
+		blockDataSavers = append(blockDataSavers, sheetsSaver)
+		wg.Add(1)
+		go sheetsSaver.run(&wg, quit)
+	}
+
+	// MQTT
+	if cfg.MQTTBroker != "" {
+		spyMQTT, err = newMQTTPublisher(cfg.MQTTBroker, cfg.MQTTClientID,
+			cfg.MQTTUser, cfg.MQTTPass, cfg.MQTTQoS, cfg.MQTTRetain,
+			cfg.MQTTBlockTopic, cfg.MQTTStakeInfoTopic, cfg.MQTTAddrTopic,
+			cfg.MQTTFilter)
+		if err != nil {
+			log.Errorf("Failed to set up MQTT publisher: %v", err)
+			return 49
+		}
+		if cfg.MQTTBlockTopic != "" {
+			blockDataSavers = append(blockDataSavers,
+				&BlockDataToMQTT{spyMQTT})
+		}
+		if cfg.MQTTStakeInfoTopic != "" {
+			stakeInfoDataSavers = append(stakeInfoDataSavers,
+				&StakeInfoDataToMQTT{spyMQTT})
+		}
+		wg.Add(1)
+		go spyMQTT.run(&wg, quit)
+	}
+
+	// NATS
+	if cfg.NATSServer != "" {
+		spyNATS, err = newNATSPublisher(cfg.NATSServer, cfg.NATSUser,
+			cfg.NATSPass, cfg.NATSToken, cfg.NATSJetStream,
+			cfg.NATSBlockSubject, cfg.NATSStakeInfoSubject,
+			cfg.NATSEventSubject)
+		if err != nil {
+			log.Errorf("Failed to set up NATS publisher: %v", err)
+			return 59
+		}
+		if cfg.NATSBlockSubject != "" {
+			blockDataSavers = append(blockDataSavers,
+				&BlockDataToNATS{spyNATS})
+		}
+		if cfg.NATSStakeInfoSubject != "" {
+			stakeInfoDataSavers = append(stakeInfoDataSavers,
+				&StakeInfoDataToNATS{spyNATS})
+		}
+		wg.Add(1)
+		go spyNATS.run(&wg, quit)
+	}
+
+	// AMQP
+	if cfg.AMQPURL != "" {
+		spyAMQP, err = newAMQPPublisher(cfg.AMQPURL, cfg.AMQPExchange,
+			cfg.AMQPRoutingKeys)
+		if err != nil {
+			log.Errorf("Failed to set up AMQP publisher: %v", err)
+			return 60
+		}
+		if _, ok := spyAMQP.routingKey(amqpTypeBlock, ""); ok {
+			blockDataSavers = append(blockDataSavers,
+				&BlockDataToAMQP{spyAMQP})
+		}
+		if _, ok := spyAMQP.routingKey(amqpTypeStakeInfo, ""); ok {
+			stakeInfoDataSavers = append(stakeInfoDataSavers,
+				&StakeInfoDataToAMQP{spyAMQP})
+		}
+		wg.Add(1)
+		go spyAMQP.run(&wg, quit)
+	}
+
+	// Elasticsearch
+	if cfg.ESURL != "" {
+		spyElasticsearch, err = newESIndexer(cfg.ESURL, cfg.ESUser,
+			cfg.ESPass, cfg.ESAPIKey, cfg.ESIndexPrefix)
+		if err != nil {
+			log.Errorf("Failed to set up Elasticsearch indexer: %v", err)
+			return 61
+		}
+		blockDataSavers = append(blockDataSavers,
+			&BlockDataToElasticsearch{spyElasticsearch})
+		wg.Add(1)
+		go spyElasticsearch.run(&wg, quit)
+	}
+
+	// Cloud archive of the JSON and CSV files
+	if cfg.ArchiveBucket != "" {
+		spyCloudArchive, err = newCloudArchiver(cfg.OutFolder,
+			cfg.ArchiveBucket, cfg.ArchiveEndpoint, cfg.ArchiveRegion,
+			cfg.ArchiveAccessKey, cfg.ArchiveSecretKey, cfg.ArchivePrefix,
+			cfg.ArchiveRetention)
+		if err != nil {
+			log.Errorf("Failed to set up cloud archive: %v", err)
+			return 62
+		}
+		if !cfg.SaveJSONFile && !cfg.SaveCSV {
+			log.Warnf("archivebucket is set, but neither save-jsonfile nor " +
+				"save-csv: only existing files will be archived.")
+		}
+		wg.Add(1)
+		go spyCloudArchive.run(&wg, quit)
+	}
+
+	// If no savers specified, enable Summary Output
+	if len(blockDataSavers) == 0 {
+		cfg.SummaryOut = true
+	}
+
+	summarySaverBlockData := NewBlockDataToSummaryStdOut(saverMutexTerm)
+	summarySaverStakeInfo := NewStakeInfoDataToSummaryStdOut(saverMutexTerm)
+	summarySaverMempool := NewMempoolDataToSummaryStdOut(cfg.FeeWinRadius, saverMutexTerm)
+
+	if cfg.SummaryOut {
+		blockDataSavers = append(blockDataSavers, summarySaverBlockData)
+		stakeInfoDataSavers = append(stakeInfoDataSavers, summarySaverStakeInfo)
+		mempoolSavers = append(mempoolSavers, summarySaverMempool)
+	}
+
+	if cfg.DumpAllMPTix {
+		log.Debugf("Dumping all mempool tickets to file in %s.\n", cfg.OutFolder)
+		mempoolFeeDumper := NewMempoolFeeDumper(cfg.OutFolder, "mempool-fees",
+			saverMutexFiles)
+		mempoolSavers = append(mempoolSavers, mempoolFeeDumper)
+	}
+
+	// Collector plugins, collected with each block of this run
+	collectorExts, err := enableCollectors(cfg.Collectors, dcrdClient)
+	if err != nil {
+		log.Errorf("Failed to enable collectors: %v", err)
+		return 55
+	}
+	var pollers []*poller
+	for _, p := range cfg.Polls {
+		c, interval, err := parsePoll(p, dcrdClient)
+		if err != nil {
+			log.Errorf("Failed to set up polling: %v", err)
+			return 90
+		}
+		pollers = append(pollers, newPoller(c, interval, dcrdClient,
+			cfg.OutFolder, activeNet.Name, cfg.NDJSONRotateSize<<20,
+			cfg.NDJSONRotatePeriod))
+	}
+
+	// Block data collector
+	collector, err := newBlockDataCollector(cfg, dcrdClient, collectorExts)
+	if err != nil {
+		fmt.Printf("Failed to create block data collector: %s\n", err.Error())
+		return 9
+	}
+
+	backendLog.Flush()
+
+	// Initial data summary prior to start of regular collection
+	blockData, err := collector.collect(!cfg.PoolValue)
+	if err != nil {
+		fmt.Printf("Block data collection for initial summary failed: %v",
+			err.Error())
+		return 10
+	}
+
+	if err = summarySaverBlockData.Store(blockData); err != nil {
+		fmt.Printf("Failed to print initial block data summary: %v",
+			err.Error())
+		return 11
+	}
+
+	if last, ok := spyBolt.lastHeight(); ok {
+		log.Infof("Last block processed before the restart: %d. %d block(s) "+
+			"connected since.", last, int64(blockData.header.Height)-last)
+	}
+
+	if !cfg.NoCollectBlockData && !cfg.NoMonitor {
+		// Blockchain monitor for the collector
+		// If collector is nil, so is connectChan
+		wsChainMonitor := newChainMonitor(collector,
+			blockDataSavers, !cfg.PoolValue, watched)
+		supervise("chain monitor", &wg, quit, chainMonitorWatchdog,
+			wsChainMonitor.blockConnectedHandler)
+	}
+
+	// Stake info data (getstakeinfo) collector
+	var stakeCollector *stakeInfoDataCollector
+	if !cfg.NoCollectStakeInfo {
+		stakeCollector, err = newStakeInfoDataCollector(cfg, dcrdClient, dcrwClient)
+		if err != nil {
+			fmt.Printf("Failed to create block data collector: %s\n", err.Error())
+			return 12
+		}
+
+		// Initial data summary prior to start of regular collection
+		height, err := stakeCollector.getHeight()
+		if err != nil {
+			fmt.Printf("Unable to get current block height. Error: %v", err.Error())
+			return 91
+		}
+		stakeInfoData, err := stakeCollector.collect(height)
+		if err != nil {
+			fmt.Printf("Stake info data collection failed gathering initial"+
+				"data: %v", err.Error())
+			return 92
+		}
+
+		if err := summarySaverStakeInfo.Store(stakeInfoData); err != nil {
+			fmt.Printf("Failed to print initial stake info data summary: %v",
+				err.Error())
+			return 93
+		}
+
+		if !cfg.NoMonitor {
+			// Stake info monitor for the stakeCollector
+			wsStakeInfoMonitor := newStakeMonitor(stakeCollector,
+				stakeInfoDataSavers)
+			supervise("stake info monitor", &wg, quit,
+				stakeMonitorWatchdog,
+				wsStakeInfoMonitor.blockConnectedHandler)
+		}
+	}
+
+	if cfg.MonitorMempool {
+		mpoolCollector, err := newMempoolDataCollector(cfg, dcrdClient)
+		if err != nil {
+			fmt.Printf("Failed to create mempool data collector: %s\n", err.Error())
+			return 13
+		}
+
+		mpData, err := mpoolCollector.collect()
+		if err != nil {
+			fmt.Printf("Mempool info collection failed while gathering initial"+
+				"data: %v", err.Error())
+			return 14
+		}
+
+		if err := summarySaverMempool.Store(mpData); err != nil {
+			fmt.Printf("Failed to print initial mempool info summary: %v",
+				err.Error())
+			return 15
+		}
+
+		newTicketLimit := int32(cfg.MPTriggerTickets)
+		mini := time.Duration(cfg.MempoolMinInterval) * time.Second
+		maxi := time.Duration(cfg.MempoolMaxInterval) * time.Second
+
+		mpi := &mempoolInfo{
+			currentHeight:               mpData.height,
+			numTicketPurchasesInMempool: mpData.numTickets,
+			numTicketsSinceStatsReport:  0,
+			lastCollectTime:             time.Now(),
+		}
+		if spyMempoolState != nil {
+			tickets, err := dcrdClient.GetRawMempool(dcrjson.GRMTickets)
+			if err != nil {
+				log.Warnf("Unable to get mempool tickets to restore the "+
+					"mempool monitor state: %v", err)
+			} else {
+				spyMempoolState.restoreTickets(mpi, tickets)
+			}
+		}
+		mpm := newMempoolMonitor(mpoolCollector, mempoolSavers,
+			newTicketLimit, mini, maxi, mpi)
+		supervise("mempool monitor", &wg, quit, mempoolMonitorWatchdog,
+			func(wg *sync.WaitGroup, quit <-chan struct{}) {
+				mpm.txHandler(dcrdClient, wg, quit)
+			})
+
+		spyChans.txTicker = time.NewTicker(time.Second * 2)
+		go func() {
+			for range spyChans.txTicker.C {
+				spyChans.newTxChan <- new(chainhash.Hash)
+			}
+		}()
+	}
+
+	// No addresses is implied if NoMonitor is true.  With the HTTP server,
+	// addresses may be registered later.
+	if len(addresses) > 0 || (cfg.APIListen != "" && !cfg.NoMonitor) {
+		if emailConfig != nil {
+			var digest time.Duration
+			perBlock := cfg.EmailDigest == emailDigestBlock
+			if cfg.EmailDigest != "" && !perBlock {
+				digest, err = time.ParseDuration(cfg.EmailDigest)
+				if err != nil || digest <= 0 {
+					log.Errorf("Invalid emaildigest %q (expected an "+
+						"interval, e.g. 30m, or block)", cfg.EmailDigest)
+					return 94
+				}
+			}
+			wg.Add(1)
+			go EmailQueue(emailConfig, digest, perBlock, &wg, quit)
+			spyNotifiers.register("email", emailNotifier{})
+		}
+		supervise("watched address handler", &wg, quit, watchAddrWatchdog,
+			func(wg *sync.WaitGroup, quit <-chan struct{}) {
+				handleReceivingTx(dcrdClient, watched, wg, quit)
+			})
+		// Transactions broadcast while stopped
+		if watched.count() > 0 {
+			supervise("mempool rescan", &wg, quit, nil,
+				func(wg *sync.WaitGroup, quit <-chan struct{}) {
+					rescanMempool(dcrdClient, watched, wg, quit)
+				})
+		}
+		//wg.Add(1)
+		//go handleSendingTx(dcrdClient, watched, spendTxChan, &wg, quit)
+	}
+
+	// Collectors polled on time intervals, tailed logs and host resources
+	if !cfg.NoMonitor {
+		for _, p := range pollers {
+			wg.Add(1)
+			go p.run(&wg, quit)
+		}
+		for _, t := range tailers {
+			wg.Add(1)
+			go t.run(&wg, quit)
+		}
+		wg.Add(1)
+		go spyHostMonitor.run(&wg, quit)
+	}
+
+	// stakediff not implemented yet as the notifier appears broken
+	go stakeDiffHandler(quit)
+
+	log.Infof("RPC client(s) successfully connected. Now monitoring and " +
+		"collecting data.")
+
+	// Wait for CTRL+C to signal goroutines to terminate via quit channel.
+	wg.Wait()
+
+	// But if monitoring is disabled, simulate an OS interrupt.
+	if cfg.NoMonitor {
+		c <- os.Interrupt
+		time.Sleep(200)
+	}
+
+	// Closing these channels should be unnecessary if quit was handled right
+	spyBlockReorder.stop()
+	closeChans()
+
+	if dcrdClient != nil {
+		log.Infof("Closing connection to dcrd.")
+		dcrdClient.Shutdown()
+	}
+
+	if !cfg.NoCollectStakeInfo && dcrwClient != nil {
+		log.Infof("Closing connection to dcrwallet.")
+		dcrwClient.Shutdown()
+	}
+
+	log.Infof("Bye!")
+	time.Sleep(500 * time.Millisecond)
+	return 0
+}
+
+// execLogger conitnually scans for new lines on outpipe, reads the text for
+// each line and writes it to execlogger (i.e. EXEC).  This should be run as
+// a goroutine, using the cmdDone receiving channel to signal to stop logging,
+// which should happen when the command being executed has terminated.
+func execLogger(outpipe io.Reader, cmdDone <-chan error) {
+	cmdScanner := bufio.NewScanner(outpipe)
+	//printout:
+	for {
+		// Check for new line, and write it to execLog
+		for cmdScanner.Scan() {
+			execLog.Info(cmdScanner.Text())
+		}
+		// Check for value in cmdDone, or closed channel
+		select {
+		case err, ok := <-cmdDone:
+			if !ok {
+				execLog.Warn("Command logger closed before execution completed.")
+				return
+			}
+			if err != nil {
+				execLog.Warn("Command execution complete. Error:", err)
+			} else {
+				execLog.Info("Command execution complete (success).")
+			}
+			return
+			//break printout
+		default:
+			// Take a break from scanning
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+}
+
+func stakeDiffHandler(quit chan struct{}) {
+	for {
+		select {
+		case s, ok := <-spyChans.stakeDiffChan:
+			if !ok {
+				log.Debugf("Stake difficulty channel closed")
+				return
+			}
+			log.Debugf("Got stake difficulty change notification (%v). "+
+				" Doing nothing for now.", s)
+		case <-quit:
+			log.Debugf("Quitting OnStakeDifficulty handler.")
+			return
+		}
+	}
+}
+
+// debugTiming can be called with defer so a function's execution time may be
+// logged.  (e.g. defer debugTiming(time.Now(), "someFunction"))
+func debugTiming(start time.Time, fun string) {
+	log.Debugf("%s completed in %s", fun, time.Since(start))
+}
+
+func decodeNetAddr(addr string) dcrutil.Address {
+	address, _ := dcrutil.DecodeNetworkAddress(addr)
+	return address
+}
+
+func getEmailConfig(cfg *Config) (emailConf *EmailConfig, err error) {
+	smtpHost, smtpPort, err := net.SplitHostPort(cfg.SMTPServer)
+	if err != nil {
+		return
+	}
+
+	smtpPortNum, err := strconv.Atoi(smtpPort)
+	if err != nil {
+		return
+	}
+
+	smtpTLS := strings.ToLower(cfg.SMTPTLS)
+	switch smtpTLS {
+	case smtpTLSAuto, smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone:
+	default:
+		return nil, fmt.Errorf("invalid smtptls %q (expected auto, "+
+			"starttls, tls or none)", cfg.SMTPTLS)
+	}
+
+	// Without a user name, the default is no authentication, e.g. for a
+	// local relay.
+	smtpAuth := strings.ToLower(cfg.SMTPAuth)
+	switch smtpAuth {
+	case "":
+		smtpAuth = smtpAuthPlain
+		if cfg.SMTPUser == "" {
+			smtpAuth = smtpAuthNone
+		}
+	case smtpAuthPlain, smtpAuthLogin, smtpAuthCRAMMD5, smtpAuthNone:
+	default:
+		return nil, fmt.Errorf("invalid smtpauth %q (expected plain, login, "+
+			"cram-md5 or none)", cfg.SMTPAuth)
+	}
+
+	// Notifications of the routed addresses go to their recipients instead.
+	routes := make(map[string][]string, len(cfg.EmailRoutes))
+	for _, r := range cfg.EmailRoutes {
+		parts := strings.Split(r, ",")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid emailroute %q (expected "+
+				"ADDRESS,RECIPIENT[,RECIPIENT...])", r)
+		}
+		addr := strings.TrimSpace(parts[0])
+		for _, to := range parts[1:] {
+			to = strings.TrimSpace(to)
+			if _, err = mail.ParseAddress(to); err != nil {
+				return nil, fmt.Errorf("invalid email recipient %q: %v", to,
+					err)
+			}
+			routes[addr] = append(routes[addr], to)
+		}
+	}
+	for _, to := range cfg.EmailAddrs {
+		if _, err = mail.ParseAddress(to); err != nil {
+			return nil, fmt.Errorf("invalid email recipient %q: %v", to, err)
+		}
+	}
+
+	emailConf = &EmailConfig{
+		emailAddrs: cfg.EmailAddrs,
+		routes:     routes,
+		smtpUser:   cfg.SMTPUser,
+		smtpPass:   cfg.SMTPPass,
+		smtpServer: smtpHost,
+		smtpPort:   smtpPortNum,
+		smtpTLS:    smtpTLS,
+		smtpAuth:   smtpAuth,
+	}
+
+	return
+}
@@ -0,0 +1,103 @@
+// runstate.go resets the package-level state of the engine when Run returns,
+// so that a program embedding dcrspy may call Run again, e.g. with a new
+// config.  The components of a run are package-level variables, set up by Run
+// as configured and left nil otherwise, and some state is accumulated while
+// running, e.g. the firing alerts and the recent blocks.  The counters
+// created at startup, e.g. of dropped notifications, are kept for the life of
+// the process.
+
+package spy
+
+// resetRunState resets the state of the engine to that before Run.
+func resetRunState() {
+	// Components set up as configured
+	alertEmailConfig = nil
+	spyAddrHistory = nil
+	spyAddrStats = nil
+	spyAMQP = nil
+	spyAPIKeys = nil
+	spyAvailability = nil
+	spyBlockReorder = nil
+	spyBolt = nil
+	spyCertRoles = nil
+	spyChainEvents = nil
+	spyChainHalt = nil
+	spyCloudArchive = nil
+	spyDataCache = nil
+	spyDeadMansSwitch = nil
+	spyDerivedMetrics = nil
+	spyDesktop = nil
+	spyDiscord = nil
+	spyElasticsearch = nil
+	spyEmailTemplates = builtinEmailTemplates
+	spyEventsCSV = nil
+	spyExchangeRate = nil
+	spyExplorer = nil
+	spyGrafana = nil
+	spyHostMonitor = nil
+	spyInactivity = nil
+	spyIRC = nil
+	spyJournal = nil
+	spyMatrix = nil
+	spyMempoolState = nil
+	spyMQTT = nil
+	spyNATS = nil
+	spyNotifiers = nil
+	spyNotifyLimiter = nil
+	spyNotifyPool = nil
+	spyNotifyTemplates = nil
+	spyPagerDuty = nil
+	spyPostgres = nil
+	spyPriceAlerts = nil
+	spyPublicStatus = nil
+	spyPushover = nil
+	spyRetryQueue = nil
+	spyRollingStats = nil
+	spySigner = nil
+	spySlack = nil
+	spySMS = nil
+	spySQLite = nil
+	spyTelegram = nil
+	spyTenants = nil
+	spyTicketEstimator = nil
+	spyTicketPool = nil
+	spyVoteExpect = nil
+	spyVoteMonitor = nil
+	spyWebhooks = nil
+	spyXMPP = nil
+	spyXpubs = nil
+	blockDataPipeline = nil
+
+	// The channels, closed when Run returns
+	spyChans.txTicker = nil
+	spyChans.connectChan = nil
+	spyChans.stakeDiffChan = nil
+	spyChans.connectChanStkInf = nil
+	spyChans.spendTxBlockChan = nil
+	spyChans.recvTxBlockChan = nil
+	spyChans.relevantTxMempoolChan = nil
+	spyChans.newTxChan = nil
+	EmailMsgChan = make(chan *spyEvent, 200)
+	emailBlockChan = make(chan int64, 16)
+
+	// State accumulated while running
+	spyAddrLabels = make(map[string]string)
+	spyBlockDedup = newBlockDeduper(blockDedupWindow)
+	spyConfirmations = &confirmationWaiter{
+		waits: make(map[string]*confirmationWait),
+	}
+	spyErrors = newErrorRegistry()
+	spyNodeIndexes = &nodeIndexes{TxIndex: true, AddrIndex: true}
+	spyRegistrationErrors = &registrationErrors{}
+	spyUsage = newUsageAccounting()
+	spyNotifyMutes = newNotifyMutes()
+	pipelineLatency = newLatencyTracker()
+
+	firingAlertsMtx.Lock()
+	firingAlerts = make(map[string]*firingAlert)
+	firingAlertsMtx.Unlock()
+
+	logTailersMtx.Lock()
+	logTailers = nil
+	logTailersMtx.Unlock()
+}
@@ -0,0 +1,339 @@
+// sheets.go implements the Google Sheets saver, which appends a row of
+// selected block data fields per block to a sheet of a Google spreadsheet.  It
+// authenticates with a service account key (the JSON key file created in the
+// Google Cloud console), with which the spreadsheet must be shared.  Rows are
+// sent in batches to stay within the API's request quotas.
+
+package spy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sheetsAPIURL = "https://sheets.googleapis.com/v4/spreadsheets/"
+	sheetsScope  = "https://www.googleapis.com/auth/spreadsheets"
+	// sheetsFlushInterval is the longest time a row waits to be sent.
+	sheetsFlushInterval = 10 * time.Minute
+	// sheetsMaxPending is the number of rows kept while the API is
+	// unavailable, beyond which the oldest are dropped.
+	sheetsMaxPending = 1000
+)
+
+// defaultSheetsColumns are the block data fields exported when none are
+// configured.
+var defaultSheetsColumns = []string{
+	"block_header.height",
+	"block_header.time",
+	"currentstakediff.current",
+	"currentstakediff.next",
+	"estimatestakediff.expected",
+	"ticketfeeinfo_block.number",
+	"ticketfeeinfo_block.mean",
+	"ticket_pool_info.poolsize",
+	"ticket_pool_info.poolvalue",
+	"coin_supply",
+}
+
+// serviceAccountKey is the part of a Google service account key file used to
+// obtain access tokens.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// sheetsClient is a minimal Google Sheets API client authenticated with a
+// service account.
+type sheetsClient struct {
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+	client   *http.Client
+
+	token  string
+	expiry time.Time
+}
+
+// newSheetsClient creates a sheetsClient with the service account key in the
+// file at path.
+func newSheetsClient(path string) (*sheetsClient, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sak serviceAccountKey
+	if err = json.Unmarshal(b, &sak); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	block, _ := pem.Decode([]byte(sak.PrivateKey))
+	if block == nil || sak.ClientEmail == "" {
+		return nil, fmt.Errorf("%s is not a service account key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s is not an RSA key", path)
+	}
+	if sak.TokenURI == "" {
+		sak.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &sheetsClient{
+		email:    sak.ClientEmail,
+		key:      key,
+		tokenURI: sak.TokenURI,
+		client:   newHTTPClient(),
+	}, nil
+}
+
+// accessToken returns an access token, requesting a new one with a signed JWT
+// if the last has expired.
+func (c *sheetsClient) accessToken() (string, error) {
+	if c.token != "" && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   c.email,
+		"scope": sheetsScope,
+		"aud":   c.tokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.client.PostForm(c.tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token request failed: %s: %s", resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	c.token = tok.AccessToken
+	// Renew a minute early.
+	c.expiry = time.Now().Add(time.Duration(tok.ExpiresIn-60) * time.Second)
+	return c.token, nil
+}
+
+// do sends an API request for the values in the range of the spreadsheet,
+// with the JSON encoding of in as the body if not nil, and decodes the
+// response into out if not nil.
+func (c *sheetsClient) do(method, spreadsheet, valuesRange, suffix string,
+	in, out interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	u := sheetsAPIURL + spreadsheet + "/values/" +
+		(&url.URL{Path: valuesRange}).EscapedPath() + suffix
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// BlockDataToSheets implements BlockDataSaver interface for output to a
+// Google Sheets spreadsheet
+type BlockDataToSheets struct {
+	mtx         sync.Mutex
+	client      *sheetsClient
+	spreadsheet string
+	sheet       string
+	columns     []string
+	batchSize   int
+	pending     [][]interface{}
+	// hasHeader is set once the sheet is known to have a header row.
+	hasHeader bool
+}
+
+// NewBlockDataToSheets creates a new BlockDataToSheets appending the columns,
+// block data field paths, to the named sheet of the spreadsheet.  Rows are
+// sent in batches of batchSize.
+func NewBlockDataToSheets(keyFile, spreadsheet, sheet string,
+	columns []string, batchSize int) (*BlockDataToSheets, error) {
+	client, err := newSheetsClient(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		columns = defaultSheetsColumns
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &BlockDataToSheets{
+		client:      client,
+		spreadsheet: spreadsheet,
+		sheet:       sheet,
+		columns:     columns,
+		batchSize:   batchSize,
+	}, nil
+}
+
+// Store queues a row of the blockData, sending the batch if it is full
+func (s *BlockDataToSheets) Store(data *blockData) error {
+	jsonConcat, err := JSONFormatBlockData(data)
+	if err != nil {
+		return err
+	}
+	cells, err := flattenJSON(jsonConcat.Bytes())
+	if err != nil {
+		return err
+	}
+	row := make([]interface{}, len(s.columns))
+	for i, col := range s.columns {
+		// Numbers are sent as numbers so the sheet can chart them.
+		if f, err := strconv.ParseFloat(cells[col], 64); err == nil {
+			row[i] = f
+		} else {
+			row[i] = cells[col]
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.pending = append(s.pending, row)
+	if n := len(s.pending); n > sheetsMaxPending {
+		log.Warnf("Dropping %d rows not yet sent to Google Sheets.",
+			n-sheetsMaxPending)
+		s.pending = s.pending[n-sheetsMaxPending:]
+	}
+	if len(s.pending) < s.batchSize {
+		return nil
+	}
+	return s.flush()
+}
+
+// flush sends the pending rows, preceded by a header row if the sheet is
+// empty.  The rows are kept for the next attempt if sending fails.  The mutex
+// must be held.
+func (s *BlockDataToSheets) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	rows := s.pending
+	if !s.hasHeader {
+		var first struct {
+			Values [][]interface{} `json:"values"`
+		}
+		err := s.client.do("GET", s.spreadsheet, s.sheet+"!1:1", "", nil,
+			&first)
+		if err != nil {
+			log.Errorf("Unable to read Google Sheets header: %v", err)
+			return err
+		}
+		if len(first.Values) == 0 {
+			header := make([]interface{}, len(s.columns))
+			for i, col := range s.columns {
+				header[i] = col
+			}
+			rows = append([][]interface{}{header}, rows...)
+		}
+	}
+
+	req := struct {
+		Values [][]interface{} `json:"values"`
+	}{rows}
+	err := s.client.do("POST", s.spreadsheet, s.sheet,
+		":append?valueInputOption=RAW&insertDataOption=INSERT_ROWS", req, nil)
+	if err != nil {
+		err = reportError(errKindSaver, "sheets", err)
+		log.Errorf("Unable to append %d rows to Google Sheets: %v",
+			len(s.pending), err)
+		return err
+	}
+	log.Debugf("Appended %d rows to Google Sheets.", len(s.pending))
+	s.hasHeader = true
+	s.pending = nil
+	return nil
+}
+
+// run sends the pending rows at sheetsFlushInterval and when quit is closed.
+// It should be run as a goroutine.
+func (s *BlockDataToSheets) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(sheetsFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mtx.Lock()
+			s.flush()
+			s.mtx.Unlock()
+		case <-quit:
+			s.mtx.Lock()
+			s.flush()
+			s.mtx.Unlock()
+			log.Debugf("Quitting Google Sheets saver.")
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// signing.go provides Ed25519 signing of the data dcrspy exports (the files
+// written by the JSON, CSV and NDJSON savers, the SQLite and Bolt databases,
+// reports, state archives, and outbound payloads), so that consumers may
+// verify it came from their dcrspy instance.  A signature is written next
+// to each signed file, in hex, in a file with the same name plus ".sig".
+
+package spy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/decred/ed25519"
+)
+
+// signatureFileSuffix is appended to the name of a signed file to get the
+// name of the file containing its signature.
+const signatureFileSuffix = ".sig"
+
+// dataSigner signs data with an Ed25519 private key.
+type dataSigner struct {
+	privKey *[ed25519.PrivateKeySize]byte
+	pubKey  *[ed25519.PublicKeySize]byte
+}
+
+// spySigner is the package-level signer.  Exported data is not signed if it is
+// nil.
+var spySigner *dataSigner
+
+// loadOrCreateSigningKey loads the signing key in the file at path.  If the
+// file does not exist, a new key is generated and written to it.
+func loadOrCreateSigningKey(path string) (*dataSigner, error) {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return loadSigningKey(path)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path, []byte(hex.EncodeToString(priv[:])+"\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Created new signing key in %s", path)
+	return &dataSigner{priv, pub}, nil
+}
+
+// loadSigningKey loads the hex-encoded Ed25519 private key in the file at
+// path.
+func loadSigningKey(path string) (*dataSigner, error) {
+	keyHex, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes, err := hex.DecodeString(strings.TrimSpace(string(keyHex)))
+	if err != nil || len(keyBytes) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s does not contain a hex-encoded %d byte "+
+			"Ed25519 private key", path, ed25519.PrivateKeySize)
+	}
+	s := &dataSigner{
+		privKey: new([ed25519.PrivateKeySize]byte),
+		pubKey:  new([ed25519.PublicKeySize]byte),
+	}
+	copy(s.privKey[:], keyBytes)
+	// The second half of the private key is the public key.
+	copy(s.pubKey[:], keyBytes[32:])
+	return s, nil
+}
+
+// publicKey returns the hex-encoded public key.
+func (s *dataSigner) publicKey() string {
+	return hex.EncodeToString(s.pubKey[:])
+}
+
+// sign returns the hex-encoded signature of data.
+func (s *dataSigner) sign(data []byte) string {
+	return hex.EncodeToString(ed25519.Sign(s.privKey, data)[:])
+}
+
+// signFile writes the signature of the contents of the file at path to the
+// corresponding signature file.
+func (s *dataSigner) signFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+signatureFileSuffix, []byte(s.sign(data)+"\n"), 0644)
+}
+
+// signStoredFile signs the file at path with spySigner, if signing is enabled.
+// Failure is logged but not fatal to the caller.
+func signStoredFile(path string) {
+	if spySigner == nil {
+		return
+	}
+	if err := spySigner.signFile(path); err != nil {
+		log.Errorf("Failed to sign %s: %v", path, err)
+	}
+}
+
+// Verify checks that sigHex is a valid signature of data by the hex-encoded
+// Ed25519 public key pubKeyHex, e.g. of a payload posted by a dcrspy instance
+// with a signing key.
+func Verify(pubKeyHex string, data []byte, sigHex string) (bool, error) {
+	pubBytes, err := hex.DecodeString(strings.TrimSpace(pubKeyHex))
+	if err != nil || len(pubBytes) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("invalid public key")
+	}
+	sigBytes, err := hex.DecodeString(strings.TrimSpace(sigHex))
+	if err != nil || len(sigBytes) != ed25519.SignatureSize {
+		return false, fmt.Errorf("invalid signature")
+	}
+
+	var pubKey [ed25519.PublicKeySize]byte
+	var sig [ed25519.SignatureSize]byte
+	copy(pubKey[:], pubBytes)
+	copy(sig[:], sigBytes)
+	return ed25519.Verify(&pubKey, data, &sig), nil
+}
+
+// VerifyFile checks the signature of the file at path, exported by a dcrspy
+// instance with a signing key, read from sigPath, or from the corresponding
+// signature file (path plus ".sig") if sigPath is empty.
+func VerifyFile(pubKeyHex, path, sigPath string) (bool, error) {
+	if sigPath == "" {
+		sigPath = path + signatureFileSuffix
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return false, err
+	}
+	return Verify(pubKeyHex, data, string(sig))
+}
@@ -0,0 +1,150 @@
+package spy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignVerifyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "signing.key")
+	signer, err := loadOrCreateSigningKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The created key is loaded again with the same public key.
+	loaded, err := loadOrCreateSigningKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.publicKey() != signer.publicKey() {
+		t.Fatalf("loaded public key %s, want %s", loaded.publicKey(),
+			signer.publicKey())
+	}
+	other, err := loadOrCreateSigningKey(filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "block_data-150000.json")
+	data := []byte(`{"block_header":{"height":150000}}`)
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = signer.signFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pubKey  string
+		content []byte
+		valid   bool
+	}{
+		{"signed", signer.publicKey(), data, true},
+		{"other key", other.publicKey(), data, false},
+		{"tampered", signer.publicKey(),
+			[]byte(`{"block_header":{"height":150001}}`), false},
+		{"appended", signer.publicKey(), append(data, '\n'), false},
+	}
+	for _, tt := range tests {
+		if err = ioutil.WriteFile(path, tt.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		valid, err := VerifyFile(tt.pubKey, path, "")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if valid != tt.valid {
+			t.Errorf("%s: got valid %v, want %v", tt.name, valid, tt.valid)
+		}
+	}
+
+	if _, err = VerifyFile("abcd", path, ""); err == nil {
+		t.Error("expected an error for an invalid public key")
+	}
+	os.Remove(path + signatureFileSuffix)
+	if _, err = VerifyFile(signer.publicKey(), path, ""); err == nil {
+		t.Error("expected an error for a missing signature file")
+	}
+}
+
+func TestCSVAppenderSigns(t *testing.T) {
+	dir := t.TempDir()
+	signer, err := loadOrCreateSigningKey(filepath.Join(dir, "signing.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spySigner = signer
+	defer func() { spySigner = nil }()
+
+	a := newCSVAppender(dir, eventsCSVPrefix, eventCSVColumns)
+	for _, seq := range []string{"1", "2"} {
+		if err = a.appendRow(map[string]string{"seq": seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := a.fileName(a.date, a.seq)
+	if _, err = os.Stat(first + signatureFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("the CSV file is signed before it is closed: %v", err)
+	}
+
+	// A file is signed when a file with new columns is started, and when
+	// the appender is closed.
+	if err = a.appendRow(map[string]string{"seq": "3", "new": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	second := a.fileName(a.date, a.seq)
+	if err = a.close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{first, second} {
+		valid, err := VerifyFile(signer.publicKey(), p, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid {
+			t.Errorf("signature of %s is invalid", p)
+		}
+	}
+}
+
+func TestNDJSONAppenderSigns(t *testing.T) {
+	dir := t.TempDir()
+	signer, err := loadOrCreateSigningKey(filepath.Join(dir, "signing.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spySigner = signer
+	defer func() { spySigner = nil }()
+
+	// Rotate after every line.
+	a := newNDJSONAppender(dir, "block_data-testnet", 1, 0)
+	for _, doc := range []string{`{"height": 1}`, `{"height": 2}`} {
+		if err = a.appendLine([]byte(doc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "block_data-testnet*.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("got %d files, want the rotated and current files", len(paths))
+	}
+	for _, p := range paths {
+		valid, err := VerifyFile(signer.publicKey(), p, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid {
+			t.Errorf("signature of %s is invalid", p)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// slack.go posts the operator's watched address notifications and alerts, and
+// optionally each connected block, to a Slack channel through an incoming
+// webhook.  Each is sent as an attachment: a watched address event shows the
+// amount, address, transaction and block height as fields, and an alert is
+// colored by severity.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// slackQueueSize is the number of messages waiting to be sent, beyond
+	// which new messages are dropped.
+	slackQueueSize = 200
+	// slackMaxRetryAfter is the longest wait for a rate limit to clear before
+	// a message is retried once.
+	slackMaxRetryAfter = 30 * time.Second
+)
+
+// Attachment colors
+const (
+	slackColorMined     = "#2ed6a1"
+	slackColorMempool   = "#2970ff"
+	slackColorBlock     = "#596d81"
+	slackColorAlert     = "#f5a623"
+	slackColorCritical  = "#ed1c24"
+	slackColorRecovered = "#41bf53"
+)
+
+// slackField is a field of an attachment.
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// slackAttachment is an attachment of a message.
+type slackAttachment struct {
+	Fallback  string        `json:"fallback"`
+	Color     string        `json:"color"`
+	Title     string        `json:"title"`
+	TitleLink string        `json:"title_link,omitempty"`
+	Text      string        `json:"text,omitempty"`
+	Fields    []*slackField `json:"fields,omitempty"`
+	// MarkdownIn are the fields formatted with markdown.
+	MarkdownIn []string `json:"mrkdwn_in,omitempty"`
+	Ts         int64    `json:"ts,omitempty"`
+}
+
+// slackMessage is a message posted to an incoming webhook, and the watched
+// address event it notifies, if any.
+type slackMessage struct {
+	Username    string             `json:"username"`
+	Attachments []*slackAttachment `json:"attachments"`
+
+	event *spyEvent
+}
+
+// slackNotifier posts messages to a Slack incoming webhook.
+type slackNotifier struct {
+	url string
+	// blocks is true if each connected block is posted.
+	blocks bool
+	client *http.Client
+	queue  chan *slackMessage
+}
+
+// spySlack is the package-level Slack notifier, nil if not configured.
+var spySlack *slackNotifier
+
+// newSlackNotifier creates a slackNotifier for the webhook URL, posting each
+// connected block if blocks.
+func newSlackNotifier(webhookURL string, blocks bool) (*slackNotifier, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Slack webhook URL")
+	}
+	return &slackNotifier{
+		url:    webhookURL,
+		blocks: blocks,
+		client: newHTTPClient(),
+		queue:  make(chan *slackMessage, slackQueueSize),
+	}, nil
+}
+
+// Notify queues a message for the watched address event.  It does not
+// block.
+func (s *slackNotifier) Notify(e *spyEvent) error {
+	if s == nil {
+		return nil
+	}
+	amount := fmt.Sprintf("%.6f DCR", e.Amount)
+	if e.Fiat != 0 && spyExchangeRate != nil {
+		amount += fmt.Sprintf(" (%.2f %s)", e.Fiat,
+			strings.ToUpper(spyExchangeRate.currency))
+	}
+	text := spyNotifyTemplates.render(notifyChannelSlack, e)
+	att := &slackAttachment{
+		Fallback: text,
+		Color:    slackColorMempool,
+		Title:    "Received " + amount,
+		Text:     text,
+		Fields: []*slackField{
+			{"Amount", amount, true},
+			{"Address", slackLink(e.Address,
+				spyExplorer.address(e.Address)), false},
+			{"Transaction", slackLink(fmt.Sprintf("%s:%d", e.TxID, e.Vout),
+				spyExplorer.tx(e.TxID)), false},
+		},
+		MarkdownIn: []string{"text", "fields"},
+		Ts:         e.Time,
+	}
+	if e.Action == eventActionMined {
+		att.Color = slackColorMined
+		att.Fields = append(att.Fields, &slackField{"Block height",
+			strconv.FormatInt(e.Height, 10), true})
+	} else {
+		att.Fields = append(att.Fields, &slackField{"Block height",
+			fmt.Sprintf("mempool (best block %d)", e.Height), true})
+	}
+	s.enqueue(att, e)
+	return nil
+}
+
+// tracksDelivery implements deliveryNotifier.
+func (s *slackNotifier) tracksDelivery() {}
+
+// notifyBlock queues a message for the new block event, if blocks are posted.
+// It does not block.
+func (s *slackNotifier) notifyBlock(e *spyEvent) {
+	if s == nil || !s.blocks {
+		return
+	}
+	s.enqueue(&slackAttachment{
+		Fallback:  e.Message,
+		Color:     slackColorBlock,
+		Title:     fmt.Sprintf("Block %d", e.Height),
+		TitleLink: spyExplorer.eventBlock(e),
+		Text:      e.Message,
+		Ts:        e.Time,
+	}, nil)
+}
+
+// slackLink returns the text as a link to the URL, or as code if the URL is
+// empty.
+func slackLink(text, url string) string {
+	if url == "" {
+		return "`" + text + "`"
+	}
+	return "<" + url + "|" + text + ">"
+}
+
+// notifyAlert queues a message for an alert with the title and color.  It
+// does not block.
+func (s *slackNotifier) notifyAlert(title, msg, color string) {
+	if s == nil {
+		return
+	}
+	s.enqueue(&slackAttachment{
+		Fallback: title + ": " + msg,
+		Color:    color,
+		Title:    title,
+		Text:     msg,
+		Ts:       time.Now().Unix(),
+	}, nil)
+}
+
+// enqueue queues a message with the attachment, notifying the watched address
+// event e if not nil, or drops it if the queue is full.
+func (s *slackNotifier) enqueue(att *slackAttachment, e *spyEvent) {
+	msg := &slackMessage{
+		Username:    "dcrspy",
+		Attachments: []*slackAttachment{att},
+		event:       e,
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		log.Warnf("Slack queue full. Dropping %q.", att.Title)
+		e.delivered()
+	}
+}
+
+// run posts queued messages until quit is closed.  It should be run as a
+// goroutine.
+func (s *slackNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case msg := <-s.queue:
+			retryAfter, err := s.send(msg)
+			if retryAfter > 0 {
+				// Rate limited.  Wait and retry once.
+				select {
+				case <-time.After(retryAfter):
+					_, err = s.send(msg)
+				case <-quit:
+					log.Debugf("Quitting Slack notifier.")
+					return
+				}
+			}
+			if err != nil {
+				log.Warnf("Failed to send Slack message: %v",
+					reportError(errKindNotifier, "slack", err))
+			}
+			msg.event.delivered()
+		case <-quit:
+			log.Debugf("Quitting Slack notifier.")
+			return
+		}
+	}
+}
+
+// send posts the message to the webhook.  If the webhook is rate limited, the
+// wait before retrying is returned, up to slackMaxRetryAfter, with the error.
+func (s *slackNotifier) send(msg *slackMessage) (time.Duration, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Post(s.url, "application/json",
+		bytes.NewReader(payload))
+	if err != nil {
+		// Omit the URL, which includes the webhook token.
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		err = fmt.Errorf("status %s", resp.Status)
+		secs, perr := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if perr != nil || secs <= 0 {
+			secs = 1
+		}
+		retryAfter := time.Duration(secs) * time.Second
+		if retryAfter > slackMaxRetryAfter {
+			return 0, err
+		}
+		return retryAfter, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("status %s", resp.Status)
+	}
+	return 0, nil
+}
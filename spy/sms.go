@@ -0,0 +1,122 @@
+// sms.go sends text messages with the Twilio API for the operator's watched
+// address events and cold storage spends of at least an amount, so that
+// high-value movements are noticed away from email.
+
+package spy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// twilioAPIURL is the URL of the Messages resource of the Twilio API,
+	// with %s for the account SID.
+	twilioAPIURL = "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json"
+	// smsQueueSize is the number of messages waiting to be sent, beyond which
+	// new messages are dropped.
+	smsQueueSize = 50
+)
+
+// smsNotifier sends text messages from a Twilio number.
+type smsNotifier struct {
+	url       string
+	sid       string
+	token     string
+	from      string
+	to        []string
+	minAmount float64
+	client    *http.Client
+	queue     chan *queuedText
+}
+
+// spySMS is the package-level SMS notifier, nil if not configured.
+var spySMS *smsNotifier
+
+// newSMSNotifier creates an smsNotifier for the Twilio account, sending from
+// the Twilio number to each number of to the events for amounts of at least
+// minAmount DCR.
+func newSMSNotifier(sid, token, from string, to []string,
+	minAmount float64) *smsNotifier {
+	return &smsNotifier{
+		url:       fmt.Sprintf(twilioAPIURL, sid),
+		sid:       sid,
+		token:     token,
+		from:      from,
+		to:        to,
+		minAmount: minAmount,
+		client:    newHTTPClient(),
+		queue:     make(chan *queuedText, smsQueueSize),
+	}
+}
+
+// Notify queues a message for the event, rendered with the sms template, if
+// its amount is at least minAmount.  It does not block, and fails if the queue
+// is full.
+func (s *smsNotifier) Notify(e *spyEvent) error {
+	if s == nil {
+		return nil
+	}
+	if e.Amount < s.minAmount {
+		e.delivered()
+		return nil
+	}
+	msg := spyNotifyTemplates.render(notifyChannelSMS, e)
+	select {
+	case s.queue <- &queuedText{msg, e}:
+	default:
+		return fmt.Errorf("SMS queue full, dropping %q", msg)
+	}
+	return nil
+}
+
+// tracksDelivery implements deliveryNotifier.
+func (s *smsNotifier) tracksDelivery() {}
+
+// run sends queued messages until quit is closed.  It should be run as a
+// goroutine.
+func (s *smsNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case msg := <-s.queue:
+			for _, to := range s.to {
+				if err := s.send(to, msg.text); err != nil {
+					log.Warnf("Failed to send SMS to %s: %v", to,
+						reportError(errKindNotifier, "sms", err))
+				}
+			}
+			msg.event.delivered()
+		case <-quit:
+			log.Debugf("Quitting SMS notifier.")
+			return
+		}
+	}
+}
+
+// send sends the message to the number.
+func (s *smsNotifier) send(to, msg string) error {
+	form := url.Values{}
+	form.Set("From", s.from)
+	form.Set("To", to)
+	form.Set("Body", msg)
+	req, err := http.NewRequest("POST", s.url,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.sid, s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -4,7 +4,7 @@
 //
 // chappjc
 
-package main
+package spy
 
 import (
 	"strings"
@@ -16,31 +16,32 @@ import (
 type chainMonitor struct {
 	collector    *blockDataCollector
 	dataSavers   []BlockDataSaver
-	quit         chan struct{}
-	wg           *sync.WaitGroup
 	noTicketPool bool
-	watchaddrs   map[string]TxAction
+	watchaddrs   *watchedAddresses
 }
 
 // newChainMonitor creates a new chainMonitor
 func newChainMonitor(collector *blockDataCollector,
-	savers []BlockDataSaver,
-	quit chan struct{}, wg *sync.WaitGroup, noPoolValue bool,
-	addrs map[string]TxAction) *chainMonitor {
+	savers []BlockDataSaver, noPoolValue bool,
+	addrs *watchedAddresses) *chainMonitor {
 	return &chainMonitor{
 		collector:    collector,
 		dataSavers:   savers,
-		quit:         quit,
-		wg:           wg,
 		noTicketPool: noPoolValue,
 		watchaddrs:   addrs,
 	}
 }
 
+// chainMonitorWatchdog tracks the progress of the chain monitor.
+var chainMonitorWatchdog = newWatchdog(func() int {
+	return len(spyChans.connectChan)
+})
+
 // blockConnectedHandler handles block connected notifications, which trigger
-// data collection and storage.
-func (p *chainMonitor) blockConnectedHandler() {
-	defer p.wg.Done()
+// data collection and storage, until quit is closed.
+func (p *chainMonitor) blockConnectedHandler(wg *sync.WaitGroup,
+	quit <-chan struct{}) {
+	defer wg.Done()
 out:
 	for {
 	keepon:
@@ -50,57 +51,88 @@ out:
 				log.Warnf("Block connected channel closed.")
 				break out
 			}
+			chainMonitorWatchdog.progressed()
 			block, _ := p.collector.dcrdChainSvr.GetBlock(hash)
 			height := block.Height()
 			daemonLog.Infof("Block height %v connected", height)
-
-			if len(p.watchaddrs) > 0 {
+			spyVoteMonitor.blockConnected(hash, height)
+			spyChainHalt.blockConnected(hash, height,
+				block.MsgBlock().Header.Timestamp)
+			spyVoteExpect.blockConnected(block)
+			spyAddrHistory.blockConnected(block)
+			spyConfirmations.blockConnected(height)
+
+			if p.watchaddrs.count() > 0 {
 				// txsForOutpoints := blockConsumesOutpointWithAddresses(block, p.watchaddrs,
 				// 	p.collector.dcrdChainSvr)
 				// if len(txsForOutpoints) > 0 {
 				// 	p.spendTxBlockChan <- &BlockWatchedTx{height, txsForOutpoints}
 				// }
 
+				// Sent even without transactions, so that the receiving
+				// handler knows each block's notifications are done.
 				txsForAddrs := BlockReceivesToAddresses(block, p.watchaddrs)
-				if len(txsForAddrs) > 0 {
-					spyChans.recvTxBlockChan <- &BlockWatchedTx{height,
-						txsForAddrs}
-				}
+				spyChans.recvTxBlockChan <- &BlockWatchedTx{height,
+					txsForAddrs}
 			}
 
 			// data collection with timeout
-			bdataChan := make(chan *blockData)
+			bdataChan := make(chan *blockData, 1)
 			// fire it off and get the blockData pointer back through the channel
 			go func() {
 				BlockData, err := p.collector.collect(p.noTicketPool)
 				if err != nil {
-					log.Errorf("Block data collection failed: %v", err.Error())
+					log.Errorf("Block data collection failed: %v",
+						reportError(errKindCollector, "chain", err))
 					// BlockData is nil when err != nil
 				}
 				bdataChan <- BlockData
 			}()
 
-			// Wait for X seconds before giving up on collect()
+			// Wait for rpctimeout before giving up on collect()
 			var BlockData *blockData
 			select {
 			case BlockData = <-bdataChan:
 				if BlockData == nil {
 					break keepon
 				}
-			case <-time.After(time.Second * 20):
-				log.Errorf("Block data collection TIMEOUT after 20 seconds.")
+			case <-time.After(spyRPCTimeout):
+				log.Errorf("Block data collection failed: %v",
+					reportError(errKindCollector, "chain", &timeoutError{
+						"block data collection", spyRPCTimeout}))
 				break keepon
 			}
 
+			// Alert on configured metric conditions
+			spyDerivedMetrics.checkAlerts(BlockData)
+			spyRollingStats.add(BlockData)
+			spyPublicStatus.blockConnected(BlockData)
+			spyIRC.blockConnected(BlockData)
+			spyChainEvents.blockConnected(BlockData)
+
 			// Store block data with each saver
+			var saveWG sync.WaitGroup
 			for _, s := range p.dataSavers {
 				if s != nil {
 					// save data to wherever the saver wants to put it
-					go s.Store(BlockData)
+					saveWG.Add(1)
+					go func(s BlockDataSaver) {
+						defer saveWG.Done()
+						s.Store(BlockData)
+					}(s)
 				}
 			}
 
-		case _, ok := <-p.quit:
+			// Record the pipeline latency and ping the dead man's switch
+			// once all savers are done
+			go func() {
+				saveWG.Wait()
+				pipelineLatency.stageDone(height, stageSaved)
+				spyDeadMansSwitch.blockProcessed(height)
+				spyAvailability.blockProcessed(height)
+			}()
+
+		case _, ok := <-quit:
 			if !ok {
 				log.Debugf("Got quit signal. Exiting block connected handler for BLOCK monitor.")
 				break out
@@ -114,26 +146,27 @@ out:
 type stakeMonitor struct {
 	collector  *stakeInfoDataCollector
 	dataSavers []StakeInfoDataSaver
-	quit       chan struct{}
-	wg         *sync.WaitGroup
 }
 
 // newStakeMonitor creates a new stakeMonitor
 func newStakeMonitor(collector *stakeInfoDataCollector,
-	savers []StakeInfoDataSaver,
-	quit chan struct{}, wg *sync.WaitGroup) *stakeMonitor {
+	savers []StakeInfoDataSaver) *stakeMonitor {
 	return &stakeMonitor{
 		collector:  collector,
 		dataSavers: savers,
-		quit:       quit,
-		wg:         wg,
 	}
 }
 
+// stakeMonitorWatchdog tracks the progress of the stake info monitor.
+var stakeMonitorWatchdog = newWatchdog(func() int {
+	return len(spyChans.connectChanStkInf)
+})
+
 // blockConnectedHandler handles block connected notifications, which trigger
-// data collection and storage.
-func (p *stakeMonitor) blockConnectedHandler() {
-	defer p.wg.Done()
+// data collection and storage, until quit is closed.
+func (p *stakeMonitor) blockConnectedHandler(wg *sync.WaitGroup,
+	quit <-chan struct{}) {
+	defer wg.Done()
 out:
 	for {
 		select {
@@ -142,24 +175,38 @@ out:
 				log.Warnf("Block connected channel closed.")
 				break out
 			}
+			stakeMonitorWatchdog.progressed()
 
 			// Let the wallet process the new block (too bad no wallet ntfns!)
 			time.Sleep(time.Millisecond * 300)
 
 			// Try to collect the data, retry if wallet says to
 		collect:
-			stakeInfo, err := p.collector.collect(uint32(height))
+			var stakeInfo *stakeInfoData
+			err := withRPCTimeout("stake info collection", func() error {
+				var err error
+				stakeInfo, err = p.collector.collect(uint32(height))
+				return err
+			})
 			if err != nil {
-				log.Errorf("Stake info data collection failed: %v", err)
+				log.Errorf("Stake info data collection failed: %v",
+					reportError(errKindCollector, "stakeinfo", err))
 				// Look for that -4 message from wallet that says: "the wallet is
 				// currently syncing to the best block, please try again later"
 				if strings.Contains(err.Error(), "try again later") {
 					time.Sleep(time.Millisecond * 700)
 					goto collect // mmm, feel so dirty! maybe make this "cleaner" later
 				}
+				// A wallet that timed out may respond for the next block.
+				if _, ok := err.(*timeoutError); ok {
+					continue
+				}
 				break out
 			}
 
+			// Update the vote estimates of the wallet's tickets
+			spyTicketEstimator.update(stakeInfo)
+
 			for _, s := range p.dataSavers {
 				if s != nil {
 					// save data to wherever the saver wants to put it
@@ -167,7 +214,7 @@ out:
 				}
 			}
 
-		case _, ok := <-p.quit:
+		case _, ok := <-quit:
 			if !ok {
 				log.Debugf("Got quit signal. Exiting block connected handler for STAKE monitor.")
 				break out
@@ -1,4 +1,4 @@
-package main
+package spy
 
 import (
 	"time"
@@ -39,7 +39,7 @@ var spyChans struct {
 	newTxChan                         chan *chainhash.Hash
 }
 
-func makeChans(cfg *config) {
+func makeChans(cfg *Config) {
 	// If we're monitoring for blocks OR collecting block data, these channels
 	// are necessary to handle new block notifications. Otherwise, leave them
 	// as nil so that both a send (below) blocks and a receive (in spy.go,
@@ -56,8 +56,8 @@ func makeChans(cfg *config) {
 		spyChans.connectChanStkInf = make(chan int32, blockConnChanBuffer)
 	}
 
-	// watchaddress
-	if len(cfg.WatchAddresses) > 0 && !cfg.NoMonitor {
+	// watchaddress, also registered via the control API
+	if (len(cfg.WatchAddresses) > 0 || cfg.APIListen != "") && !cfg.NoMonitor {
 		// recv/spendTxBlockChan come with connected blocks
 		spyChans.recvTxBlockChan = make(chan *BlockWatchedTx, blockConnChanBuffer)
 		spyChans.spendTxBlockChan = make(chan *BlockWatchedTx, blockConnChanBuffer)
@@ -0,0 +1,287 @@
+// sqlitesaver.go implements the SQLite savers, which store each block's data,
+// its stake info and the watched address events in an embedded SQLite
+// database in the output folder (dcrspy.sqlite), so that a single dcrspy
+// binary keeps a queryable history without an external database.  The schema
+// is created on first run, and its version is recorded in the database's
+// user_version, so that a later dcrspy may migrate it.  Each row has the
+// commonly queried fields as columns, and the full JSON document in its data
+// column (e.g. for SQLite's json_extract).  A block or stake info stored again
+// at the same height, e.g. after a reorganization, replaces the previous row.
+// Block data, stake info and events are inserted in batches from the saver's
+// write-ahead log (see dbwal.go).
+
+package spy
+
+import (
+	"database/sql"
+	"fmt"
+
+	// The SQLite driver, registered as "sqlite3"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteFileName is the name of the database file in the output folder.
+const sqliteFileName = "dcrspy.sqlite"
+
+// sqliteSchemaVersion is the version of the schema created by sqliteSchema.
+const sqliteSchemaVersion = 1
+
+// sqliteSchema creates the tables and indexes of the database.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS blocks (
+		height INTEGER PRIMARY KEY,
+		hash TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		voters INTEGER NOT NULL,
+		freshstake INTEGER NOT NULL,
+		revocations INTEGER NOT NULL,
+		difficulty REAL NOT NULL,
+		sdiff REAL NOT NULL,
+		poolsize INTEGER NOT NULL,
+		poolvalue REAL NOT NULL,
+		fee_mean REAL NOT NULL,
+		coinsupply REAL NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS blocks_time ON blocks (time)`,
+	`CREATE TABLE IF NOT EXISTS stake_info (
+		height INTEGER PRIMARY KEY,
+		live INTEGER NOT NULL,
+		immature INTEGER NOT NULL,
+		voted INTEGER NOT NULL,
+		missed INTEGER NOT NULL,
+		revoked INTEGER NOT NULL,
+		balance REAL NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS events (
+		id INTEGER PRIMARY KEY,
+		seq INTEGER NOT NULL,
+		time INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		height INTEGER NOT NULL,
+		address TEXT NOT NULL,
+		amount REAL NOT NULL,
+		fiat REAL NOT NULL,
+		txid TEXT NOT NULL,
+		vout INTEGER NOT NULL,
+		scriptclass TEXT NOT NULL,
+		tenant TEXT NOT NULL,
+		message TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS events_address ON events (address, time)`,
+	`CREATE INDEX IF NOT EXISTS events_txid ON events (txid)`,
+}
+
+// sqliteStore is an SQLite database of block data, stake info and watched
+// address events.
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+	wal  *dbWAL
+}
+
+// spySQLite is the package-level SQLite database, nil if disabled.  Watched
+// address events are stored in it.
+var spySQLite *sqliteStore
+
+// newSQLiteStore opens the database at path, creating it and its schema if
+// needed, and its write-ahead log.
+func newSQLiteStore(path string, walCfg dbWALConfig) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, so the savers share a connection
+	// rather than failing with "database is locked".
+	db.SetMaxOpenConns(1)
+	s := &sqliteStore{db: db, path: path}
+	if err = s.createSchema(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the schema of %s: %v", path,
+			err)
+	}
+	if s.wal, err = openDBWAL(walCfg, "sqlite", s.insert, nil); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open the write-ahead log %s: %v",
+			walCfg.path, err)
+	}
+	return s, nil
+}
+
+// createSchema creates the schema of a new database, and checks the version
+// of an existing one.
+func (s *sqliteStore) createSchema() error {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	switch {
+	case version == sqliteSchemaVersion:
+		return nil
+	case version > sqliteSchemaVersion:
+		return fmt.Errorf("schema version %d is newer than this dcrspy's (%d)",
+			version, sqliteSchemaVersion)
+	}
+
+	// A write-ahead log lets readers (e.g. the sqlite3 shell) query the
+	// database while dcrspy writes.
+	if _, err := s.db.Exec(`PRAGMA journal_mode=WAL`); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range sqliteSchema {
+		if _, err = tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// PRAGMA does not take parameters.
+	if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`,
+		sqliteSchemaVersion)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	log.Infof("Created SQLite database %s", s.path)
+	return nil
+}
+
+// event logs the watched address event for insertion.  Other events are
+// ignored.
+func (s *sqliteStore) event(e *spyEvent) {
+	if s == nil || e.Type != eventTypeWatchedAddr {
+		return
+	}
+	s.wal.storeEvent(e)
+}
+
+// insert inserts the records in one transaction.
+func (s *sqliteStore) insert(records []*walRecord) error {
+	err := s.tryInsert(records)
+	if err != nil {
+		err = reportError(errKindSaver, "sqlite", err)
+		log.Errorf("Unable to store %d record(s) in %s: %v", len(records),
+			s.path, err)
+	}
+	return err
+}
+
+// tryInsert inserts the records in a transaction, which is committed if all
+// are inserted.
+func (s *sqliteStore) tryInsert(records []*walRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		switch r.Kind {
+		case walBlockRecord:
+			err = sqliteInsertBlock(tx, r)
+		case walStakeInfoRecord:
+			err = sqliteInsertStakeInfo(tx, r)
+		case walEventRecord:
+			err = sqliteInsertEvent(tx, r)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteInsertBlock inserts the block record, replacing a block stored at its
+// height.
+func sqliteInsertBlock(tx *sql.Tx, r *walRecord) error {
+	b := r.Block
+	_, err := tx.Exec(`INSERT OR REPLACE INTO blocks (height, hash, time,
+		size, voters, freshstake, revocations, difficulty, sdiff, poolsize,
+		poolvalue, fee_mean, coinsupply, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		int64(r.Height), b.Hash, b.Time, b.Size, b.Voters, b.FreshStake,
+		b.Revocations, b.Difficulty, b.SDiff, b.PoolSize, b.PoolValue,
+		b.FeeMean, b.CoinSupply, r.Data)
+	return err
+}
+
+// sqliteInsertStakeInfo inserts the stake info record, replacing stake info
+// stored at its height.
+func sqliteInsertStakeInfo(tx *sql.Tx, r *walRecord) error {
+	si := r.StakeInfo
+	_, err := tx.Exec(`INSERT OR REPLACE INTO stake_info (height, live,
+		immature, voted, missed, revoked, balance, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		int64(r.Height), si.Live, si.Immature, si.Voted, si.Missed,
+		si.Revoked, si.Balance, r.Data)
+	return err
+}
+
+// sqliteInsertEvent inserts the event record.
+func sqliteInsertEvent(tx *sql.Tx, r *walRecord) error {
+	e := r.Event
+	_, err := tx.Exec(`INSERT INTO events (seq, time, action, height,
+		address, amount, fiat, txid, vout, scriptclass, tenant, message)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		int64(e.Seq), e.Time, e.Action, e.Height, e.Address, e.Amount, e.Fiat,
+		e.TxID, e.Vout, e.ScriptClass, e.Tenant, e.Message)
+	return err
+}
+
+// close commits the write-ahead log and closes the database, and signs the
+// database file, which is consistent once closed.
+func (s *sqliteStore) close() error {
+	if s == nil {
+		return nil
+	}
+	if err := s.wal.close(); err != nil {
+		log.Errorf("Failed to close the write-ahead log %s: %v", s.wal.cfg.path,
+			err)
+	}
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	signStoredFile(s.path)
+	return nil
+}
+
+// BlockDataToSQLite implements BlockDataSaver interface for output to an
+// SQLite database
+type BlockDataToSQLite struct {
+	*sqliteStore
+}
+
+// NewBlockDataToSQLite creates a new BlockDataToSQLite saving to the database
+func NewBlockDataToSQLite(s *sqliteStore) *BlockDataToSQLite {
+	return &BlockDataToSQLite{s}
+}
+
+// Store logs the blockData for insertion, replacing a block stored at its
+// height
+func (s *BlockDataToSQLite) Store(data *blockData) error {
+	return s.wal.storeBlock(data)
+}
+
+// StakeInfoDataToSQLite implements StakeInfoDataSaver interface for output to
+// an SQLite database
+type StakeInfoDataToSQLite struct {
+	*sqliteStore
+}
+
+// NewStakeInfoDataToSQLite creates a new StakeInfoDataToSQLite saving to the
+// database
+func NewStakeInfoDataToSQLite(s *sqliteStore) *StakeInfoDataToSQLite {
+	return &StakeInfoDataToSQLite{s}
+}
+
+// Store logs the stakeInfoData for insertion, replacing stake info stored at
+// its height
+func (s *StakeInfoDataToSQLite) Store(data *stakeInfoData) error {
+	return s.wal.storeStakeInfo(data)
+}
@@ -0,0 +1,392 @@
+// statearchive.go implements the exportstate and importstate commands, which
+// export the operational state of a dcrspy instance to a single archive, and
+// import it into another instance (e.g. for disaster recovery, or to clone an
+// environment).  The archive is a gzipped tar file with a manifest, the
+// config file (the watch list with its policies and labels, and the alert
+// rules), the tenants file, and the state files in the output folder: the
+// event journal, the address history (from which the index of watched
+// outpoints is rebuilt), the address statistics, the mempool state (tracked
+// transactions and tickets), availability, rolling statistics, webhook
+// subscriptions, the cold storage audit and the notification retry queue.
+// The manifest records the last heights of the state.
+//
+// Usage: dcrspy exportstate --file=ARCHIVE [dcrspy OPTIONS]
+//        dcrspy importstate --file=ARCHIVE [--config=PATH] [--force] [dcrspy OPTIONS]
+
+package spy
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	flags "github.com/btcsuite/go-flags"
+)
+
+// stateArchiveVersion is the version of the archive format.
+const stateArchiveVersion = 1
+
+// Names of the entries of the state archive.  The state files are in the
+// stateArchiveDir directory.
+const (
+	stateManifestEntry = "manifest.json"
+	stateConfigEntry   = "dcrspy.conf"
+	stateTenantsEntry  = "apitenants.json"
+	stateArchiveDir    = "state/"
+)
+
+// stateFiles are the state files in the output folder.
+var stateFiles = []string{
+	"events.jsonl",
+	"address-history.jsonl",
+	"address-stats.json",
+	"mempool-state.json",
+	"availability.json",
+	"rolling-stats.json",
+	"webhooks.json",
+	"cold-audit.json",
+	"retry-queue.json",
+	"cloud-archive.json",
+}
+
+// stateHeights are the last heights of the exported state, zero if unknown.
+type stateHeights struct {
+	BlockData      int64  `json:"blockdata"`
+	StakeInfo      int64  `json:"stakeinfo"`
+	MempoolTickets uint32 `json:"mempooltickets"`
+}
+
+// stateManifest describes a state archive.
+type stateManifest struct {
+	Version int          `json:"version"`
+	Network string       `json:"network"`
+	Created int64        `json:"created"`
+	Dcrspy  string       `json:"dcrspy"`
+	Heights stateHeights `json:"heights"`
+	Entries []string     `json:"entries"`
+}
+
+// exportStateOptions are the options for the exportstate command.
+type exportStateOptions struct {
+	File string `long:"file" description:"Archive to create (e.g. dcrspy-state.tar.gz)" required:"true"`
+}
+
+// importStateOptions are the options for the importstate command.
+type importStateOptions struct {
+	File   string `long:"file" description:"Archive to import" required:"true"`
+	Config string `long:"config" description:"Restore the archived config file to this path, and use it"`
+	Force  bool   `long:"force" description:"Overwrite existing files"`
+}
+
+// parseCommandOptions parses the command's options from args, leaving the
+// other arguments as the dcrspy options for LoadConfig.  It returns false,
+// with the exit code, if the command should exit.
+func parseCommandOptions(opts interface{}, usage string,
+	args []string) (bool, int) {
+	parser := flags.NewParser(opts, flags.HelpFlag|flags.IgnoreUnknown)
+	parser.Usage = usage
+	remaining, err := parser.ParseArgs(args)
+	if err != nil {
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			parser.WriteHelp(os.Stdout)
+			return false, 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return false, 1
+	}
+	os.Args = append([]string{os.Args[0]}, remaining...)
+	return true, 0
+}
+
+// ExportStateMain is the entry point for the exportstate command.  args are
+// the command line arguments following "exportstate".  The return value is
+// the exit code.
+func ExportStateMain(args []string) int {
+	var opts exportStateOptions
+	ok, code := parseCommandOptions(&opts,
+		"exportstate --file=ARCHIVE [dcrspy OPTIONS]", args)
+	if !ok {
+		return code
+	}
+	cfg, err := LoadConfig()
+	if err == ErrInfoShown {
+		return 0
+	}
+	if err != nil {
+		fmt.Printf("Failed to load dcrspy config: %s\n", err.Error())
+		return 1
+	}
+	defer backendLog.Flush()
+	if cfg.SigningKey != "" {
+		if spySigner, err = loadSigningKey(cfg.SigningKey); err != nil {
+			fmt.Printf("Failed to load signing key: %v\n", err)
+			return 1
+		}
+	}
+
+	manifest, err := exportState(cfg, opts.File)
+	if err != nil {
+		fmt.Printf("Failed to export state: %v\n", err)
+		return 2
+	}
+	fmt.Printf("Exported %s state at block %d to %s: %s\n", manifest.Network,
+		manifest.Heights.BlockData, opts.File,
+		strings.Join(manifest.Entries, ", "))
+	return 0
+}
+
+// exportState writes the state archive of the instance with the config to
+// path, returning its manifest.
+func exportState(cfg *Config, path string) (*stateManifest, error) {
+	manifest := &stateManifest{
+		Version: stateArchiveVersion,
+		Network: activeNet.Name,
+		Created: time.Now().Unix(),
+		Dcrspy:  ver.String(),
+	}
+	manifest.Heights.BlockData, _ = latestStoredHeight(cfg.OutFolder,
+		blockDataFilePrefix)
+	manifest.Heights.StakeInfo, _ = latestStoredHeight(cfg.OutFolder,
+		stakeInfoFilePrefix)
+
+	// The entries, by name, and the files they are read from.
+	files := make(map[string]string)
+	add := func(entry, file string) {
+		if _, err := os.Stat(file); err == nil {
+			files[entry] = file
+			manifest.Entries = append(manifest.Entries, entry)
+		}
+	}
+	add(stateConfigEntry, cfg.ConfigFile)
+	if cfg.APITenants != "" {
+		add(stateTenantsEntry, cfg.APITenants)
+	}
+	for _, f := range stateFiles {
+		add(stateArchiveDir+f, filepath.Join(cfg.OutFolder, f))
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(cfg.OutFolder,
+		"mempool-state.json")); err == nil {
+		var saved mempoolStateFile
+		if json.Unmarshal(b, &saved) == nil && saved.Tickets != nil {
+			manifest.Heights.MempoolTickets = saved.Tickets.Height
+		}
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	if err = writeStateArchive(f, manifest, files); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	signStoredFile(path)
+	return manifest, nil
+}
+
+// writeStateArchive writes the manifest, first, and the files of its entries
+// to w.
+func writeStateArchive(w io.Writer, manifest *stateManifest,
+	files map[string]string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	writeEntry := func(name string, b []byte) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(b)),
+			ModTime: time.Unix(manifest.Created, 0),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err = writeEntry(stateManifestEntry, b); err != nil {
+		return err
+	}
+	for _, entry := range manifest.Entries {
+		// Files are read whole, so that a file rewritten by a running
+		// dcrspy is archived consistently.
+		b, err := ioutil.ReadFile(files[entry])
+		if err != nil {
+			return err
+		}
+		if err = writeEntry(entry, b); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", entry, err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readStateArchive reads the manifest and entries of the archive at path.
+func readStateArchive(path string) (*stateManifest, map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gz)
+	entries := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries[hdr.Name] = b
+	}
+
+	b, ok := entries[stateManifestEntry]
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not a dcrspy state archive", path)
+	}
+	manifest := new(stateManifest)
+	if err = json.Unmarshal(b, manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Version != stateArchiveVersion {
+		return nil, nil, fmt.Errorf("unsupported state archive version %d",
+			manifest.Version)
+	}
+	return manifest, entries, nil
+}
+
+// ImportStateMain is the entry point for the importstate command.  args are
+// the command line arguments following "importstate".  dcrspy must not be
+// running with the output folder.  The return value is the exit code.
+func ImportStateMain(args []string) int {
+	var opts importStateOptions
+	ok, code := parseCommandOptions(&opts, "importstate --file=ARCHIVE "+
+		"[--config=PATH] [--force] [dcrspy OPTIONS]", args)
+	if !ok {
+		return code
+	}
+
+	manifest, entries, err := readStateArchive(opts.File)
+	if err != nil {
+		fmt.Printf("Failed to read state archive: %v\n", err)
+		return 2
+	}
+
+	// The config file is restored first, so that it is loaded.
+	if opts.Config != "" {
+		b, ok := entries[stateConfigEntry]
+		if !ok {
+			fmt.Printf("The archive has no config file.\n")
+			return 2
+		}
+		if err = restoreStateFile(opts.Config, b, opts.Force); err != nil {
+			fmt.Printf("Failed to restore the config file: %v\n", err)
+			return 2
+		}
+		fmt.Printf("Restored the config file to %s\n", opts.Config)
+		os.Args = append(os.Args, "--configfile="+opts.Config)
+	}
+	cfg, err := LoadConfig()
+	if err == ErrInfoShown {
+		return 0
+	}
+	if err != nil {
+		fmt.Printf("Failed to load dcrspy config: %s\n", err.Error())
+		return 1
+	}
+	defer backendLog.Flush()
+
+	if manifest.Network != activeNet.Name {
+		fmt.Printf("The archive is of %s state, but the config is for %s.\n",
+			manifest.Network, activeNet.Name)
+		return 2
+	}
+
+	// Every file is checked before any is written.
+	targets := make(map[string]string)
+	for _, entry := range manifest.Entries {
+		switch {
+		case entry == stateTenantsEntry && cfg.APITenants != "":
+			targets[entry] = cfg.APITenants
+		case strings.HasPrefix(entry, stateArchiveDir):
+			name := strings.TrimPrefix(entry, stateArchiveDir)
+			for _, f := range stateFiles {
+				if f == name {
+					targets[entry] = filepath.Join(cfg.OutFolder, f)
+				}
+			}
+		}
+	}
+	for entry, target := range targets {
+		if _, ok := entries[entry]; !ok {
+			fmt.Printf("The archive is missing %s.\n", entry)
+			return 2
+		}
+		if _, err := os.Stat(target); err == nil && !opts.Force {
+			fmt.Printf("%s exists. Use --force to overwrite it.\n", target)
+			return 2
+		}
+	}
+
+	if err = os.MkdirAll(cfg.OutFolder, 0750); err != nil {
+		fmt.Printf("Failed to create the output folder: %v\n", err)
+		return 2
+	}
+	for entry, target := range targets {
+		if err = restoreStateFile(target, entries[entry], true); err != nil {
+			fmt.Printf("Failed to restore %s: %v\n", entry, err)
+			return 2
+		}
+		fmt.Printf("Restored %s\n", target)
+	}
+	fmt.Printf("Imported %s state at block %d, exported %s by dcrspy %s.\n",
+		manifest.Network, manifest.Heights.BlockData,
+		time.Unix(manifest.Created, 0).UTC().Format("2006-01-02 15:04:05 UTC"),
+		manifest.Dcrspy)
+	return 0
+}
+
+// restoreStateFile writes the file at path, unless it exists and overwrite is
+// false.
+func restoreStateFile(path string, b []byte, overwrite bool) error {
+	if _, err := os.Stat(path); err == nil && !overwrite {
+		return fmt.Errorf("%s exists (use --force to overwrite it)", path)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,233 @@
+// supervisor.go runs the monitor goroutines (the chain, stake info and mempool
+// monitors, and the watched address handlers) under a supervisor, so that a
+// panic or a stall in a handler does not silently stop monitoring.  The
+// supervisor recovers a panic, logs it with the stack, raises an alert, and
+// restarts the handler with backoff, until quit is closed.  Only the handler's
+// own goroutine is supervised, not the goroutines it starts.
+//
+// A handler with a watchdog is also restarted when it stalls: when its
+// notifications have been waiting for stalltimeout without the handler
+// receiving any.  The stalled goroutine cannot be stopped, so it is told to
+// quit, which it does if it ever resumes, and the goroutine stacks are logged
+// to show where it is stuck.
+
+package spy
+
+import (
+	"bytes"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// supervisorInitialBackoff is the delay before restarting a handler that
+	// panicked or stalled, doubled for each consecutive restart.
+	supervisorInitialBackoff = time.Second
+	// supervisorMaxBackoff is the maximum delay before a restart.
+	supervisorMaxBackoff = time.Minute
+	// supervisorStableRun is how long a handler must run for its next
+	// restart to be after the initial backoff again.
+	supervisorStableRun = 10 * time.Minute
+	// stallCheckInterval is the interval between checks of the watchdogs.
+	stallCheckInterval = 15 * time.Second
+)
+
+var (
+	// spyMonitorRestarts counts the restarts of handlers that panicked or
+	// stalled, and spyMonitorStalls the stalls.
+	spyMonitorRestarts = spyMetrics.newCounter("dcrspy_monitor_restarts_total",
+		"Restarts of monitor goroutines that panicked or stalled.")
+	spyMonitorStalls = spyMetrics.newCounter("dcrspy_monitor_stalls_total",
+		"Monitor goroutines that stalled with notifications waiting.")
+)
+
+// watchdog tracks the progress of a handler.  The handler calls progressed
+// when it receives a notification, and pending returns the number of its
+// notifications waiting, e.g. the length of its channel.
+type watchdog struct {
+	pending func() int
+
+	mtx          sync.Mutex
+	lastProgress time.Time
+	// backlogSince is when notifications were first seen waiting since the
+	// last progress, zero if none are.
+	backlogSince time.Time
+}
+
+// newWatchdog creates a watchdog of the handler with the pending function.
+func newWatchdog(pending func() int) *watchdog {
+	return &watchdog{
+		pending:      pending,
+		lastProgress: time.Now(),
+	}
+}
+
+// progressed records that the handler received a notification.
+func (w *watchdog) progressed() {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.lastProgress = time.Now()
+	w.backlogSince = time.Time{}
+}
+
+// check returns true if notifications have been waiting for at least timeout
+// without progress, with the number waiting and the time since the last
+// progress.
+func (w *watchdog) check(now time.Time,
+	timeout time.Duration) (bool, int, time.Duration) {
+	n := w.pending()
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	idle := now.Sub(w.lastProgress)
+	if n == 0 {
+		w.backlogSince = time.Time{}
+		return false, 0, idle
+	}
+	if w.backlogSince.IsZero() {
+		w.backlogSince = now
+	}
+	return now.Sub(w.backlogSince) >= timeout, n, idle
+}
+
+// supervise runs the handler, named name in logs and alerts, as a goroutine,
+// restarting it if it panics, or if it stalls according to the watchdog wd
+// (nil for none), until quit is closed.  Each run of the handler is given a
+// WaitGroup to call Done on when it returns, and a quit channel that is closed
+// when quit is, or when the run is abandoned.  wg waits for the supervisor,
+// which waits for the handler when quitting, for at most stalltimeout if stall
+// detection is enabled.
+func supervise(name string, wg *sync.WaitGroup, quit <-chan struct{},
+	wd *watchdog, handler func(*sync.WaitGroup, <-chan struct{})) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		backoff := supervisorInitialBackoff
+		for {
+			start := time.Now()
+			wd.progressed()
+			runQuit := make(chan struct{})
+			done := make(chan bool, 1)
+			go func() {
+				var runWG sync.WaitGroup
+				runWG.Add(1)
+				done <- runRecovered(name, func() {
+					handler(&runWG, runQuit)
+				})
+			}()
+
+			reason, ok := superviseRun(name, wd, quit, runQuit, done)
+			if !ok {
+				return
+			}
+			if time.Since(start) > supervisorStableRun {
+				backoff = supervisorInitialBackoff
+			}
+
+			what := "panicked"
+			if reason == "stall" {
+				what = "stalled"
+			}
+			sendDedupAlert(reason+":"+name, "monitor "+reason,
+				"The %s %s and will be restarted in %v. See the log for "+
+					"the stack trace.", name, what, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-quit:
+				log.Infof("Not restarting %s, quitting.", name)
+				return
+			}
+			if backoff *= 2; backoff > supervisorMaxBackoff {
+				backoff = supervisorMaxBackoff
+			}
+
+			log.Infof("Restarting %s.", name)
+			spyMonitorRestarts.inc()
+		}
+	}()
+}
+
+// superviseRun waits for a run of the handler, which signals done when it
+// returns, and checks its watchdog.  It returns the reason to restart the
+// handler, "panic" or "stall", and false if it is not to be restarted.
+// runQuit is closed when quit is, or when the run stalls.
+func superviseRun(name string, wd *watchdog, quit <-chan struct{},
+	runQuit chan struct{}, done <-chan bool) (string, bool) {
+	var stallCheck <-chan time.Time
+	if wd != nil && spyStallTimeout > 0 {
+		ticker := time.NewTicker(stallCheckInterval)
+		defer ticker.Stop()
+		stallCheck = ticker.C
+	}
+
+	for {
+		select {
+		case panicked := <-done:
+			if !panicked {
+				return "", false
+			}
+			select {
+			case <-quit:
+				log.Infof("Not restarting %s, quitting.", name)
+				return "", false
+			default:
+			}
+			return "panic", true
+
+		case now := <-stallCheck:
+			stalled, pending, idle := wd.check(now, spyStallTimeout)
+			if !stalled {
+				continue
+			}
+			log.Criticalf("The %s stalled: %d notification(s) waiting, "+
+				"last received %v ago. Goroutines:\n%s", name, pending,
+				idle, goroutineStacks())
+			spyMonitorStalls.inc()
+			close(runQuit)
+			return "stall", true
+
+		case <-quit:
+			close(runQuit)
+			if stallCheck == nil {
+				<-done
+				return "", false
+			}
+			select {
+			case <-done:
+			case <-time.After(spyStallTimeout):
+				log.Warnf("The %s did not quit within %v.", name,
+					spyStallTimeout)
+			}
+			return "", false
+		}
+	}
+}
+
+// runRecovered runs the handler, and returns true if it panicked, after
+// logging the panic and stack.
+func runRecovered(name string, handler func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Criticalf("The %s panicked: %v\n%s", name, r, debug.Stack())
+			panicked = true
+		}
+	}()
+	handler()
+	return false
+}
+
+// goroutineStacks returns the stacks of all goroutines.
+func goroutineStacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return bytes.TrimSpace(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,116 @@
+// telegram.go sends the operator's watched address notifications to a
+// Telegram chat through a bot, alongside or instead of email.  Telegram
+// delivers within seconds and needs only outbound HTTPS, unlike SMTP, which
+// suits time-sensitive mempool notifications.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const (
+	// telegramAPIURL is the URL of the Bot API's sendMessage method, with %s
+	// for the bot token.
+	telegramAPIURL = "https://api.telegram.org/bot%s/sendMessage"
+	// telegramQueueSize is the number of messages waiting to be sent, beyond
+	// which new messages are dropped.
+	telegramQueueSize = 200
+)
+
+// telegramMessage is a request to the sendMessage method.
+type telegramMessage struct {
+	ChatID string `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+// telegramNotifier sends messages to a chat with a bot.
+type telegramNotifier struct {
+	url    string
+	chatID string
+	client *http.Client
+	queue  chan *queuedText
+}
+
+// spyTelegram is the package-level Telegram notifier, nil if not configured.
+var spyTelegram *telegramNotifier
+
+// newTelegramNotifier creates a telegramNotifier for the bot with the token,
+// sending to the chat with the ID (e.g. 123456789, or @channelname).
+func newTelegramNotifier(token, chatID string) *telegramNotifier {
+	return &telegramNotifier{
+		url:    fmt.Sprintf(telegramAPIURL, token),
+		chatID: chatID,
+		client: newHTTPClient(),
+		queue:  make(chan *queuedText, telegramQueueSize),
+	}
+}
+
+// notify queues the message of the event.  It does not block.
+func (n *telegramNotifier) notify(msg string, e *spyEvent) {
+	if n == nil {
+		return
+	}
+	select {
+	case n.queue <- &queuedText{msg, e}:
+	default:
+		log.Warnf("Telegram queue full. Dropping %q.", msg)
+		e.delivered()
+	}
+}
+
+// Notify queues a message of the watched address event, rendered with the
+// telegram template.  It does not block.
+func (n *telegramNotifier) Notify(e *spyEvent) error {
+	n.notify(spyNotifyTemplates.render(notifyChannelTelegram, e), e)
+	return nil
+}
+
+// tracksDelivery implements deliveryNotifier.
+func (n *telegramNotifier) tracksDelivery() {}
+
+// run sends queued messages until quit is closed.  It should be run as a
+// goroutine.
+func (n *telegramNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case msg := <-n.queue:
+			if err := n.send(msg.text); err != nil {
+				log.Warnf("Failed to send Telegram message: %v",
+					reportError(errKindNotifier, "telegram", err))
+			}
+			msg.event.delivered()
+		case <-quit:
+			log.Debugf("Quitting Telegram notifier.")
+			return
+		}
+	}
+}
+
+// send sends the message to the chat.
+func (n *telegramNotifier) send(msg string) error {
+	payload, err := json.Marshal(&telegramMessage{n.chatID, msg})
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json",
+		bytes.NewReader(payload))
+	if err != nil {
+		// Omit the URL, which includes the token.
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// tenants.go implements multi-tenant mode for the API.  Each tenant has an API
+// key, owns the watched addresses it registers, and receives notifications
+// only for those addresses.  The number of addresses per tenant is limited by
+// a quota.
+
+package spy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// tenant is an API user.  Tenants are defined in a JSON file given by the
+// apitenants option, containing an array of tenants.  Role is the API role of
+// the tenant's key (see apiroles.go), read if empty.
+type tenant struct {
+	Name         string `json:"name"`
+	APIKey       string `json:"apikey"`
+	Role         string `json:"role,omitempty"`
+	EmailAddr    string `json:"emailaddr"`
+	MaxAddresses int    `json:"maxaddresses"` // 0 for no limit
+
+	role apiRole
+}
+
+// tenantRegistry holds the tenants.
+type tenantRegistry struct {
+	tenants []*tenant
+	byName  map[string]*tenant
+}
+
+// spyTenants is the package-level tenant registry.  It is nil when not in
+// multi-tenant mode.
+var spyTenants *tenantRegistry
+
+// loadTenants reads the tenants from the JSON file at path.
+func loadTenants(path string) (*tenantRegistry, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var tenants []*tenant
+	if err = json.NewDecoder(fp).Decode(&tenants); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+
+	r := &tenantRegistry{
+		tenants: tenants,
+		byName:  make(map[string]*tenant, len(tenants)),
+	}
+	for _, t := range tenants {
+		if t.Name == operatorOwner || t.APIKey == "" {
+			return nil, fmt.Errorf("every tenant requires a name and apikey")
+		}
+		if _, dup := r.byName[t.Name]; dup {
+			return nil, fmt.Errorf("duplicate tenant name %q", t.Name)
+		}
+		if t.role, err = parseAPIRole(t.Role); err != nil {
+			return nil, fmt.Errorf("tenant %q: %v", t.Name, err)
+		}
+		r.byName[t.Name] = t
+	}
+	return r, nil
+}
+
+// lookup returns the tenant with the given name, or nil.
+func (r *tenantRegistry) lookup(name string) *tenant {
+	if r == nil {
+		return nil
+	}
+	return r.byName[name]
+}
+
+// authenticate returns the tenant identified by the API key in the request's
+// X-API-Key header or bearer token, or nil if there is none.
+func (r *tenantRegistry) authenticate(req *http.Request) *tenant {
+	key := requestAPIKey(req)
+	if key == "" {
+		return nil
+	}
+	for _, t := range r.tenants {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(t.APIKey)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// tenantHandler is an HTTP handler for a request by a tenant.  The tenant is
+// nil when not in multi-tenant mode.
+type tenantHandler func(w http.ResponseWriter, req *http.Request, t *tenant)
+
+// require returns a handler that authenticates the tenant before calling h.
+// If r is nil (not in multi-tenant mode), h is called with a nil tenant, after
+// authenticating one of the operator's API keys or client certificates if any
+// are configured.  The
+// role of the key must allow the request.  Control actions are recorded in the
+// audit log (see audit.go).  The call is counted in the usage of the tenant
+// (or operator).
+func (r *tenantRegistry) require(h tenantHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var t *tenant
+		actor, role := operatorActor, roleAdmin
+		switch {
+		case r != nil:
+			if t = r.authenticate(req); t == nil {
+				http.Error(w, "a valid API key is required",
+					http.StatusUnauthorized)
+				return
+			}
+			actor, role = t.Name, t.role
+		case spyAPIKeys != nil || spyCertRoles != nil:
+			k := spyAPIKeys.authenticate(req)
+			if k == nil {
+				k = spyCertRoles.authenticate(req)
+			}
+			if k == nil {
+				msg := "a valid API key is required"
+				if spyCertRoles != nil {
+					msg = "a valid API key or client certificate is required"
+				}
+				http.Error(w, msg, http.StatusUnauthorized)
+				return
+			}
+			actor, role = k.name, k.role
+		}
+
+		if audited(req) {
+			rec := &auditRecorder{ResponseWriter: w}
+			defer recordAudit(req, actor, t.owner(), role, rec)
+			w = rec
+		}
+		if !allowRole(w, req, role) {
+			return
+		}
+		spyUsage.apiCall(t.owner())
+		h(w, req, t)
+	})
+}
+
+// owner returns the watched address owner name for the tenant, which is the
+// operator if t is nil.
+func (t *tenant) owner() string {
+	if t == nil {
+		return operatorOwner
+	}
+	return t.Name
+}
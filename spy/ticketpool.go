@@ -0,0 +1,274 @@
+// ticketpool.go periodically samples the live ticket pool, computing the
+// histogram of ticket ages (blocks since purchase) and the distribution of the
+// prices paid, which are useful for modeling expected vote times.  Each sample
+// is saved to a file and the latest is served by the ticket pool API.  The
+// purchase height and price of each ticket are cached, so only tickets that
+// are new since the last sample are looked up.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrrpcclient"
+)
+
+const (
+	// ticketPoolFilePrefix is the prefix of the ticket pool sample files.
+	ticketPoolFilePrefix = "ticket-pool-"
+	// defaultTicketPoolBucket is the default width of the age histogram
+	// buckets, in blocks.
+	defaultTicketPoolBucket = 576
+)
+
+// poolTicket is the purchase height and price of a live ticket.
+type poolTicket struct {
+	height int64
+	price  float64
+}
+
+// ageBucket is a bucket of the ticket age histogram, for ages in [From, To).
+type ageBucket struct {
+	From  int64 `json:"from"`
+	To    int64 `json:"to"`
+	Count int   `json:"count"`
+}
+
+// priceCount is the number of live tickets bought at a price.
+type priceCount struct {
+	Price float64 `json:"price"`
+	Count int     `json:"count"`
+}
+
+// ticketPoolSample is the composition of the live ticket pool at a height.
+type ticketPoolSample struct {
+	Height       int64        `json:"height"`
+	Time         int64        `json:"time"`
+	PoolSize     int          `json:"poolsize"`
+	PoolValue    float64      `json:"poolvalue"`
+	AgeMean      float64      `json:"agemean"`
+	AgeMedian    float64      `json:"agemedian"`
+	AgeHistogram []*ageBucket `json:"agehistogram"`
+	Prices       []priceCount `json:"prices"`
+}
+
+// ticketPoolSampler samples the live ticket pool.
+type ticketPoolSampler struct {
+	mtx    sync.Mutex
+	dcrd   *dcrrpcclient.Client
+	folder string
+	bucket int64
+	// tickets caches the live tickets' purchase heights and prices.
+	tickets map[chainhash.Hash]poolTicket
+	latest  *ticketPoolSample
+}
+
+// spyTicketPool is the package-level ticket pool sampler, nil if not enabled.
+var spyTicketPool *ticketPoolSampler
+
+// newTicketPoolSampler creates a ticketPoolSampler with age buckets bucket
+// blocks wide, saving samples in folder.
+func newTicketPoolSampler(dcrd *dcrrpcclient.Client, folder string,
+	bucket int64) *ticketPoolSampler {
+	if bucket <= 0 {
+		bucket = defaultTicketPoolBucket
+	}
+	s := &ticketPoolSampler{
+		dcrd:    dcrd,
+		folder:  folder,
+		bucket:  bucket,
+		tickets: make(map[chainhash.Hash]poolTicket),
+	}
+	spyMetrics.newGauge("dcrspy_ticketpool_age_mean_blocks",
+		"Mean age of the live tickets at the last ticket pool sample.",
+		func() float64 {
+			if l := s.latestSample(); l != nil {
+				return l.AgeMean
+			}
+			return math.NaN()
+		})
+	spyMetrics.newGauge("dcrspy_ticketpool_age_median_blocks",
+		"Median age of the live tickets at the last ticket pool sample.",
+		func() float64 {
+			if l := s.latestSample(); l != nil {
+				return l.AgeMedian
+			}
+			return math.NaN()
+		})
+	return s
+}
+
+// latestSample returns the last sample, or nil if there is none yet.
+func (s *ticketPoolSampler) latestSample() *ticketPoolSample {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.latest
+}
+
+// sample looks up the live tickets and computes their composition.
+func (s *ticketPoolSampler) sample() (*ticketPoolSample, error) {
+	_, height, err := s.dcrd.GetBestBlock()
+	if err != nil {
+		return nil, err
+	}
+	live, err := s.dcrd.LiveTickets()
+	if err != nil {
+		return nil, err
+	}
+
+	// Look up new tickets, and forget those no longer live.
+	isLive := make(map[chainhash.Hash]bool, len(live))
+	var lookups int
+	for _, h := range live {
+		isLive[*h] = true
+		if _, ok := s.tickets[*h]; ok {
+			continue
+		}
+		tx, err := s.dcrd.GetRawTransactionVerbose(h)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get ticket %v: %v", h, err)
+		}
+		if len(tx.Vout) == 0 {
+			return nil, fmt.Errorf("ticket %v has no outputs", h)
+		}
+		s.tickets[*h] = poolTicket{tx.BlockHeight, tx.Vout[0].Value}
+		lookups++
+	}
+	for h := range s.tickets {
+		if !isLive[h] {
+			delete(s.tickets, h)
+		}
+	}
+	log.Debugf("Ticket pool sample at %d: %d live tickets, %d new.", height,
+		len(live), lookups)
+
+	sample := &ticketPoolSample{
+		Height:   height,
+		Time:     time.Now().Unix(),
+		PoolSize: len(s.tickets),
+	}
+	ages := make([]float64, 0, len(s.tickets))
+	buckets := make(map[int64]*ageBucket)
+	prices := make(map[float64]int)
+	var ageTotal float64
+	for _, t := range s.tickets {
+		age := height - t.height
+		ages = append(ages, float64(age))
+		ageTotal += float64(age)
+		from := age / s.bucket * s.bucket
+		b, ok := buckets[from]
+		if !ok {
+			b = &ageBucket{From: from, To: from + s.bucket}
+			buckets[from] = b
+			sample.AgeHistogram = append(sample.AgeHistogram, b)
+		}
+		b.Count++
+		prices[t.price]++
+		sample.PoolValue += t.price
+	}
+	sort.Sort(ageBucketsByAge(sample.AgeHistogram))
+	for p, n := range prices {
+		sample.Prices = append(sample.Prices, priceCount{p, n})
+	}
+	sort.Sort(priceCountsByPrice(sample.Prices))
+	if len(ages) > 0 {
+		sample.AgeMean = ageTotal / float64(len(ages))
+		sample.AgeMedian = MedianCoin(ages)
+	}
+	return sample, nil
+}
+
+// ageBucketsByAge sorts age buckets by age.
+type ageBucketsByAge []*ageBucket
+
+func (b ageBucketsByAge) Len() int           { return len(b) }
+func (b ageBucketsByAge) Less(i, j int) bool { return b[i].From < b[j].From }
+func (b ageBucketsByAge) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// priceCountsByPrice sorts price counts by price.
+type priceCountsByPrice []priceCount
+
+func (p priceCountsByPrice) Len() int           { return len(p) }
+func (p priceCountsByPrice) Less(i, j int) bool { return p[i].Price < p[j].Price }
+func (p priceCountsByPrice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// sampleAndSave takes a sample and saves it to a file.
+func (s *ticketPoolSampler) sampleAndSave() {
+	sample, err := s.sample()
+	if err != nil {
+		log.Errorf("Ticket pool sample failed: %v", err)
+		return
+	}
+	s.mtx.Lock()
+	s.latest = sample
+	s.mtx.Unlock()
+
+	b, err := json.MarshalIndent(sample, "", "    ")
+	if err != nil {
+		log.Errorf("Failed to encode ticket pool sample: %v", err)
+		return
+	}
+	path := filepath.Join(s.folder, fmt.Sprintf("%s%d.json",
+		ticketPoolFilePrefix, sample.Height))
+	if err = ioutil.WriteFile(path, b, 0644); err != nil {
+		log.Errorf("Failed to save ticket pool sample: %v", err)
+		return
+	}
+	signStoredFile(path)
+}
+
+// run samples the ticket pool at startup and then at interval until quit is
+// closed.  It should be run as a goroutine.
+func (s *ticketPoolSampler) run(interval time.Duration, wg *sync.WaitGroup,
+	quit <-chan struct{}) {
+	defer wg.Done()
+
+	s.sampleAndSave()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sampleAndSave()
+		case <-quit:
+			log.Debugf("Quitting ticket pool sampler.")
+			return
+		}
+	}
+}
+
+// ticketPoolAPI documents ticketPoolHandler.
+var ticketPoolAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "Get the latest ticket pool sample",
+	response: ticketPoolSample{},
+}}
+
+// ticketPoolHandler serves GET /ticketpool with the latest sample.
+func (s *ticketPoolSampler) ticketPoolHandler(w http.ResponseWriter,
+	r *http.Request, t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var sample *ticketPoolSample
+	if s != nil {
+		sample = s.latestSample()
+	}
+	if sample == nil {
+		http.Error(w, "no ticket pool sample", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sample)
+}
@@ -0,0 +1,101 @@
+// timeouts.go holds the timeouts of outbound operations, so that an SMTP
+// server, HTTP endpoint or dcrd that stops responding does not hang a send or
+// a block's data collection.  smtptimeout bounds a whole SMTP session,
+// httptimeout each request to webhooks and external APIs, and rpctimeout the
+// collection of a block's data and stake info, and the availability and
+// heartbeat requests to dcrd.  A notification that times out fails like any
+// other, and is queued for retry.
+
+package spy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultSMTPTimeout = 30 * time.Second
+	defaultHTTPTimeout = 10 * time.Second
+	defaultRPCTimeout  = 20 * time.Second
+
+	defaultStallTimeout = 5 * time.Minute
+)
+
+// The timeouts of outbound operations, set from the config by setTimeouts.
+var (
+	spySMTPTimeout = defaultSMTPTimeout
+	spyHTTPTimeout = defaultHTTPTimeout
+	spyRPCTimeout  = defaultRPCTimeout
+	// spyStallTimeout is how long a monitor's notifications may wait without
+	// progress before it is restarted, 0 if stalls are not detected.
+	spyStallTimeout = defaultStallTimeout
+)
+
+// setTimeouts sets the timeouts of outbound operations from the config.  It
+// must be called before the notifiers and clients are created.
+func setTimeouts(cfg *Config) error {
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"smtptimeout", cfg.SMTPTimeout},
+		{"httptimeout", cfg.HTTPTimeout},
+		{"rpctimeout", cfg.RPCTimeout},
+	} {
+		if t.d <= 0 {
+			return fmt.Errorf("invalid %s %v", t.name, t.d)
+		}
+	}
+	if cfg.StallTimeout < 0 {
+		return fmt.Errorf("invalid stalltimeout %v", cfg.StallTimeout)
+	}
+	spySMTPTimeout = cfg.SMTPTimeout
+	spyHTTPTimeout = cfg.HTTPTimeout
+	spyRPCTimeout = cfg.RPCTimeout
+	spyStallTimeout = cfg.StallTimeout
+	return nil
+}
+
+// newHTTPClient returns an HTTP client whose requests time out after
+// httptimeout.
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: spyHTTPTimeout}
+}
+
+// timeoutError is the error of an operation that timed out.
+type timeoutError struct {
+	op string
+	d  time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.op, e.d)
+}
+
+// Timeout reports that the error is a timeout, as a net.Error does.
+func (e *timeoutError) Timeout() bool { return true }
+
+// Temporary reports that the operation may succeed if retried.
+func (e *timeoutError) Temporary() bool { return true }
+
+// withRPCTimeout runs the RPC request f, the operation op in the error,
+// returning a timeoutError if it does not return within rpctimeout.  The
+// request is left to complete in the background.
+func withRPCTimeout(op string, f func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- f()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(spyRPCTimeout):
+		spyRPCTimeouts.inc()
+		return &timeoutError{op, spyRPCTimeout}
+	}
+}
+
+// spyRPCTimeouts counts the RPC requests that timed out.
+var spyRPCTimeouts = spyMetrics.newCounter("dcrspy_rpc_timeouts_total",
+	"RPC requests to dcrd or dcrwallet that timed out.")
@@ -0,0 +1,265 @@
+// transform.go implements the post-processing pipelines, configurable chains
+// of transform steps applied to the JSON documents of the collected block and
+// stake info data before they are written by the JSON savers.  Fields are
+// addressed by paths of the keys of nested objects joined with dots, e.g.
+// ticket_pool_info.poolvalue.  The steps are:
+//
+//	select=PATH,...       keep only the given fields
+//	drop=PATH,...         remove the given fields
+//	scale=PATH:FACTOR     multiply a number, e.g. for unit conversion
+//	rename=PATH:NEWPATH   move a field
+//	derive=PATH=EXPR      set a field to the value of an expression of
+//	                      other fields (see expr.go)
+
+package spy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// transformStep is a step of a post-processing pipeline.
+type transformStep interface {
+	apply(doc map[string]interface{}) error
+}
+
+// transformStage is a step of a pipeline and its specification.
+type transformStage struct {
+	spec string
+	step transformStep
+}
+
+// transformPipeline is a chain of transform steps.
+type transformPipeline []transformStage
+
+// The pipelines for block data and stake info data, nil if not configured.
+var (
+	blockDataPipeline transformPipeline
+	stakeInfoPipeline transformPipeline
+)
+
+// parseTransformPipeline parses the steps, in the form NAME=ARGS.
+func parseTransformPipeline(specs []string) (transformPipeline, error) {
+	var p transformPipeline
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid transform %q", spec)
+		}
+		name, args := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		var step transformStep
+		switch name {
+		case "select", "drop":
+			var paths []string
+			for _, path := range strings.Split(args, ",") {
+				if path = strings.TrimSpace(path); path != "" {
+					paths = append(paths, path)
+				}
+			}
+			if name == "select" {
+				step = selectStep(paths)
+			} else {
+				step = dropStep(paths)
+			}
+		case "scale":
+			i := strings.LastIndex(args, ":")
+			if i < 0 {
+				return nil, fmt.Errorf("invalid transform %q: expected "+
+					"scale=PATH:FACTOR", spec)
+			}
+			factor, err := strconv.ParseFloat(args[i+1:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scale factor in %q", spec)
+			}
+			step = &scaleStep{args[:i], factor}
+		case "rename":
+			paths := strings.Split(args, ":")
+			if len(paths) != 2 || paths[0] == "" || paths[1] == "" {
+				return nil, fmt.Errorf("invalid transform %q: expected "+
+					"rename=PATH:NEWPATH", spec)
+			}
+			step = &renameStep{paths[0], paths[1]}
+		case "derive":
+			de := strings.SplitN(args, "=", 2)
+			if len(de) != 2 {
+				return nil, fmt.Errorf("invalid transform %q: expected "+
+					"derive=PATH=EXPRESSION", spec)
+			}
+			x, err := parseExpression(de[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid expression in %q: %v", spec, err)
+			}
+			step = &deriveStep{strings.TrimSpace(de[0]), x}
+		default:
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+		p = append(p, transformStage{spec, step})
+	}
+	return p, nil
+}
+
+// transformJSON applies the pipeline to the JSON object in b.  A failing step
+// is logged and skipped.
+func (p transformPipeline) transformJSON(b []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	for _, stage := range p {
+		if err := stage.step.apply(doc); err != nil {
+			log.Warnf("Transform %q failed: %v", stage.spec, err)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// lookupPath returns the value at path in doc.
+func lookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	var v interface{} = doc
+	for _, k := range keys {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// setPath sets the value at path in doc, creating objects as needed.
+func setPath(doc map[string]interface{}, path string, val interface{}) error {
+	keys := strings.Split(path, ".")
+	obj := doc
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := obj[k]
+		if !ok {
+			next = make(map[string]interface{})
+			obj[k] = next
+		}
+		if obj, ok = next.(map[string]interface{}); !ok {
+			return fmt.Errorf("%s is not an object", k)
+		}
+	}
+	obj[keys[len(keys)-1]] = val
+	return nil
+}
+
+// deletePath removes the value at path in doc, if present.
+func deletePath(doc map[string]interface{}, path string) {
+	keys := strings.Split(path, ".")
+	obj := doc
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := obj[k].(map[string]interface{})
+		if !ok {
+			return
+		}
+		obj = next
+	}
+	delete(obj, keys[len(keys)-1])
+}
+
+// jsonNumber returns v as a float64 if it is a number.
+func jsonNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// selectStep keeps only the fields at the paths.
+type selectStep []string
+
+func (s selectStep) apply(doc map[string]interface{}) error {
+	kept := make(map[string]interface{})
+	for _, path := range s {
+		if v, ok := lookupPath(doc, path); ok {
+			if err := setPath(kept, path, v); err != nil {
+				return err
+			}
+		}
+	}
+	for k := range doc {
+		delete(doc, k)
+	}
+	for k, v := range kept {
+		doc[k] = v
+	}
+	return nil
+}
+
+// dropStep removes the fields at the paths.
+type dropStep []string
+
+func (s dropStep) apply(doc map[string]interface{}) error {
+	for _, path := range s {
+		deletePath(doc, path)
+	}
+	return nil
+}
+
+// scaleStep multiplies the number at path by factor.  It has no effect if the
+// field is absent.
+type scaleStep struct {
+	path   string
+	factor float64
+}
+
+func (s *scaleStep) apply(doc map[string]interface{}) error {
+	v, ok := lookupPath(doc, s.path)
+	if !ok {
+		return nil
+	}
+	f, ok := jsonNumber(v)
+	if !ok {
+		return fmt.Errorf("%s is not a number", s.path)
+	}
+	return setPath(doc, s.path, f*s.factor)
+}
+
+// renameStep moves the field at from to to.  It has no effect if the field is
+// absent.
+type renameStep struct {
+	from, to string
+}
+
+func (s *renameStep) apply(doc map[string]interface{}) error {
+	v, ok := lookupPath(doc, s.from)
+	if !ok {
+		return nil
+	}
+	deletePath(doc, s.from)
+	return setPath(doc, s.to, v)
+}
+
+// deriveStep sets the field at path to the value of an expression, the
+// variables of which are the paths of other fields.
+type deriveStep struct {
+	path string
+	expr *expression
+}
+
+func (s *deriveStep) apply(doc map[string]interface{}) error {
+	v, err := s.expr.eval(func(name string) (interface{}, bool) {
+		v, ok := lookupPath(doc, name)
+		if f, isNum := jsonNumber(v); isNum {
+			return f, true
+		}
+		return v, ok
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	return setPath(doc, s.path, v)
+}
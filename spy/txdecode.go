@@ -0,0 +1,270 @@
+// txdecode.go implements the transaction decode API, which decodes a raw
+// transaction, given in hex or by its txid, with the addresses and script
+// classes of its inputs and outputs extracted as the address watcher does.
+// Addresses watched by the caller are marked.
+
+package spy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/decred/dcrd/blockchain/stake"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/wire"
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+)
+
+// maxDecodeTxSize is the maximum size of a raw transaction to decode, in
+// bytes.
+const maxDecodeTxSize = 100000
+
+// txTypeNames are the names of the transaction types in decodedTx.
+var txTypeNames = map[stake.TxType]string{
+	stake.TxTypeRegular: "regular",
+	stake.TxTypeSStx:    "ticket",
+	stake.TxTypeSSGen:   "vote",
+	stake.TxTypeSSRtx:   "revocation",
+}
+
+// decodedTxIn is a decoded transaction input.  The amount, script class and
+// addresses are those of the previous output, included when it can be looked
+// up.
+type decodedTxIn struct {
+	PrevTxID    string   `json:"prevtxid"`
+	PrevVout    uint32   `json:"prevvout"`
+	Tree        int8     `json:"tree"`
+	Sequence    uint32   `json:"sequence"`
+	AmountIn    float64  `json:"amountin"`
+	ScriptClass string   `json:"scriptclass,omitempty"`
+	Addresses   []string `json:"addresses,omitempty"`
+	Watched     []string `json:"watched,omitempty"`
+}
+
+// decodedTxOut is a decoded transaction output.
+type decodedTxOut struct {
+	N           int      `json:"n"`
+	Value       float64  `json:"value"`
+	Version     uint16   `json:"version"`
+	ScriptClass string   `json:"scriptclass"`
+	ReqSigs     int      `json:"reqsigs"`
+	Addresses   []string `json:"addresses"`
+	Watched     []string `json:"watched,omitempty"`
+}
+
+// decodedTx is a decoded transaction.  The block fields are included when
+// the transaction was given by txid and is mined.
+type decodedTx struct {
+	TxID          string          `json:"txid"`
+	Type          string          `json:"type"`
+	Version       uint16          `json:"version"`
+	LockTime      uint32          `json:"locktime"`
+	Expiry        uint32          `json:"expiry"`
+	Size          int             `json:"size"`
+	Vin           []*decodedTxIn  `json:"vin"`
+	Vout          []*decodedTxOut `json:"vout"`
+	Fee           float64         `json:"fee,omitempty"`
+	BlockHash     string          `json:"blockhash,omitempty"`
+	BlockHeight   int64           `json:"blockheight,omitempty"`
+	Confirmations int64           `json:"confirmations,omitempty"`
+}
+
+// txDecoder serves the /api/tx/decode endpoint.
+type txDecoder struct {
+	dcrd    *dcrrpcclient.Client
+	watched *watchedAddresses
+}
+
+func newTxDecoder(dcrd *dcrrpcclient.Client,
+	watched *watchedAddresses) *txDecoder {
+	return &txDecoder{
+		dcrd:    dcrd,
+		watched: watched,
+	}
+}
+
+// txDecodeAPI documents the /api/tx/decode endpoint.
+var txDecodeAPI = []apiOperation{{
+	method:  "GET",
+	summary: "Decode a transaction",
+	params: []apiParam{
+		{name: "hex", in: "query", typ: "string",
+			description: "The raw transaction"},
+		{name: "txid", in: "query", typ: "string",
+			description: "The transaction ID, instead of hex"},
+	},
+	response: decodedTx{},
+}, {
+	method:   "POST",
+	summary:  "Decode a raw transaction",
+	request:  "",
+	response: decodedTx{},
+}}
+
+// serve is a tenantHandler for GET /api/tx/decode?hex=<raw tx> or
+// /api/tx/decode?txid=<txid>.  The raw transaction may also be POSTed as the
+// hex request body, or as a JSON string.
+func (d *txDecoder) serve(w http.ResponseWriter, r *http.Request, t *tenant) {
+	var rawHex, txid string
+	switch r.Method {
+	case "GET":
+		rawHex = r.FormValue("hex")
+		txid = r.FormValue("txid")
+	case "POST":
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body,
+			2*maxDecodeTxSize+1))
+		if err != nil {
+			http.Error(w, "unable to read request", http.StatusBadRequest)
+			return
+		}
+		// The hex may be a JSON string.
+		rawHex = strings.Trim(strings.TrimSpace(string(body)), `"`)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if (rawHex == "") == (txid == "") {
+		http.Error(w, "one of hex or txid is required", http.StatusBadRequest)
+		return
+	}
+
+	var dtx *decodedTx
+	if txid != "" {
+		hash, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			http.Error(w, "invalid txid", http.StatusBadRequest)
+			return
+		}
+		txRes, err := d.dcrd.GetRawTransactionVerbose(hash)
+		if err != nil {
+			http.Error(w, "transaction not found", http.StatusNotFound)
+			return
+		}
+		if dtx, err = d.decode(txRes.Hex, t.owner()); err != nil {
+			log.Errorf("Unable to decode transaction %v: %v", hash, err)
+			http.Error(w, "unable to decode transaction",
+				http.StatusInternalServerError)
+			return
+		}
+		dtx.BlockHash = txRes.BlockHash
+		dtx.BlockHeight = txRes.BlockHeight
+		dtx.Confirmations = txRes.Confirmations
+	} else {
+		if len(rawHex) > 2*maxDecodeTxSize {
+			http.Error(w, "transaction too large",
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		var err error
+		if dtx, err = d.decode(rawHex, t.owner()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dtx)
+}
+
+// decode decodes the hex-encoded raw transaction, marking the addresses
+// watched by owner.
+func (d *txDecoder) decode(rawHex, owner string) (*decodedTx, error) {
+	raw, err := hex.DecodeString(rawHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %v", err)
+	}
+	msgTx := wire.NewMsgTx()
+	if err = msgTx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("invalid transaction: %v", err)
+	}
+
+	dtx := &decodedTx{
+		TxID:     msgTx.TxHash().String(),
+		Type:     txTypeNames[stake.DetermineTxType(msgTx)],
+		Version:  msgTx.Version,
+		LockTime: msgTx.LockTime,
+		Expiry:   msgTx.Expiry,
+		Size:     msgTx.SerializeSize(),
+		Vin:      make([]*decodedTxIn, 0, len(msgTx.TxIn)),
+		Vout:     make([]*decodedTxOut, 0, len(msgTx.TxOut)),
+	}
+
+	var in, out int64
+	for i, txIn := range msgTx.TxIn {
+		prev := &txIn.PreviousOutPoint
+		din := &decodedTxIn{
+			PrevTxID: prev.Hash.String(),
+			PrevVout: prev.Index,
+			Tree:     prev.Tree,
+			Sequence: txIn.Sequence,
+			AmountIn: dcrutil.Amount(txIn.ValueIn).ToCoin(),
+		}
+		dtx.Vin = append(dtx.Vin, din)
+		in += txIn.ValueIn
+		// The coinbase and a vote's stakebase have no previous output, and
+		// the previous transaction can only be looked up with txindex.
+		if !spyNodeIndexes.TxIndex || prev.Hash == (chainhash.Hash{}) ||
+			(i == 0 && dtx.Type == txTypeNames[stake.TxTypeSSGen]) {
+			continue
+		}
+		prevTx, err := d.dcrd.GetRawTransaction(&prev.Hash)
+		if err != nil {
+			log.Debugf("Unable to get previous transaction %v: %v",
+				prev.Hash, err)
+			continue
+		}
+		prevOuts := prevTx.MsgTx().TxOut
+		if int(prev.Index) >= len(prevOuts) {
+			continue
+		}
+		class, addrs, _, err := txOutAddresses(prevOuts[prev.Index])
+		if err != nil {
+			continue
+		}
+		din.ScriptClass = class.String()
+		din.Addresses = addrs
+		din.Watched = d.watchedOf(owner, addrs)
+	}
+
+	for n, txOut := range msgTx.TxOut {
+		class, addrs, reqSigs, err := txOutAddresses(txOut)
+		if err != nil {
+			log.Debugf("ExtractPkScriptAddrs: %v", err)
+		}
+		if addrs == nil {
+			addrs = []string{}
+		}
+		dtx.Vout = append(dtx.Vout, &decodedTxOut{
+			N:           n,
+			Value:       dcrutil.Amount(txOut.Value).ToCoin(),
+			Version:     txOut.Version,
+			ScriptClass: class.String(),
+			ReqSigs:     reqSigs,
+			Addresses:   addrs,
+			Watched:     d.watchedOf(owner, addrs),
+		})
+		out += txOut.Value
+	}
+	if dtx.Type == txTypeNames[stake.TxTypeRegular] && in > out {
+		dtx.Fee = dcrutil.Amount(in - out).ToCoin()
+	}
+	return dtx, nil
+}
+
+// watchedOf returns the addresses watched by owner.
+func (d *txDecoder) watchedOf(owner string, addrs []string) []string {
+	var watched []string
+	for _, a := range addrs {
+		if d.watched.watches(owner, a) {
+			watched = append(watched, a)
+		}
+	}
+	return watched
+}
@@ -0,0 +1,309 @@
+// txhelpers.go contains helper functions for working with transactions and
+// blocks (e.g. checking for a transaction in a block).
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/txscript"
+	"github.com/decred/dcrd/wire"
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+)
+
+// TxAction is the notification policy of a watched address: what happening
+// to the transaction (mined or inserted into mempool) is notified, and the
+// number of confirmations of a mined transaction before it is notified.
+type TxAction int32
+
+// Valid values for TxAction
+const (
+	TxMined TxAction = 1 << iota
+	TxInserted
+	// TxFollowUp notifies a mined transaction that was notified in mempool
+	// with a compact follow-up.
+	TxFollowUp
+	// removed? invalidated?
+)
+
+// txActionFlags are the flags of a TxAction, below the confirmations.
+const txActionFlags = TxMined | TxInserted | TxFollowUp
+
+// txActionConfsShift is the shift of the number of confirmations in a
+// TxAction.  Zero confirmations is the same as one, notifying when mined.
+const txActionConfsShift = 8
+
+// maxTxActionConfs is the maximum number of confirmations of a policy.
+const maxTxActionConfs = 1 << 16
+
+// Notification policy names
+var txActionNames = map[string]TxAction{
+	"none":    0,
+	"mined":   TxMined,
+	"mempool": TxInserted,
+	"both":    TxMined | TxInserted,
+	// followup is both, with a compact notification when mined.
+	"followup": TxMined | TxInserted | TxFollowUp,
+}
+
+// parseTxAction parses a notification policy: none, mined, mempool, both or
+// followup, optionally followed by the number of confirmations of mined
+// transactions (e.g. mined:6 or both:6), or the number of the flags (0-7).
+func parseTxAction(s string) (TxAction, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 || TxAction(n) > txActionFlags {
+			return 0, fmt.Errorf("invalid notification policy %q", s)
+		}
+		return TxAction(n), nil
+	}
+	name, confs := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		name, confs = s[:i], s[i+1:]
+	}
+	actn, ok := txActionNames[name]
+	if !ok {
+		return 0, fmt.Errorf("invalid notification policy %q (expected "+
+			"none, mined, mempool, both or followup)", s)
+	}
+	if confs == "" {
+		return actn, nil
+	}
+	n, err := strconv.Atoi(confs)
+	if err != nil || n < 1 || n > maxTxActionConfs || actn&TxMined == 0 {
+		return 0, fmt.Errorf("invalid confirmations of notification "+
+			"policy %q", s)
+	}
+	return actn | TxAction(n)<<txActionConfsShift, nil
+}
+
+// mempool returns true if transactions inserted into mempool are notified.
+func (a TxAction) mempool() bool {
+	return a&TxInserted != 0
+}
+
+// mined returns true if mined transactions are notified.
+func (a TxAction) mined() bool {
+	return a&TxMined != 0
+}
+
+// followUp returns true if a mined transaction that was notified in mempool
+// is notified with a compact follow-up.
+func (a TxAction) followUp() bool {
+	return a&TxFollowUp != 0 && a.mempool()
+}
+
+// confirmations returns the number of confirmations of a mined transaction
+// before it is notified, at least 1.
+func (a TxAction) confirmations() int64 {
+	if n := int64(a >> txActionConfsShift); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// String returns the name of the policy, as parsed by parseTxAction.
+func (a TxAction) String() string {
+	name := "none"
+	for n, actn := range txActionNames {
+		if a&txActionFlags == actn {
+			name = n
+		}
+	}
+	if a.mined() && a.confirmations() > 1 {
+		name += ":" + strconv.FormatInt(a.confirmations(), 10)
+	}
+	return name
+}
+
+// UnmarshalJSON accepts a policy name as well as the number of a TxAction.
+func (a *TxAction) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int32
+		if err = json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid notification policy %s", b)
+		}
+		*a = TxAction(n)
+		return nil
+	}
+	actn, err := parseTxAction(s)
+	if err != nil {
+		return err
+	}
+	*a = actn
+	return nil
+}
+
+// txOutAddresses extracts the script class, the encoded addresses and the
+// number of required signatures of a transaction output's pkScript.
+func txOutAddresses(txOut *wire.TxOut) (txscript.ScriptClass, []string, int,
+	error) {
+	class, addrs, reqSigs, err := txscript.ExtractPkScriptAddrs(txOut.Version,
+		txOut.PkScript, activeChain)
+	if err != nil {
+		return class, nil, 0, err
+	}
+	encoded := make([]string, len(addrs))
+	for i, a := range addrs {
+		encoded[i] = a.EncodeAddress()
+	}
+	return class, encoded, reqSigs, nil
+}
+
+func TxhashInSlice(txs []*dcrutil.Tx, txHash *chainhash.Hash) *dcrutil.Tx {
+	if len(txs) < 1 {
+		return nil
+	}
+
+	for _, minedTx := range txs {
+		txSha := minedTx.Hash()
+		if txHash.IsEqual(txSha) {
+			return minedTx
+		}
+	}
+	return nil
+}
+
+// includesStakeTx checks if a block contains a stake transaction hash
+func IncludesStakeTx(txHash *chainhash.Hash, block *dcrutil.Block) (int, int8) {
+	blockTxs := block.STransactions()
+
+	if tx := TxhashInSlice(blockTxs, txHash); tx != nil {
+		return tx.Index(), tx.Tree()
+	}
+	return -1, -1
+}
+
+// includesTx checks if a block contains a transaction hash
+func IncludesTx(txHash *chainhash.Hash, block *dcrutil.Block) (int, int8) {
+	blockTxs := block.Transactions()
+
+	if tx := TxhashInSlice(blockTxs, txHash); tx != nil {
+		return tx.Index(), tx.Tree()
+	}
+	return -1, -1
+}
+
+func blockConsumesOutpointWithAddresses(block *dcrutil.Block, addrs map[string]TxAction,
+	c *dcrrpcclient.Client) map[string][]*dcrutil.Tx {
+	addrMap := make(map[string][]*dcrutil.Tx)
+
+	checkForOutpointAddr := func(blockTxs []*dcrutil.Tx) {
+		for _, tx := range blockTxs {
+			for _, txIn := range tx.MsgTx().TxIn {
+				prevOut := &txIn.PreviousOutPoint
+				// For each TxIn, check the indicated vout index in the txid of the
+				// previous outpoint.
+				// txrr, err := c.GetRawTransactionVerbose(&prevOut.Hash)
+				prevTx, err := c.GetRawTransaction(&prevOut.Hash)
+				if err != nil {
+					log.Debug("Unable to get raw transaction for ", prevOut.Hash.String())
+					continue
+				}
+
+				// prevOut.Index should tell us which one, but check all anyway
+				for _, txOut := range prevTx.MsgTx().TxOut {
+					_, txAddrs, _, err := txscript.ExtractPkScriptAddrs(
+						txOut.Version, txOut.PkScript, activeChain)
+					if err != nil {
+						log.Infof("ExtractPkScriptAddrs: %v", err.Error())
+						continue
+					}
+
+					for _, txAddr := range txAddrs {
+						addrstr := txAddr.EncodeAddress()
+						if _, ok := addrs[addrstr]; ok {
+							if addrMap[addrstr] == nil {
+								addrMap[addrstr] = make([]*dcrutil.Tx, 0)
+							}
+							addrMap[addrstr] = append(addrMap[addrstr], prevTx)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	checkForOutpointAddr(block.Transactions())
+	checkForOutpointAddr(block.STransactions())
+
+	return addrMap
+}
+
+// BlockReceivesToAddresses checks a block for transactions paying to the
+// specified addresses, and creates a map of addresses to a slice of dcrutil.Tx
+// involving the address.
+func BlockReceivesToAddresses(block *dcrutil.Block, addrs *watchedAddresses) map[string][]*dcrutil.Tx {
+	addrMap := make(map[string][]*dcrutil.Tx)
+
+	checkForAddrOut := func(blockTxs []*dcrutil.Tx) {
+		for _, tx := range blockTxs {
+			// Check the addresses associated with the PkScript of each TxOut
+			for _, txOut := range tx.MsgTx().TxOut {
+				_, txOutAddrs, _, err := txOutAddresses(txOut)
+				if err != nil {
+					log.Infof("ExtractPkScriptAddrs: %v", err.Error())
+					continue
+				}
+
+				// Check if we are watching any address for this TxOut
+				for _, addrstr := range txOutAddrs {
+					if addrs.isWatched(addrstr) {
+						if _, gotSlice := addrMap[addrstr]; !gotSlice {
+							addrMap[addrstr] = make([]*dcrutil.Tx, 0) // nil
+						}
+						addrMap[addrstr] = append(addrMap[addrstr], tx)
+					}
+				}
+			}
+		}
+	}
+
+	checkForAddrOut(block.Transactions())
+	checkForAddrOut(block.STransactions())
+
+	return addrMap
+}
+
+// MedianAmount gets the median Amount from a slice of Amounts
+func MedianAmount(s []dcrutil.Amount) dcrutil.Amount {
+	if len(s) == 0 {
+		return 0
+	}
+
+	sort.Sort(dcrutil.AmountSorter(s))
+
+	middle := len(s) / 2
+
+	if len(s) == 0 {
+		return 0
+	} else if (len(s) % 2) != 0 {
+		return s[middle]
+	}
+	return (s[middle] + s[middle-1]) / 2
+}
+
+// MedianCoin gets the median DCR from a slice of float64s
+func MedianCoin(s []float64) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+
+	sort.Float64s(s)
+
+	middle := len(s) / 2
+
+	if len(s) == 0 {
+		return 0
+	} else if (len(s) % 2) != 0 {
+		return s[middle]
+	}
+	return (s[middle] + s[middle-1]) / 2
+}
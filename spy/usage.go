@@ -0,0 +1,191 @@
+// usage.go accounts for the use of dcrspy by each owner of watched addresses
+// (the operator or a tenant): API calls, notifications sent, and watched
+// addresses.  Usage is available at the /usage endpoint, and reported
+// periodically to files for billing.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// usageCounts are the counted uses by an owner.
+type usageCounts struct {
+	APICalls      uint64 `json:"apicalls"`
+	Notifications uint64 `json:"notifications"`
+}
+
+// ownerUsage is the usage by one owner.  Tenant is empty for the operator.
+type ownerUsage struct {
+	Tenant           string      `json:"tenant,omitempty"`
+	WatchedAddresses int         `json:"watchedaddresses"`
+	Total            usageCounts `json:"total"`
+	Period           usageCounts `json:"period"`
+}
+
+// usageReport is the usage by all owners since the start of the current
+// accounting period.
+type usageReport struct {
+	PeriodStart int64        `json:"periodstart"`
+	PeriodEnd   int64        `json:"periodend"`
+	Usage       []ownerUsage `json:"usage"`
+}
+
+// usageAccounting counts the uses by each owner, in total and for the current
+// accounting period.
+type usageAccounting struct {
+	mtx         sync.Mutex
+	periodStart time.Time
+	total       map[string]*usageCounts
+	period      map[string]*usageCounts
+}
+
+// spyUsage is the package-level usage accounting.
+var spyUsage = newUsageAccounting()
+
+func newUsageAccounting() *usageAccounting {
+	return &usageAccounting{
+		periodStart: time.Now(),
+		total:       make(map[string]*usageCounts),
+		period:      make(map[string]*usageCounts),
+	}
+}
+
+// counts returns the total and period counts for the owner, creating them if
+// needed.  The mutex must be held.
+func (u *usageAccounting) counts(owner string) (*usageCounts, *usageCounts) {
+	if u.total[owner] == nil {
+		u.total[owner] = new(usageCounts)
+	}
+	if u.period[owner] == nil {
+		u.period[owner] = new(usageCounts)
+	}
+	return u.total[owner], u.period[owner]
+}
+
+// apiCall counts an API call by the owner.
+func (u *usageAccounting) apiCall(owner string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	total, period := u.counts(owner)
+	total.APICalls++
+	period.APICalls++
+}
+
+// notification counts a notification sent to the owner.
+func (u *usageAccounting) notification(owner string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	total, period := u.counts(owner)
+	total.Notifications++
+	period.Notifications++
+}
+
+// report returns the usage by all owners with counts or watched addresses.
+// If endPeriod is true, a new accounting period is started.
+func (u *usageAccounting) report(watched *watchedAddresses, endPeriod bool) *usageReport {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	now := time.Now()
+	numWatched := watched.countByOwner()
+	for owner := range numWatched {
+		u.counts(owner)
+	}
+
+	owners := make([]string, 0, len(u.total))
+	for owner := range u.total {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	rep := &usageReport{
+		PeriodStart: u.periodStart.Unix(),
+		PeriodEnd:   now.Unix(),
+		Usage:       make([]ownerUsage, 0, len(owners)),
+	}
+	for _, owner := range owners {
+		rep.Usage = append(rep.Usage, ownerUsage{
+			Tenant:           owner,
+			WatchedAddresses: numWatched[owner],
+			Total:            *u.total[owner],
+			Period:           *u.period[owner],
+		})
+	}
+
+	if endPeriod {
+		u.periodStart = now
+		u.period = make(map[string]*usageCounts)
+	}
+	return rep
+}
+
+// usageAPI documents the /usage endpoint.
+var usageAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "Get the usage since startup and in the current period",
+	response: usageReport{},
+}}
+
+// usageHandler returns a tenantHandler for the /usage endpoint.  A tenant gets
+// only its own usage.
+func usageHandler(watched *watchedAddresses) tenantHandler {
+	return func(w http.ResponseWriter, r *http.Request, t *tenant) {
+		rep := spyUsage.report(watched, false)
+		if t != nil {
+			var own []ownerUsage
+			for _, ou := range rep.Usage {
+				if ou.Tenant == t.Name {
+					own = append(own, ou)
+				}
+			}
+			rep.Usage = own
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rep); err != nil {
+			log.Errorf("Failed to write usage: %v", err)
+		}
+	}
+}
+
+// usageReporter writes a usage report to a file in folder at the end of each
+// accounting period, and starts a new period.  It should be run as a
+// goroutine.
+func usageReporter(interval time.Duration, folder string,
+	watched *watchedAddresses, wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rep := spyUsage.report(watched, true)
+			j, err := json.MarshalIndent(rep, "", "    ")
+			if err != nil {
+				log.Errorf("Failed to encode usage report: %v", err)
+				continue
+			}
+			fullfile := filepath.Join(folder,
+				fmt.Sprintf("usage-report-%d.json", rep.PeriodEnd))
+			if err = ioutil.WriteFile(fullfile, j, 0644); err != nil {
+				log.Errorf("Failed to write usage report: %v", err)
+				continue
+			}
+			signStoredFile(fullfile)
+			log.Infof("Wrote usage report for %d owners to %s",
+				len(rep.Usage), fullfile)
+		case <-quit:
+			log.Debugf("Quitting usage reporter.")
+			return
+		}
+	}
+}
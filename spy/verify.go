@@ -0,0 +1,73 @@
+// verify.go implements the verify command, which checks the signatures of
+// files exported by a dcrspy instance with a signing key (see signing.go).
+//
+// Usage: dcrspy verify --pubkey HEX [--sig SIGFILE] FILE [FILE ...]
+
+package spy
+
+import (
+	"fmt"
+	"os"
+
+	flags "github.com/btcsuite/go-flags"
+)
+
+// verifyOptions are the options for the verify command.
+type verifyOptions struct {
+	PubKey  string `long:"pubkey" description:"Hex-encoded Ed25519 public key of the dcrspy instance"`
+	KeyFile string `long:"keyfile" description:"Use the public key of the private key in this file (the signingkey file) instead of --pubkey"`
+	Sig     string `long:"sig" description:"Signature file (default FILE.sig). Only valid with a single FILE."`
+}
+
+// VerifyMain is the entry point for the verify command.  args are the command
+// line arguments following "verify".  The return value is the exit code: 0 if
+// all signatures are valid, 2 otherwise.
+func VerifyMain(args []string) int {
+	var opts verifyOptions
+	parser := flags.NewParser(&opts, flags.HelpFlag)
+	parser.Usage = "verify [OPTIONS] FILE [FILE ...]"
+	files, err := parser.ParseArgs(args)
+	if err != nil {
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			parser.WriteHelp(os.Stdout)
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(files) == 0 || (opts.Sig != "" && len(files) > 1) {
+		parser.WriteHelp(os.Stderr)
+		return 1
+	}
+
+	pubKey := opts.PubKey
+	if opts.KeyFile != "" {
+		signer, err := loadSigningKey(opts.KeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load key: %v\n", err)
+			return 1
+		}
+		pubKey = signer.publicKey()
+	}
+	if pubKey == "" {
+		fmt.Fprintln(os.Stderr, "One of --pubkey or --keyfile is required.")
+		return 1
+	}
+
+	exitCode := 0
+	for _, f := range files {
+		valid, err := VerifyFile(pubKey, f, opts.Sig)
+		switch {
+		case err != nil:
+			fmt.Printf("%s: ERROR (%v)\n", f, err)
+			exitCode = 2
+		case !valid:
+			fmt.Printf("%s: INVALID\n", f)
+			exitCode = 2
+		default:
+			fmt.Printf("%s: OK\n", f)
+		}
+	}
+	return exitCode
+}
@@ -0,0 +1,246 @@
+// voteestimate.go estimates, for each of the wallet's tickets, the
+// probability that it votes before it expires and its expected vote time.  A
+// live ticket is chosen to vote in each block with probability
+// TicketsPerBlock/poolsize, so the number of blocks until it votes is
+// geometric, truncated by its expiry.  The estimates are updated with each
+// block's stake info, served by the tickets API, and an alert is sent when a
+// ticket nears expiry without having voted.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrrpcclient"
+)
+
+// Event type for wallet ticket events, and its action.
+const (
+	eventTypeTicket         = "ticket"
+	eventActionTicketExpiry = "nearexpiry"
+)
+
+// Ticket statuses of ticketEstimate.
+const (
+	ticketStatusUnmined  = "unmined"
+	ticketStatusImmature = "immature"
+	ticketStatusLive     = "live"
+)
+
+// ticketEstimate is the vote estimate for a ticket.  The block and time
+// estimates are zero for unmined tickets.
+type ticketEstimate struct {
+	Ticket           string  `json:"ticket"`
+	Status           string  `json:"status"`
+	PurchaseHeight   int64   `json:"purchaseheight,omitempty"`
+	BlocksToExpiry   int64   `json:"blockstoexpiry,omitempty"`
+	VoteProbability  float64 `json:"voteprobability"`
+	ExpiryRisk       float64 `json:"expiryrisk"`
+	ExpectedBlocks   float64 `json:"expectedblocks,omitempty"`
+	ExpectedVoteTime int64   `json:"expectedvotetime,omitempty"`
+}
+
+// voteEstimate returns the probability that a ticket votes within the
+// remaining eligible blocks, given a per-block selection probability p, and
+// the expected number of blocks until it votes if it does.
+func voteEstimate(p float64, remaining int64) (prob, expected float64) {
+	if p <= 0 || remaining <= 0 {
+		return 0, 0
+	}
+	if p >= 1 {
+		return 1, 1
+	}
+	// q^R, the probability of not being chosen in R blocks
+	qR := math.Pow(1-p, float64(remaining))
+	prob = 1 - qR
+	// The mean of the geometric distribution truncated at R blocks.
+	expected = 1/p - float64(remaining)*qR/prob
+	return prob, expected
+}
+
+// ticketVoteEstimator maintains the estimates for the wallet's tickets.
+type ticketVoteEstimator struct {
+	mtx    sync.Mutex
+	wallet *dcrrpcclient.Client
+	// alertBlocks is the number of blocks before expiry at which an alert is
+	// sent, 0 to disable alerts.
+	alertBlocks int64
+	// heights caches the mined heights of tickets.
+	heights   map[string]int64
+	alerted   map[string]bool
+	estimates []*ticketEstimate
+}
+
+// spyTicketEstimator is the package-level ticket vote estimator, nil if stake
+// info is not monitored.
+var spyTicketEstimator *ticketVoteEstimator
+
+// newTicketVoteEstimator creates a ticketVoteEstimator that looks up tickets
+// with the wallet.
+func newTicketVoteEstimator(wallet *dcrrpcclient.Client,
+	alertBlocks int64) *ticketVoteEstimator {
+	return &ticketVoteEstimator{
+		wallet:      wallet,
+		alertBlocks: alertBlocks,
+		heights:     make(map[string]int64),
+		alerted:     make(map[string]bool),
+	}
+}
+
+// purchaseHeight returns the height at which a ticket was mined, or 0 if it
+// is not yet mined.
+func (v *ticketVoteEstimator) purchaseHeight(ticket string,
+	height int64) (int64, error) {
+	if h, ok := v.heights[ticket]; ok {
+		return h, nil
+	}
+	hash, err := chainhash.NewHashFromStr(ticket)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := v.wallet.GetTransaction(hash)
+	if err != nil {
+		return 0, err
+	}
+	if tx.Confirmations <= 0 {
+		return 0, nil
+	}
+	h := height - tx.Confirmations + 1
+	v.heights[ticket] = h
+	return h, nil
+}
+
+// update recomputes the estimates for the tickets in the stake info data.
+func (v *ticketVoteEstimator) update(data *stakeInfoData) {
+	if v == nil || data.stakeinfo == nil {
+		return
+	}
+	height := int64(data.height)
+	poolSize := float64(data.stakeinfo.PoolSize)
+	var p float64
+	if poolSize > 0 {
+		p = float64(activeChain.TicketsPerBlock) / poolSize
+	}
+	maturity := int64(activeChain.TicketMaturity)
+	expiry := int64(activeChain.TicketExpiry)
+	blockTime := activeChain.TargetTimePerBlock
+	now := time.Now()
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	current := make(map[string]bool, len(data.tickets))
+	estimates := make([]*ticketEstimate, 0, len(data.tickets))
+	for _, ticket := range data.tickets {
+		current[ticket] = true
+		mined, err := v.purchaseHeight(ticket, height)
+		if err != nil {
+			log.Warnf("Unable to look up ticket %s: %v", ticket, err)
+			continue
+		}
+		est := &ticketEstimate{Ticket: ticket, Status: ticketStatusUnmined}
+		estimates = append(estimates, est)
+		if mined == 0 {
+			continue
+		}
+
+		// A ticket may vote from maturity until expiry.
+		est.PurchaseHeight = mined
+		wait := mined + maturity - height
+		remaining := expiry
+		if wait > 0 {
+			est.Status = ticketStatusImmature
+		} else {
+			est.Status = ticketStatusLive
+			remaining = mined + maturity + expiry - height
+			wait = 0
+		}
+		est.BlocksToExpiry = wait + remaining
+		prob, expected := voteEstimate(p, remaining)
+		est.VoteProbability = prob
+		est.ExpiryRisk = 1 - prob
+		if prob > 0 {
+			est.ExpectedBlocks = float64(wait) + expected
+			est.ExpectedVoteTime = now.Add(time.Duration(est.ExpectedBlocks *
+				float64(blockTime))).Unix()
+		}
+
+		if est.Status == ticketStatusLive && v.alertBlocks > 0 &&
+			est.BlocksToExpiry <= v.alertBlocks && !v.alerted[ticket] {
+			v.alerted[ticket] = true
+			sendAlert("ticket near expiry", "Ticket %s has not voted and "+
+				"expires in %d blocks (%.1f%% chance to vote before).",
+				ticket, est.BlocksToExpiry, 100*prob)
+			e := &spyEvent{
+				Type:   eventTypeTicket,
+				Action: eventActionTicketExpiry,
+				Height: height,
+				TxID:   ticket,
+				Message: fmt.Sprintf("Ticket has not voted and expires in "+
+					"%d blocks.", est.BlocksToExpiry),
+			}
+			publishEvent(e)
+		}
+	}
+
+	// Forget tickets that voted or were revoked.
+	for ticket := range v.heights {
+		if !current[ticket] {
+			delete(v.heights, ticket)
+			delete(v.alerted, ticket)
+		}
+	}
+	sort.Sort(ticketEstimatesByExpiry(estimates))
+	v.estimates = estimates
+}
+
+// ticketEstimatesByExpiry sorts estimates by blocks to expiry, with unmined
+// tickets last.
+type ticketEstimatesByExpiry []*ticketEstimate
+
+func (t ticketEstimatesByExpiry) Len() int { return len(t) }
+func (t ticketEstimatesByExpiry) Less(i, j int) bool {
+	if (t[i].PurchaseHeight == 0) != (t[j].PurchaseHeight == 0) {
+		return t[j].PurchaseHeight == 0
+	}
+	return t[i].BlocksToExpiry < t[j].BlocksToExpiry
+}
+func (t ticketEstimatesByExpiry) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+// ticketsAPI documents ticketsHandler.
+var ticketsAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "Get the vote estimates of the wallet's tickets",
+	response: []*ticketEstimate{},
+}}
+
+// ticketsHandler serves GET /tickets with the estimates for the wallet's
+// tickets, soonest to expire first.
+func (v *ticketVoteEstimator) ticketsHandler(w http.ResponseWriter,
+	r *http.Request, t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The wallet's tickets are the operator's.
+	if t != nil {
+		http.Error(w, "the wallet's tickets are not available to tenants",
+			http.StatusForbidden)
+		return
+	}
+	estimates := []*ticketEstimate{}
+	if v != nil {
+		v.mtx.Lock()
+		estimates = v.estimates
+		v.mtx.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimates)
+}
@@ -0,0 +1,338 @@
+// voteexpect.go checks a voting wallet against registered expectations, for
+// validating a wallet on testnet or simnet before it is pointed at mainnet.
+// When the wallet's tickets are called to vote (winning tickets), each
+// expectation is checked: that the ticket votes, that the vote has the
+// expected vote bits, and that the vote reaches mempool in time.  Deviations
+// are alerted, published as events and summarized by the vote expectations
+// API.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/blockchain/stake"
+	"github.com/decred/dcrd/chaincfg"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrjson"
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+)
+
+// Action for eventTypeTicket events of a deviation from vote expectations.
+const eventActionVoteDeviation = "votedeviation"
+
+// maxVoteDeviations is the number of recent deviations kept for the report.
+const maxVoteDeviations = 100
+
+// voteExpectations are the expectations of the voting wallet.
+type voteExpectations struct {
+	// vote expects every called ticket to vote.
+	vote bool
+	// voteBits, if checkBits, is the expected vote bits of every vote.
+	checkBits bool
+	voteBits  uint16
+	// within, if not zero, is the time after the ticket is called by which
+	// its vote is expected in mempool.
+	within time.Duration
+}
+
+// parseVoteExpectations parses expectations, one of "vote", "votebits=BITS"
+// or "within=DURATION" each.
+func parseVoteExpectations(defs []string) (*voteExpectations, error) {
+	exp := new(voteExpectations)
+	for _, def := range defs {
+		name, value := def, ""
+		if i := strings.Index(def, "="); i >= 0 {
+			name, value = strings.TrimSpace(def[:i]), strings.TrimSpace(def[i+1:])
+		}
+		switch name {
+		case "vote":
+			exp.vote = true
+		case "votebits":
+			bits, err := strconv.ParseUint(value, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid vote bits %q: %v", value, err)
+			}
+			exp.checkBits, exp.voteBits = true, uint16(bits)
+		case "within":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid duration %q", value)
+			}
+			exp.within = d
+		default:
+			return nil, fmt.Errorf("unknown vote expectation %q", def)
+		}
+	}
+	return exp, nil
+}
+
+// String lists the expectations.
+func (exp *voteExpectations) String() string {
+	var s []string
+	if exp.vote {
+		s = append(s, "vote")
+	}
+	if exp.checkBits {
+		s = append(s, fmt.Sprintf("votebits=%#04x", exp.voteBits))
+	}
+	if exp.within > 0 {
+		s = append(s, fmt.Sprintf("within=%v", exp.within))
+	}
+	return strings.Join(s, ", ")
+}
+
+// calledTicket is a wallet ticket called to vote on a block.
+type calledTicket struct {
+	ticket chainhash.Hash
+	block  chainhash.Hash
+	height int64
+}
+
+// voteDeviation is a deviation from the expectations.  Height is the height
+// of the block the ticket was called to vote on.
+type voteDeviation struct {
+	Time   int64  `json:"time"`
+	Ticket string `json:"ticket"`
+	Height int64  `json:"height"`
+	Reason string `json:"reason"`
+}
+
+// voteExpectReport summarizes the checks since dcrspy started.
+type voteExpectReport struct {
+	Expectations string           `json:"expectations"`
+	Since        int64            `json:"since"`
+	Called       int              `json:"called"`
+	Voted        int              `json:"voted"`
+	Deviations   int              `json:"deviations"`
+	Recent       []*voteDeviation `json:"recent"`
+}
+
+// voteExpectChecker checks the wallet's votes against the expectations.
+type voteExpectChecker struct {
+	mtx    sync.Mutex
+	dcrd   *dcrrpcclient.Client
+	wallet *dcrrpcclient.Client
+	exp    *voteExpectations
+	// pending are the called tickets whose votes are not yet mined.
+	pending map[chainhash.Hash]*calledTicket
+	report  voteExpectReport
+}
+
+// spyVoteExpect is the package-level vote expectation checker, nil if no
+// expectations are registered.
+var spyVoteExpect *voteExpectChecker
+
+// newVoteExpectChecker creates a voteExpectChecker for the expectations
+// defined by defs.  Expectations may not be registered on mainnet.
+func newVoteExpectChecker(dcrd, wallet *dcrrpcclient.Client,
+	defs []string) (*voteExpectChecker, error) {
+	if activeChain == &chaincfg.MainNetParams {
+		return nil, fmt.Errorf("vote expectations are for testnet and " +
+			"simnet wallets")
+	}
+	if wallet == nil {
+		return nil, fmt.Errorf("vote expectations require a wallet " +
+			"connection")
+	}
+	exp, err := parseVoteExpectations(defs)
+	if err != nil {
+		return nil, err
+	}
+	return &voteExpectChecker{
+		dcrd:    dcrd,
+		wallet:  wallet,
+		exp:     exp,
+		pending: make(map[chainhash.Hash]*calledTicket),
+		report: voteExpectReport{
+			Expectations: exp.String(),
+			Since:        time.Now().Unix(),
+			Recent:       []*voteDeviation{},
+		},
+	}, nil
+}
+
+// winningTickets records the wallet's tickets among those called to vote on
+// the block.  It looks up the wallet's tickets in a goroutine, so it does not
+// block the notification handler.
+func (v *voteExpectChecker) winningTickets(block *chainhash.Hash, height int64,
+	tickets []*chainhash.Hash) {
+	if v == nil {
+		return
+	}
+	go func() {
+		live, err := v.wallet.GetTickets(false)
+		if err != nil {
+			log.Errorf("Unable to get wallet tickets: %v", err)
+			return
+		}
+		own := make(map[chainhash.Hash]bool, len(live))
+		for _, t := range live {
+			own[*t] = true
+		}
+
+		v.mtx.Lock()
+		defer v.mtx.Unlock()
+		for _, t := range tickets {
+			if !own[*t] {
+				continue
+			}
+			log.Infof("Wallet ticket %v called to vote on block %d.", t,
+				height)
+			ticket := *t
+			v.pending[ticket] = &calledTicket{ticket, *block, height}
+			v.report.Called++
+			if v.exp.within > 0 {
+				time.AfterFunc(v.exp.within, func() { v.checkMempool(ticket) })
+			}
+		}
+	}()
+}
+
+// blockConnected checks the votes in the block for the called tickets.  The
+// called tickets whose votes are not in the block that extends the block they
+// were called for missed their vote.
+func (v *voteExpectChecker) blockConnected(block *dcrutil.Block) {
+	if v == nil {
+		return
+	}
+	msgBlock := block.MsgBlock()
+	height := block.Height()
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	for _, tx := range msgBlock.STransactions {
+		if ok, _ := stake.IsSSGen(tx); !ok {
+			continue
+		}
+		ticket := tx.TxIn[1].PreviousOutPoint.Hash
+		c, ok := v.pending[ticket]
+		if !ok {
+			continue
+		}
+		votedOn, _, err := stake.SSGenBlockVotedOn(tx)
+		if err != nil || votedOn != c.block {
+			continue
+		}
+		delete(v.pending, ticket)
+		v.report.Voted++
+		bits := stake.SSGenVoteBits(tx)
+		if v.exp.checkBits && bits != v.exp.voteBits {
+			v.deviation(c, fmt.Sprintf("voted with vote bits %#04x, expected "+
+				"%#04x", bits, v.exp.voteBits))
+		}
+	}
+
+	for ticket, c := range v.pending {
+		switch {
+		case c.block == msgBlock.Header.PrevBlock:
+			delete(v.pending, ticket)
+			if v.exp.vote {
+				v.deviation(c, fmt.Sprintf("did not vote, block %d was "+
+					"mined without its vote", height))
+			}
+		case c.height < height-1:
+			// The block it was called for was reorganized out.
+			delete(v.pending, ticket)
+		}
+	}
+}
+
+// checkMempool checks that the vote of a called ticket is in mempool, unless
+// it was already mined.
+func (v *voteExpectChecker) checkMempool(ticket chainhash.Hash) {
+	v.mtx.Lock()
+	c, ok := v.pending[ticket]
+	v.mtx.Unlock()
+	if !ok {
+		return
+	}
+
+	voteHashes, err := v.dcrd.GetRawMempool(dcrjson.GRMVotes)
+	if err != nil {
+		log.Errorf("Unable to get mempool votes: %v", err)
+		return
+	}
+	for _, h := range voteHashes {
+		tx, err := v.dcrd.GetRawTransaction(h)
+		if err != nil {
+			log.Debugf("Unable to get vote %v: %v", h, err)
+			continue
+		}
+		msgTx := tx.MsgTx()
+		if len(msgTx.TxIn) > 1 && msgTx.TxIn[1].PreviousOutPoint.Hash == ticket {
+			return
+		}
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if _, ok = v.pending[ticket]; ok {
+		v.deviation(c, fmt.Sprintf("vote not in mempool %v after the "+
+			"ticket was called", v.exp.within))
+	}
+}
+
+// deviation records and alerts a deviation.  The mutex must be held.
+func (v *voteExpectChecker) deviation(c *calledTicket, reason string) {
+	d := &voteDeviation{
+		Time:   time.Now().Unix(),
+		Ticket: c.ticket.String(),
+		Height: c.height,
+		Reason: reason,
+	}
+	v.report.Deviations++
+	v.report.Recent = append(v.report.Recent, d)
+	if len(v.report.Recent) > maxVoteDeviations {
+		v.report.Recent = v.report.Recent[1:]
+	}
+
+	sendAlert("vote expectation", "Ticket %s called for block %d %s.",
+		d.Ticket, d.Height, reason)
+	publishEvent(&spyEvent{
+		Time:    d.Time,
+		Type:    eventTypeTicket,
+		Action:  eventActionVoteDeviation,
+		Height:  d.Height,
+		TxID:    d.Ticket,
+		Message: fmt.Sprintf("Ticket %s.", reason),
+	})
+}
+
+// voteExpectAPI documents voteExpectHandler.
+var voteExpectAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "Get the report of the voting wallet's expected votes",
+	response: voteExpectReport{},
+}}
+
+// voteExpectHandler serves GET /voteexpect with the report of the checks.
+func (v *voteExpectChecker) voteExpectHandler(w http.ResponseWriter,
+	r *http.Request, t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if t != nil {
+		http.Error(w, "the wallet's votes are not available to tenants",
+			http.StatusForbidden)
+		return
+	}
+	if v == nil {
+		http.Error(w, "no vote expectations registered", http.StatusNotFound)
+		return
+	}
+	v.mtx.Lock()
+	report := v.report
+	report.Recent = append([]*voteDeviation{}, v.report.Recent...)
+	v.mtx.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&report)
+}
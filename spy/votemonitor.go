@@ -0,0 +1,152 @@
+// votemonitor.go watches the votes (SSGen) in mempool for each new block as
+// an early warning of network-wide voting problems.  A block can only be built
+// upon with votes from a majority of the tickets called to vote on it, so when
+// few votes for the tip appear in mempool soon after it is connected, the
+// chain may stall.
+
+package spy
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/blockchain/stake"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrjson"
+	"github.com/decred/dcrrpcclient"
+)
+
+// Actions for eventTypeChain events from the vote monitor.
+const (
+	eventActionFewVotes          = "fewvotes"
+	eventActionInsufficientVotes = "insufficientvotes"
+)
+
+// mempoolVoteMonitor counts the mempool votes for each new block.
+type mempoolVoteMonitor struct {
+	mtx  sync.Mutex
+	dcrd *dcrrpcclient.Client
+	wait time.Duration
+	// tip is the last connected block.
+	tip chainhash.Hash
+	// lastCount is the number of votes for the last checked block.
+	lastCount int
+}
+
+// spyVoteMonitor is the package-level mempool vote monitor, nil if not
+// enabled.
+var spyVoteMonitor *mempoolVoteMonitor
+
+// newMempoolVoteMonitor creates a mempoolVoteMonitor that counts the votes
+// for a block wait after it is connected.
+func newMempoolVoteMonitor(dcrd *dcrrpcclient.Client,
+	wait time.Duration) *mempoolVoteMonitor {
+	m := &mempoolVoteMonitor{
+		dcrd:      dcrd,
+		wait:      wait,
+		lastCount: -1,
+	}
+	spyMetrics.newGauge("dcrspy_mempool_votes",
+		"Votes in mempool for the last block, counted votewait after it "+
+			"was connected.", func() float64 {
+			m.mtx.Lock()
+			defer m.mtx.Unlock()
+			if m.lastCount < 0 {
+				return math.NaN()
+			}
+			return float64(m.lastCount)
+		})
+	return m
+}
+
+// blockConnected schedules the vote count for the block.
+func (m *mempoolVoteMonitor) blockConnected(hash *chainhash.Hash,
+	height int64) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	m.tip = *hash
+	m.mtx.Unlock()
+
+	time.AfterFunc(m.wait, func() { m.check(*hash, height) })
+}
+
+// check counts the mempool votes for the block, alerting if there are fewer
+// than the number of tickets called to vote, or fewer than a majority.
+func (m *mempoolVoteMonitor) check(hash chainhash.Hash, height int64) {
+	m.mtx.Lock()
+	superseded := m.tip != hash
+	m.mtx.Unlock()
+	// Once the next block is connected, the votes were mined with it.  If the
+	// block was reorganized out, its votes no longer matter.
+	if superseded {
+		return
+	}
+
+	votes, err := countMempoolVotes(m.dcrd, hash)
+	if err != nil {
+		log.Errorf("Unable to count mempool votes for block %d: %v", height,
+			err)
+		return
+	}
+	m.mtx.Lock()
+	m.lastCount = votes
+	m.mtx.Unlock()
+
+	perBlock := int(activeChain.TicketsPerBlock)
+	majority := perBlock/2 + 1
+	log.Debugf("%d of %d votes for block %d in mempool after %v.", votes,
+		perBlock, height, m.wait)
+	if votes >= perBlock {
+		return
+	}
+
+	e := &spyEvent{
+		Type:   eventTypeChain,
+		Action: eventActionFewVotes,
+		Height: height,
+	}
+	if votes < majority {
+		e.Action = eventActionInsufficientVotes
+		e.Message = fmt.Sprintf("Only %d votes for block %d (%v) in mempool "+
+			"after %v, fewer than the %d required to extend the chain.",
+			votes, height, hash, m.wait, majority)
+		sendCriticalAlert("insufficient votes", e)
+		return
+	}
+	e.Message = fmt.Sprintf("Only %d of %d votes for block %d (%v) in "+
+		"mempool after %v.", votes, perBlock, height, hash, m.wait)
+	sendAlert("few votes", "%s", e.Message)
+	publishEvent(e)
+	spyGrafana.annotate(e)
+}
+
+// countMempoolVotes returns the number of votes in mempool for the block.
+func countMempoolVotes(dcrd *dcrrpcclient.Client,
+	block chainhash.Hash) (int, error) {
+	voteHashes, err := dcrd.GetRawMempool(dcrjson.GRMVotes)
+	if err != nil {
+		return 0, err
+	}
+	var votes int
+	for _, h := range voteHashes {
+		tx, err := dcrd.GetRawTransaction(h)
+		if err != nil {
+			// The vote may have been mined or removed meanwhile.
+			log.Debugf("Unable to get vote %v: %v", h, err)
+			continue
+		}
+		votedOn, _, err := stake.SSGenBlockVotedOn(tx.MsgTx())
+		if err != nil {
+			log.Warnf("Unable to decode vote %v: %v", h, err)
+			continue
+		}
+		if votedOn == block {
+			votes++
+		}
+	}
+	return votes, nil
+}
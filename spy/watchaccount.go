@@ -0,0 +1,192 @@
+// watchaccount.go watches the addresses of dcrwallet accounts.  The addresses
+// of each account are added to the watched addresses at startup, and the
+// account is synced periodically so that addresses the wallet generates later
+// are watched too.  The importaccount command instead prints the addresses of
+// accounts as watchaddress lines for the config file.
+//
+// Usage: dcrspy importaccount --account=ACCOUNT[,ACTION] ... [dcrspy OPTIONS]
+
+package spy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	flags "github.com/btcsuite/go-flags"
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+)
+
+// accountSyncInterval is the interval between syncs of the watched accounts.
+const accountSyncInterval = time.Minute
+
+// watchedAccount is a wallet account whose addresses are watched with the
+// email action.
+type watchedAccount struct {
+	name   string
+	action TxAction
+}
+
+// parseWatchedAccount parses ACCOUNT[,POLICY], where POLICY is the
+// notification policy of watchaddress.  Account names may contain commas, so
+// a suffix that is not a policy is part of the name.
+func parseWatchedAccount(s string) watchedAccount {
+	if i := strings.LastIndex(s, ","); i >= 0 {
+		if actn, err := parseTxAction(s[i+1:]); err == nil {
+			return watchedAccount{s[:i], actn}
+		}
+	}
+	return watchedAccount{s, 0}
+}
+
+// accountWatcher adds the addresses of wallet accounts to the watched
+// addresses.
+type accountWatcher struct {
+	wallet   *dcrrpcclient.Client
+	dcrd     *dcrrpcclient.Client
+	watched  *watchedAddresses
+	accounts []watchedAccount
+}
+
+// newAccountWatcher creates an accountWatcher for the accounts, each given as
+// ACCOUNT[,ACTION].
+func newAccountWatcher(wallet, dcrd *dcrrpcclient.Client,
+	watched *watchedAddresses, accounts []string) *accountWatcher {
+	w := &accountWatcher{
+		wallet:  wallet,
+		dcrd:    dcrd,
+		watched: watched,
+	}
+	for _, a := range accounts {
+		w.accounts = append(w.accounts, parseWatchedAccount(a))
+	}
+	return w
+}
+
+// sync watches the accounts' addresses that are not yet watched, adding them
+// to dcrd's transaction filter for mempool notifications and backfilling
+// their history.
+func (w *accountWatcher) sync() error {
+	var added []dcrutil.Address
+	for _, acct := range w.accounts {
+		addrs, err := w.wallet.GetAddressesByAccount(acct.name)
+		if err != nil {
+			return fmt.Errorf("unable to get addresses of account %q: %v",
+				acct.name, err)
+		}
+		for _, addr := range addrs {
+			a := addr.EncodeAddress()
+			if w.watched.watches(operatorOwner, a) {
+				continue
+			}
+			isNew, _ := w.watched.add(operatorOwner, a, acct.action, 0)
+			if isNew {
+				added = append(added, addr)
+			}
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	if err := w.dcrd.LoadTxFilter(false, added, nil); err != nil {
+		for _, addr := range added {
+			w.watched.remove(operatorOwner, addr.EncodeAddress())
+		}
+		return err
+	}
+	for _, addr := range added {
+		spyAddrHistory.requestBackfill(addr.EncodeAddress())
+	}
+	log.Infof("Watching %d new addresses of wallet accounts.", len(added))
+	return nil
+}
+
+// run syncs the accounts every accountSyncInterval until quit is closed.  It
+// should be run as a goroutine.
+func (w *accountWatcher) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(accountSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.sync(); err != nil {
+				log.Errorf("Failed to sync watched accounts: %v", err)
+				spyRegistrationErrors.record("wallet accounts", "", err)
+			}
+		case <-quit:
+			log.Debugf("Quitting account watcher.")
+			return
+		}
+	}
+}
+
+// importAccountOptions are the options for the importaccount command.
+type importAccountOptions struct {
+	Accounts []string `long:"account" description:"Wallet account to import, as ACCOUNT[,ACTION] with the email action of watchaddress. May be repeated." required:"true"`
+}
+
+// ImportAccountMain is the entry point for the importaccount command.  args
+// are the command line arguments following "importaccount".  A watchaddress
+// line is printed for each address of the accounts, for the config file.  The
+// return value is the exit code.
+func ImportAccountMain(args []string) int {
+	var opts importAccountOptions
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.IgnoreUnknown)
+	parser.Usage = "importaccount --account=ACCOUNT[,ACTION] ... [dcrspy OPTIONS]"
+	remaining, err := parser.ParseArgs(args)
+	if err != nil {
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			parser.WriteHelp(os.Stdout)
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return 1
+	}
+
+	// Everything else is a regular option (e.g. --dcrwserv or --testnet).
+	os.Args = append([]string{os.Args[0]}, remaining...)
+	cfg, err := LoadConfig()
+	if err == ErrInfoShown {
+		return 0
+	}
+	if err != nil {
+		fmt.Printf("Failed to load dcrspy config: %s\n", err.Error())
+		return 1
+	}
+	defer backendLog.Flush()
+
+	wallet, _, err := connectWalletRPC(cfg)
+	if err != nil {
+		fmt.Printf("Connection to dcrwallet failed: %v\n", err)
+		return 2
+	}
+	defer wallet.Shutdown()
+
+	for _, a := range opts.Accounts {
+		acct := parseWatchedAccount(a)
+		addrs, err := wallet.GetAddressesByAccount(acct.name)
+		if err != nil {
+			fmt.Printf("Unable to get addresses of account %q: %v\n",
+				acct.name, err)
+			return 3
+		}
+		fmt.Printf("; Account %s\n", acct.name)
+		for _, addr := range addrs {
+			if acct.action != 0 {
+				fmt.Printf("watchaddress=%s,%d\n", addr.EncodeAddress(),
+					acct.action)
+				continue
+			}
+			fmt.Printf("watchaddress=%s\n", addr.EncodeAddress())
+		}
+	}
+	return 0
+}
@@ -1,6 +1,6 @@
 // Watch for transactions receiving to or sending from certain addresses.
 // Receiving works, sending is probably messed up.
-package main
+package spy
 
 import (
 	"fmt"
@@ -54,14 +54,18 @@ func tryGetRawTransactionVerbose(c *dcrrpcclient.Client, txh *chainhash.Hash,
 	}
 }
 
+// watchAddrWatchdog tracks the progress of the watched address handler.
+var watchAddrWatchdog = newWatchdog(func() int {
+	return len(spyChans.recvTxBlockChan) + len(spyChans.relevantTxMempoolChan)
+})
+
 // handleReceivingTx should be run as a go routine, and handles notification of
-// transactions receiving to a registered address.  If no email notification is
-// required, emailConf may be a nil pointer.  addrs is a map of addresses as
-// strings with TxAction values indicating if email should be sent in response
-// to transactions involving the keyed address.
-func handleReceivingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
-	emailConf *EmailConfig, wg *sync.WaitGroup,
-	quit <-chan struct{}) {
+// transactions receiving to a registered address.  addrs is the set of watched
+// addresses, with TxAction values indicating if notifications should be sent,
+// with the registered notifiers, in response to transactions involving each
+// address.
+func handleReceivingTx(c *dcrrpcclient.Client, addrs *watchedAddresses,
+	wg *sync.WaitGroup, quit <-chan struct{}) {
 	defer wg.Done()
 	//out:
 	for {
@@ -69,6 +73,7 @@ func handleReceivingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
 		select {
 		// The message with all tx for watched addresses in new block
 		case blockWatchedTxs, ok := <-spyChans.recvTxBlockChan:
+			watchAddrWatchdog.progressed()
 			txsByAddr := blockWatchedTxs.TxsForAddress
 			// map[string][]*dcrutil.Tx is a map of addresses to slices of
 			// transactions using that address.
@@ -76,13 +81,18 @@ func handleReceivingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
 				log.Infof("Receive-Tx-in-block watch channel closed")
 				return
 			}
+			// Height is now in the message
+			height := blockWatchedTxs.BlockHeight
+			// The notified stage of the block is done when its notifications
+			// have been delivered.
+			deliveries := newBlockDeliveries(height)
 			if len(txsByAddr) == 0 {
+				deliveries.done()
+				emailBlockNotified(height)
+				spyInactivity.blockNotified(height)
 				break receive
 			}
 
-			// Height is now in the message
-			height := blockWatchedTxs.BlockHeight
-
 			// For each address in map, process each tx
 			for addr, txs := range txsByAddr {
 				if len(txs) == 0 {
@@ -93,9 +103,7 @@ func handleReceivingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
 					txHash := tx.Hash().String()
 					// Check the addresses associated with the PkScript of each TxOut
 					for outID, txOut := range tx.MsgTx().TxOut {
-						scriptClass, txAddrs, _, err :=
-							txscript.ExtractPkScriptAddrs(txOut.Version,
-								txOut.PkScript, activeChain)
+						scriptClass, txAddrs, _, err := txOutAddresses(txOut)
 						if err != nil {
 							log.Infof("ExtractPkScriptAddrs: %v", err.Error())
 							// Next TxOut
@@ -106,24 +114,63 @@ func handleReceivingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
 
 						// Check if this is a TxOut for the address
 						for _, txAddr := range txAddrs {
-							//log.Debug(addr, ", ", txAddr.EncodeAddress())
-							if addr != txAddr.EncodeAddress() {
+							if addr != txAddr {
 								// Next address for this TxOut
 								continue
 							}
-							if addrActn, ok := addrs[addr]; ok {
-
-								recvString := fmt.Sprintf("Mined in block %d: "+
-									"%s receiving %.6f DCR, type: %s "+
-									"(%s[out:%d])",
-									height, addr, value, scriptClass.String(),
-									txHash, outID)
-								log.Infof(recvString)
-								// Email notification if watchaddress has a
-								// suffix with the TxMined bit AND emailConf is
-								// non-nil.
-								if (addrActn&TxMined) > 0 && emailConf != nil {
-									EmailMsgChan <- recvString
+							owners := addrs.owners(addr)
+							if len(owners) == 0 {
+								continue
+							}
+
+							recvString := fmt.Sprintf("Mined in block %d: "+
+								"%s receiving %.6f DCR, type: %s "+
+								"(%s[out:%d])",
+								height, addr, value, scriptClass.String(),
+								txHash, outID)
+							log.Infof(recvString)
+							p := spyMempoolState.mined(txHash, outID)
+							if p != nil {
+								log.Debugf("%s[out:%d] confirmed %v after "+
+									"entering mempool.", txHash, outID,
+									time.Since(time.Unix(p.Seen, 0)))
+							}
+							// Each owner of the address gets its own event and
+							// notification.
+							for owner, addrActn := range owners {
+								e := &spyEvent{
+									Type:        eventTypeWatchedAddr,
+									Action:      eventActionMined,
+									Height:      height,
+									Address:     addr,
+									Amount:      value,
+									TxID:        txHash,
+									Vout:        outID,
+									ScriptClass: scriptClass.String(),
+									Message:     recvString,
+									Tenant:      owner,
+								}
+								publishEvent(e)
+								// Notification if the watchaddress policy
+								// notifies mined transactions, and the value
+								// meets notifyminfiat, once it has the
+								// policy's confirmations.
+								if addrActn.mined() &&
+									spyExchangeRate.notifies(value) {
+									// The transaction notified in mempool
+									// gets a compact follow-up.
+									ne := e
+									if p != nil && addrActn.followUp() {
+										followUp := *e
+										followUp.followUp = true
+										ne = &followUp
+									}
+									if confs := addrActn.confirmations(); confs > 1 {
+										spyConfirmations.wait(ne, confs)
+									} else {
+										ne.deliveries = deliveries
+										notifyOwner(ne)
+									}
 								}
 							}
 						}
@@ -131,11 +178,16 @@ func handleReceivingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
 				}
 			}
 
+			deliveries.done()
+			emailBlockNotified(height)
+			spyInactivity.blockNotified(height)
+
 		case tx, ok := <-spyChans.relevantTxMempoolChan:
 			if !ok {
 				log.Infof("Receive-Tx watch channel closed")
 				return
 			}
+			watchAddrWatchdog.progressed()
 
 			// Make like notifyForTxOuts and screen the transactions TxOuts for
 			// addresses we are watching for.
@@ -150,9 +202,8 @@ func handleReceivingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
 			txHash := tx.Hash().String()
 
 			// Check the addresses associated with the PkScript of each TxOut
-			for _, txOut := range tx.MsgTx().TxOut {
-				_, txAddrs, _, err := txscript.ExtractPkScriptAddrs(txOut.Version,
-					txOut.PkScript, activeChain)
+			for outID, txOut := range tx.MsgTx().TxOut {
+				scriptClass, txAddrs, _, err := txOutAddresses(txOut)
 				if err != nil {
 					log.Infof("ExtractPkScriptAddrs: %v", err.Error())
 					continue
@@ -161,20 +212,46 @@ func handleReceivingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
 				value := dcrutil.Amount(txOut.Value).ToCoin()
 
 				// Check if we are watching any address for this TxOut
-				for _, txAddr := range txAddrs {
-					addrstr := txAddr.EncodeAddress()
-					if addrActn, ok := addrs[addrstr]; ok {
-						recvString := fmt.Sprintf("Inserted into mempool: %s "+
-							"receiving %.6f, best block: %d (%s)",
-							addrstr, value, height, txHash)
-						log.Infof(recvString)
-						// Email notification if watchaddress has a suffix with
-						// the TxInserted bit AND we have a non-nil *emailConfig
-						if (addrActn&TxInserted) > 0 && emailConf != nil {
-							EmailMsgChan <- recvString
-						}
+				for _, addrstr := range txAddrs {
+					owners := addrs.owners(addrstr)
+					if len(owners) == 0 {
+						continue
+					}
+					recvString := fmt.Sprintf("Inserted into mempool: %s "+
+						"receiving %.6f, best block: %d (%s)",
+						addrstr, value, height, txHash)
+					// A transaction is notified once, although it may be
+					// received again, e.g. from the startup mempool rescan.
+					if !spyMempoolState.addPending(txHash, outID, addrstr,
+						value, int64(height)) ||
+						!spyBolt.markSeen(txHash, outID) {
+						log.Debugf("%s[out:%d] already notified.", txHash,
+							outID)
 						continue
 					}
+					log.Infof(recvString)
+					for owner, addrActn := range owners {
+						e := &spyEvent{
+							Type:        eventTypeWatchedAddr,
+							Action:      eventActionMempool,
+							Height:      int64(height),
+							Address:     addrstr,
+							Amount:      value,
+							TxID:        txHash,
+							Vout:        outID,
+							ScriptClass: scriptClass.String(),
+							Message:     recvString,
+							Tenant:      owner,
+						}
+						publishEvent(e)
+						// Notification if the watchaddress policy notifies
+						// mempool transactions, and the value meets
+						// notifyminfiat
+						if addrActn.mempool() &&
+							spyExchangeRate.notifies(value) {
+							notifyOwner(e)
+						}
+					}
 				}
 			}
 
@@ -186,13 +263,68 @@ func handleReceivingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
 
 }
 
+// rescanMempool scans the transactions in mempool for watched addresses, and
+// sends those paying to them to the mempool handler, so that the transactions
+// broadcast while dcrspy was stopped, but not yet mined, are notified.  Those
+// already notified before a restart are in the restored mempool state and are
+// not notified again.  It should be run as a goroutine after handleReceivingTx
+// is started.
+func rescanMempool(c *dcrrpcclient.Client, addrs *watchedAddresses,
+	wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	txHashes, err := c.GetRawMempool(dcrjson.GRMAll)
+	if err != nil {
+		log.Errorf("Unable to get mempool to rescan for watched addresses: %v",
+			err)
+		return
+	}
+
+	var found int
+	for _, txHash := range txHashes {
+		tx, err := c.GetRawTransaction(txHash)
+		if err != nil {
+			// It may have been mined or dropped since.
+			log.Debugf("Failed to get mempool transaction %v: %v", txHash, err)
+			continue
+		}
+		if !paysWatchedAddress(tx, addrs) {
+			continue
+		}
+		found++
+		select {
+		case spyChans.relevantTxMempoolChan <- tx:
+		case <-quit:
+			return
+		}
+	}
+	log.Infof("Rescanned %d mempool transactions: %d pay to watched addresses.",
+		len(txHashes), found)
+}
+
+// paysWatchedAddress checks if any output of the transaction pays to a watched
+// address.
+func paysWatchedAddress(tx *dcrutil.Tx, addrs *watchedAddresses) bool {
+	for _, txOut := range tx.MsgTx().TxOut {
+		_, txAddrs, _, err := txOutAddresses(txOut)
+		if err != nil {
+			continue
+		}
+		for _, addr := range txAddrs {
+			if addrs.isWatched(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // handleSendingTx is DEAD
 
 // Rather than watching for the sending address, which isn't known ahead of
 // time, watch for a transaction with an input (source) whos previous outpoint
 // is one of the watched addresses.
 // But I am not sure we can do that here with the Tx and BlockDetails provided.
-func handleSendingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
+func handleSendingTx(c *dcrrpcclient.Client, addrs *watchedAddresses,
 	spendTxChan <-chan *watchedAddrTx, wg *sync.WaitGroup,
 	quit <-chan struct{}) {
 	defer wg.Done()
@@ -257,7 +389,7 @@ func handleSendingTx(c *dcrrpcclient.Client, addrs map[string]TxAction,
 
 					for _, txAddr := range txAddrs {
 						addrstr := txAddr.EncodeAddress()
-						if _, ok := addrs[addrstr]; ok {
+						if addrs.isWatched(addrstr) {
 							log.Infof("Transaction with watched address %v as previous outpoint (spending), value %.6f, %v",
 								addrstr, dcrutil.Amount(txOut.Value).ToCoin(), action)
 							continue
@@ -0,0 +1,153 @@
+// watchlist.go defines watchedAddresses, the set of watched addresses shared
+// by the block monitor and the transaction handlers.  Addresses may be added
+// or removed while monitoring (e.g. via the control API).
+
+package spy
+
+import (
+	"errors"
+	"sync"
+)
+
+// errWatchQuota is the error of adding an address beyond an owner's quota.
+var errWatchQuota = errors.New("quota of watched addresses reached")
+
+// operatorOwner is the owner of the addresses watched by the dcrspy operator,
+// i.e. those in the config file, or registered with the control API when
+// there are no tenants.
+const operatorOwner = ""
+
+// watchedAddresses maps watched addresses to their owners (the operator or a
+// tenant), and each owner's TxAction flags indicating for which events email
+// should be sent.  It is safe for concurrent use.
+type watchedAddresses struct {
+	mtx   sync.RWMutex
+	addrs map[string]map[string]TxAction
+}
+
+// newWatchedAddresses creates a watchedAddresses with the operator's addresses
+// in addrs.
+func newWatchedAddresses(addrs map[string]TxAction) *watchedAddresses {
+	w := &watchedAddresses{
+		addrs: make(map[string]map[string]TxAction, len(addrs)),
+	}
+	for a, actn := range addrs {
+		w.addrs[a] = map[string]TxAction{operatorOwner: actn}
+	}
+	return w
+}
+
+// isWatched returns true if any owner watches the address.
+func (w *watchedAddresses) isWatched(addr string) bool {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	_, ok := w.addrs[addr]
+	return ok
+}
+
+// owners returns a copy of the owners of the address and their actions.
+func (w *watchedAddresses) owners(addr string) map[string]TxAction {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	owners := make(map[string]TxAction, len(w.addrs[addr]))
+	for o, actn := range w.addrs[addr] {
+		owners[o] = actn
+	}
+	return owners
+}
+
+// add adds or updates the address for the owner, returning true if the
+// address was not previously watched by any owner.  If max is positive, an
+// owner already watching max other addresses may not add another, and
+// errWatchQuota is returned.
+func (w *watchedAddresses) add(owner, addr string, actn TxAction,
+	max int) (bool, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if _, ok := w.addrs[addr][owner]; !ok && max > 0 {
+		var n int
+		for _, owners := range w.addrs {
+			if _, ok := owners[owner]; ok {
+				n++
+			}
+		}
+		if n >= max {
+			return false, errWatchQuota
+		}
+	}
+	owners, existed := w.addrs[addr]
+	if !existed {
+		owners = make(map[string]TxAction)
+		w.addrs[addr] = owners
+	}
+	owners[owner] = actn
+	return !existed, nil
+}
+
+// remove stops watching the address for the owner, returning true if the
+// owner watched it.
+func (w *watchedAddresses) remove(owner, addr string) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	owners := w.addrs[addr]
+	if _, ok := owners[owner]; !ok {
+		return false
+	}
+	delete(owners, owner)
+	if len(owners) == 0 {
+		delete(w.addrs, addr)
+	}
+	return true
+}
+
+// watches returns true if the owner watches the address.
+func (w *watchedAddresses) watches(owner, addr string) bool {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	_, ok := w.addrs[addr][owner]
+	return ok
+}
+
+// count returns the number of watched addresses.
+func (w *watchedAddresses) count() int {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	return len(w.addrs)
+}
+
+// countByOwner returns the number of addresses watched by each owner.
+func (w *watchedAddresses) countByOwner() map[string]int {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	counts := make(map[string]int)
+	for _, owners := range w.addrs {
+		for o := range owners {
+			counts[o]++
+		}
+	}
+	return counts
+}
+
+// list returns the addresses watched by the owner and their actions.
+func (w *watchedAddresses) list(owner string) map[string]TxAction {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	addrs := make(map[string]TxAction)
+	for a, owners := range w.addrs {
+		if actn, ok := owners[owner]; ok {
+			addrs[a] = actn
+		}
+	}
+	return addrs
+}
+
+// all returns all watched addresses.
+func (w *watchedAddresses) all() []string {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	addrs := make([]string, 0, len(w.addrs))
+	for a := range w.addrs {
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
@@ -0,0 +1,189 @@
+// webhookacks.go implements at-least-once delivery for webhook subscriptions
+// in ack mode.  Rather than being queued when published, events are read from
+// the event journal and delivered in order.  The consumer acknowledges events
+// by sequence number, and unacknowledged events are redelivered after the
+// redelivery window.  The last acknowledged sequence number is saved with the
+// subscription, so delivery resumes where it left off after a restart.
+
+package spy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookAckCheckInterval is the interval between checks for events to
+	// deliver or redeliver in ack mode.
+	webhookAckCheckInterval = 5 * time.Second
+	// webhookRedeliveryWindow is the time after which unacknowledged events
+	// are delivered again.
+	webhookRedeliveryWindow = time.Minute
+	// webhookAckBatch is the maximum number of events sent to a subscription
+	// per check.
+	webhookAckBatch = 100
+)
+
+// ackLoop delivers events to subscriptions in ack mode when signaled by
+// dispatch, and periodically for redelivery.  It should be run as a
+// goroutine.
+func (m *webhookManager) ackLoop(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(webhookAckCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.kick:
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+		if spyJournal == nil {
+			continue
+		}
+
+		m.mtx.RLock()
+		var subs []*webhookSubscription
+		for _, s := range m.subs {
+			if s.Ack {
+				subs = append(subs, s)
+			}
+		}
+		m.mtx.RUnlock()
+
+		for _, s := range subs {
+			m.deliverUnacked(s)
+		}
+	}
+}
+
+// deliverUnacked sends the subscription's events after the last one sent, or
+// after the last one acknowledged if the redelivery window has passed.  The
+// journal is read from the first event not yet examined for the subscription,
+// found with the journal's index, so a subscription that is up to date does
+// not read it at all.
+func (m *webhookManager) deliverUnacked(s *webhookSubscription) {
+	m.mtx.RLock()
+	acked, sentSeq, sentTime := s.AckedSeq, s.sentSeq, s.sentTime
+	scanned := s.scannedSeq
+	m.mtx.RUnlock()
+
+	// Events up to scanned were sent or did not match.
+	start := acked
+	if scanned > start {
+		start = scanned
+	}
+	awaiting := sentSeq > acked
+	if awaiting && time.Since(sentTime) >= webhookRedeliveryWindow {
+		log.Infof("Redelivering events after %d to webhook %s", acked, s.ID)
+		start, awaiting = acked, false
+		m.mtx.Lock()
+		s.scannedSeq = acked
+		m.mtx.Unlock()
+	}
+
+	var events []*spyEvent
+	last := start
+	err := spyJournal.scanAfter(start, func(e *spyEvent) bool {
+		last = e.Seq
+		if s.matches(e) {
+			events = append(events, e)
+		}
+		return len(events) < webhookAckBatch
+	})
+	if err != nil {
+		log.Errorf("Failed to read event journal: %v", err)
+		return
+	}
+
+	for _, e := range events {
+		payload, err := spyNotifyTemplates.payload(notifyChannelWebhook, e)
+		if err != nil {
+			log.Errorf("Failed to encode event %d: %v", e.Seq, err)
+			return
+		}
+		if err = m.post(s, payload); err != nil {
+			// Retried at the next check.
+			log.Debugf("Webhook delivery of event %d to %s failed: %v",
+				e.Seq, s.URL, err)
+			return
+		}
+		m.mtx.Lock()
+		// The redelivery window starts with the first unacknowledged event.
+		if !awaiting {
+			s.sentTime = time.Now()
+			awaiting = true
+		}
+		s.sentSeq, s.scannedSeq = e.Seq, e.Seq
+		m.mtx.Unlock()
+		spyUsage.notification(s.Tenant)
+	}
+	m.mtx.Lock()
+	if last > s.scannedSeq {
+		s.scannedSeq = last
+	}
+	m.mtx.Unlock()
+}
+
+// webhookAckAPI documents serveAck.
+var webhookAckAPI = apiOperation{
+	method:  "POST",
+	path:    "/webhooks/{id}/ack",
+	summary: "Acknowledge the events up to a sequence number",
+	params:  []apiParam{{name: "id", in: "path", typ: "string"}},
+	request: struct {
+		Seq uint64 `json:"seq"`
+	}{},
+	status: http.StatusNoContent,
+}
+
+// serveAck handles POST /webhooks/<id>/ack, with a body such as {"seq": 42},
+// acknowledging all events up to and including the given sequence number.
+func (m *webhookManager) serveAck(w http.ResponseWriter, r *http.Request,
+	tenant, id string) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Seq uint64 `json:"seq"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	s := m.get(tenant, id)
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.Ack {
+		http.Error(w, "subscription is not in ack mode", http.StatusBadRequest)
+		return
+	}
+	if spyJournal != nil && req.Seq > spyJournal.lastSequence() {
+		http.Error(w, "unknown sequence number", http.StatusBadRequest)
+		return
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if req.Seq > s.AckedSeq {
+		prev := s.AckedSeq
+		s.AckedSeq = req.Seq
+		if err := m.save(); err != nil {
+			s.AckedSeq = prev
+			log.Errorf("Failed to save webhook subscriptions: %v", err)
+			http.Error(w, "failed to save acknowledgement",
+				http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+// webhookguard.go restricts the addresses to which webhooks subscribed with
+// the API are delivered.  Without it, an API user could subscribe a URL on
+// dcrspy's own host or private network (e.g. a cloud metadata service at
+// 169.254.169.254) and have dcrspy POST signed payloads to it.  The URL's addresses are checked
+// when the subscription is saved, and again when each connection is dialed,
+// so that a host name later resolving to a private address is also refused.
+// The operator may allow private networks with webhookallow.
+
+package spy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// webhookBlockedNets are the networks to which API webhooks are not
+// delivered unless allowed: unspecified, loopback, private, shared (CGNAT),
+// link-local, benchmarking, multicast and reserved addresses.
+var webhookBlockedNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// webhookGuard checks the addresses of API webhooks.
+type webhookGuard struct {
+	allowed []*net.IPNet
+}
+
+// newWebhookGuard creates a webhookGuard allowing the given networks (in CIDR
+// notation) and IP addresses in addition to public addresses.
+func newWebhookGuard(allow []string) (*webhookGuard, error) {
+	g := &webhookGuard{}
+	for _, a := range allow {
+		if ip := net.ParseIP(a); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			g.allowed = append(g.allowed,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhookallow %q", a)
+		}
+		g.allowed = append(g.allowed, n)
+	}
+	return g, nil
+}
+
+// permitted returns true if a webhook may be delivered to ip.
+func (g *webhookGuard) permitted(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range g.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range webhookBlockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkURL resolves the host of the webhook URL, returning an error if any of
+// its addresses is not permitted.
+func (g *webhookGuard) checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url")
+	}
+	host := u.Hostname()
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return fmt.Errorf("unable to resolve %s", host)
+		}
+	}
+	for _, ip := range ips {
+		if !g.permitted(ip) {
+			return fmt.Errorf("url host %s is a private, loopback or "+
+				"link-local address", host)
+		}
+	}
+	return nil
+}
+
+// control refuses connections to addresses that are not permitted.  It is the
+// Control function of the dialer of client.
+func (g *webhookGuard) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !g.permitted(ip) {
+		return fmt.Errorf("webhook address %s is not permitted", host)
+	}
+	return nil
+}
+
+// client returns an HTTP client whose connections are checked by the guard.
+// It does not use a proxy, which would hide the address being connected to.
+func (g *webhookGuard) client() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   g.control,
+	}
+	return &http.Client{
+		Timeout: spyHTTPTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
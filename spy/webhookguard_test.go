@@ -0,0 +1,107 @@
+package spy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookGuardPermitted(t *testing.T) {
+	g, err := newWebhookGuard([]string{"10.1.0.0/16", "127.0.0.2", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"127.0.0.2", true},
+		{"169.254.169.254", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true},
+		{"172.16.0.1", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00::1", true},
+		{"fd00::2", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := g.permitted(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("permitted(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookGuardCheckURL(t *testing.T) {
+	g, err := newWebhookGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://93.184.216.34/hook", false},
+		{"http://127.0.0.1:8080/hook", true},
+		{"http://169.254.169.254/latest/meta-data/", true},
+		{"http://10.0.0.5/hook", true},
+		{"http://[::1]:9000/hook", true},
+		{"http://[fe80::1]/hook", true},
+		{"http://localhost/hook", true},
+	}
+	for _, tt := range tests {
+		err := g.checkURL(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkURL(%s): got error %v, want error %v", tt.url,
+				err, tt.wantErr)
+		}
+	}
+}
+
+func TestNewWebhookGuardInvalid(t *testing.T) {
+	if _, err := newWebhookGuard([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid network")
+	}
+	if _, err := newWebhookGuard([]string{"example.com"}); err == nil {
+		t.Error("expected an error for a host name")
+	}
+}
+
+func TestWebhookGuardClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// The test server listens on loopback, which is refused when dialing.
+	g, _ := newWebhookGuard(nil)
+	if resp, err := g.client().Post(srv.URL, "application/json", nil); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the connection to loopback to be refused")
+	}
+
+	g, _ = newWebhookGuard([]string{"127.0.0.0/8"})
+	resp, err := g.client().Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("allowed connection failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+}
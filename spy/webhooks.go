@@ -0,0 +1,609 @@
+// webhooks.go implements webhook subscriptions, which deliver events as JSON
+// HTTP POST requests.  Subscriptions are managed at runtime via the /webhooks
+// API endpoint, and persisted in a JSON file in the output folder.  Webhooks
+// given in the config file are subscriptions to all of the operator's events,
+// which the API lists but cannot change.  The other webhooks are only
+// delivered to permitted addresses (see webhookguard.go).
+
+package spy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookQueueSize is the number of deliveries that may be pending before
+	// new deliveries are dropped.
+	webhookQueueSize = 256
+	// webhookWorkers is the number of concurrent deliveries.
+	webhookWorkers = 4
+	// webhookAttempts is the number of attempts to deliver an event.
+	webhookAttempts = 3
+)
+
+// webhookSubscription is a subscription to events delivered to URL.  Events
+// are delivered if their type is in EventTypes and their address in
+// Addresses, where an empty list matches any, and the Filter expression (if
+// any) is true.  If Secret is set, the payload's HMAC-SHA256 is sent in the
+// X-Dcrspy-HMAC-SHA256 header.  If Ack is set, events are delivered in order
+// until acknowledged by the consumer (see webhookacks.go).  Config is set for
+// the webhooks of the config file, which are not persisted.
+type webhookSubscription struct {
+	ID         string   `json:"id"`
+	Tenant     string   `json:"tenant,omitempty"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventtypes,omitempty"`
+	Addresses  []string `json:"addresses,omitempty"`
+	Filter     string   `json:"filter,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	Ack        bool     `json:"ack,omitempty"`
+	AckedSeq   uint64   `json:"ackedseq,omitempty"`
+	Created    int64    `json:"created"`
+	Config     bool     `json:"config,omitempty"`
+
+	filter *expression
+	// The last event sent in ack mode, and when, and the last event examined
+	// for delivery.  Guarded by the manager's mutex, like AckedSeq.
+	sentSeq    uint64
+	sentTime   time.Time
+	scannedSeq uint64
+}
+
+// webhookRequest is the body of a request to create or replace a webhook
+// subscription: the fields of webhookSubscription that API users may set.
+type webhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventtypes,omitempty"`
+	Addresses  []string `json:"addresses,omitempty"`
+	Filter     string   `json:"filter,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	Ack        bool     `json:"ack,omitempty"`
+}
+
+// validate checks the subscription's URL, and parses its filter.
+func (s *webhookSubscription) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	s.filter = nil
+	if s.Filter != "" {
+		if s.filter, err = parseExpression(s.Filter); err != nil {
+			return fmt.Errorf("invalid filter: %v", err)
+		}
+	}
+	return nil
+}
+
+// matches returns true if the event should be delivered to the subscription.
+// Event types may be given as the type (e.g. "watchedaddr") or the type and
+// action (e.g. "watchedaddr.mined").
+func (s *webhookSubscription) matches(e *spyEvent) bool {
+	if e.Tenant != s.Tenant {
+		return false
+	}
+	if len(s.EventTypes) > 0 {
+		var found bool
+		for _, t := range s.EventTypes {
+			if t == e.Type || t == e.Type+"."+e.Action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(s.Addresses) > 0 {
+		var found bool
+		for _, a := range s.Addresses {
+			if a == e.Address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if s.filter != nil {
+		match, err := s.filter.evalBool(e.vars())
+		if err != nil {
+			log.Debugf("Webhook %s filter failed for event %d: %v", s.ID,
+				e.Seq, err)
+			return false
+		}
+		return match
+	}
+	return true
+}
+
+// webhookDelivery is an event queued for delivery to a subscription.
+type webhookDelivery struct {
+	sub   *webhookSubscription
+	event *spyEvent
+}
+
+// webhookManager holds the webhook subscriptions and delivers events to them.
+// guardedClient, which only connects to addresses permitted by guard, delivers
+// the events of all but the config file's webhooks.
+type webhookManager struct {
+	mtx           sync.RWMutex
+	path          string
+	subs          map[string]*webhookSubscription
+	queue         chan *webhookDelivery
+	kick          chan struct{}
+	client        *http.Client
+	guard         *webhookGuard
+	guardedClient *http.Client
+}
+
+// spyWebhooks is the package-level webhook manager.  Events are not delivered
+// to webhooks if it is nil.
+var spyWebhooks *webhookManager
+
+// newWebhookManager creates a webhookManager with the subscriptions persisted
+// in the file at path, if it exists.  API webhooks may be delivered to
+// the allowed networks and IP addresses in addition to public addresses.
+func newWebhookManager(path string, allow []string) (*webhookManager, error) {
+	guard, err := newWebhookGuard(allow)
+	if err != nil {
+		return nil, err
+	}
+	m := &webhookManager{
+		path:          path,
+		subs:          make(map[string]*webhookSubscription),
+		queue:         make(chan *webhookDelivery, webhookQueueSize),
+		kick:          make(chan struct{}, 1),
+		client:        newHTTPClient(),
+		guard:         guard,
+		guardedClient: guard.client(),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	var subs []*webhookSubscription
+	if err = json.Unmarshal(b, &subs); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	for _, s := range subs {
+		if err = s.validate(); err != nil {
+			return nil, fmt.Errorf("webhook %s: %v", s.ID, err)
+		}
+		// Webhooks of the config file are not saved.
+		s.Config = false
+		m.subs[s.ID] = s
+	}
+	return m, nil
+}
+
+// addConfigured adds a subscription to all of the operator's events for each
+// of the URLs of the config file.
+func (m *webhookManager) addConfigured(urls []string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := time.Now().Unix()
+	for i, u := range urls {
+		s := &webhookSubscription{
+			ID:      fmt.Sprintf("config-%d", i+1),
+			URL:     u,
+			Created: now,
+			Config:  true,
+		}
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("%s: %v", u, err)
+		}
+		m.subs[s.ID] = s
+	}
+	return nil
+}
+
+// save writes the subscriptions, except those of the config file, to the
+// file.  The mutex must be held.
+func (m *webhookManager) save() error {
+	subs := make([]*webhookSubscription, 0, len(m.subs))
+	for _, s := range m.subs {
+		if s.Config {
+			continue
+		}
+		subs = append(subs, s)
+	}
+	sort.Sort(webhooksByCreated(subs))
+	b, err := json.MarshalIndent(subs, "", "    ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a failed write does not lose the
+	// existing subscriptions.
+	tmp := m.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+type webhooksByCreated []*webhookSubscription
+
+func (s webhooksByCreated) Len() int      { return len(s) }
+func (s webhooksByCreated) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s webhooksByCreated) Less(i, j int) bool {
+	if s[i].Created == s[j].Created {
+		return s[i].ID < s[j].ID
+	}
+	return s[i].Created < s[j].Created
+}
+
+// list returns the tenant's subscriptions, oldest first.
+func (m *webhookManager) list(tenant string) []*webhookSubscription {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var subs []*webhookSubscription
+	for _, s := range m.subs {
+		if s.Tenant == tenant {
+			subs = append(subs, s)
+		}
+	}
+	sort.Sort(webhooksByCreated(subs))
+	return subs
+}
+
+// get returns the tenant's subscription with the given ID, or nil.
+func (m *webhookManager) get(tenant, id string) *webhookSubscription {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	s := m.subs[id]
+	if s == nil || s.Tenant != tenant {
+		return nil
+	}
+	return s
+}
+
+// put creates or replaces a subscription and saves the subscriptions.
+func (m *webhookManager) put(s *webhookSubscription) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	old := m.subs[s.ID]
+	m.subs[s.ID] = s
+	if err := m.save(); err != nil {
+		if old != nil {
+			m.subs[s.ID] = old
+		} else {
+			delete(m.subs, s.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove deletes the tenant's subscription with the given ID, returning false
+// if there is no such subscription.
+func (m *webhookManager) remove(tenant, id string) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	s := m.subs[id]
+	if s == nil || s.Tenant != tenant {
+		return false, nil
+	}
+	delete(m.subs, id)
+	if err := m.save(); err != nil {
+		m.subs[id] = s
+		return true, err
+	}
+	return true, nil
+}
+
+// dispatch queues the event for delivery to each matching subscription.
+// Subscriptions in ack mode read events from the journal instead, and ackLoop
+// is signaled to check for new events, unless the event was not recorded.
+func (m *webhookManager) dispatch(e *spyEvent) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for _, s := range m.subs {
+		if !s.matches(e) {
+			continue
+		}
+		if s.Ack {
+			if e.Seq == 0 {
+				continue
+			}
+			select {
+			case m.kick <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		select {
+		case m.queue <- &webhookDelivery{s, e}:
+		default:
+			log.Warnf("Webhook queue full. Dropping event %d for %s.",
+				e.Seq, s.URL)
+		}
+	}
+}
+
+// run delivers queued events until quit is closed.  It should be run as a
+// goroutine.
+func (m *webhookManager) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go m.ackLoop(&workers, quit)
+	for i := 0; i < webhookWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case d := <-m.queue:
+					m.deliver(d)
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+	workers.Wait()
+	log.Debugf("Quitting webhook dispatcher.")
+}
+
+// deliver posts the event to the subscription's URL, retrying on failure, and
+// queues it for later retries if every attempt fails.
+func (m *webhookManager) deliver(d *webhookDelivery) {
+	payload, err := spyNotifyTemplates.payload(notifyChannelWebhook, d.event)
+	if err != nil {
+		log.Errorf("Failed to encode event %d: %v", d.event.Seq, err)
+		return
+	}
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = m.post(d.sub, payload); err == nil {
+			spyUsage.notification(d.sub.Tenant)
+			return
+		}
+		log.Debugf("Webhook delivery of event %d to %s failed (attempt %d): %v",
+			d.event.Seq, d.sub.URL, attempt, err)
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+	if !spyRetryQueue.enqueueWebhook(d.sub, d.event.Seq, payload, err) {
+		log.Warnf("Failed to deliver event %d to webhook %s: %v",
+			d.event.Seq, d.sub.URL,
+			reportError(errKindNotifier, "webhook", err))
+	}
+}
+
+// post sends the payload to the subscription's URL with the signature
+// headers.
+func (m *webhookManager) post(s *webhookSubscription, payload []byte) error {
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.Secret))
+		mac.Write(payload)
+		req.Header.Set("X-Dcrspy-HMAC-SHA256", hex.EncodeToString(mac.Sum(nil)))
+	}
+	if spySigner != nil {
+		req.Header.Set("X-Dcrspy-Signature", spySigner.sign(payload))
+	}
+
+	client := m.guardedClient
+	if s.Config {
+		client = m.client
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// newWebhookID returns a random subscription ID.
+func newWebhookID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// webhooksAPI documents the /webhooks endpoint.
+var webhooksAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "List the webhook subscriptions",
+	response: []*webhookSubscription{},
+}, {
+	method:   "POST",
+	summary:  "Create a webhook subscription",
+	request:  webhookRequest{},
+	response: webhookSubscription{},
+	status:   http.StatusCreated,
+}}
+
+// webhookAPI documents the /webhooks/<id> endpoints.
+var webhookAPI = []apiOperation{{
+	method:   "GET",
+	path:     "/webhooks/{id}",
+	summary:  "Get a webhook subscription",
+	params:   []apiParam{{name: "id", in: "path", typ: "string"}},
+	response: webhookSubscription{},
+}, {
+	method:   "PUT",
+	path:     "/webhooks/{id}",
+	summary:  "Replace a webhook subscription",
+	params:   []apiParam{{name: "id", in: "path", typ: "string"}},
+	request:  webhookRequest{},
+	response: webhookSubscription{},
+}, {
+	method:  "DELETE",
+	path:    "/webhooks/{id}",
+	summary: "Delete a webhook subscription",
+	params:  []apiParam{{name: "id", in: "path", typ: "string"}},
+	status:  http.StatusNoContent,
+}, webhookAckAPI}
+
+// serve is a tenantHandler for the /webhooks/ endpoint:
+//
+//	GET    /webhooks/     list the subscriptions
+//	POST   /webhooks/     create a subscription
+//	GET    /webhooks/<id> get a subscription
+//	PUT    /webhooks/<id> replace a subscription
+//	DELETE /webhooks/<id> delete a subscription
+//
+// The secret is only included in the response to create and replace.
+func (m *webhookManager) serve(w http.ResponseWriter, r *http.Request, t *tenant) {
+	tenant := t.owner()
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+	if strings.HasSuffix(id, "/ack") {
+		m.serveAck(w, r, tenant, strings.TrimSuffix(id, "/ack"))
+		return
+	}
+
+	writeJSON := func(status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	withoutSecret := func(s *webhookSubscription) *webhookSubscription {
+		c := *s
+		c.Secret = ""
+		return &c
+	}
+
+	switch {
+	case id == "" && r.Method == "GET":
+		subs := m.list(tenant)
+		out := make([]*webhookSubscription, 0, len(subs))
+		for _, s := range subs {
+			out = append(out, withoutSecret(s))
+		}
+		writeJSON(http.StatusOK, out)
+
+	case id != "" && r.Method == "GET":
+		s := m.get(tenant, id)
+		if s == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(http.StatusOK, withoutSecret(s))
+
+	case (id == "" && r.Method == "POST") || (id != "" && r.Method == "PUT"):
+		var req webhookRequest
+		r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		s := &webhookSubscription{
+			URL:        req.URL,
+			EventTypes: req.EventTypes,
+			Addresses:  req.Addresses,
+			Filter:     req.Filter,
+			Secret:     req.Secret,
+			Ack:        req.Ack,
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.guard.checkURL(s.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Tenant = tenant
+		status := http.StatusOK
+		if id == "" {
+			var err error
+			if s.ID, err = newWebhookID(); err != nil {
+				log.Errorf("Failed to generate webhook ID: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			s.Created = time.Now().Unix()
+			status = http.StatusCreated
+			// Deliver events from now on.
+			if s.Ack && spyJournal != nil {
+				s.AckedSeq = spyJournal.lastSequence()
+			}
+		} else {
+			old := m.get(tenant, id)
+			if old == nil {
+				http.NotFound(w, r)
+				return
+			}
+			if old.Config {
+				http.Error(w, "webhooks of the config file cannot be changed",
+					http.StatusForbidden)
+				return
+			}
+			s.ID, s.Created, s.AckedSeq = old.ID, old.Created, old.AckedSeq
+			if s.Ack && !old.Ack && spyJournal != nil {
+				s.AckedSeq = spyJournal.lastSequence()
+			}
+		}
+		if s.Ack && spyJournal == nil {
+			http.Error(w, "ack mode requires the event journal",
+				http.StatusBadRequest)
+			return
+		}
+		if err := m.put(s); err != nil {
+			log.Errorf("Failed to save webhook subscriptions: %v", err)
+			http.Error(w, "failed to save subscription",
+				http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Saved webhook subscription %s (tenant %q) for %s", s.ID,
+			tenant, s.URL)
+		auditDetail(w, "", "save webhook %s for %s", s.ID, s.URL)
+		writeJSON(status, s)
+
+	case id != "" && r.Method == "DELETE":
+		if s := m.get(tenant, id); s != nil && s.Config {
+			http.Error(w, "webhooks of the config file cannot be deleted",
+				http.StatusForbidden)
+			return
+		}
+		found, err := m.remove(tenant, id)
+		if err != nil {
+			log.Errorf("Failed to save webhook subscriptions: %v", err)
+			http.Error(w, "failed to delete subscription",
+				http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		log.Infof("Deleted webhook subscription %s (tenant %q)", id, tenant)
+		auditDetail(w, "", "delete webhook %s", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,306 @@
+// xmpp.go sends the operator's watched address notifications as XMPP
+// (Jabber) chat messages, e.g. through a self-hosted server.  For each batch of
+// queued messages, the notifier connects to the server, requires STARTTLS,
+// authenticates with SASL PLAIN, binds a resource, sends the messages to each
+// recipient and closes the stream.
+
+package spy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// xmppQueueSize is the number of messages waiting to be sent, beyond
+	// which new messages are dropped.
+	xmppQueueSize = 200
+	// xmppTimeout is the timeout of a session, from connecting to closing the
+	// stream.
+	xmppTimeout = 30 * time.Second
+	// xmppResource is the resource bound by the notifier.
+	xmppResource = "dcrspy"
+)
+
+// XMPP namespaces
+const (
+	xmppNSClient = "jabber:client"
+	xmppNSStream = "http://etherx.jabber.org/streams"
+	xmppNSTLS    = "urn:ietf:params:xml:ns:xmpp-tls"
+	xmppNSSASL   = "urn:ietf:params:xml:ns:xmpp-sasl"
+	xmppNSBind   = "urn:ietf:params:xml:ns:xmpp-bind"
+)
+
+// xmppFeatures are the stream features offered by the server.
+type xmppFeatures struct {
+	StartTLS   *struct{} `xml:"starttls"`
+	Mechanisms []string  `xml:"mechanisms>mechanism"`
+	Bind       *struct{} `xml:"bind"`
+}
+
+// xmppNotifier sends chat messages from an XMPP account.
+type xmppNotifier struct {
+	server   string
+	domain   string
+	user     string
+	password string
+	to       []string
+	queue    chan *queuedText
+}
+
+// spyXMPP is the package-level XMPP notifier, nil if not configured.
+var spyXMPP *xmppNotifier
+
+// newXMPPNotifier creates an xmppNotifier for the account with the JID (e.g.
+// dcrspy@example.com) and password, sending to each JID of to.  server is the
+// host:port of the server, or empty for port 5222 of the JID's domain.
+func newXMPPNotifier(jid, password, server string,
+	to []string) (*xmppNotifier, error) {
+	// A resource, if any, is replaced by xmppResource.
+	jid = strings.SplitN(jid, "/", 2)[0]
+	at := strings.Index(jid, "@")
+	if at <= 0 || at == len(jid)-1 {
+		return nil, fmt.Errorf("invalid JID %q (expected user@domain)", jid)
+	}
+	n := &xmppNotifier{
+		server:   server,
+		domain:   jid[at+1:],
+		user:     jid[:at],
+		password: password,
+		to:       to,
+		queue:    make(chan *queuedText, xmppQueueSize),
+	}
+	if n.server == "" {
+		n.server = net.JoinHostPort(n.domain, "5222")
+	}
+	return n, nil
+}
+
+// Notify queues a message of the event, rendered with the xmpp template.  It
+// does not block, and fails if the queue is full.
+func (n *xmppNotifier) Notify(e *spyEvent) error {
+	if n == nil {
+		return nil
+	}
+	msg := spyNotifyTemplates.render(notifyChannelXMPP, e)
+	select {
+	case n.queue <- &queuedText{msg, e}:
+	default:
+		return fmt.Errorf("XMPP queue full, dropping %q", msg)
+	}
+	return nil
+}
+
+// tracksDelivery implements deliveryNotifier.
+func (n *xmppNotifier) tracksDelivery() {}
+
+// run sends queued messages until quit is closed, in a session for the
+// messages queued at the time.  It should be run as a goroutine.
+func (n *xmppNotifier) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case msg := <-n.queue:
+			queued := []*queuedText{msg}
+		drain:
+			for {
+				select {
+				case msg = <-n.queue:
+					queued = append(queued, msg)
+				default:
+					break drain
+				}
+			}
+			msgs := make([]string, 0, len(queued))
+			for _, q := range queued {
+				msgs = append(msgs, q.text)
+			}
+			if err := n.send(msgs); err != nil {
+				log.Warnf("Failed to send %d XMPP message(s): %v", len(msgs),
+					reportError(errKindNotifier, "xmpp", err))
+			}
+			for _, q := range queued {
+				q.event.delivered()
+			}
+		case <-quit:
+			log.Debugf("Quitting XMPP notifier.")
+			return
+		}
+	}
+}
+
+// send sends the messages to each recipient in a new session.
+func (n *xmppNotifier) send(msgs []string) error {
+	conn, err := net.DialTimeout("tcp", n.server, xmppTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(xmppTimeout))
+
+	// The server must offer STARTTLS, since the password is sent in the
+	// clear with SASL PLAIN.
+	dec, features, err := n.openStream(conn)
+	if err != nil {
+		return err
+	}
+	if features.StartTLS == nil {
+		return fmt.Errorf("server does not offer STARTTLS")
+	}
+	fmt.Fprintf(conn, "<starttls xmlns='%s'/>", xmppNSTLS)
+	if se, err := xmppNextElement(dec); err != nil {
+		return err
+	} else if se.Name.Local != "proceed" {
+		return fmt.Errorf("STARTTLS refused")
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: n.domain})
+	if err = tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	// SASL PLAIN authentication
+	if dec, features, err = n.openStream(tlsConn); err != nil {
+		return err
+	}
+	plain := false
+	for _, m := range features.Mechanisms {
+		plain = plain || m == "PLAIN"
+	}
+	if !plain {
+		return fmt.Errorf("server does not offer SASL PLAIN (offers %s)",
+			strings.Join(features.Mechanisms, ", "))
+	}
+	fmt.Fprintf(tlsConn, "<auth xmlns='%s' mechanism='PLAIN'>%s</auth>",
+		xmppNSSASL, xmppPlainAuth(n.user, n.password))
+	if se, err := xmppNextElement(dec); err != nil {
+		return err
+	} else if se.Name.Local != "success" {
+		return fmt.Errorf("authentication failed")
+	}
+
+	// Resource binding
+	if dec, features, err = n.openStream(tlsConn); err != nil {
+		return err
+	}
+	if features.Bind == nil {
+		return fmt.Errorf("server does not offer resource binding")
+	}
+	fmt.Fprintf(tlsConn, "<iq type='set' id='bind1'><bind xmlns='%s'>"+
+		"<resource>%s</resource></bind></iq>", xmppNSBind, xmppResource)
+	for {
+		se, err := xmppNextElement(dec)
+		if err != nil {
+			return err
+		}
+		if se.Name.Local != "iq" {
+			dec.Skip()
+			continue
+		}
+		if xmppAttr(se, "type") != "result" {
+			return fmt.Errorf("resource binding failed")
+		}
+		break
+	}
+
+	_, err = tlsConn.Write(append(xmppMessages(msgs, n.to),
+		"</stream:stream>"...))
+	return err
+}
+
+// xmppPlainAuth returns the SASL PLAIN response of the user and password
+// (RFC 4616), without an authorization identity.
+func xmppPlainAuth(user, password string) string {
+	return base64.StdEncoding.EncodeToString(
+		[]byte("\x00" + user + "\x00" + password))
+}
+
+// xmppMessages returns the chat message stanzas of each message to each
+// recipient.
+func xmppMessages(msgs, to []string) []byte {
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		for _, jid := range to {
+			buf.WriteString("<message type='chat' to='")
+			xml.EscapeText(&buf, []byte(jid))
+			buf.WriteString("'><body>")
+			xml.EscapeText(&buf, []byte(msg))
+			buf.WriteString("</body></message>")
+		}
+	}
+	return buf.Bytes()
+}
+
+// openStream opens a stream on the connection, returning a decoder of the
+// server's stream and the stream features.
+func (n *xmppNotifier) openStream(conn io.ReadWriter) (*xml.Decoder,
+	*xmppFeatures, error) {
+	_, err := fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream to='%s' "+
+		"xmlns='%s' xmlns:stream='%s' version='1.0'>", n.domain, xmppNSClient,
+		xmppNSStream)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := xml.NewDecoder(conn)
+	se, err := xmppNextElement(dec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if se.Name.Local != "stream" {
+		return nil, nil, fmt.Errorf("unexpected <%s> opening stream",
+			se.Name.Local)
+	}
+	se, err = xmppNextElement(dec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if se.Name.Local != "features" {
+		return nil, nil, fmt.Errorf("unexpected <%s> instead of features",
+			se.Name.Local)
+	}
+	features := new(xmppFeatures)
+	if err = dec.DecodeElement(features, &se); err != nil {
+		return nil, nil, err
+	}
+	return dec, features, nil
+}
+
+// xmppNextElement returns the next start element of the stream.  A stream
+// error is returned as an error.
+func xmppNextElement(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Space == xmppNSStream && t.Name.Local == "error" {
+				return t, fmt.Errorf("stream error")
+			}
+			return t, nil
+		case xml.EndElement:
+			if t.Name.Space == xmppNSStream && t.Name.Local == "stream" {
+				return xml.StartElement{}, fmt.Errorf("stream closed by " +
+					"server")
+			}
+		}
+	}
+}
+
+// xmppAttr returns the value of the element's attribute with the name.
+func xmppAttr(se xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,246 @@
+package spy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+// xmppTestStream is a connection reading a scripted server stream, and
+// recording what is written to it.
+type xmppTestStream struct {
+	io.Reader
+	written bytes.Buffer
+}
+
+func (s *xmppTestStream) Write(b []byte) (int, error) { return s.written.Write(b) }
+
+// xmppServerStream is the opening of a server's stream, before the features.
+const xmppServerStream = `<?xml version='1.0'?><stream:stream ` +
+	`xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' ` +
+	`id='s1' from='example.com' version='1.0'>`
+
+func TestNewXMPPNotifier(t *testing.T) {
+	tests := []struct {
+		jid, server string
+		// wantUser, wantDomain and wantServer are empty if the JID is
+		// invalid.
+		wantUser, wantDomain, wantServer string
+	}{
+		{"dcrspy@example.com", "", "dcrspy", "example.com",
+			"example.com:5222"},
+		{"dcrspy@example.com/laptop", "", "dcrspy", "example.com",
+			"example.com:5222"},
+		{"dcrspy@example.com", "xmpp.example.net:5223", "dcrspy",
+			"example.com", "xmpp.example.net:5223"},
+		{"example.com", "", "", "", ""},
+		{"@example.com", "", "", "", ""},
+		{"dcrspy@", "", "", "", ""},
+		{"dcrspy@/laptop", "", "", "", ""},
+		{"", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		n, err := newXMPPNotifier(tt.jid, "secret", tt.server,
+			[]string{"op@example.com"})
+		if tt.wantUser == "" {
+			if err == nil {
+				t.Errorf("newXMPPNotifier(%q) succeeded, want an error", tt.jid)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newXMPPNotifier(%q): %v", tt.jid, err)
+			continue
+		}
+		if n.user != tt.wantUser || n.domain != tt.wantDomain ||
+			n.server != tt.wantServer {
+			t.Errorf("newXMPPNotifier(%q, %q) = %s@%s via %s, want %s@%s via %s",
+				tt.jid, tt.server, n.user, n.domain, n.server, tt.wantUser,
+				tt.wantDomain, tt.wantServer)
+		}
+	}
+}
+
+func TestXMPPOpenStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		server string
+		// wantErr is a substring of the error, or empty if the stream opens.
+		wantErr    string
+		starttls   bool
+		mechanisms []string
+		bind       bool
+	}{
+		{"starttls", xmppServerStream + `<stream:features>` +
+			`<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/>` +
+			`</starttls></stream:features>`, "", true, nil, false},
+		{"sasl", xmppServerStream + `<stream:features>` +
+			`<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>` +
+			`<mechanism>SCRAM-SHA-1</mechanism><mechanism>PLAIN</mechanism>` +
+			`</mechanisms></stream:features>`, "", false,
+			[]string{"SCRAM-SHA-1", "PLAIN"}, false},
+		{"bind", xmppServerStream + `<stream:features>` +
+			`<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>` +
+			`</stream:features>`, "", false, nil, true},
+		{"no features", xmppServerStream + `</stream:stream>`,
+			"stream closed", false, nil, false},
+		{"stream error", xmppServerStream + `<stream:error>` +
+			`<host-unknown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>` +
+			`</stream:error>`, "stream error", false, nil, false},
+		{"not a stream", `<?xml version='1.0'?><html><body/></html>`,
+			"unexpected <html>", false, nil, false},
+		{"not features", xmppServerStream + `<message/>`,
+			"unexpected <message>", false, nil, false},
+		{"eof", xmppServerStream, "EOF", false, nil, false},
+	}
+	n, err := newXMPPNotifier("dcrspy@example.com", "secret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		conn := &xmppTestStream{Reader: strings.NewReader(tt.server)}
+		_, features, err := n.openStream(conn)
+		opening := "<?xml version='1.0'?><stream:stream to='example.com' " +
+			"xmlns='jabber:client' " +
+			"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>"
+		if got := conn.written.String(); got != opening {
+			t.Errorf("%s: wrote %q, want %q", tt.name, got, opening)
+		}
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (features.StartTLS != nil) != tt.starttls ||
+			(features.Bind != nil) != tt.bind ||
+			strings.Join(features.Mechanisms, ",") !=
+				strings.Join(tt.mechanisms, ",") {
+			t.Errorf("%s: got features %+v, want starttls %v, mechanisms %v, "+
+				"bind %v", tt.name, features, tt.starttls, tt.mechanisms,
+				tt.bind)
+		}
+	}
+}
+
+func TestXMPPNextElement(t *testing.T) {
+	tests := []struct {
+		stream  string
+		want    string
+		wantErr bool
+	}{
+		{xmppServerStream, "stream", false},
+		{`<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>`, "proceed", false},
+		{`text<!-- comment --><?pi x?><success/>`, "success", false},
+		{`<stream:stream xmlns:stream='http://etherx.jabber.org/streams'>` +
+			`<stream:error/>`, "stream", false},
+		{`<s xmlns:stream='http://etherx.jabber.org/streams'><stream:error/>`,
+			"s", false},
+		{`<stream:error xmlns:stream='http://etherx.jabber.org/streams'/>`,
+			"error", true},
+		{`<stream:stream xmlns:stream='http://etherx.jabber.org/streams'>` +
+			`</stream:stream>`, "stream", false},
+		{``, "", true},
+	}
+	for _, tt := range tests {
+		dec := xml.NewDecoder(strings.NewReader(tt.stream))
+		se, err := xmppNextElement(dec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("xmppNextElement(%q): got error %v, want error %v",
+				tt.stream, err, tt.wantErr)
+			continue
+		}
+		if se.Name.Local != tt.want {
+			t.Errorf("xmppNextElement(%q) = <%s>, want <%s>", tt.stream,
+				se.Name.Local, tt.want)
+		}
+	}
+}
+
+func TestXMPPStreamClosed(t *testing.T) {
+	dec := xml.NewDecoder(strings.NewReader(xmppServerStream +
+		`<success/></stream:stream>`))
+	for _, want := range []string{"stream", "success"} {
+		se, err := xmppNextElement(dec)
+		if err != nil || se.Name.Local != want {
+			t.Fatalf("got <%s> (%v), want <%s>", se.Name.Local, err, want)
+		}
+	}
+	if _, err := xmppNextElement(dec); err == nil ||
+		!strings.Contains(err.Error(), "stream closed") {
+		t.Errorf("got error %v at the end of the stream, want stream closed",
+			err)
+	}
+}
+
+func TestXMPPAttr(t *testing.T) {
+	dec := xml.NewDecoder(strings.NewReader(`<iq type='result' id='bind_1' ` +
+		`xml:lang='en'/>`))
+	se, err := xmppNextElement(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, want string
+	}{
+		{"type", "result"},
+		{"id", "bind_1"},
+		{"lang", "en"},
+		{"to", ""},
+	}
+	for _, tt := range tests {
+		if got := xmppAttr(se, tt.name); got != tt.want {
+			t.Errorf("xmppAttr(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestXMPPPlainAuth(t *testing.T) {
+	tests := []struct {
+		user, password, want string
+	}{
+		// RFC 4616, section 4, without the authorization identity
+		{"tim", "tanstaaftanstaaf", "AHRpbQB0YW5zdGFhZnRhbnN0YWFm"},
+		{"dcrspy", "", "AGRjcnNweQA="},
+		{"", "", "AAA="},
+	}
+	for _, tt := range tests {
+		if got := xmppPlainAuth(tt.user, tt.password); got != tt.want {
+			t.Errorf("xmppPlainAuth(%q, %q) = %q, want %q", tt.user,
+				tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestXMPPMessages(t *testing.T) {
+	tests := []struct {
+		msgs, to []string
+		want     string
+	}{
+		{nil, []string{"op@example.com"}, ""},
+		{[]string{"Block 1"}, nil, ""},
+		{[]string{"Block 1"}, []string{"op@example.com"},
+			`<message type='chat' to='op@example.com'><body>Block 1</body>` +
+				`</message>`},
+		{[]string{"a", "b"}, []string{"x@e.com", "y@e.com"},
+			`<message type='chat' to='x@e.com'><body>a</body></message>` +
+				`<message type='chat' to='y@e.com'><body>a</body></message>` +
+				`<message type='chat' to='x@e.com'><body>b</body></message>` +
+				`<message type='chat' to='y@e.com'><body>b</body></message>`},
+		{[]string{`1 < 2 & "x"</body>`}, []string{`o'p@example.com`},
+			`<message type='chat' to='o&#39;p@example.com'><body>` +
+				`1 &lt; 2 &amp; &#34;x&#34;&lt;/body&gt;</body></message>`},
+	}
+	for _, tt := range tests {
+		if got := string(xmppMessages(tt.msgs, tt.to)); got != tt.want {
+			t.Errorf("xmppMessages(%q, %q) = %q, want %q", tt.msgs, tt.to,
+				got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// xpub.go watches the addresses of accounts given by their extended public
+// keys (xpubs), e.g. exported from a hardware wallet, without any wallet
+// software.  The used addresses of the account's external and internal
+// branches are discovered BIP44-style: addresses are derived in order and
+// looked up in dcrd's address index until a gap of unused addresses is found.
+// The used addresses and the gap are watched, so that new payments extend the
+// discovery, and the account balance is computed from the address history.
+
+package spy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrrpcclient"
+	"github.com/decred/dcrutil"
+	"github.com/decred/dcrutil/hdkeychain"
+)
+
+const (
+	// xpubGapLimit is the number of consecutive unused addresses after which
+	// discovery of a branch stops.
+	xpubGapLimit = 20
+	// xpubSyncInterval is the interval between discoveries of the addresses
+	// used since the last.
+	xpubSyncInterval = time.Minute
+)
+
+// Branches of a BIP44 account.
+const (
+	xpubExternalBranch = 0
+	xpubInternalBranch = 1
+)
+
+// xpubBranch is the external (receiving) or internal (change) branch of an
+// account.  addrs are the derived addresses, by index, with "" for an index
+// with an invalid key.  used is one more than the index of the last used
+// address.
+type xpubBranch struct {
+	key   *hdkeychain.ExtendedKey
+	addrs []string
+	used  int
+}
+
+// xpubAccount is an account given by its extended public key.
+type xpubAccount struct {
+	xpub     string
+	action   TxAction
+	branches [2]*xpubBranch
+}
+
+// parseXpubAccount parses XPUB[,POLICY], where POLICY is the notification
+// policy of watchaddress, and derives the account's branch keys.
+func parseXpubAccount(s string) (*xpubAccount, error) {
+	parts := strings.Split(s, ",")
+	acct := &xpubAccount{xpub: parts[0]}
+	if len(parts) > 1 && parts[1] != "" {
+		actn, err := parseTxAction(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		acct.action = actn
+	}
+
+	key, err := hdkeychain.NewKeyFromString(acct.xpub)
+	if err != nil {
+		return nil, err
+	}
+	if key.IsPrivate() {
+		return nil, fmt.Errorf("%s... is a private key, not an xpub",
+			acct.xpub[:4])
+	}
+	if !key.IsForNet(activeNet.Params) {
+		return nil, fmt.Errorf("%s is not for %s", acct.xpub,
+			activeNet.Params.Name)
+	}
+	for _, b := range []uint32{xpubExternalBranch, xpubInternalBranch} {
+		branchKey, err := key.Child(b)
+		if err != nil {
+			return nil, err
+		}
+		acct.branches[b] = &xpubBranch{key: branchKey}
+	}
+	return acct, nil
+}
+
+// derive derives the branch's address at the next index.
+func (b *xpubBranch) derive() (dcrutil.Address, error) {
+	child, err := b.key.Child(uint32(len(b.addrs)))
+	if err == hdkeychain.ErrInvalidChild {
+		b.addrs = append(b.addrs, "")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	addr, err := child.Address(activeNet.Params)
+	if err != nil {
+		return nil, err
+	}
+	b.addrs = append(b.addrs, addr.EncodeAddress())
+	return addr, nil
+}
+
+// xpubWatcher discovers and watches the addresses of xpub accounts.
+type xpubWatcher struct {
+	mtx      sync.Mutex
+	dcrd     *dcrrpcclient.Client
+	watched  *watchedAddresses
+	accounts []*xpubAccount
+}
+
+// spyXpubs is the package-level xpub watcher, nil if no xpubs are watched.
+var spyXpubs *xpubWatcher
+
+// newXpubWatcher creates an xpubWatcher for the xpubs, each given as
+// XPUB[,ACTION].
+func newXpubWatcher(dcrd *dcrrpcclient.Client, watched *watchedAddresses,
+	xpubs []string) (*xpubWatcher, error) {
+	x := &xpubWatcher{
+		dcrd:    dcrd,
+		watched: watched,
+	}
+	for _, s := range xpubs {
+		acct, err := parseXpubAccount(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid watchxpub: %v", err)
+		}
+		x.accounts = append(x.accounts, acct)
+	}
+	return x, nil
+}
+
+// addrUsed returns true if the address has transactions in dcrd's address
+// index, or recorded history.
+func (x *xpubWatcher) addrUsed(addr dcrutil.Address) (bool, error) {
+	if spyAddrHistory.used(addr.EncodeAddress()) {
+		return true, nil
+	}
+	_, err := x.dcrd.SearchRawTransactions(addr, 0, 1, false, nil)
+	if err != nil {
+		// dcrd returns an error for an address without transactions.
+		if strings.Contains(err.Error(), "No information") {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// discover extends each branch of the accounts until the last xpubGapLimit
+// derived addresses are unused, and watches the newly derived addresses,
+// adding them to dcrd's transaction filter and backfilling their history.
+// The gap of a branch that was already discovered is checked against the
+// address history, so only the addresses derived to extend it are looked up
+// in the address index.
+func (x *xpubWatcher) discover() error {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+
+	var added []dcrutil.Address
+	for _, acct := range x.accounts {
+		for _, b := range acct.branches {
+			for i := b.used; i < len(b.addrs); i++ {
+				if b.addrs[i] != "" && spyAddrHistory.used(b.addrs[i]) {
+					b.used = i + 1
+				}
+			}
+			for len(b.addrs) < b.used+xpubGapLimit {
+				addr, err := b.derive()
+				if err != nil {
+					return err
+				}
+				if addr == nil {
+					continue
+				}
+				used, err := x.addrUsed(addr)
+				if err != nil {
+					// Derive this address again on the next discovery.
+					b.addrs = b.addrs[:len(b.addrs)-1]
+					return err
+				}
+				if used {
+					b.used = len(b.addrs)
+				}
+				isNew, _ := x.watched.add(operatorOwner,
+					addr.EncodeAddress(), acct.action, 0)
+				if isNew {
+					added = append(added, addr)
+				}
+			}
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	if err := x.dcrd.LoadTxFilter(false, added, nil); err != nil {
+		return err
+	}
+	for _, addr := range added {
+		spyAddrHistory.requestBackfill(addr.EncodeAddress())
+	}
+	log.Infof("Watching %d new addresses of xpub accounts.", len(added))
+	return nil
+}
+
+// run discovers the addresses used since the last discovery every
+// xpubSyncInterval until quit is closed.  It should be run as a goroutine.
+func (x *xpubWatcher) run(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(xpubSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := x.discover(); err != nil {
+				log.Errorf("Failed to discover xpub account addresses: %v",
+					err)
+				spyRegistrationErrors.record("xpub accounts", "", err)
+			}
+		case <-quit:
+			log.Debugf("Quitting xpub watcher.")
+			return
+		}
+	}
+}
+
+// xpubBranchSummary summarizes a branch of an xpub account.
+type xpubBranchSummary struct {
+	Derived int `json:"derived"`
+	Used    int `json:"used"`
+}
+
+// xpubAccountSummary summarizes an xpub account.  The amounts are totals of
+// the history of the account's addresses.
+type xpubAccountSummary struct {
+	Xpub     string            `json:"xpub"`
+	External xpubBranchSummary `json:"external"`
+	Internal xpubBranchSummary `json:"internal"`
+	Used     []string          `json:"used"`
+	Received float64           `json:"received"`
+	Sent     float64           `json:"sent"`
+	Balance  float64           `json:"balance"`
+}
+
+// summaries returns the summaries of the accounts.
+func (x *xpubWatcher) summaries() []*xpubAccountSummary {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+
+	sums := make([]*xpubAccountSummary, 0, len(x.accounts))
+	for _, acct := range x.accounts {
+		sum := &xpubAccountSummary{
+			Xpub: acct.xpub,
+			External: xpubBranchSummary{
+				Derived: len(acct.branches[xpubExternalBranch].addrs),
+			},
+			Internal: xpubBranchSummary{
+				Derived: len(acct.branches[xpubInternalBranch].addrs),
+			},
+			Used: []string{},
+		}
+		for bi, b := range acct.branches {
+			var used int
+			for _, a := range b.addrs {
+				if a == "" || !spyAddrHistory.used(a) {
+					continue
+				}
+				used++
+				sum.Used = append(sum.Used, a)
+				received, sent := spyAddrHistory.totals(a)
+				sum.Received += received
+				sum.Sent += sent
+			}
+			if bi == xpubExternalBranch {
+				sum.External.Used = used
+			} else {
+				sum.Internal.Used = used
+			}
+		}
+		sum.Balance = sum.Received - sum.Sent
+		sums = append(sums, sum)
+	}
+	return sums
+}
+
+// xpubAPI documents xpubHandler.
+var xpubAPI = []apiOperation{{
+	method:   "GET",
+	summary:  "Get the summaries of the xpub accounts",
+	response: []*xpubAccountSummary{},
+}}
+
+// xpubHandler serves GET /xpub with the summaries of the xpub accounts.
+func (x *xpubWatcher) xpubHandler(w http.ResponseWriter, r *http.Request,
+	t *tenant) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if t != nil {
+		http.Error(w, "xpub accounts are not available to tenants",
+			http.StatusForbidden)
+		return
+	}
+	if x == nil {
+		http.Error(w, "no xpubs watched", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(x.summaries())
+}